@@ -0,0 +1,128 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/slicefunc"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/slicetype"
+	"github.com/grailbio/bigslice/typecheck"
+)
+
+type accumulateSlice struct {
+	name Name
+	Pragmas
+	Slice
+	init reflect.Value
+	fval slicefunc.Func
+	out  slicetype.Type
+}
+
+// Accumulate returns a slice that threads an accumulator through the
+// rows of each shard of the provided slice, in order, emitting one
+// output row per input row. This can be used to compute running
+// aggregates, such as cumulative sums or counts. The accumulator is
+// initialized to init at the beginning of each shard, and fn, which is
+// invoked for each row, returns the next accumulator value along with the
+// output row:
+//
+//	func(acc accType, col1 t1, col2 t2, ..., colN tn) (accType, out1 o1, ..., outM om)
+//
+// Accumulate is pipelined and operates on each shard independently:
+// rows are accumulated in the order in which they are read from the
+// shard, and the accumulator does not carry over shard boundaries. For
+// results to be meaningful, the user must thus arrange for each shard
+// to contain the relevant rows in the desired order; for example, by
+// using Reshuffle to partition rows by key, and sorting each shard
+// (e.g., with sortio.SortReader) before accumulating.
+//
+// The init value is shared by all shards processed in a process, so
+// reference types (e.g., maps or pointers) should not be mutated by fn.
+//
+// Schematically:
+//
+//	Accumulate(Slice<t1, ..., tn>, acc, func(acc, t1, ..., tn) (acc, o1, ..., om)) Slice<o1, ..., om>
+func Accumulate(slice Slice, init interface{}, fn interface{}, prags ...Pragma) Slice {
+	a := new(accumulateSlice)
+	a.name = MakeName("accumulate")
+	a.Slice = slice
+	a.Pragmas = prags
+	if init == nil {
+		typecheck.Panic(1, "accumulate: init must not be nil")
+	}
+	a.init = reflect.ValueOf(init)
+	accType := a.init.Type()
+	fval, ok := slicefunc.Of(fn)
+	if !ok {
+		typecheck.Panicf(1, "accumulate: invalid accumulate function %T", fn)
+	}
+	if !typecheck.CanApply(fval, slicetype.Append(slicetype.New(accType), slice)) {
+		typecheck.Panicf(1, "accumulate: function %T does not match accumulator type %s and input slice type %s",
+			fn, accType, slicetype.String(slice))
+	}
+	if fval.Out.NumOut() < 2 {
+		typecheck.Panicf(1, "accumulate: function %T must return the accumulator and at least one output column", fn)
+	}
+	if !fval.Out.Out(0).AssignableTo(accType) {
+		typecheck.Panicf(1, "accumulate: function %T returns accumulator of type %s, expected %s", fn, fval.Out.Out(0), accType)
+	}
+	a.fval = fval
+	a.out = slicetype.Slice(fval.Out, 1, fval.Out.NumOut())
+	return a
+}
+
+func (a *accumulateSlice) Name() Name             { return a.name }
+func (a *accumulateSlice) NumOut() int            { return a.out.NumOut() }
+func (a *accumulateSlice) Out(c int) reflect.Type { return a.out.Out(c) }
+func (a *accumulateSlice) Prefix() int            { return 1 }
+func (*accumulateSlice) ShardType() ShardType     { return HashShard }
+func (*accumulateSlice) NumDep() int              { return 1 }
+func (a *accumulateSlice) Dep(i int) Dep          { return singleDep(i, a.Slice, false) }
+func (*accumulateSlice) Combiner() slicefunc.Func { return slicefunc.Nil }
+
+type accumulateReader struct {
+	op     *accumulateSlice
+	reader sliceio.Reader
+	in     frame.Frame
+	acc    reflect.Value
+	err    error
+}
+
+func (a *accumulateReader) Read(ctx context.Context, out frame.Frame) (int, error) {
+	if a.err != nil {
+		return 0, a.err
+	}
+	if !slicetype.Assignable(out, a.op) {
+		return 0, errTypeError
+	}
+	n := out.Len()
+	if a.in.IsZero() {
+		a.in = frame.Make(a.op.Slice, n, n)
+	} else {
+		a.in = a.in.Ensure(n)
+	}
+	n, a.err = a.reader.Read(ctx, a.in.Slice(0, n))
+	args := make([]reflect.Value, 1+a.in.NumOut())
+	for i := 0; i < n; i++ {
+		args[0] = a.acc
+		for j := 1; j < len(args); j++ {
+			args[j] = a.in.Index(j-1, i)
+		}
+		result := a.op.fval.Call(ctx, args)
+		a.acc = result[0]
+		for j := 1; j < len(result); j++ {
+			out.Index(j-1, i).Set(result[j])
+		}
+	}
+	return n, a.err
+}
+
+func (a *accumulateSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	return &accumulateReader{op: a, reader: deps[0], acc: a.init}
+}
@@ -0,0 +1,74 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"testing"
+
+	"github.com/grailbio/bigslice"
+	"github.com/grailbio/bigslice/slicetest"
+)
+
+func TestAccumulate(t *testing.T) {
+	const N = 1000
+	ints := make([]int, N)
+	for i := range ints {
+		ints[i] = i
+	}
+	slice := bigslice.Const(1, ints)
+	slice = bigslice.Accumulate(slice, 0, func(sum, x int) (int, int, int) {
+		sum += x
+		return sum, x, sum
+	})
+	sums := make([]int, N)
+	for i := range sums {
+		sums[i] = i * (i + 1) / 2
+	}
+	assertEqual(t, slice, false, ints, sums)
+
+	// The accumulator is reset for each shard.
+	slice = bigslice.Const(2, []string{"a", "b", "c", "d", "e", "f", "g"})
+	slice = bigslice.Accumulate(slice, 0, func(count int, s string) (int, string, int) {
+		return count + 1, s, count
+	})
+	assertEqual(t, slice, true,
+		[]string{"a", "b", "c", "d", "e", "f", "g"},
+		[]int{0, 1, 2, 3, 0, 1, 2},
+	)
+}
+
+func TestAccumulateError(t *testing.T) {
+	input := bigslice.Const(1, []int{1, 2, 3})
+	expectTypeError(t, "accumulate: init must not be nil", func() {
+		bigslice.Accumulate(input, nil, func(acc, x int) (int, int) { return acc, x })
+	})
+	expectTypeError(t, "accumulate: function func(string, int) (string, int) does not match accumulator type int and input slice type slice[1]int", func() {
+		bigslice.Accumulate(input, 0, func(acc string, x int) (string, int) { return acc, x })
+	})
+	expectTypeError(t, "accumulate: function func(int, int) int must return the accumulator and at least one output column", func() {
+		bigslice.Accumulate(input, 0, func(acc, x int) int { return acc })
+	})
+	expectTypeError(t, "accumulate: function func(int, int) (string, int) returns accumulator of type string, expected int", func() {
+		bigslice.Accumulate(input, 0, func(acc, x int) (string, int) { return "", x })
+	})
+}
+
+func ExampleAccumulate() {
+	slice := bigslice.Const(1,
+		[]int{1, 2, 3, 4},
+		[]float64{10, 5, 2.5, 20},
+	)
+	// Compute the running total of revenue by timestamp.
+	slice = bigslice.Accumulate(slice, 0.0, func(total float64, ts int, revenue float64) (float64, int, float64) {
+		total += revenue
+		return total, ts, total
+	})
+	slicetest.Print(slice)
+	// Output:
+	// 1 10
+	// 2 15
+	// 3 17.5
+	// 4 37.5
+}
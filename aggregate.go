@@ -0,0 +1,345 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/slicefunc"
+	"github.com/grailbio/bigslice/slicetype"
+	"github.com/grailbio/bigslice/typecheck"
+)
+
+// An Aggregation is a named aggregation of the values of a column,
+// computed for each key by Aggregate. Aggregations are constructed by
+// Sum, Count, Min, Max, and Custom.
+type Aggregation struct {
+	name string
+	// col is the aggregated column, unless the aggregation counts
+	// rows.
+	col   int
+	count bool
+	// bind returns the function that merges two aggregated values of
+	// the provided type, or an error if values of the type cannot be
+	// aggregated.
+	bind func(typ reflect.Type) (merge func(x, y reflect.Value) reflect.Value, err error)
+}
+
+// Name returns the aggregation's name.
+func (a Aggregation) Name() string { return a.name }
+
+// Sum returns an Aggregation, named name, that sums the values of
+// column col, which must be of a numeric type.
+func Sum(name string, col int) Aggregation {
+	return Aggregation{name, col, false, func(typ reflect.Type) (func(x, y reflect.Value) reflect.Value, error) {
+		var add func(x, y, z reflect.Value)
+		switch typ.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			add = func(x, y, z reflect.Value) { z.SetInt(x.Int() + y.Int()) }
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			add = func(x, y, z reflect.Value) { z.SetUint(x.Uint() + y.Uint()) }
+		case reflect.Float32, reflect.Float64:
+			add = func(x, y, z reflect.Value) { z.SetFloat(x.Float() + y.Float()) }
+		case reflect.Complex64, reflect.Complex128:
+			add = func(x, y, z reflect.Value) { z.SetComplex(x.Complex() + y.Complex()) }
+		default:
+			return nil, fmt.Errorf("cannot sum values of type %s", typ)
+		}
+		return func(x, y reflect.Value) reflect.Value {
+			z := reflect.New(typ).Elem()
+			add(x, y, z)
+			return z
+		}, nil
+	}}
+}
+
+// Count returns an Aggregation, named name, that counts the rows of
+// each key. Counts are of type int64.
+func Count(name string) Aggregation {
+	return Aggregation{name, 0, true, func(reflect.Type) (func(x, y reflect.Value) reflect.Value, error) {
+		return func(x, y reflect.Value) reflect.Value {
+			return reflect.ValueOf(x.Int() + y.Int())
+		}, nil
+	}}
+}
+
+// Min returns an Aggregation, named name, that computes the minimum
+// of the values of column col, which must be of a numeric or string
+// type.
+func Min(name string, col int) Aggregation {
+	return Aggregation{name, col, false, func(typ reflect.Type) (func(x, y reflect.Value) reflect.Value, error) {
+		less, err := lessFunc(typ)
+		if err != nil {
+			return nil, err
+		}
+		return func(x, y reflect.Value) reflect.Value {
+			if less(y, x) {
+				return y
+			}
+			return x
+		}, nil
+	}}
+}
+
+// Max returns an Aggregation, named name, that computes the maximum
+// of the values of column col, which must be of a numeric or string
+// type.
+func Max(name string, col int) Aggregation {
+	return Aggregation{name, col, false, func(typ reflect.Type) (func(x, y reflect.Value) reflect.Value, error) {
+		less, err := lessFunc(typ)
+		if err != nil {
+			return nil, err
+		}
+		return func(x, y reflect.Value) reflect.Value {
+			if less(x, y) {
+				return y
+			}
+			return x
+		}, nil
+	}}
+}
+
+// Custom returns an Aggregation, named name, that aggregates the
+// values of column col, of type t, with the provided merge function,
+// of the form func(t, t) t. Like reducers, the merge function must be
+// commutative and associative, as values are merged in arbitrary order
+// and are combined map-side.
+func Custom(name string, col int, merge interface{}) Aggregation {
+	fn := reflect.ValueOf(merge)
+	return Aggregation{name, col, false, func(typ reflect.Type) (func(x, y reflect.Value) reflect.Value, error) {
+		if fn.Kind() != reflect.Func || fn.Type().NumIn() != 2 || fn.Type().In(0) != typ || fn.Type().In(1) != typ ||
+			fn.Type().NumOut() != 1 || fn.Type().Out(0) != typ {
+			return nil, fmt.Errorf("invalid merge function %T, expected func(%s, %s) %s", merge, typ, typ, typ)
+		}
+		return func(x, y reflect.Value) reflect.Value {
+			return fn.Call([]reflect.Value{x, y})[0]
+		}, nil
+	}}
+}
+
+// lessFunc returns a function that compares values of the provided
+// ordered type.
+func lessFunc(typ reflect.Type) (func(x, y reflect.Value) bool, error) {
+	switch typ.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return func(x, y reflect.Value) bool { return x.Int() < y.Int() }, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return func(x, y reflect.Value) bool { return x.Uint() < y.Uint() }, nil
+	case reflect.Float32, reflect.Float64:
+		return func(x, y reflect.Value) bool { return x.Float() < y.Float() }, nil
+	case reflect.String:
+		return func(x, y reflect.Value) bool { return x.String() < y.String() }, nil
+	}
+	return nil, fmt.Errorf("cannot compare values of type %s", typ)
+}
+
+// Aggregate returns a slice that computes the provided aggregations
+// over the rows of each key of the provided slice. The key comprises
+// the columns with the provided indices, in order, or, if keyCols is
+// empty, the slice's prefix columns. The returned slice has the key
+// columns as its prefix, followed by a column for each aggregation, in
+// order. Schematically:
+//
+//	Aggregate(Slice<k, v1, v2>, []int{0}, Sum("sum", 1), Count("n"), Max("max", 2)) Slice<k, v1, int64, v2>
+//
+// Aggregate computes all of the aggregations in a single shuffle: the
+// aggregated values of each row are packed into a composite
+// accumulator, which is combined map-side, like Reduce, by merging
+// each of its aggregations in turn. Accumulators are shuffled
+// column-wise, so that the aggregations of builtin types are encoded
+// in compact binary form.
+//
+// Like Reduce, Aggregate maintains the working set of keys in memory.
+func Aggregate(slice Slice, keyCols []int, aggs ...Aggregation) Slice {
+	if len(keyCols) == 0 {
+		keyCols = make([]int, slice.Prefix())
+		for i := range keyCols {
+			keyCols[i] = i
+		}
+	}
+	if len(aggs) == 0 {
+		typecheck.Panic(1, "aggregate: no aggregations")
+	}
+	var (
+		seen  = make(map[int]bool)
+		keys  = make([]reflect.Type, len(keyCols))
+		types = make([]reflect.Type, len(aggs))
+		merge = make([]func(x, y reflect.Value) reflect.Value, len(aggs))
+	)
+	for i, col := range keyCols {
+		if col < 0 || col >= slice.NumOut() {
+			typecheck.Panicf(1, "aggregate: key column %d out of range for slice %s", col, slicetype.String(slice))
+		}
+		if seen[col] {
+			typecheck.Panicf(1, "aggregate: duplicate key column %d", col)
+		}
+		seen[col] = true
+		keys[i] = slice.Out(col)
+	}
+	names := make(map[string]bool)
+	for i, agg := range aggs {
+		if agg.bind == nil || agg.name == "" {
+			typecheck.Panicf(1, "aggregate: aggregation %d is unnamed", i)
+		}
+		if names[agg.name] {
+			typecheck.Panicf(1, "aggregate: duplicate aggregation %s", agg.name)
+		}
+		names[agg.name] = true
+		switch {
+		case agg.count:
+			types[i] = typeOfCount
+		case agg.col < 0 || agg.col >= slice.NumOut():
+			typecheck.Panicf(1, "aggregate: %s: column %d out of range for slice %s", agg.name, agg.col, slicetype.String(slice))
+		default:
+			types[i] = slice.Out(agg.col)
+		}
+		var err error
+		if merge[i], err = agg.bind(types[i]); err != nil {
+			typecheck.Panicf(1, "aggregate: %s: %v", agg.name, err)
+		}
+	}
+	var (
+		accType  = accumulatorType(types)
+		valsType = prefixedType{slicetype.New(append(keys, accType)...), len(keys)}
+		outType  = prefixedType{slicetype.New(append(keys, types...)...), len(keys)}
+	)
+	if err := canMakeCombiningFrame(valsType); err != nil {
+		typecheck.Panic(1, err.Error())
+	}
+	vals := &mapFrameSlice{MakeName("aggregate_values"), Pragmas(nil), slice, valsType, func(in frame.Frame) frame.Frame {
+		out := frame.Make(valsType, in.Len(), in.Len())
+		for i, col := range keyCols {
+			reflect.Copy(out.Value(i), in.Value(col))
+		}
+		accs := out.Value(len(keyCols))
+		for i := 0; i < in.Len(); i++ {
+			acc := accs.Index(i)
+			for j, agg := range aggs {
+				if agg.count {
+					acc.Field(j).SetInt(1)
+				} else {
+					acc.Field(j).Set(in.Index(agg.col, i))
+				}
+			}
+		}
+		return out
+	}}
+	combine := reflect.MakeFunc(reflect.FuncOf([]reflect.Type{accType, accType}, []reflect.Type{accType}, false),
+		func(args []reflect.Value) []reflect.Value {
+			acc := reflect.New(accType).Elem()
+			for i := range merge {
+				acc.Field(i).Set(merge[i](args[0].Field(i), args[1].Field(i)))
+			}
+			return []reflect.Value{acc}
+		})
+	combiner, _ := slicefunc.Of(combine.Interface())
+	reduced := &reduceSlice{vals, MakeName("aggregate_reduce"), combiner}
+	return &mapFrameSlice{MakeName("aggregate"), Pragmas(nil), reduced, outType, func(in frame.Frame) frame.Frame {
+		out := frame.Make(outType, in.Len(), in.Len())
+		for i := range keyCols {
+			reflect.Copy(out.Value(i), in.Value(i))
+		}
+		accs := in.Value(len(keyCols))
+		for j := range aggs {
+			col := out.Value(len(keyCols) + j)
+			for i := 0; i < in.Len(); i++ {
+				col.Index(i).Set(accs.Index(i).Field(j))
+			}
+		}
+		return out
+	}}
+}
+
+var typeOfCount = reflect.TypeOf(int64(0))
+
+var (
+	accumulatorsMu sync.Mutex
+	accumulators   = make(map[reflect.Type]bool)
+)
+
+// accumulatorType returns the type of the composite accumulator of
+// aggregations whose values have the provided types: a struct with a
+// field for each aggregation. The frame ops of the type encode
+// accumulators column-wise, so that each field is encoded using the
+// codec of its type, if it has one. Accumulator types are generated
+// when slices are constructed, which may be while jobs are running
+// (e.g., on workers), and so their ops are registered with
+// frame.RegisterGeneratedOps.
+func accumulatorType(types []reflect.Type) reflect.Type {
+	fields := make([]reflect.StructField, len(types))
+	for i, typ := range types {
+		fields[i] = reflect.StructField{Name: fmt.Sprintf("A%d", i), Type: typ}
+	}
+	typ := reflect.StructOf(fields)
+	accumulatorsMu.Lock()
+	defer accumulatorsMu.Unlock()
+	if accumulators[typ] {
+		return typ
+	}
+	var (
+		colsType = slicetype.New(types...)
+		makeOps  = reflect.FuncOf([]reflect.Type{reflect.SliceOf(typ)}, []reflect.Type{reflect.TypeOf(frame.Ops{})}, false)
+	)
+	frame.RegisterGeneratedOps(reflect.MakeFunc(makeOps, func(args []reflect.Value) []reflect.Value {
+		vec := args[0]
+		ops := frame.Ops{
+			Encode: func(enc frame.Encoder, i, j int) error {
+				cols := frame.Make(colsType, j-i, j-i)
+				for col := range types {
+					v := cols.Value(col)
+					for k := i; k < j; k++ {
+						v.Index(k - i).Set(vec.Index(k).Field(col))
+					}
+				}
+				for col := range types {
+					var err error
+					if cols.HasCodec(col) {
+						err = cols.Encode(col, enc)
+					} else {
+						err = enc.Encode(cols.Interface(col))
+					}
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			Decode: func(dec frame.Decoder, i, j int) error {
+				cols := frame.Make(colsType, j-i, j-i)
+				for col := range types {
+					if cols.HasCodec(col) {
+						if err := cols.Decode(col, dec); err != nil {
+							return err
+						}
+						continue
+					}
+					p := reflect.New(reflect.SliceOf(types[col]))
+					if err := dec.Decode(p.Interface()); err != nil {
+						return err
+					}
+					if n := p.Elem().Len(); n != j-i {
+						return errors.E(errors.Integrity,
+							fmt.Sprintf("accumulator codec: decoded %d values, expected %d", n, j-i))
+					}
+					reflect.Copy(cols.Value(col), p.Elem())
+				}
+				for col := range types {
+					v := cols.Value(col)
+					for k := i; k < j; k++ {
+						vec.Index(k).Field(col).Set(v.Index(k - i))
+					}
+				}
+				return nil
+			},
+		}
+		return []reflect.Value{reflect.ValueOf(ops)}
+	}).Interface())
+	accumulators[typ] = true
+	return typ
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/grailbio/bigslice"
+)
+
+func TestAggregate(t *testing.T) {
+	const N = 1000
+	var (
+		keys   = make([]string, N)
+		ints   = make([]int, N)
+		floats = make([]float64, N)
+		words  = make([]string, N)
+	)
+	for i := range keys {
+		keys[i] = fmt.Sprint(i % 3)
+		ints[i] = i
+		floats[i] = float64(N - i)
+		words[i] = fmt.Sprint(i % 7)
+	}
+	for nshard := 1; nshard < 5; nshard++ {
+		slice := bigslice.Const(nshard, keys, ints, floats, words)
+		slice = bigslice.Aggregate(slice, nil,
+			bigslice.Sum("sum", 1),
+			bigslice.Count("n"),
+			bigslice.Min("min", 2),
+			bigslice.Max("max", 1),
+			bigslice.Max("maxword", 3),
+			bigslice.Custom("concat", 3, func(a, b string) string {
+				// Keep the longer string, so that the result is
+				// independent of the order of merges.
+				if len(a) > len(b) || len(a) == len(b) && a > b {
+					return a
+				}
+				return b
+			}),
+		)
+		assertEqual(t, slice, true,
+			[]string{"0", "1", "2"},
+			[]int{166833, 166167, 166500},
+			[]int64{334, 333, 333},
+			[]float64{1, 3, 2},
+			[]int{999, 997, 998},
+			[]string{"6", "6", "6"},
+			[]string{"6", "6", "6"},
+		)
+	}
+}
+
+func TestAggregateKeys(t *testing.T) {
+	slice := bigslice.Const(2,
+		[]int{1, 2, 1, 2, 1},
+		[]string{"a", "b", "a", "a", "b"},
+		[]int{1, 2, 3, 4, 5},
+	)
+	slice = bigslice.Aggregate(slice, []int{1, 0}, bigslice.Sum("sum", 2), bigslice.Count("n"))
+	if got, want := slice.Prefix(), 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	assertEqual(t, slice, true,
+		[]string{"a", "a", "b", "b"},
+		[]int{1, 2, 1, 2},
+		[]int{4, 4, 5, 2},
+		[]int64{2, 1, 1, 1},
+	)
+}
+
+func TestAggregateError(t *testing.T) {
+	var (
+		slice = bigslice.Const(1, []string{"a"}, []string{"b"})
+		merge = func(a, b int) int { return a + b }
+	)
+	expectTypeError(t, "aggregate: no aggregations", func() { bigslice.Aggregate(slice, nil) })
+	expectTypeError(t, "aggregate: sum: cannot sum values of type string", func() { bigslice.Aggregate(slice, nil, bigslice.Sum("sum", 1)) })
+	expectTypeError(t, "aggregate: duplicate aggregation n", func() { bigslice.Aggregate(slice, nil, bigslice.Count("n"), bigslice.Count("n")) })
+	expectTypeError(t, "aggregate: max: column 2 out of range for slice slice[1]string,string", func() { bigslice.Aggregate(slice, nil, bigslice.Max("max", 2)) })
+	expectTypeError(t, "aggregate: custom: invalid merge function func(int, int) int, expected func(string, string) string", func() { bigslice.Aggregate(slice, nil, bigslice.Custom("custom", 1, merge)) })
+	expectTypeError(t, "aggregate: key column 3 out of range for slice slice[1]string,string", func() { bigslice.Aggregate(slice, []int{3}, bigslice.Count("n")) })
+}
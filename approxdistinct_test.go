@@ -0,0 +1,87 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/grailbio/bigslice"
+	"github.com/grailbio/bigslice/hll"
+)
+
+func TestApproxCountDistinct(t *testing.T) {
+	const N = 20000
+	ints := make([]int, N)
+	for i := range ints {
+		ints[i] = i
+	}
+	// Key "a" has N/2 distinct values; "b" has 5, each repeated.
+	slice := bigslice.Const(4, ints)
+	slice = bigslice.Map(slice, func(i int) (string, int, string) {
+		if i%2 == 0 {
+			return "a", i, "x"
+		}
+		return "b", i % 10, "y"
+	})
+	for _, precision := range []int{hll.MinPrecision, hll.DefaultPrecision} {
+		count := bigslice.ApproxCountDistinct(slice, precision)
+		if got, want := count.Name().Op, "approxcountdistinct"; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if got, want := count.Prefix(), 1; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		stderr := 1.04 / math.Sqrt(float64(int(1)<<uint(precision)))
+		ctx := context.Background()
+		for name, scanner := range run(ctx, t, count) {
+			var (
+				key   string
+				count int64
+				nkey  int
+			)
+			for scanner.Scan(ctx, &key, &count) {
+				nkey++
+				want := 5.0
+				if key == "a" {
+					want = N / 2
+				}
+				if got := float64(count); math.Abs(got-want) > 4*stderr*want+0.5 {
+					t.Errorf("%s: precision %d: key %s: got %v, want %v±%.1f%%", name, precision, key, got, want, 400*stderr)
+				}
+			}
+			if err := scanner.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := nkey, 2; got != want {
+				t.Errorf("%s: got %v, want %v", name, got, want)
+			}
+		}
+	}
+
+	// Count a subset of value columns.
+	count := bigslice.ApproxCountDistinct(slice, hll.DefaultPrecision, 2)
+	assertEqual(t, count, true, []string{"a", "b"}, []int64{1, 1})
+}
+
+func TestApproxCountDistinctError(t *testing.T) {
+	slice := bigslice.Const(1, []int{1}, []func(){func() {}})
+	expectTypeError(t, "approxcountdistinct: invalid precision 30", func() {
+		bigslice.ApproxCountDistinct(slice, 30)
+	})
+	expectTypeError(t, "approxcountdistinct: value column 2 out of range for slice slice[1]int,func()", func() {
+		bigslice.ApproxCountDistinct(slice, hll.DefaultPrecision, 2)
+	})
+	expectTypeError(t, "approxcountdistinct: duplicate value column 0", func() {
+		bigslice.ApproxCountDistinct(slice, hll.DefaultPrecision, 0, 0)
+	})
+	expectTypeError(t, "approxcountdistinct: cannot hash values of type func()", func() {
+		bigslice.ApproxCountDistinct(slice, hll.DefaultPrecision)
+	})
+	expectTypeError(t, "approxcountdistinct: slice slice[1]int has no value columns", func() {
+		bigslice.ApproxCountDistinct(bigslice.Const(1, []int{1}), hll.DefaultPrecision)
+	})
+}
@@ -0,0 +1,183 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package bloom implements Bloom filters over the keys of Bigslice
+// frames. Bloom filters are used to prune rows of the larger side of a
+// join (e.g., a Cogroup) whose keys cannot match any key of the
+// smaller side, before the larger side is shuffled. A filter may
+// report false positives, but never false negatives: pruning with a
+// filter never removes a row with a matching key.
+//
+// Keys are the prefix columns of a frame, and are hashed with the
+// frame's hash functions, so that filters are consistent across
+// processes. Filters are gob-encodable, so that they may be passed as
+// arguments to bigslice.Funcs and thus broadcast to workers.
+package bloom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/slicetype"
+)
+
+// Seeds used to derive the two base hashes of each key. Probes are
+// computed by double hashing.
+const (
+	seed1 = 0x9747b28c
+	seed2 = 0x85ebca6b
+)
+
+// minBits is the minimum size of a filter. Very small filters perform
+// poorly with double hashing, as probes of a key collide frequently.
+const minBits = 1024
+
+// A Filter is a Bloom filter over frame keys.
+type Filter struct {
+	// keyTypes describes the key types of the filter, and is used to
+	// check that filters are applied to compatible keys.
+	keyTypes string
+	// k is the number of probes per key.
+	k    uint32
+	bits []uint64
+}
+
+// New returns a new filter for keys of the provided type (i.e., the
+// types of its prefix columns) sized to hold n keys with the provided
+// false positive rate, which must be in (0, 1).
+func New(typ slicetype.Type, n int, fpRate float64) *Filter {
+	if fpRate <= 0 || fpRate >= 1 {
+		panic(fmt.Sprintf("bloom.New: invalid false positive rate %v", fpRate))
+	}
+	if n < 1 {
+		n = 1
+	}
+	m := math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2))
+	k := math.Round(m / float64(n) * math.Ln2)
+	if k < 1 {
+		k = 1
+	}
+	if m < minBits {
+		m = minBits
+	}
+	return &Filter{
+		keyTypes: KeyTypes(typ),
+		k:        uint32(k),
+		bits:     make([]uint64, (int(m)+63)/64),
+	}
+}
+
+// KeyTypes returns a string describing the key types of typ; filters
+// may be applied only to frames with equal key types.
+func KeyTypes(typ slicetype.Type) string {
+	types := make([]reflect.Type, typ.Prefix())
+	for i := range types {
+		types[i] = typ.Out(i)
+	}
+	return slicetype.String(slicetype.New(types...))
+}
+
+// Hash returns the base hashes of the key of the i'th row of f. Hashes
+// may be computed once and then used to Insert keys into a filter by
+// InsertHash once its size is known.
+func Hash(f frame.Frame, i int) (h1, h2 uint32) {
+	return f.HashWithSeed(i, seed1), f.HashWithSeed(i, seed2)
+}
+
+// Insert adds the key of the i'th row of f to the filter.
+func (b *Filter) Insert(f frame.Frame, i int) {
+	b.InsertHash(Hash(f, i))
+}
+
+// InsertHash adds the key with the provided base hashes, as computed
+// by Hash, to the filter.
+func (b *Filter) InsertHash(h1, h2 uint32) {
+	m := uint64(len(b.bits)) * 64
+	for i := uint32(0); i < b.k; i++ {
+		p := (uint64(h1) + uint64(i)*uint64(h2)) % m
+		b.bits[p/64] |= 1 << (p % 64)
+	}
+}
+
+// Test tells whether the key of the i'th row of f may be in the
+// filter. If Test returns false, the key was never inserted.
+func (b *Filter) Test(f frame.Frame, i int) bool {
+	h1, h2 := Hash(f, i)
+	m := uint64(len(b.bits)) * 64
+	for i := uint32(0); i < b.k; i++ {
+		p := (uint64(h1) + uint64(i)*uint64(h2)) % m
+		if b.bits[p/64]&(1<<(p%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Compatible tells whether the filter may be applied to the keys of
+// typ.
+func (b *Filter) Compatible(typ slicetype.Type) bool {
+	return b.keyTypes == KeyTypes(typ)
+}
+
+// Size returns the size of the filter, in bits.
+func (b *Filter) Size() int { return len(b.bits) * 64 }
+
+// GobEncode implements gob.GobEncoder.
+func (b *Filter) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	writeUvarint(&buf, uint64(len(b.keyTypes)))
+	buf.WriteString(b.keyTypes)
+	writeUvarint(&buf, uint64(b.k))
+	writeUvarint(&buf, uint64(len(b.bits)))
+	var word [8]byte
+	for _, w := range b.bits {
+		binary.LittleEndian.PutUint64(word[:], w)
+		buf.Write(word[:])
+	}
+	return buf.Bytes(), nil
+}
+
+var errCorrupt = errors.New("bloom: corrupt filter encoding")
+
+// GobDecode implements gob.GobDecoder.
+func (b *Filter) GobDecode(p []byte) error {
+	r := bytes.NewReader(p)
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > uint64(r.Len()) {
+		return errCorrupt
+	}
+	keyTypes := make([]byte, n)
+	if _, err = r.Read(keyTypes); err != nil && n > 0 {
+		return errCorrupt
+	}
+	k, err := binary.ReadUvarint(r)
+	if err != nil {
+		return errCorrupt
+	}
+	nbits, err := binary.ReadUvarint(r)
+	if err != nil || nbits*8 != uint64(r.Len()) {
+		return errCorrupt
+	}
+	b.keyTypes = string(keyTypes)
+	b.k = uint32(k)
+	b.bits = make([]uint64, nbits)
+	var word [8]byte
+	for i := range b.bits {
+		if _, err := r.Read(word[:]); err != nil {
+			return errCorrupt
+		}
+		b.bits[i] = binary.LittleEndian.Uint64(word[:])
+	}
+	return nil
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	var p [binary.MaxVarintLen64]byte
+	buf.Write(p[:binary.PutUvarint(p[:], v)])
+}
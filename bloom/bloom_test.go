@@ -0,0 +1,89 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bloom
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"testing"
+
+	"github.com/grailbio/bigslice/frame"
+)
+
+func TestFilter(t *testing.T) {
+	const N = 10000
+	keys := make([]string, 2*N)
+	for i := range keys {
+		keys[i] = fmt.Sprint("key", i)
+	}
+	f := frame.Slices(keys)
+	for _, fpRate := range []float64{0.1, 0.01, 0.001} {
+		filter := New(f, N, fpRate)
+		for i := 0; i < N; i++ {
+			filter.Insert(f, i)
+		}
+		for i := 0; i < N; i++ {
+			if !filter.Test(f, i) {
+				t.Fatalf("false negative for key %s", keys[i])
+			}
+		}
+		var fp int
+		for i := N; i < 2*N; i++ {
+			if filter.Test(f, i) {
+				fp++
+			}
+		}
+		if got, max := float64(fp)/N, 2*fpRate; got > max {
+			t.Errorf("fpRate=%v: got false positive rate %v, want <= %v", fpRate, got, max)
+		}
+	}
+}
+
+func TestFilterCompatible(t *testing.T) {
+	var (
+		ints    = frame.Slices([]int{1}, []string{"a"})
+		strings = frame.Slices([]string{"a"}, []int{1})
+		filter  = New(ints, 1, 0.01)
+	)
+	if !filter.Compatible(ints) {
+		t.Error("expected compatible")
+	}
+	if filter.Compatible(strings) {
+		t.Error("expected incompatible")
+	}
+	if !filter.Compatible(frame.Slices([]int{1})) {
+		t.Error("expected compatible; only keys are considered")
+	}
+}
+
+func TestGob(t *testing.T) {
+	f := frame.Slices([]int{1, 2, 3, 4})
+	filter := New(f, 2, 0.01)
+	filter.Insert(f, 0)
+	filter.Insert(f, 2)
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(filter); err != nil {
+		t.Fatal(err)
+	}
+	var decoded *Filter
+	if err := gob.NewDecoder(&b).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := decoded.Size(), filter.Size(); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if !decoded.Compatible(f) {
+		t.Error("expected compatible")
+	}
+	for i := 0; i < f.Len(); i++ {
+		if got, want := decoded.Test(f, i), filter.Test(f, i); got != want {
+			t.Errorf("row %d: got %v, want %v", i, got, want)
+		}
+	}
+	if err := decoded.GobDecode([]byte{1, 2, 3}); err == nil {
+		t.Error("expected error")
+	}
+}
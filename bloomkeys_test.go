@@ -0,0 +1,76 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/sliceio"
+)
+
+// readAll reads all of the rows of the provided reader into a frame of
+// the provided type.
+func readAll(ctx context.Context, t *testing.T, typ Slice, r sliceio.Reader) frame.Frame {
+	t.Helper()
+	var (
+		all = frame.Make(typ, 0, 0)
+		buf = frame.Make(typ, 3, 3)
+	)
+	for {
+		n, err := r.Read(ctx, buf)
+		all = frame.AppendFrame(all, buf.Slice(0, n))
+		if err == sliceio.EOF {
+			return all
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFilterKeysBy(t *testing.T) {
+	const N = 1000
+	ctx := context.Background()
+	keys := make([]int, N)
+	for i := range keys {
+		keys[i] = i
+	}
+	var (
+		large = Const(1, keys)
+		small = Const(2, []int{3, 500, 3, 999})
+	)
+	for _, test := range []struct {
+		maxKeys int
+		want    []int
+	}{
+		{3, []int{3, 500, 999}},
+		// With too many keys, no filter is built and every row is
+		// retained.
+		{2, keys},
+	} {
+		filter := filterKeysBy(MakeName("test"), large, small, 0.0001, test.maxKeys).(*filterKeysSlice)
+		// Collect the keys of each shard of small, as the pre-pass does,
+		// and broadcast them unreduced: the filter merges them.
+		bloomKeys := filter.keys.Dep(0).Slice
+		shards := frame.Make(bloomKeys, 0, 0)
+		for shard := 0; shard < small.NumShard(); shard++ {
+			r := bloomKeys.Reader(shard, []sliceio.Reader{small.Reader(shard, nil)})
+			shards = frame.AppendFrame(shards, readAll(ctx, t, bloomKeys, r))
+		}
+		out := readAll(ctx, t, filter, filter.Reader(0, []sliceio.Reader{
+			large.Reader(0, nil),
+			sliceio.FrameReader(shards),
+		}))
+		got := out.Interface(0).([]int)
+		sort.Ints(got)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("maxKeys %d: got %v, want %v", test.maxKeys, got, test.want)
+		}
+	}
+}
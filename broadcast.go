@@ -0,0 +1,217 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/slicefunc"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/slicetype"
+	"github.com/grailbio/bigslice/typecheck"
+)
+
+type broadcastSlice struct {
+	name    Name
+	nshard  int
+	maxRows int
+	Slice
+}
+
+// Broadcast returns a slice with nshard shards, each of which contains
+// all of the rows of the provided slice. Broadcast is a shuffle: the
+// output of each shard of the provided slice is read in full by every
+// shard of the returned slice, instead of being partitioned among
+// them.
+//
+// Broadcast is intended for small, global aggregates that are needed
+// by every shard of a computation (e.g., global statistics). For
+// example, the partials of a Reduce may be broadcast so that each
+// shard of a downstream computation sees the reduced value for every
+// key, and can compute the same global result, or its own share of it.
+//
+// Since the data are duplicated across every consumer shard, the
+// number of rows that each shard may receive is bounded by maxRows:
+// reading more than maxRows rows from a broadcast shard fails the
+// computation with a fatal (non-retriable) error.
+func Broadcast(slice Slice, nshard, maxRows int) Slice {
+	if nshard < 1 {
+		typecheck.Panicf(1, "broadcast: invalid number of shards %d", nshard)
+	}
+	if maxRows < 1 {
+		typecheck.Panicf(1, "broadcast: invalid row limit %d", maxRows)
+	}
+	return &broadcastSlice{MakeName("broadcast"), nshard, maxRows, slice}
+}
+
+func (b *broadcastSlice) Name() Name             { return b.name }
+func (*broadcastSlice) NumDep() int              { return 1 }
+func (b *broadcastSlice) NumShard() int          { return b.nshard }
+func (*broadcastSlice) ShardType() ShardType     { return HashShard }
+func (b *broadcastSlice) Dep(i int) Dep          { return Dep{Slice: b.Slice, Shuffle: true, Broadcast: true} }
+func (*broadcastSlice) Combiner() slicefunc.Func { return slicefunc.Nil }
+
+func (b *broadcastSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	if len(deps) != 1 {
+		panic(fmt.Errorf("expected one dep, got %d", len(deps)))
+	}
+	return &broadcastReader{name: b.name, maxRows: b.maxRows, reader: deps[0]}
+}
+
+// broadcastReader reads a broadcast dependency, failing once more than
+// maxRows rows have been read.
+type broadcastReader struct {
+	name    Name
+	maxRows int
+	reader  sliceio.Reader
+	n       int
+}
+
+func (b *broadcastReader) Read(ctx context.Context, out frame.Frame) (int, error) {
+	n, err := b.reader.Read(ctx, out)
+	b.n += n
+	if b.n > b.maxRows {
+		return 0, errors.E(errors.Fatal, errors.Invalid,
+			fmt.Sprintf("%s: broadcast exceeds limit of %d rows per shard", b.name, b.maxRows))
+	}
+	return n, err
+}
+
+type mapBroadcastSlice struct {
+	*mapSlice
+	agg     Slice
+	maxRows int
+}
+
+// MapWithBroadcast is a variant of Map whose function additionally
+// receives the full contents of the (small) slice agg, typically a
+// global aggregate of slice, e.g., the mean and standard deviation of
+// a feature, used to normalize each of slice's rows. Each column of agg
+// is passed to fn as a slice, ahead of the columns of the mapped row.
+// Schematically:
+//
+//	MapWithBroadcast(Slice<t1, ..., tn>, Slice<u1, ..., um>, maxRows, func(a1 []u1, ..., am []um, v1 t1, ..., vn tn) (r1, ..., rk)) Slice<r1, ..., rk>
+//
+// MapWithBroadcast is computed in two stages within a single
+// invocation: agg is first computed in full, and its output is then
+// broadcast (as with Broadcast) to every shard of the map, which reads
+// all of agg's rows before it maps its first row. Because the map
+// depends on both slices, it is not pipelined with slice: slice's
+// shards are computed by their own tasks, and each is read by the
+// corresponding shard of the map. The order of agg's rows is not
+// defined. For example:
+//
+//	type stats struct {
+//		Sum   float64
+//		Count int
+//	}
+//	// agg has a single row: the sum and count of all values.
+//	agg := bigslice.Map(values, func(v float64) (int, stats) { return 0, stats{v, 1} })
+//	agg = bigslice.Reduce(agg, func(a, e stats) stats { return stats{a.Sum + e.Sum, a.Count + e.Count} })
+//	centered := bigslice.MapWithBroadcast(values, agg, 1,
+//		func(_ []int, s []stats, v float64) float64 {
+//			return v - s[0].Sum/float64(s[0].Count)
+//		})
+//
+// Since agg is duplicated across every shard of the map, its size is
+// bounded by maxRows: shards that read more than maxRows rows of agg
+// fail the computation with a fatal (non-retriable) error.
+//
+// MapWithBroadcast otherwise behaves as Map, and accepts the same
+// pragmas.
+func MapWithBroadcast(slice, agg Slice, maxRows int, fn interface{}, prags ...Pragma) Slice {
+	if maxRows < 1 {
+		typecheck.Panicf(1, "mapwithbroadcast: invalid row limit %d", maxRows)
+	}
+	m := new(mapSlice)
+	m.name = MakeName("mapwithbroadcast")
+	m.Slice = slice
+	sliceFn, ok := slicefunc.Of(fn)
+	if !ok {
+		typecheck.Panicf(1, "mapwithbroadcast: invalid map function %T", fn)
+	}
+	aggCols := slicetype.Columns(agg)
+	for i := range aggCols {
+		aggCols[i] = reflect.SliceOf(aggCols[i])
+	}
+	if !typecheck.CanApply(sliceFn, slicetype.Append(slicetype.New(aggCols...), slice)) {
+		typecheck.Panicf(1, "mapwithbroadcast: function %T does not match broadcast slice type %s and input slice type %s",
+			fn, slicetype.String(agg), slicetype.String(slice))
+	}
+	out := slicetype.Columns(sliceFn.Out)
+	if n := len(out); n > 0 && out[n-1] == typeOfError {
+		m.fnErr = true
+		out = out[:n-1]
+	}
+	if len(out) == 0 {
+		typecheck.Panicf(1, "mapwithbroadcast: need at least one output column")
+	}
+	m.fval = sliceFn
+	m.out = slicetype.New(out...)
+	m.Pragmas = prags
+	var err error
+	if m.onErr, err = makeErrorPolicy(m.Pragmas, fn, m.fnErr); err != nil {
+		typecheck.Panicf(1, "mapwithbroadcast: %v", err)
+	}
+	return &mapBroadcastSlice{m, agg, maxRows}
+}
+
+func (*mapBroadcastSlice) NumDep() int { return 2 }
+
+func (m *mapBroadcastSlice) Dep(i int) Dep {
+	switch i {
+	case 0:
+		return Dep{Slice: m.Slice}
+	case 1:
+		return Dep{Slice: m.agg, Shuffle: true, Broadcast: true}
+	}
+	panic(fmt.Sprintf("invalid dependency %d", i))
+}
+
+func (m *mapBroadcastSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	if len(deps) != 2 {
+		panic(fmt.Errorf("expected two deps, got %d", len(deps)))
+	}
+	return &mapReader{op: m.mapSlice, reader: deps[0], bcast: &broadcastArgs{
+		typ:    m.agg,
+		reader: &broadcastReader{name: m.name, maxRows: m.maxRows, reader: deps[1]},
+	}, errs: rowErrors{name: m.name, shard: shard, policy: &m.onErr}}
+}
+
+// broadcastArgs reads the broadcast rows of a MapWithBroadcast shard,
+// which are passed, by column, to the map function.
+type broadcastArgs struct {
+	typ    slicetype.Type
+	reader sliceio.Reader
+	// values holds the broadcast columns once they have been read.
+	values []reflect.Value
+}
+
+// Init reads the broadcast rows, if they have not already been read.
+func (b *broadcastArgs) Init(ctx context.Context) error {
+	if b.values != nil {
+		return nil
+	}
+	var (
+		all = frame.Make(b.typ, 0, 0)
+		buf = frame.Make(b.typ, defaultChunksize, defaultChunksize)
+	)
+	for {
+		n, err := b.reader.Read(ctx, buf)
+		if err != nil && err != sliceio.EOF {
+			return err
+		}
+		all = frame.AppendFrame(all, buf.Slice(0, n))
+		if err == sliceio.EOF {
+			break
+		}
+	}
+	b.values = all.Values()
+	return nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/bigslice"
+)
+
+func TestBroadcast(t *testing.T) {
+	const N = 100
+	keys := make([]string, N)
+	ones := make([]int, N)
+	for i := range keys {
+		keys[i] = fmt.Sprint(i % 10)
+		ones[i] = 1
+	}
+	// Each of 10 keys is reduced to a count, which is then broadcast to
+	// every shard of the consumer.
+	for _, nshard := range []int{1, 3, 7} {
+		slice := bigslice.Const(5, keys, ones)
+		slice = bigslice.Reduce(slice, func(a, e int) int { return a + e })
+		slice = bigslice.Broadcast(slice, nshard, 10)
+		var (
+			wantKeys   []string
+			wantCounts []int
+		)
+		for i := 0; i < 10; i++ {
+			for j := 0; j < nshard; j++ {
+				wantKeys = append(wantKeys, fmt.Sprint(i))
+				wantCounts = append(wantCounts, 10)
+			}
+		}
+		assertEqual(t, slice, true, wantKeys, wantCounts)
+	}
+}
+
+func TestBroadcastLimit(t *testing.T) {
+	ints := make([]int, 100)
+	for i := range ints {
+		ints[i] = i
+	}
+	slice := bigslice.Const(5, ints)
+	slice = bigslice.Broadcast(slice, 3, 99)
+	for name, res := range runError(context.Background(), t, slice) {
+		if res.Err == nil || !strings.Contains(res.Err.Error(), "exceeds limit of 99 rows") {
+			t.Errorf("%s: got %v, want limit error", name, res.Err)
+		}
+	}
+}
+
+type broadcastStats struct {
+	Sum   float64
+	Count int
+}
+
+func TestMapWithBroadcast(t *testing.T) {
+	const N = 100
+	var (
+		keys   = make([]string, N)
+		values = make([]float64, N)
+		sum    float64
+	)
+	for i := range values {
+		keys[i] = fmt.Sprint(i)
+		values[i] = float64(i * i)
+		sum += values[i]
+	}
+	input := bigslice.Const(7, keys, values)
+	stats := bigslice.Map(input, func(_ string, v float64) (int, broadcastStats) { return 0, broadcastStats{v, 1} })
+	stats = bigslice.Reduce(stats, func(a, e broadcastStats) broadcastStats {
+		return broadcastStats{a.Sum + e.Sum, a.Count + e.Count}
+	})
+	slice := bigslice.MapWithBroadcast(input, stats, 1, func(_ []int, stats []broadcastStats, k string, v float64) (string, float64) {
+		return k, v - stats[0].Sum/float64(stats[0].Count)
+	})
+	want := make([]float64, N)
+	for i := range want {
+		want[i] = values[i] - sum/N
+	}
+	assertEqual(t, slice, true, keys, want)
+
+	// Broadcasts that exceed the row limit fail the computation.
+	slice = bigslice.MapWithBroadcast(input, input, N-1, func(_ []string, all []float64, k string, v float64) int { return len(all) })
+	for name, res := range runError(context.Background(), t, slice) {
+		if res.Err == nil || !strings.Contains(res.Err.Error(), "exceeds limit of 99 rows") {
+			t.Errorf("%s: got %v, want limit error", name, res.Err)
+		}
+	}
+	expectTypeError(t, "mapwithbroadcast: function func(string, string) int does not match broadcast slice type slice[1]string,float64 and input slice type slice[1]string,float64", func() {
+		bigslice.MapWithBroadcast(input, input, N, func(k, v string) int { return 0 })
+	})
+}
@@ -0,0 +1,93 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/slicefunc"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/slicetype"
+	"github.com/grailbio/bigslice/typecheck"
+)
+
+type canonicalKeysSlice struct {
+	name Name
+	Pragmas
+	Slice
+	fval slicefunc.Func
+}
+
+// CanonicalKeys returns a slice that replaces the key (prefix) columns
+// of each row of the provided slice with their canonical form, as
+// computed by fn, so that keys that are logically equal but distinct as
+// Go values (e.g., strings that differ only in case) are treated as
+// equal by subsequent shuffles: they are hashed to the same shard, and
+// are merged by Reduce, Cogroup, and other operations that group rows
+// by key. The function fn receives the key columns of a row and returns
+// their canonical values, with the same types. The remaining columns
+// are passed through unchanged. Schematically:
+//
+//	CanonicalKeys(Slice<k1, ..., kp, v1, ..., vn>, func(k1, ..., kp) (k1, ..., kp)) Slice<k1, ..., kp, v1, ..., vn>
+//
+// Canonicalization is consistent by construction: since logically
+// equal keys have the same canonical value, they hash and compare
+// equally. Key types may instead define custom hashing and comparison
+// by registering Ops (see frame.RegisterOps), in which case hashing
+// must be consistent with comparison: keys that compare as equal must
+// hash equally, or else logically equal keys may be assigned to
+// different shards, and results are silently incorrect. Use
+// frame.CheckKeys to check such implementations.
+func CanonicalKeys(slice Slice, fn interface{}, prags ...Pragma) Slice {
+	c := &canonicalKeysSlice{name: MakeName("canonicalkeys"), Pragmas: prags, Slice: slice}
+	fval, ok := slicefunc.Of(fn)
+	if !ok {
+		typecheck.Panicf(1, "canonicalkeys: invalid canonicalization function %T", fn)
+	}
+	keys := slicetype.New(slicetype.Columns(slice)[:slice.Prefix()]...)
+	if !typecheck.CanApply(fval, keys) {
+		typecheck.Panicf(1, "canonicalkeys: function %T does not match key type %s", fn, slicetype.String(keys))
+	}
+	if !typecheck.Equal(fval.Out, keys) {
+		typecheck.Panicf(1, "canonicalkeys: function %T does not return key type %s", fn, slicetype.String(keys))
+	}
+	c.fval = fval
+	return c
+}
+
+func (c *canonicalKeysSlice) Name() Name             { return c.name }
+func (*canonicalKeysSlice) ShardType() ShardType     { return HashShard }
+func (*canonicalKeysSlice) NumDep() int              { return 1 }
+func (c *canonicalKeysSlice) Dep(i int) Dep          { return singleDep(i, c.Slice, false) }
+func (*canonicalKeysSlice) Combiner() slicefunc.Func { return slicefunc.Nil }
+
+func (c *canonicalKeysSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	return &canonicalKeysReader{op: c, reader: deps[0]}
+}
+
+type canonicalKeysReader struct {
+	op     *canonicalKeysSlice
+	reader sliceio.Reader
+}
+
+func (r *canonicalKeysReader) Read(ctx context.Context, out frame.Frame) (int, error) {
+	if !slicetype.Assignable(out, r.op) {
+		return 0, errTypeError
+	}
+	n, err := r.reader.Read(ctx, out)
+	args := make([]reflect.Value, r.op.Prefix())
+	for i := 0; i < n; i++ {
+		for j := range args {
+			args[j] = out.Index(j, i)
+		}
+		result := r.op.fval.Call(ctx, args)
+		for j := range result {
+			out.Index(j, i).Set(result[j])
+		}
+	}
+	return n, err
+}
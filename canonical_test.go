@@ -0,0 +1,54 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/grailbio/bigslice"
+)
+
+func TestCanonicalKeys(t *testing.T) {
+	slice := bigslice.Const(3,
+		[]string{"a", "A", "b", "B", "b", "c"},
+		[]int{1, 2, 3, 4, 5, 6},
+	)
+	slice = bigslice.CanonicalKeys(slice, strings.ToLower)
+	if got, want := slice.Name().Op, "canonicalkeys"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	slice = bigslice.Reduce(slice, func(a, b int) int { return a + b })
+	assertEqual(t, slice, true, []string{"a", "b", "c"}, []int{3, 12, 6})
+
+	// Canonicalize multiple key columns.
+	slice = bigslice.Const(2,
+		[]string{"x", "X", "y"},
+		[]int{1, -1, 2},
+		[]int{1, 2, 3},
+	)
+	slice = bigslice.Prefixed(slice, 2)
+	slice = bigslice.CanonicalKeys(slice, func(s string, n int) (string, int) {
+		if n < 0 {
+			n = -n
+		}
+		return strings.ToLower(s), n
+	})
+	slice = bigslice.Reduce(slice, func(a, b int) int { return a + b })
+	assertEqual(t, slice, true, []string{"x", "y"}, []int{1, 2}, []int{3, 3})
+}
+
+func TestCanonicalKeysError(t *testing.T) {
+	slice := bigslice.Const(1, []string{"a"}, []int{1})
+	expectTypeError(t, "canonicalkeys: invalid canonicalization function int", func() {
+		bigslice.CanonicalKeys(slice, 1)
+	})
+	expectTypeError(t, "canonicalkeys: function func(int) int does not match key type slice[1]string", func() {
+		bigslice.CanonicalKeys(slice, func(int) int { return 0 })
+	})
+	expectTypeError(t, "canonicalkeys: function func(string) int does not return key type slice[1]string", func() {
+		bigslice.CanonicalKeys(slice, func(string) int { return 0 })
+	})
+}
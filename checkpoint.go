@@ -0,0 +1,166 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/bigslice/internal/slicecache"
+	"github.com/grailbio/bigslice/slicefunc"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/slicetype"
+)
+
+// checkpointMetadata describes the data of a checkpoint. It is stored,
+// JSON-encoded, at the path given by checkpointMetadataPath.
+type checkpointMetadata struct {
+	// NumShard is the number of shards of the checkpointed slice.
+	NumShard int
+	// ShardType is the sharding type of the checkpointed slice.
+	ShardType ShardType
+	// Schema is the type of the checkpointed slice, as given by
+	// slicetype.String.
+	Schema string
+}
+
+func checkpointMetadataPath(prefix string) string {
+	return prefix + "-checkpoint.json"
+}
+
+func writeCheckpointMetadata(ctx context.Context, prefix string, meta checkpointMetadata) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	f, err := file.Create(ctx, checkpointMetadataPath(prefix))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Writer(ctx).Write(b); err != nil {
+		f.Discard(ctx)
+		return err
+	}
+	return f.Close(ctx)
+}
+
+func readCheckpointMetadata(ctx context.Context, prefix string) (meta checkpointMetadata, err error) {
+	path := checkpointMetadataPath(prefix)
+	f, err := file.Open(ctx, path)
+	if err != nil {
+		return meta, err
+	}
+	defer file.CloseAndReport(ctx, f, &err)
+	b, err := ioutil.ReadAll(f.Reader(ctx))
+	if err != nil {
+		return meta, err
+	}
+	if err = json.Unmarshal(b, &meta); err != nil {
+		return meta, errors.E(errors.Invalid, fmt.Sprintf("checkpoint %q: invalid metadata %s", prefix, path), err)
+	}
+	return meta, nil
+}
+
+// Checkpoint is like Cache, but also records the number of shards,
+// the sharding type, and the type of the slice alongside the cached
+// data, in the file "prefix-checkpoint.json". Checkpointed data may be
+// read by a separate computation using ReadCheckpoint, which recovers
+// the slice's sharding from this metadata. The metadata is written
+// once, by the driver, after all of the slice's shards have been
+// written, so that ReadCheckpoint never reads an incomplete checkpoint.
+func Checkpoint(ctx context.Context, slice Slice, prefix string) Slice {
+	shardCache := slicecache.NewFileShardCache(ctx, prefix, slice.NumShard())
+	shardCache.RequireAllCached()
+	return &checkpointSlice{
+		name:   MakeName("checkpoint"),
+		Slice:  slice,
+		cache:  shardCache,
+		prefix: prefix,
+		meta: checkpointMetadata{
+			NumShard:  slice.NumShard(),
+			ShardType: slice.ShardType(),
+			Schema:    slicetype.String(slice),
+		},
+	}
+}
+
+type checkpointSlice struct {
+	name Name
+	Slice
+	cache  *slicecache.FileShardCache
+	prefix string
+	meta   checkpointMetadata
+}
+
+var (
+	_ slicecache.Cacheable = (*checkpointSlice)(nil)
+	_ FinalizerSlice       = (*checkpointSlice)(nil)
+)
+
+func (c *checkpointSlice) Name() Name                                             { return c.name }
+func (c *checkpointSlice) NumDep() int                                            { return 1 }
+func (c *checkpointSlice) Dep(i int) Dep                                          { return Dep{Slice: c.Slice} }
+func (*checkpointSlice) Combiner() slicefunc.Func                                 { return slicefunc.Nil }
+func (c *checkpointSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader { return deps[0] }
+
+func (c *checkpointSlice) Cache() slicecache.ShardCache { return c.cache }
+
+// Finalize implements FinalizerSlice. It writes the checkpoint's
+// metadata.
+func (c *checkpointSlice) Finalize(ctx context.Context) error {
+	return writeCheckpointMetadata(ctx, c.prefix, c.meta)
+}
+
+type readCheckpointSlice struct {
+	readCacheSlice
+	shardType ShardType
+	err       error
+}
+
+func (r *readCheckpointSlice) ShardType() ShardType { return r.shardType }
+
+func (r *readCheckpointSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	if r.err != nil {
+		return sliceio.ErrReader(r.err)
+	}
+	return r.readCacheSlice.Reader(shard, deps)
+}
+
+// ReadCheckpoint returns a slice that reads the data checkpointed by
+// Checkpoint with the provided prefix, without computing the
+// checkpointed slice. The returned slice has the number of shards and
+// the sharding type of the checkpointed slice, and each of its shards
+// reads the data of the corresponding checkpointed shard, so that the
+// returned slice is partitioned exactly as the checkpointed slice was.
+//
+// The type of the checkpointed slice must match typ, which may be
+// constructed using slicetype.New or be a Slice. Reading the returned
+// slice fails if the checkpoint's metadata cannot be read (in which
+// case the slice has a single shard), if its type does not match typ,
+// or if any of its shards is missing.
+func ReadCheckpoint(ctx context.Context, prefix string, typ slicetype.Type) Slice {
+	meta, err := readCheckpointMetadata(ctx, prefix)
+	if err != nil {
+		err = errors.E(errors.Fatal, fmt.Sprintf("checkpoint %q: reading metadata", prefix), err)
+		meta.NumShard = 1
+	} else if schema := slicetype.String(typ); meta.Schema != schema {
+		err = errors.E(errors.Fatal, errors.Invalid,
+			fmt.Sprintf("checkpoint %q: checkpointed type %s does not match type %s", prefix, meta.Schema, schema))
+	}
+	var shardCache *slicecache.FileShardCache
+	if err == nil {
+		shardCache = slicecache.NewFileShardCache(ctx, prefix, meta.NumShard)
+		shardCache.RequireAllCached()
+	}
+	return &readCheckpointSlice{
+		readCacheSlice{typ, MakeName("readcheckpoint"), meta.NumShard, shardCache},
+		meta.ShardType,
+		err,
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigslice"
+	"github.com/grailbio/bigslice/exec"
+	"github.com/grailbio/bigslice/slicetype"
+	"github.com/grailbio/testutil"
+)
+
+// shardContents returns a slice that passes through the provided
+// slice, recording the values of each of its shards in contents.
+func shardContents(slice bigslice.Slice, contents [][]int) bigslice.Slice {
+	var mu sync.Mutex
+	return bigslice.WriterFunc(slice, func(shard int, _ struct{}, _ error, xs []int) error {
+		mu.Lock()
+		contents[shard] = append(contents[shard], xs...)
+		mu.Unlock()
+		return nil
+	})
+}
+
+func TestReadCheckpoint(t *testing.T) {
+	dir, cleanUp := testutil.TempDir(t, "", "")
+	defer cleanUp()
+	prefix := filepath.Join(dir, "checkpoint")
+	ctx := context.Background()
+
+	const (
+		N      = 1000
+		Nshard = 7
+	)
+	input := make([]int, N)
+	for i := range input {
+		input[i] = i
+	}
+	want := make([][]int, Nshard)
+	slice := bigslice.Const(Nshard, input)
+	slice = bigslice.Checkpoint(ctx, slice, prefix)
+	slice = shardContents(slice, want)
+	scan := runLocal(ctx, t, slice)
+	v1 := scanInts(ctx, t, scan)
+	if got, want := len(ls1(t, dir)), Nshard+1; got != want {
+		t.Errorf("got %v [%v], want %v", got, ls1(t, dir), want)
+	}
+
+	slice = bigslice.ReadCheckpoint(ctx, prefix, slicetype.New(reflect.TypeOf(0)))
+	if got, want := slice.NumShard(), Nshard; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := slice.ShardType(), bigslice.HashShard; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	got := make([][]int, Nshard)
+	slice = shardContents(slice, got)
+	scan = runLocal(ctx, t, slice)
+	v2 := scanInts(ctx, t, scan)
+	if !reflect.DeepEqual(v1, v2) {
+		t.Errorf("corrupt checkpoint")
+	}
+	for shard := range want {
+		sort.Ints(want[shard])
+		sort.Ints(got[shard])
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestReadCheckpointError(t *testing.T) {
+	dir, cleanUp := testutil.TempDir(t, "", "")
+	defer cleanUp()
+	prefix := filepath.Join(dir, "checkpoint")
+	ctx := context.Background()
+	sess := exec.Start(exec.Local)
+	defer sess.Shutdown()
+
+	readCheckpoint := bigslice.Func(func() bigslice.Slice {
+		return bigslice.ReadCheckpoint(ctx, prefix, slicetype.New(reflect.TypeOf("")))
+	})
+	if _, err := sess.Run(ctx, readCheckpoint); err == nil {
+		t.Error("expected error when reading from non-existent checkpoint")
+	}
+
+	slice := bigslice.Const(3, []int{1, 2, 3})
+	slice = bigslice.Checkpoint(ctx, slice, prefix)
+	_ = runLocal(ctx, t, slice)
+	_, err := sess.Run(ctx, readCheckpoint)
+	if err == nil || !errors.Is(errors.Invalid, err) || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("got %v, want type mismatch error", err)
+	}
+}
+
+func TestCheckpointIncomplete(t *testing.T) {
+	dir, cleanUp := testutil.TempDir(t, "", "")
+	defer cleanUp()
+	prefix := filepath.Join(dir, "checkpoint")
+	ctx := context.Background()
+	sess := exec.Start(exec.Local)
+	defer sess.Shutdown()
+
+	// Shard 1 fails, while the others are written to the checkpoint.
+	fn := bigslice.Func(func() bigslice.Slice {
+		slice := bigslice.Const(3, []int{0, 1, 2, 3, 4, 5})
+		slice = bigslice.Map(slice, func(i int) (int, error) {
+			if i == 2 {
+				return 0, errors.E(errors.Fatal, "shard failed")
+			}
+			return i, nil
+		})
+		return bigslice.Checkpoint(ctx, slice, prefix)
+	})
+	if _, err := sess.Run(ctx, fn); err == nil {
+		t.Fatal("expected error")
+	}
+	for _, path := range ls1(t, dir) {
+		if strings.HasSuffix(path, "-checkpoint.json") {
+			t.Errorf("metadata %s written for incomplete checkpoint", path)
+		}
+	}
+	readCheckpoint := bigslice.Func(func() bigslice.Slice {
+		return bigslice.ReadCheckpoint(ctx, prefix, slicetype.New(reflect.TypeOf(0)))
+	})
+	if _, err := sess.Run(ctx, readCheckpoint); err == nil {
+		t.Error("expected error when reading incomplete checkpoint")
+	}
+}
+
+func TestCheckpointCompression(t *testing.T) {
+	dir, cleanUp := testutil.TempDir(t, "", "")
+	defer cleanUp()
+	prefix := filepath.Join(dir, "checkpoint")
+	ctx := context.Background()
+
+	const N = 1000
+	input := make([]int, N)
+	for i := range input {
+		input[i] = i
+	}
+	fn := bigslice.Func(func() bigslice.Slice {
+		return bigslice.Checkpoint(ctx, bigslice.Const(2, input), prefix)
+	})
+	sess := exec.Start(exec.Local, exec.Compression("gzip"))
+	defer sess.Shutdown()
+	if _, err := sess.Run(ctx, fn); err != nil {
+		t.Fatal(err)
+	}
+	// The checkpoint is compressed, and is read back regardless of the
+	// reading session's codec.
+	for _, path := range ls1(t, dir) {
+		if strings.HasSuffix(path, ".json") {
+			continue
+		}
+		p, err := ioutil.ReadFile(filepath.Join(dir, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(p, []byte("gzip")) {
+			t.Errorf("%s: not compressed", path)
+		}
+	}
+	slice := bigslice.ReadCheckpoint(ctx, prefix, slicetype.New(reflect.TypeOf(0)))
+	got := scanInts(ctx, t, runLocal(ctx, t, slice))
+	sort.Ints(got)
+	if !reflect.DeepEqual(got, input) {
+		t.Errorf("corrupt checkpoint")
+	}
+}
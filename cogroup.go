@@ -7,9 +7,11 @@ package bigslice
 import (
 	"container/heap"
 	"context"
+	"math/rand"
 	"reflect"
 
 	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/metrics"
 	"github.com/grailbio/bigslice/slicefunc"
 	"github.com/grailbio/bigslice/sliceio"
 	"github.com/grailbio/bigslice/slicetype"
@@ -23,6 +25,59 @@ type cogroupSlice struct {
 	out      []reflect.Type
 	prefix   int
 	numShard int
+
+	// maxGroupSize is the maximum number of values in each group, or 0
+	// if groups are unlimited.
+	maxGroupSize int
+	overflow     GroupOverflow
+}
+
+// GroupOverflows counts the number of values that were dropped from
+// groups that exceeded the maximum group size of a Cogroup (see
+// MaxGroupSize).
+var GroupOverflows = metrics.NewCounter()
+
+// A GroupOverflow determines which values are kept in a group that
+// exceeds its maximum size.
+type GroupOverflow int
+
+const (
+	// OverflowTruncate keeps the first values of the group, in the order
+	// in which they are merged, and drops the rest. This is the cheapest
+	// policy, but the kept values are not a uniform sample of the group.
+	OverflowTruncate GroupOverflow = iota
+	// OverflowReservoir keeps a uniform random sample of the group's
+	// values, using reservoir sampling. Though sampling is seeded by
+	// the shard, the values of a group are merged in an order that
+	// depends on the order in which the shard's dependencies are read,
+	// which varies from run to run (and across retries of a task), so
+	// the values that are kept are not deterministic.
+	OverflowReservoir
+)
+
+// A CogroupOption configures the behavior of Cogroup.
+type CogroupOption func(c *cogroupSlice)
+
+// MaxGroupSize is a CogroupOption that limits the number of values
+// of each key's group, in each slice, to n. Once a group exceeds n
+// values, further values are not accumulated: the provided overflow
+// policy determines which n values are passed downstream, and the
+// dropped values are counted by GroupOverflows. This protects
+// Cogroup from keys with pathologically large groups. Groups are
+// unlimited by default.
+func MaxGroupSize(n int, overflow GroupOverflow) CogroupOption {
+	if n <= 0 {
+		typecheck.Panicf(1, "maxgroupsize: invalid maximum group size %d", n)
+	}
+	switch overflow {
+	case OverflowTruncate, OverflowReservoir:
+	default:
+		typecheck.Panicf(1, "maxgroupsize: invalid overflow policy %d", overflow)
+	}
+	return func(c *cogroupSlice) {
+		c.maxGroupSize = n
+		c.overflow = overflow
+	}
 }
 
 // Cogroup returns a slice that, for each key in any slice, contains
@@ -44,13 +99,25 @@ type cogroupSlice struct {
 // require some changes downstream, however, so that buffering and
 // encoding functionality also know how to read scanner values.
 func Cogroup(slices ...Slice) Slice {
+	return cogroup(2, MakeName("cogroup"), nil, slices)
+}
+
+// CogroupWithOptions is like Cogroup, but configured by the provided
+// options. Note that Reduce does not need a limit on group sizes:
+// it combines each key's values as they are read, so that its memory
+// use depends only on the number of keys.
+func CogroupWithOptions(opts []CogroupOption, slices ...Slice) Slice {
+	return cogroup(2, MakeName("cogroup"), opts, slices)
+}
+
+func cogroup(calldepth int, name Name, opts []CogroupOption, slices []Slice) Slice {
 	if len(slices) == 0 {
-		typecheck.Panic(1, "cogroup: expected at least one slice")
+		typecheck.Panic(calldepth, "cogroup: expected at least one slice")
 	}
 	var keyTypes []reflect.Type
 	for i, slice := range slices {
 		if slice.NumOut() == 0 {
-			typecheck.Panicf(1, "cogroup: slice %d has no columns", i)
+			typecheck.Panicf(calldepth, "cogroup: slice %d has no columns", i)
 		}
 		if i == 0 {
 			keyTypes = make([]reflect.Type, slice.Prefix())
@@ -59,21 +126,21 @@ func Cogroup(slices ...Slice) Slice {
 			}
 		} else {
 			if got, want := slice.Prefix(), len(keyTypes); got != want {
-				typecheck.Panicf(1, "cogroup: prefix mismatch: expected %d but got %d", want, got)
+				typecheck.Panicf(calldepth, "cogroup: prefix mismatch: expected %d but got %d", want, got)
 			}
 			for j := range keyTypes {
 				if got, want := slice.Out(j), keyTypes[j]; got != want {
-					typecheck.Panicf(1, "cogroup: key column type mismatch: expected %s but got %s", want, got)
+					typecheck.Panicf(calldepth, "cogroup: key column type mismatch: expected %s but got %s", want, got)
 				}
 			}
 		}
 	}
 	for i := range keyTypes {
 		if !frame.CanHash(keyTypes[i]) {
-			typecheck.Panicf(1, "cogroup: key column(%d) type %s cannot be hashed", i, keyTypes[i])
+			typecheck.Panicf(calldepth, "cogroup: key column(%d) type %s cannot be hashed", i, keyTypes[i])
 		}
 		if !frame.CanCompare(keyTypes[i]) {
-			typecheck.Panicf(1, "cogroup: key column(%d) type %s cannot be sorted", i, keyTypes[i])
+			typecheck.Panicf(calldepth, "cogroup: key column(%d) type %s cannot be sorted", i, keyTypes[i])
 		}
 	}
 	out := keyTypes
@@ -92,13 +159,17 @@ func Cogroup(slices ...Slice) Slice {
 		}
 	}
 
-	return &cogroupSlice{
-		name:     MakeName("cogroup"),
+	c := &cogroupSlice{
+		name:     name,
 		numShard: numShard,
 		slices:   slices,
 		out:      out,
 		prefix:   len(keyTypes),
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
 }
 
 func (c *cogroupSlice) Name() Name             { return c.name }
@@ -108,9 +179,13 @@ func (c *cogroupSlice) NumOut() int            { return len(c.out) }
 func (c *cogroupSlice) Out(i int) reflect.Type { return c.out[i] }
 func (c *cogroupSlice) Prefix() int            { return c.prefix }
 func (c *cogroupSlice) NumDep() int            { return len(c.slices) }
-func (c *cogroupSlice) Dep(i int) Dep          { return Dep{c.slices[i], true, nil, false} }
+func (c *cogroupSlice) Dep(i int) Dep          { return Dep{Slice: c.slices[i], Shuffle: true} }
 func (*cogroupSlice) Combiner() slicefunc.Func { return slicefunc.Nil }
 
+// Sorted implements SortedSlice: each shard's groups are emitted in
+// key order.
+func (*cogroupSlice) Sorted() bool { return true }
+
 type cogroupReader struct {
 	err error
 	op  *cogroupSlice
@@ -118,6 +193,28 @@ type cogroupReader struct {
 	readers []sliceio.Reader
 
 	heap *sortio.FrameBufferHeap
+
+	// rand is used to sample groups with OverflowReservoir.
+	rand *rand.Rand
+}
+
+// add adds the single-row frame f to the group row[idx] of the
+// current key, which has had count[idx] values so far, applying the
+// cogroup's maximum group size. Add returns the number of values that
+// were dropped.
+func (c *cogroupReader) add(row []frame.Frame, count []int, idx int, f frame.Frame) int64 {
+	count[idx]++
+	max := c.op.maxGroupSize
+	if max == 0 || count[idx] <= max {
+		row[idx] = frame.AppendFrame(row[idx], f)
+		return 0
+	}
+	if c.op.overflow == OverflowReservoir {
+		if j := c.rand.Intn(count[idx]); j < max {
+			frame.Copy(row[idx].Slice(j, j+1), f)
+		}
+	}
+	return 1
 }
 
 func (c *cogroupReader) Read(ctx context.Context, out frame.Frame) (int, error) {
@@ -134,7 +231,8 @@ func (c *cogroupReader) Read(ctx context.Context, out frame.Frame) (int, error)
 		// Maintain a compare buffer that's used to compare values across
 		// the heterogeneously typed buffers.
 		// TODO(marius): the extra copy and indirection here is unnecessary.
-		lessBuf := frame.Make(slicetype.New(c.op.out[:c.op.prefix]...), 2, 2).Prefixed(c.op.prefix)
+		lessBuf := frame.Make(slicetype.New(c.op.out[:c.op.prefix]...), 2, 2).Prefixed(c.op.prefix).
+			WithKeyPolicy(frame.ContextKeyPolicy(ctx))
 		c.heap.LessFunc = func(i, j int) bool {
 			ib, jb := c.heap.Buffers[i], c.heap.Buffers[j]
 			for i := 0; i < c.op.prefix; i++ {
@@ -182,7 +280,8 @@ func (c *cogroupReader) Read(ctx context.Context, out frame.Frame) (int, error)
 	var (
 		n       int
 		max     = out.Len()
-		lessBuf = frame.Make(slicetype.New(c.op.out[:c.op.prefix]...), 2, 2).Prefixed(c.op.prefix)
+		lessBuf = frame.Make(slicetype.New(c.op.out[:c.op.prefix]...), 2, 2).Prefixed(c.op.prefix).
+			WithKeyPolicy(frame.ContextKeyPolicy(ctx))
 	)
 	if max == 0 {
 		panic("bigslice.Cogroup: max == 0")
@@ -192,8 +291,10 @@ func (c *cogroupReader) Read(ctx context.Context, out frame.Frame) (int, error)
 		// First, gather all the records that have the same key.
 		row := make([]frame.Frame, len(c.readers))
 		var (
-			key  = make([]reflect.Value, c.op.prefix)
-			last = -1
+			key      = make([]reflect.Value, c.op.prefix)
+			last     = -1
+			count    = make([]int, len(c.readers))
+			overflow int64
 		)
 		// TODO(marius): the extra copy and indirection here is unnecessary.
 		less := func() bool {
@@ -209,7 +310,7 @@ func (c *cogroupReader) Read(ctx context.Context, out frame.Frame) (int, error)
 			// first key: need to pick the smallest one
 			buf := c.heap.Buffers[0]
 			idx := buf.Off / bufferSize
-			row[idx] = frame.AppendFrame(row[idx], buf.Slice(buf.Index, buf.Index+1))
+			overflow += c.add(row, count, idx, buf.Slice(buf.Index, buf.Index+1))
 			buf.Index++
 			if last < 0 {
 				for i := 0; i < c.op.prefix; i++ {
@@ -230,6 +331,9 @@ func (c *cogroupReader) Read(ctx context.Context, out frame.Frame) (int, error)
 				heap.Fix(c.heap, 0)
 			}
 		}
+		if overflow > 0 {
+			GroupOverflows.Incr(metrics.ContextScope(ctx), overflow)
+		}
 
 		// Now that we've gathered all the row values for a given key,
 		// push them into our output.
@@ -268,5 +372,6 @@ func (c *cogroupSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
 	return &cogroupReader{
 		op:      c,
 		readers: deps,
+		rand:    rand.New(rand.NewSource(int64(shard))),
 	}
 }
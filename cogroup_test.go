@@ -5,11 +5,16 @@
 package bigslice_test
 
 import (
+	"context"
+	"fmt"
+	"math"
 	"reflect"
 	"sort"
 	"testing"
 
 	"github.com/grailbio/bigslice"
+	"github.com/grailbio/bigslice/exec"
+	"github.com/grailbio/bigslice/frame"
 	"github.com/grailbio/bigslice/slicetest"
 	"github.com/grailbio/bigslice/slicetype"
 )
@@ -177,3 +182,158 @@ func ExampleCogroup_one() {
 	// 2 [two]
 	// 3 [three]
 }
+
+func TestCogroupMaxGroupSize(t *testing.T) {
+	ctx := context.Background()
+	for _, overflow := range []bigslice.GroupOverflow{bigslice.OverflowTruncate, bigslice.OverflowReservoir} {
+		for name, opt := range executors {
+			if testing.Short() && name != "Local" {
+				continue
+			}
+			slice1 := bigslice.Const(2,
+				[]string{"a", "a", "a", "a", "a", "a", "a", "a", "a", "a", "b", "b"},
+				[]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+			)
+			slice2 := bigslice.Const(1, []string{"a", "a", "a"}, []int{0, 1, 2})
+			fn := bigslice.Func(func() bigslice.Slice {
+				opts := []bigslice.CogroupOption{bigslice.MaxGroupSize(4, overflow)}
+				return bigslice.CogroupWithOptions(opts, slice1, slice2)
+			})
+			res, err := exec.Start(opt).Run(ctx, fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var (
+				keys            []string
+				groups1, group2 [][]int
+			)
+			if err := res.Collect(ctx, &keys, &groups1, &group2); err != nil {
+				t.Fatal(err)
+			}
+			for i, key := range keys {
+				want1, want2 := 4, 3
+				if key == "b" {
+					want1, want2 = 2, 0
+				}
+				if got := len(groups1[i]); got != want1 {
+					t.Errorf("%s: key %s: got %v, want %v", name, key, got, want1)
+				}
+				if got := len(group2[i]); got != want2 {
+					t.Errorf("%s: key %s: got %v, want %v", name, key, got, want2)
+				}
+				seen := make(map[int]bool)
+				for _, v := range groups1[i] {
+					if seen[v] || (key == "a") != (v < 10) {
+						t.Errorf("%s: key %s: unexpected group %v", name, key, groups1[i])
+					}
+					seen[v] = true
+				}
+			}
+			if got, want := len(keys), 2; got != want {
+				t.Errorf("%s: got %v, want %v", name, got, want)
+			}
+			if got, want := bigslice.GroupOverflows.Value(res.Scope()), int64(6); got != want {
+				t.Errorf("%s: got %v, want %v", name, got, want)
+			}
+		}
+	}
+}
+
+func TestMaxGroupSizeError(t *testing.T) {
+	expectTypeError(t, "maxgroupsize: invalid maximum group size 0", func() {
+		bigslice.MaxGroupSize(0, bigslice.OverflowTruncate)
+	})
+	expectTypeError(t, "maxgroupsize: invalid overflow policy 5", func() {
+		bigslice.MaxGroupSize(1, bigslice.GroupOverflow(5))
+	})
+}
+
+func TestCogroupKeyPolicy(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		nan  = math.NaN()
+		a, b = "a", "b"
+	)
+	floatsFn := bigslice.Func(func(nshard int) bigslice.Slice {
+		return sortedCogroup(bigslice.Const(nshard,
+			[]float64{1, nan, 2, nan, math.Copysign(0, -1), nan, 0},
+			[]int{0, 1, 2, 3, 4, 5, 6}))
+	})
+	strsFn := bigslice.Func(func(nshard int) bigslice.Slice {
+		return sortedCogroup(bigslice.Const(nshard,
+			[]*string{&b, nil, &a, nil, &b},
+			[]int{0, 1, 2, 3, 4}))
+	})
+	for _, policy := range []frame.KeyPolicy{{}, {NaNFirst: true, NilLast: true}} {
+		for name, opt := range executors {
+			if testing.Short() && name != "Local" {
+				continue
+			}
+			name := fmt.Sprintf("%s/%+v", name, policy)
+			sess := exec.Start(opt, exec.KeyPolicy(policy))
+			for _, nshard := range []int{1, 3} {
+				var (
+					floats      []float64
+					floatGroups [][]int
+				)
+				if err := sess.Must(ctx, floatsFn, nshard).Collect(ctx, &floats, &floatGroups); err != nil {
+					t.Fatal(err)
+				}
+				groups := make(map[string][]int)
+				for i, f := range floats {
+					groups[fmt.Sprint(math.Abs(f))] = floatGroups[i]
+				}
+				// NaNs, and zeros, are grouped regardless of sharding.
+				if got, want := groups, map[string][]int{"NaN": {1, 3, 5}, "0": {4, 6}, "1": {0}, "2": {2}}; !reflect.DeepEqual(got, want) {
+					t.Errorf("%s: %d shards: got %v, want %v", name, nshard, got, want)
+				}
+				var (
+					strs      []*string
+					strGroups [][]int
+				)
+				if err := sess.Must(ctx, strsFn, nshard).Collect(ctx, &strs, &strGroups); err != nil {
+					t.Fatal(err)
+				}
+				keys := make(map[string][]int)
+				for i, s := range strs {
+					key := "nil"
+					if s != nil {
+						key = *s
+					}
+					keys[key] = strGroups[i]
+				}
+				if got, want := keys, map[string][]int{"nil": {1, 3}, "a": {2}, "b": {0, 4}}; !reflect.DeepEqual(got, want) {
+					t.Errorf("%s: %d shards: got %v, want %v", name, nshard, got, want)
+				}
+				if nshard != 1 {
+					continue
+				}
+				// A single shard is sorted by key, according to the policy.
+				wantFloats, wantStrs := "[0 1 2 NaN]", "[nil a b]"
+				if policy.NaNFirst {
+					wantFloats = "[NaN 0 1 2]"
+				}
+				if policy.NilLast {
+					wantStrs = "[a b nil]"
+				}
+				for i := range floats {
+					floats[i] = math.Abs(floats[i])
+				}
+				if got := fmt.Sprint(floats); got != wantFloats {
+					t.Errorf("%s: got %v, want %v", name, got, wantFloats)
+				}
+				var strKeys []string
+				for _, s := range strs {
+					if s == nil {
+						strKeys = append(strKeys, "nil")
+					} else {
+						strKeys = append(strKeys, *s)
+					}
+				}
+				if got := fmt.Sprint(strKeys); got != wantStrs {
+					t.Errorf("%s: got %v, want %v", name, got, wantStrs)
+				}
+			}
+		}
+	}
+}
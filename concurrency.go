@@ -0,0 +1,49 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import "github.com/grailbio/bigslice/typecheck"
+
+type concurrency struct {
+	n int
+}
+
+func (concurrency) Procs() int        { return 1 }
+func (concurrency) Exclusive() bool   { return false }
+func (concurrency) Materialize() bool { return false }
+
+// Concurrency returns a pragma that limits the number of the tasks
+// that compute a slice that may run at once to n, across all of the
+// session's machines. Tasks beyond the limit wait to run even when
+// machines are available to run them. Concurrency limits are useful to
+// bound the load that a stage places on external services, e.g., to
+// limit the number of shards that call an API at the same time,
+// regardless of the size of the cluster.
+//
+// The limit applies to the stage that computes the slice: that is, to
+// the tasks of the slice and of the operations pipelined with it. If
+// the pipelined operations have multiple Concurrency pragmas, the
+// smallest limit applies. Tasks hold their place under the limit only
+// while they run, and not while they wait for their dependencies, so
+// that limited stages that depend on each other cannot deadlock.
+func Concurrency(n int) Pragma {
+	if n <= 0 {
+		typecheck.Panicf(1, "concurrency: invalid limit %d", n)
+	}
+	return concurrency{n}
+}
+
+// ConcurrencyOf returns the limit given by the Concurrency pragmas in
+// p, or 0 if there is none. If multiple slices with Concurrency pragmas
+// are pipelined, the smallest limit applies to the composed pipeline.
+func ConcurrencyOf(p Pragma) int {
+	var limit int
+	eachPragma(p, func(q Pragma) {
+		if c, ok := q.(concurrency); ok && (limit == 0 || c.n < limit) {
+			limit = c.n
+		}
+	})
+	return limit
+}
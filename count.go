@@ -0,0 +1,113 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/slicefunc"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/slicetype"
+	"github.com/grailbio/bigslice/typecheck"
+)
+
+// countCombiner is the combiner used by CountByKey.
+var countCombiner, _ = slicefunc.Of(func(n, m int64) int64 { return n + m })
+
+// CountByKey returns a slice that counts the rows of the provided
+// slice for each distinct key. The key comprises the columns with the
+// provided indices, in order, or, if none are provided, the slice's
+// prefix columns. The returned slice has the key columns as its prefix,
+// followed by a column of type int64 holding the count. Schematically:
+//
+//	CountByKey(Slice<k1, k2, v>, 0, 1) Slice<k1, k2, int64>
+//
+// CountByKey is equivalent to reducing a count of 1 for each row, but
+// non-key columns are dropped before the shuffle, and counts are always
+// combined map-side, so that only keys and partial counts are shuffled.
+// Like Reduce, counts are exact despite task retries: each task attempt
+// combines only its own input.
+func CountByKey(slice Slice, keyCols ...int) Slice {
+	if len(keyCols) == 0 {
+		keyCols = make([]int, slice.Prefix())
+		for i := range keyCols {
+			keyCols[i] = i
+		}
+	}
+	seen := make(map[int]bool)
+	cols := make([]reflect.Type, 0, len(keyCols)+1)
+	for _, col := range keyCols {
+		if col < 0 || col >= slice.NumOut() {
+			typecheck.Panicf(1, "countbykey: key column %d out of range for slice %s", col, slicetype.String(slice))
+		}
+		if seen[col] {
+			typecheck.Panicf(1, "countbykey: duplicate key column %d", col)
+		}
+		seen[col] = true
+		cols = append(cols, slice.Out(col))
+	}
+	cols = append(cols, reflect.TypeOf(int64(0)))
+	keys := &countKeysSlice{
+		name:  MakeName("count"),
+		Slice: slice,
+		out:   slicetype.New(cols...),
+		keys:  append([]int(nil), keyCols...),
+	}
+	if err := canMakeCombiningFrame(keys); err != nil {
+		typecheck.Panic(1, err.Error())
+	}
+	return &reduceSlice{keys, MakeName("count"), countCombiner}
+}
+
+// countKeysSlice projects the key columns of a slice, and appends a
+// count column of 1s.
+type countKeysSlice struct {
+	name Name
+	Slice
+	out  slicetype.Type
+	keys []int
+}
+
+func (c *countKeysSlice) Name() Name             { return c.name }
+func (c *countKeysSlice) NumOut() int            { return c.out.NumOut() }
+func (c *countKeysSlice) Out(i int) reflect.Type { return c.out.Out(i) }
+func (c *countKeysSlice) Prefix() int            { return len(c.keys) }
+func (*countKeysSlice) ShardType() ShardType     { return HashShard }
+func (*countKeysSlice) NumDep() int              { return 1 }
+func (c *countKeysSlice) Dep(i int) Dep          { return singleDep(i, c.Slice, false) }
+func (*countKeysSlice) Combiner() slicefunc.Func { return slicefunc.Nil }
+
+func (c *countKeysSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	return &countKeysReader{op: c, reader: deps[0]}
+}
+
+type countKeysReader struct {
+	op     *countKeysSlice
+	reader sliceio.Reader
+	in     frame.Frame
+}
+
+func (r *countKeysReader) Read(ctx context.Context, out frame.Frame) (int, error) {
+	if !slicetype.Assignable(out, r.op) {
+		return 0, errTypeError
+	}
+	if r.in.IsZero() {
+		r.in = frame.Make(r.op.Slice, out.Len(), out.Len())
+	} else {
+		r.in = r.in.Ensure(out.Len())
+	}
+	n, err := r.reader.Read(ctx, r.in.Slice(0, out.Len()))
+	in := r.in.Slice(0, n)
+	for i, col := range r.op.keys {
+		reflect.Copy(out.Value(i), in.Value(col))
+	}
+	counts := out.Interface(len(r.op.keys)).([]int64)
+	for i := 0; i < n; i++ {
+		counts[i] = 1
+	}
+	return n, err
+}
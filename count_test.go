@@ -0,0 +1,58 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/grailbio/bigslice"
+)
+
+func TestCountByKey(t *testing.T) {
+	const N = 100
+	ints := make([]int, N)
+	for i := range ints {
+		ints[i] = i
+	}
+	for m := 1; m < 5; m++ {
+		slice := bigslice.Const(m, ints)
+		slice = bigslice.Map(slice, func(x int) (string, string, int) {
+			return fmt.Sprint(x%3) + "x", fmt.Sprint(x%2) + "y", x
+		})
+		count := bigslice.CountByKey(slice)
+		if got, want := count.Name().Op, "count"; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if got, want := count.NumOut(), 2; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		assertEqual(t, count, true, []string{"0x", "1x", "2x"}, []int64{34, 33, 33})
+
+		count = bigslice.CountByKey(slice, 1, 0)
+		if got, want := count.Prefix(), 2; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		count = bigslice.Map(count, func(y, x string, n int64) (string, int64) {
+			return y + x, n
+		})
+		assertEqual(t, count, true,
+			[]string{"0y0x", "0y1x", "0y2x", "1y0x", "1y1x", "1y2x"},
+			[]int64{17, 16, 17, 17, 17, 16})
+	}
+}
+
+func TestCountByKeyError(t *testing.T) {
+	slice := bigslice.Const(1, []int{1}, []func(){func() {}})
+	expectTypeError(t, "countbykey: key column 2 out of range for slice slice[1]int,func()", func() {
+		bigslice.CountByKey(slice, 2)
+	})
+	expectTypeError(t, "countbykey: duplicate key column 0", func() {
+		bigslice.CountByKey(slice, 0, 0)
+	})
+	expectTypeError(t, "cannot combine values for keys of type: func()", func() {
+		bigslice.CountByKey(slice, 1)
+	})
+}
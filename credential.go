@@ -0,0 +1,124 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/grailbio/base/errors"
+)
+
+func init() {
+	gob.Register(EnvCredentials{})
+}
+
+// A Credential is a structured secret, e.g., an access key ID and its
+// secret key, keyed by field name.
+type Credential map[string]string
+
+// A CredentialProvider resolves named credentials. Providers are
+// configured for a session (see exec.Credentials), and are shipped to
+// the session's worker machines, where credentials are resolved at
+// execution time, e.g., from the worker's environment or from a secret
+// manager. Providers thus must be gob-encodable (and registered with
+// gob.Register), and should carry only the configuration needed to
+// locate secrets, not the secrets themselves.
+type CredentialProvider interface {
+	// Credential resolves the credential with the provided name.
+	Credential(ctx context.Context, name string) (Credential, error)
+}
+
+// EnvCredentials is a CredentialProvider that resolves credentials from
+// the environment of the process in which they are resolved. The
+// fields of the credential with name n are given by the environment
+// variables named Prefix + N + "_" + FIELD, where N is n in upper
+// case; field names are in lower case. For example, with prefix
+// "BIGSLICE_", the variable BIGSLICE_S3_SECRET_KEY provides the field
+// "secret_key" of the credential "s3".
+type EnvCredentials struct {
+	Prefix string
+}
+
+// Credential implements CredentialProvider.
+func (e EnvCredentials) Credential(ctx context.Context, name string) (Credential, error) {
+	prefix := e.Prefix + strings.ToUpper(name) + "_"
+	cred := make(Credential)
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, prefix) {
+			continue
+		}
+		kv = kv[len(prefix):]
+		if i := strings.Index(kv, "="); i > 0 {
+			cred[strings.ToLower(kv[:i])] = kv[i+1:]
+		}
+	}
+	if len(cred) == 0 {
+		return nil, errors.E(errors.NotExist, fmt.Sprintf("no environment variables with prefix %s", prefix))
+	}
+	return cred, nil
+}
+
+// credentialContextKeyType is used to create a unique context key for
+// credential resolvers, available only to code in this package.
+type credentialContextKeyType struct{}
+
+var credentialContextKey credentialContextKeyType
+
+// credentialResolver resolves credentials for a task, caching them for
+// its duration.
+type credentialResolver struct {
+	provider CredentialProvider
+
+	mu    sync.Mutex
+	creds map[string]Credential
+}
+
+// CredentialContext returns a context that resolves credentials from
+// the provided provider. Executors attach a fresh context to each task
+// run, so that credentials are resolved, lazily, at most once per task
+// run. CredentialContext is called by executors; user code should
+// retrieve credentials with LookupCredential.
+func CredentialContext(ctx context.Context, provider CredentialProvider) context.Context {
+	return context.WithValue(ctx, credentialContextKey, &credentialResolver{
+		provider: provider,
+		creds:    make(map[string]Credential),
+	})
+}
+
+// LookupCredential returns the credential with the provided name, as
+// resolved by the session's credential provider on the machine that is
+// running the current task. It should be called with the context
+// passed to slice functions, e.g., the reader function of ReaderFunc
+// or the writer function of WriterFunc, so that secrets are used by
+// tasks without being part of the (serialized) slice graph.
+//
+// LookupCredential returns a fatal error if the credential cannot be
+// resolved on the machine, or if the session has no credential
+// provider.
+func LookupCredential(ctx context.Context, name string) (Credential, error) {
+	r, _ := ctx.Value(credentialContextKey).(*credentialResolver)
+	if r == nil {
+		return nil, errors.E(errors.Fatal, errors.Precondition,
+			fmt.Sprintf("credential %q: session has no credential provider", name))
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cred, ok := r.creds[name]; ok {
+		return cred, nil
+	}
+	cred, err := r.provider.Credential(ctx, name)
+	if err != nil {
+		host, _ := os.Hostname()
+		return nil, errors.E(errors.Fatal,
+			fmt.Sprintf("credential %q could not be resolved on %s", name, host), err)
+	}
+	r.creds[name] = cred
+	return cred, nil
+}
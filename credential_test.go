@@ -0,0 +1,42 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigslice"
+)
+
+func TestLookupCredential(t *testing.T) {
+	os.Setenv("BIGSLICETEST_S3_KEY_ID", "id")
+	os.Setenv("BIGSLICETEST_S3_SECRET", "secret")
+	defer os.Unsetenv("BIGSLICETEST_S3_KEY_ID")
+	defer os.Unsetenv("BIGSLICETEST_S3_SECRET")
+
+	ctx := context.Background()
+	if _, err := bigslice.LookupCredential(ctx, "s3"); !errors.Is(errors.Precondition, err) {
+		t.Errorf("got %v, want precondition error", err)
+	}
+	ctx = bigslice.CredentialContext(ctx, bigslice.EnvCredentials{Prefix: "BIGSLICETEST_"})
+	cred, err := bigslice.LookupCredential(ctx, "s3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cred, (bigslice.Credential{"key_id": "id", "secret": "secret"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	_, err = bigslice.LookupCredential(ctx, "gcs")
+	if !errors.Is(errors.NotExist, err) {
+		t.Errorf("got %v, want not exist error", err)
+	}
+	if !errors.Match(errors.E(errors.Fatal), err) {
+		t.Errorf("got %v, want fatal error", err)
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/metrics"
+	"github.com/grailbio/bigslice/slicefunc"
+	"github.com/grailbio/bigslice/slicetype"
+	"github.com/grailbio/bigslice/typecheck"
+)
+
+// DeadLetterRows counts the rows that were passed to dead-letter sinks
+// (see DeadLetterSink) or routed to dead-letter slices (see
+// MapDeadLetter and FilterDeadLetter). It may be read from the scope of
+// a task or of a result.
+var DeadLetterRows = metrics.NewCounter()
+
+var typeOfMapError = reflect.TypeOf((*MapError)(nil))
+
+// A DeadLetterRow is a row for which a Map function or Filter predicate
+// returned an error.
+type DeadLetterRow struct {
+	// Err describes the failure.
+	Err *MapError
+	// Values holds the row's column values, as passed to the function.
+	Values []interface{}
+}
+
+type deadLetterSink struct {
+	sink        func(ctx context.Context, row DeadLetterRow) error
+	maxFraction float64
+}
+
+func (deadLetterSink) Procs() int        { return 1 }
+func (deadLetterSink) Exclusive() bool   { return false }
+func (deadLetterSink) Materialize() bool { return false }
+
+// DeadLetterSink returns a pragma that changes the handling of errors
+// returned by Map functions and Filter predicates: instead of failing
+// on the first error, rows for which the function returns an error are
+// dropped from the slice, and passed, along with the error, to the
+// provided sink, so that they may be inspected, e.g., by writing them
+// to a file or a queue. The sink is called by the task that computes
+// the failed row, on the machine that runs it. An error returned by the
+// sink fails the task; unless the error is temporary, the failure is
+// fatal. Failed rows are counted by DeadLetterRows.
+//
+// Should the fraction of failed rows in a shard exceed maxFraction, the
+// computation fails, as for SampleErrors, with which DeadLetterSink
+// cannot be combined.
+func DeadLetterSink(sink func(ctx context.Context, row DeadLetterRow) error, maxFraction float64) Pragma {
+	if sink == nil {
+		typecheck.Panic(1, "deadlettersink: nil sink")
+	}
+	if maxFraction < 0 || maxFraction > 1 {
+		typecheck.Panicf(1, "deadlettersink: invalid maximum error fraction %v", maxFraction)
+	}
+	return deadLetterSink{sink, maxFraction}
+}
+
+// deadLetterSinkOf returns the DeadLetterSink pragma in p, if any.
+func deadLetterSinkOf(p Pragma) (deadLetterSink, bool) {
+	switch p := p.(type) {
+	case deadLetterSink:
+		return p, true
+	case Pragmas:
+		for _, q := range p {
+			if s, ok := deadLetterSinkOf(q); ok {
+				return s, true
+			}
+		}
+	}
+	return deadLetterSink{}, false
+}
+
+// MapDeadLetter is like Map, with a function that returns an error as
+// its last value, except that rows for which the function returns an
+// error do not fail the computation: they are instead routed, along
+// with a *MapError describing the failure, to a dead-letter slice,
+// which is returned alongside the slice of mapped rows. Should the
+// fraction of failed rows in a shard exceed maxFraction, the
+// computation fails. Failed rows are counted by DeadLetterRows.
+//
+// The returned slices are outputs of a single operation, as for
+// Partition2: both have the shards of the provided slice, and their
+// computation is shared when they are used by the same invocation. The
+// dead-letter slice may be consumed as any other, e.g., to write failed
+// rows to files for inspection. Schematically:
+//
+//	MapDeadLetter(Slice<t1, ..., tn>, func(t1, ..., tn) (r1, ..., rm, error), float64) (Slice<r1, ..., rm>, Slice<t1, ..., tn, *MapError>)
+func MapDeadLetter(slice Slice, fn interface{}, maxFraction float64, prags ...Pragma) (Slice, Slice) {
+	Helper()
+	sliceFn, ok := slicefunc.Of(fn)
+	if !ok {
+		typecheck.Panicf(1, "mapdeadletter: invalid map function %T", fn)
+	}
+	if !typecheck.CanApply(sliceFn, slice) {
+		typecheck.Panicf(1, "mapdeadletter: function %T does not match input slice type %s", fn, slicetype.String(slice))
+	}
+	if n := sliceFn.Out.NumOut(); n < 2 || sliceFn.Out.Out(n-1) != typeOfError {
+		typecheck.Panicf(1, "mapdeadletter: function %T must return at least one output column and an error", fn)
+	}
+	checkDeadLetter(1, "mapdeadletter", maxFraction, prags)
+	m := Map(slice, fn, prags...).(*mapSlice)
+	m.name = MakeName("mapdeadletter")
+	m.onErr.route = true
+	m.onErr.maxFraction = maxFraction
+	nout := m.out.NumOut()
+	m.out = slicetype.Concat(m.out, slice, slicetype.New(typeOfMapError))
+	m.onErr.placeholders = deadLetterPlaceholders(m.out)
+	return deadLetterSplit(m, nout, "mapdeadletter")
+}
+
+// FilterDeadLetter is like Filter, with a predicate that returns an
+// error as its second value, except that rows for which the predicate
+// returns an error do not fail the computation: they are instead
+// routed, along with a *MapError describing the failure, to a
+// dead-letter slice, as for MapDeadLetter. Schematically:
+//
+//	FilterDeadLetter(Slice<t1, ..., tn>, func(t1, ..., tn) (bool, error), float64) (Slice<t1, ..., tn>, Slice<t1, ..., tn, *MapError>)
+func FilterDeadLetter(slice Slice, pred interface{}, maxFraction float64, prags ...Pragma) (Slice, Slice) {
+	Helper()
+	fn, ok := slicefunc.Of(pred)
+	if !ok {
+		typecheck.Panicf(1, "filterdeadletter: invalid predicate function %T", pred)
+	}
+	if !typecheck.CanApply(fn, slice) {
+		typecheck.Panicf(1, "filterdeadletter: function %T does not match input slice type %s", pred, slicetype.String(slice))
+	}
+	if fn.Out.NumOut() != 2 || fn.Out.Out(0).Kind() != reflect.Bool || fn.Out.Out(1) != typeOfError {
+		typecheck.Panicf(1, "filterdeadletter: predicate %T must return a boolean value and an error", pred)
+	}
+	checkDeadLetter(1, "filterdeadletter", maxFraction, prags)
+	f := Filter(slice, pred, prags...).(*filterSlice)
+	f.name = MakeName("filterdeadletter")
+	f.onErr.route = true
+	f.onErr.maxFraction = maxFraction
+	f.onErr.placeholders = deadLetterPlaceholders(f)
+	return deadLetterSplit(f, 0, "filterdeadletter")
+}
+
+// checkDeadLetter checks the arguments of a dead-letter operation,
+// panicking with a typecheck error, attributed to the caller at the
+// provided depth, if they are invalid.
+func checkDeadLetter(calldepth int, op string, maxFraction float64, prags []Pragma) {
+	if maxFraction < 0 || maxFraction > 1 {
+		typecheck.Panicf(calldepth+1, "%s: invalid maximum error fraction %v", op, maxFraction)
+	}
+	p := Pragmas(prags)
+	_, sampling := sampleErrorsOf(p)
+	_, sinking := deadLetterSinkOf(p)
+	if sampling || sinking {
+		typecheck.Panicf(calldepth+1, "%s: cannot be combined with SampleErrors or DeadLetterSink", op)
+	}
+}
+
+// deadLetterSplit returns the outputs of the provided dead-letter slice,
+// whose rows comprise nout output columns, the columns of the failed
+// row, and its *MapError. Each row fills the columns that it does not
+// use with placeholders (see deadLetterPlaceholders).
+func deadLetterSplit(slice Slice, nout int, op string) (Slice, Slice) {
+	project := func(name Name, slice Slice, from, to int) Slice {
+		cols := make([]int, to-from)
+		types := make([]reflect.Type, to-from)
+		for i := range cols {
+			cols[i] = from + i
+			types[i] = slice.Out(from + i)
+		}
+		return &selectSlice{name, slice, slicetype.New(types...), cols, 1}
+	}
+	var (
+		n    = slice.NumOut()
+		ok   = &branchSlice{MakeName(op + "_ok"), slice, routeDeadLetters, 0, 2}
+		dead = &branchSlice{MakeName(op + "_dead"), slice, routeDeadLetters, 1, 2}
+	)
+	if nout == 0 {
+		// Filters produce the columns of the input row in either case.
+		return project(MakeName(op+"_ok"), ok, 0, n-1), dead
+	}
+	return project(MakeName(op+"_ok"), ok, 0, nout), project(MakeName(op+"_dead"), dead, nout, n)
+}
+
+// routeDeadLetters is the partitioner of the outputs of dead-letter
+// slices: rows with errors are routed to output 1, and all others to
+// output 0.
+func routeDeadLetters(ctx context.Context, f frame.Frame, nshard int, shards []int) {
+	col := f.NumOut() - 1
+	for i := range shards {
+		if f.Index(col, i).Interface().(*MapError).Err == nil {
+			shards[i] = 0
+		} else {
+			shards[i] = 1
+		}
+	}
+}
+
+// deadLetterPlaceholders returns the values with which the unused
+// columns of the rows of a dead-letter slice of the provided type are
+// filled. Pointer columns are filled with pointers to zero values,
+// since nil pointers cannot be encoded; in particular, rows without
+// errors have a *MapError with a nil Err.
+func deadLetterPlaceholders(typ slicetype.Type) []reflect.Value {
+	values := make([]reflect.Value, typ.NumOut())
+	for i := range values {
+		if t := typ.Out(i); t.Kind() == reflect.Ptr {
+			values[i] = reflect.New(t.Elem())
+		} else {
+			values[i] = reflect.Zero(t)
+		}
+	}
+	return values
+}
+
+// routeFailed sets row i of the provided frame of a dead-letter slice
+// to a failed row with the provided column values and error, filling
+// its first nout (output) columns with placeholders.
+func (p *errorPolicy) routeFailed(f frame.Frame, i, nout int, args []reflect.Value, err *MapError) {
+	for j := 0; j < nout; j++ {
+		f.Index(j, i).Set(p.placeholders[j])
+	}
+	for j := range args {
+		f.Index(nout+j, i).Set(args[j])
+	}
+	f.Index(f.NumOut()-1, i).Set(reflect.ValueOf(err))
+}
+
+// routeOK fills the columns of the failed row, and its error, with
+// placeholders in row i of the provided frame of a dead-letter slice,
+// whose first nout (output) columns have been set.
+func (p *errorPolicy) routeOK(f frame.Frame, i, nout int) {
+	for j := nout; j < f.NumOut(); j++ {
+		f.Index(j, i).Set(p.placeholders[j])
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/grailbio/bigslice"
+	"github.com/grailbio/bigslice/exec"
+)
+
+// deadLetterInts returns the ints in [0, n) that are not multiples of
+// 10 (ok) and those that are (dead).
+func deadLetterInts(n int) (all, ok, dead []int) {
+	for i := 0; i < n; i++ {
+		all = append(all, i)
+		if i%10 == 0 {
+			dead = append(dead, i)
+		} else {
+			ok = append(ok, i)
+		}
+	}
+	return
+}
+
+func TestDeadLetterSink(t *testing.T) {
+	const N = 1000
+	var (
+		ctx           = context.Background()
+		all, ok, dead = deadLetterInts(N)
+		mu            sync.Mutex
+		sunk          = make(map[int]string)
+		sink          = func(ctx context.Context, row bigslice.DeadLetterRow) error {
+			mu.Lock()
+			defer mu.Unlock()
+			sunk[row.Values[0].(int)] = row.Err.Err.Error()
+			return nil
+		}
+	)
+	for name, opt := range executors {
+		if testing.Short() && name != "Local" {
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			sess := exec.Start(opt)
+			fn := bigslice.Func(func() bigslice.Slice {
+				slice := bigslice.Const(4, all)
+				return bigslice.Filter(slice, func(i int) (bool, error) {
+					if i%10 == 0 {
+						return false, fmt.Errorf("bad row %d", i)
+					}
+					return true, nil
+				}, bigslice.DeadLetterSink(sink, 0.2))
+			})
+			res, err := sess.Run(ctx, fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ints []int
+			if err = res.Collect(ctx, &ints); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := fmt.Sprint(ints), fmt.Sprint(ok); got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			if got, want := bigslice.DeadLetterRows.Value(res.Scope()), int64(len(dead)); got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if got, want := len(sunk), len(dead); got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			for _, i := range dead {
+				if got, want := sunk[i], fmt.Sprintf("bad row %d", i); got != want {
+					t.Errorf("got %v, want %v", got, want)
+				}
+			}
+		})
+	}
+
+	// A failing sink fails the computation.
+	slice := failingMap(bigslice.DeadLetterSink(func(ctx context.Context, row bigslice.DeadLetterRow) error {
+		return errors.New("sink failed")
+	}, 1))
+	for name, res := range runError(ctx, t, slice) {
+		if res.Err == nil || !strings.Contains(res.Err.Error(), "sink failed") {
+			t.Errorf("%s: got %v, want error", name, res.Err)
+		}
+	}
+
+	// Too many errors fail the computation.
+	slice = failingMap(bigslice.DeadLetterSink(sink, 0.05))
+	for name, res := range runError(ctx, t, slice) {
+		if res.Err == nil || !strings.Contains(res.Err.Error(), "exceeding maximum fraction 0.05") {
+			t.Errorf("%s: got %v, want error", name, res.Err)
+		}
+	}
+}
+
+func TestMapDeadLetter(t *testing.T) {
+	all, ok, dead := deadLetterInts(100)
+	slice := bigslice.Const(4, all)
+	mapped, deadLetters := bigslice.MapDeadLetter(slice, func(i int) (string, int, error) {
+		if i%10 == 0 {
+			return "", 0, fmt.Errorf("bad row %d", i)
+		}
+		return fmt.Sprint(i), i * 2, nil
+	}, 0.2)
+	var (
+		strs    []string
+		doubled []int
+	)
+	for _, i := range ok {
+		strs = append(strs, fmt.Sprint(i))
+		doubled = append(doubled, i*2)
+	}
+	assertEqual(t, mapped, false, strs, doubled)
+
+	errs := make([]string, len(dead))
+	for i := range dead {
+		errs[i] = fmt.Sprintf("bad row %d", dead[i])
+	}
+	deadLetters = bigslice.Map(deadLetters, func(i int, err *bigslice.MapError) (int, string) {
+		return i, err.Err.Error()
+	})
+	assertEqual(t, deadLetters, false, dead, errs)
+}
+
+func TestFilterDeadLetter(t *testing.T) {
+	all, _, dead := deadLetterInts(100)
+	slice := bigslice.Const(4, all)
+	// Even rows are kept, and multiples of 10 fail.
+	even, deadLetters := bigslice.FilterDeadLetter(slice, func(i int) (bool, error) {
+		if i%10 == 0 {
+			return false, fmt.Errorf("bad row %d", i)
+		}
+		return i%2 == 0, nil
+	}, 0.2)
+	var ints []int
+	for _, i := range all {
+		if i%2 == 0 && i%10 != 0 {
+			ints = append(ints, i)
+		}
+	}
+	assertEqual(t, even, false, ints)
+
+	deadLetters = bigslice.Map(deadLetters, func(i int, err *bigslice.MapError) (int, int64) {
+		return i, err.Row
+	})
+	rows := make([]int64, len(dead))
+	for i := range dead {
+		// Const shards have 26 rows each.
+		rows[i] = int64(dead[i] % 26)
+	}
+	assertEqual(t, deadLetters, false, dead, rows)
+}
+
+func TestFilterFuncError(t *testing.T) {
+	slice := bigslice.Filter(bigslice.Const(1, []int{1, 2, 3}), func(i int) (bool, error) {
+		if i == 2 {
+			return false, errors.New("bad row")
+		}
+		return true, nil
+	})
+	for name, res := range runError(context.Background(), t, slice) {
+		if res.Err == nil || !strings.Contains(res.Err.Error(), "shard 0: row 1: bad row") {
+			t.Errorf("%s: got %v, want map error", name, res.Err)
+		}
+	}
+}
+
+func TestDeadLetterType(t *testing.T) {
+	slice := bigslice.Const(1, []int{})
+	expectTypeError(t, "map: DeadLetterSink requires function func(int) string to return an error", func() {
+		bigslice.Map(slice, func(int) string { return "" }, bigslice.DeadLetterSink(func(context.Context, bigslice.DeadLetterRow) error { return nil }, 0))
+	})
+	expectTypeError(t, "mapdeadletter: function func(int) string must return at least one output column and an error", func() {
+		bigslice.MapDeadLetter(slice, func(int) string { return "" }, 0)
+	})
+	expectTypeError(t, "filterdeadletter: predicate func(int) bool must return a boolean value and an error", func() {
+		bigslice.FilterDeadLetter(slice, func(int) bool { return true }, 0)
+	})
+	expectTypeError(t, "mapdeadletter: cannot be combined with SampleErrors or DeadLetterSink", func() {
+		bigslice.MapDeadLetter(slice, func(int) (string, error) { return "", nil }, 0, bigslice.SampleErrors(1, 0))
+	})
+}
@@ -0,0 +1,357 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package decimal implements an exact, fixed-point decimal type that
+// may be used as a Bigslice column type. Unlike floating point
+// columns, decimals represent values such as monetary amounts
+// exactly, and retain their scale (the number of digits after the
+// decimal point) through operations and serialization.
+//
+// Decimals may be used as keys: the package registers frame operations
+// so that decimal columns can be compared, sorted, hashed, and
+// efficiently encoded. Numerically equal decimals compare and hash
+// equally regardless of their scale, so that, e.g., 1.5 and 1.50 are the
+// same key.
+package decimal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/grailbio/bigslice/frame"
+	"github.com/spaolacci/murmur3"
+)
+
+// MaxScale is the maximum scale of a decimal. It is the largest
+// number of fractional digits for which every digit can be represented
+// by a 64-bit unscaled value.
+const MaxScale = 18
+
+// ErrOverflow is returned (or used as a panic value) when the result of
+// an operation cannot be represented by a Decimal.
+var ErrOverflow = errors.New("decimal: overflow")
+
+// pow10 holds powers of 10 up to 10^MaxScale.
+var pow10 [MaxScale + 1]int64
+
+func init() {
+	pow10[0] = 1
+	for i := 1; i < len(pow10); i++ {
+		pow10[i] = pow10[i-1] * 10
+	}
+}
+
+// A Decimal is a fixed-point decimal number, represented by a 64-bit
+// unscaled value and a scale: the value of the decimal is unscaled *
+// 10^-scale. The zero Decimal represents 0 with a scale of 0.
+//
+// Decimals are values and are safe to copy.
+type Decimal struct {
+	unscaled int64
+	scale    uint8
+}
+
+// New returns the decimal unscaled * 10^-scale. New panics if scale is
+// negative or greater than MaxScale.
+func New(unscaled int64, scale int) Decimal {
+	if scale < 0 || scale > MaxScale {
+		panic(fmt.Sprintf("decimal.New: invalid scale %d", scale))
+	}
+	return Decimal{unscaled, uint8(scale)}
+}
+
+// Parse parses a decimal from its string representation: an optional
+// sign followed by decimal digits, optionally containing a decimal
+// point. The scale of the returned decimal is the number of digits
+// following the decimal point, so that Parse("1.50") has scale 2.
+func Parse(s string) (Decimal, error) {
+	orig := s
+	neg := false
+	if len(s) > 0 && (s[0] == '-' || s[0] == '+') {
+		neg = s[0] == '-'
+		s = s[1:]
+	}
+	intPart, fracPart := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		intPart, fracPart = s[:i], s[i+1:]
+	}
+	if intPart == "" && fracPart == "" {
+		return Decimal{}, fmt.Errorf("decimal: invalid syntax %q", orig)
+	}
+	if len(fracPart) > MaxScale {
+		return Decimal{}, fmt.Errorf("decimal: %q exceeds maximum scale %d", orig, MaxScale)
+	}
+	var u uint64
+	for _, c := range intPart + fracPart {
+		if c < '0' || c > '9' {
+			return Decimal{}, fmt.Errorf("decimal: invalid syntax %q", orig)
+		}
+		// The magnitude of the minimum int64 is one larger than that of
+		// the maximum int64.
+		if u > (1<<63)/10 || u*10+uint64(c-'0') > 1<<63 {
+			return Decimal{}, fmt.Errorf("decimal: %q: %v", orig, ErrOverflow)
+		}
+		u = u*10 + uint64(c-'0')
+	}
+	if !neg && u > 1<<63-1 {
+		return Decimal{}, fmt.Errorf("decimal: %q: %v", orig, ErrOverflow)
+	}
+	unscaled := int64(u)
+	if neg {
+		unscaled = -unscaled
+	}
+	return Decimal{unscaled, uint8(len(fracPart))}, nil
+}
+
+// MustParse is like Parse, but panics on error.
+func MustParse(s string) Decimal {
+	d, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// Unscaled returns the unscaled value of d.
+func (d Decimal) Unscaled() int64 { return d.unscaled }
+
+// Scale returns the scale of d.
+func (d Decimal) Scale() int { return int(d.scale) }
+
+// Sign returns -1, 0, or 1 depending on whether d is negative, zero,
+// or positive.
+func (d Decimal) Sign() int {
+	switch {
+	case d.unscaled < 0:
+		return -1
+	case d.unscaled > 0:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// String returns the exact string representation of d, with exactly
+// d.Scale() fractional digits.
+func (d Decimal) String() string {
+	var (
+		u   = new(big.Int).SetInt64(d.unscaled)
+		neg = u.Sign() < 0
+	)
+	digits := u.Abs(u).String()
+	if d.scale > 0 {
+		if pad := int(d.scale) + 1 - len(digits); pad > 0 {
+			digits = strings.Repeat("0", pad) + digits
+		}
+		i := len(digits) - int(d.scale)
+		digits = digits[:i] + "." + digits[i:]
+	}
+	if neg {
+		return "-" + digits
+	}
+	return digits
+}
+
+// Cmp compares d and e, returning -1 if d < e, 0 if d == e, and 1 if
+// d > e. Decimals are compared exactly, regardless of their scale.
+func (d Decimal) Cmp(e Decimal) int {
+	if d.scale == e.scale {
+		switch {
+		case d.unscaled < e.unscaled:
+			return -1
+		case d.unscaled > e.unscaled:
+			return 1
+		default:
+			return 0
+		}
+	}
+	x, y := d.big(), e.big()
+	align(x, y, int(d.scale), int(e.scale))
+	return x.Cmp(y)
+}
+
+// Equal tells whether d and e represent the same number.
+func (d Decimal) Equal(e Decimal) bool { return d.Cmp(e) == 0 }
+
+// Neg returns -d. Neg panics with ErrOverflow when d is the smallest
+// representable unscaled value.
+func (d Decimal) Neg() Decimal {
+	return fromBig(new(big.Int).Neg(d.big()), int(d.scale))
+}
+
+// Add returns d+e, with the larger of their scales. Add panics with
+// ErrOverflow if the result cannot be represented.
+func (d Decimal) Add(e Decimal) Decimal {
+	x, y := d.big(), e.big()
+	scale := align(x, y, int(d.scale), int(e.scale))
+	return fromBig(x.Add(x, y), scale)
+}
+
+// Sub returns d-e, with the larger of their scales. Sub panics with
+// ErrOverflow if the result cannot be represented.
+func (d Decimal) Sub(e Decimal) Decimal {
+	x, y := d.big(), e.big()
+	scale := align(x, y, int(d.scale), int(e.scale))
+	return fromBig(x.Sub(x, y), scale)
+}
+
+// Mul returns d*e. The scale of the product is the sum of the scales
+// of d and e; if this exceeds MaxScale, the product is rounded to
+// MaxScale. Mul panics with ErrOverflow if the result cannot be
+// represented.
+func (d Decimal) Mul(e Decimal) Decimal {
+	x := d.big()
+	x.Mul(x, e.big())
+	scale := int(d.scale) + int(e.scale)
+	if scale > MaxScale {
+		x = roundBig(x, scale-MaxScale)
+		scale = MaxScale
+	}
+	return fromBig(x, scale)
+}
+
+// Round returns d with the provided scale. If scale is smaller than
+// d's scale, the value is rounded half away from zero; for example,
+// 2.345 rounds to 2.35 and -2.345 to -2.35 at scale 2. Round panics if
+// scale is invalid, and with ErrOverflow if the result cannot be
+// represented.
+func (d Decimal) Round(scale int) Decimal {
+	if scale < 0 || scale > MaxScale {
+		panic(fmt.Sprintf("decimal.Round: invalid scale %d", scale))
+	}
+	x := d.big()
+	if scale < int(d.scale) {
+		x = roundBig(x, int(d.scale)-scale)
+	} else {
+		x.Mul(x, big.NewInt(pow10[scale-int(d.scale)]))
+	}
+	return fromBig(x, scale)
+}
+
+// Normalize returns d with trailing fractional zeros removed; that is,
+// the numerically equal decimal with the smallest scale.
+func (d Decimal) Normalize() Decimal {
+	for d.scale > 0 && d.unscaled%10 == 0 {
+		d.unscaled /= 10
+		d.scale--
+	}
+	return d
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler, so that decimals are
+// encoded exactly by gob.
+func (d Decimal) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 9)
+	binary.LittleEndian.PutUint64(b, uint64(d.unscaled))
+	b[8] = d.scale
+	return b, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (d *Decimal) UnmarshalBinary(b []byte) error {
+	if len(b) != 9 || b[8] > MaxScale {
+		return errors.New("decimal: invalid binary encoding")
+	}
+	d.unscaled = int64(binary.LittleEndian.Uint64(b))
+	d.scale = b[8]
+	return nil
+}
+
+func (d Decimal) big() *big.Int {
+	return big.NewInt(d.unscaled)
+}
+
+// align scales the smaller-scaled of x and y (with scales xs and ys,
+// respectively) so that both have the same scale, which is returned.
+func align(x, y *big.Int, xs, ys int) int {
+	switch {
+	case xs < ys:
+		x.Mul(x, big.NewInt(pow10[ys-xs]))
+		return ys
+	case ys < xs:
+		y.Mul(y, big.NewInt(pow10[xs-ys]))
+	}
+	return xs
+}
+
+// roundBig divides x by 10^n, rounding half away from zero.
+func roundBig(x *big.Int, n int) *big.Int {
+	var (
+		div = new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+		q   = new(big.Int)
+		r   = new(big.Int)
+	)
+	q.QuoRem(x, div, r)
+	// Round away from zero if |2r| >= div.
+	r.Abs(r).Lsh(r, 1)
+	if r.Cmp(div) >= 0 {
+		if x.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return q
+}
+
+func fromBig(x *big.Int, scale int) Decimal {
+	if !x.IsInt64() {
+		panic(ErrOverflow)
+	}
+	return Decimal{x.Int64(), uint8(scale)}
+}
+
+func hash(d Decimal, seed uint32) uint32 {
+	// Hash the normalized representation so that numerically equal
+	// decimals hash equally.
+	d = d.Normalize()
+	var b [9]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(d.unscaled))
+	b[8] = d.scale
+	return murmur3.Sum32WithSeed(b[:], seed)
+}
+
+func init() {
+	frame.RegisterOps(func(slice []Decimal) frame.Ops {
+		return frame.Ops{
+			Less:         func(i, j int) bool { return slice[i].Cmp(slice[j]) < 0 },
+			HashWithSeed: func(i int, seed uint32) uint32 { return hash(slice[i], seed) },
+			Encode: func(enc frame.Encoder, i, j int) error {
+				var (
+					unscaled = make([]int64, j-i)
+					scales   = make([]byte, j-i)
+				)
+				for k, d := range slice[i:j] {
+					unscaled[k], scales[k] = d.unscaled, d.scale
+				}
+				if err := enc.Encode(unscaled); err != nil {
+					return err
+				}
+				return enc.Encode(scales)
+			},
+			Decode: func(dec frame.Decoder, i, j int) error {
+				var (
+					unscaled []int64
+					scales   []byte
+				)
+				if err := dec.Decode(&unscaled); err != nil {
+					return err
+				}
+				if err := dec.Decode(&scales); err != nil {
+					return err
+				}
+				if len(unscaled) != j-i || len(scales) != j-i {
+					return errors.New("decimal: bad frame encoding")
+				}
+				for k := range slice[i:j] {
+					slice[i+k] = Decimal{unscaled[k], scales[k]}
+				}
+				return nil
+			},
+		}
+	})
+}
@@ -0,0 +1,185 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package decimal
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/grailbio/bigslice"
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/slicetest"
+)
+
+func TestParseString(t *testing.T) {
+	for _, c := range []struct {
+		in, out  string
+		unscaled int64
+		scale    int
+	}{
+		{"0", "0", 0, 0},
+		{"12.34", "12.34", 1234, 2},
+		{"-12.34", "-12.34", -1234, 2},
+		{"+1.50", "1.50", 150, 2},
+		{".5", "0.5", 5, 1},
+		{"-.05", "-0.05", -5, 2},
+		{"5.", "5", 5, 0},
+		{"-0.000000000000000001", "-0.000000000000000001", -1, MaxScale},
+		{"9223372036854775807", "9223372036854775807", math.MaxInt64, 0},
+		{"-9223372036854775808", "-9223372036854775808", math.MinInt64, 0},
+		{"-9.223372036854775808", "-9.223372036854775808", math.MinInt64, MaxScale},
+	} {
+		d, err := Parse(c.in)
+		if err != nil {
+			t.Errorf("%s: %v", c.in, err)
+			continue
+		}
+		if got, want := d, New(c.unscaled, c.scale); got != want {
+			t.Errorf("%s: got %v, want %v", c.in, got, want)
+		}
+		if got, want := d.String(), c.out; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	for _, bad := range []string{"", "-", ".", "1.2.3", "1e3", "abc", "9223372036854775808", "-9223372036854775809", "0.1234567890123456789"} {
+		if _, err := Parse(bad); err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	for _, c := range []struct {
+		got  Decimal
+		want string
+	}{
+		{MustParse("1.25").Add(MustParse("0.7")), "1.95"},
+		{MustParse("-1.25").Add(MustParse("0.7")), "-0.55"},
+		{MustParse("1").Sub(MustParse("0.001")), "0.999"},
+		{MustParse("-1.5").Mul(MustParse("2.25")), "-3.375"},
+		{MustParse("0.000000001").Mul(MustParse("0.0000000015")), "0.000000000000000002"},
+		{MustParse("-0.000000001").Mul(MustParse("0.0000000015")), "-0.000000000000000002"},
+		{MustParse("2.345").Round(2), "2.35"},
+		{MustParse("-2.345").Round(2), "-2.35"},
+		{MustParse("2.344").Round(2), "2.34"},
+		{MustParse("-2.5").Round(0), "-3"},
+		{MustParse("2.5").Round(4), "2.5000"},
+		{MustParse("-1.2300").Normalize(), "-1.23"},
+		{MustParse("-12").Neg(), "12"},
+	} {
+		if got, want := c.got.String(), c.want; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	for _, fn := range []func(){
+		func() { New(math.MaxInt64, 0).Add(New(1, 0)) },
+		func() { New(math.MinInt64, 0).Neg() },
+		func() { New(math.MaxInt64/2, 0).Mul(New(3, 0)) },
+		func() { New(math.MaxInt64, 0).Round(1) },
+	} {
+		func() {
+			defer func() {
+				if e := recover(); e != ErrOverflow {
+					t.Errorf("got %v, want %v", e, ErrOverflow)
+				}
+			}()
+			fn()
+		}()
+	}
+}
+
+func TestCompareHash(t *testing.T) {
+	var (
+		a = MustParse("1.5")
+		b = MustParse("1.50")
+		c = MustParse("-1.5")
+		d = MustParse("1.500000000000000001")
+	)
+	if !a.Equal(b) || a == b {
+		t.Error("expected equal values of distinct scales")
+	}
+	if got, want := c.Cmp(a), -1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := d.Cmp(a), 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := New(math.MinInt64, 0).Cmp(New(math.MaxInt64, MaxScale)), -1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	typ := reflect.TypeOf(Decimal{})
+	if !frame.CanCompare(typ) || !frame.CanHash(typ) {
+		t.Fatal("decimals must be comparable and hashable")
+	}
+	f := frame.Slices([]Decimal{a, b, c, d})
+	if got, want := f.Hash(0), f.Hash(1); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if f.Hash(0) == f.Hash(2) {
+		t.Error("expected distinct hashes for a and -a")
+	}
+	sort.Sort(f)
+	// a and b are equal, so their relative order is unspecified.
+	sorted := f.Interface(0).([]Decimal)
+	if sorted[0] != c || !sorted[1].Equal(a) || !sorted[2].Equal(a) || sorted[3] != d {
+		t.Errorf("got %v, want [%v %v %v %v]", sorted, c, a, b, d)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	ds := []Decimal{MustParse("-0.01"), MustParse("123.456"), New(math.MinInt64, MaxScale), {}}
+	var b bytes.Buffer
+	enc := sliceio.NewEncodingWriter(&b)
+	if err := enc.Write(context.Background(), frame.Slices(ds)); err != nil {
+		t.Fatal(err)
+	}
+	f := frame.Make(frame.Slices(ds), len(ds), len(ds))
+	n, err := sliceio.NewDecodingReader(&b).Read(context.Background(), f)
+	if err != nil && err != sliceio.EOF {
+		t.Fatal(err)
+	}
+	if got, want := f.Slice(0, n).Interface(0).([]Decimal), ds; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Decimals nested in other values are encoded by gob.
+	type row struct{ D Decimal }
+	b.Reset()
+	if err := gob.NewEncoder(&b).Encode(row{ds[2]}); err != nil {
+		t.Fatal(err)
+	}
+	var r row
+	if err := gob.NewDecoder(&b).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.D, ds[2]; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestReduce(t *testing.T) {
+	slice := bigslice.Const(3,
+		[]Decimal{MustParse("1.5"), MustParse("-2"), MustParse("1.50"), MustParse("-2.000"), MustParse("0.01")},
+		[]Decimal{MustParse("0.10"), MustParse("-1"), MustParse("0.2"), MustParse("-0.001"), MustParse("5")},
+	)
+	slice = bigslice.Reduce(slice, Decimal.Add)
+	var keys, sums []Decimal
+	slicetest.RunAndScan(t, slice, &keys, &sums)
+	got := make(map[string]string)
+	for i := range keys {
+		got[keys[i].Normalize().String()] = sums[i].String()
+	}
+	want := map[string]string{"1.5": "0.30", "-2": "-1.001", "0.01": "5"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
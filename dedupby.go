@@ -0,0 +1,170 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/slicefunc"
+	"github.com/grailbio/bigslice/slicetype"
+	"github.com/grailbio/bigslice/typecheck"
+)
+
+// DedupBy returns a slice that keeps a single row for each key of the
+// provided slice: the row that ranks highest by the provided function
+// better, which reports whether row a is better than row b. The key
+// comprises the columns with the provided indices, or, if keyCols is
+// empty, the slice's prefix columns. The returned slice has the type
+// (and prefix) of the provided slice. Schematically:
+//
+//	DedupBy(Slice<t1, ..., tn>, []int{...}, func(a1 t1, ..., an tn, b1 t1, ..., bn tn) bool) Slice<t1, ..., tn>
+//
+// For example, the latest row of each user, keyed by its first column,
+// is kept by:
+//
+//	DedupBy(events, []int{0}, func(aUser string, aTime int64, bUser string, bTime int64) bool {
+//		return aTime > bTime
+//	})
+//
+// DedupBy is computed like Reduce: the best row so far is the
+// accumulator of each key, which is combined map-side, so that only one
+// candidate row per key survives each partial combination. Since rows
+// are combined in an unspecified order, ties (rows neither of which is
+// better than the other) are broken deterministically by the rows'
+// column values, in column order, keeping the smaller row. Values of
+// numeric and string columns are compared by their natural order;
+// values of other columns by their printed representations.
+//
+// Like Reduce, DedupBy maintains the working set of keys in memory.
+// The provided pragmas apply to both the map-side and the reduce-side
+// tasks of the DedupBy, as better is invoked by both.
+func DedupBy(slice Slice, keyCols []int, better interface{}, prags ...Pragma) Slice {
+	if len(keyCols) == 0 {
+		keyCols = make([]int, slice.Prefix())
+		for i := range keyCols {
+			keyCols[i] = i
+		}
+	}
+	var (
+		seen = make(map[int]bool)
+		keys = make([]reflect.Type, len(keyCols))
+		cols = slicetype.Columns(slice)
+	)
+	for i, col := range keyCols {
+		if col < 0 || col >= slice.NumOut() {
+			typecheck.Panicf(1, "dedupby: key column %d out of range for slice %s", col, slicetype.String(slice))
+		}
+		if seen[col] {
+			typecheck.Panicf(1, "dedupby: duplicate key column %d", col)
+		}
+		seen[col] = true
+		keys[i] = slice.Out(col)
+	}
+	fn, ok := slicefunc.Of(better)
+	ok = ok && !fn.IsVariadic && fn.In.NumOut() == 2*len(cols)
+	for i := 0; ok && i < fn.In.NumOut(); i++ {
+		ok = fn.In.Out(i) == cols[i%len(cols)]
+	}
+	if !ok || fn.Out.NumOut() != 1 || fn.Out.Out(0).Kind() != reflect.Bool {
+		typecheck.Panicf(1, "dedupby: invalid better function %T, expected a function of two rows of slice %s that returns a boolean",
+			better, slicetype.String(slice))
+	}
+	var (
+		rowType  = accumulatorType(cols)
+		valsType = prefixedType{slicetype.New(append(keys, rowType)...), len(keys)}
+		outType  = prefixedType{slicetype.New(cols...), slice.Prefix()}
+		ties     = make([]func(x, y reflect.Value) int, len(cols))
+	)
+	if err := canMakeCombiningFrame(valsType); err != nil {
+		typecheck.Panic(1, err.Error())
+	}
+	for i, typ := range cols {
+		ties[i] = compareFunc(typ)
+	}
+	vals := &mapFrameSlice{MakeName("dedupby_values"), Pragmas(prags), slice, valsType, func(in frame.Frame) frame.Frame {
+		out := frame.Make(valsType, in.Len(), in.Len())
+		for i, col := range keyCols {
+			reflect.Copy(out.Value(i), in.Value(col))
+		}
+		rows := out.Value(len(keyCols))
+		for i := 0; i < in.Len(); i++ {
+			row := rows.Index(i)
+			for col := range cols {
+				row.Field(col).Set(in.Index(col, i))
+			}
+		}
+		return out
+	}}
+	args := func(a, b reflect.Value) []reflect.Value {
+		args := make([]reflect.Value, 2*len(cols))
+		for col := range cols {
+			args[col] = a.Field(col)
+			args[len(cols)+col] = b.Field(col)
+		}
+		return args
+	}
+	best := reflect.MakeFunc(reflect.FuncOf([]reflect.Type{rowType, rowType}, []reflect.Type{rowType}, false),
+		func(rows []reflect.Value) []reflect.Value {
+			a, b := rows[0], rows[1]
+			switch {
+			case fn.Call(context.Background(), args(a, b))[0].Bool():
+				return []reflect.Value{a}
+			case fn.Call(context.Background(), args(b, a))[0].Bool():
+				return []reflect.Value{b}
+			}
+			for col, compare := range ties {
+				if c := compare(a.Field(col), b.Field(col)); c < 0 {
+					return []reflect.Value{a}
+				} else if c > 0 {
+					return []reflect.Value{b}
+				}
+			}
+			return []reflect.Value{a}
+		})
+	combiner, _ := slicefunc.Of(best.Interface())
+	reduced := &reduceSlice{vals, MakeName("dedupby_reduce"), combiner}
+	return &mapFrameSlice{MakeName("dedupby"), Pragmas(prags), reduced, outType, func(in frame.Frame) frame.Frame {
+		out := frame.Make(outType, in.Len(), in.Len())
+		rows := in.Value(len(keyCols))
+		for i := 0; i < in.Len(); i++ {
+			row := rows.Index(i)
+			for col := range cols {
+				out.Index(col, i).Set(row.Field(col))
+			}
+		}
+		return out
+	}}
+}
+
+// compareFunc returns a function that compares values of the provided
+// type, returning a negative number, zero, or a positive number if x is
+// less than, equal to, or greater than y. Values of types that are not
+// ordered are compared by their printed representations.
+func compareFunc(typ reflect.Type) func(x, y reflect.Value) int {
+	if less, err := lessFunc(typ); err == nil {
+		return func(x, y reflect.Value) int {
+			switch {
+			case less(x, y):
+				return -1
+			case less(y, x):
+				return 1
+			}
+			return 0
+		}
+	}
+	return func(x, y reflect.Value) int {
+		xs, ys := fmt.Sprint(x.Interface()), fmt.Sprint(y.Interface())
+		switch {
+		case xs < ys:
+			return -1
+		case xs > ys:
+			return 1
+		}
+		return 0
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/grailbio/bigslice"
+)
+
+func TestDedupBy(t *testing.T) {
+	const N = 1000
+	var (
+		users  = make([]string, N)
+		times  = make([]int, N)
+		scores = make([]float64, N)
+	)
+	for i := range users {
+		users[i] = fmt.Sprint("user", i%7)
+		times[i] = i
+		scores[i] = float64(i % 10)
+	}
+	for nshard := 1; nshard < 5; nshard++ {
+		slice := bigslice.Const(nshard, users, times, scores)
+		// Keep the latest row of each user.
+		latest := bigslice.DedupBy(slice, []int{0}, func(aUser string, aTime int, aScore float64, bUser string, bTime int, bScore float64) bool {
+			return aTime > bTime
+		})
+		if got, want := latest.Name().Op, "dedupby"; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		var (
+			wantUsers  []string
+			wantTimes  []int
+			wantScores []float64
+		)
+		for i := N - 7; i < N; i++ {
+			wantUsers = append(wantUsers, users[i])
+			wantTimes = append(wantTimes, times[i])
+			wantScores = append(wantScores, scores[i])
+		}
+		assertEqual(t, latest, true, wantUsers, wantTimes, wantScores)
+
+		// Keep the highest scoring row of each user. Each user has
+		// several rows with score 9; ties are broken by keeping the row
+		// with the smallest time.
+		best := bigslice.DedupBy(slice, []int{0}, func(aUser string, aTime int, aScore float64, bUser string, bTime int, bScore float64) bool {
+			return aScore > bScore
+		})
+		wantUsers, wantTimes, wantScores = nil, nil, nil
+		for i := 0; i < 7; i++ {
+			// Rows 9, 19, ... have score 9; the first of each user is
+			// the first such row congruent to the user modulo 7.
+			j := 9
+			for j%7 != i {
+				j += 10
+			}
+			wantUsers = append(wantUsers, users[j])
+			wantTimes = append(wantTimes, j)
+			wantScores = append(wantScores, 9)
+		}
+		assertEqual(t, best, true, wantUsers, wantTimes, wantScores)
+	}
+}
+
+func TestDedupByKeyColumns(t *testing.T) {
+	slice := bigslice.Const(2,
+		[]int{1, 2, 3, 4, 5, 6},
+		[]string{"a", "b", "a", "b", "a", "c"},
+		[]int{0, 0, 1, 1, 0, 0},
+	)
+	// Keep the row with the largest first column of each key of the
+	// second and third columns.
+	slice = bigslice.DedupBy(slice, []int{1, 2}, func(a int, _ string, _ int, b int, _ string, _ int) bool {
+		return a > b
+	})
+	slice = bigslice.Map(slice, func(i int, s string, j int) (string, int, int) { return fmt.Sprint(s, j), i, j })
+	assertEqual(t, slice, true,
+		[]string{"a0", "a1", "b0", "b1", "c0"},
+		[]int{5, 3, 2, 4, 6},
+		[]int{0, 1, 0, 1, 0})
+}
+
+func TestDedupByPragma(t *testing.T) {
+	slice := bigslice.Const(2, []string{"a", "b", "a"}, []int{1, 2, 3})
+	slice = bigslice.DedupBy(slice, nil, func(_ string, a int, _ string, b int) bool {
+		return a > b
+	}, bigslice.Procs(2))
+	// The pragmas apply to both the reduce-side and the map-side
+	// tasks.
+	for _, s := range []bigslice.Slice{slice, slice.Dep(0).Dep(0).Slice} {
+		pragma, ok := s.(bigslice.Pragma)
+		if !ok {
+			t.Fatalf("%s does not implement Pragma", s.Name())
+		}
+		if got, want := pragma.Procs(), 2; got != want {
+			t.Errorf("%s: got %v, want %v", s.Name(), got, want)
+		}
+	}
+	assertEqual(t, slice, true, []string{"a", "b"}, []int{3, 2})
+}
+
+func TestDedupByType(t *testing.T) {
+	slice := bigslice.Const(1, []string{}, []int{})
+	expectTypeError(t, "dedupby: key column 2 out of range for slice slice[1]string,int", func() {
+		bigslice.DedupBy(slice, []int{2}, func(string, int, string, int) bool { return false })
+	})
+	expectTypeError(t, "dedupby: duplicate key column 0", func() {
+		bigslice.DedupBy(slice, []int{0, 0}, func(string, int, string, int) bool { return false })
+	})
+	expectTypeError(t, "dedupby: invalid better function func(string, int) bool, expected a function of two rows of slice slice[1]string,int that returns a boolean", func() {
+		bigslice.DedupBy(slice, nil, func(string, int) bool { return false })
+	})
+	expectTypeError(t, "dedupby: invalid better function func(string, int, string, int) int, expected a function of two rows of slice slice[1]string,int that returns a boolean", func() {
+		bigslice.DedupBy(slice, nil, func(string, int, string, int) int { return 0 })
+	})
+}
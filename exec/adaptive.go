@@ -0,0 +1,138 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigslice"
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/sliceio"
+)
+
+// An AdaptiveDecision records the plan chosen for an adaptive slice
+// (see bigslice.AdaptiveSlice) of an invocation.
+type AdaptiveDecision struct {
+	// Small indicates whether the slice's input was measured to be
+	// small, i.e., to have at most the slice's threshold of rows.
+	Small bool
+	// Probe is the index of the invocation that computed the slice's
+	// input, which is read by the slice's plan, or 0 if the input is
+	// the result of a previous invocation.
+	Probe uint64
+}
+
+// adaptiveSlices returns the adaptive slices in the graph of the
+// provided slice, in a deterministic order in which each adaptive slice
+// follows the adaptive slices on which it depends. Slices that are
+// computed by previous invocations are not inspected.
+func adaptiveSlices(slice bigslice.Slice) []bigslice.AdaptiveSlice {
+	var (
+		visited  = make(map[bigslice.Slice]bool)
+		adaptive []bigslice.AdaptiveSlice
+		walk     func(bigslice.Slice)
+	)
+	walk = func(slice bigslice.Slice) {
+		if visited[slice] {
+			return
+		}
+		visited[slice] = true
+		if _, ok := bigslice.Unwrap(slice).(*Result); ok {
+			return
+		}
+		for i := 0; i < slice.NumDep(); i++ {
+			walk(slice.Dep(i).Slice)
+		}
+		if a, ok := slice.(bigslice.AdaptiveSlice); ok {
+			adaptive = append(adaptive, a)
+		}
+	}
+	walk(slice)
+	return adaptive
+}
+
+// rootSlice returns the slice that is computed by the invocation inv,
+// which produced the provided slice: for probe invocations, this is the
+// input of the probed adaptive slice.
+func rootSlice(inv execInvocation, slice bigslice.Slice) (bigslice.Slice, error) {
+	if inv.Env.Probe == 0 {
+		return slice, nil
+	}
+	adaptive := adaptiveSlices(slice)
+	if inv.Env.Probe > len(adaptive) {
+		return nil, fmt.Errorf("invalid probe %d of %d adaptive slices", inv.Env.Probe, len(adaptive))
+	}
+	return adaptive[inv.Env.Probe-1].Input(), nil
+}
+
+// adapt chooses the plans of the adaptive slices of invocation inv,
+// which produced the provided slice, and records them in inv's
+// environment. The input of each adaptive slice is computed by its own
+// (probe) invocation of the same Func, and its rows are counted, up to
+// the slice's threshold, to choose its plan. The probe's results are
+// then read by the plan when inv is compiled.
+func (s *Session) adapt(ctx context.Context, location string, funcv *bigslice.FuncValue, args []interface{}, inv *execInvocation, slice bigslice.Slice) error {
+	for i, a := range adaptiveSlices(slice) {
+		var (
+			input    *Result
+			decision AdaptiveDecision
+		)
+		if result, ok := bigslice.Unwrap(a.Input()).(*Result); ok {
+			input = result
+		} else {
+			probe := makeExecInvocation(funcv.Invocation(location, append([]interface{}(nil), args...)...))
+			probe.Priority = inv.Priority
+			probe.maxTasks, probe.maxDepth = inv.maxTasks, inv.maxDepth
+			probe.Env.Adaptive = append([]AdaptiveDecision(nil), inv.Env.Adaptive...)
+			probe.Env.Probe = i + 1
+			probe.Env.Snapshots = inv.Env.Snapshots
+			probe.Env.Manifests = inv.Env.Manifests
+			probe.Env.Since = inv.Env.Since
+			probe.probes = inv.probes
+			tasks, err := compile(probe, slice, s.machineCombiners)
+			if err != nil {
+				return err
+			}
+			probe.Env.Freeze()
+			if err := Eval(ctx, s.executor, tasks, nil); err != nil {
+				return err
+			}
+			input = &Result{Slice: a.Input(), sess: s, invIndex: probe.Index, tasks: tasks}
+			decision.Probe = probe.Index
+			inv.probes[probe.Index] = input
+		}
+		n, err := countRows(ctx, input, a.Threshold()+1)
+		if err != nil {
+			return errors.E(fmt.Sprintf("%s: measuring input", a.Name()), err)
+		}
+		decision.Small = n <= a.Threshold()
+		inv.Env.Adaptive = append(inv.Env.Adaptive, decision)
+	}
+	return nil
+}
+
+// countRows returns the number of rows of the provided result, reading
+// no more than limit rows.
+func countRows(ctx context.Context, r *Result, limit int) (int, error) {
+	var (
+		reader = r.open()
+		buf    = frame.Make(r, r.sess.chunkSize, r.sess.chunkSize)
+		total  int
+	)
+	defer reader.Close()
+	for total < limit {
+		n, err := reader.Read(ctx, buf)
+		total += n
+		if err == sliceio.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
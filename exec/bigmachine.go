@@ -60,12 +60,12 @@ var retryPolicy = retry.MaxTries(retry.Backoff(5*time.Second, 60*time.Second, 2)
 var fatalErr = errors.E(errors.Fatal)
 
 // DoShuffleReaders determines whether reader tasks should be
-// shuffled in order to avoid potential thundering herd issues.
-// This should only be used in testing when deterministic ordering
-// matters.
+// shuffled in order to avoid potential thundering herd issues. It
+// determines the default read order of sessions with the bigmachine
+// executor: ReadShuffled if true, ReadByShard otherwise.
 //
-// TODO(marius): make this a session option instead.
-var DoShuffleReaders = true
+// Deprecated: use the DepReadOrder session option instead.
+var DoShuffleReaders = false
 
 func init() {
 	gob.Register(&worker{})
@@ -91,6 +91,10 @@ type bigmachineExecutor struct {
 	locations map[*Task]*sliceMachine
 	stats     map[string]stats.Values
 
+	// reattached holds the machines, keyed by address, that store the
+	// outputs of tasks reattached from a previous driver. See Reattach.
+	reattached map[string]*sliceMachine
+
 	// Invocations and invocationDeps are used to track dependencies
 	// between invocations so that we can execute arbitrary graphs of
 	// slices on bigmachine workers. Note that this requires that we
@@ -141,6 +145,7 @@ func (b *bigmachineExecutor) Start(sess *Session) (shutdown func()) {
 	b.b = bigmachine.Start(b.system)
 	b.locations = make(map[*Task]*sliceMachine)
 	b.stats = make(map[string]stats.Values)
+	b.reattached = make(map[string]*sliceMachine)
 	if status := sess.Status(); status != nil {
 		b.status = status.Group(BigmachineStatusGroup)
 	}
@@ -149,11 +154,28 @@ func (b *bigmachineExecutor) Start(sess *Session) (shutdown func()) {
 	b.encodedInvocations = make(map[uint64][]byte)
 	b.worker = &worker{
 		MachineCombiners: sess.machineCombiners,
+		ChunkSize:        sess.chunkSize,
+		ShuffleMemory:    sess.shuffleMemory,
+		ReadOrder:        sess.depReadOrder(defaultBigmachineReadOrder()),
+		Credentials:      sess.credentials,
+		KeyPolicy:        sess.keyPolicy,
+		Codec:            sess.codec,
+		Keys:             sess.keys,
+		CombinerMemory:   sess.combinerMemory,
 	}
 
 	return b.b.Shutdown
 }
 
+// defaultBigmachineReadOrder returns the read order of bigmachine
+// sessions that are not configured by DepReadOrder.
+func defaultBigmachineReadOrder() ReadOrder {
+	if DoShuffleReaders {
+		return ReadShuffled
+	}
+	return ReadByShard
+}
+
 func (b *bigmachineExecutor) manager(i int) *machineManager {
 	b.mu.Lock()
 	defer b.mu.Unlock()
@@ -167,12 +189,80 @@ func (b *bigmachineExecutor) manager(i int) *machineManager {
 			// feasible value; i.e., one task may run on each machine.
 			maxLoad = 0
 		}
-		b.managers[i] = newMachineManager(b.b, b.params, b.status, b.sess.Parallelism(), maxLoad, b.worker)
+		b.managers[i] = newMachineManager(b.b, b.params, b.status, b.sess.Parallelism(), maxLoad, b.sess.budget, b.worker)
+		b.managers[i].events = b.sess.events
+		if policy := b.sess.provisionPolicy; policy != nil {
+			b.managers[i].provisionPolicy = policy
+		}
 		go b.managers[i].Do(backgroundcontext.Get())
 	}
 	return b.managers[i]
 }
 
+// taskCluster returns the cluster (machine manager) on which the
+// provided task runs: the default/shared cluster unless the task's func
+// is exclusive.
+func taskCluster(task *Task) int {
+	if task.Invocation.Exclusive {
+		return int(task.Invocation.Index)
+	}
+	return 0
+}
+
+// taskProcs returns the number of procs requested by the provided task
+// from the provided manager.
+func taskProcs(mgr *machineManager, task *Task) int {
+	procs := task.Pragma.Procs()
+	if task.Pragma.Exclusive() || procs > mgr.machprocs {
+		procs = mgr.machprocs
+	}
+	return procs
+}
+
+// warmMachines implements warmer.
+func (b *bigmachineExecutor) warmMachines(n int, timeout time.Duration) {
+	mgr := b.manager(0)
+	mgr.Warm(n*mgr.machprocs, timeout)
+}
+
+// warmTasks implements warmer.
+func (b *bigmachineExecutor) warmTasks(tasks []*Task, timeout time.Duration) {
+	procs := make(map[int]int)
+	for _, task := range tasks {
+		cluster := taskCluster(task)
+		procs[cluster] += taskProcs(b.manager(cluster), task)
+	}
+	for cluster, n := range procs {
+		b.manager(cluster).Warm(n, timeout)
+	}
+}
+
+// managerStats adds the stats of the executor's machine managers to
+// vals.
+func (b *bigmachineExecutor) managerStats(vals stats.Values) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, mgr := range b.managers {
+		if mgr != nil {
+			mgr.stats.AddAll(vals)
+		}
+	}
+}
+
+// taskLocality returns the locality hints of the provided task, as given
+// by the first of its slices that is a bigslice.LocalitySlice with
+// hints for the task's shard.
+func taskLocality(task *Task) []string {
+	for _, slice := range task.Slices {
+		if l, ok := slice.(bigslice.LocalitySlice); ok {
+			if hints := l.Locality(task.Name.Shard); len(hints) > 0 {
+				return hints
+			}
+		}
+	}
+	return nil
+}
+
 type invocationRef struct{ Index uint64 }
 
 func (b *bigmachineExecutor) compile(ctx context.Context, m *sliceMachine, inv execInvocation) error {
@@ -197,13 +287,41 @@ func (b *bigmachineExecutor) compile(ctx context.Context, m *sliceMachine, inv e
 			}
 			b.invocationDeps[inv.Index][result.invIndex] = true
 		}
+		// Likewise record the probe invocations whose results are read by
+		// the plans of adaptive slices.
+		for _, decision := range inv.Env.Adaptive {
+			if decision.Probe == 0 {
+				continue
+			}
+			if _, ok := b.invocations[decision.Probe]; !ok {
+				b.mu.Unlock()
+				return fmt.Errorf("invalid probe invocation %x", decision.Probe)
+			}
+			if b.invocationDeps[inv.Index] == nil {
+				b.invocationDeps[inv.Index] = make(map[uint64]bool)
+			}
+			b.invocationDeps[inv.Index][decision.Probe] = true
+		}
+		// And the previous invocation whose stages are reused by a
+		// restaged invocation.
+		if restage := inv.Env.Restage; restage != nil {
+			if _, ok := b.invocations[restage.Invocation]; !ok {
+				b.mu.Unlock()
+				return fmt.Errorf("invalid restaged invocation %x", restage.Invocation)
+			}
+			if b.invocationDeps[inv.Index] == nil {
+				b.invocationDeps[inv.Index] = make(map[uint64]bool)
+			}
+			b.invocationDeps[inv.Index][restage.Invocation] = true
+		}
 		b.invocations[inv.Index] = inv
 
-		// gob-encode the invocation, so we can reuse the work of gob-encoding
+		// Encode the invocation, so we can reuse the work of encoding
 		// when sending the invocation to each worker.
 		var buf bytes.Buffer
-		if err := gob.NewEncoder(&buf).Encode(inv); err != nil {
-			return errors.E(errors.Fatal, errors.Invalid, "error gob-encoding invocation", err)
+		if err := encodeInvocation(&buf, b.sess.invEncoding, inv); err != nil {
+			b.mu.Unlock()
+			return err
 		}
 		b.encodedInvocations[inv.Index] = buf.Bytes()
 	}
@@ -265,35 +383,69 @@ func (b *bigmachineExecutor) commit(ctx context.Context, m *sliceMachine, key st
 }
 
 func (b *bigmachineExecutor) Run(task *Task) {
-	task.Status.Print("waiting for a machine")
+	b.RunBatch([]*Task{task})
+}
 
-	// Use the default/shared cluster unless the func is exclusive.
-	var cluster int
-	if task.Invocation.Exclusive {
-		cluster = int(task.Invocation.Index)
+// abandonBatch stops the provided tasks, of the same stage, before they
+// are run because their stage context is done: they fail if their stage
+// was cancelled, and are otherwise marked lost, as their evaluation was
+// abandoned, so that they are resubmitted by any later evaluation that
+// needs them.
+func (b *bigmachineExecutor) abandonBatch(tasks []*Task) {
+	if err := b.sess.stageErr(tasks[0].Name); err != nil {
+		for _, task := range tasks {
+			task.Error(err)
+		}
+		return
 	}
-	mgr := b.manager(cluster)
-	procs := task.Pragma.Procs()
-	if task.Pragma.Exclusive() || procs > mgr.machprocs {
-		procs = mgr.machprocs
+	for _, task := range tasks {
+		task.Set(TaskLost)
 	}
+}
+
+// RunBatch runs the provided tasks, which must be of the same stage,
+// as a single unit of scheduling: the tasks are run in order, on a
+// single machine, by a single call to the worker. The tasks' states
+// and stats are maintained individually. If a task fails, the tasks
+// that follow it in the batch are not run, and are marked lost, so
+// that they are resubmitted by the evaluator. See CoalesceTasks.
+func (b *bigmachineExecutor) RunBatch(tasks []*Task) {
+	// The completion of the batch may allow idle machines to be
+	// released to starved machine pools.
+	defer b.sess.budget.TaskDone()
+	// All tasks of the batch share the scheduling parameters of the
+	// first.
+	task := tasks[0]
+	// Wait for the stage's concurrency limit before asking for a
+	// machine, so that waiting tasks do not hold machine resources.
+	ctx, release, err := b.sess.acquireStage(task)
+	if err != nil {
+		b.abandonBatch(tasks)
+		return
+	}
+	defer release()
+	for _, task := range tasks {
+		task.Status.Print("waiting for a machine")
+	}
+
+	mgr := b.manager(taskCluster(task))
+	procs := taskProcs(mgr, task)
 	var (
-		ctx            = backgroundcontext.Get()
-		offerc, cancel = mgr.Offer(int(task.Invocation.Index), procs)
+		offerc, cancel = mgr.Offer(task.Invocation.Priority, int(task.Invocation.Index), procs, task.Tags, taskLocality(task)...)
 		m              *sliceMachine
 	)
 	select {
 	case <-ctx.Done():
-		task.Error(ctx.Err())
+		b.abandonBatch(tasks)
 		cancel()
 		return
 	case m = <-offerc:
 	}
 	numTasks := m.Stats.Int("tasks")
-	numTasks.Add(1)
+	numTasks.Add(int64(len(tasks)))
 	m.UpdateStatus()
 	defer func() {
-		numTasks.Add(-1)
+		numTasks.Add(-int64(len(tasks)))
 		m.UpdateStatus()
 	}()
 
@@ -319,25 +471,105 @@ compile:
 			// Compilations don't involve invoking user code, nor do they
 			// involve dependencies other than potentially uploading data from
 			// the driver node, so we consider any error to be fatal to the task.
-			task.Errorf("failed to compile invocation on machine %s: %v", m.Addr, err)
+			for _, task := range tasks {
+				task.Errorf("failed to compile invocation on machine %s: %v", m.Addr, err)
+			}
 			m.Done(procs, err)
 			return
 		default:
-			task.Status.Printf("task lost while compiling bigslice.Func: %v", err)
-			task.Set(TaskLost)
+			for _, task := range tasks {
+				task.Status.Printf("task lost while compiling bigslice.Func: %v", err)
+				task.Set(TaskLost)
+			}
 			m.Done(procs, err)
 			return
 		}
 	}
 
-	// Populate the run request. Include the locations of all dependent
+	// Populate the run requests. Include the locations of all dependent
 	// outputs so that the receiving worker can read from them.
+	var (
+		reqs  = make([]taskRunRequest, 0, len(tasks))
+		ready = tasks[:0:0]
+	)
+	g, _ := errgroup.WithContext(ctx)
+	for _, task := range tasks {
+		req, ok := b.runRequest(ctx, g, m, task)
+		if !ok {
+			continue
+		}
+		reqs = append(reqs, req)
+		ready = append(ready, task)
+	}
+	tasks = ready
+	if len(tasks) == 0 {
+		m.Done(procs, nil)
+		return
+	}
+
+	for _, task := range tasks {
+		task.Status.Print(m.Addr)
+	}
+	if err := g.Wait(); err != nil {
+		if stageErr := b.sess.stageErr(task.Name); stageErr != nil {
+			err = stageErr
+		} else {
+			err = fmt.Errorf("failed to commit combiner: %v", err)
+		}
+		for _, task := range tasks {
+			task.Error(err)
+		}
+		m.Done(procs, nil)
+		return
+	}
+
+	// While we're running, also update task stats directly into the tasks's status.
+	// TODO(marius): also aggregate stats across all tasks.
+	statsCtx, statsCancel := context.WithCancel(ctx)
+	for _, task := range tasks {
+		go monitorTaskStats(statsCtx, m, task, b.sess.events)
+		b.sess.tracer.Event(m, task, "B")
+		task.Set(TaskRunning)
+	}
+	if len(tasks) == 1 {
+		var reply taskRunReply
+		err := m.RetryCall(ctx, "Worker.Run", reqs[0], &reply)
+		statsCancel()
+		m.Done(procs, machineErr(ctx, err))
+		b.complete(ctx, m, tasks[0], reply, err)
+		return
+	}
+	var reply taskRunBatchReply
+	err = m.RetryCall(ctx, "Worker.RunBatch", reqs, &reply)
+	statsCancel()
+	m.Done(procs, machineErr(ctx, err))
+	for i, task := range tasks {
+		switch {
+		case err != nil:
+			b.complete(ctx, m, task, taskRunReply{}, err)
+		case i < len(reply.Replies):
+			b.complete(ctx, m, task, reply.Replies[i], nil)
+		case i == len(reply.Replies) && reply.Err != nil:
+			b.complete(ctx, m, task, taskRunReply{}, errors.E(errors.Remote, reply.Err))
+		default:
+			b.sess.tracer.Event(m, task, "E", "error", "not run", "error_type", "lost")
+			task.Status.Printf("not run: task %s of coalesced batch failed", tasks[len(reply.Replies)].Name)
+			task.Set(TaskLost)
+		}
+	}
+}
+
+// runRequest returns the run request for the provided task, to be
+// run on machine m, and schedules the commits of the combiners that
+// the task depends on in g. If a dependency's location is unknown,
+// the task fails and runRequest returns false.
+func (b *bigmachineExecutor) runRequest(ctx context.Context, g *errgroup.Group, m *sliceMachine, task *Task) (taskRunRequest, bool) {
 	req := taskRunRequest{
 		Name:       task.Name,
 		Invocation: task.Invocation.Index,
+		Assignment: b.sess.assignment(task),
 	}
 	machineIndices := make(map[string]int)
-	g, _ := errgroup.WithContext(ctx)
 	for _, dep := range task.Deps {
 		for i := 0; i < dep.NumTask(); i++ {
 			deptask := dep.Task(i)
@@ -346,8 +578,7 @@ compile:
 				// TODO(marius): make this a separate state, or a separate
 				// error type?
 				task.Errorf("task %v has no location", deptask)
-				m.Done(procs, nil)
-				return
+				return req, false
 			}
 			j, ok := machineIndices[depm.Addr]
 			if !ok {
@@ -364,24 +595,23 @@ compile:
 			g.Go(func() error { return b.commit(ctx, depm, key) })
 		}
 	}
+	return req, true
+}
 
-	task.Status.Print(m.Addr)
-	if err := g.Wait(); err != nil {
-		task.Errorf("failed to commit combiner: %v", err)
-		return
+// machineErr returns the error, if any, of a call to a machine made in
+// the provided context that reflects on the machine's health: calls
+// that fail because their context was cancelled, e.g. because their
+// stage was cancelled, are not the machine's fault.
+func machineErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return nil
 	}
+	return err
+}
 
-	// While we're running, also update task stats directly into the tasks's status.
-	// TODO(marius): also aggregate stats across all tasks.
-	statsCtx, statsCancel := context.WithCancel(ctx)
-	go monitorTaskStats(statsCtx, m, task)
-
-	b.sess.tracer.Event(m, task, "B")
-	task.Set(TaskRunning)
-	var reply taskRunReply
-	err := m.RetryCall(ctx, "Worker.Run", req, &reply)
-	statsCancel()
-	m.Done(procs, err)
+// complete completes the provided task, run on machine m, given the
+// reply and error of its run.
+func (b *bigmachineExecutor) complete(ctx context.Context, m *sliceMachine, task *Task, reply taskRunReply, err error) {
 	switch {
 	case err == nil:
 		// Convert nanoseconds to microseconds to be same units as event durations.
@@ -392,10 +622,16 @@ compile:
 		b.setLocation(task, m)
 		task.Status.Printf("done: %s", reply.Vals)
 		task.Scope.Reset(&reply.Scope)
+		task.Lock()
+		task.PartitionSizes = reply.Partitions
+		task.Unlock()
 		task.Set(TaskOk)
 		m.Assign(task)
 	case ctx.Err() != nil:
 		b.sess.tracer.Event(m, task, "E", "error", ctx.Err())
+		if stageErr := b.sess.stageErr(task.Name); stageErr != nil {
+			err = stageErr
+		}
 		task.Error(err)
 	case errors.Is(errors.Remote, err) && errors.Match(fatalErr, err):
 		b.sess.tracer.Event(m, task, "E", "error", err, "error_type", "fatal")
@@ -411,8 +647,14 @@ compile:
 }
 
 // monitorTaskStats monitors stats (e.g. records read/written) of the task
-// running on m, updating task's status until ctx is done.
-func monitorTaskStats(ctx context.Context, m *sliceMachine, task *Task) {
+// running on m, updating task's status and publishing them to events
+// until ctx is done.
+func monitorTaskStats(ctx context.Context, m *sliceMachine, task *Task, events *eventBus) {
+	// The task's status is replaced if it is resubmitted, e.g., when its
+	// output is lost after it has been read by another evaluation.
+	task.Lock()
+	status := task.Status
+	task.Unlock()
 	wait := func() {
 		select {
 		case <-time.After(statsPollInterval):
@@ -427,7 +669,14 @@ func monitorTaskStats(ctx context.Context, m *sliceMachine, task *Task) {
 			wait()
 			continue
 		}
-		task.Status.Printf("%s: %s", m.Addr, *vals)
+		status.Printf("%s: %s", m.Addr, *vals)
+		if events != nil {
+			fields := []interface{}{"machine", m.Addr}
+			for k, v := range *vals {
+				fields = append(fields, k, v)
+			}
+			events.publish(EventTaskStats, task.Name, fields...)
+		}
 		wait()
 	}
 }
@@ -469,6 +718,10 @@ func (b *bigmachineExecutor) Discard(ctx context.Context, task *Task) {
 	task.Set(TaskLost)
 }
 
+func (b *bigmachineExecutor) taskCompletions() *completionQueue {
+	return b.sess.completions
+}
+
 func (b *bigmachineExecutor) Eventer() eventlog.Eventer {
 	return b.sess.eventer
 }
@@ -477,6 +730,52 @@ func (b *bigmachineExecutor) HandleDebug(handler *http.ServeMux) {
 	b.b.HandleDebug(handler)
 }
 
+// TaskAddr implements reattacher.
+func (b *bigmachineExecutor) TaskAddr(task *Task) string {
+	if m := b.location(task); m != nil {
+		return m.Addr
+	}
+	return ""
+}
+
+// reattachTimeout bounds the time taken to verify that a machine
+// stores the output of a reattached task.
+const reattachTimeout = time.Minute
+
+// Reattach implements reattacher. The machine with the provided
+// address is dialed, and must store every partition of the task's
+// output. Reattached machines are not managed by the executor: they
+// serve only the outputs of reattached tasks, and are not used to run
+// new tasks.
+func (b *bigmachineExecutor) Reattach(ctx context.Context, task *Task, addr string) error {
+	ctx, cancel := context.WithTimeout(ctx, reattachTimeout)
+	defer cancel()
+	b.mu.Lock()
+	m := b.reattached[addr]
+	b.mu.Unlock()
+	if m == nil {
+		machine, err := b.b.Dial(ctx, addr)
+		if err != nil {
+			return err
+		}
+		m = &sliceMachine{Machine: machine, Stats: stats.NewMap()}
+	}
+	for partition := 0; partition < task.NumPartition; partition++ {
+		var info sliceInfo
+		if err := m.Call(ctx, "Worker.Stat", taskPartition{task.Name, partition}, &info); err != nil {
+			return err
+		}
+	}
+	b.mu.Lock()
+	if b.reattached[addr] == nil {
+		b.reattached[addr] = m
+	}
+	m = b.reattached[addr]
+	b.locations[task] = m
+	b.mu.Unlock()
+	return nil
+}
+
 // Location returns the machine on which the results of the provided
 // task resides.
 func (b *bigmachineExecutor) location(task *Task) *sliceMachine {
@@ -509,6 +808,29 @@ type worker struct {
 	// MachineCombiners determines whether to use the MachineCombiners
 	// compilation option.
 	MachineCombiners bool
+	// ChunkSize is the session's chunk size. See ChunkSize.
+	ChunkSize int
+	// ShuffleMemory is the session's in-flight shuffle memory budget per
+	// task, or 0 if unlimited. See ShuffleMemory.
+	ShuffleMemory int64
+	// ReadOrder is the order in which tasks read the partitions of
+	// their dependencies. See DepReadOrder.
+	ReadOrder ReadOrder
+	// Credentials is the session's credential provider, if any. See
+	// Credentials.
+	Credentials bigslice.CredentialProvider
+	// KeyPolicy is the session's key policy, carried by the contexts of
+	// the worker's tasks. See KeyPolicy.
+	KeyPolicy frame.KeyPolicy
+	// Codec is the name of the codec with which task outputs are
+	// compressed, if any. See Compression.
+	Codec string
+	// Keys is the key provider with which task outputs are encrypted,
+	// if any. See Encryption.
+	Keys sliceio.KeyProvider
+	// CombinerMemory is the memory budget of each combiner, in bytes, or
+	// 0 if unlimited. See CombinerMemory.
+	CombinerMemory int64
 
 	b     *bigmachine.B
 	store Store
@@ -579,8 +901,8 @@ func (w *worker) Compile(ctx context.Context, invReader io.Reader, _ *struct{})
 		}
 	}()
 	var inv execInvocation
-	if err = gob.NewDecoder(invReader).Decode(&inv); err != nil {
-		return errors.E(errors.Invalid, "error gob-decoding invocation", err)
+	if err = decodeInvocation(invReader, &inv); err != nil {
+		return err
 	}
 	return w.compiles.Do(inv.Index, func() error {
 		// Substitute invocation refs for the results of the invocation.
@@ -597,11 +919,38 @@ func (w *worker) Compile(ctx context.Context, invReader io.Reader, _ *struct{})
 				return fmt.Errorf("worker.Compile: invalid invocation reference %x", ref.Index)
 			}
 		}
+		// Likewise substitute the results of probe invocations, which are
+		// read by the plans of adaptive slices.
+		inv.probes = make(map[uint64]*Result)
+		for _, decision := range inv.Env.Adaptive {
+			if decision.Probe == 0 {
+				continue
+			}
+			w.mu.Lock()
+			result, ok := w.slices[decision.Probe].(*Result)
+			w.mu.Unlock()
+			if !ok {
+				return fmt.Errorf("worker.Compile: invalid probe invocation %x", decision.Probe)
+			}
+			inv.probes[decision.Probe] = result
+		}
+		// And the result of the invocation rerun by a restaged invocation.
+		if restage := inv.Env.Restage; restage != nil {
+			w.mu.Lock()
+			inv.restageFrom, _ = w.slices[restage.Invocation].(*Result)
+			w.mu.Unlock()
+			if inv.restageFrom == nil {
+				return fmt.Errorf("worker.Compile: invalid restaged invocation %x", restage.Invocation)
+			}
+		}
 		slice := inv.Invoke()
 		tasks, err := compile(inv, slice, w.MachineCombiners)
 		if err != nil {
 			return err
 		}
+		if slice, err = rootSlice(inv, slice); err != nil {
+			return err
+		}
 		all := make(map[*Task]bool)
 		for _, task := range tasks {
 			task.all(all)
@@ -639,6 +988,12 @@ type taskRunRequest struct {
 	// fact that the task graph is identical to all viewers: locations
 	// are stored in the order of task dependencies.
 	Locations []int
+
+	// Assignment, if non-nil, is the partition assignment of the
+	// task's stage: the task reads the partitions of each dependency
+	// that are assigned to its shard, instead of the compiled ones. It
+	// is set when the session rebalances partitions. See Rebalance.
+	Assignment []int
 }
 
 func (r *taskRunRequest) location(taskIndex int) string {
@@ -652,6 +1007,20 @@ type taskRunReply struct {
 	// Scope is the scope of the task at completion time.
 	// TODO(marius): unify scopes with values, above.
 	Scope metrics.Scope
+
+	// Partitions holds the measured sizes of the task's output
+	// partitions. It is nil if they were not measured.
+	Partitions []PartitionSize
+}
+
+// taskRunBatchReply is the reply to Worker.RunBatch.
+type taskRunBatchReply struct {
+	// Replies are the replies of the tasks of the batch that completed
+	// successfully, in order.
+	Replies []taskRunReply
+	// Err is the error of the task that failed, if any. It is the task
+	// that follows those with replies; the remaining tasks were not run.
+	Err *errors.Error
 }
 
 // maybeTaskFatalErr wraps errors in (*worker).Run that can cause fatal task
@@ -689,7 +1058,24 @@ func reviseSeverity(err error) error {
 // buffer. If Run returns a *errors.Error with errors.Fatal severity, the task
 // wll be marked in TaskErr, and evaluation will halt.
 func (w *worker) Run(ctx context.Context, req taskRunRequest, reply *taskRunReply) (err error) {
-	var task *Task
+	var (
+		task *Task
+		out  sliceio.Reader
+	)
+	// Clean up the task's readers once the attempt is complete, and
+	// abort any staged side effects if it fails. These are deferred
+	// before the recovery below so that they run after it, and so also
+	// abort attempts that panic; cleanup runs after any abort.
+	defer func() {
+		if out != nil {
+			cleanupOutput(out)
+		}
+	}()
+	defer func() {
+		if err != nil && out != nil {
+			abortOutput(ctx, out)
+		}
+	}()
 	defer func() {
 		if e := recover(); e != nil {
 			stack := debug.Stack()
@@ -697,7 +1083,11 @@ func (w *worker) Run(ctx context.Context, req taskRunRequest, reply *taskRunRepl
 			err = maybeTaskFatalErr{errors.E(err, errors.Fatal)}
 		}
 		if err != nil {
-			log.Error.Printf("task %s error: %v", req.Name, err)
+			if task != nil && len(task.Tags) > 0 {
+				log.Error.Printf("task %s (tags %s) error: %v", req.Name, formatTags(task.Tags), err)
+			} else {
+				log.Error.Printf("task %s error: %v", req.Name, err)
+			}
 			err = reviseSeverity(err)
 			if task != nil {
 				task.Error(errors.Recover(err))
@@ -722,11 +1112,26 @@ func (w *worker) Run(ctx context.Context, req taskRunRequest, reply *taskRunRepl
 	}
 	taskStats := namedStats[req.Name]
 	ctx = metrics.ScopedContext(ctx, &task.Scope)
+	if w.Credentials != nil {
+		ctx = bigslice.CredentialContext(ctx, w.Credentials)
+	}
+	if w.Codec != "" {
+		ctx = sliceio.CodecContext(ctx, w.Codec)
+	}
+	if w.Keys != nil {
+		ctx = sliceio.KeyProviderContext(ctx, w.Keys)
+	}
+	if w.KeyPolicy != (frame.KeyPolicy{}) {
+		ctx = frame.KeyPolicyContext(ctx, w.KeyPolicy)
+	}
 
 	defer func() {
 		reply.Vals = make(stats.Values)
 		taskStats.AddAll(reply.Vals)
 		reply.Scope.Reset(&task.Scope)
+		task.Lock()
+		reply.Partitions = task.PartitionSizes
+		task.Unlock()
 	}()
 
 	task.Lock()
@@ -751,6 +1156,7 @@ func (w *worker) Run(ctx context.Context, req taskRunRequest, reply *taskRunRepl
 		return err
 	}
 	task.state = TaskRunning
+	task.PartitionSizes = nil
 	task.Unlock()
 	// Gather inputs from the bigmachine cluster, dialing machines
 	// as necessary.
@@ -778,15 +1184,25 @@ func (w *worker) Run(ctx context.Context, req taskRunRequest, reply *taskRunRepl
 	var (
 		in        = make([]sliceio.Reader, 0, len(task.Deps))
 		taskIndex int
+		shuffle   *shuffleBuffer
 	)
+	if w.ShuffleMemory > 0 && len(task.Deps) > 0 {
+		shuffle = newShuffleBuffer(w.ShuffleMemory, taskChunkSize(task, w.ChunkSize), taskStats.Int("shuffleSpillBytes"))
+		defer shuffle.Cleanup()
+	}
+	assigned := assignedPartitions(req.Assignment, task.Name.Shard)
 	for _, dep := range task.Deps {
+		partitions := depPartitions(dep, assigned)
 		// If the dependency has a combine key, they are combined on the
 		// machine, and we de-dup the dependencies.
 		//
 		// The caller of has already ensured that the combiner buffers
 		// are committed on the machines.
 		if dep.CombineKey != "" {
-			locations := make(map[string]bool)
+			var (
+				locations = make(map[string]bool)
+				addrs     []string
+			)
 			for i := 0; i < dep.NumTask(); i++ {
 				addr := req.location(taskIndex)
 				taskIndex++
@@ -803,75 +1219,99 @@ func (w *worker) Run(ctx context.Context, req taskRunRequest, reply *taskRunRepl
 					continue
 				}
 				locations[addr] = true
+				addrs = append(addrs, addr)
 			}
-			for addr := range locations {
+			if w.ReadOrder == ReadShuffled {
+				rand.Shuffle(len(addrs), func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] })
+			}
+			for _, addr := range addrs {
 				machine, err := w.b.Dial(ctx, addr)
 				if err != nil {
 					return err
 				}
-				r := newMachineReader(machine, taskPartition{TaskName{Op: dep.CombineKey}, dep.Partition})
-				in = append(in, &statsReader{r, []*stats.Int{taskRecordsIn, recordsIn}, taskReadDuration})
-				defer r.Close()
+				for _, partition := range partitions {
+					r := newMachineReader(machine, taskPartition{TaskName{Op: dep.CombineKey}, partition})
+					in = append(in, &statsReader{r, []*stats.Int{taskRecordsIn, recordsIn}, taskReadDuration})
+					defer r.Close()
+				}
 			}
 		} else {
-			reader := new(multiReader)
-			reader.q = make([]sliceio.Reader, dep.NumTask())
-		Tasks:
-			for j := 0; j < dep.NumTask(); j++ {
-				deptask := dep.Task(j)
-				// If we have it locally, or if we're using a shared backend store
-				// (e.g., S3), then read it directly.
-				info, err := w.store.Stat(ctx, deptask.Name, dep.Partition)
-				if err == nil {
-					rc, openErr := w.store.Open(ctx, deptask.Name, dep.Partition, 0)
-					if openErr == nil {
-						defer rc.Close()
-						r := sliceio.NewDecodingReader(rc)
-						reader.q[j] = &statsReader{r, []*stats.Int{taskRecordsIn, recordsIn}, taskReadDuration}
-						taskTotalRecordsIn.Add(info.Records)
-						totalRecordsIn.Add(info.Records)
-						taskIndex++
-						continue Tasks
+			q := make([]sliceio.Reader, 0, dep.NumTask()*len(partitions))
+			// Each partition is read from every task of the
+			// dependency; locations are indexed by task.
+			depIndex := taskIndex
+			taskIndex += dep.NumTask()
+			for _, partition := range partitions {
+			Tasks:
+				for j := 0; j < dep.NumTask(); j++ {
+					deptask := dep.Task(j)
+					// If we have it locally, or if we're using a shared backend store
+					// (e.g., S3), then read it directly.
+					info, err := w.store.Stat(ctx, deptask.Name, partition)
+					if err == nil {
+						rc, openErr := w.store.Open(ctx, deptask.Name, partition, 0)
+						if openErr == nil {
+							defer rc.Close()
+							r := sliceio.NewDecodingReader(rc)
+							q = append(q, &statsReader{r, []*stats.Int{taskRecordsIn, recordsIn}, taskReadDuration})
+							taskTotalRecordsIn.Add(info.Records)
+							totalRecordsIn.Add(info.Records)
+							continue Tasks
+						}
 					}
+					// Find the location of the task.
+					addr := req.location(depIndex + j)
+					machine, err := w.b.Dial(ctx, addr)
+					if err != nil {
+						return err
+					}
+					tp := taskPartition{deptask.Name, partition}
+					if err := machine.RetryCall(ctx, "Worker.Stat", tp, &info); err != nil {
+						return err
+					}
+					r := newMachineReader(machine, tp)
+					q = append(q, &statsReader{r, []*stats.Int{taskRecordsIn, recordsIn}, taskReadDuration})
+					taskTotalRecordsIn.Add(info.Records)
+					totalRecordsIn.Add(info.Records)
+					defer r.Close()
 				}
-				// Find the location of the task.
-				addr := req.location(taskIndex)
-				taskIndex++
-				machine, err := w.b.Dial(ctx, addr)
-				if err != nil {
-					return err
-				}
-				tp := taskPartition{deptask.Name, dep.Partition}
-				if err := machine.RetryCall(ctx, "Worker.Stat", tp, &info); err != nil {
-					return err
-				}
-				r := newMachineReader(machine, tp)
-				reader.q[j] = &statsReader{r, []*stats.Int{taskRecordsIn, recordsIn}, taskReadDuration}
-				taskTotalRecordsIn.Add(info.Records)
-				totalRecordsIn.Add(info.Records)
-				defer r.Close()
 			}
-			// We shuffle the tasks here so that we don't encounter
-			// "thundering herd" issues were partitions are read sequentially
-			// from the same (ordered) list of machines.
+			// Readers are listed by partition and producer shard index;
+			// the session's read order may shuffle them so that we don't
+			// encounter "thundering herd" issues where partitions are
+			// read sequentially from the same (ordered) list of machines.
 			//
 			// TODO(marius): possibly we should perform proper load balancing
 			// here
-			if DoShuffleReaders {
-				rand.Shuffle(len(reader.q), func(i, j int) { reader.q[i], reader.q[j] = reader.q[j], reader.q[i] })
+			orderReaders(w.ReadOrder, q)
+			// Fetch the partitions within the task's shuffle memory
+			// budget, spilling the remainder, before they are merged.
+			if shuffle != nil {
+				for i, r := range q {
+					if q[i], err = shuffle.Buffer(ctx, dep.Head, r); err != nil {
+						return err
+					}
+				}
 			}
 			if dep.Expand {
-				in = append(in, reader.q...)
+				in = append(in, q...)
 			} else {
-				in = append(in, reader)
+				r := mergeReaders(w.ReadOrder, dep.Head, taskChunkSize(task, w.ChunkSize), q)
+				defer r.Close()
+				in = append(in, r)
 			}
 		}
 	}
 
+	out = task.Do(in)
+
 	// If we have a combiner, then we partition globally for the machine
 	// into common combiners.
 	if !task.Combiner.IsNil() {
-		return w.runCombine(ctx, task, taskStats, task.Do(in))
+		if err := w.runCombine(ctx, task, taskStats, out); err != nil {
+			return err
+		}
+		return commitOutput(ctx, out)
 	}
 
 	// Stream partition output directly to the underlying store, but
@@ -882,8 +1322,10 @@ func (w *worker) Run(ctx context.Context, req taskRunRequest, reply *taskRunRepl
 	// instead once we also have memory management, in order to control
 	// buffer growth.
 	type partition struct {
-		wc  writeCommitter
-		buf *bufio.Writer
+		wc    writeCommitter
+		buf   *bufio.Writer
+		bytes countingWriter
+		enc   *sliceio.Encoder
 		sliceio.Writer
 	}
 	partitions := make([]*partition, task.NumPartition)
@@ -895,9 +1337,13 @@ func (w *worker) Run(ctx context.Context, req taskRunRequest, reply *taskRunRepl
 		// TODO(marius): pool the writers so we can reuse them.
 		part := new(partition)
 		part.wc = wc
-		part.buf = bufio.NewWriter(wc)
-		part.Writer = &statsWriter{sliceio.NewEncodingWriter(part.buf), taskWriteDuration}
+		part.bytes.w = wc
+		part.buf = bufio.NewWriter(&part.bytes)
 		partitions[p] = part
+		if part.enc, err = sliceio.NewEncryptingWriter(ctx, part.buf, w.Codec, w.Keys); err != nil {
+			return err
+		}
+		part.Writer = &statsWriter{part.enc, taskWriteDuration}
 	}
 	defer func() {
 		for _, part := range partitions {
@@ -907,8 +1353,8 @@ func (w *worker) Run(ctx context.Context, req taskRunRequest, reply *taskRunRepl
 			part.wc.Discard(ctx)
 		}
 	}()
-	out := task.Do(in)
 	count := make([]int64, task.NumPartition)
+	chunkSize := taskChunkSize(task, w.ChunkSize)
 	switch {
 	case task.NumOut() == 0:
 		// If there are no output columns, just drive the computation.
@@ -916,18 +1362,21 @@ func (w *worker) Run(ctx context.Context, req taskRunRequest, reply *taskRunRepl
 		if err != nil && err != sliceio.EOF {
 			return maybeTaskFatalErr{err}
 		}
-		return nil
+		return commitOutput(ctx, out)
 	case task.NumPartition > 1:
-		var psize = *defaultChunksize / 100
+		var psize = chunkSize / 100
+		if psize < 1 {
+			psize = 1
+		}
 		var (
 			partitionv = make([]frame.Frame, task.NumPartition)
 			lens       = make([]int, task.NumPartition)
-			shards     = make([]int, *defaultChunksize)
+			shards     = make([]int, chunkSize)
 		)
 		for i := range partitionv {
 			partitionv[i] = frame.Make(task, psize, psize)
 		}
-		in := frame.Make(task, *defaultChunksize, *defaultChunksize)
+		in := frame.Make(task, chunkSize, chunkSize)
 		for {
 			n, err := out.Read(ctx, in)
 			if err != nil && err != sliceio.EOF {
@@ -964,7 +1413,7 @@ func (w *worker) Run(ctx context.Context, req taskRunRequest, reply *taskRunRepl
 			}
 		}
 	default:
-		in := frame.Make(task, *defaultChunksize, *defaultChunksize)
+		in := frame.Make(task, chunkSize, chunkSize)
 		for {
 			n, err := out.Read(ctx, in)
 			if err != nil && err != sliceio.EOF {
@@ -982,7 +1431,11 @@ func (w *worker) Run(ctx context.Context, req taskRunRequest, reply *taskRunRepl
 		}
 	}
 
+	sizes := make([]PartitionSize, len(partitions))
 	for i, part := range partitions {
+		if err := part.enc.Close(); err != nil {
+			return err
+		}
 		if err := part.buf.Flush(); err != nil {
 			return err
 		}
@@ -990,8 +1443,32 @@ func (w *worker) Run(ctx context.Context, req taskRunRequest, reply *taskRunRepl
 		if err := part.wc.Commit(ctx, count[i]); err != nil {
 			return err
 		}
+		sizes[i] = PartitionSize{Records: count[i], Bytes: part.bytes.n}
 	}
 	partitions = nil
+	if err := commitOutput(ctx, out); err != nil {
+		return err
+	}
+	task.Lock()
+	task.PartitionSizes = sizes
+	task.Unlock()
+	return nil
+}
+
+// RunBatch runs the tasks of the provided requests, in order, as by
+// Run, stopping at the first task that fails.
+func (w *worker) RunBatch(ctx context.Context, reqs []taskRunRequest, reply *taskRunBatchReply) error {
+	for _, req := range reqs {
+		var r taskRunReply
+		if err := w.Run(ctx, req, &r); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			reply.Err = errors.Recover(err)
+			return nil
+		}
+		reply.Replies = append(reply.Replies, r)
+	}
 	return nil
 }
 
@@ -1062,7 +1539,7 @@ func (w *worker) runCombine(ctx context.Context, task *Task, taskStats *stats.Ma
 	case combinerNone:
 		combiners := make([]chan *combiner, task.NumPartition)
 		for i := range combiners {
-			comb, combErr := newCombiner(task, fmt.Sprintf("%s%d", combineKey, i), task.Combiner, *defaultChunksize*100)
+			comb, combErr := newCombiner(task, fmt.Sprintf("%s%d", combineKey, i), task.Combiner, *defaultChunksize*100, w.CombinerMemory, w.KeyPolicy)
 			if combErr != nil {
 				w.mu.Unlock()
 				for j := 0; j < i; j++ {
@@ -1112,8 +1589,9 @@ func (w *worker) runCombine(ctx context.Context, task *Task, taskStats *stats.Ma
 	// preconfigured threshold.)
 	var (
 		partitionCombiner = make([]*combiningFrame, task.NumPartition)
-		out               = frame.Make(task, *defaultChunksize, *defaultChunksize)
-		shards            = make([]int, *defaultChunksize)
+		chunkSize         = taskChunkSize(task, w.ChunkSize)
+		out               = frame.Make(task, chunkSize, chunkSize)
+		shards            = make([]int, chunkSize)
 	)
 	for i := range partitionCombiner {
 		partitionCombiner[i] = makeCombiningFrame(task, task.Combiner, 8, 1)
@@ -1233,12 +1711,20 @@ func (w *worker) writeCombiner(key TaskName) {
 				return err
 			}
 			buf := bufio.NewWriter(wc)
-			enc := sliceio.NewEncodingWriter(buf)
+			enc, err := sliceio.NewEncryptingWriter(ctx, buf, w.Codec, w.Keys)
+			if err != nil {
+				wc.Discard(ctx)
+				return err
+			}
 			n, err := combiner.WriteTo(ctx, enc)
 			if err != nil {
 				wc.Discard(ctx)
 				return err
 			}
+			if err := enc.Close(); err != nil {
+				wc.Discard(ctx)
+				return err
+			}
 			if err := buf.Flush(); err != nil {
 				wc.Discard(ctx)
 				return err
@@ -1372,6 +1858,10 @@ type openerAtReader struct {
 	// Read will be revised with respect to task errors (i.e. should errors be
 	// considered task-fatal?).
 	ReviseSeverity bool
+	// Keys is the key provider with which encrypted data are read, if
+	// it is not carried by the context of the read (see
+	// sliceio.KeyProviderContext).
+	Keys sliceio.KeyProvider
 
 	readCloser    io.ReadCloser
 	sliceioReader sliceio.Reader
@@ -1379,6 +1869,9 @@ type openerAtReader struct {
 
 // Read implements sliceio.Reader.
 func (r *openerAtReader) Read(ctx context.Context, f frame.Frame) (int, error) {
+	if r.Keys != nil && sliceio.ContextKeyProvider(ctx) == nil {
+		ctx = sliceio.KeyProviderContext(ctx, r.Keys)
+	}
 	if r.readCloser == nil {
 		r.readCloser = newRetryReader(ctx, r.OpenerAt)
 		r.sliceioReader = sliceio.NewDecodingReader(r.readCloser)
@@ -1491,6 +1984,7 @@ func newEvalReader(executor *bigmachineExecutor, task *Task, partition int) *ope
 			Partition: partition,
 		},
 		ReviseSeverity: false,
+		Keys:           executor.sess.keys,
 	}
 }
 
@@ -1514,12 +2008,32 @@ func (s *statsReader) Read(ctx context.Context, f frame.Frame) (int, error) {
 	return n, err
 }
 
+// Close closes the underlying reader, if it is an io.Closer.
+func (s *statsReader) Close() error {
+	if c, ok := s.reader.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
 func truncatef(v interface{}) string {
 	b := limitbuf.NewLogger(512)
 	fmt.Fprint(b, v)
 	return b.String()
 }
 
+// countingWriter counts the bytes written to the underlying writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
 type statsWriter struct {
 	writer          sliceio.Writer
 	writeDurationNs *stats.Int
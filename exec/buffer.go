@@ -86,6 +86,18 @@ func (r *taskBufferReader) Close() error {
 	return nil
 }
 
+// Sizes returns the number of records in each partition of the
+// taskBuffer.
+func (b taskBuffer) Sizes() []PartitionSize {
+	sizes := make([]PartitionSize, len(b))
+	for p, frames := range b {
+		for _, f := range frames {
+			sizes[p].Records += int64(f.Len())
+		}
+	}
+	return sizes
+}
+
 // Reader returns a Reader for a partition of the taskBuffer.
 func (b taskBuffer) Reader(partition int) sliceio.ReadCloser {
 	if len(b) == 0 {
@@ -0,0 +1,146 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import "sort"
+
+// CoalesceTasks configures the session to coalesce small tasks of the
+// same stage that are runnable at the same time into batches of up to
+// maxTasks tasks. Each batch is run as a single unit of scheduling: it
+// is placed on a single machine and its tasks are run there
+// sequentially, in shard order, by a single call to the worker. This
+// amortizes per-task scheduling and RPC overhead, which dominates the
+// runtime of stages with many tiny shards. If maxBytes is positive,
+// the estimated input size of a batch, summed over its tasks, is at
+// most maxBytes, and tasks whose estimated input exceeds it are run
+// alone. A task's input size is estimated from the measured sizes of
+// the partitions that it reads; tasks without measured inputs (e.g.,
+// those reading sources) are estimated to be empty.
+//
+// Coalescing does not change the compiled task graph: each task still
+// computes a single shard, with its own output, state, and stats, and
+// its output is read by its dependents as usual. Tasks are
+// individually retried: if a task of a batch fails, the tasks that
+// follow it are not run, and are resubmitted as lost, with the failed
+// task if it is retriable, possibly in different batches; the tasks
+// that completed before it are unaffected. Coalescing applies only to
+// executors that run tasks remotely (i.e., Bigmachine).
+func CoalesceTasks(maxTasks int, maxBytes int64) Option {
+	if maxTasks < 1 {
+		panic("exec.CoalesceTasks: maxTasks < 1")
+	}
+	return func(s *Session) {
+		s.coalesceTasks = maxTasks
+		s.coalesceBytes = maxBytes
+	}
+}
+
+// A batchExecutor is an Executor that can run multiple tasks of the
+// same stage as a single unit of scheduling.
+type batchExecutor interface {
+	Executor
+	// Coalescing returns the maximum number of tasks, and the maximum
+	// estimated input size, of a batch. Tasks are not coalesced if the
+	// maximum number of tasks is less than 2.
+	Coalescing() (maxTasks int, maxBytes int64)
+	// RunBatch runs the provided tasks, which are of the same stage, as
+	// by Run.
+	RunBatch([]*Task)
+}
+
+// Coalescing implements batchExecutor.
+func (b *bigmachineExecutor) Coalescing() (maxTasks int, maxBytes int64) {
+	return b.sess.coalesceTasks, b.sess.coalesceBytes
+}
+
+// dispatch runs the provided tasks with the provided executor,
+// coalescing them into batches if the executor supports it.
+func dispatch(executor Executor, tasks []*Task) {
+	batcher, ok := executor.(batchExecutor)
+	if !ok {
+		for _, task := range tasks {
+			go executor.Run(task)
+		}
+		return
+	}
+	maxTasks, maxBytes := batcher.Coalescing()
+	for _, batch := range coalesce(tasks, maxTasks, maxBytes) {
+		if len(batch) == 1 {
+			go executor.Run(batch[0])
+		} else {
+			go batcher.RunBatch(batch)
+		}
+	}
+}
+
+// coalesce groups the provided tasks into batches of tasks of the same
+// stage, ordered by shard, with at most maxTasks tasks and, if maxBytes
+// is positive, at most maxBytes of estimated input.
+func coalesce(tasks []*Task, maxTasks int, maxBytes int64) [][]*Task {
+	if maxTasks < 2 {
+		batches := make([][]*Task, len(tasks))
+		for i, task := range tasks {
+			batches[i] = []*Task{task}
+		}
+		return batches
+	}
+	type stage struct {
+		inv uint64
+		op  string
+	}
+	var (
+		stages  []stage
+		byStage = make(map[stage][]*Task)
+	)
+	for _, task := range tasks {
+		key := stage{task.Name.InvIndex, task.Name.Op}
+		if _, ok := byStage[key]; !ok {
+			stages = append(stages, key)
+		}
+		byStage[key] = append(byStage[key], task)
+	}
+	var batches [][]*Task
+	for _, key := range stages {
+		tasks := byStage[key]
+		sort.Slice(tasks, func(i, j int) bool {
+			return tasks[i].Name.Shard < tasks[j].Name.Shard
+		})
+		var (
+			batch []*Task
+			size  int64
+		)
+		for _, task := range tasks {
+			est := estimateInputSize(task)
+			if len(batch) > 0 && (len(batch) == maxTasks || maxBytes > 0 && size+est > maxBytes) {
+				batches = append(batches, batch)
+				batch, size = nil, 0
+			}
+			batch = append(batch, task)
+			size += est
+		}
+		if len(batch) > 0 {
+			batches = append(batches, batch)
+		}
+	}
+	return batches
+}
+
+// estimateInputSize returns the estimated size of the input of the
+// provided task, in bytes: the sum of the measured sizes of the
+// partitions of its dependencies that it reads.
+func estimateInputSize(task *Task) int64 {
+	var size int64
+	for _, dep := range task.Deps {
+		for i := 0; i < dep.NumTask(); i++ {
+			deptask := dep.Task(i)
+			deptask.Lock()
+			if dep.Partition < len(deptask.PartitionSizes) {
+				size += deptask.PartitionSizes[dep.Partition].Bytes
+			}
+			deptask.Unlock()
+		}
+	}
+	return size
+}
@@ -0,0 +1,112 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/grailbio/bigmachine/testsystem"
+	"github.com/grailbio/bigslice"
+)
+
+func TestCoalesce(t *testing.T) {
+	// Two stages; the tasks of stage "b" read partitions of sizes 10, 20,
+	// 30, and 40 bytes.
+	dep := &Task{
+		Name:           TaskName{Op: "a", NumShard: 1},
+		PartitionSizes: []PartitionSize{{Bytes: 10}, {Bytes: 20}, {Bytes: 30}, {Bytes: 40}},
+	}
+	var tasks []*Task
+	for shard := 3; shard >= 0; shard-- {
+		tasks = append(tasks, &Task{
+			Name: TaskName{Op: "b", Shard: shard, NumShard: 4},
+			Deps: []TaskDep{{Head: dep, Partition: shard}},
+		})
+	}
+	for shard := 0; shard < 3; shard++ {
+		tasks = append(tasks, &Task{Name: TaskName{Op: "c", Shard: shard, NumShard: 3}})
+	}
+	shards := func(batches [][]*Task) [][]string {
+		var names [][]string
+		for _, batch := range batches {
+			var b []string
+			for _, task := range batch {
+				b = append(b, task.Name.String())
+			}
+			names = append(names, b)
+		}
+		return names
+	}
+	for _, c := range []struct {
+		maxTasks int
+		maxBytes int64
+		want     [][]int
+	}{
+		{1, 0, [][]int{{0}, {1}, {2}, {3}, {4}, {5}, {6}}},
+		{2, 0, [][]int{{3, 2}, {1, 0}, {4, 5}, {6}}},
+		{8, 0, [][]int{{3, 2, 1, 0}, {4, 5, 6}}},
+		{8, 50, [][]int{{3, 2}, {1}, {0}, {4, 5, 6}}},
+	} {
+		var want [][]*Task
+		for _, batch := range c.want {
+			var b []*Task
+			for _, i := range batch {
+				b = append(b, tasks[i])
+			}
+			want = append(want, b)
+		}
+		if got, want := shards(coalesce(tasks, c.maxTasks, c.maxBytes)), shards(want); !reflect.DeepEqual(got, want) {
+			t.Errorf("coalesce(%d, %d): got %v, want %v", c.maxTasks, c.maxBytes, got, want)
+		}
+	}
+}
+
+func TestCoalesceTasks(t *testing.T) {
+	const N, Nshard = 1000, 32
+	var (
+		ctx = context.Background()
+		fn  = bigslice.Func(func() bigslice.Slice {
+			slice := bigslice.Const(Nshard, rangeSlice(0, N))
+			slice = bigslice.Map(slice, func(i int) (int, int) { return i % 10, i })
+			return bigslice.Reshuffle(slice)
+		})
+	)
+	sess := Start(Bigmachine(testsystem.New()), CoalesceTasks(8, 0))
+	defer sess.Shutdown()
+	res, err := sess.Run(ctx, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys, vals []int
+	if err := res.Collect(ctx, &keys, &vals); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(keys), N; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	var sum int
+	for _, v := range vals {
+		sum += v
+	}
+	if got, want := sum, N*(N-1)/2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Each task retains its own stats.
+	var ntask int
+	_ = iterTasks(res.tasks, func(task *Task) error {
+		if len(task.Deps) == 0 {
+			ntask++
+			if len(task.PartitionSizes) == 0 {
+				t.Errorf("task %s: no partition sizes", task.Name)
+			}
+		}
+		return nil
+	})
+	if got, want := ntask, Nshard; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/grailbio/base/data"
 	"github.com/grailbio/base/log"
 	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/metrics"
 	"github.com/grailbio/bigslice/slicefunc"
 	"github.com/grailbio/bigslice/sliceio"
 	"github.com/grailbio/bigslice/slicetype"
@@ -28,6 +29,14 @@ var (
 	combineDiskSpills    = expvar.NewInt("combinediskspills")
 )
 
+// CombinerSpills counts the number of times that combiners exceeded
+// their in-memory budget (see CombinerMemory) and spilled a sorted run
+// of their keys to disk. A nonzero count indicates that keys were
+// grouped externally, by merging the sorted runs, instead of entirely
+// in memory. Spills are counted in the scope of the task that combines
+// the rows.
+var CombinerSpills = metrics.NewCounter()
+
 var (
 	combiningFrameInitSize    = defaultChunksize
 	combiningFrameScratchSize = defaultChunksize
@@ -233,17 +242,38 @@ type combiner struct {
 	spiller    sliceio.Spiller
 	name       string
 	total      int
+
+	// memoryLimit is the budget, in bytes, for the in-memory hash
+	// table, or 0 if it is limited only by targetSize. RowSize is the
+	// fixed size of a row of the table; varBytes and varRows estimate
+	// the variable size (strings and byte slices) of combined rows.
+	memoryLimit       int64
+	rowSize           int64
+	varBytes, varRows int64
+
+	// policy is the key policy by which combined rows are sorted.
+	policy frame.KeyPolicy
 }
 
 // NewCombiner creates a new combiner with the given type, name,
-// combiner, and target in-memory size (rows). Combiners can be
-// safely accessed concurrently.
-func newCombiner(typ slicetype.Type, name string, comb slicefunc.Func, targetSize int) (*combiner, error) {
+// combiner, and target in-memory size (rows). If memoryLimit is
+// nonzero, the combiner also spills when the estimated memory used by
+// its in-memory hash table exceeds memoryLimit bytes. Rows are sorted
+// by the provided key policy. Combiners can be safely accessed
+// concurrently.
+func newCombiner(typ slicetype.Type, name string, comb slicefunc.Func, targetSize int, memoryLimit int64, policy frame.KeyPolicy) (*combiner, error) {
 	c := &combiner{
-		Type:       typ,
-		name:       name,
-		combiner:   comb,
-		targetSize: targetSize,
+		Type:        typ,
+		name:        name,
+		combiner:    comb,
+		targetSize:  targetSize,
+		memoryLimit: memoryLimit,
+		policy:      policy,
+	}
+	// Each slot of the hash table also stores a hit count.
+	c.rowSize = int64(reflect.TypeOf(0).Size())
+	for i := 0; i < typ.NumOut(); i++ {
+		c.rowSize += int64(typ.Out(i).Size())
 	}
 	var err error
 	c.spiller, err = sliceio.NewSpiller(name)
@@ -257,10 +287,10 @@ func newCombiner(typ slicetype.Type, name string, comb slicefunc.Func, targetSiz
 	return c, nil
 }
 
-func (c *combiner) spill(f frame.Frame) error {
+func (c *combiner) spill(ctx context.Context, f frame.Frame) error {
 	log.Debug.Printf("combiner %s: spilling %d rows disk", c.name, c.comb.Len())
-	sort.Sort(f)
-	n, err := c.spiller.Spill(f)
+	sort.Sort(f.WithKeyPolicy(c.policy))
+	n, err := c.spiller.Spill(ctx, f)
 	if err == nil {
 		combinerKeys.Add(-int64(f.Len()))
 		combinerRecords.Add(-int64(c.total))
@@ -284,23 +314,47 @@ func (c *combiner) Combine(ctx context.Context, f frame.Frame) error {
 	combinerRecords.Add(int64(n))
 	combinerTotalRecords.Add(int64(n))
 	c.total += n
+	if c.memoryLimit > 0 && n > 0 {
+		c.varBytes += frameSize(f) - int64(n)*(c.rowSize-int64(reflect.TypeOf(0).Size()))
+		c.varRows += int64(n)
+	}
 	nkeys := c.comb.Len()
 	c.comb.Combine(f)
 	// TODO(marius): keep combining up to the next threshold; spill only if
 	// we need to grow.  maybe Combine should return 'n', and then we invoke
 	// 'grow' manually; or at least an option for this API.
 	combinerKeys.Add(int64(c.comb.Len() - nkeys))
-	if nkeys >= c.targetSize {
+	overBudget := c.memoryLimit > 0 && c.memory() > c.memoryLimit
+	if nkeys >= c.targetSize || overBudget {
 		// TODO(marius): we can copy the data and spill this concurrently
 		spilled := c.comb.Compact()
 		combineDiskSpills.Add(1)
-		if err := c.spill(spilled); err != nil {
+		CombinerSpills.Incr(metrics.ContextScope(ctx), 1)
+		if err := c.spill(ctx, spilled); err != nil {
 			return err
 		}
+		if overBudget {
+			// Compaction retains the table's capacity; start afresh so
+			// that the table's memory is released.
+			log.Debug.Printf("combiner %s: hash table exceeds memory budget of %s; grouping externally",
+				c.name, data.Size(c.memoryLimit))
+			c.comb = makeCombiningFrame(c, c.combiner, *combiningFrameInitSize, *combiningFrameScratchSize)
+		}
 	}
 	return nil
 }
 
+// memory returns an estimate of the number of bytes of memory used by
+// the combiner's hash table: the fixed size of each of its slots, plus
+// the average variable size of its combined rows.
+func (c *combiner) memory() int64 {
+	mem := int64(c.comb.Cap()) * c.rowSize
+	if c.varRows > 0 {
+		mem += int64(c.comb.Len()) * c.varBytes / c.varRows
+	}
+	return mem
+}
+
 // Discard discards this combiner's state. The combiner is invalid
 // after a call to Discard.
 func (c *combiner) Discard() error {
@@ -308,7 +362,9 @@ func (c *combiner) Discard() error {
 }
 
 // Reader returns a reader that streams the contents of this combiner.
-// A call to Reader invalidates the combiner.
+// A call to Reader invalidates the combiner. The reader must be read
+// with a context that carries the combiner's key policy (see
+// frame.KeyPolicyContext).
 func (c *combiner) Reader() (sliceio.Reader, error) {
 	defer func() {
 		if cleanupErr := c.spiller.Cleanup(); cleanupErr != nil {
@@ -323,7 +379,7 @@ func (c *combiner) Reader() (sliceio.Reader, error) {
 		return nil, err
 	}
 	f := c.comb.Compact()
-	sort.Sort(f)
+	sort.Sort(f.WithKeyPolicy(c.policy))
 	readers = append(readers, sliceio.FrameReader(f))
 	return sortio.Reduce(c, c.name, readers, c.combiner), nil
 }
@@ -338,6 +394,7 @@ func (c *combiner) WriteTo(ctx context.Context, enc *sliceio.Encoder) (int64, er
 	if err != nil {
 		return 0, err
 	}
+	ctx = frame.KeyPolicyContext(ctx, c.policy)
 	var total int64
 	in := frame.Make(c, *defaultChunksize, *defaultChunksize)
 	for {
@@ -13,6 +13,7 @@ import (
 
 	fuzz "github.com/google/gofuzz"
 	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/metrics"
 	"github.com/grailbio/bigslice/slicefunc"
 	"github.com/grailbio/bigslice/sliceio"
 	"github.com/grailbio/bigslice/slicetype"
@@ -126,11 +127,12 @@ func TestCombiner(t *testing.T) {
 		t.Fatal("unexpected bad func")
 	}
 	// Set a small target value to ensure spilling.
-	c, err := newCombiner(typ, "test", fn, 2)
+	c, err := newCombiner(typ, "test", fn, 2, 0, frame.KeyPolicy{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	ctx := context.Background()
+	var scope metrics.Scope
+	ctx := metrics.ScopedContext(context.Background(), &scope)
 	f := frame.Slices(
 		[]string{"a", "a", "b", "c", "d"},
 		[]int{0, 1, 2, 3, 4},
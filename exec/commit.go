@@ -0,0 +1,109 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/bigslice/sliceio"
+)
+
+// committingReader is a reader that tracks the committers and cleaners
+// that are pipelined into a task, so that the executor can commit or
+// abort, and then clean up, them once the task attempt is complete.
+type committingReader struct {
+	sliceio.Reader
+	committers []sliceio.Committer
+	cleaners   []sliceio.Cleaner
+	// committed is the number of committers (a prefix of committers)
+	// that have been committed successfully, and so must not be
+	// aborted.
+	committed int
+}
+
+// withCommitters returns a reader that reads from r and carries the
+// committers and cleaners of the provided (pipelined) readers. If none
+// of the readers are committers or cleaners, r is returned unchanged.
+func withCommitters(r sliceio.Reader, readers ...sliceio.Reader) sliceio.Reader {
+	var (
+		committers []sliceio.Committer
+		cleaners   []sliceio.Cleaner
+		seen       = make(map[*committingReader]bool)
+	)
+	for _, reader := range readers {
+		if reader, ok := reader.(*committingReader); ok {
+			// Slices may pass their dependency's reader through unchanged,
+			// so we may see the same reader more than once.
+			if seen[reader] {
+				continue
+			}
+			seen[reader] = true
+			committers = append(committers, reader.committers...)
+			cleaners = append(cleaners, reader.cleaners...)
+			continue
+		}
+		if committer, ok := reader.(sliceio.Committer); ok {
+			committers = append(committers, committer)
+		}
+		if cleaner, ok := reader.(sliceio.Cleaner); ok {
+			cleaners = append(cleaners, cleaner)
+		}
+	}
+	if len(committers) == 0 && len(cleaners) == 0 {
+		return r
+	}
+	return &committingReader{Reader: r, committers: committers, cleaners: cleaners}
+}
+
+// commitOutput commits the staged side effects of the task output
+// reader out, if any.
+func commitOutput(ctx context.Context, out sliceio.Reader) error {
+	c, ok := out.(*committingReader)
+	if !ok {
+		return nil
+	}
+	for _, committer := range c.committers[c.committed:] {
+		if err := committer.Commit(ctx); err != nil {
+			return err
+		}
+		c.committed++
+	}
+	return nil
+}
+
+// abortOutput aborts the staged side effects of the task output reader
+// out, if any, skipping those that were already committed. A committer
+// whose Commit failed is aborted. Aborting is best-effort: errors are
+// logged.
+func abortOutput(ctx context.Context, out sliceio.Reader) {
+	c, ok := out.(*committingReader)
+	if !ok {
+		return
+	}
+	for _, committer := range c.committers[c.committed:] {
+		if err := committer.Abort(ctx); err != nil {
+			log.Error.Printf("error aborting staged output: %v", err)
+		}
+	}
+}
+
+// cleanupOutput cleans up the readers pipelined into the task output
+// reader out, if any. It must be called exactly once for each task
+// attempt, after the output has been committed or aborted. Cleanup is
+// best-effort: errors are logged.
+func cleanupOutput(out sliceio.Reader) {
+	c, ok := out.(*committingReader)
+	if !ok {
+		return
+	}
+	// Cleanup must proceed even if the task was cancelled.
+	ctx := context.Background()
+	for _, cleaner := range c.cleaners {
+		if err := cleaner.Cleanup(ctx); err != nil {
+			log.Error.Printf("error cleaning up task reader: %v", err)
+		}
+	}
+}
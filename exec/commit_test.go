@@ -0,0 +1,60 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/grailbio/bigslice/sliceio"
+)
+
+type testCommitter struct {
+	sliceio.Reader
+	err             error
+	commits, aborts int
+}
+
+func (c *testCommitter) Commit(ctx context.Context) error {
+	c.commits++
+	return c.err
+}
+
+func (c *testCommitter) Abort(ctx context.Context) error {
+	c.aborts++
+	return nil
+}
+
+func TestCommitOutputFailure(t *testing.T) {
+	var (
+		ctx = context.Background()
+		a   = &testCommitter{Reader: sliceio.EmptyReader{}}
+		b   = &testCommitter{Reader: sliceio.EmptyReader{}, err: errors.New("commit failed")}
+		c   = &testCommitter{Reader: sliceio.EmptyReader{}}
+		out = withCommitters(sliceio.EmptyReader{}, a, b, c)
+	)
+	if err := commitOutput(ctx, out); err == nil {
+		t.Fatal("expected error")
+	}
+	abortOutput(ctx, out)
+	// a was committed, and so must not be aborted; b failed to commit,
+	// and so is aborted; c was never committed.
+	for i, test := range []struct {
+		c               *testCommitter
+		commits, aborts int
+	}{
+		{a, 1, 0},
+		{b, 1, 1},
+		{c, 0, 1},
+	} {
+		if got, want := test.c.commits, test.commits; got != want {
+			t.Errorf("committer %d: got %v commits, want %v", i, got, want)
+		}
+		if got, want := test.c.aborts, test.aborts; got != want {
+			t.Errorf("committer %d: got %v aborts, want %v", i, got, want)
+		}
+	}
+}
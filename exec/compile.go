@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/grailbio/base/errors"
 	"github.com/grailbio/base/log"
 	"github.com/grailbio/bigslice"
 	"github.com/grailbio/bigslice/frame"
@@ -37,7 +38,11 @@ func pipeline(slice bigslice.Slice) (slices []bigslice.Slice) {
 			return
 		}
 		dep := slice.Dep(0)
-		if dep.Shuffle {
+		if dep.Shuffle || dep.NumBranch > 0 {
+			return
+		}
+		// Adaptive slices are compiled according to their chosen plans.
+		if _, ok := dep.Slice.(bigslice.AdaptiveSlice); ok {
 			return
 		}
 		if pragma, ok := dep.Slice.(bigslice.Pragma); ok && pragma.Materialize() {
@@ -60,16 +65,22 @@ type memoKey struct {
 // dependency.
 type partitioner struct {
 	// numPartition is the number of partitions in the output for a shuffle
-	// dependency, if >1. If 0, the output is not used by a shuffle.
+	// dependency, if >1, or 1 for a broadcast dependency. If 0, the output is
+	// not used by a shuffle.
 	numPartition int
 	partitioner  bigslice.Partitioner
 	Combiner     slicefunc.Func
 	CombineKey   string
+	// branch indicates that the partitions of the output are the
+	// outputs of a multi-output slice, each read by the corresponding
+	// shard of a branch dependency (see bigslice.Dep.NumBranch), rather
+	// than by a shuffle.
+	branch bool
 }
 
 // IsShuffle returns whether the task output is used by a shuffle dependency.
 func (p partitioner) IsShuffle() bool {
-	return p.numPartition != 0
+	return p.numPartition != 0 && !p.branch
 }
 
 // Partitioner returns the partitioner to be used to partition the output of
@@ -96,7 +107,9 @@ func (p partitioner) NumPartition() int {
 // slice operations that can be pipelined into single tasks, creating
 // wide dependencies only at shuffle boundaries. The provided namer
 // must mint names that are unique to the session. The order in which
-// the namer is invoked is guaranteed to be deterministic.
+// the namer is invoked is guaranteed to be deterministic. Compile
+// fails if the invocation's task or depth limits are exceeded (see
+// MaxTasks and MaxCompileDepth).
 //
 // TODO(marius): we don't currently reuse tasks across compilations,
 // even though this could sometimes safely be done (when the number
@@ -114,14 +127,78 @@ func compile(inv execInvocation, slice bigslice.Slice, machineCombiners bool) (t
 		inv:              inv,
 		machineCombiners: machineCombiners,
 		memo:             make(map[memoKey][]*Task),
+		adaptive:         make(map[bigslice.Slice]int),
+		plans:            make(map[bigslice.Slice]bigslice.Slice),
+	}
+	if err = applySnapshots(inv, slice); err != nil {
+		return nil, err
+	}
+	if err = applyManifests(inv, slice); err != nil {
+		return nil, err
+	}
+	if err = applySince(inv, slice); err != nil {
+		return nil, err
+	}
+	for i, a := range adaptiveSlices(slice) {
+		c.adaptive[a] = i
+	}
+	if slice, err = rootSlice(inv, slice); err != nil {
+		return nil, err
+	}
+	if inv.Env.Checkpoint != "" {
+		slice = bigslice.Checkpoint(context.Background(), slice, inv.Env.Checkpoint)
 	}
-	// Top-level compilation always produces tasks that write single partitions,
+	// Top-level compilation produces tasks that write single partitions,
 	// as they are materialized and will not be used as direct shuffle
-	// dependencies.
-	tasks, err = c.compile(slice, partitioner{})
+	// dependencies, unless the invocation is explicitly partitioned.
+	tasks, err = c.compile(slice, partitioner{numPartition: inv.NumPartition})
+	if err == nil && inv.Env.Restage != nil && !c.restaged {
+		err = errors.E(errors.NotExist, fmt.Sprintf("restage: no stage %s", inv.Env.Restage.Stage))
+	}
 	return
 }
 
+// emptySlice is a slice with a single shard and no rows, of the type of
+// the slice that it embeds. It stands in for shuffle dependencies that
+// have no shards.
+type emptySlice struct {
+	bigslice.Slice
+}
+
+func (emptySlice) NumShard() int                               { return 1 }
+func (emptySlice) ShardType() bigslice.ShardType               { return bigslice.HashShard }
+func (emptySlice) NumDep() int                                 { return 0 }
+func (emptySlice) Dep(i int) bigslice.Dep                      { panic("no deps") }
+func (emptySlice) Combiner() slicefunc.Func                    { return slicefunc.Nil }
+func (emptySlice) Reader(int, []sliceio.Reader) sliceio.Reader { return sliceio.EmptyReader{} }
+
+// emptyShards returns a slice without shards in the graph of the
+// provided slice, or nil if there is none. Slices that are computed by
+// previous invocations are not inspected.
+func emptyShards(slice bigslice.Slice) bigslice.Slice {
+	visited := make(map[bigslice.Slice]bool)
+	var walk func(bigslice.Slice) bigslice.Slice
+	walk = func(slice bigslice.Slice) bigslice.Slice {
+		if visited[slice] {
+			return nil
+		}
+		visited[slice] = true
+		if _, ok := bigslice.Unwrap(slice).(*Result); ok {
+			return nil
+		}
+		if slice.NumShard() == 0 {
+			return slice
+		}
+		for i := 0; i < slice.NumDep(); i++ {
+			if empty := walk(slice.Dep(i).Slice); empty != nil {
+				return empty
+			}
+		}
+		return nil
+	}
+	return walk(slice)
+}
+
 // CompileEnv is the environment for compilation. This environment should
 // capture all external state that can affect compilation of an invocation. It
 // is shared across compilations of the same invocation (e.g. on worker nodes)
@@ -136,6 +213,41 @@ type CompileEnv struct {
 	// TaskCached indicates whether a task's results can be read from cache. It
 	// is only exported so that it can be gob-{en,dec}oded.
 	TaskCached map[TaskName]bool
+
+	// Adaptive holds the decisions for the invocation's adaptive slices, in
+	// the order returned by adaptiveSlices. Adaptive slices without
+	// decisions are compiled according to their default plans. It is only
+	// exported so that it can be gob-{en,dec}oded.
+	Adaptive []AdaptiveDecision
+	// Probe, if positive, indicates that the invocation computes only the
+	// input of its (Probe-1)th adaptive slice, so that its size can be
+	// measured. It is only exported so that it can be gob-{en,dec}oded.
+	Probe int
+	// Snapshots holds the snapshots read by the invocation's snapshot
+	// slices (see bigslice.SnapshotSlice), in the order returned by
+	// snapshotSlices, if the invocation reads snapshots. It is only
+	// exported so that it can be gob-{en,dec}oded.
+	Snapshots []interface{}
+	// Manifests holds the manifests of the invocation's manifest slices
+	// (see bigslice.ManifestSlice), in the order returned by
+	// manifestSlices. It is only exported so that it can be
+	// gob-{en,dec}oded.
+	Manifests []interface{}
+	// Since holds the snapshots of the invocation's snapshot slices that
+	// were read by a previous run of an incremental computation, so that
+	// the invocation reads only the data that were added since. See
+	// Session.RunIncremental. It is only exported so that it can be
+	// gob-{en,dec}oded.
+	Since []interface{}
+	// Checkpoint, if not empty, is the prefix with which the invocation's
+	// output is checkpointed (see bigslice.Checkpoint). It is only
+	// exported so that it can be gob-{en,dec}oded.
+	Checkpoint string
+	// Restage, if not nil, indicates that the invocation reruns a
+	// previous invocation with a restaged stage (see
+	// RunHandle.RestageWith). It is only exported so that it can be
+	// gob-{en,dec}oded.
+	Restage *Restage
 }
 
 // makeCompileEnv returns an empty and writable CompileEnv that can be passed to
@@ -175,15 +287,92 @@ type compiler struct {
 	inv              execInvocation
 	machineCombiners bool
 	memo             map[memoKey][]*Task
+	// adaptive indexes the invocation's adaptive slices, and plans holds
+	// the plans chosen for them.
+	adaptive map[bigslice.Slice]int
+	plans    map[bigslice.Slice]bigslice.Slice
+	// numTasks is the number of tasks created so far, and depth is the
+	// current depth of recursive compilation. They are bounded by the
+	// invocation's limits. See MaxTasks and MaxCompileDepth.
+	numTasks int
+	depth    int
+	// prev indexes the stages of the previous invocation, if the
+	// invocation restages one of its stages. See previousStages.
+	prev map[string][]*Task
+	// restaged indicates whether the restaged stage was compiled.
+	restaged bool
+}
+
+// addTasks accounts for the n tasks of the stage with the provided
+// name, returning an error if they exceed the invocation's task
+// limit.
+func (c *compiler) addTasks(stage string, n int) error {
+	if max := c.inv.maxTasks; max > 0 && c.numTasks+n > max {
+		return errors.E(errors.Invalid, fmt.Sprintf(
+			"compile: stage %s: its %d tasks exceed the limit of %d tasks, with %d tasks already compiled; reduce shard counts or raise the limit (see exec.MaxTasks)",
+			stage, n, max, c.numTasks))
+	}
+	c.numTasks += n
+	return nil
+}
+
+// plan returns the plan chosen for the provided adaptive slice.
+func (c *compiler) plan(a bigslice.AdaptiveSlice) (bigslice.Slice, error) {
+	if plan, ok := c.plans[a]; ok {
+		return plan, nil
+	}
+	i, ok := c.adaptive[a]
+	if !ok {
+		return nil, fmt.Errorf("adaptive slice %s is not part of the invocation", a.Name())
+	}
+	if i >= len(c.inv.Env.Adaptive) {
+		// Without a decision, the slice is compiled according to its
+		// default plan.
+		c.plans[a] = a
+		return a, nil
+	}
+	var (
+		decision = c.inv.Env.Adaptive[i]
+		input    = a.Input()
+	)
+	if decision.Probe != 0 {
+		result, ok := c.inv.probes[decision.Probe]
+		if !ok {
+			return nil, fmt.Errorf("adaptive slice %s: missing probe invocation %x", a.Name(), decision.Probe)
+		}
+		input = result
+	}
+	plan := a.Plan(input, decision.Small)
+	c.plans[a] = plan
+	return plan, nil
 }
 
 // compile compiles the provided slice into a set of task graphs, memoizing the
 // compilation so that tasks can be reused within the invocation.
 func (c *compiler) compile(slice bigslice.Slice, part partitioner) (tasks []*Task, err error) {
+	c.depth++
+	defer func() { c.depth-- }()
+	if max := c.inv.maxDepth; max > 0 && c.depth > max {
+		return nil, errors.E(errors.Invalid, fmt.Sprintf(
+			"compile: slice %s: dependency depth %d exceeds the limit of %d, with %d tasks already compiled; see exec.MaxCompileDepth",
+			slice.Name(), c.depth, max, c.numTasks))
+	}
+	if a, ok := slice.(bigslice.AdaptiveSlice); ok {
+		if slice, err = c.plan(a); err != nil {
+			return nil, err
+		}
+	}
+	if slice.NumShard() == 0 && part.IsShuffle() {
+		// Shuffle dependencies without shards are compiled as though they
+		// had a single, empty shard, so that every partition read by the
+		// dependent tasks is well defined (and empty).
+		slice = emptySlice{slice}
+	}
 	// We never reuse combiner tasks, as we currently don't have a way of
 	// identifying equivalent combiner functions. Ditto with custom
-	// partitioners.
-	if part.Combiner.IsNil() && part.partitioner == nil {
+	// partitioners, except those of multi-output slices, which are
+	// defined by the slice itself: its outputs must share its tasks.
+	if part.Combiner.IsNil() && (part.partitioner == nil || part.branch) {
 		// TODO(jcharumilind): Repartition already-computed data instead of
 		// forcing recomputation of the slice if we get a different
 		// numPartition.
@@ -201,9 +390,11 @@ func (c *compiler) compile(slice bigslice.Slice, part partitioner) (tasks []*Tas
 		}()
 	}
 	// Beyond this point, any tasks used for shuffles are new and need to have
-	// task groups set up for phasic evaluation.
+	// task groups set up for phasic evaluation, unless they are reused
+	// from the previous invocation of a restaged invocation.
+	var reused bool
 	defer func() {
-		if part.IsShuffle() {
+		if part.IsShuffle() && !reused {
 			for _, task := range tasks {
 				task.Group = tasks
 			}
@@ -211,6 +402,12 @@ func (c *compiler) compile(slice bigslice.Slice, part partitioner) (tasks []*Tas
 	}()
 	// Reuse tasks from a previous invocation.
 	if result, ok := bigslice.Unwrap(slice).(*Result); ok {
+		if len(result.tasks) == 0 {
+			return nil, nil
+		}
+		if result.numPartition != 0 {
+			return nil, errors.E(errors.Invalid, fmt.Sprintf("cannot reuse partitioned result %s", result.tasks[0].Name.Op))
+		}
 		for _, task := range result.tasks {
 			if !task.Combiner.IsNil() {
 				// TODO(marius): we may consider supporting this, but it should
@@ -227,6 +424,9 @@ func (c *compiler) compile(slice bigslice.Slice, part partitioner) (tasks []*Tas
 		// We now insert a set of tasks whose only purpose is (re-)shuffling
 		// the output from the previously completed task.
 		shuffleOpName := c.namer.New(fmt.Sprintf("%s_shuffle", result.tasks[0].Name.Op))
+		if err = c.addTasks(shuffleOpName, len(result.tasks)); err != nil {
+			return nil, err
+		}
 		tasks = make([]*Task, len(result.tasks))
 		for shard, task := range result.tasks {
 			tasks[shard] = &Task{
@@ -238,10 +438,15 @@ func (c *compiler) compile(slice bigslice.Slice, part partitioner) (tasks []*Tas
 					Shard:    shard,
 					NumShard: len(result.tasks),
 				},
-				Do:     func(readers []sliceio.Reader) sliceio.Reader { return readers[0] },
-				Deps:   []TaskDep{{task, 0, false, ""}},
-				Pragma: task.Pragma,
-				Slices: task.Slices,
+				Do:           func(readers []sliceio.Reader) sliceio.Reader { return readers[0] },
+				Deps:         []TaskDep{{task, 0, false, ""}},
+				Pragma:       task.Pragma,
+				Tags:         task.Tags,
+				Slices:       task.Slices,
+				NumPartition: part.NumPartition(),
+				Partitioner:  part.Partitioner(),
+				Combiner:     part.Combiner,
+				CombineKey:   part.CombineKey,
 			}
 		}
 		return
@@ -250,6 +455,9 @@ func (c *compiler) compile(slice bigslice.Slice, part partitioner) (tasks []*Tas
 	// the eligible computations.
 	slices := pipeline(slice)
 	defer func() {
+		if reused {
+			return
+		}
 		for _, task := range tasks {
 			task.Slices = slices
 		}
@@ -264,7 +472,20 @@ func (c *compiler) compile(slice bigslice.Slice, part partitioner) (tasks []*Tas
 		}
 	}
 	opName := c.namer.New(strings.Join(ops, "_"))
-	tasks = make([]*Task, slice.NumShard())
+	numShard := slice.NumShard()
+	restage := c.inv.Env.Restage
+	isRestaged := restage != nil && stageKey(c.inv.Index, opName) == restage.Stage
+	if isRestaged {
+		if err = restageable(opName, slices); err != nil {
+			return nil, err
+		}
+		numShard = restage.NumShard
+		c.restaged = true
+	}
+	if err = c.addTasks(opName, numShard); err != nil {
+		return nil, err
+	}
+	tasks = make([]*Task, numShard)
 	for i := range tasks {
 		tasks[i] = &Task{
 			Type: slices[0],
@@ -276,6 +497,7 @@ func (c *compiler) compile(slice bigslice.Slice, part partitioner) (tasks []*Tas
 			},
 			Invocation:   c.inv,
 			Pragma:       pragmas,
+			Tags:         bigslice.TagsOf(pragmas),
 			NumPartition: part.NumPartition(),
 			Partitioner:  part.Partitioner(),
 			Combiner:     part.Combiner,
@@ -288,16 +510,41 @@ func (c *compiler) compile(slice bigslice.Slice, part partitioner) (tasks []*Tas
 	for i := 0; i < lastSlice.NumDep(); i++ {
 		dep := lastSlice.Dep(i)
 		if !dep.Shuffle {
-			depTasks, err := c.compile(dep.Slice, partitioner{})
+			var depPart partitioner
+			if dep.NumBranch > 0 {
+				// Each shard reads its branch of the corresponding shard of
+				// the multi-output slice, whose tasks are shared by all of
+				// its branches.
+				depPart = partitioner{numPartition: dep.NumBranch, partitioner: dep.Partitioner, branch: true}
+			}
+			depTasks, err := c.compile(dep.Slice, depPart)
 			if err != nil {
 				return nil, err
 			}
 			if len(tasks) != len(depTasks) {
+				if restage != nil {
+					return nil, errors.E(errors.Invalid, fmt.Sprintf(
+						"restage: stage %s with %d shards reads dependency %s with %d shards without a shuffle",
+						opName, len(tasks), depTasks[0].Name.Op, len(depTasks)))
+				}
 				log.Panicf("tasks:%d deptasks:%d", len(tasks), len(depTasks))
 			}
 			for shard := range tasks {
 				tasks[shard].Deps = append(tasks[shard].Deps,
-					TaskDep{depTasks[shard], 0, dep.Expand, ""})
+					TaskDep{depTasks[shard], dep.Branch, dep.Expand, ""})
+			}
+			continue
+		}
+		if dep.Broadcast {
+			// Broadcast dependencies are compiled into a single output
+			// partition, which is read in full by each shard.
+			depTasks, err := c.compile(dep.Slice, partitioner{numPartition: 1})
+			if err != nil {
+				return nil, err
+			}
+			for shard := range tasks {
+				tasks[shard].Deps = append(tasks[shard].Deps,
+					TaskDep{depTasks[0], 0, dep.Expand, ""})
 			}
 			continue
 		}
@@ -306,8 +553,8 @@ func (c *compiler) compile(slice bigslice.Slice, part partitioner) (tasks []*Tas
 			combineKey = opName
 		}
 		depPart := partitioner{
-			slice.NumShard(), dep.Partitioner,
-			lastSlice.Combiner(), combineKey,
+			numShard, dep.Partitioner,
+			lastSlice.Combiner(), combineKey, false,
 		}
 		depTasks, err := c.compile(dep.Slice, depPart)
 		if err != nil {
@@ -354,22 +601,41 @@ func (c *compiler) compile(slice bigslice.Slice, part partitioner) (tasks []*Tas
 				continue
 			}
 			if prev == nil {
-				// First, read the input directly.
+				// First, read the input directly. The rows read from
+				// sources are counted, for lineage.
+				var (
+					source = slices[i].NumDep() == 0
+					task   = tasks[shard]
+				)
 				tasks[shard].Do = func(readers []sliceio.Reader) sliceio.Reader {
 					r := reader(shard, readers)
-					r = shardCache.WritethroughReader(shard, r)
-					return &sliceio.PprofReader{Reader: r, Label: pprofLabel}
+					var in sliceio.Reader = r
+					if source {
+						in = &sourceRowsReader{r, &task.Scope}
+					}
+					w := shardCache.WritethroughReader(shard, in)
+					return withCommitters(&sliceio.PprofReader{Reader: w, Label: pprofLabel}, r)
 				}
 			} else {
 				// Subsequently, read the previous pipelined slice's output.
 				tasks[shard].Do = func(readers []sliceio.Reader) sliceio.Reader {
-					r := reader(shard, []sliceio.Reader{prev(readers)})
-					r = shardCache.WritethroughReader(shard, r)
-					return &sliceio.PprofReader{Reader: r, Label: pprofLabel}
+					in := prev(readers)
+					r := reader(shard, []sliceio.Reader{in})
+					w := shardCache.WritethroughReader(shard, r)
+					return withCommitters(&sliceio.PprofReader{Reader: w, Label: pprofLabel}, in, r)
 				}
 			}
 		}
 	}
+	if restage != nil && !isRestaged {
+		var prev []*Task
+		if prev, reused, err = c.reuse(slices, tasks, part); err != nil {
+			return nil, err
+		}
+		if prev != nil {
+			tasks = prev
+		}
+	}
 	return
 }
 
@@ -9,6 +9,7 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"reflect"
 	"sort"
 	"strings"
 	"testing"
@@ -65,6 +66,20 @@ func TestCompile(t *testing.T) {
 				return
 			},
 		},
+		{
+			// Branch from a slice materialized by bigslice.Materialize. Its
+			// tasks are pipelined with its input, and each of its shards is
+			// read by the corresponding shard of the subsequent maps.
+			"branch-materialize-op",
+			func() (slice bigslice.Slice) {
+				slice = bigslice.Const(3, []int{})
+				slice = bigslice.Materialize(slice)
+				slice0 := bigslice.Map(slice, func(i int) int { return i })
+				slice1 := bigslice.Map(slice, func(i int) int { return i })
+				slice = bigslice.Cogroup(slice0, slice1)
+				return
+			},
+		},
 		{
 			// Branch the const slice with a reduce, which introduces its own
 			// shuffle/combiner, so the const slice tasks cannot be reused.
@@ -408,3 +423,92 @@ func (c *fakeCacheSlice) Cache() slicecache.ShardCache
 func fakeCache(slice bigslice.Slice, shardIsCached []bool) bigslice.Slice {
 	return &fakeCacheSlice{bigslice.MakeName("testcache"), slice, fakeShardCache{shardIsCached}}
 }
+
+// TestCompileTags verifies that tags are merged across pipelined slices,
+// overridden by later slices, and do not affect task names.
+func TestCompileTags(t *testing.T) {
+	makeFunc := func(tagged bool) *bigslice.FuncValue {
+		return bigslice.Func(func() bigslice.Slice {
+			var tags [3][]bigslice.Pragma
+			if tagged {
+				tags[0] = []bigslice.Pragma{bigslice.Tag("team", "a"), bigslice.Tag("cost", "1")}
+				tags[1] = []bigslice.Pragma{bigslice.Tag("cost", "2")}
+				tags[2] = []bigslice.Pragma{bigslice.Tag("trace", "xyz")}
+			}
+			slice := bigslice.Const(2, []string{"a", "b", "c"}, []int{1, 2, 3})
+			slice = bigslice.Map(slice, func(s string, i int) (string, int) { return s, i }, tags[0]...)
+			slice = bigslice.Map(slice, func(s string, i int) (string, int) { return s, i }, tags[1]...)
+			slice = bigslice.Reduce(slice, func(a, b int) int { return a + b })
+			slice = bigslice.Map(slice, func(s string, i int) (string, int) { return s, i }, tags[2]...)
+			return slice
+		})
+	}
+	compileFunc := func(f *bigslice.FuncValue) []*Task {
+		t.Helper()
+		inv := makeExecInvocation(f.Invocation("<unknown>"))
+		inv.Index = 0
+		tasks, err := compile(inv, inv.Invoke(), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tasks
+	}
+	tagged, untagged := compileFunc(makeFunc(true)), compileFunc(makeFunc(false))
+	for i, task := range tagged {
+		if got, want := task.Tags, map[string]string{"trace": "xyz"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if got, want := task.Name, untagged[i].Name; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if len(untagged[i].Tags) != 0 {
+			t.Errorf("unexpected tags %v", untagged[i].Tags)
+		}
+		for j, dep := range task.Deps {
+			if got, want := dep.Head.Tags, map[string]string{"team": "a", "cost": "2"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			if got, want := dep.Head.Name, untagged[i].Deps[j].Head.Name; got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		}
+	}
+}
+
+func TestCompileLimits(t *testing.T) {
+	fn := bigslice.Func(func() bigslice.Slice {
+		slice := bigslice.Const(3, []string{"a", "b", "c"}, []int{1, 2, 3})
+		slice = bigslice.Reduce(slice, func(a, b int) int { return a + b })
+		return bigslice.Map(slice, func(s string, i int) (string, int) { return s, i })
+	})
+	compileFunc := func(maxTasks, maxDepth int) (int, error) {
+		inv := makeExecInvocation(fn.Invocation("<unknown>"))
+		inv.maxTasks, inv.maxDepth = maxTasks, maxDepth
+		tasks, err := compile(inv, inv.Invoke(), false)
+		return countTasks(inv, tasks), err
+	}
+	n, err := compileFunc(6, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := n, 6; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, test := range []struct {
+		maxTasks, maxDepth int
+		want               string
+	}{
+		{5, 0, "its 3 tasks exceed the limit of 5 tasks, with 3 tasks already compiled"},
+		{2, 0, "its 3 tasks exceed the limit of 2 tasks, with 0 tasks already compiled"},
+		{0, 1, "dependency depth 2 exceeds the limit of 1, with 3 tasks already compiled"},
+	} {
+		_, err := compileFunc(test.maxTasks, test.maxDepth)
+		if err == nil {
+			t.Errorf("%d, %d: expected error", test.maxTasks, test.maxDepth)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%d, %d: got %v, want %q", test.maxTasks, test.maxDepth, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A TaskCompletion describes the completion of an attempt to run a
+// task. See TaskCompletionFunc.
+type TaskCompletion struct {
+	// Task is the name of the task.
+	Task TaskName
+	// Attempt is the number of the attempt: a task's first attempt is
+	// 1, and each subsequent attempt, e.g., to rerun a task that was
+	// lost, increments it.
+	Attempt int
+	// State is the state in which the attempt completed: TaskOk,
+	// TaskErr, or TaskLost.
+	State TaskState
+	// Err is the error with which the attempt failed, if any.
+	Err error
+	// Duration is the time from the submission of the attempt to the
+	// executor to its completion, including the time that the task
+	// waited for resources.
+	Duration time.Duration
+	// Records and Bytes are the number of records and encoded bytes
+	// output by the attempt, as measured by the executor, if it
+	// completed successfully. Bytes is 0 if the executor does not
+	// encode task outputs (e.g., the local executor).
+	Records, Bytes int64
+}
+
+// TaskCompletionFunc is an Option that invokes fn with a TaskCompletion
+// as each attempt to run a task completes, whether it succeeds, fails,
+// or is lost, e.g., to record completions in an external job tracker.
+// fn is invoked exactly once for each attempt that completes before
+// the session is shut down, in the order in which the attempts
+// complete, by a goroutine dedicated to the callback, so that it never
+// delays scheduling. Completions are queued for fn without bound;
+// completions that are queued when the session is shut down are
+// delivered before Shutdown returns.
+//
+// Attempts are counted by the evaluator that submits them: tasks that
+// are shared by concurrent invocations are reported by the invocation
+// that runs them.
+func TaskCompletionFunc(fn func(TaskCompletion)) Option {
+	return func(s *Session) {
+		if s.completions == nil {
+			s.completions = new(completionQueue)
+		}
+		s.completions.fns = append(s.completions.fns, fn)
+	}
+}
+
+// completionExecutor is implemented by executors that report task
+// completions to their session.
+type completionExecutor interface {
+	Executor
+	// taskCompletions returns the queue to which task completions are
+	// reported, or nil if they are not.
+	taskCompletions() *completionQueue
+}
+
+// completionsOf returns the completion queue of the provided executor,
+// or nil if it has none.
+func completionsOf(executor Executor) *completionQueue {
+	if c, ok := executor.(completionExecutor); ok {
+		return c.taskCompletions()
+	}
+	return nil
+}
+
+// makeCompletion returns the completion of the provided attempt of
+// task, which must be complete. The task's lock must be held.
+func makeCompletion(task *Task, attempt int, start time.Time) TaskCompletion {
+	c := TaskCompletion{
+		Task:     task.Name,
+		Attempt:  attempt,
+		State:    task.state,
+		Duration: time.Since(start),
+	}
+	if task.state == TaskOk {
+		for _, size := range task.PartitionSizes {
+			c.Records += size.Records
+			c.Bytes += size.Bytes
+		}
+	} else {
+		c.Err = task.err
+	}
+	return c
+}
+
+// A completionQueue delivers task completions to a session's callbacks.
+// A nil *completionQueue delivers nothing.
+type completionQueue struct {
+	fns []func(TaskCompletion)
+
+	// ctx is cancelled when the queue is closed, abandoning the
+	// attempts that are awaited.
+	ctx    context.Context
+	cancel func()
+	// readyc is signalled when completions are queued.
+	readyc chan struct{}
+	// closec is closed when the queue is closed; donec once its loop
+	// has returned.
+	closec, donec chan struct{}
+
+	mu    sync.Mutex
+	queue []TaskCompletion
+}
+
+// start starts delivering completions to the queue's callbacks.
+func (q *completionQueue) start() {
+	if q == nil {
+		return
+	}
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	q.readyc = make(chan struct{}, 1)
+	q.closec = make(chan struct{})
+	q.donec = make(chan struct{})
+	go q.loop()
+}
+
+// close stops the queue, returning once its queued completions have
+// been delivered.
+func (q *completionQueue) close() {
+	if q == nil {
+		return
+	}
+	q.cancel()
+	close(q.closec)
+	<-q.donec
+}
+
+// send queues c for delivery, without blocking.
+func (q *completionQueue) send(c TaskCompletion) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	q.queue = append(q.queue, c)
+	q.mu.Unlock()
+	select {
+	case q.readyc <- struct{}{}:
+	default:
+	}
+}
+
+// await reports the provided attempt of task once it completes. It is
+// used for attempts that are abandoned by their evaluator, e.g.,
+// because its invocation was cancelled, which are still reported
+// unless the queue is closed first.
+func (q *completionQueue) await(task *Task, attempt int, start time.Time) {
+	if q == nil {
+		return
+	}
+	go func() {
+		task.Lock()
+		var err error
+		for task.state < TaskOk && err == nil {
+			err = task.Wait(q.ctx)
+		}
+		var c TaskCompletion
+		if err == nil {
+			c = makeCompletion(task, attempt, start)
+		}
+		task.Unlock()
+		if err == nil {
+			q.send(c)
+		}
+	}()
+}
+
+// loop delivers queued completions until the queue is closed, after
+// which it delivers the remaining queued completions and returns.
+func (q *completionQueue) loop() {
+	defer close(q.donec)
+	for {
+		var closed bool
+		select {
+		case <-q.readyc:
+		case <-q.closec:
+			closed = true
+		}
+		q.mu.Lock()
+		completions := q.queue
+		q.queue = nil
+		q.mu.Unlock()
+		for _, c := range completions {
+			for _, fn := range q.fns {
+				fn(c)
+			}
+		}
+		if closed {
+			return
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	baseerrors "github.com/grailbio/base/errors"
+	"github.com/grailbio/bigslice"
+	"github.com/grailbio/bigslice/sliceio"
+)
+
+// failSlice returns a slice of 2 shards of 10 integers each, whose
+// first shard fails on its first attempt with the provided error.
+func failSlice(err error) bigslice.Slice {
+	var attempts int32
+	return bigslice.ReaderFunc(2, func(shard int, off *int, out []int) (int, error) {
+		if shard == 0 && *off == 0 && atomic.AddInt32(&attempts, 1) == 1 {
+			return 0, err
+		}
+		var i int
+		for ; i < len(out) && *off < 10; i++ {
+			out[i] = *off
+			*off++
+		}
+		if *off == 10 {
+			return i, sliceio.EOF
+		}
+		return i, nil
+	})
+}
+
+func TestTaskCompletion(t *testing.T) {
+	ctx := context.Background()
+	for _, test := range []struct {
+		err       error
+		wantState TaskState
+	}{
+		{baseerrors.E(baseerrors.Temporary, "lost"), TaskLost},
+		{baseerrors.E(baseerrors.Fatal, "failed"), TaskErr},
+	} {
+		var (
+			mu          sync.Mutex
+			completions []TaskCompletion
+		)
+		sess := Start(Local, TaskCompletionFunc(func(c TaskCompletion) {
+			mu.Lock()
+			completions = append(completions, c)
+			mu.Unlock()
+		}))
+		fn := bigslice.Func(func() bigslice.Slice { return failSlice(test.err) })
+		_, err := sess.Run(ctx, fn)
+		if test.wantState == TaskErr && err == nil {
+			t.Error("expected error")
+		}
+		if test.wantState == TaskLost && err != nil {
+			t.Fatal(err)
+		}
+		// Completions are delivered before Shutdown returns.
+		sess.Shutdown()
+
+		sort.Slice(completions, func(i, j int) bool {
+			ci, cj := completions[i], completions[j]
+			if ci.Task.Shard != cj.Task.Shard {
+				return ci.Task.Shard < cj.Task.Shard
+			}
+			return ci.Attempt < cj.Attempt
+		})
+		type attempt struct {
+			shard, attempt int
+			state          TaskState
+		}
+		want := []attempt{{0, 1, test.wantState}, {0, 2, TaskOk}, {1, 1, TaskOk}}
+		if test.wantState == TaskErr {
+			// Failed tasks are not retried, and the evaluation stops;
+			// the other shard may or may not have completed.
+			want = want[:1]
+			if len(completions) > 1 {
+				want = append(want, attempt{1, 1, TaskOk})
+			}
+		}
+		if got := len(completions); got != len(want) {
+			t.Fatalf("got %v completions, want %v: %v", got, len(want), completions)
+		}
+		for i, c := range completions {
+			w := want[i]
+			if c.Task.Shard != w.shard || c.Attempt != w.attempt || c.State != w.state {
+				t.Errorf("got %+v, want %+v", c, w)
+			}
+			if c.Duration <= 0 {
+				t.Errorf("%v: got duration %v", c.Task, c.Duration)
+			}
+			switch c.State {
+			case TaskOk:
+				if c.Err != nil || c.Records != 10 {
+					t.Errorf("%v: got %v, %v, want 10 records", c.Task, c.Err, c.Records)
+				}
+			default:
+				if c.Err == nil || c.Records != 0 {
+					t.Errorf("%v: got %v, %v, want error", c.Task, c.Err, c.Records)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigslice"
+)
+
+// RunWithDeadline evaluates the slice returned by the bigslice func
+// funcv applied to the provided arguments, as Run, but on a best-effort
+// basis: if the evaluation has not completed by the provided deadline,
+// it is stopped, and RunWithDeadline returns a partial result
+// comprising the shards that had completed by then (see
+// Result.Partial). Partial results are consistent: each shard of the
+// result is either complete or absent, and shards whose computation
+// was interrupted are never read. The shards that are absent are given
+// by Result.Unfinished.
+//
+// At the deadline, every stage of the invocation is cancelled, as by
+// RunHandle.CancelStage, so that its running tasks are interrupted and
+// the machines that they hold are released, and its remaining tasks
+// are never run. Stages of previous invocations whose results the
+// invocation reuses are not cancelled. RunWithDeadline returns an
+// error if the evaluation fails before the deadline, or if it is not
+// compiled by the deadline.
+func (s *Session) RunWithDeadline(ctx context.Context, deadline time.Time, funcv *bigslice.FuncValue, args ...interface{}) (*Result, error) {
+	location := "<unknown>"
+	if _, file, line, ok := runtime.Caller(1); ok {
+		location = fmt.Sprintf("%s:%d", file, line)
+	}
+	var (
+		mu       sync.Mutex
+		invIndex uint64
+		tasks    []*Task
+	)
+	opts := []RunOption{
+		func(inv *execInvocation) {
+			inv.Location = location
+			inv.compiled = func(inv execInvocation, compiled []*Task) {
+				mu.Lock()
+				invIndex, tasks = inv.Index, compiled
+				mu.Unlock()
+			}
+		},
+	}
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		res *Result
+		err error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		res, err := s.run(runCtx, 1, opts, funcv, args...)
+		resc <- result{res, err}
+	}()
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case r := <-resc:
+		return r.res, r.err
+	case <-timer.C:
+	}
+	// Cancel the invocation's stages before its evaluation, so that its
+	// running tasks are interrupted and are not left to complete.
+	mu.Lock()
+	stages := make(map[stageID]bool)
+	_ = iterTasks(tasks, func(task *Task) error {
+		if task.Name.InvIndex == invIndex {
+			stages[stageID{invIndex, task.Name.Op}] = true
+		}
+		return nil
+	})
+	mu.Unlock()
+	for id := range stages {
+		s.cancelStage(id)
+	}
+	cancel()
+	r := <-resc
+	if r.res == nil {
+		if r.err == nil || r.err == context.Canceled {
+			r.err = errors.E(errors.Timeout, "deadline exceeded before the invocation was compiled")
+		}
+		return nil, r.err
+	}
+	if r.err == nil {
+		// The evaluation completed at the deadline.
+		return r.res, nil
+	}
+	res := r.res
+	res.partial = true
+	complete := res.tasks[:0:0]
+	for _, task := range res.tasks {
+		if task.State() == TaskOk {
+			complete = append(complete, task)
+		} else {
+			res.unfinished = append(res.unfinished, task.Name.Shard)
+		}
+	}
+	sort.Ints(res.unfinished)
+	res.tasks = complete
+	return res, nil
+}
+
+// Partial tells whether r is the partial result of an evaluation that
+// did not complete by its deadline (see Session.RunWithDeadline). The
+// shards of a partial result are those that completed by the deadline.
+func (r *Result) Partial() bool { return r.partial }
+
+// Unfinished returns the indices of the shards of r that are absent
+// from it because they had not completed by its deadline, in
+// increasing order, or nil if r is not partial.
+func (r *Result) Unfinished() []int { return r.unfinished }
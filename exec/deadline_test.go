@@ -0,0 +1,84 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grailbio/bigslice"
+	"github.com/grailbio/bigslice/sliceio"
+)
+
+func TestRunWithDeadline(t *testing.T) {
+	ctx := context.Background()
+	var calls int32
+	fn := bigslice.Func(func(slow bool) bigslice.Slice {
+		// Shards 0 and 1 complete immediately; shards 2 and 3, if slow,
+		// produce rows until they are interrupted.
+		slice := bigslice.ReaderFunc(4, func(shard int, off *int, out []int) (int, error) {
+			if slow && shard >= 2 {
+				atomic.AddInt32(&calls, 1)
+				time.Sleep(time.Millisecond)
+				out[0] = shard
+				*off++
+				return 1, nil
+			}
+			out[0] = shard
+			return 1, sliceio.EOF
+		})
+		return bigslice.Map(slice, func(i int) int { return i })
+	})
+	sess := Start(Local, Parallelism(4))
+	defer sess.Shutdown()
+
+	res, err := sess.RunWithDeadline(ctx, time.Now().Add(100*time.Millisecond), fn, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Partial() {
+		t.Fatal("expected partial result")
+	}
+	if got, want := res.Unfinished(), []int{2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	var ints []int
+	if err = res.Collect(ctx, &ints); err != nil {
+		t.Fatal(err)
+	}
+	sort.Ints(ints)
+	if got, want := ints, []int{0, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The unfinished tasks have been interrupted: they read no more
+	// rows.
+	n := atomic.LoadInt32(&calls)
+	time.Sleep(50 * time.Millisecond)
+	if got, want := atomic.LoadInt32(&calls), n; got > want+2 {
+		t.Errorf("unfinished tasks were not interrupted: got %v calls, want %v", got, want)
+	}
+
+	// Evaluations that complete by their deadline return complete
+	// results.
+	res, err = sess.RunWithDeadline(ctx, time.Now().Add(time.Minute), fn, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Partial() || res.Unfinished() != nil {
+		t.Errorf("got partial result, unfinished %v", res.Unfinished())
+	}
+	ints = nil
+	if err = res.Collect(ctx, &ints); err != nil {
+		t.Fatal(err)
+	}
+	sort.Ints(ints)
+	if got, want := ints, []int{0, 1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/grailbio/base/data"
+	"github.com/grailbio/bigslice"
+)
+
+// DotOptions configures the rendering of task graphs by WriteDot.
+type DotOptions struct {
+	// Shards renders each stage as a cluster of nodes, one for each of
+	// the stage's tasks (shards), connected to the tasks on which they
+	// depend, instead of as a single node. The graphs of large
+	// computations may then be too large to render usefully.
+	Shards bool
+}
+
+// WriteDot writes to w the plan of the invocation of funcv with the
+// provided arguments, annotated with estimated sizes, as a Graphviz DOT
+// graph, using the zero Estimator and default options.
+func WriteDot(w io.Writer, funcv *bigslice.FuncValue, args ...interface{}) error {
+	return Estimator{}.writeDot(1, w, DotOptions{}, funcv, args)
+}
+
+// WriteDot writes to w the plan of the invocation of funcv with the
+// provided arguments, annotated with estimated sizes, as a Graphviz DOT
+// graph. The invocation is compiled, as it would be by Session.Run, but
+// nothing is computed.
+//
+// Each stage of the computation (a set of tasks that compute the
+// shards of the same pipelined slices) is rendered as a node, labeled
+// with the operations of its slices, from first to last, its number of
+// shards, and the estimated size of its output. Each dependency between
+// stages is rendered as an edge labeled with the estimated volume of
+// data read across it; shuffle dependencies are drawn in bold. Sizes
+// are estimated as by EstimateShuffle, and are marked as incomplete if
+// some of the sources from which they are computed lack size hints.
+// Results computed by previous invocations, and passed as arguments,
+// are rendered as dashed nodes with their measured sizes.
+func (e Estimator) WriteDot(w io.Writer, opts DotOptions, funcv *bigslice.FuncValue, args ...interface{}) error {
+	return e.writeDot(1, w, opts, funcv, args)
+}
+
+// dotStage is a stage of a task graph rendered by WriteDot.
+type dotStage struct {
+	id    int
+	tasks []*Task
+	size  taskSize
+	// prior indicates that the stage was computed by a previous
+	// invocation.
+	prior bool
+}
+
+// dotEdge is a dependency between the stages or tasks with the provided
+// ids rendered by WriteDot.
+type dotEdge struct {
+	from, to int
+}
+
+// dotVolume is the estimated volume of data read across a dotEdge.
+type dotVolume struct {
+	size    taskSize
+	shuffle bool
+}
+
+func (e Estimator) writeDot(calldepth int, w io.Writer, opts DotOptions, funcv *bigslice.FuncValue, args []interface{}) error {
+	inv, tasks, err := compileEstimate(calldepth+1, funcv, args)
+	if err != nil {
+		return err
+	}
+	var (
+		sizes      = make(map[*Task]taskSize)
+		stages     = make(map[TaskName]*dotStage)
+		order      []*dotStage
+		taskIDs    = make(map[*Task]int)
+		stageEdges = make(map[dotEdge]*dotVolume)
+		taskEdges  = make(map[dotEdge]*dotVolume)
+		edgeOrder  []dotEdge
+	)
+	stageOf := func(task *Task) *dotStage {
+		key := TaskName{InvIndex: task.Name.InvIndex, Op: task.Name.Op}
+		stage := stages[key]
+		if stage == nil {
+			stage = &dotStage{
+				id:    len(order),
+				size:  taskSize{complete: true},
+				prior: task.Name.InvIndex != inv.Index,
+			}
+			stages[key] = stage
+			order = append(order, stage)
+		}
+		if _, ok := taskIDs[task]; !ok {
+			taskIDs[task] = len(taskIDs)
+			size := e.size(task, sizes)
+			stage.tasks = append(stage.tasks, task)
+			stage.size.rows += size.rows
+			stage.size.bytes += size.bytes
+			stage.size.complete = stage.size.complete && size.complete
+		}
+		return stage
+	}
+	_ = iterTasks(tasks, func(task *Task) error {
+		if task.Name.InvIndex != inv.Index {
+			// Stages of previous invocations are rendered only if they
+			// are read by this one.
+			return nil
+		}
+		stage := stageOf(task)
+		for _, dep := range task.Deps {
+			shuffle := dep.Head != nil && len(dep.Head.Group) > 0
+			for i := 0; i < dep.NumTask(); i++ {
+				deptask := dep.Task(i)
+				depStage := stageOf(deptask)
+				rows, bytes := e.size(deptask, sizes).share(deptask.NumPartition)
+				stageEdge := dotEdge{depStage.id, stage.id}
+				if stageEdges[stageEdge] == nil {
+					stageEdges[stageEdge] = &dotVolume{size: taskSize{complete: true}, shuffle: shuffle}
+					edgeOrder = append(edgeOrder, stageEdge)
+				}
+				taskEdge := dotEdge{taskIDs[deptask], taskIDs[task]}
+				if taskEdges[taskEdge] == nil {
+					taskEdges[taskEdge] = &dotVolume{size: taskSize{complete: true}, shuffle: shuffle}
+				}
+				for _, vol := range []*dotVolume{stageEdges[stageEdge], taskEdges[taskEdge]} {
+					vol.size.rows += rows
+					vol.size.bytes += bytes
+					vol.size.complete = vol.size.complete && sizes[deptask].complete
+				}
+			}
+		}
+		return nil
+	})
+
+	b := bufio.NewWriter(w)
+	fmt.Fprintln(b, "digraph plan {")
+	fmt.Fprintln(b, "\tnode [shape=box, fontname=\"Helvetica\", fontsize=10];")
+	fmt.Fprintln(b, "\tedge [fontname=\"Helvetica\", fontsize=9];")
+	for _, stage := range order {
+		label := stage.label()
+		if !opts.Shards {
+			fmt.Fprintf(b, "\ts%d [label=%s%s];\n", stage.id, dotQuote(label), stage.style())
+			continue
+		}
+		fmt.Fprintf(b, "\tsubgraph cluster_s%d {\n", stage.id)
+		fmt.Fprintf(b, "\t\tlabel=%s;\n", dotQuote(label))
+		if stage.prior {
+			fmt.Fprintln(b, "\t\tstyle=dashed;")
+		}
+		for _, task := range stage.tasks {
+			label := fmt.Sprintf("shard %d\n%s", task.Name.Shard, sizes[task].String())
+			fmt.Fprintf(b, "\t\tt%d [label=%s%s];\n", taskIDs[task], dotQuote(label), stage.style())
+		}
+		fmt.Fprintln(b, "\t}")
+	}
+	if !opts.Shards {
+		for _, edge := range edgeOrder {
+			vol := stageEdges[edge]
+			fmt.Fprintf(b, "\ts%d -> s%d [label=%s%s];\n", edge.from, edge.to, dotQuote(vol.size.String()), vol.style())
+		}
+	} else {
+		for _, stage := range order {
+			for _, task := range stage.tasks {
+				for _, dep := range task.Deps {
+					for i := 0; i < dep.NumTask(); i++ {
+						edge := dotEdge{taskIDs[dep.Task(i)], taskIDs[task]}
+						vol := taskEdges[edge]
+						if vol == nil {
+							// Edges of previous invocations are not rendered.
+							continue
+						}
+						fmt.Fprintf(b, "\tt%d -> t%d [label=%s%s];\n", edge.from, edge.to, dotQuote(vol.size.String()), vol.style())
+						// Render each edge once, even if the task
+						// depends on a task more than once.
+						delete(taskEdges, edge)
+					}
+				}
+			}
+		}
+	}
+	fmt.Fprintln(b, "}")
+	return b.Flush()
+}
+
+// label returns the label of the stage's node.
+func (s *dotStage) label() string {
+	task := s.tasks[0]
+	var lines []string
+	if s.prior {
+		lines = append(lines, fmt.Sprintf("result of invocation %d", task.Name.InvIndex))
+	} else {
+		lines = append(lines, task.Name.Op)
+	}
+	// Pipelined slices are ordered from last to first.
+	ops := make([]string, len(task.Slices))
+	for i, slice := range task.Slices {
+		ops[len(ops)-1-i] = slice.Name().Op
+	}
+	if len(ops) > 0 {
+		lines = append(lines, strings.Join(ops, " → "))
+	}
+	lines = append(lines, fmt.Sprintf("%d shards", task.Name.NumShard), s.size.String())
+	return strings.Join(lines, "\n")
+}
+
+// style returns the attributes that style the stage's nodes.
+func (s *dotStage) style() string {
+	if s.prior {
+		return ", style=dashed"
+	}
+	return ""
+}
+
+// style returns the attributes that style the edge with the volume.
+func (v *dotVolume) style() string {
+	if v.shuffle {
+		return ", style=bold"
+	}
+	return ""
+}
+
+// String returns a description of the estimated size.
+func (s taskSize) String() string {
+	str := fmt.Sprintf("~%d rows, ~%s", int64(math.Round(s.rows)), data.Size(int64(math.Round(s.bytes))))
+	if !s.complete {
+		str += " (incomplete)"
+	}
+	return str
+}
+
+// dotQuote returns s as a quoted DOT string.
+func dotQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	return `"` + s + `"`
+}
@@ -0,0 +1,156 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/bigslice"
+)
+
+// dotLines returns the lines of the provided DOT graph that declare
+// nodes and edges, checking that the graph is well formed.
+func dotLines(t *testing.T, dot string) (nodes, edges []string) {
+	t.Helper()
+	lines := strings.Split(strings.TrimSpace(dot), "\n")
+	if got, want := lines[0], "digraph plan {"; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := lines[len(lines)-1], "}"; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	depth := 0
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasSuffix(line, "{"):
+			depth++
+		case line == "}":
+			depth--
+		case !strings.HasSuffix(line, ";"):
+			t.Errorf("malformed line %q", line)
+		case strings.Contains(line, " -> "):
+			edges = append(edges, line)
+		case strings.Contains(line, " [label="):
+			nodes = append(nodes, line)
+		}
+	}
+	if depth != 0 {
+		t.Errorf("unbalanced graph:\n%s", dot)
+	}
+	return
+}
+
+func TestWriteDot(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteDot(&b, estimateFunc, true); err != nil {
+		t.Fatal(err)
+	}
+	nodes, edges := dotLines(t, b.String())
+	if got, want := len(nodes), 3; got != want {
+		t.Fatalf("got %v, want %v:\n%s", got, want, b.String())
+	}
+	for i, want := range []string{
+		`\nreader → filter\n4 shards\n~500 rows, ~3.9KiB"`,
+		`\nreshuffle → flatmap\n4 shards\n~1500 rows, ~11.7KiB"`,
+		`\nreduce\n4 shards\n~1500 rows, ~11.7KiB"`,
+	} {
+		if !strings.Contains(nodes[i], want) {
+			t.Errorf("node %d: got %s, want %s", i, nodes[i], want)
+		}
+	}
+	// Shuffle edges carry the shuffled volumes of EstimateShuffle.
+	for i, want := range []string{
+		`s0 -> s1 [label="~500 rows, ~3.9KiB", style=bold];`,
+		`s1 -> s2 [label="~1500 rows, ~11.7KiB", style=bold];`,
+	} {
+		if got := edges[i]; got != want {
+			t.Errorf("edge %d: got %s, want %s", i, got, want)
+		}
+	}
+
+	b.Reset()
+	if err := (Estimator{}).WriteDot(&b, DotOptions{Shards: true}, estimateFunc, false); err != nil {
+		t.Fatal(err)
+	}
+	nodes, edges = dotLines(t, b.String())
+	if got, want := len(nodes), 12; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := len(edges), 32; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := strings.Count(b.String(), "subgraph cluster_"), 3; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if !strings.Contains(b.String(), "(incomplete)") {
+		t.Error("expected incomplete estimates")
+	}
+}
+
+func TestWriteDotLarge(t *testing.T) {
+	const N = 200
+	// Each reshuffle begins a new stage.
+	fn := bigslice.Func(func() bigslice.Slice {
+		slice := bigslice.Const(10, rangeSlice(0, 1000))
+		for i := 0; i < N; i++ {
+			slice = bigslice.Reshuffle(slice)
+		}
+		return slice
+	})
+	var b bytes.Buffer
+	if err := WriteDot(&b, fn); err != nil {
+		t.Fatal(err)
+	}
+	nodes, edges := dotLines(t, b.String())
+	if got, want := len(nodes), N+1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := len(edges), N; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestWriteDotResult(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		sess  = Start(Local)
+		reuse = bigslice.Func(func(slice bigslice.Slice) bigslice.Slice {
+			return bigslice.Reduce(slice, func(a, b int) int { return a + b })
+		})
+	)
+	defer sess.Shutdown()
+	res, err := sess.Run(ctx, bigslice.Func(func() bigslice.Slice {
+		return bigslice.Const(2, rangeSlice(0, 10), rangeSlice(0, 10))
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := WriteDot(&b, reuse, res); err != nil {
+		t.Fatal(err)
+	}
+	nodes, edges := dotLines(t, b.String())
+	// The result is read by a stage that shuffles it for the reduce.
+	if got, want := len(nodes), 3; got != want {
+		t.Fatalf("got %v, want %v:\n%s", got, want, b.String())
+	}
+	// The result's stage is dashed, with its measured size.
+	var result string
+	for _, node := range nodes {
+		if strings.Contains(node, "result of invocation") {
+			result = node
+		}
+	}
+	if !strings.Contains(result, "~10 rows") || !strings.HasSuffix(result, "style=dashed];") {
+		t.Errorf("got %q, want dashed result node with 10 rows", result)
+	}
+	if got, want := len(edges), 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
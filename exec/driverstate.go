@@ -0,0 +1,273 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/limiter"
+	"github.com/grailbio/base/log"
+)
+
+// driverStateInterval is the minimum interval between writes of an
+// invocation's driver state.
+var driverStateInterval = 5 * time.Second
+
+// StatePrefix is an Option that persists the state of the task graph
+// of each invocation run by the session to durable storage, under the
+// provided path prefix: which tasks have completed, and the addresses
+// of the machines that store their outputs. The state is written as
+// tasks complete or are lost, and once more when the invocation
+// returns. A driver that is restarted after a crash may then use
+// Session.Reattach to resume its invocations from their persisted
+// state instead of recomputing them.
+//
+// State is recorded only for executors whose task outputs may outlive
+// the driver (currently, the bigmachine executor), and only for tasks
+// whose outputs are not written to shared machine combiners.
+func StatePrefix(prefix string) Option {
+	return func(s *Session) {
+		s.statePrefix = prefix
+	}
+}
+
+// A reattacher is an Executor whose task outputs may outlive the
+// driver, so that a restarted driver may reattach to them.
+type reattacher interface {
+	// TaskAddr returns the address of the machine that stores the
+	// output of the provided task, or "" if there is none.
+	TaskAddr(task *Task) string
+	// Reattach reattaches the provided task to its output, as stored
+	// by a previous driver on the machine with the provided address.
+	// Reattach returns an error if the output is unavailable, e.g.,
+	// because the machine has died.
+	Reattach(ctx context.Context, task *Task, addr string) error
+}
+
+// invocationKey identifies an invocation across driver processes.
+// Invocation indices are assigned in invocation order, so that a
+// restarted driver that makes the same invocations in the same order
+// compiles tasks with the same names as its predecessor.
+type invocationKey struct {
+	Index    uint64
+	Func     uint64
+	Location string
+}
+
+func (k invocationKey) String() string {
+	return fmt.Sprintf("%s(%d, %d)", k.Location, k.Func, k.Index)
+}
+
+func makeInvocationKey(inv execInvocation) invocationKey {
+	return invocationKey{inv.Index, inv.Func, inv.Location}
+}
+
+// driverState is the persisted state of an invocation's task graph.
+// It is stored, JSON-encoded, at the path given by driverStatePath.
+type driverState struct {
+	// Invocation is the invocation whose state is recorded.
+	Invocation invocationKey
+	// Tasks are the invocation's completed tasks, ordered by name.
+	Tasks []taskLocation
+}
+
+// taskLocation records the location of a completed task's output.
+type taskLocation struct {
+	Name TaskName
+	// Addr is the address of the machine that stores the task's
+	// output.
+	Addr string
+}
+
+func driverStatePath(prefix string, key invocationKey) string {
+	return fmt.Sprintf("%s-inv%d.json", prefix, key.Index)
+}
+
+// makeDriverState returns the current state of the task graph given
+// by roots, as located by the provided executor.
+func makeDriverState(key invocationKey, roots []*Task, x reattacher) driverState {
+	state := driverState{Invocation: key}
+	_ = iterTasks(roots, func(task *Task) error {
+		if task.CombineKey != "" || task.State() != TaskOk {
+			return nil
+		}
+		if addr := x.TaskAddr(task); addr != "" {
+			state.Tasks = append(state.Tasks, taskLocation{task.Name, addr})
+		}
+		return nil
+	})
+	sort.Slice(state.Tasks, func(i, j int) bool {
+		return state.Tasks[i].Name.String() < state.Tasks[j].Name.String()
+	})
+	return state
+}
+
+func writeDriverState(ctx context.Context, path string, state driverState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	f, err := file.Create(ctx, path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Writer(ctx).Write(b); err != nil {
+		f.Discard(ctx)
+		return err
+	}
+	return f.Close(ctx)
+}
+
+func readDriverState(ctx context.Context, path string) (state driverState, err error) {
+	f, err := file.Open(ctx, path)
+	if err != nil {
+		return state, err
+	}
+	defer file.CloseAndReport(ctx, f, &err)
+	b, err := ioutil.ReadAll(f.Reader(ctx))
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return state, errors.E(errors.Invalid, fmt.Sprintf("driver state %s", path), err)
+	}
+	return state, nil
+}
+
+// maintainDriverState persists the state of the provided invocation's
+// task graph whenever its tasks change state, at most once every
+// driverStateInterval. The returned function stops maintenance after
+// a final write, and returns once it is complete.
+func (s *Session) maintainDriverState(inv execInvocation, roots []*Task) (stop func()) {
+	x, ok := s.executor.(reattacher)
+	if !ok {
+		return func() {}
+	}
+	var (
+		key         = makeInvocationKey(inv)
+		path        = driverStatePath(s.statePrefix, key)
+		sub         = NewTaskSubscriber()
+		ctx, cancel = context.WithCancel(s.Context)
+		done        = make(chan struct{})
+	)
+	_ = iterTasks(roots, func(task *Task) error {
+		task.Subscribe(sub)
+		return nil
+	})
+	write := func() {
+		if err := writeDriverState(s.Context, path, makeDriverState(key, roots, x)); err != nil {
+			log.Error.Printf("error writing driver state %s: %v", path, err)
+		}
+	}
+	go func() {
+		defer close(done)
+		defer func() {
+			_ = iterTasks(roots, func(task *Task) error {
+				task.Unsubscribe(sub)
+				return nil
+			})
+			write()
+		}()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sub.Ready():
+			}
+			_ = sub.Tasks()
+			write()
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(driverStateInterval):
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// reattach reattaches the tasks of the provided invocation to the
+// outputs recorded in the invocation's driver state, marking them
+// TaskOk. Tasks whose outputs are no longer available, e.g., because
+// the machines that stored them have died, are left to be recomputed.
+func (s *Session) reattach(ctx context.Context, inv execInvocation, roots []*Task) error {
+	if s.statePrefix == "" {
+		return errors.E(errors.Precondition, "reattach: session has no state prefix")
+	}
+	x, ok := s.executor.(reattacher)
+	if !ok {
+		log.Printf("reattach: executor %s cannot reattach to task outputs; recomputing all tasks", s.executor.Name())
+		return nil
+	}
+	key := makeInvocationKey(inv)
+	path := driverStatePath(s.statePrefix, key)
+	state, err := readDriverState(ctx, path)
+	switch {
+	case errors.Is(errors.NotExist, err):
+		log.Printf("reattach: no driver state at %s; recomputing all tasks", path)
+		return nil
+	case err != nil:
+		return err
+	}
+	if state.Invocation != key {
+		return errors.E(errors.Precondition,
+			fmt.Sprintf("reattach: driver state %s is for invocation %s, not %s", path, state.Invocation, key))
+	}
+	addrs := make(map[TaskName]string, len(state.Tasks))
+	for _, loc := range state.Tasks {
+		addrs[loc.Name] = loc.Addr
+	}
+	var (
+		limiter = limiter.New()
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		n       int
+	)
+	limiter.Release(64)
+	err = iterTasks(roots, func(task *Task) error {
+		addr, ok := addrs[task.Name]
+		if !ok || task.CombineKey != "" {
+			return nil
+		}
+		if err := limiter.Acquire(ctx, 1); err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer limiter.Release(1)
+			if err := x.Reattach(ctx, task, addr); err != nil {
+				log.Printf("reattach: %v: recomputing: %v", task.Name, err)
+				return
+			}
+			task.Set(TaskOk)
+			mu.Lock()
+			n++
+			mu.Unlock()
+		}()
+		return nil
+	})
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	log.Printf("reattach: %s: reattached %d of %d recorded tasks", key, n, len(state.Tasks))
+	s.eventer.Event("bigslice:reattach",
+		"invocation", key.String(),
+		"recorded", len(state.Tasks),
+		"reattached", n)
+	return nil
+}
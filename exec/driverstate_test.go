@@ -0,0 +1,145 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/eventlog"
+	"github.com/grailbio/bigmachine/testsystem"
+	"github.com/grailbio/bigslice"
+	"github.com/grailbio/testutil"
+)
+
+func TestReattach(t *testing.T) {
+	dir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	x, stop := bigmachineTestExecutor(1)
+	defer stop()
+	sess := x.sess
+	sess.executor = x
+	sess.eventer = eventlog.Nop{}
+	sess.statePrefix = filepath.Join(dir, "state")
+
+	ctx := context.Background()
+	tasks, _, inv := compileFunc(func() bigslice.Slice {
+		slice := bigslice.Const(4, []string{"a", "b", "c", "a"}, []int{1, 2, 3, 4})
+		return bigslice.Reduce(slice, func(a, b int) int { return a + b })
+	})
+	if err := Eval(ctx, x, tasks, nil); err != nil {
+		t.Fatal(err)
+	}
+	var ntask int
+	_ = iterTasks(tasks, func(*Task) error { ntask++; return nil })
+
+	key := makeInvocationKey(inv)
+	path := driverStatePath(sess.statePrefix, key)
+	state := makeDriverState(key, tasks, x)
+	if got, want := len(state.Tasks), ntask; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if err := writeDriverState(ctx, path, state); err != nil {
+		t.Fatal(err)
+	}
+	read, err := readDriverState(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, state) {
+		t.Errorf("got %v, want %v", read, state)
+	}
+
+	// Discard the output of a source task, as if its machine had died.
+	var lost *Task
+	_ = iterTasks(tasks, func(task *Task) error {
+		if len(task.Deps) == 0 && lost == nil {
+			lost = task
+		}
+		return nil
+	})
+	x.Discard(ctx, lost)
+
+	// Recompile the invocation, as would a restarted driver, and
+	// reattach its tasks.
+	restarted, err := compile(inv, inv.Invoke(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sess.reattach(ctx, inv, restarted); err != nil {
+		t.Fatal(err)
+	}
+	var nok int
+	_ = iterTasks(restarted, func(task *Task) error {
+		switch state := task.State(); {
+		case task.Name == lost.Name:
+			if state != TaskInit {
+				t.Errorf("task %v: got %v, want %v", task.Name, state, TaskInit)
+			}
+		case state == TaskOk:
+			nok++
+		}
+		return nil
+	})
+	if got, want := nok, ntask-1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err = Eval(ctx, x, restarted, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Invocations without state are recomputed in full.
+	tasks, _, inv = compileFunc(func() bigslice.Slice {
+		return bigslice.Const(1, []int{1})
+	})
+	if err = sess.reattach(ctx, inv, tasks); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tasks[0].State(), TaskInit; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// State must match the invocation.
+	state.Invocation = makeInvocationKey(inv)
+	state.Invocation.Location = "elsewhere"
+	if err = writeDriverState(ctx, driverStatePath(sess.statePrefix, makeInvocationKey(inv)), state); err != nil {
+		t.Fatal(err)
+	}
+	if err = sess.reattach(ctx, inv, tasks); !errors.Is(errors.Precondition, err) {
+		t.Errorf("got %v, want precondition error", err)
+	}
+}
+
+func TestStatePrefix(t *testing.T) {
+	dir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	prefix := filepath.Join(dir, "state")
+	sess := Start(Bigmachine(testsystem.New()), StatePrefix(prefix))
+	defer sess.Shutdown()
+	ctx := context.Background()
+	fn := bigslice.Func(func() bigslice.Slice {
+		return bigslice.Const(2, []int{1, 2, 3})
+	})
+	res, err := sess.Run(ctx, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := readDriverState(ctx, driverStatePath(prefix, invocationKey{Index: res.invIndex}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := state.Invocation.Index, res.invIndex; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := len(state.Tasks), 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// A session without a state prefix cannot reattach.
+	if _, err := Start(Local).Reattach(ctx, fn); !errors.Is(errors.Precondition, err) {
+		t.Errorf("got %v, want precondition error", err)
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"runtime"
+	"sort"
+
+	"github.com/grailbio/bigslice"
+)
+
+// A ShuffleEstimate is an estimate of the volume of data that the
+// computation of an invocation moves across its shuffle boundaries.
+// Estimates are approximate: they are derived from size hints, and
+// are only as accurate as the hints from which they are derived. See
+// EstimateShuffle.
+type ShuffleEstimate struct {
+	// Stages holds the estimates of each stage whose output is
+	// shuffled, ordered by stage name.
+	Stages []StageShuffle
+	// Rows and Bytes are the estimated number of rows and bytes moved
+	// across all shuffle boundaries. Bytes is an estimate of the network
+	// cost of the computation.
+	Rows, Bytes int64
+	// Complete tells whether the estimate accounts for all the sources
+	// of the computation. Sources without size hints are taken to be
+	// empty.
+	Complete bool
+}
+
+// NetworkCost returns the estimated cost of the data moved across the
+// computation's shuffle boundaries, given a price per GiB transferred.
+func (e *ShuffleEstimate) NetworkCost(pricePerGiB float64) float64 {
+	return float64(e.Bytes) / (1 << 30) * pricePerGiB
+}
+
+// A StageShuffle is the estimated volume of data shuffled from the
+// tasks of a stage to the tasks that depend on them.
+type StageShuffle struct {
+	// Stage is the name of the stage whose output is shuffled, as
+	// displayed in the session's status.
+	Stage string
+	// NumShard is the number of tasks of the stage.
+	NumShard int
+	// Rows and Bytes are the estimated number of rows and bytes read by
+	// the stage's dependents. The output of a broadcast is counted once
+	// for each of its readers.
+	Rows, Bytes int64
+	// Complete tells whether the estimate accounts for all the sources
+	// from which the stage is computed.
+	Complete bool
+}
+
+// String returns a one-line description of the stage's estimate.
+func (s StageShuffle) String() string {
+	str := fmt.Sprintf("stage %s (%d shards): ~%d rows, ~%d bytes", s.Stage, s.NumShard, s.Rows, s.Bytes)
+	if !s.Complete {
+		str += " (incomplete: some sources lack size hints)"
+	}
+	return str
+}
+
+// An Estimator estimates the shuffle volume of invocations. The zero
+// Estimator derives estimates only from the size and selectivity hints
+// of slices (see bigslice.SizeHint and bigslice.Selectivity).
+type Estimator struct {
+	// Selectivity overrides the selectivity of slices, keyed by the
+	// slices' names (e.g., "filter@pipeline.go:12") or operations
+	// (e.g., "reduce"). Overrides take precedence over Selectivity
+	// pragmas, and may be used to hint at the selectivity of slices
+	// that do not accept pragmas, such as Reduce.
+	Selectivity map[string]float64
+}
+
+// EstimateShuffle estimates the volume of data that the computation of
+// the invocation of funcv with the provided arguments moves across its
+// shuffle boundaries, using the zero Estimator.
+func EstimateShuffle(funcv *bigslice.FuncValue, args ...interface{}) (*ShuffleEstimate, error) {
+	return Estimator{}.EstimateShuffle(funcv, args...)
+}
+
+// EstimateShuffle estimates the volume of data that the computation of
+// the invocation of funcv with the provided arguments moves across its
+// shuffle boundaries. The invocation is compiled, as it would be by
+// Session.Run, but nothing is computed. The sizes of source slices are
+// taken from their SizeHint pragmas, and are propagated through the
+// compiled stages by the selectivity of each slice. Results passed as
+// arguments contribute their measured sizes. Estimates do not account
+// for the reductions of combiners (e.g., of Reduce), which occur before
+// data is shuffled: estimates of combined shuffles are upper bounds.
+func (e Estimator) EstimateShuffle(funcv *bigslice.FuncValue, args ...interface{}) (*ShuffleEstimate, error) {
+	inv, tasks, err := compileEstimate(1, funcv, args)
+	if err != nil {
+		return nil, err
+	}
+	type stageSize struct {
+		StageShuffle
+		size taskSize
+	}
+	var (
+		est    = &ShuffleEstimate{Complete: true}
+		sizes  = make(map[*Task]taskSize)
+		stages = make(map[string]*stageSize)
+	)
+	_ = iterTasks(tasks, func(task *Task) error {
+		if task.Name.InvIndex != inv.Index {
+			// The task was computed by a previous invocation.
+			return nil
+		}
+		for _, dep := range task.Deps {
+			if dep.Head == nil || len(dep.Head.Group) == 0 {
+				// Not a shuffle.
+				continue
+			}
+			for i := 0; i < dep.NumTask(); i++ {
+				deptask := dep.Task(i)
+				size := e.size(deptask, sizes)
+				rows, bytes := size.share(deptask.NumPartition)
+				stage := stages[deptask.Name.Op]
+				if stage == nil {
+					stage = &stageSize{
+						StageShuffle: StageShuffle{Stage: deptask.Name.Op, NumShard: deptask.Name.NumShard},
+						size:         taskSize{complete: true},
+					}
+					stages[deptask.Name.Op] = stage
+				}
+				stage.size.rows += rows
+				stage.size.bytes += bytes
+				stage.size.complete = stage.size.complete && size.complete
+			}
+		}
+		return nil
+	})
+	for _, stage := range stages {
+		stage.Rows = int64(math.Round(stage.size.rows))
+		stage.Bytes = int64(math.Round(stage.size.bytes))
+		stage.Complete = stage.size.complete
+		est.Stages = append(est.Stages, stage.StageShuffle)
+		est.Rows += stage.Rows
+		est.Bytes += stage.Bytes
+		est.Complete = est.Complete && stage.Complete
+	}
+	sort.Slice(est.Stages, func(i, j int) bool {
+		return est.Stages[i].Stage < est.Stages[j].Stage
+	})
+	return est, nil
+}
+
+// compileEstimate compiles the invocation of funcv with the provided
+// arguments, attributed to the caller at the provided depth, so that
+// its size may be estimated.
+func compileEstimate(calldepth int, funcv *bigslice.FuncValue, args []interface{}) (execInvocation, []*Task, error) {
+	location := "<unknown>"
+	if _, file, line, ok := runtime.Caller(calldepth + 1); ok {
+		location = fmt.Sprintf("%s:%d", file, line)
+	}
+	var (
+		inv   = makeExecInvocation(funcv.Invocation(location, args...))
+		slice = inv.Invoke()
+	)
+	if err := manifest(context.Background(), &inv, slice); err != nil {
+		return inv, nil, err
+	}
+	tasks, err := compile(inv, slice, false)
+	return inv, tasks, err
+}
+
+// taskSize is the estimated size of the output of a task.
+type taskSize struct {
+	rows, bytes float64
+	complete    bool
+}
+
+// share returns the estimated size of one of n partitions of an
+// output of size s.
+func (s taskSize) share(n int) (rows, bytes float64) {
+	if n < 1 {
+		n = 1
+	}
+	return s.rows / float64(n), s.bytes / float64(n)
+}
+
+// size returns the estimated size of the output of the provided task,
+// summed over its partitions, memoizing estimates in sizes.
+func (e Estimator) size(task *Task, sizes map[*Task]taskSize) taskSize {
+	if size, ok := sizes[task]; ok {
+		return size
+	}
+	task.Lock()
+	measured := task.PartitionSizes
+	task.Unlock()
+	if len(measured) > 0 {
+		// The task was computed by a previous invocation.
+		size := taskSize{complete: true}
+		for _, m := range measured {
+			size.rows += float64(m.Records)
+			size.bytes += float64(m.Bytes)
+		}
+		sizes[task] = size
+		return size
+	}
+	var (
+		size   = taskSize{complete: true}
+		slices = task.Slices
+	)
+	if len(task.Deps) == 0 && len(slices) > 0 {
+		// The task reads a source, which is the first of its pipelined
+		// slices.
+		source := slices[len(slices)-1]
+		slices = slices[:len(slices)-1]
+		var (
+			rows, bytes int64
+			ok          bool
+		)
+		if p, isPragma := source.(bigslice.Pragma); isPragma {
+			rows, bytes, ok = bigslice.SizeHintOf(p)
+		}
+		size.complete = ok
+		if n := source.NumShard(); n > 0 {
+			size.rows = float64(rows) / float64(n)
+			size.bytes = float64(bytes) / float64(n)
+		}
+	}
+	for _, dep := range task.Deps {
+		for i := 0; i < dep.NumTask(); i++ {
+			deptask := dep.Task(i)
+			depSize := e.size(deptask, sizes)
+			rows, bytes := depSize.share(deptask.NumPartition)
+			size.rows += rows
+			size.bytes += bytes
+			size.complete = size.complete && depSize.complete
+		}
+	}
+	// Pipelined slices are ordered from last to first.
+	for i := len(slices) - 1; i >= 0; i-- {
+		ratio := e.selectivity(slices[i])
+		size.rows *= ratio
+		size.bytes *= ratio
+	}
+	sizes[task] = size
+	return size
+}
+
+// selectivity returns the selectivity of the provided slice.
+func (e Estimator) selectivity(slice bigslice.Slice) float64 {
+	name := slice.Name()
+	if ratio, ok := e.Selectivity[name.String()]; ok {
+		return ratio
+	}
+	if ratio, ok := e.Selectivity[name.Op]; ok {
+		return ratio
+	}
+	if p, ok := slice.(bigslice.Pragma); ok {
+		if ratio := bigslice.SelectivityOf(p); ratio > 0 {
+			return ratio
+		}
+	}
+	return 1
+}
@@ -0,0 +1,65 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"testing"
+
+	"github.com/grailbio/bigslice"
+	"github.com/grailbio/bigslice/sliceio"
+)
+
+var estimateFunc = bigslice.Func(func(hint bool) bigslice.Slice {
+	var prags []bigslice.Pragma
+	if hint {
+		prags = append(prags, bigslice.SizeHint(1000, 8000))
+	}
+	slice := bigslice.ReaderFunc(4, func(shard int, state *int, out []int) (int, error) {
+		return 0, sliceio.EOF
+	}, prags...)
+	slice = bigslice.Filter(slice, func(i int) bool { return i%2 == 0 }, bigslice.Selectivity(0.5))
+	slice = bigslice.Reshuffle(slice)
+	slice = bigslice.Flatmap(slice, func(i int) ([]int, []int) { return []int{i, i, i}, []int{1, 1, 1} }, bigslice.Selectivity(3))
+	return bigslice.Reduce(slice, func(a, b int) int { return a + b })
+})
+
+func TestEstimateShuffle(t *testing.T) {
+	est, err := EstimateShuffle(estimateFunc, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(est.Stages), 2; got != want {
+		t.Fatalf("got %v, want %v: %v", got, want, est.Stages)
+	}
+	// The filter halves the source; the flatmap triples its input.
+	for i, want := range []struct{ rows, bytes int64 }{{500, 4000}, {1500, 12000}} {
+		stage := est.Stages[i]
+		if stage.Rows != want.rows || stage.Bytes != want.bytes || !stage.Complete {
+			t.Errorf("stage %d: got %v, want %d rows, %d bytes", i, stage, want.rows, want.bytes)
+		}
+	}
+	if got, want := est.Bytes, int64(16000); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := est.NetworkCost(1<<30), 16000.; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	est, err = Estimator{Selectivity: map[string]float64{"filter": 0.25}}.EstimateShuffle(estimateFunc, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := est.Rows, int64(250+750); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	est, err = EstimateShuffle(estimateFunc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if est.Complete || est.Bytes != 0 {
+		t.Errorf("got %+v, want incomplete, empty estimate", est)
+	}
+}
@@ -16,12 +16,27 @@ import (
 	"github.com/grailbio/base/eventlog"
 	"github.com/grailbio/base/log"
 	"github.com/grailbio/base/status"
+	"github.com/grailbio/bigslice"
 	"github.com/grailbio/bigslice/internal/defaultsize"
 	"github.com/grailbio/bigslice/sliceio"
 )
 
 var defaultChunksize = &defaultsize.Chunk
 
+// taskChunkSize returns the chunk size with which the provided task's
+// output is read and written: the chunk size given by the task's
+// pragma, if any, or else the provided session chunk size, if it is
+// positive, or else the default chunk size.
+func taskChunkSize(task *Task, sessionChunkSize int) int {
+	if n := bigslice.ChunkSizeOf(task.Pragma); n > 0 {
+		return n
+	}
+	if sessionChunkSize > 0 {
+		return sessionChunkSize
+	}
+	return *defaultChunksize
+}
+
 // maxConsecutiveLost is the maximum number of times a task can be run and lost
 // consecutively before we give up and consider it an error. This helps catch
 // persistent errors that prevent meaningful progress from being made in an
@@ -74,20 +89,24 @@ type Executor interface {
 // tasks when their dependencies have been satisfied. Eval returns on
 // evaluation error or else when all roots are fully evaluated.
 //
-// TODO(marius): we can often stream across shuffle boundaries. This would
-// complicate scheduling, but may be worth doing.
+// If the executor materializes dependencies lazily (see
+// MaterializeLazy), a task's dependencies are satisfied once they are
+// running, so that Eval can stream across shuffle boundaries.
 func Eval(ctx context.Context, executor Executor, roots []*Task, group *status.Group) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	state := newState()
+	state.lazy = isLazy(executor)
+	completions := completionsOf(executor)
 	for _, task := range roots {
 		state.Enqueue(task)
 	}
 	var (
-		donec   = make(chan *Task, 8)
-		errc    = make(chan error)
-		running int
+		donec    = make(chan *Task, 8)
+		startedc = make(chan *Task)
+		errc     = make(chan error)
+		running  int
 	)
 	for !state.Done() {
 		group.Printf("tasks: runnable: %d", running)
@@ -101,11 +120,14 @@ func Eval(ctx context.Context, executor Executor, roots []*Task, group *status.G
 			case task := <-donec:
 				running--
 				state.Return(task)
+			case task := <-startedc:
+				state.Started(task)
 			}
 		}
 
 		// Mark each ready task as runnable and keep track of them.
 		// The executor manages parallelism.
+		var run []*Task
 		for _, task := range state.Runnable() {
 			task.Lock()
 			if task.state == TaskLost {
@@ -115,16 +137,34 @@ func Eval(ctx context.Context, executor Executor, roots []*Task, group *status.G
 			status := group.Start(task.Name)
 			// runner is true if this evaluator is going to execute the task.
 			runner := task.state == TaskInit
-			var startRunTime time.Time
+			var (
+				startRunTime time.Time
+				attempt      int
+			)
 			if runner {
 				task.state = TaskWaiting
 				task.Status = status
 				startRunTime = time.Now()
-				go executor.Run(task)
+				task.attempts++
+				attempt = task.attempts
+				run = append(run, task)
 			} else {
 				status.Print("running in another invocation")
 			}
 			running++
+			if state.lazy {
+				// Tasks that depend lazily on this one may be run once it
+				// is running.
+				go func(task *Task) {
+					if _, err := task.WaitState(ctx, TaskRunning); err != nil {
+						return
+					}
+					select {
+					case startedc <- task:
+					case <-ctx.Done():
+					}
+				}(task)
+			}
 			go func(task *Task) {
 				var err error
 				for task.state < TaskOk && err == nil {
@@ -150,10 +190,22 @@ func Eval(ctx context.Context, executor Executor, roots []*Task, group *status.G
 						}
 					}
 					d := time.Since(startRunTime)
-					executor.Eventer().Event("bigslice:taskComplete",
+					fields := []interface{}{
 						"name", task.Name.String(),
 						"state", task.state.String(),
-						"duration", d.Nanoseconds()/1e6)
+						"duration", d.Nanoseconds() / 1e6,
+					}
+					for _, k := range sortedTagKeys(task.Tags) {
+						fields = append(fields, "tag:"+k, task.Tags[k])
+					}
+					executor.Eventer().Event("bigslice:taskComplete", fields...)
+					if task.state >= TaskOk {
+						completions.send(makeCompletion(task, attempt, startRunTime))
+					} else {
+						// The evaluation was abandoned before the attempt
+						// completed: it is reported once it does.
+						completions.await(task, attempt, startRunTime)
+					}
 				}
 				task.Unlock()
 				status.Done()
@@ -164,6 +216,7 @@ func Eval(ctx context.Context, executor Executor, roots []*Task, group *status.G
 				}
 			}(task)
 		}
+		dispatch(executor, run)
 	}
 	return state.Err()
 }
@@ -185,11 +238,23 @@ func Eval(ctx context.Context, executor Executor, roots []*Task, group *status.G
 // In order to ensure that the state operates on consistent view of
 // the task graph, waitlist decisions are memoized per toplevel call;
 // it does not require locking subgraphs.
+//
+// If the state is lazy, tasks wait only for the tasks on which they
+// depend to be running: instead of waitlists, the state maintains the
+// set of tasks that lazily depend on each phase, which are
+// re-enqueued, and thus reconciled, whenever a task of the phase
+// starts running (see Started).
 type state struct {
 	// deps and counts maintains the task waitlist.
 	deps   map[*Task]map[*Task]struct{}
 	counts map[*Task]int
 
+	// lazy indicates that tasks depend lazily on their dependencies.
+	lazy bool
+	// lazyDeps stores the set of tasks that lazily depend on each
+	// phase, keyed by the phase's head task.
+	lazyDeps map[*Task]map[*Task]struct{}
+
 	// todo is the set of tasks that are scheduled to be run. They are
 	// retrieved via the Runnable method.
 	todo map[*Task]bool
@@ -202,18 +267,26 @@ type state struct {
 	// atomic reading of task state), per round. This is what enables
 	// state to maintain a consistent view of the task graph state.
 	wait map[*Task]int
+	// lazyWait stores memoized counts of the tasks of each phase that
+	// are not yet running, per round, as wait.
+	lazyWait map[*Task]int
 
 	err error
+	// cancelErr is the error of the first task of a cancelled stage;
+	// it is reported if no other error occurred.
+	cancelErr error
 }
 
 // newState returns a newly allocated, empty state.
 func newState() *state {
 	return &state{
-		deps:    make(map[*Task]map[*Task]struct{}),
-		counts:  make(map[*Task]int),
-		todo:    make(map[*Task]bool),
-		pending: make(map[*Task]bool),
-		wait:    make(map[*Task]int),
+		deps:     make(map[*Task]map[*Task]struct{}),
+		counts:   make(map[*Task]int),
+		lazyDeps: make(map[*Task]map[*Task]struct{}),
+		todo:     make(map[*Task]bool),
+		pending:  make(map[*Task]bool),
+		wait:     make(map[*Task]int),
+		lazyWait: make(map[*Task]int),
 	}
 }
 
@@ -238,7 +311,13 @@ func (s *state) Enqueue(task *Task) (nwait int) {
 	}
 	for _, task := range task.Phase() {
 		switch task.State() {
-		case TaskOk, TaskErr:
+		case TaskOk:
+		case TaskErr:
+			if isStageCancelled(task.Err()) {
+				// Tasks of cancelled stages never complete, so that
+				// their dependents are never run.
+				nwait++
+			}
 		case TaskWaiting, TaskRunning:
 			s.schedule(task)
 			nwait++
@@ -246,6 +325,13 @@ func (s *state) Enqueue(task *Task) (nwait int) {
 			s.clear(task)
 			ready := true
 			for _, dep := range task.Deps {
+				if s.lazy {
+					if s.enqueueLazy(dep.Head) > 0 {
+						s.addLazy(dep.Head.Head(), task)
+						ready = false
+					}
+					continue
+				}
 				n := s.Enqueue(dep.Head)
 				if n == 0 {
 					continue
@@ -263,6 +349,45 @@ func (s *state) Enqueue(task *Task) (nwait int) {
 	return
 }
 
+// enqueueLazy enqueues the phase of the provided task, as Enqueue,
+// returning the number of tasks of the phase that are not yet running
+// or done, and which lazily dependent tasks must thus wait for.
+func (s *state) enqueueLazy(task *Task) (nwait int) {
+	head := task.Head()
+	if n, ok := s.lazyWait[head]; ok {
+		return n
+	}
+	s.Enqueue(head)
+	for _, task := range head.Phase() {
+		if state := task.State(); state != TaskRunning && state != TaskOk {
+			nwait++
+		}
+	}
+	s.lazyWait[head] = nwait
+	return
+}
+
+// Started notifies the state that the provided pending task has
+// started running (or is done), re-enqueueing the tasks that lazily
+// depend on its phase, which may consequently have become ready.
+func (s *state) Started(task *Task) {
+	s.wait = make(map[*Task]int)
+	s.lazyWait = make(map[*Task]int)
+	s.enqueueLazyDeps(task)
+}
+
+// enqueueLazyDeps re-enqueues the tasks that lazily depend on the
+// phase of the provided task.
+func (s *state) enqueueLazyDeps(task *Task) {
+	dsts := make([]*Task, 0, len(s.lazyDeps[task.Head()]))
+	for dst := range s.lazyDeps[task.Head()] {
+		dsts = append(dsts, dst)
+	}
+	for _, dst := range dsts {
+		s.Enqueue(dst)
+	}
+}
+
 // Return returns a pending task to state, recomputing the state view
 // and scheduling follow-on tasks.
 func (s *state) Return(task *Task) {
@@ -272,6 +397,7 @@ func (s *state) Return(task *Task) {
 	// Clear the wait map between each call since the state of tasks may
 	// have changed between calls.
 	s.wait = make(map[*Task]int)
+	s.lazyWait = make(map[*Task]int)
 	delete(s.pending, task)
 	switch task.State() {
 	default:
@@ -280,11 +406,24 @@ func (s *state) Return(task *Task) {
 		s.schedule(task)
 	case TaskErr:
 		msg := fmt.Sprintf("error running %s", task.Name)
+		if isStageCancelled(task.err) {
+			// Tasks of cancelled stages do not abort evaluation; we let
+			// independent tasks proceed. Tasks depending on this one are
+			// never scheduled, and the error is reported once evaluation
+			// can no longer make progress.
+			if s.cancelErr == nil {
+				s.cancelErr = errors.E(errors.Canceled, msg, task.err)
+			}
+			break
+		}
 		s.err = errors.E(msg, task.err)
 	case TaskOk:
 		for _, task := range s.done(task.Head()) {
 			s.Enqueue(task)
 		}
+		// The task's Started notification may not yet have been
+		// delivered.
+		s.enqueueLazyDeps(task)
 	case TaskLost:
 		// Re-enqueue immediately.
 		s.Enqueue(task)
@@ -321,7 +460,10 @@ func (s *state) Done() bool {
 
 // Err returns an error, if any, that occurred during evaluation.
 func (s *state) Err() error {
-	return s.err
+	if s.err != nil {
+		return s.err
+	}
+	return s.cancelErr
 }
 
 // Schedule schedules the provided task. It is a no-op if
@@ -340,6 +482,9 @@ func (s *state) clear(task *Task) {
 		if d := s.deps[dep.Head]; d != nil {
 			delete(d, task)
 		}
+		if d := s.lazyDeps[dep.Head.Head()]; d != nil {
+			delete(d, task)
+		}
 	}
 }
 
@@ -354,6 +499,15 @@ func (s *state) add(src, dst *Task, n int) {
 	}
 }
 
+// addLazy adds a lazy dependency from the provided src to dst tasks.
+func (s *state) addLazy(src, dst *Task) {
+	if d := s.lazyDeps[src]; d == nil {
+		s.lazyDeps[src] = map[*Task]struct{}{dst: {}}
+	} else {
+		d[dst] = struct{}{}
+	}
+}
+
 // Done marks the provided task as done, and returns the set
 // of tasks that have consequently become ready for evaluation.
 func (s *state) done(src *Task) (ready []*Task) {
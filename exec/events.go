@@ -0,0 +1,236 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"sync"
+	"time"
+)
+
+// An EventType identifies the kind of an Event, and so the schema of
+// its fields. Event types and their fields are stable: new fields may
+// be added to existing types, but fields are not removed or changed.
+type EventType string
+
+const (
+	// EventInvocation is published when an invocation starts to run
+	// and when it is done. Its fields are "location" (string), the
+	// location of the invocation; "index" (uint64), the invocation's
+	// index; "state" (string), either "start" or "done"; and, for
+	// invocations that fail, "error" (string).
+	EventInvocation EventType = "invocation"
+	// EventTaskState is published whenever a task changes state. Its
+	// fields are "state" (string), the task's new state (see
+	// TaskState.String); and, for tasks that fail or are lost with an
+	// error, "error" (string).
+	EventTaskState EventType = "taskState"
+	// EventTaskStats is published periodically while a task runs on a
+	// machine, reporting its progress, e.g., the number of records it
+	// has read and written, which measures the progress of shuffles.
+	// Its fields are "machine" (string), the address of the machine
+	// running the task, and one field (int64) for each of the task's
+	// stats, keyed by the name of the stat (e.g., "read", "write").
+	EventTaskStats EventType = "taskStats"
+	// EventMachine is published when a machine is provisioned, fails
+	// to start, or stops. Its fields are "state" (string), one of
+	// "ready", "failed", or "stopped"; "machine" (string), the address
+	// of the machine, if any; "count" (int), the number of machines
+	// that failed to start, for "failed" events; and, for machines
+	// that stop with an error, "error" (string).
+	EventMachine EventType = "machine"
+)
+
+// An Event is a structured event published by a session to its
+// subscribers (see EventSubscriber).
+type Event struct {
+	// Type is the type of the event.
+	Type EventType
+	// Time is the time at which the event was published.
+	Time time.Time
+	// Task is the name of the task that the event concerns, or the zero
+	// TaskName if the event does not concern a task.
+	Task TaskName
+	// Fields holds the payload of the event, whose schema is given by
+	// its type.
+	Fields map[string]interface{}
+	// Dropped is the number of events that were dropped for the
+	// subscriber, because it did not keep up with the session's events,
+	// immediately before this one.
+	Dropped int
+}
+
+// Stage returns the name of the stage of the task that the event
+// concerns, as displayed in the session's status, or "" if the event
+// does not concern a task.
+func (e Event) Stage() string { return e.Task.Op }
+
+// An OverflowPolicy determines which events are dropped when a
+// subscriber does not keep up with a session's events.
+type OverflowPolicy int
+
+const (
+	// DropNewest drops the events that are published while the
+	// subscriber's buffer is full.
+	DropNewest OverflowPolicy = iota
+	// DropOldest drops the oldest buffered event to make room for each
+	// event that is published while the subscriber's buffer is full.
+	DropOldest
+)
+
+// EventSubscriber is an Option that publishes the session's events
+// (see EventType) to the provided function, e.g., to export them to an
+// event bus for monitoring. Events are delivered to fn in the order in
+// which they are published, one at a time, by a goroutine dedicated
+// to the subscriber.
+//
+// Publishing never blocks the session: up to buffer events are queued
+// for delivery to each subscriber, and events that are published
+// while its queue is full are dropped according to the provided
+// policy. The number of dropped events is reported to the subscriber
+// by the events that follow them. Events that are queued when the
+// session is shut down are delivered before Shutdown returns.
+//
+// Sessions without subscribers do not publish events, and so incur no
+// overhead.
+func EventSubscriber(fn func(Event), buffer int, policy OverflowPolicy) Option {
+	if buffer < 1 {
+		panic("exec.EventSubscriber: buffer < 1")
+	}
+	return func(s *Session) {
+		if s.events == nil {
+			s.events = new(eventBus)
+		}
+		s.events.subs = append(s.events.subs, &eventSub{
+			fn:     fn,
+			buffer: buffer,
+			policy: policy,
+			readyc: make(chan struct{}, 1),
+			donec:  make(chan struct{}),
+		})
+	}
+}
+
+// An eventBus publishes events to a session's subscribers. A nil
+// *eventBus publishes nothing.
+type eventBus struct {
+	subs   []*eventSub
+	closec chan struct{}
+}
+
+// start starts delivering events to the bus's subscribers.
+func (b *eventBus) start() {
+	if b == nil {
+		return
+	}
+	b.closec = make(chan struct{})
+	for _, sub := range b.subs {
+		go sub.loop(b.closec)
+	}
+}
+
+// close stops the bus, returning once its queued events have been
+// delivered.
+func (b *eventBus) close() {
+	if b == nil {
+		return
+	}
+	close(b.closec)
+	for _, sub := range b.subs {
+		<-sub.donec
+	}
+}
+
+// publish publishes an event of the provided type to every subscriber.
+// Fields are given as key-value pairs k0, v0, k1, v1, ..., kn, vn.
+func (b *eventBus) publish(typ EventType, task TaskName, fields ...interface{}) {
+	if b == nil {
+		return
+	}
+	if len(fields)%2 != 0 {
+		panic("eventBus.publish: invalid fields")
+	}
+	e := Event{
+		Type:   typ,
+		Time:   time.Now(),
+		Task:   task,
+		Fields: make(map[string]interface{}, len(fields)/2),
+	}
+	for i := 0; i < len(fields); i += 2 {
+		e.Fields[fields[i].(string)] = fields[i+1]
+	}
+	for _, sub := range b.subs {
+		sub.send(e)
+	}
+}
+
+// An eventSub is a subscriber of an eventBus.
+type eventSub struct {
+	fn     func(Event)
+	buffer int
+	policy OverflowPolicy
+	// readyc is signalled when events are queued.
+	readyc chan struct{}
+	// donec is closed once the subscriber's loop has returned.
+	donec chan struct{}
+
+	mu    sync.Mutex
+	queue []Event
+	// dropped is the number of events dropped since the last event
+	// that was queued.
+	dropped int
+}
+
+// send queues e for delivery, without blocking.
+func (s *eventSub) send(e Event) {
+	s.mu.Lock()
+	if len(s.queue) == s.buffer {
+		switch s.policy {
+		case DropNewest:
+			s.dropped++
+			s.mu.Unlock()
+			return
+		case DropOldest:
+			// The dropped event precedes the next one in the queue.
+			if len(s.queue) > 1 {
+				s.queue[1].Dropped += s.queue[0].Dropped + 1
+			} else {
+				s.dropped += s.queue[0].Dropped + 1
+			}
+			s.queue = s.queue[1:]
+		}
+	}
+	e.Dropped = s.dropped
+	s.dropped = 0
+	s.queue = append(s.queue, e)
+	s.mu.Unlock()
+	select {
+	case s.readyc <- struct{}{}:
+	default:
+	}
+}
+
+// loop delivers queued events until closec is closed, after which it
+// delivers the remaining queued events and returns.
+func (s *eventSub) loop(closec <-chan struct{}) {
+	defer close(s.donec)
+	for {
+		var closed bool
+		select {
+		case <-s.readyc:
+		case <-closec:
+			closed = true
+		}
+		s.mu.Lock()
+		events := s.queue
+		s.queue = nil
+		s.mu.Unlock()
+		for _, e := range events {
+			s.fn(e)
+		}
+		if closed {
+			return
+		}
+	}
+}
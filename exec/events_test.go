@@ -0,0 +1,114 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/grailbio/bigslice"
+)
+
+func TestEventOverflow(t *testing.T) {
+	for _, c := range []struct {
+		policy  OverflowPolicy
+		want    []int
+		dropped []int
+	}{
+		{DropNewest, []int{0, 1, 2, 3, 8}, []int{0, 0, 0, 0, 4}},
+		{DropOldest, []int{0, 5, 6, 7, 8}, []int{0, 4, 0, 0, 0}},
+	} {
+		var (
+			mu           sync.Mutex
+			got, dropped []int
+			block        = make(chan struct{})
+		)
+		bus := new(eventBus)
+		EventSubscriber(func(e Event) {
+			if e.Fields["i"] == 0 {
+				// Hold up delivery until the rest of the events are
+				// published.
+				<-block
+			}
+			mu.Lock()
+			got = append(got, e.Fields["i"].(int))
+			dropped = append(dropped, e.Dropped)
+			mu.Unlock()
+		}, 3, c.policy)(&Session{events: bus})
+		bus.start()
+		// queued returns the number of events that are queued for
+		// delivery.
+		queued := func() int {
+			sub := bus.subs[0]
+			sub.mu.Lock()
+			defer sub.mu.Unlock()
+			return len(sub.queue)
+		}
+		bus.publish(EventTaskState, TaskName{}, "i", 0)
+		// Wait for the first event to be taken for delivery, which then
+		// blocks; the buffer holds three of the next seven events.
+		for queued() != 0 {
+		}
+		for i := 1; i < 8; i++ {
+			bus.publish(EventTaskState, TaskName{}, "i", i)
+		}
+		close(block)
+		for queued() != 0 {
+		}
+		bus.publish(EventTaskState, TaskName{}, "i", 8)
+		bus.close()
+		if !reflect.DeepEqual(got, c.want) || !reflect.DeepEqual(dropped, c.dropped) {
+			t.Errorf("policy %d: got %v (dropped %v), want %v (dropped %v)", c.policy, got, dropped, c.want, c.dropped)
+		}
+	}
+}
+
+func TestEventSubscriber(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		events []Event
+	)
+	sess := Start(Local, EventSubscriber(func(e Event) {
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	}, 1024, DropNewest))
+	fn := bigslice.Func(func() bigslice.Slice {
+		return bigslice.Const(4, rangeSlice(0, 100))
+	})
+	ctx := context.Background()
+	if _, err := sess.Run(ctx, fn); err != nil {
+		t.Fatal(err)
+	}
+	sess.Shutdown()
+	var (
+		invocations []string
+		ok          = make(map[TaskName]bool)
+	)
+	for _, e := range events {
+		if e.Dropped != 0 {
+			t.Errorf("dropped %d events", e.Dropped)
+		}
+		switch e.Type {
+		case EventInvocation:
+			invocations = append(invocations, e.Fields["state"].(string))
+		case EventTaskState:
+			if e.Stage() == "" {
+				t.Errorf("event %v has no stage", e)
+			}
+			if e.Fields["state"] == TaskOk.String() {
+				ok[e.Task] = true
+			}
+		}
+	}
+	if got, want := invocations, []string{"start", "done"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := len(ok), 4; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigslice"
+)
+
+// finalize finalizes the finalizer slices computed by the provided
+// tasks of invocation inv, which have all completed, in dependency
+// order. Only the tasks of inv are considered, as the slices computed
+// by previous invocations were finalized by those invocations.
+func finalize(ctx context.Context, inv execInvocation, tasks []*Task) error {
+	finalized := make(map[bigslice.FinalizerSlice]bool)
+	return iterTasks(tasks, func(task *Task) error {
+		if task.Name.InvIndex != inv.Index {
+			return nil
+		}
+		for _, slice := range task.Slices {
+			s, ok := bigslice.Unwrap(slice).(bigslice.FinalizerSlice)
+			if !ok || finalized[s] {
+				continue
+			}
+			finalized[s] = true
+			if err := s.Finalize(ctx); err != nil {
+				return errors.E(fmt.Sprintf("%s: finalize", s.Name()), err)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,214 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/bigslice"
+)
+
+// incrementalMark is the high-water mark of an incremental computation
+// (see Session.RunIncremental). It is stored, gob-encoded, at the path
+// given by incrementalMarkPath. A pending mark, stored at the path given
+// by incrementalPendingPath, records the snapshots read by a run that
+// has not yet committed.
+type incrementalMark struct {
+	// Generation is the number of the last committed run. Generations
+	// are never reused, even after the mark is reset, so that the
+	// state of each run is stored at a distinct path.
+	Generation int
+	// Snapshots are the snapshots read by the last committed run, in
+	// the order returned by snapshotSlices. Nil snapshots indicate that
+	// the next run reads all of its sources' data.
+	Snapshots []interface{}
+	// State is the prefix of the checkpoint of the state computed by
+	// the last committed run, or empty if there is none.
+	State string
+}
+
+func incrementalMarkPath(prefix string) string {
+	return file.Join(prefix, "mark")
+}
+
+func incrementalPendingPath(prefix string) string {
+	return file.Join(prefix, "pending")
+}
+
+func incrementalStatePath(prefix string, generation int) string {
+	return file.Join(prefix, fmt.Sprintf("state-%d", generation))
+}
+
+// RunIncremental runs an incremental computation, which maintains a
+// cumulative state (e.g., an aggregate) of an append-only source. Each
+// run reads only the data that was added to the computation's sources
+// since the last successful run, and combines it with the state that
+// was computed by that run: the invocation of funcv is passed, as its
+// first argument, the prefix of the checkpoint of the prior state
+// (see bigslice.ReadCheckpoint), or the empty string if there is none,
+// followed by the provided arguments. The slice returned by funcv is
+// the new state. For example:
+//
+//	var counts = bigslice.Func(func(prior string) bigslice.Slice {
+//		slice := bigslice.ReadGCS(ctx, client, bucket, "logs/")
+//		slice = bigslice.Map(slice, func(line string) (string, int) { return key(line), 1 })
+//		slice = bigslice.Reduce(slice, func(a, b int) int { return a + b })
+//		if prior == "" {
+//			return slice
+//		}
+//		slice = bigslice.Cogroup(slice, bigslice.ReadCheckpoint(ctx, prior, slice))
+//		return bigslice.Map(slice, func(key string, added, prior []int) (string, int) {
+//			return key, sum(added) + sum(prior)
+//		})
+//	})
+//
+// All of the sources of the computation whose data may change must be
+// incremental slices (see bigslice.IncrementalSlice); RunIncremental
+// fails otherwise.
+//
+// The computation's high-water mark, which comprises the snapshots of
+// its sources read by the last successful run, and its state are
+// stored under the provided prefix, which may be any path supported by
+// package github.com/grailbio/base/file: the mark in the file
+// "prefix/mark", and the state of the nth run checkpointed (see
+// bigslice.Checkpoint) with the prefix "prefix/state-n". The mark is
+// advanced only once the new state has been checkpointed in its
+// entirety.
+//
+// New data are incorporated exactly once, even if runs fail and are
+// retried: the snapshots to be read by a run are recorded, in the file
+// "prefix/pending", before any data are read, and a retried run reads
+// the same snapshots, and so computes the same state. Concurrent runs
+// of the same computation are not supported.
+//
+// Checkpoints of the states of previous runs are not removed; they
+// may be removed once the mark has been advanced. ResetIncremental
+// resets the mark, so that the next run reprocesses all of the data.
+func (s *Session) RunIncremental(ctx context.Context, prefix string, funcv *bigslice.FuncValue, args ...interface{}) (*Result, error) {
+	mark, err := readIncrementalMark(ctx, incrementalMarkPath(prefix))
+	if err != nil && !errors.Is(errors.NotExist, err) {
+		return nil, err
+	}
+	pending, err := readIncrementalMark(ctx, incrementalPendingPath(prefix))
+	if err != nil && !errors.Is(errors.NotExist, err) {
+		return nil, err
+	}
+	var (
+		generation = mark.Generation + 1
+		state      = incrementalStatePath(prefix, generation)
+		opts       = []RunOption{func(inv *execInvocation) {
+			inv.Env.Since = mark.Snapshots
+			inv.Env.Checkpoint = state
+		}}
+	)
+	if err == nil && pending.Generation == generation {
+		// A previous attempt of this run failed: read the same data.
+		opts = append(opts, AtSnapshots(pending.Snapshots))
+	} else {
+		opts = append(opts, Snapshot(), func(inv *execInvocation) {
+			inv.snapshotted = func(ctx context.Context, snapshots []interface{}) error {
+				pending := incrementalMark{Generation: generation, Snapshots: snapshots}
+				return writeIncrementalMark(ctx, incrementalPendingPath(prefix), pending)
+			}
+		})
+	}
+	res, err := s.run(ctx, 1, opts, funcv, append([]interface{}{mark.State}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	mark = incrementalMark{Generation: generation, Snapshots: res.Snapshots(), State: state}
+	if err = writeIncrementalMark(ctx, incrementalMarkPath(prefix), mark); err != nil {
+		return nil, err
+	}
+	if err = file.Remove(ctx, incrementalPendingPath(prefix)); err != nil && !errors.Is(errors.NotExist, err) {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ResetIncremental resets the high-water mark of the incremental
+// computation with the provided prefix (see Session.RunIncremental),
+// so that its next run reprocesses all of its sources' data, without
+// prior state.
+func ResetIncremental(ctx context.Context, prefix string) error {
+	mark, err := readIncrementalMark(ctx, incrementalMarkPath(prefix))
+	switch {
+	case errors.Is(errors.NotExist, err):
+		return nil
+	case err != nil:
+		return err
+	}
+	// Keep the generation, so that the states of later runs do not
+	// collide with those of earlier ones.
+	if err = writeIncrementalMark(ctx, incrementalMarkPath(prefix), incrementalMark{Generation: mark.Generation}); err != nil {
+		return err
+	}
+	if err = file.Remove(ctx, incrementalPendingPath(prefix)); err != nil && !errors.Is(errors.NotExist, err) {
+		return err
+	}
+	return nil
+}
+
+// applySince configures the snapshot slices of invocation inv, which
+// produced the provided slice, to read only the data added since the
+// snapshots recorded in inv's environment, if any. It fails if any of
+// the slices is not incremental.
+func applySince(inv execInvocation, slice bigslice.Slice) error {
+	if inv.Env.Since == nil {
+		return nil
+	}
+	slices := snapshotSlices(slice)
+	if got, want := len(inv.Env.Since), len(slices); got != want {
+		return errors.E(errors.Invalid, fmt.Sprintf("got %d high-water marks for %d snapshot slices", got, want))
+	}
+	for i, snap := range slices {
+		incr, ok := snap.(bigslice.IncrementalSlice)
+		if !ok {
+			return errors.E(errors.NotSupported, fmt.Sprintf("%s: slice cannot be read incrementally", snap.Name()))
+		}
+		if err := incr.SetSince(inv.Env.Since[i]); err != nil {
+			return errors.E(fmt.Sprintf("%s: high-water mark", snap.Name()), err)
+		}
+	}
+	return nil
+}
+
+func writeIncrementalMark(ctx context.Context, path string, mark incrementalMark) error {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(mark); err != nil {
+		return err
+	}
+	f, err := file.Create(ctx, path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Writer(ctx).Write(b.Bytes()); err != nil {
+		f.Discard(ctx)
+		return err
+	}
+	return f.Close(ctx)
+}
+
+func readIncrementalMark(ctx context.Context, path string) (mark incrementalMark, err error) {
+	f, err := file.Open(ctx, path)
+	if err != nil {
+		return mark, err
+	}
+	defer f.Close(ctx) // nolint: errcheck
+	b, err := ioutil.ReadAll(f.Reader(ctx))
+	if err != nil {
+		return mark, err
+	}
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&mark); err != nil {
+		return mark, errors.E(errors.Invalid, fmt.Sprintf("incremental mark %s", path), err)
+	}
+	return mark, nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigslice"
+	"github.com/grailbio/testutil"
+)
+
+func TestRunIncremental(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		client = new(versionedGCS)
+		sum    = func(xs []int) (n int) {
+			for _, x := range xs {
+				n += x
+			}
+			return
+		}
+		// fn counts the lines of each letter. It fails, after the
+		// snapshots of its sources are captured, if fail is true.
+		fn = bigslice.Func(func(prior string, fail bool) bigslice.Slice {
+			slice := bigslice.ReadGCS(ctx, client, "bucket", "data/")
+			slice = bigslice.Map(slice, func(line string) (string, int) {
+				if fail {
+					panic("fail")
+				}
+				return line[:1], 1
+			})
+			slice = bigslice.Reduce(slice, func(a, b int) int { return a + b })
+			if prior == "" {
+				return slice
+			}
+			slice = bigslice.Cogroup(slice, bigslice.ReadCheckpoint(ctx, prior, slice))
+			return bigslice.Map(slice, func(key string, added, prior []int) (string, int) {
+				return key, sum(added) + sum(prior)
+			})
+		})
+		read = func(t *testing.T, res *Result) map[string]int {
+			t.Helper()
+			var (
+				scan   = res.Scanner()
+				key    string
+				count  int
+				counts = make(map[string]int)
+			)
+			defer scan.Close()
+			for scan.Scan(ctx, &key, &count) {
+				counts[key] = count
+			}
+			if err := scan.Err(); err != nil {
+				t.Fatal(err)
+			}
+			return counts
+		}
+	)
+	testSession(t, func(t *testing.T, sess *Session) {
+		dir, cleanup := testutil.TempDir(t, "", "")
+		defer cleanup()
+		prefix := filepath.Join(dir, "incremental")
+		run := func(t *testing.T, want map[string]int) {
+			t.Helper()
+			res, err := sess.RunIncremental(ctx, prefix, fn, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := read(t, res); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		}
+
+		client.objects = make(map[string][]string)
+		client.put("data/a", "a1\na2\n")
+		client.put("data/b", "b1\n")
+		run(t, map[string]int{"a": 2, "b": 1})
+		// Nothing was added.
+		run(t, map[string]int{"a": 2, "b": 1})
+
+		client.put("data/c", "a3\nc1\n")
+		run(t, map[string]int{"a": 3, "b": 1, "c": 1})
+
+		// A failed run is retried at the same snapshot, so data added
+		// after it started are incorporated (once) only by the next run.
+		client.put("data/d", "d1\n")
+		if _, err := sess.RunIncremental(ctx, prefix, fn, true); err == nil {
+			t.Fatal("expected error")
+		}
+		client.put("data/e", "e1\n")
+		run(t, map[string]int{"a": 3, "b": 1, "c": 1, "d": 1})
+		run(t, map[string]int{"a": 3, "b": 1, "c": 1, "d": 1, "e": 1})
+
+		// After a reset, all of the data are reprocessed.
+		if err := ResetIncremental(ctx, prefix); err != nil {
+			t.Fatal(err)
+		}
+		run(t, map[string]int{"a": 3, "b": 1, "c": 1, "d": 1, "e": 1})
+
+		// Sources must be append-only.
+		client.put("data/a", "a4\n")
+		_, err := sess.RunIncremental(ctx, prefix, fn, false)
+		if err == nil || !errors.Is(errors.Invalid, err) {
+			t.Errorf("got %v, want Invalid", err)
+		}
+	})
+}
@@ -0,0 +1,320 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigslice"
+)
+
+// invocationMagic begins every encoded invocation.
+var invocationMagic = []byte("bigslice-invocation\n")
+
+// invocationVersion is the version of the invocation encoding, which
+// comprises the encoding's header and the fields of the encoded
+// invocation. It is incremented whenever either changes incompatibly.
+const invocationVersion = 1
+
+// DefaultInvocationEncoding is the name of the invocation encoder used
+// by sessions that are not configured with InvocationEncoding. It
+// encodes invocations with package encoding/gob.
+const DefaultInvocationEncoding = "gob"
+
+// An InvocationEncoder encodes and decodes the invocations that the
+// bigmachine executor sends to its workers, so that each worker may
+// compile the invocation's tasks. The values passed to an encoder
+// contain the invocation's arguments, and so may be of any type that
+// is passed to a Func.
+type InvocationEncoder interface {
+	// Encode writes the encoding of v to w.
+	Encode(w io.Writer, v interface{}) error
+	// Decode decodes a value encoded by Encode from r into v, which is
+	// a pointer to a value of the type that was encoded.
+	Decode(r io.Reader, v interface{}) error
+}
+
+var (
+	invocationEncodersMu sync.Mutex
+	invocationEncoders   = map[string]InvocationEncoder{
+		DefaultInvocationEncoding: gobInvocationEncoder{},
+	}
+)
+
+// RegisterInvocationEncoder registers an invocation encoder with the
+// provided name, which may then be selected by InvocationEncoding.
+// Since the name of the encoder is recorded with each encoded
+// invocation, the encoder must be registered by every process of the
+// session, e.g., in an init function of a package linked into the
+// binary. RegisterInvocationEncoder panics if an encoder is already
+// registered with the name.
+func RegisterInvocationEncoder(name string, enc InvocationEncoder) {
+	if name == "" {
+		panic("exec.RegisterInvocationEncoder: empty encoder name")
+	}
+	invocationEncodersMu.Lock()
+	defer invocationEncodersMu.Unlock()
+	if _, ok := invocationEncoders[name]; ok {
+		panic(fmt.Sprintf("exec.RegisterInvocationEncoder: encoder %q already registered", name))
+	}
+	invocationEncoders[name] = enc
+}
+
+func lookupInvocationEncoder(name string) (InvocationEncoder, bool) {
+	invocationEncodersMu.Lock()
+	defer invocationEncodersMu.Unlock()
+	enc, ok := invocationEncoders[name]
+	return enc, ok
+}
+
+// InvocationEncoding configures the session to encode the invocations
+// that it sends to its workers with the encoder registered with the
+// provided name (see RegisterInvocationEncoder). The default is
+// DefaultInvocationEncoding. InvocationEncoding panics if no encoder is
+// registered with the provided name.
+//
+// Regardless of the encoder, each encoded invocation records the
+// version of the encoding and the identity of the binary that encoded
+// it (see BinaryIdentity), so that a worker that cannot decode it,
+// e.g., because it runs another version of bigslice during a rolling
+// upgrade, fails with an error that names both versions instead of a
+// decoding error. The invocation also records the location and
+// signature of the Func that it invokes, which the worker checks
+// against its own Func registry before it compiles the invocation.
+func InvocationEncoding(name string) Option {
+	if _, ok := lookupInvocationEncoder(name); !ok {
+		panic(fmt.Sprintf("exec.InvocationEncoding: unregistered encoder %q", name))
+	}
+	return func(s *Session) {
+		s.invEncoding = name
+	}
+}
+
+type gobInvocationEncoder struct{}
+
+func (gobInvocationEncoder) Encode(w io.Writer, v interface{}) error {
+	return gob.NewEncoder(w).Encode(v)
+}
+
+func (gobInvocationEncoder) Decode(r io.Reader, v interface{}) error {
+	return gob.NewDecoder(r).Decode(v)
+}
+
+// A funcIdentity identifies a Func referenced by an encoded invocation.
+type funcIdentity struct {
+	// Index is the index of the Func in the Func registry.
+	Index uint64
+	// Location is the location at which the Func was created, as
+	// given by bigslice.FuncLocations.
+	Location string
+	// Signature is the signature of the Func, e.g., "func(int, string)".
+	Signature string
+}
+
+// makeFuncIdentity returns the identity of the Func with the provided
+// index in this process's registry, and whether it is registered.
+func makeFuncIdentity(index uint64) (funcIdentity, bool) {
+	funcv, ok := bigslice.FuncByIndex(index)
+	if !ok {
+		return funcIdentity{}, false
+	}
+	args := make([]string, funcv.NumIn())
+	for i := range args {
+		args[i] = funcv.In(i).String()
+	}
+	return funcIdentity{
+		Index:     index,
+		Location:  bigslice.FuncLocations()[index],
+		Signature: "func(" + strings.Join(args, ", ") + ")",
+	}, true
+}
+
+func (f funcIdentity) String() string {
+	return fmt.Sprintf("%d (%s at %s)", f.Index, f.Signature, f.Location)
+}
+
+// An invocationHeader precedes every encoded invocation.
+type invocationHeader struct {
+	// Binary is the identity of the binary that encoded the invocation.
+	Binary string
+	// Encoder is the name of the encoder that encoded the invocation.
+	Encoder string
+	// Funcs are the identities of the Funcs referenced by the
+	// invocation.
+	Funcs []funcIdentity
+}
+
+// check checks that the invocation with the provided header may be
+// compiled by this process, returning a precondition error that
+// identifies the mismatched Func if it references a Func that is not
+// in this process's registry.
+func (h invocationHeader) check() error {
+	for _, want := range h.Funcs {
+		have, ok := makeFuncIdentity(want.Index)
+		switch {
+		case !ok:
+			return errors.E(errors.Fatal, errors.Precondition,
+				fmt.Sprintf("invocation: func %s, referenced by binary %q, is not registered by binary %q",
+					want, h.Binary, BinaryIdentity()))
+		case have != want:
+			return errors.E(errors.Fatal, errors.Precondition,
+				fmt.Sprintf("invocation: func %s, referenced by binary %q, is func %s in binary %q",
+					want, h.Binary, have, BinaryIdentity()))
+		}
+	}
+	return nil
+}
+
+// encodeInvocation writes the encoding of inv, using the encoder with
+// the provided name, or DefaultInvocationEncoding if the name is empty,
+// to w. The encoding comprises the magic string invocationMagic, the
+// encoding version as a uvarint, and the invocation's header, whose
+// fields are length-prefixed, followed by the encoder's encoding of
+// the invocation.
+func encodeInvocation(w io.Writer, encoder string, inv execInvocation) error {
+	if encoder == "" {
+		encoder = DefaultInvocationEncoding
+	}
+	enc, ok := lookupInvocationEncoder(encoder)
+	if !ok {
+		return errors.E(errors.Fatal, errors.Invalid, fmt.Sprintf("invocation: unregistered encoder %q", encoder))
+	}
+	h := invocationHeader{Binary: BinaryIdentity(), Encoder: encoder}
+	if f, ok := makeFuncIdentity(inv.Func); ok {
+		h.Funcs = append(h.Funcs, f)
+	}
+	var buf bytes.Buffer
+	writeInvocationHeader(&buf, invocationVersion, h)
+	if err := enc.Encode(&buf, inv); err != nil {
+		return errors.E(errors.Fatal, errors.Invalid, "invocation: encoding invocation", err)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// decodeInvocation decodes an invocation encoded by encodeInvocation
+// from r into inv. It fails with a precondition error if the
+// invocation was encoded with another version of the encoding or an
+// unregistered encoder, or if it references Funcs that do not match
+// this process's registry.
+func decodeInvocation(r io.Reader, inv *execInvocation) error {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(invocationMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || !bytes.Equal(magic, invocationMagic) {
+		return errors.E(errors.Invalid, "invocation: not an encoded invocation")
+	}
+	version, err := binary.ReadUvarint(br)
+	if err != nil {
+		return errors.E(errors.Invalid, "invocation: reading version", err)
+	}
+	// The binary's identity precedes the rest of the header in every
+	// version of the encoding, so that it may be reported for any
+	// version.
+	binaryID, err := readString(br)
+	if err != nil {
+		return errors.E(errors.Invalid, "invocation: reading header", err)
+	}
+	if version != invocationVersion {
+		return errors.E(errors.Fatal, errors.Precondition,
+			fmt.Sprintf("invocation: invocation encoded with encoding version %d by binary %q, but binary %q supports encoding version %d",
+				version, binaryID, BinaryIdentity(), invocationVersion))
+	}
+	h, err := readInvocationHeader(br)
+	if err != nil {
+		return errors.E(errors.Invalid, "invocation: reading header", err)
+	}
+	h.Binary = binaryID
+	enc, ok := lookupInvocationEncoder(h.Encoder)
+	if !ok {
+		return errors.E(errors.Fatal, errors.Precondition,
+			fmt.Sprintf("invocation: invocation encoded by binary %q with encoder %q, which is not registered by binary %q",
+				h.Binary, h.Encoder, BinaryIdentity()))
+	}
+	if err := h.check(); err != nil {
+		return err
+	}
+	if err := enc.Decode(br, inv); err != nil {
+		return errors.E(errors.Invalid, fmt.Sprintf("invocation: decoding invocation with encoder %q", h.Encoder), err)
+	}
+	return nil
+}
+
+// writeInvocationHeader writes the magic string, the provided version,
+// and the header h to buf.
+func writeInvocationHeader(buf *bytes.Buffer, version uint64, h invocationHeader) {
+	buf.Write(invocationMagic)
+	writeUvarint(buf, version)
+	writeString(buf, h.Binary)
+	writeString(buf, h.Encoder)
+	writeUvarint(buf, uint64(len(h.Funcs)))
+	for _, f := range h.Funcs {
+		writeUvarint(buf, f.Index)
+		writeString(buf, f.Location)
+		writeString(buf, f.Signature)
+	}
+}
+
+// readInvocationHeader reads the fields of a header that follow the
+// binary's identity from r.
+func readInvocationHeader(r *bufio.Reader) (h invocationHeader, err error) {
+	if h.Encoder, err = readString(r); err != nil {
+		return
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return
+	}
+	for i := uint64(0); i < n; i++ {
+		var f funcIdentity
+		if f.Index, err = binary.ReadUvarint(r); err != nil {
+			return
+		}
+		if f.Location, err = readString(r); err != nil {
+			return
+		}
+		if f.Signature, err = readString(r); err != nil {
+			return
+		}
+		h.Funcs = append(h.Funcs, f)
+	}
+	return
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	writeUvarint(buf, uint64(len(s)))
+	buf.WriteString(s)
+}
+
+// maxHeaderString bounds the length of the strings of an invocation
+// header, so that corrupt headers do not cause large allocations.
+const maxHeaderString = 1 << 20
+
+func readString(r *bufio.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if n > maxHeaderString {
+		return "", fmt.Errorf("string of length %d exceeds limit", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigmachine/testsystem"
+	"github.com/grailbio/bigslice"
+)
+
+// countingEncoder is a gob invocation encoder that counts the
+// invocations that it decodes.
+type countingEncoder struct {
+	gobInvocationEncoder
+	decoded *int32
+}
+
+func (e countingEncoder) Decode(r io.Reader, v interface{}) error {
+	atomic.AddInt32(e.decoded, 1)
+	return e.gobInvocationEncoder.Decode(r, v)
+}
+
+var numCountingDecoded int32
+
+func init() {
+	RegisterInvocationEncoder("counting", countingEncoder{decoded: &numCountingDecoded})
+}
+
+var encodingTestFunc = bigslice.Func(func(n int) bigslice.Slice {
+	ints := make([]int, n)
+	for i := range ints {
+		ints[i] = i
+	}
+	return bigslice.Const(2, ints)
+})
+
+func TestInvocationEncoding(t *testing.T) {
+	ctx := context.Background()
+	sess := Start(Bigmachine(testsystem.New()), Parallelism(2), InvocationEncoding("counting"))
+	defer sess.Shutdown()
+	var ints []int
+	if err := sess.Must(ctx, encodingTestFunc, 10).Collect(ctx, &ints); err != nil {
+		t.Fatal(err)
+	}
+	sort.Ints(ints)
+	if got, want := ints, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if atomic.LoadInt32(&numCountingDecoded) == 0 {
+		t.Error("invocation was not decoded by the session's encoder")
+	}
+
+	inv := makeExecInvocation(encodingTestFunc.Invocation("<test>", 10))
+	var buf bytes.Buffer
+	if err := encodeInvocation(&buf, DefaultInvocationEncoding, inv); err != nil {
+		t.Fatal(err)
+	}
+	var decoded execInvocation
+	if err := decodeInvocation(&buf, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := decoded.Invocation, inv.Invocation; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestInvocationEncodingMismatch(t *testing.T) {
+	inv := makeExecInvocation(encodingTestFunc.Invocation("<test>", 10))
+	f, _ := makeFuncIdentity(inv.Func)
+	header := invocationHeader{Binary: "other", Encoder: DefaultInvocationEncoding, Funcs: []funcIdentity{f}}
+	encode := func(version uint64, h invocationHeader) io.Reader {
+		var buf bytes.Buffer
+		writeInvocationHeader(&buf, version, h)
+		if err := (gobInvocationEncoder{}).Encode(&buf, inv); err != nil {
+			t.Fatal(err)
+		}
+		return &buf
+	}
+	var decoded execInvocation
+	if err := decodeInvocation(encode(invocationVersion, header), &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	wrongSignature := header
+	wrongSignature.Funcs = []funcIdentity{{f.Index, f.Location, "func(string)"}}
+	unregisteredFunc := header
+	unregisteredFunc.Funcs = []funcIdentity{{1 << 40, "other.go:1", "func()"}}
+	unregisteredEncoder := header
+	unregisteredEncoder.Encoder = "unregistered"
+	for _, test := range []struct {
+		r    io.Reader
+		want string
+	}{
+		{
+			encode(invocationVersion+1, header),
+			`invocation encoded with encoding version 2 by binary "other", but binary "` + BinaryIdentity() + `" supports encoding version 1`,
+		},
+		{
+			encode(invocationVersion, wrongSignature),
+			`func ` + wrongSignature.Funcs[0].String() + `, referenced by binary "other", is func ` + f.String(),
+		},
+		{
+			encode(invocationVersion, unregisteredFunc),
+			`func 1099511627776 (func() at other.go:1), referenced by binary "other", is not registered`,
+		},
+		{
+			encode(invocationVersion, unregisteredEncoder),
+			`with encoder "unregistered", which is not registered`,
+		},
+	} {
+		err := decodeInvocation(test.r, &decoded)
+		if err == nil {
+			t.Errorf("expected error %q", test.want)
+			continue
+		}
+		if !errors.Is(errors.Precondition, err) {
+			t.Errorf("got %v, want precondition error", err)
+		}
+		if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("got %v, want %q", err, test.want)
+		}
+	}
+
+	if err := decodeInvocation(strings.NewReader("garbage"), &decoded); !errors.Is(errors.Invalid, err) {
+		t.Errorf("got %v, want invalid error", err)
+	}
+}
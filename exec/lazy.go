@@ -0,0 +1,136 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/sliceio"
+)
+
+// Materialization determines when a task that depends on the output of
+// other tasks, e.g., a task reading the shuffled output of a previous
+// stage, is started.
+type Materialization int
+
+const (
+	// MaterializeEager starts a task only once all of the tasks on
+	// which it depends have completed, so that its inputs are fully
+	// materialized when it starts. This is the default.
+	MaterializeEager Materialization = iota
+	// MaterializeLazy starts a task as soon as all of the tasks on
+	// which it depends are running, so that the execution of
+	// producers and consumers overlaps: the task reads the output of
+	// each producer as soon as that producer has completed, instead of
+	// waiting for the slowest of them. (With the ReadReady read order,
+	// the outputs of completed producers are also merged in the order
+	// in which they complete.) Since the task holds its resources while
+	// it waits for its producers, MaterializeLazy may reduce the
+	// number of producers that can run concurrently. If a producer
+	// fails or is lost, the tasks that are reading its output are lost
+	// with it, and they are restarted once the producer is again
+	// running.
+	//
+	// Only the local executor supports MaterializeLazy; sessions with
+	// other executors may not be started with it (see
+	// DepMaterialization).
+	MaterializeLazy
+)
+
+func (m Materialization) String() string {
+	switch m {
+	case MaterializeEager:
+		return "eager"
+	case MaterializeLazy:
+		return "lazy"
+	default:
+		return fmt.Sprintf("Materialization(%d)", int(m))
+	}
+}
+
+// DepMaterialization configures when tasks are started relative to
+// the tasks on which they depend. See Materialization for the
+// available modes; the default is MaterializeEager. Start panics if
+// the session's executor does not support the configured mode.
+func DepMaterialization(m Materialization) Option {
+	switch m {
+	case MaterializeEager, MaterializeLazy:
+	default:
+		panic(fmt.Sprintf("exec.DepMaterialization: invalid materialization %d", m))
+	}
+	return func(s *Session) {
+		s.materialization = m
+	}
+}
+
+// lazyExecutor is implemented by executors that may materialize
+// dependencies lazily. Sessions with other executors may not be
+// configured with MaterializeLazy.
+type lazyExecutor interface {
+	Executor
+	// Lazy returns whether the executor's tasks may be started as soon
+	// as the tasks on which they depend are running.
+	Lazy() bool
+}
+
+// isLazy returns whether the provided executor materializes
+// dependencies lazily.
+func isLazy(executor Executor) bool {
+	l, ok := executor.(lazyExecutor)
+	return ok && l.Lazy()
+}
+
+// lazyReader reads a partition of the output of a running task,
+// waiting for the task to complete before reading it. If the task does
+// not complete successfully, the read fails with an error of kind
+// errors.Unavailable, so that the reading task is lost, and retried.
+type lazyReader struct {
+	task      *Task
+	partition int
+	// open opens the partition once the task has completed.
+	open func(task *Task, partition int) sliceio.ReadCloser
+
+	reader sliceio.ReadCloser
+	err    error
+}
+
+func (r *lazyReader) Read(ctx context.Context, out frame.Frame) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.reader == nil {
+		// The reading task was started once the task was running. The
+		// task's state changes only once the running attempt is done: if
+		// it is then not complete, the attempt failed, and the reading
+		// task must be retried along with the task's next attempt,
+		// instead of waiting for it while holding its resources.
+		var err error
+		r.task.Lock()
+		if r.task.state == TaskRunning {
+			err = r.task.Wait(ctx)
+		}
+		state := r.task.state
+		r.task.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		if state != TaskOk {
+			r.err = errors.E(errors.Unavailable, fmt.Sprintf("dependency %s did not complete: %s", r.task.Name, state))
+			return 0, r.err
+		}
+		r.reader = r.open(r.task, r.partition)
+	}
+	return r.reader.Read(ctx, out)
+}
+
+func (r *lazyReader) Close() error {
+	if r.reader == nil {
+		return nil
+	}
+	return r.reader.Close()
+}
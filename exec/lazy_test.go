@@ -0,0 +1,198 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	baseerrors "github.com/grailbio/base/errors"
+	"github.com/grailbio/bigmachine/testsystem"
+	"github.com/grailbio/bigslice"
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/sliceio"
+)
+
+// overlapSlice returns a slice of the integers [0, n), read by 2
+// producer shards and reshuffled. The second producer shard waits for
+// the consumers to start reading the output of the first, failing
+// fatally if they do not. Its first numLost attempts are lost once the
+// consumers have started.
+func overlapSlice(n int, numLost int32, attempts *int32) bigslice.Slice {
+	var (
+		consumed = make(chan struct{})
+		once     sync.Once
+	)
+	slice := bigslice.ReaderFunc(2, func(shard int, off *int, out []int) (int, error) {
+		if shard == 1 && *off == 0 {
+			select {
+			case <-consumed:
+			case <-time.After(10 * time.Second):
+				return 0, baseerrors.E(baseerrors.Fatal, "consumers did not start")
+			}
+			if atomic.AddInt32(attempts, 1) <= numLost {
+				return 0, baseerrors.E(baseerrors.Temporary, "lost")
+			}
+		}
+		var i int
+		for ; i < len(out) && *off < n/2; i++ {
+			out[i] = shard*n/2 + *off
+			*off++
+		}
+		if *off == n/2 {
+			return i, sliceio.EOF
+		}
+		return i, nil
+	})
+	slice = bigslice.Reshuffle(slice)
+	return bigslice.Map(slice, func(i int) int {
+		once.Do(func() { close(consumed) })
+		return i
+	})
+}
+
+func TestLazyMaterialization(t *testing.T) {
+	const N = 100
+	ctx := context.Background()
+	for _, numLost := range []int32{0, 1} {
+		var attempts int32
+		fn := bigslice.Func(func() bigslice.Slice { return overlapSlice(N, numLost, &attempts) })
+		sess := Start(Local, Parallelism(4), DepMaterialization(MaterializeLazy))
+		var ints []int
+		if err := sess.Must(ctx, fn).Collect(ctx, &ints); err != nil {
+			t.Fatal(err)
+		}
+		sess.Shutdown()
+		sort.Ints(ints)
+		if got, want := ints, rangeSlice(0, N); !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if got, want := attempts, numLost+1; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+}
+
+// lazyTestExecutor is a testExecutor that materializes dependencies
+// lazily.
+type lazyTestExecutor struct{ testExecutor }
+
+func (lazyTestExecutor) Lazy() bool { return true }
+
+func TestEvalLazy(t *testing.T) {
+	tasks, _, _ := compileFunc(func() bigslice.Slice {
+		return bigslice.Cogroup(bigslice.Const(1, []int{1, 2, 3}))
+	})
+	var (
+		constTask   = tasks[0].Deps[0].Task(0)
+		cogroupTask = tasks[0]
+		errc        = make(chan error)
+	)
+	go func() {
+		errc <- Eval(context.Background(), lazyTestExecutor{}, tasks, nil)
+	}()
+	// The cogroup task is run as soon as the const task is running.
+	waitState(t, constTask, TaskRunning)
+	waitState(t, cogroupTask, TaskRunning)
+	// When the const task is lost, so is the cogroup task reading it;
+	// both are run again.
+	constTask.Set(TaskLost)
+	cogroupTask.Set(TaskLost)
+	waitState(t, constTask, TaskRunning)
+	waitState(t, cogroupTask, TaskRunning)
+	constTask.Set(TaskOk)
+	cogroupTask.Set(TaskOk)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLazyReader(t *testing.T) {
+	tasks, _, _ := compileFunc(func() bigslice.Slice {
+		return bigslice.Const(1, []int{1, 2, 3})
+	})
+	var (
+		ctx  = context.Background()
+		task = tasks[0]
+	)
+	for _, state := range []TaskState{TaskOk, TaskLost} {
+		task.Set(TaskRunning)
+		r := &lazyReader{task: task, open: func(*Task, int) sliceio.ReadCloser {
+			return sliceio.NopCloser(sliceio.FrameReader(frame.Slices([]int{1, 2, 3})))
+		}}
+		type result struct {
+			n   int
+			err error
+		}
+		c := make(chan result)
+		go func() {
+			n, err := r.Read(ctx, frame.Make(task, 3, 3))
+			c <- result{n, err}
+		}()
+		task.Set(state)
+		res := <-c
+		switch state {
+		case TaskOk:
+			if res.err != nil && res.err != sliceio.EOF || res.n != 3 {
+				t.Errorf("got %v, %v, want 3 rows", res.n, res.err)
+			}
+		case TaskLost:
+			if !baseerrors.Is(baseerrors.Unavailable, res.err) {
+				t.Errorf("got %v, want Unavailable error", res.err)
+			}
+		}
+	}
+}
+
+// BenchmarkMaterialization measures the latency of a two-stage job
+// whose producers complete at staggered times, so that with lazy
+// materialization the consumers can process the output of the first
+// producers while the others are still running.
+func BenchmarkMaterialization(b *testing.B) {
+	const (
+		Nshard = 8
+		N      = 64
+	)
+	ctx := context.Background()
+	fn := bigslice.Func(func() bigslice.Slice {
+		slice := bigslice.ReaderFunc(Nshard, func(shard int, done *bool, out []int) (int, error) {
+			time.Sleep(time.Duration(shard) * 10 * time.Millisecond)
+			for i := 0; i < N/Nshard; i++ {
+				out[i] = shard*N/Nshard + i
+			}
+			return N / Nshard, sliceio.EOF
+		})
+		slice = bigslice.Reshuffle(slice)
+		return bigslice.Map(slice, func(i int) int {
+			time.Sleep(5 * time.Millisecond)
+			return i
+		})
+	})
+	for _, m := range []Materialization{MaterializeEager, MaterializeLazy} {
+		b.Run(m.String(), func(b *testing.B) {
+			sess := Start(Local, Parallelism(2*Nshard), DepMaterialization(m))
+			defer sess.Shutdown()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				sess.Must(ctx, fn)
+			}
+		})
+	}
+}
+
+func TestLazyMaterializationUnsupported(t *testing.T) {
+	defer func() {
+		if e := recover(); e == nil {
+			t.Error("expected panic")
+		}
+	}()
+	sess := Start(Bigmachine(testsystem.New()), DepMaterialization(MaterializeLazy))
+	sess.Shutdown()
+}
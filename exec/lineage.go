@@ -0,0 +1,91 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+
+	"github.com/grailbio/bigslice"
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/metrics"
+	"github.com/grailbio/bigslice/sliceio"
+)
+
+// sourceRows counts the rows read from the shard of a source slice, in
+// the scope of the task that reads it, so that the lineages of the
+// slices computed from it may be derived (see Result.Lineage).
+var sourceRows = metrics.NewCounter()
+
+// sourceRowsReader counts the rows read from a source slice in
+// sourceRows. Rows are counted in the scope of the reading task, rather
+// than that of the read's context, as sources may be read by user code
+// (e.g., bigslice.Scan) with contexts of its own.
+type sourceRowsReader struct {
+	sliceio.Reader
+	scope *metrics.Scope
+}
+
+func (r *sourceRowsReader) Read(ctx context.Context, out frame.Frame) (int, error) {
+	n, err := r.Reader.Read(ctx, out)
+	sourceRows.Incr(r.scope, int64(n))
+	return n, err
+}
+
+// Lineage returns the lineage of the provided shard of the result: the
+// rows of the shards of source slices from which the shard was
+// computed. Lineage is executor metadata, recorded as sources are read,
+// and so adds no data to the result's rows, nor any overhead beyond
+// counting the rows read from sources. It is tracked by shard: the
+// lineage of each row of the shard is the lineage of the shard, a
+// superset of the source rows that contributed to it. A shard that
+// depends on a shuffle thus has the lineage of all of the shards of the
+// shuffle's input, as any of their rows may have been partitioned into
+// it. Tasks that read their output from a cache (see bigslice.Cache)
+// are reported as sources, named by the cached slice.
+//
+// Spans are named by the String of the source slice's Name (e.g.,
+// "readgcs@main.go:42"), and cover the rows that were read from each
+// shard. Lineage is valid only once the result has been computed.
+func (r *Result) Lineage(shard int) bigslice.Lineage {
+	var (
+		spans   []bigslice.LineageSpan
+		visited = make(map[*Task]bool)
+		walk    func(*Task)
+	)
+	walk = func(task *Task) {
+		if visited[task] {
+			return
+		}
+		visited[task] = true
+		if len(task.Deps) == 0 {
+			spans = append(spans, bigslice.LineageSpan{
+				Source: sourceName(task),
+				Shard:  task.Name.Shard,
+				End:    sourceRows.Value(&task.Scope),
+			})
+			return
+		}
+		for _, dep := range task.Deps {
+			for i := 0; i < dep.NumTask(); i++ {
+				walk(dep.Task(i))
+			}
+		}
+	}
+	for _, task := range r.tasks {
+		if task.Name.Shard == shard {
+			walk(task)
+		}
+	}
+	return bigslice.Lineage(nil).Merge(spans)
+}
+
+// sourceName returns the name of the source slice read by the provided
+// task, which has no dependencies: the first slice in its pipeline.
+func sourceName(task *Task) string {
+	if len(task.Slices) == 0 {
+		return task.Name.Op
+	}
+	return task.Slices[len(task.Slices)-1].Name().String()
+}
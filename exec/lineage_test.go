@@ -0,0 +1,68 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/bigslice"
+)
+
+func TestLineage(t *testing.T) {
+	const N, numShard = 30, 3
+	var (
+		ctx = context.Background()
+		// sourceSpan returns the span of the rows of the provided shard
+		// of the Const source, which assigns contiguous ranges of 11,
+		// 11, and 8 rows to its shards.
+		sourceSpan = func(source string, shard int) bigslice.LineageSpan {
+			return bigslice.LineageSpan{Source: source, Shard: shard, End: []int64{11, 11, 8}[shard]}
+		}
+		pipelined = bigslice.Func(func() bigslice.Slice {
+			slice := bigslice.Const(numShard, rangeSlice(0, N))
+			return bigslice.Filter(slice, func(i int) bool { return i%2 == 0 })
+		})
+		reduced = bigslice.Func(func() bigslice.Slice {
+			slice := bigslice.Const(numShard, rangeSlice(0, N))
+			slice = bigslice.Map(slice, func(i int) (bool, int) { return i < N/2, i })
+			return bigslice.Reduce(slice, func(a, b int) int { return a + b })
+		})
+	)
+	testSession(t, func(t *testing.T, sess *Session) {
+		// Pipelined shards have the lineage of the source shard from
+		// which they were computed.
+		res := sess.Must(ctx, pipelined)
+		for shard := 0; shard < numShard; shard++ {
+			lineage := res.Lineage(shard)
+			if got, want := len(lineage), 1; got != want {
+				t.Fatalf("shard %d: got %v, want %v", shard, got, want)
+			}
+			source := lineage[0].Source
+			if !strings.HasPrefix(source, "const@") {
+				t.Errorf("shard %d: got %v, want const source", shard, source)
+			}
+			if got, want := lineage, (bigslice.Lineage{sourceSpan(source, shard)}); !reflect.DeepEqual(got, want) {
+				t.Errorf("shard %d: got %v, want %v", shard, got, want)
+			}
+		}
+		// Shards computed from shuffles have the lineage of all of the
+		// shards of the shuffle's input.
+		res = sess.Must(ctx, reduced)
+		for shard := 0; shard < res.NumShard(); shard++ {
+			lineage := res.Lineage(shard)
+			if len(lineage) == 0 {
+				t.Fatalf("shard %d: no lineage", shard)
+			}
+			source := lineage[0].Source
+			want := bigslice.Lineage{sourceSpan(source, 0), sourceSpan(source, 1), sourceSpan(source, 2)}
+			if got := lineage; !reflect.DeepEqual(got, want) {
+				t.Errorf("shard %d: got %v, want %v", shard, got, want)
+			}
+		}
+	})
+}
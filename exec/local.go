@@ -11,11 +11,11 @@ import (
 	"runtime/debug"
 	"sync"
 
-	"github.com/grailbio/base/backgroundcontext"
 	"github.com/grailbio/base/errors"
 	"github.com/grailbio/base/eventlog"
 	"github.com/grailbio/base/limiter"
 	"github.com/grailbio/base/log"
+	"github.com/grailbio/bigslice"
 	"github.com/grailbio/bigslice/frame"
 	"github.com/grailbio/bigslice/metrics"
 	"github.com/grailbio/bigslice/sliceio"
@@ -43,6 +43,10 @@ func (*localExecutor) Name() string {
 	return "local"
 }
 
+func (l *localExecutor) taskCompletions() *completionQueue {
+	return l.sess.completions
+}
+
 func (l *localExecutor) Start(sess *Session) (shutdown func()) {
 	l.sess = sess
 	l.limiter.Release(sess.p)
@@ -50,23 +54,55 @@ func (l *localExecutor) Start(sess *Session) (shutdown func()) {
 }
 
 func (l *localExecutor) Run(task *Task) {
-	ctx := backgroundcontext.Get()
 	n := 1
 	if task.Pragma.Exclusive() {
 		n = l.sess.p
 	}
-	if err := l.limiter.Acquire(ctx, n); err != nil {
+	ctx, release, err := l.sess.acquireStage(task)
+	if err == nil {
+		defer release()
+		err = l.limiter.Acquire(ctx, n)
+	}
+	if err != nil {
 		// The only errors we should encounter here are context errors,
 		// in which case there is no more work to do.
 		if err != context.Canceled && err != context.DeadlineExceeded {
 			log.Panicf("exec.Local: unexpected error: %v", err)
 		}
+		if err := l.sess.stageErr(task.Name); err != nil {
+			task.Error(err)
+		} else {
+			// The evaluation was abandoned before the task ran; it is
+			// resubmitted by any later evaluation that needs it.
+			task.Set(TaskLost)
+		}
 		return
 	}
 	defer l.limiter.Release(n)
-	in, err := l.depReaders(ctx, task)
+	// Readers of the task's dependencies may read them concurrently
+	// (see ReadReady); they are stopped once the task is done.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if l.sess.credentials != nil {
+		ctx = bigslice.CredentialContext(ctx, l.sess.credentials)
+	}
+	if l.sess.codec != "" {
+		ctx = sliceio.CodecContext(ctx, l.sess.codec)
+	}
+	if l.sess.keys != nil {
+		ctx = sliceio.KeyProviderContext(ctx, l.sess.keys)
+	}
+	if l.sess.keyPolicy != (frame.KeyPolicy{}) {
+		ctx = frame.KeyPolicyContext(ctx, l.sess.keyPolicy)
+	}
+	// The task's scope is reset before its dependencies are read, as
+	// they may be combined in the scope of the task.
+	task.Scope.Reset(nil)
+	in, err := l.depReaders(ctx, task, assignedPartitions(l.sess.assignment(task), task.Name.Shard))
 	if err != nil {
-		if errors.Match(fatalErr, err) {
+		if stageErr := l.sess.stageErr(task.Name); stageErr != nil {
+			task.Error(stageErr)
+		} else if errors.Match(fatalErr, err) {
 			task.Error(err)
 		} else {
 			task.Set(TaskLost)
@@ -77,17 +113,29 @@ func (l *localExecutor) Run(task *Task) {
 
 	// Start execution, then place output in a task buffer. We also plumb a
 	// metrics scope in here so we can store and aggregate metrics.
-	task.Scope.Reset(nil)
 	out := task.Do(in)
-	buf, err := bufferOutput(metrics.ScopedContext(ctx, &task.Scope), task, out)
+	buf, err := bufferOutput(metrics.ScopedContext(ctx, &task.Scope), task, out, taskChunkSize(task, l.sess.chunkSize))
+	if err == nil {
+		err = commitOutput(ctx, out)
+	}
+	if err != nil {
+		abortOutput(ctx, out)
+	}
+	cleanupOutput(out)
+	if err != nil {
+		if stageErr := l.sess.stageErr(task.Name); stageErr != nil {
+			err = stageErr
+		}
+	}
 	task.Lock()
 	if err == nil {
 		l.mu.Lock()
 		l.buffers[task] = buf
 		l.mu.Unlock()
+		task.PartitionSizes = buf.Sizes()
 		task.state = TaskOk
 	} else {
-		if errors.Match(fatalErr, err) {
+		if errors.Match(fatalErr, err) || isStageCancelled(err) {
 			task.state = TaskErr
 		} else {
 			task.state = TaskLost
@@ -98,52 +146,80 @@ func (l *localExecutor) Run(task *Task) {
 	task.Unlock()
 }
 
-func (l *localExecutor) depReaders(ctx context.Context, task *Task) ([]sliceio.Reader, error) {
+// depReaders returns readers for the dependencies of the provided
+// task. If partitions is non-nil, the task reads the listed partitions
+// of each dependency instead of the compiled ones.
+func (l *localExecutor) depReaders(ctx context.Context, task *Task, partitions []int) ([]sliceio.Reader, error) {
 	in := make([]sliceio.Reader, 0, len(task.Deps))
 	for _, dep := range task.Deps {
-		reader := new(multiReader)
-		reader.q = make([]sliceio.Reader, dep.NumTask())
-		for j := 0; j < dep.NumTask(); j++ {
-			reader.q[j] = l.Reader(dep.Task(j), dep.Partition)
+		var q []sliceio.Reader
+		for _, partition := range depPartitions(dep, partitions) {
+			for j := 0; j < dep.NumTask(); j++ {
+				q = append(q, l.depReader(dep.Task(j), partition))
+			}
 		}
+		orderReaders(l.sess.depReadOrder(ReadByShard), q)
+		chunkSize := taskChunkSize(task, l.sess.chunkSize)
 		if dep.NumTask() > 0 && !dep.Task(0).Combiner.IsNil() {
+			reader := mergeReaders(l.sess.depReadOrder(ReadByShard), dep.Head, chunkSize, q)
+			defer reader.Close()
 			// Perform input combination in-line, one for each partition.
 			combineKey := task.Name
 			if task.CombineKey != "" {
 				combineKey = TaskName{Op: task.CombineKey}
 			}
-			combiner, err := newCombiner(dep.Task(0), combineKey.String(), dep.Task(0).Combiner, *defaultChunksize*100)
+			combiner, err := newCombiner(dep.Task(0), combineKey.String(), dep.Task(0).Combiner, *defaultChunksize*100, l.sess.combinerMemory, l.sess.keyPolicy)
 			if err != nil {
 				return nil, errors.E(errors.Fatal, "could not make combiner for %v", dep.Task(0).String(), err)
 			}
-			buf := frame.Make(dep.Task(0), *defaultChunksize, *defaultChunksize)
+			var (
+				buf = frame.Make(dep.Task(0), *defaultChunksize, *defaultChunksize)
+				// Spills are counted in the scope of the task.
+				combineCtx = metrics.ScopedContext(ctx, &task.Scope)
+			)
 			for {
 				var n int
 				n, err = reader.Read(ctx, buf)
 				if err != nil && err != sliceio.EOF {
 					return nil, errors.E("error reading %v", dep.Task(0).String(), err)
 				}
-				if combineErr := combiner.Combine(ctx, buf.Slice(0, n)); combineErr != nil {
+				if combineErr := combiner.Combine(combineCtx, buf.Slice(0, n)); combineErr != nil {
 					return nil, errors.E(errors.Fatal, "failed to combine %v", dep.Task(0).String(), combineErr)
 				}
 				if err == sliceio.EOF {
 					break
 				}
 			}
-			reader, err := combiner.Reader()
+			combined, err := combiner.Reader()
 			if err != nil {
 				return nil, errors.E(errors.Fatal, "failed to start reading combiner for %v", dep.Task(0).String(), err)
 			}
-			in = append(in, reader)
+			in = append(in, combined)
 		} else if dep.Expand {
-			in = append(in, reader.q...)
+			in = append(in, q...)
 		} else {
-			in = append(in, reader)
+			in = append(in, mergeReaders(l.sess.depReadOrder(ReadByShard), dep.Head, chunkSize, q))
 		}
 	}
 	return in, nil
 }
 
+// depReader returns a reader of the provided partition of the output of
+// the provided task, on which another task depends. With lazy
+// materialization, the task may still be running, and the returned
+// reader waits for it to complete.
+func (l *localExecutor) depReader(task *Task, partition int) sliceio.ReadCloser {
+	if l.Lazy() && task.State() != TaskOk {
+		return &lazyReader{task: task, partition: partition, open: l.Reader}
+	}
+	return l.Reader(task, partition)
+}
+
+// Lazy implements lazyExecutor.
+func (l *localExecutor) Lazy() bool {
+	return l.sess.materialization == MaterializeLazy
+}
+
 func (l *localExecutor) Reader(task *Task, partition int) sliceio.ReadCloser {
 	l.mu.Lock()
 	buf, ok := l.buffers[task]
@@ -184,7 +260,8 @@ func (*localExecutor) HandleDebug(*http.ServeMux) {}
 // BufferOutput reads the output from reader and places it in a
 // task buffer. If the output is partitioned, bufferOutput invokes
 // the task's partitioner in order to determine the correct partition.
-func bufferOutput(ctx context.Context, task *Task, out sliceio.Reader) (buf taskBuffer, err error) {
+// Output is read and buffered in frames of chunkSize rows.
+func bufferOutput(ctx context.Context, task *Task, out sliceio.Reader, chunkSize int) (buf taskBuffer, err error) {
 	if task.NumOut() == 0 {
 		_, err = out.Read(ctx, frame.Empty)
 		if err == sliceio.EOF {
@@ -201,10 +278,13 @@ func bufferOutput(ctx context.Context, task *Task, out sliceio.Reader) (buf task
 			err = errors.E(err, errors.Fatal)
 		}
 	}()
-	shards := make([]int, *defaultChunksize)
+	shards := make([]int, chunkSize)
 	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		if in.IsZero() {
-			in = frame.Make(task, *defaultChunksize, *defaultChunksize)
+			in = frame.Make(task, chunkSize, chunkSize)
 		}
 		n, err := out.Read(ctx, in)
 		if err != nil && err != sliceio.EOF {
@@ -213,7 +293,7 @@ func bufferOutput(ctx context.Context, task *Task, out sliceio.Reader) (buf task
 		// If the output needs to be partitioned, we ask the partitioner to
 		// assign partitions to each input element, and then append the
 		// elements in their respective partitions. In this case, we just
-		// maintain buffer slices of defaultChunksize each.
+		// maintain buffer slices of chunkSize each.
 		if task.NumPartition > 1 {
 			task.Partitioner(ctx, in, task.NumPartition, shards[:n])
 			for i := 0; i < n; i++ {
@@ -222,7 +302,7 @@ func bufferOutput(ctx context.Context, task *Task, out sliceio.Reader) (buf task
 				// create a new one.
 				m := len(buf[p])
 				if m == 0 || buf[p][m-1].Cap() == buf[p][m-1].Len() {
-					frame := frame.Make(task, 0, *defaultChunksize)
+					frame := frame.Make(task, 0, chunkSize)
 					buf[p] = append(buf[p], frame)
 					m++
 				}
@@ -254,6 +334,9 @@ func (m *multiReader) Read(ctx context.Context, out frame.Frame) (n int, err err
 		switch {
 		case err == sliceio.EOF:
 			m.q = m.q[1:]
+			if n > 0 {
+				return n, nil
+			}
 		case err != nil:
 			m.err = err
 			return n, err
@@ -0,0 +1,276 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"sync"
+
+	"github.com/grailbio/bigslice/stats"
+)
+
+// A machineBudget caps the total number of machines that may be
+// allocated by a session, across all of its machine managers. Managers
+// acquire budget before starting machines, and release it when
+// machines fail to start or are lost. A nil *machineBudget imposes no
+// cap.
+//
+// To guarantee progress, a manager that has no machines (allocated or
+// pending) is always granted one machine, even if this exceeds the
+// cap: otherwise a manager that is needed to run, e.g., exclusive
+// tasks could wait indefinitely for machines that are held by other
+// managers, which never relinquish them since they hold task results.
+// Such overcommitted grants are reflected in the budget's stats.
+//
+// Machines store the outputs of the tasks they ran, and so cannot in
+// general be stopped to make room for others. However, once a machine
+// is idle, and all of the outputs it holds have been consumed, e.g.,
+// because the stages that read them have completed, it may be released
+// back to the budget (see sliceMachine.idle). Managers do so whenever
+// other managers are starved: they wait on Reclaim, which is notified
+// when a manager becomes starved, and whenever a task completes while
+// managers are starved.
+type machineBudget struct {
+	mu sync.Mutex
+	// max is the maximum number of machines; 0 means unlimited.
+	max int
+	// used is the number of machines currently allocated or pending.
+	used int
+	// changec is closed (and replaced) whenever budget becomes
+	// available, either through release or by raising max.
+	changec chan struct{}
+	// nstarved is the number of managers that are waiting for budget;
+	// reclaimc is closed (and replaced) whenever idle machines should
+	// be released to them.
+	nstarved int
+	reclaimc chan struct{}
+
+	stats *stats.Map
+	// machines is the number of machines that are currently allocated
+	// or pending.
+	machines *stats.Int
+	// maxMachines is the current cap.
+	maxMachines *stats.Int
+	// starved is the number of managers that are currently waiting
+	// for budget.
+	starved *stats.Int
+	// starvations is the total number of times a manager was denied
+	// (some of) the machines it needed.
+	starvations *stats.Int
+	// overcommitted is the number of machines granted beyond the cap
+	// to guarantee progress.
+	overcommitted *stats.Int
+	// reclaimed is the total number of idle machines that were
+	// released to starved managers.
+	reclaimed *stats.Int
+}
+
+// newMachineBudget returns a new machine budget that allows up to max
+// machines. If max is 0, the budget is unlimited.
+func newMachineBudget(max int) *machineBudget {
+	b := &machineBudget{
+		max:      max,
+		changec:  make(chan struct{}),
+		reclaimc: make(chan struct{}),
+		stats:    stats.NewMap(),
+	}
+	b.machines = b.stats.Int("machines")
+	b.maxMachines = b.stats.Int("maxMachines")
+	b.starved = b.stats.Int("starvedManagers")
+	b.starvations = b.stats.Int("starvations")
+	b.overcommitted = b.stats.Int("overcommittedMachines")
+	b.reclaimed = b.stats.Int("reclaimedMachines")
+	b.maxMachines.Set(int64(max))
+	return b
+}
+
+// Acquire requests n machines from the budget, returning the number of
+// machines granted, which may be fewer than n. Have is the number of
+// machines currently held (allocated or pending) by the caller; if it
+// is zero, at least one machine is granted. If fewer than n machines
+// are granted, the caller should wait on Wait before trying again.
+func (b *machineBudget) Acquire(n, have int) int {
+	if b == nil || n == 0 {
+		return n
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	granted := n
+	if b.max > 0 {
+		if avail := b.max - b.used; avail < granted {
+			granted = avail
+		}
+		if granted < 0 {
+			granted = 0
+		}
+		if granted == 0 && have == 0 {
+			granted = 1
+			b.overcommitted.Add(1)
+		}
+	}
+	if granted < n {
+		b.starvations.Add(1)
+	}
+	b.used += granted
+	b.machines.Set(int64(b.used))
+	return granted
+}
+
+// Release returns n machines to the budget.
+func (b *machineBudget) Release(n int) {
+	if b == nil || n == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	b.machines.Set(int64(b.used))
+	b.notify()
+}
+
+// Wait returns a channel that is closed when budget may have become
+// available. A nil channel (which blocks forever) is returned for an
+// unlimited budget.
+func (b *machineBudget) Wait() <-chan struct{} {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.changec
+}
+
+// SetMax sets the maximum number of machines in the budget. Lowering
+// the cap does not stop allocated machines, but it prevents new ones
+// from being started until usage falls below the new cap.
+func (b *machineBudget) SetMax(max int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.max = max
+	b.maxMachines.Set(int64(max))
+	b.notify()
+}
+
+// Starved records whether a manager is (or is no longer) waiting for
+// budget.
+func (b *machineBudget) Starved(starved bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if starved {
+		b.nstarved++
+		b.starved.Add(1)
+		b.notifyReclaim()
+	} else {
+		b.nstarved--
+		b.starved.Add(-1)
+	}
+}
+
+// Starving tells whether any manager is waiting for budget.
+func (b *machineBudget) Starving() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.nstarved > 0
+}
+
+// TaskDone is called whenever a task completes, which may cause the
+// outputs held by idle machines to have been consumed. If managers are
+// starved, TaskDone notifies Reclaim.
+func (b *machineBudget) TaskDone() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.nstarved > 0 {
+		b.notifyReclaim()
+	}
+}
+
+// Reclaim returns a channel that is closed when managers should release
+// their idle machines to starved managers. A nil channel (which blocks
+// forever) is returned for a nil budget.
+func (b *machineBudget) Reclaim() <-chan struct{} {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.reclaimc
+}
+
+// notify wakes up waiters. It must be called with b.mu held.
+func (b *machineBudget) notify() {
+	close(b.changec)
+	b.changec = make(chan struct{})
+}
+
+// notifyReclaim wakes up managers waiting on Reclaim. It must be
+// called with b.mu held.
+func (b *machineBudget) notifyReclaim() {
+	close(b.reclaimc)
+	b.reclaimc = make(chan struct{})
+}
+
+// linkConsumers records, for the provided root tasks of an invocation
+// and their dependencies, the tasks that consume each task's output,
+// so that machines may tell whether the outputs they hold are still
+// needed (see Task.outputNeeded). Tasks that are shared with other
+// invocations accumulate the consumers of each.
+func linkConsumers(roots []*Task) {
+	for _, task := range roots {
+		task.Lock()
+		task.root = true
+		task.Unlock()
+	}
+	_ = iterTasks(roots, func(task *Task) error {
+		for _, dep := range task.Deps {
+			for i := 0; i < dep.NumTask(); i++ {
+				deptask := dep.Task(i)
+				deptask.Lock()
+				if deptask.consumers == nil {
+					deptask.consumers = make(map[*Task]bool)
+				}
+				deptask.consumers[task] = true
+				deptask.Unlock()
+			}
+		}
+		return nil
+	})
+}
+
+// outputNeeded tells whether the output of task t, as held by the
+// machine that ran it, may still be read: t has completed, and either
+// it is the root of an invocation, whose output may be read by its
+// result, or some of its consumers have yet to complete. Outputs that
+// turn out to be needed after all, e.g., because a consumer is lost,
+// are recomputed.
+func (t *Task) outputNeeded() bool {
+	t.Lock()
+	if t.state != TaskOk {
+		t.Unlock()
+		return false
+	}
+	if t.root {
+		t.Unlock()
+		return true
+	}
+	consumers := make([]*Task, 0, len(t.consumers))
+	for c := range t.consumers {
+		consumers = append(consumers, c)
+	}
+	t.Unlock()
+	for _, c := range consumers {
+		if c.State() != TaskOk {
+			return true
+		}
+	}
+	return false
+}
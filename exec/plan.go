@@ -0,0 +1,223 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/bigslice"
+)
+
+// planMagic begins every encoded plan.
+var planMagic = []byte("bigslice-plan\n")
+
+// planVersion is the version of the plan encoding. It is incremented
+// whenever the encoding changes incompatibly.
+const planVersion = 1
+
+// A Plan is a serializable description of a computation: a bigslice
+// Func invocation, by reference to the Func registry. Plans are built
+// by a submitting process and run by another process (e.g., the driver
+// of a remote cluster) running the same binary, which reconstructs the
+// computation by invoking the referenced Func with the plan's
+// arguments; since slices are built by Funcs, the slice structure
+// itself need not be transmitted. This is the same mechanism by which
+// bigmachine workers compile the tasks of an invocation.
+//
+// A plan may be run only by a binary with the same identity and the
+// same Func registry as the binary that built it; see Plan.Check.
+//
+// Plans are encoded by EncodePlan as follows: the magic string
+// "bigslice-plan\n", followed by the encoding version as a uvarint,
+// followed by the gob encoding of the Plan. Plan arguments are
+// gob-encoded, and so must be of gob-encodable types; Func argument
+// types are registered with gob when the Func is created.
+type Plan struct {
+	// Binary identifies the binary that built the plan. See BinaryIdentity.
+	Binary string
+	// FuncLocations is the Func registry of the binary that built the
+	// plan, as returned by bigslice.FuncLocations.
+	FuncLocations []string
+	// Func is the index of the invoked Func in the Func registry.
+	Func uint64
+	// Args are the arguments of the invocation.
+	Args []interface{}
+	// Exclusive indicates whether the invoked Func is exclusive.
+	Exclusive bool
+	// Location is the location at which the plan was built.
+	Location string
+}
+
+// BinaryIdentity returns a string identifying the running binary for
+// the purpose of checking plan compatibility: the main module's path
+// and version, and the Go version with which the binary was built.
+// Binaries that are not built from a released version of their main
+// module (e.g., those built with "go build" from a working tree, whose
+// version is "(devel)") are additionally identified by a digest of the
+// contents of their executable, since their module versions do not
+// distinguish them.
+func BinaryIdentity() string {
+	var (
+		mod     string
+		version string
+	)
+	if info, ok := debug.ReadBuildInfo(); ok {
+		mod = info.Main.Path + "@" + info.Main.Version
+		version = info.Main.Version
+	}
+	id := fmt.Sprintf("%s %s", mod, runtime.Version())
+	if version == "" || version == "(devel)" {
+		if digest := executableDigest(); digest != "" {
+			id += " " + digest
+		}
+	}
+	return id
+}
+
+var (
+	executableDigestOnce sync.Once
+	executableDigestHex  string
+)
+
+// executableDigest returns the hex-encoded SHA-256 digest of the
+// contents of the running executable, or the empty string if the
+// executable cannot be read. The digest is computed once per process.
+func executableDigest() string {
+	executableDigestOnce.Do(func() {
+		path, err := os.Executable()
+		if err != nil {
+			log.Error.Printf("plan: locating executable: %v", err)
+			return
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			log.Error.Printf("plan: opening executable: %v", err)
+			return
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			log.Error.Printf("plan: reading executable %s: %v", path, err)
+			return
+		}
+		executableDigestHex = hex.EncodeToString(h.Sum(nil))
+	})
+	return executableDigestHex
+}
+
+// NewPlan returns a plan for the invocation of funcv with the provided
+// arguments. Arguments may not be results of a session, since these
+// refer to the session's state; to use the result of a prior
+// computation, pass a description of it instead (e.g., a cache
+// prefix).
+func NewPlan(funcv *bigslice.FuncValue, args ...interface{}) (*Plan, error) {
+	for i, arg := range args {
+		if _, ok := arg.(*Result); ok {
+			return nil, errors.E(errors.Invalid, fmt.Sprintf("plan: argument %d is a *Result, which cannot be serialized", i))
+		}
+	}
+	location := "<unknown>"
+	if _, file, line, ok := runtime.Caller(1); ok {
+		location = fmt.Sprintf("%s:%d", file, line)
+	}
+	inv := funcv.Invocation(location, args...)
+	return &Plan{
+		Binary:        BinaryIdentity(),
+		FuncLocations: bigslice.FuncLocations(),
+		Func:          inv.Func,
+		Args:          inv.Args,
+		Exclusive:     inv.Exclusive,
+		Location:      location,
+	}, nil
+}
+
+// Check checks that the plan can be run by this binary, returning a
+// precondition error describing the incompatibility if it cannot: the
+// binary must have the same identity and the same Func registry as the
+// binary that built the plan.
+func (p *Plan) Check() error {
+	if binary := BinaryIdentity(); p.Binary != binary {
+		return errors.E(errors.Precondition,
+			fmt.Sprintf("plan: plan was built by binary %q, but this binary is %q", p.Binary, binary))
+	}
+	if diff := bigslice.FuncLocationsDiff(p.FuncLocations, bigslice.FuncLocations()); diff != nil {
+		return errors.E(errors.Precondition,
+			fmt.Sprintf("plan: func registry of this binary differs from that of the plan:\n%s", strings.Join(diff, "\n")))
+	}
+	if _, ok := bigslice.FuncByIndex(p.Func); !ok {
+		return errors.E(errors.Precondition, fmt.Sprintf("plan: func %d is not registered", p.Func))
+	}
+	return nil
+}
+
+// EncodePlan writes the encoding of the provided plan to w.
+func EncodePlan(w io.Writer, p *Plan) error {
+	var buf bytes.Buffer
+	buf.Write(planMagic)
+	var version [binary.MaxVarintLen64]byte
+	buf.Write(version[:binary.PutUvarint(version[:], planVersion)])
+	if err := gob.NewEncoder(&buf).Encode(p); err != nil {
+		return errors.E(errors.Invalid, "plan: encoding plan", err)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// DecodePlan reads a plan encoded by EncodePlan from r. It fails with a
+// precondition error if the plan was encoded with an incompatible
+// version of the encoding. DecodePlan does not check that the plan can
+// be run by this binary; see Plan.Check.
+func DecodePlan(r io.Reader) (*Plan, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(planMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || !bytes.Equal(magic, planMagic) {
+		return nil, errors.E(errors.Invalid, "plan: not a bigslice plan")
+	}
+	version, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, errors.E(errors.Invalid, "plan: reading version", err)
+	}
+	if version != planVersion {
+		return nil, errors.E(errors.Precondition,
+			fmt.Sprintf("plan: plan encoding version %d is not supported (want %d)", version, planVersion))
+	}
+	p := new(Plan)
+	if err := gob.NewDecoder(br).Decode(p); err != nil {
+		return nil, errors.E(errors.Invalid, "plan: decoding plan", err)
+	}
+	return p, nil
+}
+
+// RunPlan checks that the provided plan can be run by this binary (see
+// Plan.Check), and then evaluates it as Run would evaluate the plan's
+// invocation.
+func (s *Session) RunPlan(ctx context.Context, p *Plan) (*Result, error) {
+	if err := p.Check(); err != nil {
+		return nil, err
+	}
+	funcv, _ := bigslice.FuncByIndex(p.Func)
+	if p.Exclusive {
+		funcv = funcv.Exclusive()
+	}
+	return s.run(ctx, 1, nil, funcv, p.Args...)
+}
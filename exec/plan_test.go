@@ -0,0 +1,107 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigslice"
+)
+
+var planFunc = bigslice.Func(func(n int, suffix string) bigslice.Slice {
+	slice := bigslice.Const(3, rangeSlice(0, n))
+	return bigslice.Map(slice, func(i int) string { return strings.Repeat("x", i) + suffix })
+})
+
+func TestPlan(t *testing.T) {
+	plan, err := NewPlan(planFunc, 4, "!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err = EncodePlan(&b, plan); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodePlan(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, plan) {
+		t.Errorf("got %+v, want %+v", decoded, plan)
+	}
+	ctx := context.Background()
+	sess := Start(Local)
+	res, err := sess.RunPlan(ctx, decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var strs []string
+	if err = res.Collect(ctx, &strs); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(strs)
+	if got, want := strs, []string{"!", "x!", "xx!", "xxx!"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestPlanErrors(t *testing.T) {
+	if _, err := NewPlan(planFunc, &Result{}, "!"); !errors.Is(errors.Invalid, err) {
+		t.Errorf("got %v, want invalid error", err)
+	}
+
+	plan, err := NewPlan(planFunc, 4, "!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = plan.Check(); err != nil {
+		t.Fatal(err)
+	}
+
+	mismatched := *plan
+	mismatched.Binary = "other"
+	if err = mismatched.Check(); !errors.Is(errors.Precondition, err) || !strings.Contains(err.Error(), `"other"`) {
+		t.Errorf("got %v, want binary mismatch", err)
+	}
+
+	mismatched = *plan
+	mismatched.FuncLocations = append([]string{"other.go:1"}, plan.FuncLocations...)
+	err = mismatched.Check()
+	if !errors.Is(errors.Precondition, err) || !strings.Contains(err.Error(), "- other.go:1") {
+		t.Errorf("got %v, want func registry mismatch", err)
+	}
+	_, err = Start(Local).RunPlan(context.Background(), &mismatched)
+	if !errors.Is(errors.Precondition, err) {
+		t.Errorf("got %v, want precondition error", err)
+	}
+
+	var b bytes.Buffer
+	b.WriteString("bigslice-plan\n")
+	b.WriteByte(planVersion + 1)
+	if _, err = DecodePlan(&b); !errors.Is(errors.Precondition, err) {
+		t.Errorf("got %v, want precondition error", err)
+	}
+	if _, err = DecodePlan(strings.NewReader("not a plan")); !errors.Is(errors.Invalid, err) {
+		t.Errorf("got %v, want invalid error", err)
+	}
+}
+
+func TestBinaryIdentityDigest(t *testing.T) {
+	// Test binaries are not built from a released module version, and so
+	// are identified by the digest of their executable.
+	digest := executableDigest()
+	if len(digest) != 64 {
+		t.Fatalf("got digest %q, want SHA-256 hex digest", digest)
+	}
+	if id := BinaryIdentity(); !strings.HasSuffix(id, " "+digest) {
+		t.Errorf("binary identity %q does not include executable digest %s", id, digest)
+	}
+}
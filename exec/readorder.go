@@ -0,0 +1,224 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/slicetype"
+)
+
+// ReadOrder determines the order in which a task reads the partitions
+// of a dependency that are produced by the dependency's tasks, i.e.,
+// the order of the merged input of e.g. a reduce or cogroup shard.
+// Dependencies that are expanded, e.g., into the sorted merge of a
+// cogroup, read each partition separately; for these, the read order
+// only determines the order of the expanded readers.
+type ReadOrder int
+
+const (
+	// ReadByShard reads partitions in order of partition, and then of
+	// the shard index of the task that produced them. Tasks thus read
+	// the same input in the same order across runs. This is the
+	// default.
+	ReadByShard ReadOrder = iota
+	// ReadShuffled reads partitions in a random order, so that
+	// concurrent tasks do not read from the same (ordered) list of
+	// machines at the same time. This may relieve machines of large
+	// bigmachine sessions from a "thundering herd" of readers, at the
+	// cost of the determinism of ReadByShard.
+	ReadShuffled
+	// ReadReady reads partitions concurrently, merging chunks of rows
+	// in the order in which they become available. ReadReady trades
+	// determinism for latency: a task is not held up by a slow
+	// producer while others have data ready, but the order of its
+	// input, and thus possibly of its output, may differ across runs.
+	// ReadReady holds a chunk of rows in flight for each partition
+	// read.
+	ReadReady
+)
+
+func (o ReadOrder) String() string {
+	switch o {
+	case ReadByShard:
+		return "byshard"
+	case ReadShuffled:
+		return "shuffled"
+	case ReadReady:
+		return "ready"
+	default:
+		return fmt.Sprintf("ReadOrder(%d)", int(o))
+	}
+}
+
+// DepReadOrder configures the order in which tasks read the partitions
+// of their dependencies. See ReadOrder for the available orders. By
+// default, partitions are read by shard (ReadByShard), so that
+// tasks read their input in the same order across runs, whichever the
+// executor; shuffled reads (ReadShuffled) must be requested.
+func DepReadOrder(order ReadOrder) Option {
+	switch order {
+	case ReadByShard, ReadShuffled, ReadReady:
+	default:
+		panic(fmt.Sprintf("exec.DepReadOrder: invalid order %d", order))
+	}
+	return func(s *Session) {
+		s.readOrder = order
+		s.readOrderSet = true
+	}
+}
+
+// depReadOrder returns the order in which the session's tasks read the
+// partitions of their dependencies, given the executor's default
+// order.
+func (s *Session) depReadOrder(def ReadOrder) ReadOrder {
+	if s.readOrderSet {
+		return s.readOrder
+	}
+	return def
+}
+
+// orderReaders reorders, in place, the provided readers of a
+// dependency's partitions, which are listed by partition and then by
+// producer shard index, according to the read order.
+func orderReaders(order ReadOrder, q []sliceio.Reader) {
+	if order == ReadShuffled {
+		rand.Shuffle(len(q), func(i, j int) { q[i], q[j] = q[j], q[i] })
+	}
+}
+
+// mergeReaders returns a reader of the concatenation of the provided
+// readers, which read rows of type typ, as (previously) ordered by
+// orderReaders. The returned reader must be closed once the task is
+// done reading.
+func mergeReaders(order ReadOrder, typ slicetype.Type, chunkSize int, q []sliceio.Reader) sliceio.ReadCloser {
+	if order == ReadReady && len(q) > 1 {
+		return newReadyReader(typ, chunkSize, q)
+	}
+	return sliceio.NopCloser(&multiReader{q: q})
+}
+
+// readyChunk is a chunk of rows read by one of a readyReader's
+// readers, or the error that ended it.
+type readyChunk struct {
+	f   frame.Frame
+	err error
+	// done is signalled once the chunk is consumed, so that its frame
+	// may be reused.
+	done chan struct{}
+}
+
+// readyReader reads its underlying readers concurrently, returning
+// chunks of rows in the order in which they are read. Each underlying
+// reader is read by its own goroutine into its own frame, using the
+// context of the readyReader's first Read.
+type readyReader struct {
+	typ       slicetype.Type
+	chunkSize int
+	q         []sliceio.Reader
+
+	start   sync.Once
+	cancel  func()
+	c       chan readyChunk
+	pending int
+	cur     readyChunk
+	err     error
+}
+
+func newReadyReader(typ slicetype.Type, chunkSize int, q []sliceio.Reader) *readyReader {
+	return &readyReader{
+		typ:       typ,
+		chunkSize: chunkSize,
+		q:         q,
+		cancel:    func() {},
+	}
+}
+
+func (r *readyReader) Read(ctx context.Context, out frame.Frame) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	r.start.Do(func() {
+		ctx, r.cancel = context.WithCancel(ctx)
+		r.c = make(chan readyChunk)
+		r.pending = len(r.q)
+		for _, reader := range r.q {
+			go r.read(ctx, reader)
+		}
+		r.q = nil
+	})
+	for {
+		if r.cur.f.Len() > 0 {
+			n := frame.Copy(out, r.cur.f)
+			r.cur.f = r.cur.f.Slice(n, r.cur.f.Len())
+			if r.cur.f.Len() == 0 {
+				r.cur.done <- struct{}{}
+			}
+			return n, nil
+		}
+		if r.pending == 0 {
+			r.err = sliceio.EOF
+			r.cancel()
+			return 0, r.err
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case chunk := <-r.c:
+			switch {
+			case chunk.err == sliceio.EOF:
+				r.pending--
+			case chunk.err != nil:
+				r.err = chunk.err
+				r.cancel()
+				return 0, r.err
+			default:
+				r.cur = chunk
+			}
+		}
+	}
+}
+
+// read reads the provided reader until it is exhausted or fails,
+// sending its chunks to r.c.
+func (r *readyReader) read(ctx context.Context, reader sliceio.Reader) {
+	var (
+		f    = frame.Make(r.typ, r.chunkSize, r.chunkSize)
+		done = make(chan struct{}, 1)
+	)
+	for {
+		n, err := reader.Read(ctx, f)
+		if n > 0 {
+			select {
+			case r.c <- readyChunk{f: f.Slice(0, n), done: done}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case <-done:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err != nil {
+			select {
+			case r.c <- readyChunk{err: err}:
+			case <-ctx.Done():
+			}
+			return
+		}
+	}
+}
+
+// Close stops the reader's goroutines.
+func (r *readyReader) Close() error {
+	r.cancel()
+	return nil
+}
@@ -0,0 +1,324 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/bigslice"
+)
+
+// PartitionSize holds the measured size of one output partition of a
+// task.
+type PartitionSize struct {
+	// Records is the number of records in the partition.
+	Records int64
+	// Bytes is the encoded size of the partition, in bytes. It is 0 if
+	// the executor does not encode task outputs (e.g., the local
+	// executor).
+	Bytes int64
+}
+
+// A PartitionPolicy assigns the partitions of a shuffle to the shards
+// of the stage that consumes it. PartitionPolicy is invoked with the
+// total size of each partition, summed over all tasks (and all
+// shuffle dependencies) that feed the consuming stage, and with the
+// number of shards of the consuming stage. It returns, for each
+// partition, the shard that reads it. A consuming shard may read any
+// number of partitions, including none; partitions are never split.
+// If the policy returns nil, partition p is read by shard p. Policies
+// must be deterministic: the assignment of a stage is recomputed when
+// its tasks are rerun by a later evaluation.
+type PartitionPolicy func(sizes []PartitionSize, numShard int) []int
+
+// ProportionalPartitions is a PartitionPolicy that assigns contiguous
+// ranges of partitions to shards so that each shard reads
+// approximately the same amount of data. Sizes are measured in bytes
+// when available, and in records otherwise. Since partitions cannot be
+// split, a large partition is still read by a single shard; the policy
+// instead coalesces small partitions, so that fewer, better balanced
+// shards do the work, and the remaining shards have nothing to read.
+func ProportionalPartitions(sizes []PartitionSize, numShard int) []int {
+	var (
+		total   int64
+		byBytes bool
+	)
+	for _, size := range sizes {
+		if size.Bytes > 0 {
+			byBytes = true
+			break
+		}
+	}
+	weight := func(size PartitionSize) int64 {
+		if byBytes {
+			return size.Bytes
+		}
+		return size.Records
+	}
+	for _, size := range sizes {
+		total += weight(size)
+	}
+	assign := make([]int, len(sizes))
+	if total == 0 {
+		for p := range assign {
+			assign[p] = p % numShard
+		}
+		return assign
+	}
+	// Each shard is given an equal range of the cumulative size of the
+	// partitions, and each partition is assigned to the shard whose
+	// range contains the partition's midpoint.
+	var cum int64
+	for p, size := range sizes {
+		w := weight(size)
+		shard := int((2*cum + w) * int64(numShard) / (2 * total))
+		if shard >= numShard {
+			shard = numShard - 1
+		}
+		assign[p] = shard
+		cum += w
+	}
+	return assign
+}
+
+// PartitionWeights weights the dimensions of partition sizes in the
+// cost of reading a partition, as computed by BalancedPartitions. Each
+// dimension is normalized by its total over all partitions, so that
+// the weights are independent of the dimensions' scales: with weights
+// {Bytes: 1, Records: 1}, a partition with a tenth of the bytes and a
+// tenth of the records costs as much as one with a fifth of the bytes
+// and no records.
+type PartitionWeights struct {
+	// Bytes is the weight of the encoded size of a partition.
+	Bytes float64
+	// Records is the weight of the number of records in a partition.
+	Records float64
+}
+
+// DefaultPartitionWeights are the size-dominant weights used by
+// BalancedPartitions when no weights are provided.
+var DefaultPartitionWeights = PartitionWeights{Bytes: 0.8, Records: 0.2}
+
+// costs returns the costs of reading the provided partitions, as
+// weighted by w. Dimensions that were not measured (e.g., bytes, by the
+// local executor) do not contribute to the costs.
+func (w PartitionWeights) costs(sizes []PartitionSize) []float64 {
+	var total PartitionSize
+	for _, size := range sizes {
+		total.Bytes += size.Bytes
+		total.Records += size.Records
+	}
+	costs := make([]float64, len(sizes))
+	for p, size := range sizes {
+		if total.Bytes > 0 {
+			costs[p] += w.Bytes * float64(size.Bytes) / float64(total.Bytes)
+		}
+		if total.Records > 0 {
+			costs[p] += w.Records * float64(size.Records) / float64(total.Records)
+		}
+	}
+	return costs
+}
+
+// BalancedPartitions returns a PartitionPolicy that assigns partitions
+// to shards so as to balance the cost of reading them, which combines
+// their byte sizes and record counts as weighted by the provided
+// weights (DefaultPartitionWeights if zero). Unlike
+// ProportionalPartitions, which balances a single dimension, this
+// avoids shards that read few bytes but many records (e.g., from many
+// small partitions of small records), or vice versa.
+//
+// Partitions are assigned greedily, in decreasing order of cost, each
+// to the shard with the least total cost so far (the "longest
+// processing time" rule). The cost of the most expensive shard is thus
+// within a factor 4/3 of that of the optimal assignment. Partitions
+// assigned to a shard need not be contiguous, so the policy does not
+// rebalance range-sharded stages (see Rebalance).
+func BalancedPartitions(weights PartitionWeights) PartitionPolicy {
+	if weights == (PartitionWeights{}) {
+		weights = DefaultPartitionWeights
+	}
+	if weights.Bytes < 0 || weights.Records < 0 {
+		panic(fmt.Sprintf("exec.BalancedPartitions: invalid weights %+v", weights))
+	}
+	return func(sizes []PartitionSize, numShard int) []int {
+		var (
+			costs  = weights.costs(sizes)
+			order  = make([]int, len(sizes))
+			loads  = make([]float64, numShard)
+			assign = make([]int, len(sizes))
+		)
+		for p := range order {
+			order[p] = p
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			return costs[order[i]] > costs[order[j]]
+		})
+		for i, p := range order {
+			shard := 0
+			for s := range loads {
+				if loads[s] < loads[shard] {
+					shard = s
+				}
+			}
+			if costs[p] == 0 {
+				// Spread partitions without cost, which are
+				// last, over the shards in turn.
+				shard = i % numShard
+			}
+			assign[p] = shard
+			loads[shard] += costs[p]
+		}
+		return assign
+	}
+}
+
+// Rebalance configures the session to assign shuffle partitions to the
+// shards of consuming stages by the provided policy, using the
+// partition sizes measured by the executor. Consuming stages always
+// wait for the whole of their producing stages to complete, so this
+// introduces no new scheduling barrier; however, the policy is run on
+// the driver, once per consuming stage, before the stage's first task
+// is dispatched, and its run time adds directly to the latency of the
+// stage. Stages whose dependencies are combined on their producing
+// machines (see MachineCombiners) do not report partition sizes and
+// are not rebalanced. The shards of range-sharded stages (see
+// bigslice.RangeShard) must hold ascending ranges of keys, and so are
+// rebalanced only if the policy assigns them contiguous, ascending
+// ranges of partitions, as ProportionalPartitions does.
+func Rebalance(policy PartitionPolicy) Option {
+	return func(s *Session) {
+		s.partitionPolicy = policy
+	}
+}
+
+// assignment returns the partition assignment of the stage of the
+// provided task, or nil if the stage is not rebalanced. Assignments
+// are computed by the session's partition policy from the measured
+// sizes of the task's dependencies the first time assignment is called
+// for a task of a stage, and reused for the other tasks of the stage.
+// They are released when the evaluation of the task's invocation ends
+// (see endStages); tasks of the stage that are rerun by a later
+// evaluation recompute the assignment from the same measured sizes.
+func (s *Session) assignment(task *Task) []int {
+	if s.partitionPolicy == nil || len(task.Deps) == 0 {
+		return nil
+	}
+	key := TaskName{InvIndex: task.Name.InvIndex, Op: task.Name.Op}
+	s.mu.Lock()
+	assign, ok := s.assignments[key]
+	s.mu.Unlock()
+	if !ok {
+		assign = s.assign(task)
+		s.mu.Lock()
+		if s.assignments == nil {
+			s.assignments = make(map[TaskName][]int)
+		}
+		if prev, ok := s.assignments[key]; ok {
+			// Another task of the stage raced us; its assignment
+			// must be used by all tasks.
+			assign = prev
+		} else {
+			s.assignments[key] = assign
+		}
+		s.mu.Unlock()
+	}
+	return assign
+}
+
+// assignedPartitions returns the partitions assigned to the provided
+// shard by a stage's assignment, or nil if the stage is not
+// rebalanced.
+func assignedPartitions(assign []int, shard int) []int {
+	if assign == nil {
+		return nil
+	}
+	partitions := []int{}
+	for p, s := range assign {
+		if s == shard {
+			partitions = append(partitions, p)
+		}
+	}
+	return partitions
+}
+
+// depPartitions returns the partitions of dep to be read given the
+// assigned partitions, as returned by assignedPartitions.
+func depPartitions(dep TaskDep, partitions []int) []int {
+	if partitions == nil {
+		return []int{dep.Partition}
+	}
+	return partitions
+}
+
+// assign computes the partition assignment for the stage of the
+// provided task, returning nil if the stage cannot be rebalanced.
+func (s *Session) assign(task *Task) []int {
+	numShard := task.Name.NumShard
+	if numShard <= 1 {
+		return nil
+	}
+	sizes := make([]PartitionSize, numShard)
+	for _, dep := range task.Deps {
+		if dep.CombineKey != "" || dep.Head == nil || len(dep.Head.Group) == 0 {
+			// Only shuffle dependencies without combiners may be
+			// rebalanced.
+			return nil
+		}
+		for i := 0; i < dep.NumTask(); i++ {
+			deptask := dep.Task(i)
+			deptask.Lock()
+			depSizes := deptask.PartitionSizes
+			deptask.Unlock()
+			if deptask.NumPartition != numShard || len(depSizes) != numShard {
+				return nil
+			}
+			for p, size := range depSizes {
+				sizes[p].Records += size.Records
+				sizes[p].Bytes += size.Bytes
+			}
+		}
+	}
+	assign := s.partitionPolicy(sizes, numShard)
+	if assign == nil {
+		return nil
+	}
+	if len(assign) != numShard {
+		log.Error.Printf("partition policy for %s returned %d assignments for %d partitions; not rebalancing",
+			task.Name.Op, len(assign), numShard)
+		return nil
+	}
+	for p, shard := range assign {
+		if shard < 0 || shard >= numShard {
+			log.Error.Printf("partition policy for %s assigned partition %d to invalid shard %d; not rebalancing",
+				task.Name.Op, p, shard)
+			return nil
+		}
+	}
+	if isRangeSharded(task) {
+		for p := 1; p < numShard; p++ {
+			if assign[p] < assign[p-1] {
+				log.Debug.Printf("partition policy for range-sharded %s does not assign contiguous ranges of partitions; not rebalancing",
+					task.Name.Op)
+				return nil
+			}
+		}
+	}
+	return assign
+}
+
+// isRangeSharded returns whether any of the slices computed by the
+// provided task are sharded by range, in which case the order of its
+// stage's shards must be preserved.
+func isRangeSharded(task *Task) bool {
+	for _, slice := range task.Slices {
+		if slice.ShardType() == bigslice.RangeShard {
+			return true
+		}
+	}
+	return false
+}
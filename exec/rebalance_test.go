@@ -0,0 +1,278 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/grailbio/bigmachine/testsystem"
+	"github.com/grailbio/bigslice"
+)
+
+func TestProportionalPartitions(t *testing.T) {
+	for _, c := range []struct {
+		sizes    []PartitionSize
+		numShard int
+		want     []int
+	}{
+		{
+			[]PartitionSize{{Records: 1}, {Records: 1}, {Records: 1}, {Records: 1}},
+			4,
+			[]int{0, 1, 2, 3},
+		},
+		{
+			[]PartitionSize{{Records: 10}, {Records: 1}, {Records: 1}, {Records: 1}},
+			4,
+			[]int{1, 3, 3, 3},
+		},
+		{
+			[]PartitionSize{{Records: 1}, {Records: 1}, {Records: 1}, {Records: 10}},
+			4,
+			[]int{0, 0, 0, 2},
+		},
+		{
+			// Bytes take precedence over records.
+			[]PartitionSize{{1, 5}, {100, 5}, {1, 5}, {100, 5}},
+			4,
+			[]int{0, 1, 2, 3},
+		},
+		{
+			[]PartitionSize{{}, {}, {}},
+			3,
+			[]int{0, 1, 2},
+		},
+	} {
+		if got, want := ProportionalPartitions(c.sizes, c.numShard), c.want; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", c.sizes, got, want)
+		}
+	}
+}
+
+// maxLoad returns the cost of the most expensive shard of the provided
+// assignment.
+func maxLoad(costs []float64, assign []int, numShard int) float64 {
+	loads := make([]float64, numShard)
+	for p, shard := range assign {
+		loads[shard] += costs[p]
+	}
+	var max float64
+	for _, load := range loads {
+		if load > max {
+			max = load
+		}
+	}
+	return max
+}
+
+// optimalLoad returns the cost of the most expensive shard of an optimal
+// assignment of partitions with the provided costs, by exhaustive
+// search.
+func optimalLoad(costs []float64, numShard int) float64 {
+	var (
+		assign = make([]int, len(costs))
+		best   = math.Inf(1)
+		search func(p int)
+	)
+	search = func(p int) {
+		if p == len(costs) {
+			if load := maxLoad(costs, assign, numShard); load < best {
+				best = load
+			}
+			return
+		}
+		for shard := 0; shard < numShard; shard++ {
+			assign[p] = shard
+			search(p + 1)
+		}
+	}
+	search(0)
+	return best
+}
+
+func TestBalancedPartitions(t *testing.T) {
+	// Partitions have equal sizes in bytes, but partition 0 has many
+	// small records.
+	sizes := []PartitionSize{{10, 100}, {1, 100}, {1, 100}, {1, 100}, {1, 100}, {1, 100}}
+	if got, want := BalancedPartitions(PartitionWeights{Bytes: 1})(sizes, 3), []int{0, 1, 2, 0, 1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Balancing both dimensions gives partition 0 a shard of its own.
+	if got, want := BalancedPartitions(PartitionWeights{Bytes: 1, Records: 1})(sizes, 3), []int{0, 1, 2, 1, 2, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Records are used when bytes are not measured.
+	sizes = []PartitionSize{{Records: 10}, {Records: 1}, {Records: 1}, {Records: 1}}
+	if got, want := BalancedPartitions(PartitionWeights{})(sizes, 2), []int{0, 1, 1, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Partitions without cost are spread over the shards.
+	if got, want := BalancedPartitions(PartitionWeights{})(make([]PartitionSize, 4), 3), []int{0, 1, 2, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// The most expensive shard is within a factor 4/3 of optimal.
+	var (
+		r       = rand.New(rand.NewSource(0))
+		weights = DefaultPartitionWeights
+	)
+	for i := 0; i < 200; i++ {
+		var (
+			numShard = 2 + r.Intn(3)
+			sizes    = make([]PartitionSize, 3+r.Intn(5))
+		)
+		for p := range sizes {
+			sizes[p] = PartitionSize{Bytes: r.Int63n(1000), Records: r.Int63n(1000)}
+		}
+		var (
+			costs   = weights.costs(sizes)
+			got     = maxLoad(costs, BalancedPartitions(weights)(sizes, numShard), numShard)
+			optimal = optimalLoad(costs, numShard)
+		)
+		if got > optimal*4/3+1e-9 {
+			t.Errorf("%v, %d shards: got max load %v, optimal %v", sizes, numShard, got, optimal)
+		}
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	const N = 1000
+	// Most rows share the key 0, so that one partition is much larger
+	// than the others.
+	fn := bigslice.Func(func() bigslice.Slice {
+		keys := make([]int, N)
+		for i := range keys {
+			if i%10 == 0 {
+				keys[i] = i
+			}
+		}
+		vals := rangeSlice(0, N)
+		return bigslice.Cogroup(bigslice.Const(5, keys, vals))
+	})
+	for name, newOpt := range map[string]func() Option{
+		"Local":           func() Option { return Local },
+		"Bigmachine.Test": func() Option { return Bigmachine(testsystem.New()) },
+	} {
+		for _, policy := range []struct {
+			name string
+			PartitionPolicy
+		}{
+			{"proportional", ProportionalPartitions},
+			{"balanced", BalancedPartitions(PartitionWeights{})},
+			{"single", func(sizes []PartitionSize, numShard int) []int {
+				return make([]int, len(sizes))
+			}},
+		} {
+			t.Run(name+"/"+policy.name, func(t *testing.T) {
+				var (
+					mu    sync.Mutex
+					calls int
+					total PartitionSize
+				)
+				sess := Start(newOpt(), Rebalance(func(sizes []PartitionSize, numShard int) []int {
+					mu.Lock()
+					defer mu.Unlock()
+					calls++
+					for _, size := range sizes {
+						total.Records += size.Records
+						total.Bytes += size.Bytes
+					}
+					return policy.PartitionPolicy(sizes, numShard)
+				}))
+				ctx := context.Background()
+				res := sess.Must(ctx, fn)
+				var (
+					keys   []int
+					groups [][]int
+				)
+				if err := res.Collect(ctx, &keys, &groups); err != nil {
+					t.Fatal(err)
+				}
+				var vals []int
+				for _, group := range groups {
+					vals = append(vals, group...)
+				}
+				sort.Ints(vals)
+				if got, want := vals, rangeSlice(0, N); !reflect.DeepEqual(got, want) {
+					t.Errorf("got %v, want %v", got, want)
+				}
+				if got, want := len(keys), N/10; got != want {
+					t.Errorf("got %v, want %v", got, want)
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if got, want := calls, 1; got != want {
+					t.Errorf("got %v, want %v", got, want)
+				}
+				if got, want := total.Records, int64(N); got != want {
+					t.Errorf("got %v, want %v", got, want)
+				}
+				if name == "Bigmachine.Test" && total.Bytes == 0 {
+					t.Error("expected bytes to be measured")
+				}
+			})
+		}
+	}
+}
+
+func TestRebalanceRangeShard(t *testing.T) {
+	const N = 1000
+	bounds := []int{250, 500, 750}
+	fn := bigslice.Func(func() bigslice.Slice {
+		keys := rangeSlice(0, N)
+		rand.New(rand.NewSource(0)).Shuffle(N, func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+		return bigslice.PartitionByRanges(bigslice.Const(4, keys), 0, bounds)
+	})
+	// A policy that reverses the order of the partitions would reverse
+	// the ranges of the stage's shards.
+	reverse := func(sizes []PartitionSize, numShard int) []int {
+		assign := make([]int, len(sizes))
+		for p := range assign {
+			assign[p] = numShard - 1 - p
+		}
+		return assign
+	}
+	sess := Start(Local, Rebalance(reverse))
+	ctx := context.Background()
+	var keys []int
+	if err := sess.Must(ctx, fn).Collect(ctx, &keys); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(keys), N; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	rangeOf := func(key int) int { return sort.SearchInts(bounds, key+1) }
+	for i := 1; i < len(keys); i++ {
+		if rangeOf(keys[i]) < rangeOf(keys[i-1]) {
+			t.Fatalf("key %d of range %d follows key %d of range %d", keys[i], rangeOf(keys[i]), keys[i-1], rangeOf(keys[i-1]))
+		}
+	}
+}
+
+func TestRebalanceReleasesAssignments(t *testing.T) {
+	fn := bigslice.Func(func() bigslice.Slice {
+		return bigslice.Reshuffle(bigslice.Const(4, rangeSlice(0, 100)))
+	})
+	sess := Start(Local, Rebalance(ProportionalPartitions))
+	ctx := context.Background()
+	var keys []int
+	if err := sess.Must(ctx, fn).Collect(ctx, &keys); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(keys), 100; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	sess.mu.Lock()
+	n := len(sess.assignments)
+	sess.mu.Unlock()
+	if n != 0 {
+		t.Errorf("got %d assignments after evaluation, want 0", n)
+	}
+}
@@ -0,0 +1,340 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigslice"
+	"github.com/grailbio/bigslice/sliceio"
+)
+
+// Restage describes the restaging of a stage of an invocation (see
+// RunHandle.RestageWith): the invocation is a rerun of a previous
+// invocation in which one of its stages is compiled with a different
+// number of shards, and in which the stages of the previous invocation
+// that do not depend on the restaged stage are reused.
+type Restage struct {
+	// Invocation is the index of the previous invocation.
+	Invocation uint64
+	// Stage is the name of the restaged stage, without the prefix
+	// that names its invocation.
+	Stage string
+	// NumShard is the number of shards of the restaged stage.
+	NumShard int
+}
+
+// A RunHandle is a handle to an invocation that is being evaluated
+// asynchronously (see Session.RunAsync), through which the evaluation
+// may be adjusted while it is running.
+type RunHandle struct {
+	sess *Session
+	done chan struct{}
+	res  *Result
+	err  error
+
+	mu sync.Mutex
+	// invIndex and tasks are the index and the tasks of the invocation
+	// that is currently being evaluated, once it is compiled.
+	invIndex uint64
+	tasks    []*Task
+	// restage is the restaging requested for the current invocation,
+	// if any.
+	restage *Restage
+}
+
+// RunAsync evaluates the slice returned by the bigslice func funcv
+// applied to the provided arguments, as Run, but returns immediately
+// with a handle to the evaluation. The evaluation's result is returned
+// by RunHandle.Wait.
+func (s *Session) RunAsync(ctx context.Context, funcv *bigslice.FuncValue, args ...interface{}) *RunHandle {
+	location := "<unknown>"
+	if _, file, line, ok := runtime.Caller(1); ok {
+		location = fmt.Sprintf("%s:%d", file, line)
+	}
+	h := &RunHandle{sess: s, done: make(chan struct{})}
+	go h.run(ctx, location, funcv, args)
+	return h
+}
+
+func (h *RunHandle) run(ctx context.Context, location string, funcv *bigslice.FuncValue, args []interface{}) {
+	defer close(h.done)
+	opts := []RunOption{
+		func(inv *execInvocation) {
+			inv.Location = location
+			inv.compiled = h.compiled
+		},
+	}
+	for {
+		res, err := h.sess.run(ctx, 1, opts, funcv, args...)
+		h.mu.Lock()
+		restage := h.restage
+		h.restage, h.tasks = nil, nil
+		h.mu.Unlock()
+		if err == nil || restage == nil || res == nil {
+			h.res, h.err = res, err
+			return
+		}
+		// The run was stopped by the cancellation of the restaged stage:
+		// rerun it, reusing what it computed.
+		opts = append(opts[:1], func(inv *execInvocation) {
+			inv.Env.Restage = restage
+			inv.restageFrom = res
+		})
+	}
+}
+
+// compiled records the tasks of the handle's current invocation.
+func (h *RunHandle) compiled(inv execInvocation, tasks []*Task) {
+	h.mu.Lock()
+	h.invIndex, h.tasks = inv.Index, tasks
+	h.mu.Unlock()
+}
+
+// Wait waits for the evaluation to complete, and returns its result.
+// If stages were restaged, the result is that of the last invocation.
+func (h *RunHandle) Wait() (*Result, error) {
+	<-h.done
+	return h.res, h.err
+}
+
+// RestageWith aborts the stage with the provided name, as displayed in
+// the session's status (i.e., TaskName.Op), and reruns it with nshard
+// shards, so that a stage that is found to be badly under- or
+// over-sharded can be corrected without restarting the evaluation.
+//
+// The stage's tasks are cancelled, as by RunHandle.CancelStage, and,
+// once the tasks that do not depend on the stage have completed, the
+// invocation is rerun as a new invocation in which the stage is
+// compiled with nshard shards. Stages of the new invocation that do
+// not depend on the restaged stage reuse the outputs of the previous
+// invocation instead of being recomputed; the outputs of the restaged
+// stage's dependencies are redistributed among the new shards by an
+// additional stage that reads the existing outputs. Stages that depend
+// on the restaged stage are recomputed, reading the restaged output.
+// The result of the new invocation is returned by Wait. Reuse is
+// limited to stages that are unambiguously identified by the source
+// locations of their slices, and that do not use machine combiners
+// (see MachineCombiners); other stages
+// are recomputed.
+//
+// Only stages whose partitioning allows them to be resharded may be
+// restaged: every dependency of the stage must be a shuffle (or
+// broadcast) dependency, partitioned by the default hash partitioner,
+// and the stage may read its dependencies' outputs as sorted runs
+// only if it combines them (as, e.g., Reduce does). Every stage that
+// depends on the restaged stage must do so through a shuffle, and
+// slices that depend on the number or index of their shards must not
+// be pipelined into the stage. RestageWith returns an error if the
+// stage cannot be restaged, if the stage has completed, or if the
+// evaluation has completed.
+func (h *RunHandle) RestageWith(name string, nshard int) error {
+	if nshard <= 0 {
+		return errors.E(errors.Invalid, fmt.Sprintf("restage: invalid number of shards %d", nshard))
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	select {
+	case <-h.done:
+		return errors.E(errors.Precondition, "restage: evaluation is complete")
+	default:
+	}
+	if h.restage != nil {
+		return errors.E(errors.Precondition, fmt.Sprintf("restage: stage %s is already being restaged", h.restage.Stage))
+	}
+	var stage []*Task
+	_ = iterTasks(h.tasks, func(task *Task) error {
+		if task.Name.InvIndex == h.invIndex && task.Name.Op == name {
+			stage = append(stage, task)
+		}
+		return nil
+	})
+	if len(stage) == 0 {
+		return errors.E(errors.NotExist, fmt.Sprintf("restage: no stage %s in invocation %d", name, h.invIndex))
+	}
+	var complete = true
+	for _, task := range stage {
+		task.Lock()
+		complete = complete && task.state == TaskOk
+		task.Unlock()
+	}
+	if complete {
+		return errors.E(errors.Precondition, fmt.Sprintf("restage: stage %s is complete", name))
+	}
+	if err := restageable(name, stage[0].Slices); err != nil {
+		return err
+	}
+	h.restage = &Restage{
+		Invocation: h.invIndex,
+		Stage:      stageKey(h.invIndex, name),
+		NumShard:   nshard,
+	}
+	h.sess.cancelStage(stageID{h.invIndex, name})
+	return nil
+}
+
+// stageKey returns the name of the stage with the provided name,
+// compiled by the invocation with the provided index, without the
+// prefix that names the invocation, so that the stage may be
+// identified in reruns of the invocation.
+func stageKey(invIndex uint64, name string) string {
+	return strings.TrimPrefix(name, fmt.Sprintf("inv%d_", invIndex))
+}
+
+// restageable returns an error if the stage with the provided name,
+// comprising the provided pipelined slices, cannot be restaged. See
+// RunHandle.RestageWith.
+func restageable(name string, slices []bigslice.Slice) error {
+	last := slices[len(slices)-1]
+	if last.NumDep() == 0 {
+		return errors.E(errors.Invalid, fmt.Sprintf("restage: stage %s reads its shards directly from source %s", name, last.Name()))
+	}
+	for i := 0; i < last.NumDep(); i++ {
+		dep := last.Dep(i)
+		switch {
+		case !dep.Shuffle:
+			return errors.E(errors.Invalid, fmt.Sprintf("restage: stage %s reads dependency %s without a shuffle", name, dep.Slice.Name()))
+		case dep.Broadcast:
+		case dep.Partitioner != nil:
+			return errors.E(errors.Invalid, fmt.Sprintf("restage: stage %s partitions dependency %s with a custom partitioner", name, dep.Slice.Name()))
+		case dep.Expand && last.Combiner().IsNil():
+			return errors.E(errors.Invalid, fmt.Sprintf("restage: stage %s reads dependency %s as sorted runs", name, dep.Slice.Name()))
+		}
+	}
+	return nil
+}
+
+// stageSignature returns a string that identifies the stage comprising
+// the provided pipelined slices across invocations: the names of the
+// slices, which include their source locations.
+func stageSignature(slices []bigslice.Slice) string {
+	names := make([]string, len(slices))
+	for i, slice := range slices {
+		names[i] = slice.Name().String()
+	}
+	return strings.Join(names, ",")
+}
+
+// previousStages indexes the stages of the invocations that are rerun
+// by the compiled invocation, by stage signature. Only the stages of
+// the latest invocation that compiled each signature are retained, and
+// signatures that are ambiguous within that invocation are mapped to
+// nil, so that they are not reused.
+func (c *compiler) previousStages() map[string][]*Task {
+	restage := c.inv.Env.Restage
+	if c.prev != nil || restage == nil || c.inv.restageFrom == nil {
+		return c.prev
+	}
+	// The previous invocation may itself have reused the stages of the
+	// invocations that it reran.
+	var (
+		prev   = c.inv.restageFrom.tasks
+		reruns = map[uint64]bool{restage.Invocation: true}
+		stages = make(map[TaskName][]*Task)
+	)
+	for changed := true; changed; {
+		changed = false
+		_ = iterTasks(prev, func(task *Task) error {
+			if r := task.Invocation.Env.Restage; reruns[task.Name.InvIndex] && r != nil && !reruns[r.Invocation] {
+				reruns[r.Invocation] = true
+				changed = true
+			}
+			return nil
+		})
+	}
+	_ = iterTasks(prev, func(task *Task) error {
+		if reruns[task.Name.InvIndex] && task.Name.NumShard > 0 {
+			key := task.Name
+			key.Shard = 0
+			stages[key] = append(stages[key], task)
+		}
+		return nil
+	})
+	c.prev = make(map[string][]*Task)
+	latest := make(map[string]uint64)
+	for key, tasks := range stages {
+		if len(tasks) != key.NumShard || len(tasks[0].Slices) == 0 {
+			continue
+		}
+		ordered := make([]*Task, len(tasks))
+		for _, task := range tasks {
+			ordered[task.Name.Shard] = task
+		}
+		sig := stageSignature(ordered[0].Slices)
+		switch inv, ok := latest[sig]; {
+		case !ok || key.InvIndex > inv:
+			latest[sig] = key.InvIndex
+			c.prev[sig] = ordered
+		case key.InvIndex == inv:
+			c.prev[sig] = nil
+		}
+	}
+	return c.prev
+}
+
+// reuse returns the tasks with which the newly compiled tasks of the
+// stage comprising the provided slices may be substituted when
+// compiling a rerun of an invocation, or nil if they must be computed.
+// The tasks of a stage that does not depend on newly compiled tasks
+// are substituted with those of the corresponding stage of the
+// previous invocation, if it has the same shards and partitions; if
+// only its partitioning differs, as for the dependencies of a restaged
+// stage, they are substituted with new tasks that repartition the
+// previous outputs. The returned boolean indicates whether the
+// returned tasks are those of the previous invocation.
+func (c *compiler) reuse(slices []bigslice.Slice, tasks []*Task, part partitioner) ([]*Task, bool, error) {
+	for _, task := range tasks {
+		for _, dep := range task.Deps {
+			if dep.Head.Name.InvIndex == c.inv.Index {
+				return nil, false, nil
+			}
+		}
+	}
+	prev := c.previousStages()[stageSignature(slices)]
+	if prev == nil || len(prev) != len(tasks) || prev[0].CombineKey != "" {
+		return nil, false, nil
+	}
+	if prev[0].NumPartition == part.NumPartition() && prev[0].Combiner.IsNil() == part.Combiner.IsNil() && part.CombineKey == "" {
+		return prev, true, nil
+	}
+	if !part.IsShuffle() || part.partitioner != nil {
+		return nil, false, nil
+	}
+	// Each repartitioning task reads one of the previous partitions
+	// from all of the previous tasks.
+	var (
+		opName = c.namer.New(fmt.Sprintf("%s_restage", tasks[0].Name.Op))
+		repart = make([]*Task, prev[0].NumPartition)
+	)
+	if err := c.addTasks(opName, len(repart)); err != nil {
+		return nil, false, err
+	}
+	for i := range repart {
+		repart[i] = &Task{
+			Type:       prev[0].Type,
+			Invocation: c.inv,
+			Name: TaskName{
+				InvIndex: c.inv.Index,
+				Op:       opName,
+				Shard:    i,
+				NumShard: len(repart),
+			},
+			Do:           func(readers []sliceio.Reader) sliceio.Reader { return readers[0] },
+			Deps:         []TaskDep{{prev[0], i, false, ""}},
+			Pragma:       prev[0].Pragma,
+			Tags:         prev[0].Tags,
+			NumPartition: part.NumPartition(),
+			Partitioner:  part.Partitioner(),
+			Combiner:     part.Combiner,
+			CombineKey:   part.CombineKey,
+		}
+	}
+	return repart, false, nil
+}
@@ -0,0 +1,143 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigslice"
+)
+
+func TestRestage(t *testing.T) {
+	const N = 1000
+	var (
+		ctx      = context.Background()
+		mapped   int32
+		blocking int32
+		started  = make(chan struct{}, N)
+	)
+	fn := bigslice.Func(func() bigslice.Slice {
+		slice := bigslice.Const(4, rangeSlice(0, N), rangeSlice(0, N))
+		slice = bigslice.Map(slice, func(k, v int) (int, int) {
+			atomic.AddInt32(&mapped, 1)
+			return k % 100, 1
+		})
+		slice = bigslice.Reduce(slice, func(a, b int) int { return a + b })
+		slice = bigslice.Filter(slice, func(ctx context.Context, k, v int) bool {
+			if atomic.LoadInt32(&blocking) == 1 {
+				started <- struct{}{}
+				<-ctx.Done()
+			}
+			return true
+		})
+		slice = bigslice.Map(slice, func(k, v int) (int, int) { return k % 10, v })
+		return bigslice.Reduce(slice, func(a, b int) int { return a + b })
+	})
+	testSession(t, func(t *testing.T, sess *Session) {
+		atomic.StoreInt32(&mapped, 0)
+		atomic.StoreInt32(&blocking, 1)
+		h := sess.RunAsync(ctx, fn)
+		<-started
+		h.mu.Lock()
+		var (
+			invIndex = h.invIndex
+			name     string
+		)
+		_ = iterTasks(h.tasks, func(task *Task) error {
+			if strings.Contains(task.Name.Op, "filter") {
+				name = task.Name.Op
+			}
+			return nil
+		})
+		h.mu.Unlock()
+		if name == "" {
+			t.Fatal("stage not found")
+		}
+		if err := h.RestageWith("nonexistent", 7); !errors.Is(errors.NotExist, err) {
+			t.Errorf("expected NotExist error, got %v", err)
+		}
+		if err := h.RestageWith(name, 0); !errors.Is(errors.Invalid, err) {
+			t.Errorf("expected Invalid error, got %v", err)
+		}
+		atomic.StoreInt32(&blocking, 0)
+		if err := h.RestageWith(name, 7); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.RestageWith(name, 8); !errors.Is(errors.Precondition, err) {
+			t.Errorf("expected Precondition error, got %v", err)
+		}
+		res, err := h.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.invIndex == invIndex {
+			t.Error("invocation was not rerun")
+		}
+		var keys, counts []int
+		if err := res.Collect(ctx, &keys, &counts); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := len(keys), 10; got != want {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+		for i := range keys {
+			if got, want := counts[i], N/10; got != want {
+				t.Errorf("key %d: got %v, want %v", keys[i], got, want)
+			}
+		}
+		// The upstream stage was not recomputed, and the restaged stage was
+		// compiled with the new number of shards.
+		if got, want := atomic.LoadInt32(&mapped), int32(N); got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		restaged := make(map[string]int)
+		_ = iterTasks(res.tasks, func(task *Task) error {
+			if task.Name.InvIndex == res.invIndex {
+				restaged[stageKey(res.invIndex, task.Name.Op)] = task.Name.NumShard
+			}
+			return nil
+		})
+		if got, want := restaged[stageKey(invIndex, name)], 7; got != want {
+			t.Errorf("got %v, want %v (%v)", got, want, restaged)
+		}
+		if err := h.RestageWith(name, 7); !errors.Is(errors.Precondition, err) {
+			t.Errorf("expected Precondition error, got %v", err)
+		}
+	})
+}
+
+func TestRestageable(t *testing.T) {
+	var (
+		source   = bigslice.Const(2, []int{1}, []int{1})
+		reduced  = bigslice.Reduce(source, func(a, b int) int { return a + b })
+		ranges   = bigslice.PartitionByRanges(source, 0, []int{0})
+		branch   = bigslice.Map(source, func(k, v int) int { return k })
+		cogroup  = bigslice.Cogroup(source, reduced)
+		reshards = bigslice.Reshard(reduced, 4)
+	)
+	for _, test := range []struct {
+		slice bigslice.Slice
+		want  string
+	}{
+		{reduced, ""},
+		{cogroup, ""},
+		{source, "reads its shards directly from source"},
+		{branch, "reads its shards directly from source"},
+		{ranges, "with a custom partitioner"},
+		{reshards, ""},
+	} {
+		err := restageable("stage", pipeline(test.slice))
+		switch {
+		case test.want == "" && err != nil:
+			t.Errorf("%s: %v", test.slice.Name(), err)
+		case test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)):
+			t.Errorf("%s: got %v, want %q", test.slice.Name(), err, test.want)
+		}
+	}
+}
@@ -11,26 +11,49 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"reflect"
 	"runtime"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/grailbio/base/backgroundcontext"
 	"github.com/grailbio/base/diagnostic/dump"
+	"github.com/grailbio/base/errors"
 	"github.com/grailbio/base/eventlog"
 	"github.com/grailbio/base/limiter"
 	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/retry"
 	"github.com/grailbio/base/status"
 	"github.com/grailbio/bigmachine"
 	"github.com/grailbio/bigslice"
+	"github.com/grailbio/bigslice/bloom"
+	"github.com/grailbio/bigslice/frame"
 	"github.com/grailbio/bigslice/metrics"
 	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/stats"
 	"github.com/grailbio/bigslice/typecheck"
 )
 
 // DefaultMaxLoad is the default machine max load.
 const DefaultMaxLoad = 0.95
 
+// DefaultCollectLimit is the default maximum number of rows that may be
+// collected to the driver by Result.Collect.
+const DefaultCollectLimit = 1 << 20
+
+// DefaultCollectByteLimit is the default maximum (estimated) number of
+// bytes that may be collected to the driver by Result.Collect.
+const DefaultCollectByteLimit = 1 << 30
+
+// DefaultMaxTasks is the default maximum number of tasks that may be
+// compiled for a single invocation.
+const DefaultMaxTasks = 1 << 22
+
+// DefaultMaxCompileDepth is the default maximum depth of the
+// dependencies of the slices of a single invocation.
+const DefaultMaxCompileDepth = 1 << 12
+
 func init() {
 	gob.Register(&Result{})
 }
@@ -74,8 +97,81 @@ type Session struct {
 	status    *status.Status
 	eventer   eventlog.Eventer
 	tracePath string
+	// events publishes the session's events to its subscribers, or is
+	// nil if there are none. See EventSubscriber.
+	events *eventBus
+	// completions delivers task completions to the session's
+	// callbacks, or is nil if there are none. See TaskCompletionFunc.
+	completions *completionQueue
 
 	machineCombiners bool
+	// failEmptySlices, if set, fails invocations that include slices
+	// without shards. See FailEmptySlices.
+	failEmptySlices bool
+
+	// collectLimit and collectByteLimit are the maximum number of rows
+	// and bytes that may be collected by Result.Collect.
+	collectLimit     int
+	collectByteLimit int64
+
+	// maxTasks and maxCompileDepth bound the number of tasks and the
+	// dependency depth of each compiled invocation. See MaxTasks and
+	// MaxCompileDepth.
+	maxTasks        int
+	maxCompileDepth int
+
+	// chunkSize is the number of rows per frame with which task outputs
+	// are read and written. See ChunkSize.
+	chunkSize int
+
+	// shuffleMemory is the per-task budget for in-flight shuffle data,
+	// in bytes, or 0 if unlimited. See ShuffleMemory.
+	shuffleMemory int64
+
+	// readOrder is the order in which tasks read the partitions of
+	// their dependencies, if readOrderSet; otherwise, the executor's
+	// default order is used. See DepReadOrder.
+	readOrder    ReadOrder
+	readOrderSet bool
+
+	// materialization determines when tasks are started relative to
+	// the tasks on which they depend. See DepMaterialization.
+	materialization Materialization
+
+	// credentials resolves the credentials used by tasks, if any. See
+	// Credentials.
+	credentials bigslice.CredentialProvider
+
+	// keyPolicy determines the ordering of NaN and nil keys. See
+	// KeyPolicy.
+	keyPolicy frame.KeyPolicy
+
+	// codec is the name of the codec with which shuffle and checkpoint
+	// data are compressed, if any. See Compression.
+	codec string
+
+	// invEncoding is the name of the encoder with which invocations are
+	// sent to workers, or empty for DefaultInvocationEncoding. See
+	// InvocationEncoding.
+	invEncoding string
+
+	// keys provides the keys with which shuffle and checkpoint data are
+	// encrypted, if any. See Encryption.
+	keys sliceio.KeyProvider
+
+	// combinerMemory is the memory budget of each combiner, in bytes, or
+	// 0 if unlimited. See CombinerMemory.
+	combinerMemory int64
+
+	// maxMachines is the maximum number of machines that may be
+	// allocated by the session; 0 means unlimited. Budget enforces it.
+	maxMachines int
+	budget      *machineBudget
+
+	// provisionPolicy is the retry policy with which temporarily failed
+	// machine provisioning requests are retried, if not the default. See
+	// ProvisionPolicy.
+	provisionPolicy retry.Policy
 
 	tracer *tracer
 
@@ -83,6 +179,43 @@ type Session struct {
 	// roots stores all task roots compiled by this session;
 	// used for debugging.
 	roots map[*Task]struct{}
+	// stages holds the cancellation state of each stage of the
+	// invocations that are being evaluated. See RunHandle.CancelStage.
+	stages map[stageID]*stage
+	// idleStage is the stage shared by the tasks of invocations that
+	// are not being evaluated. See Session.stage.
+	idleStage *stage
+	// liveInvs holds the invocations whose tasks are being evaluated.
+	// See beginStages.
+	liveInvs map[uint64]*liveInv
+
+	// partitionPolicy, if set, assigns shuffle partitions to consuming
+	// shards; assignments holds the assignment computed for each
+	// consuming stage, keyed by its task name without shard. See
+	// Rebalance.
+	partitionPolicy PartitionPolicy
+	assignments     map[TaskName][]int
+
+	// statePrefix is the path prefix under which the state of each
+	// invocation's task graph is persisted, if any. See StatePrefix.
+	statePrefix string
+
+	// skewThreshold is the max/median ratio of task output sizes above
+	// which a stage is skewed; skewWarnings logs skewed stages after
+	// each invocation. See SkewThreshold and SkewWarnings.
+	skewThreshold float64
+	skewWarnings  bool
+
+	// coalesceTasks and coalesceBytes bound the number and estimated
+	// input size of the tasks that are run together. See CoalesceTasks.
+	coalesceTasks int
+	coalesceBytes int64
+
+	// warmDepth is the number of stages ahead of running stages that
+	// are warmed, or 0 if none; warmTimeout is the time after which
+	// warmed machines that are unused are released. See WarmLookahead.
+	warmDepth   int
+	warmTimeout time.Duration
 }
 
 func newSession() *Session {
@@ -174,6 +307,296 @@ var MachineCombiners Option = func(s *Session) {
 	s.machineCombiners = true
 }
 
+// FailEmptySlices is a session option that fails invocations whose
+// computations include slices with no shards, e.g., sources over an
+// empty list of files, instead of computing them. By default, a slice
+// with no shards is well defined, and empty: its dependents read no
+// rows from it, so that, e.g., scanning a result computed from it
+// yields nothing.
+var FailEmptySlices Option = func(s *Session) {
+	s.failEmptySlices = true
+}
+
+// CollectLimit configures the maximum number of rows that may be
+// collected to the driver by Result.Collect. Collecting a result with
+// more rows fails instead of risking exhausting the driver's memory.
+func CollectLimit(rows int) Option {
+	if rows <= 0 {
+		panic("exec.CollectLimit: rows <= 0")
+	}
+	return func(s *Session) {
+		s.collectLimit = rows
+	}
+}
+
+// CollectByteLimit configures the maximum number of bytes that may be
+// collected to the driver by Result.Collect, as estimated from the
+// sizes of the collected values: the fixed size of each value, plus
+// the lengths of strings and byte slices. Collecting a result with
+// more bytes fails instead of risking exhausting the driver's memory.
+func CollectByteLimit(bytes int64) Option {
+	if bytes <= 0 {
+		panic("exec.CollectByteLimit: bytes <= 0")
+	}
+	return func(s *Session) {
+		s.collectByteLimit = bytes
+	}
+}
+
+// MaxTasks configures the maximum number of tasks that may be compiled
+// for a single invocation. Compiling an invocation with more tasks,
+// e.g. because of enormous shard counts, fails with an error that
+// names the stage that exceeded the limit, rather than risking
+// exhausting the driver's memory before the computation starts. The
+// default is DefaultMaxTasks. The number of tasks compiled for an
+// invocation is reported by Result.NumTasks.
+func MaxTasks(n int) Option {
+	if n <= 0 {
+		panic("exec.MaxTasks: n <= 0")
+	}
+	return func(s *Session) {
+		s.maxTasks = n
+	}
+}
+
+// MaxCompileDepth configures the maximum depth of the dependencies of
+// the slices of a single invocation, i.e., the length of the longest
+// chain of slices, each a dependency of the next. Compiling a more
+// deeply nested invocation fails with an error that names the slice
+// that exceeded the limit. The default is DefaultMaxCompileDepth.
+func MaxCompileDepth(n int) Option {
+	if n <= 0 {
+		panic("exec.MaxCompileDepth: n <= 0")
+	}
+	return func(s *Session) {
+		s.maxCompileDepth = n
+	}
+}
+
+// ChunkSize configures the number of rows per frame with which the
+// session reads and writes task outputs: frames of this size are
+// passed through each task's chain of readers, and written to its
+// output and shuffle partitions. Small chunks incur per-frame
+// overhead, while large chunks inflate memory use and latency. The
+// default, 128 rows, is configured by the flag
+// -bigslice-internal-default-chunk-rows; chunks of tens to thousands
+// of rows are typical. Individual slices may override the session's
+// chunk size with the bigslice.ChunkSize pragma.
+func ChunkSize(rows int) Option {
+	if rows <= 0 {
+		panic("exec.ChunkSize: rows <= 0")
+	}
+	return func(s *Session) {
+		s.chunkSize = rows
+	}
+}
+
+// ShuffleMemory configures the maximum number of bytes of in-flight
+// shuffle data that each task may hold in memory. When configured,
+// tasks fetch the shuffle partitions that they read in full before
+// they are run, and spill partitions to local disk once the budget is
+// exhausted; spilled partitions are read back in order, so that the
+// task, e.g. a merge of its partitions, reads the same data as it would
+// otherwise. The memory use of fetched data is estimated from the
+// sizes of its values. By default, shuffle partitions are streamed
+// from the machines that produced them as they are read, so that a
+// task reading many partitions concurrently holds data from all of
+// them in flight. Bytes spilled are reported by the task statistic
+// "shuffleSpillBytes", and, for each process, by the expvar
+// "shufflespillbytes", distinct from bytes spilled by sorting
+// ("sortspillbytes"). ShuffleMemory currently applies only to the
+// bigmachine executor.
+func ShuffleMemory(bytes int64) Option {
+	if bytes <= 0 {
+		panic("exec.ShuffleMemory: bytes <= 0")
+	}
+	return func(s *Session) {
+		s.shuffleMemory = bytes
+	}
+}
+
+// CombinerMemory configures the maximum number of bytes of memory that
+// each combiner (e.g., of a Reduce) may use to group rows by key in
+// its in-memory hash table. The memory use of the table is estimated
+// from the sizes of its slots and of the values it holds. When the
+// budget is exceeded, the combiner sorts the keys it holds and spills
+// them to disk, and starts afresh with an empty table; once all rows
+// are combined, the sorted runs are merged and reduced, so that the
+// results are the same as if all keys were grouped in memory. Memory
+// is thus bounded regardless of the number of distinct keys.
+// Combiners always spill once they hold a fixed number of keys;
+// CombinerMemory bounds them further, e.g., when keys or values are
+// large. Spills are counted by CombinerSpills.
+func CombinerMemory(bytes int64) Option {
+	if bytes <= 0 {
+		panic("exec.CombinerMemory: bytes <= 0")
+	}
+	return func(s *Session) {
+		s.combinerMemory = bytes
+	}
+}
+
+// KeyPolicy configures how NaN floating point keys and nil pointer
+// keys are ordered when slices are sorted, merged, and grouped by key.
+// By default, nil keys are ordered first and NaN keys last. Since all
+// NaN keys (and all nil keys) compare and hash as equal under any
+// policy, rows with such keys are assigned to the same shard and
+// grouped together. The policy is carried by the contexts of the
+// session's tasks (see frame.KeyPolicyContext), so that sessions that
+// share a process may use different policies.
+func KeyPolicy(p frame.KeyPolicy) Option {
+	return func(s *Session) {
+		s.keyPolicy = p
+	}
+}
+
+// Compression configures the session to compress the data that its
+// tasks store, using the codec registered with the provided name (see
+// sliceio.RegisterCodec): the outputs of tasks that are shuffled or
+// read by other machines, and checkpoints (see bigslice.Checkpoint).
+// The codec's name is recorded with the data, so that it is always
+// decompressed by the matching codec, and data compressed by any
+// registered codec (or not compressed at all) may be read regardless
+// of the session's codec. The codec must be registered by every
+// process of the session, e.g. in an init function of a package
+// linked into the binary; reading data compressed with an unregistered
+// codec fails. The local executor does not store task outputs, so
+// only its checkpoints are compressed. Compression panics if no codec
+// is registered with the provided name.
+func Compression(name string) Option {
+	if !sliceio.CodecRegistered(name) {
+		panic(fmt.Sprintf("exec.Compression: unregistered codec %q", name))
+	}
+	return func(s *Session) {
+		s.codec = name
+	}
+}
+
+// Encryption configures the session to encrypt the data that its tasks
+// store, as configured by Compression, with the current key of the
+// provided key provider (see sliceio.NewEncryptingWriter). Data are
+// compressed before they are encrypted. Encrypted data are
+// authenticated, so that reads of data that have been modified or
+// truncated fail with an error of kind errors.Integrity. The ID of the
+// key with which data are encrypted is recorded with the data, so that
+// keys may be rotated: data remain readable for as long as the provider
+// returns their keys. Data that are not encrypted, such as data stored
+// by a session without encryption, are rejected with an error of kind
+// errors.Integrity, so that unauthenticated data cannot be substituted
+// for encrypted data.
+//
+// The provider is shipped to each of the session's machines, and so
+// must be gob-encodable when used with the bigmachine executor (see
+// sliceio.StaticKeys). Data that tasks spill to local disk while they
+// run are encrypted with a key that is generated by, and never leaves,
+// the process that spills them (see sliceio.NewSpillWriter).
+// Encryption panics if the provider is nil.
+func Encryption(keys sliceio.KeyProvider) Option {
+	if keys == nil {
+		panic("exec.Encryption: nil key provider")
+	}
+	return func(s *Session) {
+		s.keys = keys
+	}
+}
+
+// Credentials configures the provider with which tasks resolve named
+// credentials (see bigslice.LookupCredential). The provider is shipped
+// to each of the session's machines, where credentials are resolved,
+// lazily and at most once per task run, as tasks look them up; secrets
+// are thus not carried through the invocation's slice graph. The
+// provider must be gob-encodable when used with the bigmachine
+// executor.
+func Credentials(provider bigslice.CredentialProvider) Option {
+	if provider == nil {
+		panic("exec.Credentials: nil provider")
+	}
+	return func(s *Session) {
+		s.credentials = provider
+	}
+}
+
+// MaxMachines configures the maximum number of machines that may be
+// allocated concurrently by the session's executor. When the cap is
+// reached, ready tasks are queued until machines become available; the
+// cap may be raised while the session is running by
+// Session.SetMaxMachines. Machines store the results of the tasks they
+// ran, so they are stopped to make room for others only once they are
+// idle and the results they hold have been consumed: when a machine
+// pool (e.g., one used for exclusive tasks) is waiting for machines,
+// the other pools release such machines between stages. To guarantee
+// progress, each of the executor's machine pools is granted at least
+// one machine, even if this exceeds the cap. MaxMachines currently
+// applies only to the bigmachine executor.
+func MaxMachines(n int) Option {
+	if n <= 0 {
+		panic("exec.MaxMachines: n <= 0")
+	}
+	return func(s *Session) {
+		s.maxMachines = n
+	}
+}
+
+// ProvisionPolicy configures the retry policy with which the session's
+// executor retries requests to provision machines that fail with a
+// temporary error, e.g., because the cloud provider is throttling
+// requests. Retried requests wait as determined by the policy; a
+// provisioning request is abandoned only once the policy gives up. The
+// default policy backs off exponentially, with jitter, and never gives
+// up. ProvisionPolicy currently applies only to the bigmachine
+// executor.
+func ProvisionPolicy(policy retry.Policy) Option {
+	if policy == nil {
+		panic("exec.ProvisionPolicy: nil policy")
+	}
+	return func(s *Session) {
+		s.provisionPolicy = policy
+	}
+}
+
+// A RunOption represents a configuration parameter value of a single
+// invocation run by Session.RunWithOptions.
+type RunOption func(inv *execInvocation)
+
+// Priority configures the scheduling priority of an invocation.
+// Invocations with higher priority values are preferentially allocated
+// machine capacity: when machines become available, they are offered to
+// the ready tasks of the highest-priority invocation first. The default
+// priority is 0; priorities may be negative.
+//
+// Tasks that are already running are never preempted, so no completed
+// or in-progress work is lost; only the order in which pending tasks
+// are scheduled is affected. To guarantee that lower-priority
+// invocations make progress, the priority of a pending task is raised
+// by one for every interval (one minute by default) in which it waits
+// behind tasks of higher priority, until it exceeds theirs.
+//
+// Priority currently applies only to the bigmachine executor.
+func Priority(p int) RunOption {
+	return func(inv *execInvocation) {
+		inv.Priority = p
+	}
+}
+
+// Partitions configures an invocation to partition the output of each
+// of its shards into n partitions, as it would for a shuffle, so that
+// each partition may subsequently be read directly by
+// Result.Partition. Rows are assigned to partitions by the default
+// partitioner: by the hash of their prefix (key) columns, modulo n.
+// Partition contents thus depend on the hash functions of the key
+// types (see frame.Ops.HashWithSeed), as well as on n.
+//
+// The result of a partitioned invocation may be scanned as usual, but
+// it may not be used as the argument of another invocation.
+func Partitions(n int) RunOption {
+	if n <= 0 {
+		panic("exec.Partitions: n <= 0")
+	}
+	return func(inv *execInvocation) {
+		inv.NumPartition = n
+	}
+}
+
 // nextSessionIndex is the index of the next session that will be started by
 // Start. In general, there should be only one session per process, but we
 // violate this in some tests.
@@ -198,9 +621,29 @@ func Start(options ...Option) *Session {
 	if s.maxLoad == 0 {
 		s.maxLoad = DefaultMaxLoad
 	}
+	if s.collectLimit == 0 {
+		s.collectLimit = DefaultCollectLimit
+	}
+	if s.collectByteLimit == 0 {
+		s.collectByteLimit = DefaultCollectByteLimit
+	}
+	if s.chunkSize == 0 {
+		s.chunkSize = *defaultChunksize
+	}
+	if s.maxTasks == 0 {
+		s.maxTasks = DefaultMaxTasks
+	}
+	if s.maxCompileDepth == 0 {
+		s.maxCompileDepth = DefaultMaxCompileDepth
+	}
+	s.budget = newMachineBudget(s.maxMachines)
 	if s.executor == nil {
 		s.executor = newBigmachineExecutor(bigmachine.Local)
 	}
+	if _, ok := s.executor.(lazyExecutor); !ok && s.materialization == MaterializeLazy {
+		panic(fmt.Sprintf("exec.DepMaterialization: executor %T does not support %s materialization",
+			s.executor, s.materialization))
+	}
 	s.start()
 	return s
 }
@@ -211,12 +654,35 @@ func Start(options ...Option) *Session {
 // on error. It is safe to make concurrent calls to Run; the
 // underlying computation will be performed in parallel.
 func (s *Session) Run(ctx context.Context, funcv *bigslice.FuncValue, args ...interface{}) (*Result, error) {
-	return s.run(ctx, 1, funcv, args...)
+	return s.run(ctx, 1, nil, funcv, args...)
+}
+
+// RunWithOptions is a version of Run that configures the invocation
+// according to the provided options.
+func (s *Session) RunWithOptions(ctx context.Context, opts []RunOption, funcv *bigslice.FuncValue, args ...interface{}) (*Result, error) {
+	return s.run(ctx, 1, opts, funcv, args...)
+}
+
+// Reattach is a version of Run that resumes an invocation made by a
+// previous driver process, e.g., one that crashed, of a session with
+// the same StatePrefix. Tasks that the previous driver completed are
+// reattached to their outputs, provided that the machines that store
+// them are still alive; all other tasks are recomputed. The restarted
+// driver must make the same invocations, in the same order, as its
+// predecessor, so that they are identified with the persisted state.
+// If no state was persisted for the invocation, Reattach is
+// equivalent to Run.
+func (s *Session) Reattach(ctx context.Context, funcv *bigslice.FuncValue, args ...interface{}) (*Result, error) {
+	return s.run(ctx, 1, []RunOption{reattachInvocation}, funcv, args...)
+}
+
+var reattachInvocation RunOption = func(inv *execInvocation) {
+	inv.reattach = true
 }
 
 // Must is a version of Run that panics if the computation fails.
 func (s *Session) Must(ctx context.Context, funcv *bigslice.FuncValue, args ...interface{}) *Result {
-	res, err := s.run(ctx, 1, funcv, args...)
+	res, err := s.run(ctx, 1, nil, funcv, args...)
 	if err != nil {
 		log.Panicf("exec.Run: %v", err)
 	}
@@ -250,13 +716,16 @@ func (s *Session) Discard(ctx context.Context, roots []*Task) {
 }
 
 func (s *Session) start() {
+	s.events.start()
+	s.completions.start()
 	s.shutdown = s.executor.Start(s)
 	s.eventer.Event("bigslice:sessionStart",
 		"command", command(),
 		"executorType", s.executor.Name(),
 		"parallelism", s.p,
 		"maxLoad", s.maxLoad,
-		"machineCombiners", s.machineCombiners)
+		"machineCombiners", s.machineCombiners,
+		"maxMachines", s.maxMachines)
 	s.tracer = newTracer()
 
 	name := fmt.Sprintf("bigslice-%02d-trace", s.index)
@@ -271,12 +740,46 @@ type execInvocation struct {
 	bigslice.Invocation
 	// Env is the compilation environment
 	Env CompileEnv
+	// Priority is the scheduling priority of the invocation's tasks. See
+	// Priority.
+	Priority int
+	// NumPartition is the number of partitions of the output of each of
+	// the invocation's tasks, if they are explicitly partitioned. See
+	// Partitions.
+	NumPartition int
+
+	// maxTasks and maxDepth, if positive, bound the number of tasks and
+	// the dependency depth of the invocation's compilation. They are
+	// checked only by the driver. See MaxTasks and MaxCompileDepth.
+	maxTasks, maxDepth int
+	// reattach indicates that the invocation's tasks should be
+	// reattached to the outputs recorded by a previous driver. See
+	// Session.Reattach.
+	reattach bool
+	// probes holds the results of the invocation's probe invocations,
+	// keyed by invocation index, which are read by the plans of its
+	// adaptive slices. See CompileEnv.Adaptive.
+	probes map[uint64]*Result
+	// snapshot indicates that the invocation's snapshot slices should
+	// read snapshots captured when it is compiled. See Snapshot.
+	snapshot bool
+	// snapshotted, if not nil, is called with the snapshots captured for
+	// the invocation before it is computed. See Session.RunIncremental.
+	snapshotted func(ctx context.Context, snapshots []interface{}) error
+	// compiled, if not nil, is called with the invocation's tasks once
+	// it is compiled. See Session.RunAsync.
+	compiled func(inv execInvocation, tasks []*Task)
+	// restageFrom is the result of the previous invocation that the
+	// invocation reruns, if it restages a stage. See
+	// CompileEnv.Restage.
+	restageFrom *Result
 }
 
 func makeExecInvocation(inv bigslice.Invocation) execInvocation {
 	return execInvocation{
 		Invocation: inv,
 		Env:        makeCompileEnv(),
+		probes:     make(map[uint64]*Result),
 	}
 }
 
@@ -285,7 +788,7 @@ func makeExecInvocation(inv bigslice.Invocation) execInvocation {
 // consistent.
 var statusMu sync.Mutex
 
-func (s *Session) run(ctx context.Context, calldepth int, funcv *bigslice.FuncValue, args ...interface{}) (*Result, error) {
+func (s *Session) run(ctx context.Context, calldepth int, opts []RunOption, funcv *bigslice.FuncValue, args ...interface{}) (*Result, error) {
 	location := "<unknown>"
 	if _, file, line, ok := runtime.Caller(calldepth + 1); ok {
 		location = fmt.Sprintf("%s:%d", file, line)
@@ -297,6 +800,8 @@ func (s *Session) run(ctx context.Context, calldepth int, funcv *bigslice.FuncVa
 		tasks      []*Task
 		sliceGroup *status.Group
 		taskGroup  *status.Group
+		numTasks   int
+		endStages  func()
 	)
 	// Make invocation and status setup atomic so that status displays in
 	// invocation index order.
@@ -307,7 +812,48 @@ func (s *Session) run(ctx context.Context, calldepth int, funcv *bigslice.FuncVa
 		statusMu.Lock()
 		defer statusMu.Unlock()
 		inv = makeExecInvocation(funcv.Invocation(location, args...))
+		inv.maxTasks, inv.maxDepth = s.maxTasks, s.maxCompileDepth
+		for _, opt := range opts {
+			opt(&inv)
+		}
+		// Options may attribute the invocation to another location.
+		location = inv.Location
 		slice = inv.Invoke()
+		return nil
+	}()
+	if err != nil {
+		return nil, err
+	}
+	// Capture the snapshots and manifests of the invocation's sources,
+	// so that the inputs of adaptive slices, and the invocation itself,
+	// read them.
+	if err = s.snapshot(ctx, &inv, slice); err != nil {
+		return nil, err
+	}
+	if err = manifest(ctx, &inv, slice); err != nil {
+		return nil, err
+	}
+	if s.failEmptySlices {
+		// The shards of sources are determined by their snapshots and
+		// manifests.
+		if err = applySnapshots(inv, slice); err != nil {
+			return nil, err
+		}
+		if err = applyManifests(inv, slice); err != nil {
+			return nil, err
+		}
+		if empty := emptyShards(slice); empty != nil {
+			return nil, errors.E(errors.Invalid, fmt.Sprintf("slice %s has no shards", empty.Name()))
+		}
+	}
+	// Choose the plans of adaptive slices, which requires computing their
+	// inputs, before compiling the invocation.
+	if err = s.adapt(ctx, location, funcv, args, &inv, slice); err != nil {
+		return nil, err
+	}
+	err = func() error {
+		statusMu.Lock()
+		defer statusMu.Unlock()
 		var err error
 		tasks, err = compile(inv, slice, s.machineCombiners)
 		if err != nil {
@@ -316,6 +862,13 @@ func (s *Session) run(ctx context.Context, calldepth int, funcv *bigslice.FuncVa
 		// Freeze the environment to ensure that compilations are consistent
 		// (e.g. across workers).
 		inv.Env.Freeze()
+		numTasks = countTasks(inv, tasks)
+		log.Debug.Printf("%s: invocation %d: compiled %d tasks", location, inv.Index, numTasks)
+		endStages = s.beginStages(ctx, tasks)
+		linkConsumers(tasks)
+		if inv.compiled != nil {
+			inv.compiled(inv, tasks)
+		}
 		// TODO(marius): give a way to provide names for these groups
 		if s.status != nil {
 			// Make the slice status group come before the more granular task
@@ -329,6 +882,9 @@ func (s *Session) run(ctx context.Context, calldepth int, funcv *bigslice.FuncVa
 		}
 		return nil
 	}()
+	if endStages != nil {
+		defer endStages()
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -337,18 +893,89 @@ func (s *Session) run(ctx context.Context, calldepth int, funcv *bigslice.FuncVa
 		defer cancel()
 		go maintainSliceGroup(maintainCtx, tasks, sliceGroup)
 	}
+	if w, ok := s.executor.(warmer); ok && s.warmDepth > 0 {
+		warmCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go maintainWarm(warmCtx, w, tasks, s.warmDepth, s.warmTimeout)
+	}
 	// Register all the tasks so they may be used in visualization.
 	s.mu.Lock()
 	for _, task := range tasks {
 		s.roots[task] = struct{}{}
 	}
 	s.mu.Unlock()
-	return &Result{
-		Slice:    slice,
-		sess:     s,
-		invIndex: inv.Index,
-		tasks:    tasks,
-	}, Eval(ctx, s.executor, tasks, taskGroup)
+	if s.events != nil {
+		_ = iterTasks(tasks, func(task *Task) error {
+			task.Lock()
+			task.events = s.events
+			task.Unlock()
+			return nil
+		})
+	}
+	if inv.reattach {
+		if err = s.reattach(ctx, inv, tasks); err != nil {
+			return nil, err
+		}
+	}
+	if s.statePrefix != "" {
+		stop := s.maintainDriverState(inv, tasks)
+		defer stop()
+	}
+	res := &Result{
+		Slice:        slice,
+		sess:         s,
+		invIndex:     inv.Index,
+		numPartition: inv.NumPartition,
+		snapshots:    inv.Env.Snapshots,
+		tasks:        tasks,
+		numTasks:     numTasks,
+	}
+	s.events.publish(EventInvocation, TaskName{}, "location", location, "index", inv.Index, "state", "start")
+	err = Eval(ctx, s.executor, tasks, taskGroup)
+	if err == nil {
+		err = checkMissingShards(inv, tasks)
+	}
+	if err == nil {
+		err = finalize(ctx, inv, tasks)
+	}
+	if err == nil && s.skewWarnings {
+		s.logSkew(tasks)
+	}
+	if err != nil {
+		s.events.publish(EventInvocation, TaskName{}, "location", location, "index", inv.Index, "state", "done", "error", err.Error())
+	} else {
+		s.events.publish(EventInvocation, TaskName{}, "location", location, "index", inv.Index, "state", "done")
+	}
+	return res, err
+}
+
+// countTasks returns the number of the provided tasks, and their
+// dependencies, that belong to invocation inv.
+func countTasks(inv execInvocation, tasks []*Task) int {
+	var n int
+	_ = iterTasks(tasks, func(task *Task) error {
+		if task.Name.InvIndex == inv.Index {
+			n++
+		}
+		return nil
+	})
+	return n
+}
+
+// checkMissingShards checks that the source slices of invocation inv,
+// computed by the provided tasks, did not skip more than the maximum
+// fraction of their shards permitted by their OnMissingShard pragmas.
+// Only the tasks of inv are considered, as those of previous
+// invocations have already been checked.
+func checkMissingShards(inv execInvocation, tasks []*Task) error {
+	var scope metrics.Scope
+	_ = iterTasks(tasks, func(task *Task) error {
+		if task.Name.InvIndex == inv.Index {
+			scope.Merge(&task.Scope)
+		}
+		return nil
+	})
+	return bigslice.CheckMissingShards(&scope)
 }
 
 // Parallelism returns the desired amount of evaluation parallelism.
@@ -361,12 +988,46 @@ func (s *Session) MaxLoad() float64 {
 	return s.maxLoad
 }
 
+// SetMaxMachines sets the maximum number of machines that may be
+// allocated concurrently by the session. See MaxMachines. Queued tasks
+// are scheduled as soon as the raised cap permits.
+func (s *Session) SetMaxMachines(n int) {
+	if n <= 0 {
+		panic("exec.SetMaxMachines: n <= 0")
+	}
+	s.budget.SetMax(n)
+}
+
+// MachineStats returns a snapshot of the session's machine allocation
+// statistics: "machines" is the number of machines allocated or being
+// started; "maxMachines" is the configured cap (0 if unlimited);
+// "starvedManagers" is the number of machine pools currently waiting
+// for the cap to permit more machines; "starvations" counts the times a
+// pool was denied machines it needed; and "overcommittedMachines"
+// counts the machines granted beyond the cap to guarantee progress. A
+// nonzero "starvedManagers" indicates that the job is machine-starved.
+//
+// Task placement is described by "localityTasks", the number of tasks
+// placed that had locality hints (see bigslice.LocalitySlice), and
+// "localityHits", the number of these that were placed on a preferred
+// machine. Their ratio is the locality hit rate.
+func (s *Session) MachineStats() stats.Values {
+	vals := make(stats.Values)
+	s.budget.stats.AddAll(vals)
+	if b, ok := s.executor.(*bigmachineExecutor); ok {
+		b.managerStats(vals)
+	}
+	return vals
+}
+
 // Shutdown tears down resources associated with this session.
 // It should be called when the session is discarded.
 func (s *Session) Shutdown() {
 	if s.shutdown != nil {
 		s.shutdown()
 	}
+	s.events.close()
+	s.completions.close()
 	if s.tracePath != "" {
 		writeTraceFile(s.tracer, s.tracePath)
 	}
@@ -397,22 +1058,159 @@ func (s *Session) HandleDebug(handler *http.ServeMux) {
 // bigslice.Func.
 type Result struct {
 	bigslice.Slice
-	invIndex  uint64
+	invIndex uint64
+	// numPartition is the number of partitions of the output of each of
+	// the result's tasks, if they are explicitly partitioned.
+	numPartition int
+	// snapshots are the snapshots read by the invocation that computed
+	// the result, if any.
+	snapshots []interface{}
 	sess      *Session
 	tasks     []*Task
+	// numTasks is the number of tasks compiled for the invocation.
+	numTasks  int
 	initScope sync.Once
 	scope     metrics.Scope
+	// partial indicates that the result comprises only the shards that
+	// completed by its deadline; unfinished holds the shards that did
+	// not. See Session.RunWithDeadline.
+	partial    bool
+	unfinished []int
 }
 
 // Scanner returns a scanner that scans the output. If the output contains
-// multiple shards, they are scanned sequentially. You must call Close on the
-// returned scanner when you are done scanning. You may get and scan multiple
-// scanners concurrently from r.
+// multiple shards, they are scanned sequentially, in shard order, so
+// that the rows of a globally sorted output (see
+// bigslice.GloballySorted) are scanned in sorted order. You must call
+// Close on the returned scanner when you are done scanning. You may get
+// and scan multiple scanners concurrently from r.
 func (r *Result) Scanner() *sliceio.Scanner {
 	reader := r.open()
 	return sliceio.NewScanner(r, reader)
 }
 
+// Scanners returns n scanners, each of which scans the entire output of
+// r, as by Scanner. The scanners are independent, and may be used
+// concurrently, e.g., by separate consumers of the output of one
+// expensive computation. Scanners first ensures that the outputs of
+// r's tasks are available, recomputing any that have since been lost or
+// discarded, so that every scanner reads the same materialized task
+// outputs instead of triggering computation of its own. Task outputs
+// are retained only for the lifetime of the session; outputs that are
+// to be shared across sessions should be materialized explicitly (see
+// bigslice.Cache). You must call Close on each of the returned
+// scanners.
+func (r *Result) Scanners(ctx context.Context, n int) ([]*sliceio.Scanner, error) {
+	if n < 0 {
+		return nil, errors.E(errors.Invalid, fmt.Sprintf("scanners: invalid number of scanners %d", n))
+	}
+	if err := Eval(ctx, r.sess.executor, r.tasks, nil); err != nil {
+		return nil, err
+	}
+	scanners := make([]*sliceio.Scanner, n)
+	for i := range scanners {
+		scanners[i] = r.Scanner()
+	}
+	return scanners, nil
+}
+
+// Collect reads the entire output of r into the provided column
+// pointers, which must be pointers to slices of the result's column
+// types. Collect is intended for small results: it fails if the result
+// contains more rows, or more bytes, than the session's collect limits
+// (see CollectLimit and CollectByteLimit).
+//
+// Shards are read sequentially, in the same order as by Scanner, so
+// that the collected rows are sorted if the result is globally sorted.
+func (r *Result) Collect(ctx context.Context, columns ...interface{}) error {
+	if got, want := len(columns), r.NumOut(); got != want {
+		return errors.E(errors.Invalid, fmt.Sprintf("collect: wrong arity: expected %d columns, got %d", want, got))
+	}
+	columnsv := make([]reflect.Value, len(columns))
+	for i := range columns {
+		columnsv[i] = reflect.ValueOf(columns[i])
+		if got, want := columnsv[i].Type(), reflect.PtrTo(reflect.SliceOf(r.Out(i))); got != want {
+			return errors.E(errors.Invalid, fmt.Sprintf("collect: column %d: expected %s, got %s", i, want, got))
+		}
+	}
+	var (
+		reader = r.open()
+		buf    = frame.Make(r, r.sess.chunkSize, r.sess.chunkSize)
+		limit  = r.sess.collectLimit
+		total  int
+		bytes  int64
+	)
+	defer reader.Close()
+	for {
+		n, err := reader.Read(ctx, buf)
+		if err != nil && err != sliceio.EOF {
+			return err
+		}
+		if total += n; total > limit {
+			return errors.E(errors.Invalid, fmt.Sprintf("collect: result exceeds limit of %d rows", limit))
+		}
+		if bytes += frameSize(buf.Slice(0, n)); bytes > r.sess.collectByteLimit {
+			return errors.E(errors.Invalid, fmt.Sprintf("collect: result exceeds limit of %d bytes", r.sess.collectByteLimit))
+		}
+		for i := range columnsv {
+			columnsv[i].Elem().Set(reflect.AppendSlice(columnsv[i].Elem(), buf.Slice(0, n).Value(i)))
+		}
+		if err == sliceio.EOF {
+			return nil
+		}
+	}
+}
+
+// BloomFilter returns a Bloom filter with the provided false positive
+// rate over the keys (prefix columns) of r, for use with
+// bigslice.FilterKeys to prune the other side of a join with r. The
+// filter is built on the driver by reading r. If r has more than
+// maxRows rows, pruning is unlikely to pay off: BloomFilter stops
+// reading and returns a nil filter, for which FilterKeys is a no-op.
+// Joins that need not inspect the filter should instead use
+// bigslice.Join with bigslice.BloomFilterKeys, which builds the filter
+// on the executors and broadcasts it to the join.
+func (r *Result) BloomFilter(ctx context.Context, fpRate float64, maxRows int) (*bloom.Filter, error) {
+	if fpRate <= 0 || fpRate >= 1 {
+		return nil, errors.E(errors.Invalid, fmt.Sprintf("bloomfilter: invalid false positive rate %v", fpRate))
+	}
+	var (
+		reader = r.open()
+		buf    = frame.Make(r, r.sess.chunkSize, r.sess.chunkSize)
+		hashes [][2]uint32
+	)
+	defer reader.Close()
+	for {
+		n, err := reader.Read(ctx, buf)
+		if err != nil && err != sliceio.EOF {
+			return nil, err
+		}
+		if len(hashes)+n > maxRows {
+			return nil, nil
+		}
+		for i := 0; i < n; i++ {
+			h1, h2 := bloom.Hash(buf, i)
+			hashes = append(hashes, [2]uint32{h1, h2})
+		}
+		if err == sliceio.EOF {
+			break
+		}
+	}
+	filter := bloom.New(r, len(hashes), fpRate)
+	for _, h := range hashes {
+		filter.InsertHash(h[0], h[1])
+	}
+	return filter, nil
+}
+
+// Snapshots returns the snapshots read by the snapshot slices of the
+// invocation that computed r, if it was run with Snapshot or
+// AtSnapshots, or nil otherwise. They may be passed to AtSnapshots to
+// read the same data in a later invocation.
+func (r *Result) Snapshots() []interface{} {
+	return r.snapshots
+}
+
 // Scope returns the merged metrics scope for the entire task graph represented
 // by the result r. Scope relies on the local values in the scopes of the task
 // graph, and thus are not precise.
@@ -429,14 +1227,65 @@ func (r *Result) Scope() *metrics.Scope {
 	return &r.scope
 }
 
+// Sorted implements bigslice.SortedSlice, so that results retain the
+// sortedness of their slices when passed to other Funcs.
+func (r *Result) Sorted() bool {
+	s, ok := r.Slice.(bigslice.SortedSlice)
+	return ok && s.Sorted()
+}
+
+// Ordering implements bigslice.OrderedSlice, so that results retain
+// the ordering of their slices when passed to other Funcs.
+func (r *Result) Ordering() (order bigslice.Ordering, global bool) {
+	if o, ok := r.Slice.(bigslice.OrderedSlice); ok {
+		return o.Ordering()
+	}
+	return
+}
+
 func (r *Result) open() sliceio.ReadCloser {
-	readers := make([]sliceio.ReadCloser, len(r.tasks))
-	for i := range readers {
-		readers[i] = r.sess.executor.Reader(r.tasks[i], 0)
+	// Tasks are compiled in shard order, so that shards are read in
+	// order.
+	readers := make([]sliceio.ReadCloser, 0, len(r.tasks))
+	for _, task := range r.tasks {
+		for p := 0; p < task.NumPartition; p++ {
+			readers = append(readers, r.sess.executor.Reader(task, p))
+		}
 	}
 	return sliceio.MultiReader(readers...)
 }
 
+// NumTasks returns the number of tasks that were compiled for the
+// invocation that computed r, not counting the tasks of previous
+// invocations whose results it reused. It may be used to tune shard
+// counts and the session's task limit (see MaxTasks).
+func (r *Result) NumTasks() int { return r.numTasks }
+
+// NumPartition returns the number of partitions in the output of each
+// of r's shards, or 0 if r's invocation was not explicitly partitioned
+// (see Partitions).
+func (r *Result) NumPartition() int { return r.numPartition }
+
+// Partition returns a reader of partition p of r: the rows of every
+// shard of r that were assigned to partition p. Partition is valid only
+// for results of invocations that were explicitly partitioned (see
+// Partitions), so that partitions are computed, and retained, by the
+// evaluation of the invocation. The order of the rows of a partition
+// is unspecified. The caller must close the returned reader.
+func (r *Result) Partition(p int) (sliceio.ReadCloser, error) {
+	if r.numPartition == 0 {
+		return nil, errors.E(errors.Precondition, "partition: result is not partitioned")
+	}
+	if p < 0 || p >= r.numPartition {
+		return nil, errors.E(errors.Invalid, fmt.Sprintf("partition: partition %d out of range [0, %d)", p, r.numPartition))
+	}
+	readers := make([]sliceio.ReadCloser, len(r.tasks))
+	for i, task := range r.tasks {
+		readers[i] = r.sess.executor.Reader(task, p)
+	}
+	return sliceio.MultiReader(readers...), nil
+}
+
 // Discard discards the storage resources held by the subgraph of tasks used to
 // compute r. This should be used to discard results that are no longer needed.
 // If the results are needed by another computation, they will be recomputed.
@@ -6,19 +6,29 @@ package exec
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/grailbio/base/errors"
 	"github.com/grailbio/base/log"
 	"github.com/grailbio/bigmachine/testsystem"
 	"github.com/grailbio/bigslice"
+	"github.com/grailbio/bigslice/bloom"
 	"github.com/grailbio/bigslice/frame"
 	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/slicetype"
+	"github.com/grailbio/testutil"
 	"github.com/grailbio/testutil/assert"
 	"github.com/grailbio/testutil/h"
 )
@@ -102,6 +112,62 @@ func TestSessionIterative(t *testing.T) {
 	}
 }
 
+func TestResultScanners(t *testing.T) {
+	const N, Nshard, Nscan = 1000, 8, 4
+	var nmap int64
+	fn := bigslice.Func(func() bigslice.Slice {
+		slice := bigslice.Const(Nshard, rangeSlice(0, N))
+		return bigslice.Map(slice, func(i int) int {
+			atomic.AddInt64(&nmap, 1)
+			return i
+		})
+	})
+	ctx := context.Background()
+	testSession(t, func(t *testing.T, sess *Session) {
+		atomic.StoreInt64(&nmap, 0)
+		res, err := sess.Run(ctx, fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Discarded outputs are recomputed once, and then shared by all
+		// of the scanners.
+		res.Discard(ctx)
+		scanners, err := res.Scanners(ctx, Nscan)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var (
+			wg   sync.WaitGroup
+			ints = make([][]int, Nscan)
+			errs = make([]error, Nscan)
+		)
+		for i := range scanners {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				defer scanners[i].Close()
+				for x := 0; scanners[i].Scan(ctx, &x); {
+					ints[i] = append(ints[i], x)
+				}
+				errs[i] = scanners[i].Err()
+			}(i)
+		}
+		wg.Wait()
+		for i := range ints {
+			if errs[i] != nil {
+				t.Fatal(errs[i])
+			}
+			sort.Ints(ints[i])
+			if got, want := ints[i], rangeSlice(0, N); !reflect.DeepEqual(got, want) {
+				t.Errorf("scanner %d: got %v, want %v", i, got, want)
+			}
+		}
+		if got, want := atomic.LoadInt64(&nmap), int64(2*N); got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+}
+
 func TestSessionReuse(t *testing.T) {
 	const N = 1000
 	input := bigslice.Func(func() bigslice.Slice {
@@ -126,60 +192,1055 @@ func TestSessionReuse(t *testing.T) {
 	})
 	ctx := context.Background()
 	testSession(t, func(t *testing.T, sess *Session) {
-		atomic.StoreInt64(&nmap, 0)
-		input := sess.Must(ctx, input)
-		mapped := sess.Must(ctx, mapper, input)
-		var wg sync.WaitGroup
-		var reduced *Result
-		wg.Add(1)
+		atomic.StoreInt64(&nmap, 0)
+		input := sess.Must(ctx, input)
+		mapped := sess.Must(ctx, mapper, input)
+		var wg sync.WaitGroup
+		var reduced *Result
+		wg.Add(1)
+		go func() {
+			reduced = sess.Must(ctx, reducer, mapped)
+			wg.Done()
+		}()
+		unmapped := sess.Must(ctx, unmap, mapped)
+		wg.Wait()
+		// The map results were reused:
+		if got, want := atomic.LoadInt64(&nmap), int64(N); got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		// And we computed the correct results:
+		var (
+			f = readFrame(t, reduced, N/2)
+			k = f.Interface(0).([]int)
+			v = f.Interface(1).([]int)
+		)
+		for i := range k {
+			if got, want := v[i], k[i]*4+1; got != want {
+				t.Errorf("index %d: got %v, want %v", i, got, want)
+			}
+		}
+
+		f = readFrame(t, unmapped, N)
+		k = f.Interface(0).([]int)
+		v = f.Interface(1).([]int)
+		for i := range k {
+			if got, want := v[i], k[i]*2; got != want {
+				t.Errorf("index %d: got %v, want %v", i, got, want)
+			}
+		}
+	})
+}
+
+// TestSessionFuncPanic verifies that the session survives a Func that panics
+// on invocation.
+func TestSessionFuncPanic(t *testing.T) {
+	panicker := bigslice.Func(func() bigslice.Slice {
+		panic("panic")
+	})
+	nonPanicker := bigslice.Func(func() bigslice.Slice {
+		return bigslice.Const(1, []int{})
+	})
+	ctx := context.Background()
+	testSession(t, func(t *testing.T, sess *Session) {
+		assert.That(t, func() { _, _ = sess.Run(ctx, panicker) }, h.Panics(h.NotNil()))
+		_, err := sess.Run(ctx, nonPanicker)
+		if err != nil {
+			t.Errorf("session did not survive panic")
+		}
+	})
+}
+
+func TestCollect(t *testing.T) {
+	const N = 1000
+	input := bigslice.Func(func() bigslice.Slice {
+		slice := bigslice.Const(5, rangeSlice(0, N))
+		return bigslice.Map(slice, func(i int) (int, string) { return i, fmt.Sprint(i) })
+	})
+	ctx := context.Background()
+	testSession(t, func(t *testing.T, sess *Session) {
+		res := sess.Must(ctx, input)
+		var (
+			ints    []int
+			strings []string
+		)
+		if err := res.Collect(ctx, &ints, &strings); err != nil {
+			t.Fatal(err)
+		}
+		sort.Ints(ints)
+		if got, want := ints, rangeSlice(0, N); !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if got, want := len(strings), N; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if err := res.Collect(ctx, &ints); err == nil {
+			t.Error("expected arity error")
+		}
+		if err := res.Collect(ctx, &strings, &ints); err == nil {
+			t.Error("expected type error")
+		}
+	})
+
+	sess := Start(Local, CollectLimit(N-1))
+	res := sess.Must(ctx, input)
+	var (
+		ints    []int
+		strings []string
+	)
+	err := res.Collect(ctx, &ints, &strings)
+	if err == nil {
+		t.Fatal("expected limit error")
+	}
+	if !errors.Is(errors.Invalid, err) {
+		t.Errorf("got %v, want invalid error", err)
+	}
+	sess.Shutdown()
+
+	// Each row comprises an int and a string: the fixed sizes of their
+	// values, plus the string's length. The row limit is not exceeded,
+	// so the error must be due to the byte limit.
+	var size int64
+	for i := 0; i < N; i++ {
+		size += 8 + 16 + int64(len(fmt.Sprint(i)))
+	}
+	sess = Start(Local, CollectByteLimit(size-1))
+	defer sess.Shutdown()
+	ints, strings = nil, nil
+	err = sess.Must(ctx, input).Collect(ctx, &ints, &strings)
+	if err == nil {
+		t.Fatal("expected byte limit error")
+	}
+	if !errors.Is(errors.Invalid, err) {
+		t.Errorf("got %v, want invalid error", err)
+	}
+	sess = Start(Local, CollectByteLimit(size))
+	defer sess.Shutdown()
+	ints, strings = nil, nil
+	if err := sess.Must(ctx, input).Collect(ctx, &ints, &strings); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(ints), N; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	var (
+		ctx      = context.Background()
+		newSmall = func() bigslice.Slice {
+			return bigslice.Const(2, []int{3, 500, 999}, []string{"a", "b", "c"})
+		}
+		small = bigslice.Func(newSmall)
+		join  = bigslice.Func(func(filter *bloom.Filter) bigslice.Slice {
+			large := bigslice.Const(5, rangeSlice(0, 1000))
+			large = bigslice.FilterKeys(large, filter)
+			large = bigslice.Map(large, func(i int) (int, int) { return i, 1 })
+			return bigslice.Cogroup(large, newSmall())
+		})
+	)
+	testSession(t, func(t *testing.T, sess *Session) {
+		res := sess.Must(ctx, small)
+		filter, err := res.BloomFilter(ctx, 0.0001, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filter == nil {
+			t.Fatal("expected filter")
+		}
+		joined := sess.Must(ctx, join, filter)
+		var (
+			keys   []int
+			counts [][]int
+			vals   [][]string
+		)
+		if err := joined.Collect(ctx, &keys, &counts, &vals); err != nil {
+			t.Fatal(err)
+		}
+		var matched []int
+		for i := range keys {
+			if len(counts[i]) > 0 && len(vals[i]) > 0 {
+				matched = append(matched, keys[i])
+			}
+		}
+		sort.Ints(matched)
+		if got, want := matched, []int{3, 500, 999}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if got, max := len(keys), 10; got > max {
+			t.Errorf("got %v keys, want <= %v", got, max)
+		}
+
+		filter, err = res.BloomFilter(ctx, 0.0001, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filter != nil {
+			t.Error("expected nil filter")
+		}
+		if _, err := res.BloomFilter(ctx, 1, 100); !errors.Is(errors.Invalid, err) {
+			t.Errorf("got %v, want invalid error", err)
+		}
+	})
+}
+
+// TestMaxMachines verifies that the session's machine cap is applied and
+// can be raised while the session is running.
+func TestMaxMachines(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		fn   = bigslice.Func(func() bigslice.Slice { return bigslice.Const(4, []int{1, 2, 3, 4}) })
+		sess = Start(Bigmachine(testsystem.New()), Parallelism(4), MaxMachines(1))
+	)
+	defer sess.Shutdown()
+	if got, want := sess.MachineStats()["maxMachines"], int64(1); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	sess.Must(ctx, fn)
+	if got, want := sess.MachineStats()["machines"], int64(1); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	sess.SetMaxMachines(2)
+	if got, want := sess.MachineStats()["maxMachines"], int64(2); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestRunPriority(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		fn   = bigslice.Func(func() bigslice.Slice { return bigslice.Const(8, []int{1, 2, 3, 4, 5, 6, 7, 8}) })
+		sess = Start(Bigmachine(testsystem.New()), Parallelism(2), MaxMachines(1))
+	)
+	defer sess.Shutdown()
+	var (
+		wg      sync.WaitGroup
+		results = make([]*Result, 3)
+		errs    = make([]error, 3)
+	)
+	for i := range results {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = sess.RunWithOptions(ctx, []RunOption{Priority(i - 1)}, fn)
+		}()
+	}
+	wg.Wait()
+	for i, result := range results {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		for _, task := range result.tasks {
+			if got, want := task.Invocation.Priority, i-1; got != want {
+				t.Errorf("task %v: got %v, want %v", task, got, want)
+			}
+		}
+		var (
+			scan = result.Scanner()
+			sum  int
+		)
+		for v := 0; scan.Scan(ctx, &v); {
+			sum += v
+		}
+		if err := scan.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := sum, 36; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestPartitions(t *testing.T) {
+	const (
+		N            = 1000
+		numPartition = 7
+	)
+	var (
+		fn = bigslice.Func(func() bigslice.Slice {
+			return bigslice.Const(5, rangeSlice(0, N))
+		})
+		reuse = bigslice.Func(func(slice bigslice.Slice) bigslice.Slice { return slice })
+		ctx   = context.Background()
+	)
+	testSession(t, func(t *testing.T, sess *Session) {
+		res, err := sess.RunWithOptions(ctx, []RunOption{Partitions(numPartition)}, fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := res.NumPartition(), numPartition; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		var all []int
+		for p := 0; p < numPartition; p++ {
+			reader, err := res.Partition(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ints []int
+			err = sliceio.ReadAll(ctx, reader, &ints)
+			reader.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Rows are assigned to partitions by the default partitioner.
+			f := frame.Slices(ints)
+			for i := range ints {
+				if got, want := int(f.Hash(i)%numPartition), p; got != want {
+					t.Errorf("row %d: got partition %v, want %v", ints[i], got, want)
+				}
+			}
+			all = append(all, ints...)
+		}
+		sort.Ints(all)
+		if got, want := all, rangeSlice(0, N); !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		// Scanning reads every partition.
+		var ints []int
+		if err = res.Collect(ctx, &ints); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := len(ints), N; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+
+		if _, err = res.Partition(numPartition); !errors.Is(errors.Invalid, err) {
+			t.Errorf("got %v, want invalid argument", err)
+		}
+		if _, err = sess.Run(ctx, reuse, res); !errors.Is(errors.Invalid, err) {
+			t.Errorf("got %v, want invalid argument reusing partitioned result", err)
+		}
+		res = sess.Must(ctx, fn)
+		if _, err = res.Partition(0); !errors.Is(errors.Precondition, err) {
+			t.Errorf("got %v, want precondition error", err)
+		}
+	})
+}
+
+// versionedGCS is a fake GCS client whose objects keep all of their
+// versions. Generation i of an object is its ith version.
+type versionedGCS struct {
+	mu      sync.Mutex
+	objects map[string][]string
+	// lists counts the calls to ListObjects.
+	lists int
+}
+
+func (v *versionedGCS) put(name, content string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.objects[name] = append(v.objects[name], content)
+}
+
+func (v *versionedGCS) ListObjects(ctx context.Context, bucket, prefix string) ([]bigslice.GCSObject, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.lists++
+	var objects []bigslice.GCSObject
+	for name, versions := range v.objects {
+		if strings.HasPrefix(name, prefix) {
+			objects = append(objects, bigslice.GCSObject{
+				Name:       name,
+				Size:       int64(len(versions[len(versions)-1])),
+				Generation: int64(len(versions)),
+			})
+		}
+	}
+	return objects, nil
+}
+
+func (v *versionedGCS) NewRangeReader(ctx context.Context, bucket, object string, offset, length int64) (io.ReadCloser, error) {
+	v.mu.Lock()
+	generation := int64(len(v.objects[object]))
+	v.mu.Unlock()
+	return v.NewGenerationRangeReader(ctx, bucket, object, generation, offset, length)
+}
+
+func (v *versionedGCS) NewGenerationRangeReader(ctx context.Context, bucket, object string, generation, offset, length int64) (io.ReadCloser, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	versions := v.objects[object]
+	if generation < 1 || generation > int64(len(versions)) {
+		return nil, errors.E(errors.NotExist, fmt.Sprintf("gs://%s/%s#%d", bucket, object, generation))
+	}
+	content := versions[generation-1][offset:]
+	if length >= 0 && int64(len(content)) > length {
+		content = content[:length]
+	}
+	return ioutil.NopCloser(strings.NewReader(content)), nil
+}
+
+func (v *versionedGCS) NewWriter(ctx context.Context, bucket, object string) (io.WriteCloser, error) {
+	return nil, errors.E(errors.NotSupported, "versionedGCS: writes are not supported")
+}
+
+func TestSnapshot(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		client = new(versionedGCS)
+		fn     = bigslice.Func(func(generations bool) bigslice.Slice {
+			var c bigslice.GCSClient = client
+			if !generations {
+				// Hide the client's support for generations.
+				c = struct{ bigslice.GCSClient }{client}
+			}
+			return bigslice.ReadGCS(ctx, c, "bucket", "data/")
+		})
+		lists = func(t *testing.T, want int) {
+			t.Helper()
+			client.mu.Lock()
+			defer client.mu.Unlock()
+			if got := client.lists; got != want {
+				t.Errorf("got %v lists, want %v", got, want)
+			}
+			client.lists = 0
+		}
+		read = func(t *testing.T, res *Result) []string {
+			t.Helper()
+			var (
+				scan  = res.Scanner()
+				line  string
+				lines []string
+			)
+			defer scan.Close()
+			for scan.Scan(ctx, &line) {
+				lines = append(lines, line)
+			}
+			if err := scan.Err(); err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(lines)
+			return lines
+		}
+	)
+	testSession(t, func(t *testing.T, sess *Session) {
+		client.objects = make(map[string][]string)
+		client.lists = 0
+		// Invocations fail when there are no objects.
+		if _, err := sess.Run(ctx, fn, true); !errors.Is(errors.NotExist, err) {
+			t.Errorf("got %v, want not exist error", err)
+		}
+		lists(t, 1)
+		client.put("data/a", "a1\na2\n")
+		client.put("data/b", "b1\n")
+		res, err := sess.RunWithOptions(ctx, []RunOption{Snapshot()}, fn, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"a1", "a2", "b1"}
+		if got := read(t, res); !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		// Objects are listed once, by the driver.
+		lists(t, 1)
+		snapshots := res.Snapshots()
+		if got, want := len(snapshots), 1; got != want {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+
+		// Change the data: invocations at the snapshot read the data as
+		// of the snapshot; others read the current data.
+		client.put("data/a", "a3\n")
+		client.put("data/c", "c1\n")
+		res, err = sess.RunWithOptions(ctx, []RunOption{AtSnapshots(snapshots)}, fn, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := read(t, res); !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		// Objects are not listed by invocations at a snapshot.
+		lists(t, 0)
+		if got, want := res.Snapshots(), snapshots; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		res, err = sess.Run(ctx, fn, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := read(t, res), []string{"a3", "b1", "c1"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		lists(t, 1)
+		if got := res.Snapshots(); got != nil {
+			t.Errorf("got %v, want nil", got)
+		}
+
+		// Sources that cannot provide snapshots fail snapshot invocations.
+		_, err = sess.RunWithOptions(ctx, []RunOption{Snapshot()}, fn, false)
+		if !errors.Is(errors.NotSupported, err) {
+			t.Errorf("got %v, want not supported error", err)
+		}
+		// Snapshots must match the invocation's snapshot slices.
+		_, err = sess.RunWithOptions(ctx, []RunOption{AtSnapshots(nil)}, fn, true)
+		if !errors.Is(errors.Invalid, err) {
+			t.Errorf("got %v, want invalid error", err)
+		}
+	})
+}
+
+func TestEmptySlices(t *testing.T) {
+	empty := func() bigslice.Slice {
+		return bigslice.ReaderFunc(0, func(shard int, state *int, strs []string, ints []int) (int, error) {
+			panic("read from slice without shards")
+		})
+	}
+	var (
+		pipeline = bigslice.Func(func() bigslice.Slice {
+			slice := bigslice.Map(empty(), func(s string, i int) (string, int) { return s, i + 1 })
+			slice = bigslice.Reshard(slice, 4)
+			return bigslice.Reduce(slice, func(a, b int) int { return a + b })
+		})
+		cogroup = bigslice.Func(func() bigslice.Slice {
+			slice := bigslice.Const(2, []string{"a", "b"}, []int{1, 2})
+			return bigslice.Cogroup(slice, empty())
+		})
+		ctx = context.Background()
+	)
+	testSession(t, func(t *testing.T, sess *Session) {
+		res, err := sess.Run(ctx, pipeline)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := res.NumShard(), 4; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		var (
+			strs []string
+			ints []int
+		)
+		if err = res.Collect(ctx, &strs, &ints); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := len(strs), 0; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+
+		res, err = sess.Run(ctx, cogroup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var (
+			a, b []int
+			keys []string
+		)
+		scan := res.Scanner()
+		for key := ""; scan.Scan(ctx, &key, &a, &b); {
+			if len(a) != 1 || len(b) != 0 {
+				t.Errorf("key %s: got %v, %v", key, a, b)
+			}
+			keys = append(keys, key)
+		}
+		if err = scan.Close(); err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(keys)
+		if got, want := keys, []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	sess := Start(Local, FailEmptySlices)
+	if _, err := sess.Run(ctx, pipeline); !errors.Is(errors.Invalid, err) {
+		t.Errorf("got %v, want invalid argument", err)
+	}
+}
+
+func TestShuffleMemory(t *testing.T) {
+	const N = 10000
+	var (
+		ctx = context.Background()
+		fn  = bigslice.Func(func() bigslice.Slice {
+			slice := bigslice.Const(4, rangeSlice(0, N))
+			slice = bigslice.Map(slice, func(i int) (int, int) { return i % 100, i })
+			return bigslice.Cogroup(slice)
+		})
+		// The budget admits only a few chunks of each task's input.
+		sess   = Start(Bigmachine(testsystem.New()), ShuffleMemory(1<<10), ChunkSize(16))
+		before = shuffleSpillBytes.Value()
+	)
+	defer sess.Shutdown()
+	result, err := sess.Run(ctx, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		scan = result.Scanner()
+		key  int
+		vals []int
+		n    int
+	)
+	for scan.Scan(ctx, &key, &vals) {
+		if got, want := len(vals), N/100; got != want {
+			t.Errorf("key %d: got %v, want %v", key, got, want)
+		}
+		for _, v := range vals {
+			if v%100 != key {
+				t.Errorf("key %d: unexpected value %d", key, v)
+			}
+		}
+		n++
+	}
+	if err := scan.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := n, 100; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if shuffleSpillBytes.Value() == before {
+		t.Error("no shuffle data spilled")
+	}
+}
+
+func TestDepReadOrder(t *testing.T) {
+	const N = 1000
+	var (
+		ctx = context.Background()
+		fn  = bigslice.Func(func() bigslice.Slice {
+			return bigslice.Reshard(bigslice.Const(4, rangeSlice(0, N)), 1)
+		})
+	)
+	for _, order := range []ReadOrder{ReadByShard, ReadShuffled, ReadReady} {
+		for name, opt := range map[string]Option{
+			"Local":           Local,
+			"Bigmachine.Test": Bigmachine(testsystem.New()),
+		} {
+			t.Run(fmt.Sprintf("%s/%s", order, name), func(t *testing.T) {
+				sess := Start(opt, DepReadOrder(order), ChunkSize(16))
+				defer sess.Shutdown()
+				var ints []int
+				if err := sess.Must(ctx, fn).Collect(ctx, &ints); err != nil {
+					t.Fatal(err)
+				}
+				// Read by shard, the resharded slice reads the shards of
+				// its dependency in order.
+				if order != ReadByShard {
+					sort.Ints(ints)
+				}
+				if got, want := ints, rangeSlice(0, N); !reflect.DeepEqual(got, want) {
+					t.Errorf("got %v, want %v", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	os.Setenv("BIGSLICETEST_DB_PASSWORD", "secret")
+	defer os.Unsetenv("BIGSLICETEST_DB_PASSWORD")
+	var (
+		ctx = context.Background()
+		fn  = bigslice.Func(func(name string) bigslice.Slice {
+			return bigslice.ReaderFunc(2, func(ctx context.Context, shard int, done *bool, passwords []string) (int, error) {
+				cred, err := bigslice.LookupCredential(ctx, name)
+				if err != nil {
+					return 0, err
+				}
+				passwords[0] = cred["password"]
+				return 1, sliceio.EOF
+			})
+		})
+	)
+	for name, opt := range map[string]Option{
+		"Local":           Local,
+		"Bigmachine.Test": Bigmachine(testsystem.New()),
+	} {
+		t.Run(name, func(t *testing.T) {
+			sess := Start(opt, Credentials(bigslice.EnvCredentials{Prefix: "BIGSLICETEST_"}))
+			defer sess.Shutdown()
+			var passwords []string
+			if err := sess.Must(ctx, fn, "db").Collect(ctx, &passwords); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := passwords, []string{"secret", "secret"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			_, err := sess.Run(ctx, fn, "missing")
+			if err == nil || !strings.Contains(err.Error(), `credential "missing" could not be resolved`) {
+				t.Errorf("got %v, want unresolved credential error", err)
+			}
+		})
+	}
+}
+
+func TestDepReadOrderDefault(t *testing.T) {
+	readOrder := func(opts ...Option) ReadOrder {
+		sess := Start(append([]Option{Bigmachine(testsystem.New())}, opts...)...)
+		defer sess.Shutdown()
+		return sess.executor.(*bigmachineExecutor).worker.ReadOrder
+	}
+	if got, want := readOrder(), ReadByShard; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := readOrder(DepReadOrder(ReadReady)), ReadReady; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	DoShuffleReaders = true
+	defer func() { DoShuffleReaders = false }()
+	if got, want := readOrder(), ReadShuffled; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := readOrder(DepReadOrder(ReadByShard)), ReadByShard; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// chunkSlice returns a slice of n rows over 3 shards, reduced by key,
+// whose source records the largest frame it is asked to fill in max.
+func chunkSlice(n int, max *int64, prags ...bigslice.Pragma) bigslice.Slice {
+	slice := bigslice.ReaderFunc(3, func(shard int, off *int, keys, vals []int) (int, error) {
+		for {
+			m := atomic.LoadInt64(max)
+			if int64(len(keys)) <= m || atomic.CompareAndSwapInt64(max, m, int64(len(keys))) {
+				break
+			}
+		}
+		beg, end := shardRange(n, 3, shard)
+		var i int
+		for ; i < len(keys) && beg+*off < end; i++ {
+			keys[i] = (beg + *off) % 10
+			vals[i] = 1
+			*off++
+		}
+		if beg+*off == end {
+			return i, sliceio.EOF
+		}
+		return i, nil
+	}, prags...)
+	return bigslice.Reduce(slice, func(a, b int) int { return a + b })
+}
+
+func TestChunkSize(t *testing.T) {
+	const N = 1003
+	ctx := context.Background()
+	for name, opt := range executors {
+		for _, c := range []struct {
+			name  string
+			opts  []Option
+			prags []bigslice.Pragma
+			want  int64
+		}{
+			{"default", nil, nil, int64(*defaultChunksize)},
+			{"session", []Option{ChunkSize(7)}, nil, 7},
+			{"pragma", []Option{ChunkSize(7)}, []bigslice.Pragma{bigslice.ChunkSize(13)}, 13},
+		} {
+			t.Run(name+"/"+c.name, func(t *testing.T) {
+				var max int64
+				fn := bigslice.Func(func() bigslice.Slice { return chunkSlice(N, &max, c.prags...) })
+				sess := Start(append([]Option{opt}, c.opts...)...)
+				var keys, counts []int
+				if err := sess.Must(ctx, fn).Collect(ctx, &keys, &counts); err != nil {
+					t.Fatal(err)
+				}
+				var total int
+				for _, count := range counts {
+					total += count
+				}
+				if got, want := len(keys), 10; got != want {
+					t.Errorf("got %v, want %v", got, want)
+				}
+				if got, want := total, N; got != want {
+					t.Errorf("got %v, want %v", got, want)
+				}
+				if got, want := atomic.LoadInt64(&max), c.want; got != want {
+					t.Errorf("got %v, want %v", got, want)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkChunkSize(b *testing.B) {
+	const N = 1 << 20
+	ctx := context.Background()
+	for _, size := range []int{8, 128, 1024, 8192} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			var max int64
+			fn := bigslice.Func(func() bigslice.Slice { return chunkSlice(N, &max) })
+			sess := Start(Local, ChunkSize(size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				sess.Must(ctx, fn)
+			}
+		})
+	}
+}
+
+// TestCancelStage verifies that cancelling a stage fails its tasks
+// without interrupting evaluation of independent tasks.
+func TestConcurrency(t *testing.T) {
+	const Nshard = 16
+	type counter struct{ inflight, max int32 }
+	var counters [2]counter
+	track := func(c *counter) {
+		n := atomic.AddInt32(&c.inflight, 1)
+		for {
+			max := atomic.LoadInt32(&c.max)
+			if n <= max || atomic.CompareAndSwapInt32(&c.max, max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&c.inflight, -1)
+	}
+	fn := bigslice.Func(func() bigslice.Slice {
+		// One row per shard, so that the rows in flight are the tasks in
+		// flight.
+		slice := bigslice.Const(Nshard, rangeSlice(0, Nshard))
+		slice = bigslice.Map(slice, func(i int) int {
+			track(&counters[0])
+			return i
+		}, bigslice.Concurrency(2))
+		slice = bigslice.Reshuffle(slice)
+		return bigslice.Map(slice, func(i int) int {
+			track(&counters[1])
+			return i
+		}, bigslice.Concurrency(3))
+	})
+	ctx := context.Background()
+	testSession(t, func(t *testing.T, sess *Session) {
+		counters = [2]counter{}
+		// Sample the stages' in-flight counts during the evaluation.
+		done := make(chan struct{})
+		maxc := make(chan int64)
 		go func() {
-			reduced = sess.Must(ctx, reducer, mapped)
-			wg.Done()
+			var max int64
+			for {
+				for _, n := range sess.StageStats() {
+					if n > max {
+						max = n
+					}
+				}
+				select {
+				case <-done:
+					maxc <- max
+					return
+				case <-time.After(time.Millisecond):
+				}
+			}
 		}()
-		unmapped := sess.Must(ctx, unmap, mapped)
-		wg.Wait()
-		// The map results were reused:
-		if got, want := atomic.LoadInt64(&nmap), int64(N); got != want {
+		res, err := sess.Run(ctx, fn)
+		close(done)
+		maxInflight := <-maxc
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ints []int
+		if err := res.Collect(ctx, &ints); err != nil {
+			t.Fatal(err)
+		}
+		sort.Ints(ints)
+		if got, want := ints, rangeSlice(0, Nshard); !reflect.DeepEqual(got, want) {
 			t.Errorf("got %v, want %v", got, want)
 		}
-		// And we computed the correct results:
+		for i, limit := range []int32{2, 3} {
+			if got := atomic.LoadInt32(&counters[i].max); got > limit {
+				t.Errorf("stage %d: %d tasks ran concurrently, want at most %d", i, got, limit)
+			}
+		}
+		if maxInflight == 0 || maxInflight > 3 {
+			t.Errorf("got %d tasks in flight, want between 1 and 3", maxInflight)
+		}
+		// Stages are released once the evaluation is done.
+		if stats := sess.StageStats(); len(stats) != 0 {
+			t.Errorf("got stage stats %v after evaluation", stats)
+		}
+	})
+}
+
+func TestCancelStage(t *testing.T) {
+	const N = 100
+	var (
+		ctx     = context.Background()
+		started = make(chan struct{}, N)
+		mapped  int32
+	)
+	fn := bigslice.Func(func() bigslice.Slice {
+		stuck := bigslice.Const(2, rangeSlice(0, N), rangeSlice(0, N))
+		stuck = bigslice.Filter(stuck, func(ctx context.Context, k, v int) bool {
+			started <- struct{}{}
+			<-ctx.Done()
+			return false
+		})
+		independent := bigslice.Const(2, rangeSlice(0, N), rangeSlice(0, N))
+		independent = bigslice.Map(independent, func(k, v int) (int, int) {
+			atomic.AddInt32(&mapped, 1)
+			return k, v
+		})
+		return bigslice.Cogroup(stuck, independent)
+	})
+	sess := Start(Local, Parallelism(4))
+	h := sess.RunAsync(ctx, fn)
+	<-started
+	var stage string
+	sess.mu.Lock()
+	for id := range sess.stages {
+		if strings.Contains(id.op, "filter") {
+			stage = id.op
+		}
+	}
+	sess.mu.Unlock()
+	if stage == "" {
+		t.Fatal("stage not found")
+	}
+	if err := h.CancelStage("nonexistent"); !errors.Is(errors.NotExist, err) {
+		t.Errorf("got %v, want NotExist", err)
+	}
+	if err := h.CancelStage(stage); err != nil {
+		t.Fatal(err)
+	}
+	_, err := h.Wait()
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !errors.Is(errors.Canceled, err) || !strings.Contains(err.Error(), stage) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if got, want := atomic.LoadInt32(&mapped), int32(N); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The stages of the invocation are released once it has been
+	// evaluated, so that the cancellation does not outlive it.
+	sess.mu.Lock()
+	if n := len(sess.stages); n != 0 {
+		t.Errorf("%d stages remain", n)
+	}
+	sess.mu.Unlock()
+	if err := h.CancelStage(stage); !errors.Is(errors.Precondition, err) {
+		t.Errorf("got %v, want Precondition", err)
+	}
+}
+
+// TestConcurrencyCancel verifies that tasks waiting on the concurrency
+// limit of their stage stop waiting once their evaluation's context is
+// done.
+func TestConcurrencyCancel(t *testing.T) {
+	const Nshard = 4
+	var (
+		started = make(chan struct{}, Nshard)
+		done    = make(chan struct{})
+	)
+	defer close(done)
+	fn := bigslice.Func(func() bigslice.Slice {
+		slice := bigslice.Const(Nshard, rangeSlice(0, Nshard))
+		return bigslice.Filter(slice, func(ctx context.Context, i int) bool {
+			select {
+			case started <- struct{}{}:
+			default:
+			}
+			select {
+			case <-ctx.Done():
+			case <-done:
+			}
+			return false
+		}, bigslice.Concurrency(1))
+	})
+	testSession(t, func(t *testing.T, sess *Session) {
 		var (
-			f = readFrame(t, reduced, N/2)
-			k = f.Interface(0).([]int)
-			v = f.Interface(1).([]int)
+			mu    sync.Mutex
+			tasks []*Task
 		)
-		for i := range k {
-			if got, want := v[i], k[i]*4+1; got != want {
-				t.Errorf("index %d: got %v, want %v", i, got, want)
+		opts := []RunOption{func(inv *execInvocation) {
+			inv.compiled = func(_ execInvocation, compiled []*Task) {
+				mu.Lock()
+				tasks = compiled
+				mu.Unlock()
 			}
+		}}
+		ctx, cancel := context.WithCancel(context.Background())
+		errc := make(chan error)
+		go func() {
+			_, err := sess.RunWithOptions(ctx, opts, fn)
+			errc <- err
+		}()
+		<-started
+		cancel()
+		if err := <-errc; err != context.Canceled {
+			t.Errorf("got %v, want %v", err, context.Canceled)
 		}
-
-		f = readFrame(t, unmapped, N)
-		k = f.Interface(0).([]int)
-		v = f.Interface(1).([]int)
-		for i := range k {
-			if got, want := v[i], k[i]*2; got != want {
-				t.Errorf("index %d: got %v, want %v", i, got, want)
+		mu.Lock()
+		defer mu.Unlock()
+		// No task is left waiting on the stage's concurrency limit.
+		deadline := time.Now().Add(10 * time.Second)
+		for _, task := range tasks {
+			for task.State() == TaskWaiting {
+				if time.Now().After(deadline) {
+					t.Fatalf("task %v: still waiting", task)
+				}
+				time.Sleep(time.Millisecond)
 			}
 		}
 	})
 }
 
-// TestSessionFuncPanic verifies that the session survives a Func that panics
-// on invocation.
-func TestSessionFuncPanic(t *testing.T) {
-	panicker := bigslice.Func(func() bigslice.Slice {
-		panic("panic")
-	})
-	nonPanicker := bigslice.Func(func() bigslice.Slice {
-		return bigslice.Const(1, []int{})
+// cleanupState is a ReaderFunc state that counts its instances and
+// closes.
+type cleanupState struct {
+	opened bool
+	closed bool
+}
+
+var cleanupOpens, cleanupCloses int32
+
+func (s *cleanupState) Close() error {
+	if s.closed {
+		panic("closed twice")
+	}
+	s.closed = true
+	atomic.AddInt32(&cleanupCloses, 1)
+	return nil
+}
+
+// TestCleanupCancel verifies that readers are cleaned up when their
+// stage is cancelled.
+func TestCleanupCancel(t *testing.T) {
+	const Nshard = 4
+	fn := bigslice.Func(func() bigslice.Slice {
+		return bigslice.ReaderFunc(Nshard, func(ctx context.Context, shard int, state *cleanupState, x []int) (int, error) {
+			if !state.opened {
+				state.opened = true
+				atomic.AddInt32(&cleanupOpens, 1)
+			}
+			<-ctx.Done()
+			return 0, ctx.Err()
+		})
 	})
-	ctx := context.Background()
 	testSession(t, func(t *testing.T, sess *Session) {
-		assert.That(t, func() { _, _ = sess.Run(ctx, panicker) }, h.Panics(h.NotNil()))
-		_, err := sess.Run(ctx, nonPanicker)
-		if err != nil {
-			t.Errorf("session did not survive panic")
+		atomic.StoreInt32(&cleanupOpens, 0)
+		atomic.StoreInt32(&cleanupCloses, 0)
+		h := sess.RunAsync(context.Background(), fn)
+		for atomic.LoadInt32(&cleanupOpens) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		var stage string
+		sess.mu.Lock()
+		for id := range sess.stages {
+			if strings.Contains(id.op, "reader") {
+				stage = id.op
+			}
+		}
+		sess.mu.Unlock()
+		if stage == "" {
+			t.Fatal("stage not found")
+		}
+		if err := h.CancelStage(stage); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := h.Wait(); !errors.Is(errors.Canceled, err) {
+			t.Fatalf("got %v, want canceled error", err)
+		}
+		// Tasks may complete after Run returns.
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			opens, closes := atomic.LoadInt32(&cleanupOpens), atomic.LoadInt32(&cleanupCloses)
+			if opens == closes {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%d readers opened, but %d closed", opens, closes)
+			}
+			time.Sleep(10 * time.Millisecond)
 		}
 	})
 }
@@ -372,6 +1433,62 @@ var executors = map[string]Option{
 	"Bigmachine.Test": Bigmachine(testsystem.New()),
 }
 
+func TestAdaptiveJoin(t *testing.T) {
+	const N = 100
+	var (
+		ctx    = context.Background()
+		nsmall int64
+		fn     = bigslice.Func(func(threshold int) bigslice.Slice {
+			large := bigslice.Const(5, rangeSlice(0, N), rangeSlice(0, N))
+			small := bigslice.Const(3, rangeSlice(0, N/2))
+			small = bigslice.Map(small, func(i int) (int, string) {
+				atomic.AddInt64(&nsmall, 1)
+				return i * 2, fmt.Sprint(i)
+			})
+			return bigslice.Join(large, small, threshold)
+		})
+	)
+	for _, c := range []struct {
+		threshold int
+		op        string
+	}{
+		{N / 2, "broadcastjoin"},
+		{N/2 - 1, "shufflejoin"},
+	} {
+		testSession(t, func(t *testing.T, sess *Session) {
+			atomic.StoreInt64(&nsmall, 0)
+			res, err := sess.Run(ctx, fn, c.threshold)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := res.tasks[0].Name.Op, c.op; !strings.Contains(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			// The small side is computed only once, to measure it, and is
+			// then read by the join.
+			if got, want := atomic.LoadInt64(&nsmall), int64(N/2); got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			var (
+				keys, values []int
+				strs         []string
+			)
+			if err := res.Collect(ctx, &keys, &values, &strs); err != nil {
+				t.Fatal(err)
+			}
+			sort.Ints(keys)
+			if got, want := len(keys), N/2; got != want {
+				t.Fatalf("got %v, want %v", got, want)
+			}
+			for i, key := range keys {
+				if got, want := key, i*2; got != want {
+					t.Errorf("got %v, want %v", got, want)
+				}
+			}
+		})
+	}
+}
+
 func testSession(t *testing.T, run func(t *testing.T, sess *Session)) {
 	t.Helper()
 	for name, opt := range executors {
@@ -412,3 +1529,332 @@ func readFrame(t *testing.T, res *Result, n int) frame.Frame {
 	}
 	return f.Slice(0, n)
 }
+
+func TestSkew(t *testing.T) {
+	// Shard 2 produces 100 times as many rows as the others.
+	input := bigslice.Func(func() bigslice.Slice {
+		slice := bigslice.ReaderFunc(4, func(shard int, n *int, out []int) (int, error) {
+			total := 10
+			if shard == 2 {
+				total = 1000
+			}
+			var m int
+			for m < len(out) && *n < total {
+				out[m] = 0
+				m++
+				*n++
+			}
+			if *n == total {
+				return m, sliceio.EOF
+			}
+			return m, nil
+		})
+		return bigslice.Reshuffle(slice)
+	})
+	ctx := context.Background()
+	for _, c := range []struct {
+		opts   []Option
+		skewed bool
+	}{
+		{[]Option{Local}, true},
+		{[]Option{Local, SkewThreshold(200)}, false},
+	} {
+		sess := Start(c.opts...)
+		res := sess.Must(ctx, input)
+		var found bool
+		for _, skew := range res.Skew() {
+			if !strings.Contains(skew.Stage, "reader") {
+				continue
+			}
+			found = true
+			if got, want := skew.Skewed, c.skewed; got != want {
+				t.Errorf("%s: got %v, want %v", skew, got, want)
+			}
+			if got, want := skew.Shard, 2; got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			if got, want := skew.MaxRecords, int64(1000); got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			if got, want := skew.MedianRecords, int64(10); got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			// All rows have the same key, so they are all in one
+			// partition.
+			if !strings.Contains(skew.Hint, "100%") {
+				t.Errorf("unexpected hint %q", skew.Hint)
+			}
+		}
+		if !found {
+			t.Errorf("no skew report for reader stage: %v", res.Skew())
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	const N = 10000
+	var (
+		ctx = context.Background()
+		fn  = bigslice.Func(func() bigslice.Slice {
+			slice := bigslice.Const(4, rangeSlice(0, N))
+			slice = bigslice.Map(slice, func(i int) (int, string) { return i % 100, "compressible" })
+			return bigslice.Cogroup(slice)
+		})
+	)
+	// shuffleBytes returns the number of bytes of shuffled task output
+	// of a run of fn.
+	shuffleBytes := func(opts ...Option) int64 {
+		sess := Start(append([]Option{Bigmachine(testsystem.New())}, opts...)...)
+		defer sess.Shutdown()
+		result, err := sess.Run(ctx, fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var (
+			keys []int
+			vals [][]string
+		)
+		if err := result.Collect(ctx, &keys, &vals); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := len(keys), 100; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		for i := range vals {
+			if got, want := len(vals[i]), N/100; got != want {
+				t.Errorf("key %d: got %v, want %v", keys[i], got, want)
+			}
+		}
+		var bytes int64
+		_ = iterTasks(result.tasks, func(task *Task) error {
+			if task.NumPartition > 1 {
+				for _, size := range task.PartitionSizes {
+					bytes += size.Bytes
+				}
+			}
+			return nil
+		})
+		return bytes
+	}
+	uncompressed, compressed := shuffleBytes(), shuffleBytes(Compression("gzip"))
+	if compressed == 0 || compressed >= uncompressed {
+		t.Errorf("compressed %d bytes, uncompressed %d", compressed, uncompressed)
+	}
+}
+
+func TestCompressionUnregistered(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic")
+		}
+	}()
+	Compression("nonexistent")
+}
+
+func TestEncryption(t *testing.T) {
+	const N = 10000
+	var (
+		ctx  = context.Background()
+		keys = sliceio.StaticKeys{
+			Current: "k1",
+			Keys: map[string][]byte{
+				"k1": []byte("0123456789abcdef0123456789abcdef"),
+				"k2": []byte("fedcba9876543210"),
+			},
+		}
+		fn = bigslice.Func(func(prefix string) bigslice.Slice {
+			slice := bigslice.Const(4, rangeSlice(0, N))
+			slice = bigslice.Map(slice, func(i int) (int, string) { return i % 100, "sensitive" })
+			slice = bigslice.Reduce(slice, func(a, b string) string { return a })
+			return bigslice.Checkpoint(ctx, slice, prefix)
+		})
+		readFn = bigslice.Func(func(prefix string) bigslice.Slice {
+			return bigslice.ReadCheckpoint(ctx, prefix, slicetype.New(typeOfInt, typeOfString))
+		})
+	)
+	for name, opt := range map[string]func() Option{
+		"Local":           func() Option { return Local },
+		"Bigmachine.Test": func() Option { return Bigmachine(testsystem.New()) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir, cleanup := testutil.TempDir(t, "", "")
+			defer cleanup()
+			prefix := filepath.Join(dir, "checkpoint")
+			sess := Start(opt(), Compression("gzip"), Encryption(keys))
+			defer sess.Shutdown()
+			var (
+				ints []int
+				strs []string
+			)
+			if err := sess.Must(ctx, fn, prefix).Collect(ctx, &ints, &strs); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := len(ints), 100; got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			paths, err := filepath.Glob(prefix + "-*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var nshard int
+			for _, path := range paths {
+				if strings.HasSuffix(path, ".json") {
+					continue
+				}
+				nshard++
+				p, err := ioutil.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !strings.HasPrefix(string(p), "\x00bscrypt\x02k1") || strings.Contains(string(p), "sensitive") {
+					t.Errorf("%s: checkpoint is not encrypted", path)
+				}
+			}
+			if got, want := nshard, 4; got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+
+			// Once the key is rotated, data encrypted with the previous
+			// key are still read.
+			rotated := keys
+			rotated.Current = "k2"
+			rotatedSess := Start(opt(), Encryption(rotated))
+			defer rotatedSess.Shutdown()
+			ints, strs = nil, nil
+			if err := rotatedSess.Must(ctx, readFn, prefix).Collect(ctx, &ints, &strs); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := len(ints), 100; got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+
+			// Without keys, the checkpoint cannot be read.
+			plainSess := Start(opt())
+			defer plainSess.Shutdown()
+			_, err = plainSess.Run(ctx, readFn, prefix)
+			if err == nil || !strings.Contains(err.Error(), "no key provider") {
+				t.Errorf("got %v, want missing key provider error", err)
+			}
+		})
+	}
+}
+
+func TestEncryptionNil(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic")
+		}
+	}()
+	Encryption(nil)
+}
+
+func TestMaxTasks(t *testing.T) {
+	var (
+		ctx = context.Background()
+		fn  = bigslice.Func(func() bigslice.Slice {
+			slice := bigslice.Const(10, rangeSlice(0, 100))
+			slice = bigslice.Map(slice, func(i int) (int, int) { return i % 3, i })
+			return bigslice.Reduce(slice, func(a, b int) int { return a + b })
+		})
+	)
+	sess := Start(Local, MaxTasks(20))
+	defer sess.Shutdown()
+	res, err := sess.Run(ctx, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.NumTasks(), 20; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Reused results do not count toward the limit.
+	reuse := bigslice.Func(func(slice bigslice.Slice) bigslice.Slice {
+		return bigslice.Map(slice, func(k, v int) int { return v })
+	})
+	if res, err = sess.Run(ctx, reuse, res); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.NumTasks(), 10; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	sess = Start(Local, MaxTasks(19))
+	defer sess.Shutdown()
+	_, err = sess.Run(ctx, fn)
+	if !errors.Is(errors.Invalid, err) {
+		t.Fatalf("expected Invalid error, got %v", err)
+	}
+	if want := "exceed the limit of 19 tasks, with 10 tasks already compiled"; !strings.Contains(err.Error(), want) {
+		t.Errorf("got %v, want %q", err, want)
+	}
+}
+
+func TestMaxCompileDepth(t *testing.T) {
+	var (
+		ctx = context.Background()
+		fn  = bigslice.Func(func(n int) bigslice.Slice {
+			slice := bigslice.Const(1, []int{0})
+			for i := 0; i < n; i++ {
+				slice = bigslice.Reshuffle(slice)
+			}
+			return slice
+		})
+	)
+	sess := Start(Local, MaxCompileDepth(4))
+	defer sess.Shutdown()
+	if _, err := sess.Run(ctx, fn, 3); err != nil {
+		t.Fatal(err)
+	}
+	_, err := sess.Run(ctx, fn, 4)
+	if want := "dependency depth 5 exceeds the limit of 4"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("got %v, want %q", err, want)
+	}
+}
+
+func TestCombinerMemory(t *testing.T) {
+	const N = 100000
+	var (
+		ctx = context.Background()
+		fn  = bigslice.Func(func() bigslice.Slice {
+			slice := bigslice.Const(4, rangeSlice(0, N))
+			slice = bigslice.Map(slice, func(i int) (string, int) { return fmt.Sprint(i % (N / 2)), i })
+			return bigslice.Reduce(slice, func(a, b int) int { return a + b })
+		})
+	)
+	for name, executor := range map[string]func() Option{
+		"Local":           func() Option { return Local },
+		"Bigmachine.Test": func() Option { return Bigmachine(testsystem.New()) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			results := make([]map[string]int, 2)
+			for i, opts := range [][]Option{{executor()}, {executor(), CombinerMemory(1 << 16)}} {
+				sess := Start(opts...)
+				res, err := sess.Run(ctx, fn)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var (
+					keys []string
+					vals []int
+				)
+				if err := res.Collect(ctx, &keys, &vals); err != nil {
+					t.Fatal(err)
+				}
+				results[i] = make(map[string]int)
+				for j := range keys {
+					results[i][keys[j]] = vals[j]
+				}
+				spills := CombinerSpills.Value(res.Scope())
+				if i == 1 && spills == 0 {
+					t.Error("expected spills with memory budget")
+				}
+				sess.Shutdown()
+			}
+			if got, want := len(results[0]), N/2; got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			if !reflect.DeepEqual(results[0], results[1]) {
+				t.Error("results differ with memory budget")
+			}
+		})
+	}
+}
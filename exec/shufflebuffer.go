@@ -0,0 +1,201 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"bufio"
+	"context"
+	"expvar"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync/atomic"
+
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/slicetype"
+	"github.com/grailbio/bigslice/stats"
+)
+
+var shuffleSpillBytes = expvar.NewInt("shufflespillbytes")
+
+// A shuffleBuffer fetches the shuffle partitions read by a task before
+// the task is run, holding them in memory up to a budget, and spilling
+// the remainder to disk. This bounds the memory used by in-flight
+// shuffle data for consumers that read many partitions concurrently,
+// e.g., by merging them, and releases the connections to the machines
+// that produced the partitions as soon as they are fetched.
+type shuffleBuffer struct {
+	// budget is the number of bytes of shuffle data that may be held in
+	// memory; used is the number of bytes currently held, and is
+	// accessed atomically, as buffered data are released as they are
+	// read.
+	budget, used int64
+	chunkSize    int
+	// spilled is incremented by the number of bytes spilled to disk.
+	spilled *stats.Int
+
+	dir   string
+	files []*os.File
+}
+
+// newShuffleBuffer returns a new shuffle buffer with the provided
+// memory budget, in bytes.
+func newShuffleBuffer(budget int64, chunkSize int, spilled *stats.Int) *shuffleBuffer {
+	return &shuffleBuffer{budget: budget, chunkSize: chunkSize, spilled: spilled}
+}
+
+// Buffer reads the partition read by r, of type typ, to completion,
+// and returns a reader of its data. Data are held in memory while the
+// buffer's budget allows; once exceeded, the remainder of the
+// partition is spilled to a file, encrypted if ctx carries a key
+// provider (see sliceio.NewSpillWriter). Partitions are thus read back
+// in their original order. Memory held by the partition is returned to
+// the budget as the returned reader reads past it. If r is an
+// io.Closer, it is closed once the partition has been read, or on
+// error.
+func (b *shuffleBuffer) Buffer(ctx context.Context, typ slicetype.Type, r sliceio.Reader) (sliceio.Reader, error) {
+	if c, ok := r.(io.Closer); ok {
+		defer func() {
+			if err := c.Close(); err != nil {
+				log.Debug.Printf("shuffle buffer: close: %v", err)
+			}
+		}()
+	}
+	var (
+		buffered = new(multiReader)
+		f        *os.File
+		w        *bufio.Writer
+		enc      *sliceio.Encoder
+	)
+	for {
+		in := frame.Make(typ, b.chunkSize, b.chunkSize)
+		n, err := r.Read(ctx, in)
+		if err != nil && err != sliceio.EOF {
+			return nil, err
+		}
+		if n > 0 {
+			in = in.Slice(0, n)
+			if size := frameSize(in); f == nil && atomic.LoadInt64(&b.used)+size <= b.budget {
+				atomic.AddInt64(&b.used, size)
+				buffered.q = append(buffered.q, &releasingReader{sliceio.FrameReader(in), b, size})
+			} else {
+				if f == nil {
+					if f, err = b.create(); err != nil {
+						return nil, err
+					}
+					w = bufio.NewWriter(f)
+					if enc, err = sliceio.NewSpillWriter(ctx, w); err != nil {
+						return nil, err
+					}
+				}
+				if err := enc.Write(ctx, in); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if err == sliceio.EOF {
+			break
+		}
+	}
+	if f == nil {
+		return buffered, nil
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	nspill, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	shuffleSpillBytes.Add(nspill)
+	if b.spilled != nil {
+		b.spilled.Add(nspill)
+	}
+	buffered.q = append(buffered.q, sliceio.NewSpillReader(f))
+	return buffered, nil
+}
+
+// create creates a new spill file.
+func (b *shuffleBuffer) create() (*os.File, error) {
+	if b.dir == "" {
+		dir, err := ioutil.TempDir("", "shuffle-")
+		if err != nil {
+			return nil, err
+		}
+		b.dir = dir
+	}
+	f, err := ioutil.TempFile(b.dir, "spill-")
+	if err != nil {
+		return nil, err
+	}
+	b.files = append(b.files, f)
+	return f, nil
+}
+
+// Cleanup closes and removes the buffer's spill files, and releases
+// its memory.
+func (b *shuffleBuffer) Cleanup() {
+	for _, f := range b.files {
+		_ = f.Close()
+	}
+	b.files = nil
+	atomic.StoreInt64(&b.used, 0)
+	if b.dir == "" {
+		return
+	}
+	if err := os.RemoveAll(b.dir); err != nil {
+		log.Debug.Printf("shuffle buffer: failed to remove %s: %v", b.dir, err)
+	}
+}
+
+// releasingReader reads a frame held in memory by a shuffle buffer,
+// and returns its size to the buffer's budget once it has been read.
+type releasingReader struct {
+	sliceio.Reader
+	b    *shuffleBuffer
+	size int64
+}
+
+func (r *releasingReader) Read(ctx context.Context, out frame.Frame) (int, error) {
+	n, err := r.Reader.Read(ctx, out)
+	if err == sliceio.EOF && r.size > 0 {
+		atomic.AddInt64(&r.b.used, -r.size)
+		r.size = 0
+	}
+	return n, err
+}
+
+// frameSize returns an estimate of the number of bytes of memory used
+// by the values of frame f: the fixed size of each value, plus the
+// lengths of strings and byte slices.
+func frameSize(f frame.Frame) int64 {
+	var size int64
+	for col := 0; col < f.NumOut(); col++ {
+		typ := f.Out(col)
+		size += int64(f.Len()) * int64(typ.Size())
+		switch {
+		case typ.Kind() == reflect.String:
+			v := f.Value(col)
+			for i := 0; i < f.Len(); i++ {
+				size += int64(v.Index(i).Len())
+			}
+		case typ.Kind() == reflect.Slice && typ.Elem().Kind() == reflect.Uint8:
+			v := f.Value(col)
+			for i := 0; i < f.Len(); i++ {
+				size += int64(v.Index(i).Len())
+			}
+		}
+	}
+	return size
+}
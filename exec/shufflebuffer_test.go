@@ -0,0 +1,95 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/stats"
+)
+
+func TestShuffleBuffer(t *testing.T) {
+	const N = 1000
+	var (
+		ctx     = context.Background()
+		spilled = stats.NewMap().Int("spilled")
+		keys    = make([]string, N)
+		vals    = rangeSlice(0, N)
+	)
+	for i := range keys {
+		keys[i] = fmt.Sprint(i)
+	}
+	for _, budget := range []int64{0, 1 << 10, 1 << 20} {
+		spilled.Set(0)
+		b := newShuffleBuffer(budget, 64, spilled)
+		in := frame.Slices(keys, vals)
+		var readers []sliceio.Reader
+		for i := 0; i < 3; i++ {
+			r, err := b.Buffer(ctx, in, sliceio.FrameReader(in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			readers = append(readers, r)
+		}
+		for _, r := range readers {
+			var (
+				gotKeys []string
+				gotVals []int
+			)
+			if err := sliceio.ReadAll(ctx, r, &gotKeys, &gotVals); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(gotKeys, keys) || !reflect.DeepEqual(gotVals, vals) {
+				t.Errorf("budget %d: partition data mismatch", budget)
+			}
+		}
+		if got, want := spilled.Get() > 0, budget < 1<<20; got != want {
+			t.Errorf("budget %d: got %v, want %v", budget, got, want)
+		}
+		if got, want := atomic.LoadInt64(&b.used), int64(0); got != want {
+			t.Errorf("budget %d: got %v, want %v", budget, got, want)
+		}
+		b.Cleanup()
+	}
+}
+
+// closeReader is a reader that records whether it was closed.
+type closeReader struct {
+	sliceio.Reader
+	closed bool
+}
+
+func (r *closeReader) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestShuffleBufferClose(t *testing.T) {
+	ctx := context.Background()
+	b := newShuffleBuffer(1<<20, 64, nil)
+	defer b.Cleanup()
+	in := frame.Slices(rangeSlice(0, 100))
+	r := &closeReader{Reader: sliceio.FrameReader(in)}
+	if _, err := b.Buffer(ctx, in, r); err != nil {
+		t.Fatal(err)
+	}
+	if !r.closed {
+		t.Error("reader not closed")
+	}
+	r = &closeReader{Reader: sliceio.ErrReader(errors.New("read error"))}
+	if _, err := b.Buffer(ctx, in, r); err == nil {
+		t.Error("expected error")
+	}
+	if !r.closed {
+		t.Error("reader not closed on error")
+	}
+}
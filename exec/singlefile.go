@@ -0,0 +1,141 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/slicefunc"
+	"github.com/grailbio/bigslice/sliceio"
+)
+
+var (
+	typeOfWriter = reflect.TypeOf((*io.Writer)(nil)).Elem()
+	typeOfError  = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// A SingleFileOption configures WriteSingleFile.
+type SingleFileOption func(*singleFileOptions)
+
+type singleFileOptions struct {
+	header, footer func(w io.Writer) error
+}
+
+// SingleFileHeader returns an option that writes a header, such as the
+// column names of a CSV file, to the beginning of the file written by
+// WriteSingleFile. The header is written exactly once, even if the
+// result is empty.
+func SingleFileHeader(header func(w io.Writer) error) SingleFileOption {
+	return func(o *singleFileOptions) {
+		o.header = header
+	}
+}
+
+// SingleFileFooter returns an option that writes a footer, such as the
+// closing bracket of a JSON array, to the end of the file written by
+// WriteSingleFile.
+func SingleFileFooter(footer func(w io.Writer) error) SingleFileOption {
+	return func(o *singleFileOptions) {
+		o.footer = footer
+	}
+}
+
+// WriteSingleFile writes the rows of every shard of r into the single
+// file at path. The provided write function has the same form as that
+// of bigslice.WriteFiles:
+//
+//	func(w io.Writer, col1 []col1Type, col2 []col2Type, ..., colN []colNType) error
+//
+// and is invoked with successive chunks of rows. Shards are read
+// sequentially in shard index order (and, for partitioned results,
+// partition order within each shard), so that the rows of a globally
+// sorted result (see bigslice.GloballySorted) are written in sorted
+// order. Rows are streamed from the shards' stored outputs to the file
+// one chunk at a time, and are never materialized in memory in full.
+//
+// Framing that must appear once per file, rather than once per shard,
+// is written by the SingleFileHeader and SingleFileFooter options.
+//
+// WriteSingleFile is performed by the driver, which reads every row of
+// r; the final write is thus serialized, and WriteSingleFile is
+// intended for modest outputs. Larger outputs should be written in
+// parallel by bigslice.WriteFiles. The file is created with
+// file.Create, and is discarded if the write fails, so that, as with
+// other files written by file.Create, readers do not observe a
+// partially written file.
+func (r *Result) WriteSingleFile(ctx context.Context, path string, write interface{}, opts ...SingleFileOption) error {
+	fn, ok := slicefunc.Of(write)
+	if !ok || fn.In.NumOut() != 1+r.NumOut() || fn.In.Out(0) != typeOfWriter ||
+		fn.Out.NumOut() != 1 || fn.Out.Out(0) != typeOfError {
+		return errors.E(errors.Invalid, fmt.Sprintf("writesinglefile: invalid write function type %T", write))
+	}
+	for i := 0; i < r.NumOut(); i++ {
+		if got, want := fn.In.Out(i+1), reflect.SliceOf(r.Out(i)); got != want {
+			return errors.E(errors.Invalid, fmt.Sprintf("writesinglefile: column %d: expected %s, got %s", i, want, got))
+		}
+	}
+	var o singleFileOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	f, err := file.Create(ctx, path)
+	if err != nil {
+		return err
+	}
+	if err = r.writeSingleFile(ctx, f.Writer(ctx), fn, o); err != nil {
+		f.Discard(ctx)
+		return err
+	}
+	return f.Close(ctx)
+}
+
+// writeSingleFile writes the rows of r, in shard order, to w, framed by
+// the header and footer in o.
+func (r *Result) writeSingleFile(ctx context.Context, w io.Writer, fn slicefunc.Func, o singleFileOptions) error {
+	if o.header != nil {
+		if err := o.header(w); err != nil {
+			return err
+		}
+	}
+	tasks := append([]*Task(nil), r.tasks...)
+	sort.SliceStable(tasks, func(i, j int) bool {
+		return tasks[i].Name.Shard < tasks[j].Name.Shard
+	})
+	readers := make([]sliceio.ReadCloser, 0, len(tasks))
+	for _, task := range tasks {
+		for p := 0; p < task.NumPartition; p++ {
+			readers = append(readers, r.sess.executor.Reader(task, p))
+		}
+	}
+	reader := sliceio.MultiReader(readers...)
+	defer reader.Close()
+	buf := frame.Make(r, r.sess.chunkSize, r.sess.chunkSize)
+	for {
+		n, err := reader.Read(ctx, buf)
+		if err != nil && err != sliceio.EOF {
+			return err
+		}
+		if n > 0 {
+			args := append([]reflect.Value{reflect.ValueOf(w)}, buf.Slice(0, n).Values()...)
+			if e := fn.Call(ctx, args)[0].Interface(); e != nil {
+				return e.(error)
+			}
+		}
+		if err == sliceio.EOF {
+			break
+		}
+	}
+	if o.footer != nil {
+		return o.footer(w)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/bigslice"
+	"github.com/grailbio/testutil"
+)
+
+func TestWriteSingleFile(t *testing.T) {
+	const N = 1000
+	input := bigslice.Func(func() bigslice.Slice {
+		slice := bigslice.Const(5, rangeSlice(0, N))
+		return bigslice.Map(slice, func(i int) (int, string) { return i, fmt.Sprint(i) })
+	})
+	ctx := context.Background()
+	testSession(t, func(t *testing.T, sess *Session) {
+		dir, cleanup := testutil.TempDir(t, "", "")
+		defer cleanup()
+		res := sess.Must(ctx, input)
+		path := filepath.Join(dir, "out.csv")
+		err := res.WriteSingleFile(ctx, path,
+			func(w io.Writer, ints []int, strs []string) error {
+				for i := range ints {
+					if _, err := fmt.Fprintf(w, "%d,%s\n", ints[i], strs[i]); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			SingleFileHeader(func(w io.Writer) error {
+				_, err := io.WriteString(w, "int,str\n")
+				return err
+			}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSuffix(string(p), "\n"), "\n")
+		if got, want := len(lines), N+1; got != want {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+		if got, want := lines[0], "int,str"; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		// Shards are written in shard order, and each shard of Const is
+		// a contiguous range.
+		for i, line := range lines[1:] {
+			if got, want := line, fmt.Sprintf("%d,%d", i, i); got != want {
+				t.Fatalf("line %d: got %v, want %v", i+1, got, want)
+			}
+		}
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := len(infos), 1; got != want {
+			t.Errorf("got %v files, want %v", got, want)
+		}
+	})
+}
+
+func TestWriteSingleFileTypeError(t *testing.T) {
+	input := bigslice.Func(func() bigslice.Slice {
+		return bigslice.Const(2, []int{1, 2, 3})
+	})
+	ctx := context.Background()
+	sess := Start(Local)
+	res := sess.Must(ctx, input)
+	path := filepath.Join(os.TempDir(), "never-written")
+	if err := res.WriteSingleFile(ctx, path, func(w io.Writer, strs []string) error { return nil }); err == nil {
+		t.Error("expected type error")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected file not to exist, got %v", err)
+	}
+}
+
+func TestWriteSingleFileError(t *testing.T) {
+	input := bigslice.Func(func() bigslice.Slice {
+		return bigslice.Const(2, []int{1, 2, 3})
+	})
+	ctx := context.Background()
+	sess := Start(Local)
+	res := sess.Must(ctx, input)
+	dir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	path := filepath.Join(dir, "out")
+	err := res.WriteSingleFile(ctx, path, func(w io.Writer, ints []int) error {
+		if _, err := fmt.Fprintln(w, ints); err != nil {
+			return err
+		}
+		return fmt.Errorf("write failed")
+	})
+	if err == nil || !strings.Contains(err.Error(), "write failed") {
+		t.Errorf("got %v, want write error", err)
+	}
+	// The partially written file is discarded.
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(infos), 0; got != want {
+		t.Errorf("got %v files, want %v", got, want)
+	}
+}
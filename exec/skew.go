@@ -0,0 +1,209 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/grailbio/base/log"
+)
+
+// defaultSkewThreshold is the default ratio of a stage's largest task
+// output to its median task output above which the stage is considered
+// skewed. See SkewThreshold.
+const defaultSkewThreshold = 4
+
+// SkewThreshold configures the ratio of the output size of a stage's
+// largest task to that of its median task above which the stage is
+// reported as skewed by Result.Skew. The default threshold is 4.
+func SkewThreshold(ratio float64) Option {
+	if ratio <= 1 {
+		panic("exec.SkewThreshold: ratio <= 1")
+	}
+	return func(s *Session) {
+		s.skewThreshold = ratio
+	}
+}
+
+// SkewWarnings is a session option that logs a warning for every
+// skewed stage (see Result.Skew) once the invocation that computes it
+// has completed.
+var SkewWarnings Option = func(s *Session) {
+	s.skewWarnings = true
+}
+
+// StageSkew describes the balance of the outputs of the tasks of a
+// stage; i.e., all tasks with the same TaskName.Op.
+type StageSkew struct {
+	// Stage is the name of the stage, as displayed in the session's
+	// status.
+	Stage string
+	// NumTask is the number of tasks of the stage whose outputs were
+	// measured.
+	NumTask int
+	// MaxRecords and MedianRecords are the largest and median number of
+	// records output by a task of the stage.
+	MaxRecords, MedianRecords int64
+	// MaxBytes and MedianBytes are the largest and median number of
+	// bytes output by a task of the stage. They are 0 if the executor
+	// does not encode task outputs (e.g., the local executor).
+	MaxBytes, MedianBytes int64
+	// Ratio is the ratio of the largest to the median task output,
+	// measured in bytes when available, and in records otherwise.
+	Ratio float64
+	// Shard is the shard index of the task with the largest output.
+	Shard int
+	// Skewed tells whether Ratio exceeds the session's skew threshold.
+	Skewed bool
+	// Hint describes the distribution of the largest task's output
+	// among its partitions, when the task's output is partitioned by
+	// key for a shuffle: a single dominant partition suggests a hot
+	// key. It is empty otherwise.
+	Hint string
+}
+
+// String returns a one-line description of the stage's skew.
+func (s StageSkew) String() string {
+	str := fmt.Sprintf("stage %s: shard %d of %d output %d records (median %d)",
+		s.Stage, s.Shard, s.NumTask, s.MaxRecords, s.MedianRecords)
+	if s.MaxBytes > 0 {
+		str += fmt.Sprintf(", %d bytes (median %d)", s.MaxBytes, s.MedianBytes)
+	}
+	str += fmt.Sprintf(": max/median ratio %.1f", s.Ratio)
+	if s.Hint != "" {
+		str += "; " + s.Hint
+	}
+	return str
+}
+
+// Skew returns a skew report for each stage of the task graph that
+// computed r, derived from the measured output sizes of the stage's
+// tasks, ordered by stage name. Stages with fewer than two measured
+// tasks are omitted. A stage is skewed when the output of its largest
+// task exceeds that of its median task by more than the session's
+// skew threshold (see SkewThreshold); skew may be remedied by salting
+// hot keys or rebalancing partitions (see Rebalance).
+func (r *Result) Skew() []StageSkew {
+	return skewReport(r.tasks, r.sess.skewThreshold)
+}
+
+// skewReport computes the skew of the stages of the task graph rooted
+// at tasks, given the provided threshold.
+func skewReport(tasks []*Task, threshold float64) []StageSkew {
+	if threshold <= 0 {
+		threshold = defaultSkewThreshold
+	}
+	type measured struct {
+		shard int
+		sizes []PartitionSize
+	}
+	stages := make(map[TaskName][]measured)
+	_ = iterTasks(tasks, func(task *Task) error {
+		task.Lock()
+		sizes := task.PartitionSizes
+		task.Unlock()
+		if len(sizes) == 0 {
+			return nil
+		}
+		key := TaskName{InvIndex: task.Name.InvIndex, Op: task.Name.Op}
+		stages[key] = append(stages[key], measured{task.Name.Shard, sizes})
+		return nil
+	})
+	var report []StageSkew
+	for key, ms := range stages {
+		if len(ms) < 2 {
+			continue
+		}
+		var (
+			records = make([]int64, len(ms))
+			bytes   = make([]int64, len(ms))
+			byBytes bool
+		)
+		for i, m := range ms {
+			for _, size := range m.sizes {
+				records[i] += size.Records
+				bytes[i] += size.Bytes
+			}
+			if bytes[i] > 0 {
+				byBytes = true
+			}
+		}
+		weights := records
+		if byBytes {
+			weights = bytes
+		}
+		var max int
+		for i := range weights {
+			if weights[i] > weights[max] {
+				max = i
+			}
+		}
+		skew := StageSkew{
+			Stage:         key.Op,
+			NumTask:       len(ms),
+			MaxRecords:    records[max],
+			MedianRecords: median(records),
+			MaxBytes:      bytes[max],
+			MedianBytes:   median(bytes),
+			Shard:         ms[max].shard,
+			Hint:          partitionHint(ms[max].sizes, byBytes),
+		}
+		med := median(weights)
+		if med < 1 {
+			med = 1
+		}
+		skew.Ratio = float64(weights[max]) / float64(med)
+		skew.Skewed = skew.Ratio > threshold
+		report = append(report, skew)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		return report[i].Stage < report[j].Stage
+	})
+	return report
+}
+
+// median returns the median of the provided values.
+func median(vals []int64) int64 {
+	vals = append([]int64(nil), vals...)
+	sort.Slice(vals, func(i, j int) bool { return vals[i] < vals[j] })
+	return vals[len(vals)/2]
+}
+
+// partitionHint describes the distribution of a task's output among its
+// partitions, or returns an empty string if its output is not
+// partitioned.
+func partitionHint(sizes []PartitionSize, byBytes bool) string {
+	if len(sizes) < 2 {
+		return ""
+	}
+	var total, largest int64
+	var p int
+	for i, size := range sizes {
+		w := size.Records
+		if byBytes {
+			w = size.Bytes
+		}
+		total += w
+		if w > largest {
+			largest, p = w, i
+		}
+	}
+	if total == 0 {
+		return ""
+	}
+	return fmt.Sprintf("partition %d of %d holds %.0f%% of the shard's output",
+		p, len(sizes), 100*float64(largest)/float64(total))
+}
+
+// logSkew logs a warning for each skewed stage of the task graph rooted
+// at tasks.
+func (s *Session) logSkew(tasks []*Task) {
+	for _, skew := range skewReport(tasks, s.skewThreshold) {
+		if skew.Skewed {
+			log.Printf("warning: skewed %s", skew)
+		}
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"container/heap"
 	"context"
 	"fmt"
+	"net/url"
+	"sort"
 	"sync"
 	"time"
 
@@ -15,6 +17,7 @@ import (
 	"github.com/grailbio/base/data"
 	"github.com/grailbio/base/errors"
 	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/retry"
 	"github.com/grailbio/base/status"
 	"github.com/grailbio/base/sync/once"
 	"github.com/grailbio/bigmachine"
@@ -31,6 +34,15 @@ var ProbationTimeout = 30 * time.Second
 // may be started in one batch.
 const maxStartMachines = 10
 
+// provisionCoalesce is the interval for which a machine manager defers
+// provisioning once it needs machines, so that simultaneous requests
+// for machines are coalesced into a single provisioning request.
+var provisionCoalesce = 100 * time.Millisecond
+
+// defaultProvisionPolicy is the default retry policy for machine
+// provisioning requests that fail with temporary errors.
+var defaultProvisionPolicy = retry.Jitter(retry.Backoff(time.Second, time.Minute, 2), 0.5)
+
 // MachineHealth is the overall assessment of machine health by
 // the bigmachine executor.
 type machineHealth int
@@ -68,6 +80,12 @@ type sliceMachine struct {
 	// health is managed by the machineManager.
 	health machineHealth
 
+	// used indicates whether the machine has been offered to any task;
+	// released indicates that the machine was stopped by the
+	// machineManager because it was warmed but unused (see
+	// machineManager.Warm). Both are managed by the machineManager.
+	used, released bool
+
 	// lastFailure is managed by the machineManager.
 	lastFailure time.Time
 
@@ -105,12 +123,45 @@ func (s *sliceMachine) String() string {
 	return fmt.Sprintf("%s (%s)", s.Addr, health)
 }
 
+// hasLocality returns whether the machine is one of the provided
+// locations, given as machine addresses or host names.
+func (s *sliceMachine) hasLocality(hints []string) bool {
+	var host string
+	if u, err := url.Parse(s.Addr); err == nil {
+		host = u.Hostname()
+	}
+	for _, hint := range hints {
+		if hint == s.Addr || hint == host {
+			return true
+		}
+	}
+	return false
+}
+
 // Done returns procs on the machine, and reports any error observed while
 // running tasks.
 func (s *sliceMachine) Done(procs int, err error) {
 	s.donec <- machineDone{s, procs, err}
 }
 
+// idle tells whether the machine may be released: no tasks are
+// running on it, and none of the outputs it holds may still be read.
+// Idle is managed by the machineManager.
+func (s *sliceMachine) idle() bool {
+	if s.taskProcs > 0 {
+		return false
+	}
+	s.mu.Lock()
+	tasks := s.tasks
+	s.mu.Unlock()
+	for _, task := range tasks {
+		if task.outputNeeded() {
+			return false
+		}
+	}
+	return true
+}
+
 // Assign assigns the provided task to this machine. If the machine
 // fails, its assigned tasks are marked LOST.
 func (s *sliceMachine) Assign(task *Task) {
@@ -345,20 +396,46 @@ type machineManager struct {
 	// tasks, taking into account max load.
 	machprocs int
 	worker    *worker
+	// budget caps the number of machines that may be started by the
+	// manager, shared with the session's other managers. A nil budget is
+	// unlimited.
+	budget *machineBudget
 	// schedQ is the priority queue of scheduling requests, which determines the
 	// order in which requests are satisfied. See Offer.
 	schedQ   scheduleRequestQ
 	schedc   chan scheduleRequest
 	unschedc chan scheduleRequest
+	// warmc receives requests to warm the cluster. See Warm.
+	warmc chan warmRequest
+
+	// provisionPolicy is the retry policy for provisioning requests that
+	// fail with temporary errors.
+	provisionPolicy retry.Policy
+
+	stats *stats.Map
+	// localityTasks is the number of scheduling requests with locality
+	// hints that have been serviced; localityHits is the number of
+	// these that were serviced by a preferred machine.
+	localityTasks, localityHits *stats.Int
+	// provisionRetries is the number of provisioning requests that have
+	// been retried after failing with a temporary error.
+	provisionRetries *stats.Int
+	// warmedProcs is the number of procs requested by warm requests;
+	// warmReleased is the number of warmed machines that were released
+	// without having been used.
+	warmedProcs, warmReleased *stats.Int
+	// events publishes the manager's machine events, or is nil.
+	events *eventBus
 }
 
 // NewMachineManager returns a new machineManager paramterized by the
 // provided arguments. Maxp determines the maximum number of procs
 // that may be allocated, maxLoad determines the maximum fraction of
-// machine procs that may be allocated to user work.
+// machine procs that may be allocated to user work, and budget (which
+// may be nil) caps the number of machines that may be started.
 //
 // The cluster is not managed until machineManager.Do is called by the user.
-func newMachineManager(b *bigmachine.B, params []bigmachine.Param, group *status.Group, maxp int, maxLoad float64, worker *worker) *machineManager {
+func newMachineManager(b *bigmachine.B, params []bigmachine.Param, group *status.Group, maxp int, maxLoad float64, budget *machineBudget, worker *worker) *machineManager {
 	// Adjust maxLoad so that we are guaranteed at least one proc per
 	// machine; otherwise we can get stuck in nasty deadlocks. We also
 	// adjust maxp in this case to account for the fact, when maxLoad=0,
@@ -378,29 +455,80 @@ func newMachineManager(b *bigmachine.B, params []bigmachine.Param, group *status
 		machprocs = 1
 		maxp = (maxp + maxprocs - 1) / maxprocs
 	}
-	return &machineManager{
+	m := &machineManager{
 		b:         b,
 		params:    params,
 		group:     group,
 		maxp:      maxp,
 		machprocs: machprocs,
 		worker:    worker,
+		budget:    budget,
 		schedc:    make(chan scheduleRequest),
 		unschedc:  make(chan scheduleRequest),
+		warmc:     make(chan warmRequest),
+
+		provisionPolicy: defaultProvisionPolicy,
+
+		stats: stats.NewMap(),
+	}
+	m.localityTasks = m.stats.Int("localityTasks")
+	m.localityHits = m.stats.Int("localityHits")
+	m.provisionRetries = m.stats.Int("provisionRetries")
+	m.warmedProcs = m.stats.Int("warmedProcs")
+	m.warmReleased = m.stats.Int("warmReleased")
+	return m
+}
+
+// A warmRequest asks a machineManager to maintain capacity for procs
+// procs until the request expires.
+type warmRequest struct {
+	procs   int
+	expires time.Time
+}
+
+// Warm asks m to provision machines with capacity for the provided
+// number of procs ahead of the requests that will use them, e.g.,
+// those of an upcoming stage with many tasks, so that the requests do
+// not wait for machines to be provisioned. Warm does not wait for the
+// machines. The capacity counts toward the capacity needed by m until
+// the provided timeout expires; machines that were started, but have
+// not been used, by then are stopped, unless they are needed by other
+// requests. Warm requests do not add to each other's capacity, or to
+// that needed by pending requests, but are satisfied together: m
+// provisions the largest of the capacity needed by pending requests
+// and the total capacity requested by unexpired warm requests.
+func (m *machineManager) Warm(procs int, timeout time.Duration) {
+	if procs <= 0 {
+		return
 	}
+	m.warmc <- warmRequest{procs, time.Now().Add(timeout)}
 }
 
-// Offer asks m to offer a machine on which to run work with the given priority
-// and number of procs. When m schedules the request, the machine is sent to the
+// Offer asks m to offer a machine on which to run work with the given
+// invocation priority class, priority, and number of procs. Requests
+// with higher classes are serviced first; within a class, requests with
+// lower priority values are serviced first. Requests that wait behind
+// requests of higher classes are aged (see priorityAging) so that they
+// are eventually serviced. When m schedules the request, the machine is sent to the
 // returned channel. The second return value is a function that cancels the
 // request when called. If the request has already been serviced (i.e. a machine
 // has already been delivered), calling the cancel function is a no-op.
-func (m *machineManager) Offer(priority, procs int) (<-chan *sliceMachine, func()) {
+//
+// Tags is the metadata of the work (see Task.Tags); it is logged when
+// the request is placed. Hints are the preferred locations (machine
+// addresses or host names) of the work. The request is serviced by a
+// preferred machine if one has capacity, and otherwise by any machine.
+func (m *machineManager) Offer(class, priority, procs int, tags map[string]string, hints ...string) (<-chan *sliceMachine, func()) {
 	machc := make(chan *sliceMachine)
 	s := scheduleRequest{
-		procs:    procs,
+		class:    class,
+		boost:    class,
 		priority: priority,
+		procs:    procs,
+		tags:     tags,
+		hints:    hints,
 		machc:    machc,
+		queued:   time.Now(),
 	}
 	m.schedc <- s
 	cancel := func() {
@@ -427,11 +555,43 @@ func (m *machineManager) Do(ctx context.Context) {
 		machines       []*sliceMachine
 		probation      machineFailureQ
 		probationTimer timer
+		// classes counts the queued scheduling requests of each class;
+		// queued requests are aged by agingTimer only while there is more
+		// than one class.
+		classes    = make(map[int]int)
+		agingTimer timer
 		// We track consecutive failures to start machines as a heuristic to
 		// decide that there might be a systematic problem preventing machines
 		// from starting.
 		consecutiveStartFailures int
+		// held is the number of machines (allocated or pending) that
+		// have been acquired from the budget.
+		held int
+		// starved indicates whether the manager is waiting for budget;
+		// budgetc is closed when budget may have become available.
+		starved bool
+		budgetc <-chan struct{}
+		// reclaimc is closed when the manager should release its idle
+		// machines to other, starved, managers.
+		reclaimc = m.budget.Reclaim()
+		// coalesceTimer expires when the manager should provision the
+		// machines it needs; coalesced is set in the loop iteration in
+		// which it does.
+		coalesceTimer timer
+		coalesced     bool
+		// warms are the unexpired warm requests, and warm is the total
+		// number of procs that they request; warmTimer expires when the
+		// first of them does.
+		warms     []warmRequest
+		warm      int
+		warmTimer timer
 	)
+	defer func() {
+		m.budget.Release(held)
+		if starved {
+			m.budget.Starved(false)
+		}
+	}()
 	for {
 		var (
 			mach  *sliceMachine
@@ -445,10 +605,36 @@ func (m *machineManager) Do(ctx context.Context) {
 		} else {
 			probationTimer.Set(probation[0].lastFailure.Add(ProbationTimeout))
 		}
+		if len(warms) == 0 {
+			warmTimer.Clear()
+		} else {
+			warmTimer.Set(warms[0].expires)
+		}
+		if len(classes) < 2 {
+			agingTimer.Clear()
+		} else if agingTimer.C() == nil {
+			agingTimer.Set(time.Now().Add(priorityAging))
+		}
 		select {
 		case machc <- mach:
 			mach.taskProcs += m.schedQ[0].procs
-			heap.Pop(&m.schedQ)
+			mach.used = true
+			if hints := m.schedQ[0].hints; len(hints) > 0 {
+				m.localityTasks.Add(1)
+				if mach.hasLocality(hints) {
+					m.localityHits.Add(1)
+				}
+			}
+			s := heap.Pop(&m.schedQ).(scheduleRequest)
+			uncount(classes, s.class)
+			if len(s.tags) > 0 {
+				log.Debug.Printf("slicemachine: placed request for %d procs on %s; tags %s",
+					s.procs, mach.Addr, formatTags(s.tags))
+			}
+		case now := <-agingTimer.C():
+			agingTimer.Clear()
+			m.schedQ.age(now)
+			heap.Init(&m.schedQ)
 		case <-probationTimer.C():
 			mach := probation[0]
 			mach.health = machineOk
@@ -493,6 +679,12 @@ func (m *machineManager) Do(ctx context.Context) {
 			}
 		case s := <-m.schedc:
 			heap.Push(&m.schedQ, s)
+			if classes[s.class]++; classes[s.class] == 1 && len(classes) > 1 {
+				// The request introduces a new class, which may change
+				// the effective classes of the queued requests.
+				m.schedQ.age(time.Now())
+				heap.Init(&m.schedQ)
+			}
 			need += s.procs
 		case s := <-m.unschedc:
 			if s.index < 0 {
@@ -502,9 +694,94 @@ func (m *machineManager) Do(ctx context.Context) {
 			}
 			need -= s.procs
 			heap.Remove(&m.schedQ, s.index)
+			uncount(classes, s.class)
+		case w := <-m.warmc:
+			// Keep warms ordered by expiry.
+			i := sort.Search(len(warms), func(i int) bool { return warms[i].expires.After(w.expires) })
+			warms = append(warms, warmRequest{})
+			copy(warms[i+1:], warms[i:])
+			warms[i] = w
+			warm += w.procs
+			m.warmedProcs.Add(int64(w.procs))
+			log.Printf("slicemachine: warming %d procs until %s", w.procs, w.expires.Format(time.RFC3339))
+		case now := <-warmTimer.C():
+			warmTimer.Clear()
+			for len(warms) > 0 && !warms[0].expires.After(now) {
+				warm -= warms[0].procs
+				warms = warms[1:]
+			}
+			// Release the machines that were warmed but not used, and
+			// are not needed by pending or warm requests.
+			var (
+				have   = len(machines) * m.machprocs
+				target = need
+				unused []*sliceMachine
+			)
+			if warm > target {
+				target = warm
+			}
+			for _, mach := range machines {
+				if !mach.used && mach.taskProcs == 0 {
+					unused = append(unused, mach)
+				}
+			}
+			for _, mach := range unused {
+				if have-m.machprocs < target {
+					break
+				}
+				have -= m.machprocs
+				machines = removeMachine(machines, mach)
+				mach.health = machineLost
+				mach.released = true
+				m.warmReleased.Add(1)
+				log.Printf("slicemachine: releasing unused warm machine %s", mach.Addr)
+				m.events.publish(EventMachine, TaskName{}, "state", "released", "machine", mach.Addr)
+				mach.Cancel()
+			}
+		case <-budgetc:
+			// Budget may have become available; we re-evaluate below.
+		case <-reclaimc:
+			reclaimc = m.budget.Reclaim()
+			if starved || len(m.schedQ) > 0 || !m.budget.Starving() {
+				break
+			}
+			// Release the idle machines whose outputs have been consumed,
+			// keeping those needed by warm requests, so that other
+			// managers may use their budget.
+			var (
+				have = len(machines) * m.machprocs
+				idle []*sliceMachine
+			)
+			for _, mach := range machines {
+				if mach.idle() {
+					idle = append(idle, mach)
+				}
+			}
+			for _, mach := range idle {
+				if have-m.machprocs < warm {
+					break
+				}
+				have -= m.machprocs
+				machines = removeMachine(machines, mach)
+				mach.health = machineLost
+				mach.released = true
+				m.budget.reclaimed.Add(1)
+				log.Printf("slicemachine: releasing idle machine %s to starved machine pools", mach.Addr)
+				m.events.publish(EventMachine, TaskName{}, "state", "released", "machine", mach.Addr)
+				mach.Cancel()
+			}
+		case <-coalesceTimer.C():
+			coalesceTimer.Clear()
+			coalesced = true
 		case result := <-startc:
 			pending -= m.machprocs * (len(result.machines) + result.nFailures)
+			held -= result.nFailures
+			m.budget.Release(result.nFailures)
+			if result.nFailures > 0 {
+				m.events.publish(EventMachine, TaskName{}, "state", "failed", "count", result.nFailures)
+			}
 			for _, mach := range result.machines {
+				m.events.publish(EventMachine, TaskName{}, "state", "ready", "machine", mach.Addr)
 				machines = appendMachine(machines, mach)
 				mach.donec = donec
 				go func(mach *sliceMachine) {
@@ -523,7 +800,17 @@ func (m *machineManager) Do(ctx context.Context) {
 		case mach := <-stoppedc:
 			// Remove the machine from management. We let the sliceMachine
 			// instance deal with failing the tasks.
-			log.Error.Printf("machine %s stopped with error %s", mach, mach.Err())
+			switch err := mach.Err(); {
+			case mach.released:
+				// The machine was stopped by the manager, which published
+				// its release.
+			case err != nil:
+				log.Error.Printf("machine %s stopped with error %s", mach, err)
+				m.events.publish(EventMachine, TaskName{}, "state", "stopped", "machine", mach.Addr, "error", err.Error())
+			default:
+				log.Error.Printf("machine %s stopped with error %s", mach, err)
+				m.events.publish(EventMachine, TaskName{}, "state", "stopped", "machine", mach.Addr)
+			}
 			switch mach.health {
 			case machineOk:
 				machines = removeMachine(machines, mach)
@@ -532,36 +819,85 @@ func (m *machineManager) Do(ctx context.Context) {
 			}
 			mach.health = machineLost
 			mach.Status.Done()
+			held--
+			m.budget.Release(1)
 		case <-ctx.Done():
 			return
 		}
 
 		// TODO(marius): consider scaling down when we don't need as many
 		// resources any more; his would involve moving results to other
-		// machines or to another storage medium.
-		if have := (len(machines) + len(probation)) * m.machprocs; have+pending < need && have+pending < m.maxp {
+		// machines or to another storage medium. For now, only machines
+		// whose results have been consumed are released, and only when
+		// other managers are starved (see reclaimc).
+		budgetc = nil
+		have := (len(machines) + len(probation)) * m.machprocs
+		demand := need
+		if warm > demand {
+			demand = warm
+		}
+		short := have+pending < demand && have+pending < m.maxp
+		if short && !coalesced && provisionCoalesce > 0 {
+			// Defer provisioning so that machines needed by requests that
+			// arrive in the meantime are provisioned in the same batch.
+			if coalesceTimer.C() == nil {
+				coalesceTimer.Set(time.Now().Add(provisionCoalesce))
+			}
+		} else if short {
 			var (
-				needProcs    = min(need, m.maxp) - have - pending
+				needProcs    = min(demand, m.maxp) - have - pending
 				needMachines = min((needProcs+m.machprocs-1)/m.machprocs, maxStartMachines)
 			)
-			pending += needMachines * m.machprocs
-			log.Printf("slicemachine: %d machines (%d procs); %d machines pending (%d procs)",
-				have/m.machprocs, have, pending/m.machprocs, pending)
-			go func() {
-				machines := startMachines(ctx, m.b, m.group, m.machprocs, needMachines, m.worker, m.params...)
-				startc <- startResult{
-					machines:  machines,
-					nFailures: needMachines - len(machines),
+			// Retrieve the wait channel before acquiring so that we do not
+			// miss releases that happen in between.
+			waitc := m.budget.Wait()
+			granted := m.budget.Acquire(needMachines, held)
+			if granted < needMachines {
+				// Waiting scheduling requests remain queued until budget
+				// is released, or the cap is raised.
+				budgetc = waitc
+				if !starved {
+					log.Printf("slicemachine: machine budget exhausted; %d machines needed, %d granted", needMachines, granted)
 				}
-			}()
+			}
+			if starved != (granted < needMachines) {
+				starved = !starved
+				m.budget.Starved(starved)
+			}
+			if granted > 0 {
+				held += granted
+				pending += granted * m.machprocs
+				log.Printf("slicemachine: %d machines (%d procs); %d machines pending (%d procs)",
+					have/m.machprocs, have, pending/m.machprocs, pending)
+				go func() {
+					machines := m.startMachines(ctx, granted)
+					startc <- startResult{
+						machines:  machines,
+						nFailures: granted - len(machines),
+					}
+				}()
+			}
+		} else if starved {
+			starved = false
+			m.budget.Starved(false)
 		}
+		coalesced = false
 	}
 }
 
 // schedule attempts to schedule s on a machine in machines, returning the
 // machine and the channel on which to send the machine. If no machine can
-// satisfy the request, it returns (nil, nil).
+// satisfy the request, it returns (nil, nil). Machines preferred by the
+// request's locality hints are chosen over others.
 func schedule(s scheduleRequest, machines []*sliceMachine) (*sliceMachine, chan<- *sliceMachine) {
+	if len(s.hints) > 0 {
+		for _, m := range machines {
+			freeProcs := m.maxTaskProcs - m.taskProcs
+			if s.procs <= freeProcs && m.hasLocality(s.hints) {
+				return m, s.machc
+			}
+		}
+	}
 	// schedQ is ordered from largest to smallest proc needs, within a given
 	// priority, so this implements a first fit decreasing scheduling strategy.
 	for _, m := range machines {
@@ -585,16 +921,42 @@ func removeMachine(ms []*sliceMachine, m *sliceMachine) []*sliceMachine {
 	return ms[:len(ms)-1]
 }
 
+// StartMachines starts n machines managed by m. Requests to provision
+// the machines that fail with temporary errors are retried according
+// to m's provision policy.
+func (m *machineManager) startMachines(ctx context.Context, n int) []*sliceMachine {
+	for retries := 0; ; retries++ {
+		machines, err := startMachines(ctx, m.b, m.group, m.machprocs, n, m.worker, m.params...)
+		if err == nil || !retryableProvision(err) {
+			return machines
+		}
+		if err = retry.Wait(ctx, m.provisionPolicy, retries); err != nil {
+			log.Error.Printf("giving up starting %d machines: %v", n, err)
+			return nil
+		}
+		m.provisionRetries.Add(1)
+		log.Printf("retrying(%d) start of %d machines", retries+1, n)
+	}
+}
+
+// retryableProvision tells whether a failed provisioning request should
+// be retried: temporary errors and unavailable resources, as reported,
+// e.g., when the cloud provider throttles requests, are retried.
+func retryableProvision(err error) bool {
+	return errors.IsTemporary(err) || errors.Is(errors.Unavailable, err)
+}
+
 // StartMachines starts a number of machines on b, installing a worker service
 // on each of them. StartMachines returns a slice of successfully started
 // machines when all of them are in bigmachine.Running state. If a machine
-// fails to start, it is not included.
-func startMachines(ctx context.Context, b *bigmachine.B, group *status.Group, maxTaskProcs int, n int, worker *worker, params ...bigmachine.Param) []*sliceMachine {
+// fails to start, it is not included. If the machines cannot be
+// provisioned, startMachines returns the provisioning error.
+func startMachines(ctx context.Context, b *bigmachine.B, group *status.Group, maxTaskProcs int, n int, worker *worker, params ...bigmachine.Param) ([]*sliceMachine, error) {
 	params = append([]bigmachine.Param{bigmachine.Services{"Worker": worker}}, params...)
 	machines, err := b.Start(ctx, n, params...)
 	if err != nil {
 		log.Error.Printf("error starting machines: %v", err)
-		return nil
+		return nil, err
 	}
 	var wg sync.WaitGroup
 	slicemachines := make([]*sliceMachine, len(machines))
@@ -650,21 +1012,46 @@ func startMachines(ctx context.Context, b *bigmachine.B, group *status.Group, ma
 			n++
 		}
 	}
-	return slicemachines[:n]
+	return slicemachines[:n], nil
 }
 
+// priorityAging is the interval after which a scheduling request that
+// waits behind requests of a higher class is promoted by one class.
+var priorityAging = time.Minute
+
 type scheduleRequest struct {
-	// priority is the priority of the request. Lower values have higher
-	// priority. If there is more than one request waiting for a machine, the
-	// request with the lowest priority value will be satisfied first.
+	// class is the priority class of the request, i.e., the priority of
+	// its invocation. Higher classes are satisfied first.
+	class int
+	// boost is the effective class of the request: its class, raised by
+	// aging while it waits behind requests of a higher class.
+	boost int
+	// priority is the priority of the request within its class. Lower
+	// values have higher priority. If there is more than one request of
+	// the same effective class waiting for a machine, the request with the
+	// lowest priority value will be satisfied first.
 	priority int
 	// procs is the number of procs being requested.
 	procs int
+	// tags is the metadata of the work requesting the machine.
+	tags map[string]string
+	// hints are the preferred locations of the request.
+	hints []string
 	machc chan *sliceMachine
+	// queued is the time at which the request was made.
+	queued time.Time
 	// index is the index of this request in the request heap.
 	index int
 }
 
+// uncount decrements the count of class in classes, removing it if it
+// drops to zero.
+func uncount(classes map[int]int, class int) {
+	if classes[class]--; classes[class] == 0 {
+		delete(classes, class)
+	}
+}
+
 // scheduleRequestQ is a priority queue based on request priority and proc
 // demand.
 type scheduleRequestQ []scheduleRequest
@@ -672,6 +1059,9 @@ type scheduleRequestQ []scheduleRequest
 func (q scheduleRequestQ) Len() int { return len(q) }
 
 func (q scheduleRequestQ) Less(i, j int) bool {
+	if q[i].boost != q[j].boost {
+		return q[i].boost > q[j].boost
+	}
 	if q[i].priority != q[j].priority {
 		return q[i].priority < q[j].priority
 	}
@@ -680,6 +1070,35 @@ func (q scheduleRequestQ) Less(i, j int) bool {
 	return q[i].procs > q[j].procs
 }
 
+// age recomputes the effective class of each request in q at time now:
+// a request whose class is lower than the highest class in q is
+// promoted by one class for every priorityAging interval that it has
+// waited, up to one class above the highest, so that it is eventually
+// serviced ahead of newer requests. The caller must restore the heap
+// invariant.
+func (q scheduleRequestQ) age(now time.Time) {
+	if len(q) == 0 {
+		return
+	}
+	max := q[0].class
+	for _, s := range q {
+		if s.class > max {
+			max = s.class
+		}
+	}
+	for i := range q {
+		q[i].boost = q[i].class
+		if q[i].class == max {
+			continue
+		}
+		if promote := int64(now.Sub(q[i].queued) / priorityAging); promote > int64(max-q[i].class) {
+			q[i].boost = max + 1
+		} else {
+			q[i].boost += int(promote)
+		}
+	}
+}
+
 func (q scheduleRequestQ) Swap(i, j int) {
 	q[i], q[j] = q[j], q[i]
 	q[i].index = i
@@ -8,12 +8,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"reflect"
 	"sync"
 	"testing"
 	"time"
 
+	baseerrors "github.com/grailbio/base/errors"
+	"github.com/grailbio/base/retry"
 	"github.com/grailbio/bigmachine"
 	"github.com/grailbio/bigmachine/testsystem"
+	"github.com/grailbio/bigslice/stats"
 )
 
 func TestSlicemachineLoad(t *testing.T) {
@@ -205,7 +209,7 @@ func TestSlicemachinePriority(t *testing.T) {
 	for i := (maxp * 4) - 1; i >= 0; i-- {
 		i := i
 		go func() {
-			offerc, _ := mgr.Offer(i, 1)
+			offerc, _ := mgr.Offer(0, i, 1, nil)
 			sema <- struct{}{}
 			select {
 			case <-offerc:
@@ -230,7 +234,326 @@ func TestSlicemachinePriority(t *testing.T) {
 	}
 }
 
+// TestSlicemachineClass verifies that requests of higher classes are
+// serviced before requests of lower classes, regardless of their
+// priority within their classes.
+func TestSlicemachineClass(t *testing.T) {
+	const maxp = 16
+	_, _, mgr, cancel := startTestSystem(2, maxp, 1.0)
+	defer cancel()
+
+	ctx, ctxcancel := context.WithCancel(context.Background())
+	defer ctxcancel()
+	ms := getMachines(ctx, mgr, maxp)
+	sema := make(chan struct{})
+	c := make(chan int)
+	// Queue up requests of class 0 with the highest priority, and then
+	// requests of class 1 with lower priority. We expect the class 1
+	// requests to be serviced first.
+	for _, class := range []int{0, 1} {
+		for i := 0; i < maxp; i++ {
+			class, i := class, i
+			go func() {
+				offerc, _ := mgr.Offer(class, maxp*(1-class)+i, 1, nil)
+				sema <- struct{}{}
+				select {
+				case <-offerc:
+				case <-ctx.Done():
+					return
+				}
+				c <- class
+			}()
+			<-sema
+		}
+	}
+	for _, m := range ms {
+		m.Done(1, nil)
+	}
+	for j := 0; j < maxp; j++ {
+		if class := <-c; class != 1 {
+			t.Error("did not respect class")
+		}
+	}
+}
+
+// TestSlicemachineAging verifies that requests waiting behind requests
+// of higher classes are eventually serviced.
+func TestSlicemachineAging(t *testing.T) {
+	save := priorityAging
+	priorityAging = 10 * time.Millisecond
+	defer func() {
+		priorityAging = save
+	}()
+	const maxp = 2
+	_, _, mgr, cancel := startTestSystem(1, maxp, 1.0)
+	defer cancel()
+
+	ctx, ctxcancel := context.WithCancel(context.Background())
+	defer ctxcancel()
+	ms := getMachines(ctx, mgr, maxp)
+	lowc, _ := mgr.Offer(0, 0, 1, nil)
+	// Wait for the low-class request to age past class 1.
+	time.Sleep(10 * priorityAging)
+	highc := make(chan *sliceMachine)
+	for i := 0; i < 4; i++ {
+		offerc, _ := mgr.Offer(1, 0, 1, nil)
+		go func() {
+			select {
+			case m := <-offerc:
+				highc <- m
+			case <-ctx.Done():
+			}
+		}()
+	}
+	ms[0].Done(1, nil)
+	select {
+	case m := <-lowc:
+		m.Done(1, nil)
+	case <-highc:
+		t.Fatal("low-class request starved")
+	case <-time.After(10 * time.Second):
+		t.Fatal("request not serviced")
+	}
+	// The high-class requests are then serviced.
+	ms[1].Done(1, nil)
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-highc:
+			m.Done(1, nil)
+		case <-time.After(10 * time.Second):
+			t.Fatal("request not serviced")
+		}
+	}
+}
+
+// TestSlicemachineBudget verifies that machine managers respect a shared
+// machine budget, that the budget may be raised, and that a manager
+// without machines is always granted one.
+func TestSlicemachineBudget(t *testing.T) {
+	budget := newMachineBudget(2)
+	system, b, mgr, cancel := startTestSystemBudget(1, 8, 1.0, budget)
+	defer cancel()
+
+	ctx := context.Background()
+	getMachines(ctx, mgr, 2)
+	mustUnavailable(t, mgr)
+	if got, want := system.N(), 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The request remains queued while the manager is starved.
+	offerc, _ := mgr.Offer(0, 0, 1, nil)
+	for budget.starved.Get() == 0 {
+		<-time.After(10 * time.Millisecond)
+	}
+	budget.SetMax(3)
+	<-offerc
+	if got, want := system.Wait(3), 3; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := budget.machines.Get(), int64(3); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// A second manager sharing the (exhausted) budget must still make
+	// progress.
+	mgr2 := newMachineManager(b, nil, nil, 8, 1.0, budget, &worker{MachineCombiners: false})
+	ctx2, cancel2 := context.WithCancel(ctx)
+	defer cancel2()
+	go mgr2.Do(ctx2)
+	getMachines(ctx, mgr2, 1)
+	if got, want := budget.overcommitted.Get(), int64(1); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// TestSlicemachineReclaim verifies that a manager releases its idle
+// machines to a starved manager once the outputs they hold have been
+// consumed.
+func TestSlicemachineReclaim(t *testing.T) {
+	budget := newMachineBudget(2)
+	_, b, mgr, cancel := startTestSystemBudget(1, 8, 1.0, budget)
+	defer cancel()
+	ctx := context.Background()
+
+	// The first stage runs a task on each of the manager's machines;
+	// their outputs are consumed by a task of the second stage.
+	var (
+		producers = []*Task{
+			{Name: TaskName{Op: "stage1", Shard: 0, NumShard: 2}},
+			{Name: TaskName{Op: "stage1", Shard: 1, NumShard: 2}},
+		}
+		consumer = &Task{
+			Name: TaskName{Op: "stage2", NumShard: 1},
+			Deps: []TaskDep{{Head: producers[0]}, {Head: producers[1]}},
+		}
+	)
+	linkConsumers([]*Task{consumer})
+	for i, m := range getMachines(ctx, mgr, 2) {
+		producers[i].Set(TaskOk)
+		m.Assign(producers[i])
+		m.Done(1, nil)
+	}
+
+	// A second manager needs two machines: it is granted one beyond the
+	// cap, and is then starved.
+	mgr2 := newMachineManager(b, nil, nil, 8, 1.0, budget, &worker{MachineCombiners: false})
+	ctx2, cancel2 := context.WithCancel(ctx)
+	defer cancel2()
+	go mgr2.Do(ctx2)
+	getMachines(ctx, mgr2, 1)
+	offerc, _ := mgr2.Offer(0, 0, 1, nil)
+	for budget.starved.Get() == 0 {
+		<-time.After(10 * time.Millisecond)
+	}
+
+	// The machines are idle, but the second stage has yet to consume
+	// their outputs, so they are kept.
+	budget.TaskDone()
+	select {
+	case <-offerc:
+		t.Fatal("machine released before its outputs were consumed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Once the second stage completes, they are released.
+	consumer.Set(TaskOk)
+	budget.TaskDone()
+	<-offerc
+	if got, want := budget.reclaimed.Get(), int64(2); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// TestSlicemachineWarm verifies that warm requests provision machines
+// ahead of need, and that warmed machines that are not used are
+// released once the requests expire.
+func TestSlicemachineWarm(t *testing.T) {
+	system, _, mgr, cancel := startTestSystem(1, 8, 1.0)
+	defer cancel()
+
+	ctx := context.Background()
+	getMachines(ctx, mgr, 1)
+	// Warm requests are satisfied together with pending requests.
+	mgr.Warm(3, time.Second)
+	if got, want := system.Wait(3), 3; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	ms := getMachines(ctx, mgr, 1)
+	if got, want := system.N(), 3; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Only the machine that was never used is released.
+	for mgr.warmReleased.Get() == 0 {
+		<-time.After(10 * time.Millisecond)
+	}
+	<-time.After(50 * time.Millisecond)
+	if got, want := mgr.warmReleased.Get(), int64(1); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := mgr.warmedProcs.Get(), int64(3); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if ms[0].released {
+		t.Error("used machine was released")
+	}
+}
+
+// TestSlicemachineLocality verifies that requests are serviced by machines
+// preferred by their locality hints when they have capacity, and by other
+// machines otherwise.
+func TestSlicemachineLocality(t *testing.T) {
+	_, _, mgr, cancel := startTestSystem(2, 4, 1.0)
+	defer cancel()
+
+	ctx := context.Background()
+	ms := getMachines(ctx, mgr, 4)
+	for _, m := range ms {
+		m.Done(1, nil)
+	}
+	preferred := ms[3]
+	offerc, _ := mgr.Offer(0, 0, 2, nil, "unknown", preferred.Addr)
+	if got, want := <-offerc, preferred; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The preferred machine is now fully occupied.
+	offerc, _ = mgr.Offer(0, 0, 1, nil, preferred.Addr)
+	if m := <-offerc; m == preferred {
+		t.Errorf("got %v, want other machine", m)
+	}
+	vals := make(stats.Values)
+	mgr.stats.AddAll(vals)
+	if got, want := vals["localityTasks"], int64(2); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := vals["localityHits"], int64(1); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// throttledSystem is a test system whose first throttle requests to
+// start machines fail with a temporary error.
+type throttledSystem struct {
+	*testsystem.System
+	throttle int
+
+	mu sync.Mutex
+	// starts records the number of machines of each successful request.
+	starts []int
+}
+
+func (s *throttledSystem) Start(ctx context.Context, count int) ([]*bigmachine.Machine, error) {
+	s.mu.Lock()
+	if s.throttle > 0 {
+		s.throttle--
+		s.mu.Unlock()
+		return nil, baseerrors.E(baseerrors.Unavailable, "request throttled")
+	}
+	s.starts = append(s.starts, count)
+	s.mu.Unlock()
+	return s.System.Start(ctx, count)
+}
+
+// TestSlicemachineProvision verifies that throttled provisioning
+// requests are retried, and that simultaneous requests for machines are
+// coalesced.
+func TestSlicemachineProvision(t *testing.T) {
+	system := &throttledSystem{System: testsystem.New(), throttle: 2}
+	system.Machineprocs = 1
+	b := bigmachine.Start(system)
+	defer b.Shutdown()
+	mgr := newMachineManager(b, nil, nil, 8, 1.0, nil, &worker{MachineCombiners: false})
+	mgr.provisionPolicy = retry.Backoff(time.Millisecond, 10*time.Millisecond, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go mgr.Do(ctx)
+
+	const N = 4
+	var wg sync.WaitGroup
+	wg.Add(N)
+	for i := 0; i < N; i++ {
+		go func() {
+			defer wg.Done()
+			getMachines(ctx, mgr, 1)
+		}()
+	}
+	wg.Wait()
+	system.mu.Lock()
+	if got, want := system.starts, []int{N}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	system.mu.Unlock()
+	vals := make(stats.Values)
+	mgr.stats.AddAll(vals)
+	if got, want := vals["provisionRetries"], int64(2); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
 func startTestSystem(machinep, maxp int, maxLoad float64) (system *testsystem.System, b *bigmachine.B, m *machineManager, cancel func()) {
+	return startTestSystemBudget(machinep, maxp, maxLoad, nil)
+}
+
+func startTestSystemBudget(machinep, maxp int, maxLoad float64, budget *machineBudget) (system *testsystem.System, b *bigmachine.B, m *machineManager, cancel func()) {
 	system = testsystem.New()
 	system.Machineprocs = machinep
 	// Customize timeouts so that tests run faster.
@@ -239,7 +562,7 @@ func startTestSystem(machinep, maxp int, maxLoad float64) (system *testsystem.Sy
 	system.KeepaliveRpcTimeout = time.Second
 	b = bigmachine.Start(system)
 	ctx, ctxcancel := context.WithCancel(context.Background())
-	m = newMachineManager(b, nil, nil, maxp, maxLoad, &worker{MachineCombiners: false})
+	m = newMachineManager(b, nil, nil, maxp, maxLoad, budget, &worker{MachineCombiners: false})
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
@@ -257,7 +580,7 @@ func startTestSystem(machinep, maxp int, maxLoad float64) (system *testsystem.Sy
 func getMachines(ctx context.Context, mgr *machineManager, n int) []*sliceMachine {
 	ms := make([]*sliceMachine, n)
 	for i := range ms {
-		offerc, _ := mgr.Offer(0, 1)
+		offerc, _ := mgr.Offer(0, 0, 1, nil)
 		ms[i] = <-offerc
 	}
 	return ms
@@ -268,7 +591,7 @@ func mustUnavailable(t *testing.T, mgr *machineManager) {
 	t.Helper()
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
 	defer cancel()
-	offerc, cancel := mgr.Offer(0, 1)
+	offerc, cancel := mgr.Offer(0, 0, 1, nil)
 	select {
 	case <-offerc:
 		t.Fatal("unexpected machine available")
@@ -0,0 +1,196 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigslice"
+)
+
+// Snapshot configures an invocation to read a consistent, point-in-time
+// snapshot of each of its snapshot slices (see bigslice.SnapshotSlice).
+// The snapshots are captured once, by the driver, before the invocation
+// is compiled, and every task of the invocation reads them, even if the
+// underlying data change while it runs. The captured snapshots are
+// returned by Result.Snapshots, and may be passed to AtSnapshots to
+// reproduce the invocation later.
+//
+// The invocation fails if any of its snapshot slices cannot provide a
+// stable snapshot. Sources that are not snapshot slices (e.g., those
+// constructed by Const or ReaderFunc) are read as they otherwise would
+// be.
+func Snapshot() RunOption {
+	return func(inv *execInvocation) {
+		inv.snapshot = true
+	}
+}
+
+// AtSnapshots configures an invocation to read the provided snapshots,
+// as returned by Result.Snapshots of a previous invocation of the same
+// Func with the same arguments, so that it reads the same data. The
+// invocation fails if the snapshots do not match its snapshot slices.
+func AtSnapshots(tokens []interface{}) RunOption {
+	if tokens == nil {
+		tokens = []interface{}{}
+	}
+	return func(inv *execInvocation) {
+		inv.Env.Snapshots = tokens
+	}
+}
+
+// snapshotSlices returns the snapshot slices in the graph of the
+// provided slice, in a deterministic order. Slices that are computed by
+// previous invocations are not inspected.
+func snapshotSlices(slice bigslice.Slice) []bigslice.SnapshotSlice {
+	var (
+		visited   = make(map[bigslice.Slice]bool)
+		snapshots []bigslice.SnapshotSlice
+		walk      func(bigslice.Slice)
+	)
+	walk = func(slice bigslice.Slice) {
+		if visited[slice] {
+			return
+		}
+		visited[slice] = true
+		if _, ok := bigslice.Unwrap(slice).(*Result); ok {
+			return
+		}
+		for i := 0; i < slice.NumDep(); i++ {
+			walk(slice.Dep(i).Slice)
+		}
+		if s, ok := bigslice.Unwrap(slice).(bigslice.SnapshotSlice); ok {
+			snapshots = append(snapshots, s)
+		}
+	}
+	walk(slice)
+	return snapshots
+}
+
+// snapshot captures the snapshots of the snapshot slices of invocation
+// inv, which produced the provided slice, and records them in inv's
+// environment, if inv was configured by Snapshot. Snapshots that were
+// provided by AtSnapshots are checked against the slices.
+func (s *Session) snapshot(ctx context.Context, inv *execInvocation, slice bigslice.Slice) error {
+	slices := snapshotSlices(slice)
+	if inv.Env.Snapshots != nil {
+		if got, want := len(inv.Env.Snapshots), len(slices); got != want {
+			return errors.E(errors.Invalid, fmt.Sprintf("got %d snapshots for %d snapshot slices", got, want))
+		}
+		return nil
+	}
+	if !inv.snapshot {
+		return nil
+	}
+	tokens := make([]interface{}, len(slices))
+	for i, snap := range slices {
+		token, err := snap.Snapshot(ctx)
+		if err != nil {
+			return errors.E(fmt.Sprintf("%s: snapshot", snap.Name()), err)
+		}
+		tokens[i] = token
+	}
+	inv.Env.Snapshots = tokens
+	if inv.snapshotted != nil {
+		return inv.snapshotted(ctx, tokens)
+	}
+	return nil
+}
+
+// applySnapshots configures the snapshot slices of invocation inv,
+// which produced the provided slice, to read the snapshots recorded in
+// inv's environment, if any.
+func applySnapshots(inv execInvocation, slice bigslice.Slice) error {
+	if inv.Env.Snapshots == nil {
+		return nil
+	}
+	slices := snapshotSlices(slice)
+	if got, want := len(inv.Env.Snapshots), len(slices); got != want {
+		return errors.E(errors.Invalid, fmt.Sprintf("got %d snapshots for %d snapshot slices", got, want))
+	}
+	for i, snap := range slices {
+		if err := snap.SetSnapshot(inv.Env.Snapshots[i]); err != nil {
+			return errors.E(fmt.Sprintf("%s: snapshot", snap.Name()), err)
+		}
+	}
+	return nil
+}
+
+// readsSnapshots returns whether invocation inv reads the snapshots of
+// its snapshot slices.
+func readsSnapshots(inv *execInvocation) bool {
+	return inv.snapshot || inv.Env.Snapshots != nil
+}
+
+// manifestSlices returns the manifest slices in the graph of the
+// provided slice, in a deterministic order, excluding those whose
+// snapshots are read by invocation inv, as their snapshots record
+// their manifests. Slices that are computed by previous invocations
+// are not inspected.
+func manifestSlices(inv *execInvocation, slice bigslice.Slice) []bigslice.ManifestSlice {
+	var (
+		visited   = make(map[bigslice.Slice]bool)
+		manifests []bigslice.ManifestSlice
+		walk      func(bigslice.Slice)
+	)
+	walk = func(slice bigslice.Slice) {
+		if visited[slice] {
+			return
+		}
+		visited[slice] = true
+		if _, ok := bigslice.Unwrap(slice).(*Result); ok {
+			return
+		}
+		for i := 0; i < slice.NumDep(); i++ {
+			walk(slice.Dep(i).Slice)
+		}
+		s, ok := bigslice.Unwrap(slice).(bigslice.ManifestSlice)
+		if !ok {
+			return
+		}
+		if _, ok := s.(bigslice.SnapshotSlice); ok && readsSnapshots(inv) {
+			return
+		}
+		manifests = append(manifests, s)
+	}
+	walk(slice)
+	return manifests
+}
+
+// manifest computes the manifests of the manifest slices of invocation
+// inv, which produced the provided slice, and records them in inv's
+// environment. It must be called after snapshot, which determines
+// whether snapshots record the manifests of snapshot slices.
+func manifest(ctx context.Context, inv *execInvocation, slice bigslice.Slice) error {
+	slices := manifestSlices(inv, slice)
+	tokens := make([]interface{}, len(slices))
+	for i, s := range slices {
+		token, err := s.Manifest(ctx)
+		if err != nil {
+			return errors.E(fmt.Sprintf("%s: manifest", s.Name()), err)
+		}
+		tokens[i] = token
+	}
+	inv.Env.Manifests = tokens
+	return nil
+}
+
+// applyManifests configures the manifest slices of invocation inv,
+// which produced the provided slice, with the manifests recorded in
+// inv's environment.
+func applyManifests(inv execInvocation, slice bigslice.Slice) error {
+	slices := manifestSlices(&inv, slice)
+	if got, want := len(inv.Env.Manifests), len(slices); got != want {
+		return errors.E(errors.Invalid, fmt.Sprintf("got %d manifests for %d manifest slices", got, want))
+	}
+	for i, s := range slices {
+		if err := s.SetManifest(inv.Env.Manifests[i]); err != nil {
+			return errors.E(fmt.Sprintf("%s: manifest", s.Name()), err)
+		}
+	}
+	return nil
+}
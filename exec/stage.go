@@ -0,0 +1,332 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/grailbio/base/backgroundcontext"
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/limiter"
+	"github.com/grailbio/bigslice"
+	"github.com/grailbio/bigslice/stats"
+)
+
+// A stageCancelledError is the error of tasks belonging to a stage that
+// was cancelled by RunHandle.CancelStage.
+type stageCancelledError struct {
+	stage string
+}
+
+func (e stageCancelledError) Error() string {
+	return fmt.Sprintf("stage %s cancelled", e.stage)
+}
+
+// isStageCancelled tells whether err indicates that a task's stage was
+// cancelled.
+func isStageCancelled(err error) bool {
+	_, ok := err.(stageCancelledError)
+	return ok
+}
+
+// A stageID identifies a stage: the tasks of an invocation with the
+// same TaskName.Op.
+type stageID struct {
+	inv uint64
+	op  string
+}
+
+// A liveInv is an invocation whose tasks are being evaluated.
+type liveInv struct {
+	// n is the number of evaluations that include the invocation.
+	n int
+	// ctx is done once no evaluation includes the invocation, either
+	// because the evaluations completed or because their contexts were
+	// done. The contexts of the invocation's stages are derived from it.
+	ctx    context.Context
+	cancel func()
+}
+
+// A stage holds the cancellation context and the concurrency limit
+// shared by all tasks of a stage.
+type stage struct {
+	ctx    context.Context
+	cancel func()
+	// cancelled is set when the stage is cancelled by CancelStage, as
+	// opposed to its invocation no longer being evaluated.
+	cancelled bool
+
+	// initLimit initializes limit from the Concurrency pragma of the
+	// stage's tasks, which is shared by all of them.
+	initLimit sync.Once
+	// limit bounds the number of the stage's tasks that run at once, or
+	// is nil if the stage is not limited.
+	limit *limiter.Limiter
+	// inflight is the number of the stage's tasks that are running.
+	inflight int64
+}
+
+func newStage(parent context.Context) *stage {
+	ctx, cancel := context.WithCancel(parent)
+	return &stage{ctx: ctx, cancel: cancel}
+}
+
+// newIdleStage returns a stage that is neither cancelled nor limited.
+func newIdleStage() *stage {
+	st := &stage{ctx: backgroundcontext.Get(), cancel: func() {}}
+	st.initLimit.Do(func() {})
+	return st
+}
+
+// stageErr returns the error with which the task with the provided
+// name should fail if its stage was cancelled, or nil if it was not.
+func (s *Session) stageErr(name TaskName) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.stageLocked(stageID{name.InvIndex, name.Op}).cancelled {
+		return nil
+	}
+	return stageCancelledError{name.Op}
+}
+
+// stage returns the stage of the task with the provided name. Stages
+// are maintained only while their invocations are being evaluated
+// (see beginStages); tasks of other invocations, e.g., those that
+// complete after their evaluation has returned, share a single stage
+// that is neither cancelled nor limited.
+func (s *Session) stage(name TaskName) *stage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stageLocked(stageID{name.InvIndex, name.Op})
+}
+
+func (s *Session) stageLocked(id stageID) *stage {
+	live := s.liveInvs[id.inv]
+	if live == nil {
+		if s.idleStage == nil {
+			s.idleStage = newIdleStage()
+		}
+		return s.idleStage
+	}
+	if s.stages == nil {
+		s.stages = make(map[stageID]*stage)
+	}
+	st := s.stages[id]
+	if st == nil {
+		st = newStage(live.ctx)
+		s.stages[id] = st
+	}
+	return st
+}
+
+// beginStages maintains the stages of the provided tasks, and those of
+// their dependencies, while they are evaluated in the provided context.
+// The returned function must be called once the evaluation is done; it
+// releases the stages of the invocations that are no longer being
+// evaluated, as does the context being done, so that tasks waiting to
+// run (see acquireStage) are not left waiting on an abandoned
+// evaluation.
+func (s *Session) beginStages(ctx context.Context, tasks []*Task) (end func()) {
+	invs := make(map[uint64]bool)
+	_ = iterTasks(tasks, func(task *Task) error {
+		invs[task.Name.InvIndex] = true
+		return nil
+	})
+	s.mu.Lock()
+	if s.liveInvs == nil {
+		s.liveInvs = make(map[uint64]*liveInv)
+	}
+	for inv := range invs {
+		live := s.liveInvs[inv]
+		if live == nil {
+			live = new(liveInv)
+			live.ctx, live.cancel = context.WithCancel(backgroundcontext.Get())
+			s.liveInvs[inv] = live
+		}
+		live.n++
+	}
+	s.mu.Unlock()
+	var (
+		once sync.Once
+		done = make(chan struct{})
+	)
+	end = func() {
+		once.Do(func() {
+			close(done)
+			s.endStages(invs, tasks)
+		})
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			end()
+		case <-done:
+		}
+	}()
+	return end
+}
+
+// endStages ends an evaluation of the provided invocations, and the
+// provided tasks, releasing the stages and partition assignments (see
+// Session.assignment) of those invocations that are no longer being
+// evaluated. Their tasks that are waiting to run are marked lost, so
+// that they are not run (see acquireStage), but are resubmitted by any
+// later evaluation that needs them.
+func (s *Session) endStages(invs map[uint64]bool, tasks []*Task) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ended := make(map[uint64]bool)
+	for inv := range invs {
+		live := s.liveInvs[inv]
+		live.n--
+		if live.n > 0 {
+			continue
+		}
+		ended[inv] = true
+		delete(s.liveInvs, inv)
+		for id := range s.stages {
+			if id.inv == inv {
+				delete(s.stages, id)
+			}
+		}
+		for key := range s.assignments {
+			if key.InvIndex == inv {
+				delete(s.assignments, key)
+			}
+		}
+		// Release the contexts of the invocation's stages; tasks that
+		// are still running or waiting have been abandoned by the
+		// evaluation.
+		live.cancel()
+	}
+	if len(ended) == 0 {
+		return
+	}
+	_ = iterTasks(tasks, func(task *Task) error {
+		if ended[task.Name.InvIndex] {
+			task.Lock()
+			if task.state == TaskWaiting {
+				task.state = TaskLost
+				task.Broadcast()
+			}
+			task.Unlock()
+		}
+		return nil
+	})
+}
+
+// CancelStage cancels all tasks of the stage with the provided name,
+// the operation name (TaskName.Op) shared by the tasks of the stage, as
+// displayed in the session's status, in the handle's current
+// invocation. Running tasks are interrupted and their machine resources
+// are released; they, and tasks of the stage that have yet to run, fail
+// with an error indicating that the stage was cancelled. Evaluation
+// otherwise continues: tasks that do not depend on the cancelled stage
+// run to completion, while tasks that depend on it (and so on,
+// transitively) are never run. Once no more tasks can make progress,
+// Wait returns an error reporting the cancellation. The cancellation
+// lasts only until the evaluation completes: later invocations that
+// rerun the stage's tasks are unaffected. CancelStage returns an error
+// if the invocation has no such stage, or if the evaluation has
+// completed.
+func (h *RunHandle) CancelStage(name string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	select {
+	case <-h.done:
+		return errors.E(errors.Precondition, "cancel: evaluation is complete")
+	default:
+	}
+	var found bool
+	_ = iterTasks(h.tasks, func(task *Task) error {
+		found = found || task.Name.InvIndex == h.invIndex && task.Name.Op == name
+		return nil
+	})
+	if !found {
+		return errors.E(errors.NotExist, fmt.Sprintf("cancel: no stage %s in invocation %d", name, h.invIndex))
+	}
+	h.sess.cancelStage(stageID{h.invIndex, name})
+	return nil
+}
+
+// cancelStage cancels the stage with the provided ID, as CancelStage.
+// Only stages of invocations that are being evaluated are cancelled.
+func (s *Session) cancelStage(id stageID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.liveInvs[id.inv] == nil {
+		return
+	}
+	st := s.stageLocked(id)
+	st.cancelled = true
+	st.cancel()
+}
+
+// acquireStage waits until the provided task may run under the
+// concurrency limit of its stage (see bigslice.Concurrency), and
+// returns the context in which it should run and a function that
+// releases its place once it is done. The context is cancelled when the
+// task's stage is cancelled by CancelStage, and when its invocation is
+// no longer being evaluated, e.g., because the context of its
+// evaluation is done. Tasks of a batch
+// run sequentially, so a batch holds a single place. Tasks acquire
+// their places only once their dependencies are satisfied, so limited
+// stages cannot wait on each other. acquireStage returns an error if
+// the task's stage context is done before the task may run, or if its
+// evaluation has ended.
+func (s *Session) acquireStage(task *Task) (ctx context.Context, release func(), err error) {
+	s.mu.Lock()
+	st := s.stageLocked(stageID{task.Name.InvIndex, task.Name.Op})
+	// Tasks that were waiting to run when their evaluation ended are
+	// not run. See endStages.
+	abandoned := st == s.idleStage && task.State() == TaskLost
+	s.mu.Unlock()
+	if abandoned {
+		return nil, nil, context.Canceled
+	}
+	st.initLimit.Do(func() {
+		if n := bigslice.ConcurrencyOf(task.Pragma); n > 0 {
+			st.limit = limiter.New()
+			st.limit.Release(n)
+		}
+	})
+	if st.limit != nil {
+		if err := st.limit.Acquire(st.ctx, 1); err != nil {
+			return nil, nil, err
+		}
+	}
+	release = func() {
+		atomic.AddInt64(&st.inflight, -1)
+		if st.limit != nil {
+			st.limit.Release(1)
+		}
+	}
+	atomic.AddInt64(&st.inflight, 1)
+	// The place may have been acquired as the context was done.
+	if err := st.ctx.Err(); err != nil {
+		release()
+		return nil, nil, err
+	}
+	return st.ctx, release, nil
+}
+
+// StageStats returns a snapshot of the number of tasks of each stage
+// that are running, keyed by stage name (TaskName.Op), as displayed in
+// the session's status. Stages of the invocations that are being
+// evaluated are included even when none of their tasks are running,
+// so that the in-flight counts of stages with concurrency limits (see
+// bigslice.Concurrency) may be monitored.
+func (s *Session) StageStats() stats.Values {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vals := make(stats.Values)
+	for id, st := range s.stages {
+		vals[id.op] += atomic.LoadInt64(&st.inflight)
+	}
+	return vals
+}
@@ -251,6 +251,12 @@ type Task struct {
 	// are pipelined into this task.
 	bigslice.Pragma
 
+	// Tags is the metadata attached to this task by the Tag pragmas of
+	// the slice operations pipelined into it (see bigslice.Tag). Tags
+	// are not part of the task's name, and so do not affect its
+	// identity.
+	Tags map[string]string
+
 	// Slices is the set of slices to which this task directly contributes.
 	Slices []bigslice.Slice
 
@@ -265,9 +271,20 @@ type Task struct {
 	// metrics produced during execution of this task.
 	Scope metrics.Scope
 
+	// PartitionSizes holds the measured size of each of the task's
+	// output partitions, as reported by the executor upon successful
+	// completion of the task. It is nil if the executor did not
+	// measure the task's output. PartitionSizes is protected by the
+	// task's lock.
+	PartitionSizes []PartitionSize
+
 	// subs is the set of subscribers to which this task will be sent whenever
 	// its state changes.
 	subs []*TaskSubscriber
+	// events publishes the task's state changes to the subscribers of
+	// the sessions that run it, or is nil. It is protected by the
+	// task's lock.
+	events *eventBus
 
 	// The following are used to coordinate runtime execution.
 
@@ -284,6 +301,14 @@ type Task struct {
 	// consecutiveLost is the number of times this task has been run and lost
 	// consecutively. See maxConsecutiveLost.
 	consecutiveLost int
+	// attempts is the number of attempts to run this task that have
+	// been submitted to an executor. See TaskCompletion.
+	attempts int
+	// consumers is the set of tasks that read this task's output, and
+	// root indicates that the task is the root of an invocation. They
+	// are maintained by linkConsumers. See outputNeeded.
+	consumers map[*Task]bool
+	root      bool
 
 	// Status is a status object to which task status is reported.
 	Status *status.Task
@@ -385,6 +410,13 @@ func (t *Task) Broadcast() {
 	for _, sub := range t.subs {
 		sub.Notify(t)
 	}
+	if t.events != nil {
+		if t.err != nil && t.state >= TaskErr {
+			t.events.publish(EventTaskState, t.Name, "state", t.state.String(), "error", t.err.Error())
+		} else {
+			t.events.publish(EventTaskState, t.Name, "state", t.state.String())
+		}
+	}
 }
 
 // Wait returns after the next call to Broadcast, or if the context
@@ -508,3 +540,26 @@ func (t *Task) all(tasks map[*Task]bool) {
 		}
 	}
 }
+
+// sortedTagKeys returns the keys of tags in sorted order.
+func sortedTagKeys(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatTags formats tags as a sorted, comma-separated list of
+// key=value pairs.
+func formatTags(tags map[string]string) string {
+	var b strings.Builder
+	for i, k := range sortedTagKeys(tags) {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, "%s=%s", k, tags[k])
+	}
+	return b.String()
+}
@@ -115,6 +115,9 @@ func (t *tracer) Event(mach *sliceMachine, subject interface{}, ph string, args
 	case *Task:
 		event.Name = arg.Name.String()
 		event.Cat = "task"
+		if len(arg.Tags) > 0 {
+			event.Args["tags"] = arg.Tags
+		}
 		t.assignTid(mach, ph, t.taskEvents[arg], &event)
 		t.taskEvents[arg] = append(t.taskEvents[arg], event)
 	case execInvocation:
@@ -0,0 +1,198 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// The module's go directive predates generics. Since Go 1.21, a build
+// constraint on a Go release sets the language version of its file,
+// which permits the use of generics here.
+
+//go:build go1.21
+
+package exec
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigslice"
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/slicetype"
+)
+
+// TypedResult is a Result whose rows are read as values of type T,
+// without scanning them into pointers (see Typed). TypedResult embeds
+// the untyped Result, which remains available, e.g., to pass the
+// result to another invocation.
+type TypedResult[T any] struct {
+	*Result
+	// row returns row i of the provided frame as a T.
+	row func(f frame.Frame, i int) T
+}
+
+// Typed returns a view of r whose rows are read as values of type T.
+// If r has a single column of type T, each row is read as the value of
+// its column. Otherwise, T must be a struct with an exported field for
+// each of r's columns, in column order, each of the type of its column:
+// column i of each row is read into field i of T. Typed checks r's
+// type once, returning an error of kind errors.Invalid if its rows
+// cannot be read as Ts.
+func Typed[T any](r *Result) (*TypedResult[T], error) {
+	row, err := rowFunc[T](r)
+	if err != nil {
+		return nil, err
+	}
+	return &TypedResult[T]{Result: r, row: row}, nil
+}
+
+// RunTyped runs the invocation of funcv with the provided arguments in
+// the provided session, as by Session.Run, and returns its result as a
+// TypedResult[T] (see Typed). Since the type of the invocation's slice
+// is known only once it is invoked, a mismatch with T is reported only
+// once the result has been computed.
+func RunTyped[T any](ctx context.Context, sess *Session, funcv *bigslice.FuncValue, args ...interface{}) (*TypedResult[T], error) {
+	res, err := sess.run(ctx, 1, nil, funcv, args...)
+	if err != nil {
+		return nil, err
+	}
+	return Typed[T](res)
+}
+
+// rowFunc returns a function that reads a row of a frame of the type of
+// the provided slice as a T, or an error if the slice's rows cannot be
+// read as Ts.
+func rowFunc[T any](typ slicetype.Type) (func(f frame.Frame, i int) T, error) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	if typ.NumOut() == 1 && typ.Out(0) == t {
+		return func(f frame.Frame, i int) T {
+			return f.Index(0, i).Interface().(T)
+		}, nil
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, errors.E(errors.Invalid, fmt.Sprintf("typed: cannot read rows of type %s as %s", slicetype.String(typ), t))
+	}
+	if got, want := t.NumField(), typ.NumOut(); got != want {
+		return nil, errors.E(errors.Invalid, fmt.Sprintf("typed: struct %s has %d fields, expected %d for rows of type %s",
+			t, got, want, slicetype.String(typ)))
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			return nil, errors.E(errors.Invalid, fmt.Sprintf("typed: field %s of struct %s is not exported", field.Name, t))
+		}
+		if field.Type != typ.Out(i) {
+			return nil, errors.E(errors.Invalid, fmt.Sprintf("typed: field %s of struct %s has type %s, expected %s for column %d",
+				field.Name, t, field.Type, typ.Out(i), i))
+		}
+	}
+	return func(f frame.Frame, i int) T {
+		var row T
+		v := reflect.ValueOf(&row).Elem()
+		for col := 0; col < v.NumField(); col++ {
+			v.Field(col).Set(f.Index(col, i))
+		}
+		return row
+	}, nil
+}
+
+// Rows returns an iterator over the rows of r, in the order in which
+// they are scanned by Scanner. You must call Close on the returned
+// iterator when you are done with it. You may iterate over the rows of
+// r concurrently with multiple iterators.
+func (r *TypedResult[T]) Rows() *Rows[T] {
+	return &Rows[T]{typ: r.Result, chunkSize: r.sess.chunkSize, reader: r.open(), rowFunc: r.row}
+}
+
+// Slice returns the rows of r. Like Collect, Slice is intended for
+// small results: it fails if the result contains more rows, or more
+// bytes, than the session's collect limits (see CollectLimit and
+// CollectByteLimit).
+func (r *TypedResult[T]) Slice(ctx context.Context) ([]T, error) {
+	var (
+		rows      = r.Rows()
+		limit     = r.sess.collectLimit
+		byteLimit = r.sess.collectByteLimit
+		bytes     int64
+		out       []T
+	)
+	defer rows.Close() // nolint: errcheck
+	for rows.Scan(ctx) {
+		if len(out) == limit {
+			return nil, errors.E(errors.Invalid, fmt.Sprintf("typed: result exceeds limit of %d rows", limit))
+		}
+		if bytes += frameSize(rows.buf.Slice(rows.beg-1, rows.beg)); bytes > byteLimit {
+			return nil, errors.E(errors.Invalid, fmt.Sprintf("typed: result exceeds limit of %d bytes", byteLimit))
+		}
+		out = append(out, rows.Row())
+	}
+	return out, rows.Err()
+}
+
+// Rows is an iterator over the rows of a TypedResult. For example:
+//
+//	rows := res.Rows()
+//	defer rows.Close()
+//	for rows.Scan(ctx) {
+//		row := rows.Row()
+//		// ...
+//	}
+//	if err := rows.Err(); err != nil {
+//		// ...
+//	}
+type Rows[T any] struct {
+	typ       slicetype.Type
+	chunkSize int
+	reader    sliceio.ReadCloser
+	rowFunc   func(f frame.Frame, i int) T
+
+	buf      frame.Frame
+	beg, end int
+	eof      bool
+	row      T
+	err      error
+}
+
+// Scan advances the iterator to the next row, which is then returned
+// by Row. Scan returns false once there are no more rows, or if an
+// error occurs; Err then returns the error, if any.
+func (r *Rows[T]) Scan(ctx context.Context) bool {
+	if r.err != nil {
+		return false
+	}
+	if r.buf.IsZero() {
+		r.buf = frame.Make(r.typ, r.chunkSize, r.chunkSize)
+	}
+	for r.beg == r.end {
+		if r.eof {
+			return false
+		}
+		n, err := r.reader.Read(ctx, r.buf)
+		if err != nil && err != sliceio.EOF {
+			r.err = err
+			return false
+		}
+		r.eof = err == sliceio.EOF
+		r.beg, r.end = 0, n
+	}
+	r.row = r.rowFunc(r.buf, r.beg)
+	r.beg++
+	return true
+}
+
+// Row returns the row to which the iterator was advanced by the last
+// call to Scan.
+func (r *Rows[T]) Row() T {
+	return r.row
+}
+
+// Err returns the error, if any, that stopped iteration.
+func (r *Rows[T]) Err() error {
+	return r.err
+}
+
+// Close releases the iterator's resources.
+func (r *Rows[T]) Close() error {
+	return r.reader.Close()
+}
@@ -0,0 +1,180 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+
+package exec
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigslice"
+)
+
+func TestTyped(t *testing.T) {
+	const N = 1000
+	var (
+		ctx   = context.Background()
+		ints  = bigslice.Func(func() bigslice.Slice { return bigslice.Const(5, rangeSlice(0, N)) })
+		pairs = bigslice.Func(func() bigslice.Slice {
+			slice := bigslice.Const(5, rangeSlice(0, N))
+			return bigslice.Map(slice, func(i int) (int, string) { return i, fmt.Sprint(i) })
+		})
+	)
+	type pair struct {
+		Int    int
+		String string
+	}
+	testSession(t, func(t *testing.T, sess *Session) {
+		res, err := RunTyped[int](ctx, sess, ints)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vals, err := res.Slice(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Ints(vals)
+		if got, want := vals, rangeSlice(0, N); !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+
+		// Rows are mapped to structs by position.
+		typed, err := Typed[pair](sess.Must(ctx, pairs))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows := typed.Rows()
+		var n int
+		for rows.Scan(ctx) {
+			row := rows.Row()
+			if got, want := row.String, fmt.Sprint(row.Int); got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			n++
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if err := rows.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := n, N; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		// The untyped result remains available.
+		var (
+			is []int
+			ss []string
+		)
+		if err := typed.Collect(ctx, &is, &ss); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := len(is), N; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+}
+
+func TestTypedMismatch(t *testing.T) {
+	var (
+		ctx = context.Background()
+		fn  = bigslice.Func(func() bigslice.Slice {
+			return bigslice.Const(1, []int{1}, []string{"a"})
+		})
+	)
+	sess := Start(Local)
+	defer sess.Shutdown()
+	res := sess.Must(ctx, fn)
+	for _, test := range []struct {
+		typed func() error
+		want  string
+	}{
+		{
+			func() error { _, err := Typed[int](res); return err },
+			"typed: cannot read rows of type slice[1]int,string as int",
+		},
+		{
+			func() error { _, err := Typed[struct{ A int }](res); return err },
+			"typed: struct struct { A int } has 1 fields, expected 2 for rows of type slice[1]int,string",
+		},
+		{
+			func() error {
+				_, err := Typed[struct {
+					A int
+					b string
+				}](res)
+				return err
+			},
+			"typed: field b of struct struct { A int; b string } is not exported",
+		},
+		{
+			func() error {
+				_, err := Typed[struct {
+					A int
+					B int
+				}](res)
+				return err
+			},
+			"typed: field B of struct struct { A int; B int } has type int, expected string for column 1",
+		},
+	} {
+		err := test.typed()
+		if !errors.Is(errors.Invalid, err) {
+			t.Errorf("expected Invalid error, got %v", err)
+			continue
+		}
+		if got, want := err.Error(), test.want; !strings.Contains(got, want) {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestTypedCollectLimit(t *testing.T) {
+	var (
+		ctx = context.Background()
+		fn  = bigslice.Func(func() bigslice.Slice { return bigslice.Const(2, rangeSlice(0, 10)) })
+	)
+	sess := Start(Local, CollectLimit(5))
+	defer sess.Shutdown()
+	res, err := RunTyped[int](ctx, sess, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := res.Slice(ctx); err == nil {
+		t.Error("expected collect limit error")
+	}
+
+	// Ten ints are 80 bytes.
+	for _, test := range []struct {
+		limit   int64
+		wantErr bool
+	}{{79, true}, {80, false}} {
+		sess := Start(Local, CollectByteLimit(test.limit))
+		defer sess.Shutdown()
+		res, err := RunTyped[int](ctx, sess, fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ints, err := res.Slice(ctx)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("limit %d: expected collect byte limit error", test.limit)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("limit %d: %v", test.limit, err)
+		}
+		if got, want := len(ints), 10; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+	"time"
+)
+
+// WarmLookahead configures the session to provision machines ahead of
+// the stages of its invocations that are about to run, so that stages
+// with many tasks (e.g., those that follow a wide shuffle) do not wait
+// for machines to be provisioned when they become ready. Once a stage
+// begins to run, the stages that depend on it, up to depth stages
+// downstream, are warmed: the executor provisions capacity for their
+// tasks that have yet to run (see Session.WarmMachines).
+//
+// To avoid provisioning machines for stages that may not run soon, a
+// stage is warmed only if each of the stages on which it depends has
+// begun to run, or is itself within depth stages of a stage that has.
+// Stages whose tasks have all run (e.g., because they were cached) are
+// not warmed. Capacity that is warmed, but not used by the time the
+// provided timeout expires, is released. WarmLookahead currently
+// applies only to the bigmachine executor.
+func WarmLookahead(depth int, timeout time.Duration) Option {
+	if depth < 1 {
+		panic("exec.WarmLookahead: depth < 1")
+	}
+	if timeout <= 0 {
+		panic("exec.WarmLookahead: timeout <= 0")
+	}
+	return func(s *Session) {
+		s.warmDepth = depth
+		s.warmTimeout = timeout
+	}
+}
+
+// WarmMachines asks the session's executor to provision n machines in
+// the session's shared cluster ahead of need, e.g., before an
+// invocation that is known to run many tasks at once. WarmMachines does
+// not wait for the machines to be provisioned. The machines count
+// toward the capacity needed by the session until the provided timeout
+// expires; machines that have not been used by then are stopped,
+// unless they are needed by tasks. Machines are provisioned subject to
+// the session's parallelism and machine budget (see MaxMachines).
+// WarmMachines currently applies only to the bigmachine executor; it
+// is a no-op otherwise.
+func (s *Session) WarmMachines(n int, timeout time.Duration) {
+	if w, ok := s.executor.(warmer); ok {
+		w.warmMachines(n, timeout)
+	}
+}
+
+// A warmer is an executor that can provision capacity ahead of need.
+type warmer interface {
+	// warmMachines provisions n machines in the executor's shared
+	// cluster until the provided timeout expires.
+	warmMachines(n int, timeout time.Duration)
+	// warmTasks provisions capacity for the provided tasks until the
+	// provided timeout expires.
+	warmTasks(tasks []*Task, timeout time.Duration)
+}
+
+// warmStage is a stage of a task graph maintained by maintainWarm: the
+// tasks of an invocation that compute the shards of the same slices.
+type warmStage struct {
+	tasks []*Task
+	// deps and dependents are the stages on which the stage depends, and
+	// those that depend on it.
+	deps, dependents map[*warmStage]bool
+	// running indicates that at least one of the stage's tasks has
+	// begun to run; warmed indicates that the stage has been warmed.
+	running, warmed bool
+}
+
+// maintainWarm warms the stages of the provided task graph that are
+// within depth stages downstream of stages that run, as configured by
+// WarmLookahead, until ctx is done.
+func maintainWarm(ctx context.Context, w warmer, tasks []*Task, depth int, timeout time.Duration) {
+	var (
+		sub    = NewTaskSubscriber()
+		stages = make(map[TaskName]*warmStage)
+		order  []*warmStage
+	)
+	stageOf := func(task *Task) *warmStage {
+		key := TaskName{InvIndex: task.Name.InvIndex, Op: task.Name.Op}
+		stage := stages[key]
+		if stage == nil {
+			stage = &warmStage{
+				deps:       make(map[*warmStage]bool),
+				dependents: make(map[*warmStage]bool),
+			}
+			stages[key] = stage
+			order = append(order, stage)
+		}
+		return stage
+	}
+	_ = iterTasks(tasks, func(task *Task) error {
+		// Subscribe to updates before the initial states are read, so
+		// that every subsequent update is seen.
+		task.Subscribe(sub)
+		stage := stageOf(task)
+		stage.tasks = append(stage.tasks, task)
+		for _, dep := range task.Deps {
+			for i := 0; i < dep.NumTask(); i++ {
+				depStage := stageOf(dep.Task(i))
+				if depStage != stage {
+					stage.deps[depStage] = true
+					depStage.dependents[stage] = true
+				}
+			}
+		}
+		return nil
+	})
+	defer func() {
+		_ = iterTasks(tasks, func(task *Task) error {
+			task.Unsubscribe(sub)
+			return nil
+		})
+	}()
+	// update marks the stage of the provided task as running if the
+	// task has begun to run, returning whether the stage was newly
+	// marked.
+	update := func(task *Task) bool {
+		stage := stageOf(task)
+		if stage.running {
+			return false
+		}
+		switch task.State() {
+		case TaskWaiting, TaskRunning, TaskOk:
+			stage.running = true
+			return true
+		}
+		return false
+	}
+	changed := false
+	for _, stage := range order {
+		for _, task := range stage.tasks {
+			if update(task) {
+				changed = true
+			}
+		}
+	}
+	for {
+		if changed {
+			warmAhead(w, order, depth, timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-sub.Ready():
+			changed = false
+			for _, task := range sub.Tasks() {
+				if update(task) {
+					changed = true
+				}
+			}
+		}
+	}
+}
+
+// warmAhead warms the stages that are within depth stages downstream
+// of running stages, and whose dependencies are running or are
+// themselves within depth stages of running stages. Each stage is
+// warmed at most once.
+func warmAhead(w warmer, stages []*warmStage, depth int, timeout time.Duration) {
+	var (
+		ahead    = make(map[*warmStage]bool)
+		frontier []*warmStage
+	)
+	for _, stage := range stages {
+		if stage.running {
+			frontier = append(frontier, stage)
+		}
+	}
+	for i := 0; i < depth && len(frontier) > 0; i++ {
+		var next []*warmStage
+		for _, stage := range frontier {
+			for dependent := range stage.dependents {
+				if !dependent.running && !ahead[dependent] {
+					ahead[dependent] = true
+					next = append(next, dependent)
+				}
+			}
+		}
+		frontier = next
+	}
+	for _, stage := range stages {
+		if !ahead[stage] || stage.warmed {
+			continue
+		}
+		ready := true
+		for dep := range stage.deps {
+			if !dep.running && !ahead[dep] {
+				ready = false
+				break
+			}
+		}
+		if !ready {
+			continue
+		}
+		stage.warmed = true
+		var pending []*Task
+		for _, task := range stage.tasks {
+			if state := task.State(); state == TaskInit || state == TaskLost {
+				pending = append(pending, task)
+			}
+		}
+		if len(pending) > 0 {
+			w.warmTasks(pending, timeout)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/grailbio/bigmachine/testsystem"
+	"github.com/grailbio/bigslice"
+)
+
+// testWarmer records the tasks that are warmed.
+type testWarmer struct {
+	warmc chan []*Task
+}
+
+func (w testWarmer) warmMachines(n int, timeout time.Duration) {}
+
+func (w testWarmer) warmTasks(tasks []*Task, timeout time.Duration) {
+	w.warmc <- tasks
+}
+
+func TestMaintainWarm(t *testing.T) {
+	const (
+		nshard = 4
+		nstage = 3
+	)
+	for _, depth := range []int{1, 2} {
+		tasks := multiPhaseCompile(nshard, nstage)
+		// stages holds the tasks of each stage, from first to last.
+		stages := make(map[int][]*Task)
+		_ = iterTasks(tasks, func(task *Task) error {
+			depth := 0
+			for t := task; len(t.Deps) > 0; t = t.Deps[0].Task(0) {
+				depth++
+			}
+			stages[depth] = append(stages[depth], task)
+			return nil
+		})
+		if got, want := len(stages), nstage+1; got != want {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+		var (
+			w           = testWarmer{make(chan []*Task)}
+			ctx, cancel = context.WithCancel(context.Background())
+			done        = make(chan struct{})
+		)
+		go func() {
+			maintainWarm(ctx, w, tasks, depth, time.Minute)
+			close(done)
+		}()
+		// Nothing is warmed until a stage runs.
+		expectNoWarm(t, w)
+		stages[0][0].Set(TaskRunning)
+		var warmed []int
+		for i := 0; i < depth; i++ {
+			select {
+			case tasks := <-w.warmc:
+				if got, want := len(tasks), nshard; got != want {
+					t.Errorf("got %v, want %v", got, want)
+				}
+				for stage := range stages {
+					if stages[stage][0].Name.Op == tasks[0].Name.Op {
+						warmed = append(warmed, stage)
+					}
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("stage not warmed")
+			}
+		}
+		expectNoWarm(t, w)
+		sort.Ints(warmed)
+		for i, stage := range warmed {
+			if got, want := stage, i+1; got != want {
+				t.Errorf("depth %d: got %v, want %v", depth, got, want)
+			}
+		}
+		// Stages are warmed once, as the stages ahead of them run.
+		for _, task := range stages[1] {
+			task.Set(TaskOk)
+		}
+		select {
+		case tasks := <-w.warmc:
+			if got, want := tasks[0].Name.Op, stages[depth+1][0].Name.Op; got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("stage not warmed")
+		}
+		expectNoWarm(t, w)
+		cancel()
+		<-done
+	}
+}
+
+func expectNoWarm(t *testing.T, w testWarmer) {
+	t.Helper()
+	select {
+	case tasks := <-w.warmc:
+		t.Errorf("unexpected warm of %v", tasks[0].Name)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWarmLookahead(t *testing.T) {
+	var (
+		ctx = context.Background()
+		fn  = bigslice.Func(func() bigslice.Slice {
+			slice := bigslice.Const(4, []string{"a", "b", "c", "a"}, []int{1, 2, 3, 4})
+			return bigslice.Reduce(slice, func(a, b int) int { return a + b })
+		})
+		sess = Start(Bigmachine(testsystem.New()), Parallelism(4), WarmLookahead(1, time.Minute))
+	)
+	defer sess.Shutdown()
+	res, err := sess.Run(ctx, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		keys   []string
+		values []int
+	)
+	if err = res.Collect(ctx, &keys, &values); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(keys), 3; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	mgr := sess.executor.(*bigmachineExecutor).manager(0)
+	if mgr.warmedProcs.Get() == 0 {
+		t.Error("reduce stage was not warmed")
+	}
+	warmed := mgr.warmedProcs.Get()
+	sess.WarmMachines(2, time.Minute)
+	// A subsequent run ensures that the manager has processed the
+	// request.
+	sess.Must(ctx, fn)
+	if got, want := mgr.warmedProcs.Get()-warmed, int64(2*mgr.machprocs); got < want {
+		t.Errorf("got %v, want at least %v", got, want)
+	}
+}
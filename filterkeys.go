@@ -0,0 +1,288 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/grailbio/bigslice/bloom"
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/slicefunc"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/slicetype"
+	"github.com/grailbio/bigslice/typecheck"
+)
+
+var (
+	typeOfBloomKeys      = reflect.TypeOf((*bloomKeys)(nil))
+	bloomKeysCombiner, _ = slicefunc.Of(mergeBloomKeys)
+)
+
+type filterKeysSlice struct {
+	name Name
+	Slice
+	filter *bloom.Filter
+	// keys is the reduced set of keys from which the filter is built on
+	// the executors, with false positive rate fpRate, if filter is nil.
+	// It is broadcast to every shard.
+	keys   Slice
+	fpRate float64
+}
+
+// FilterKeys returns a slice that contains only the rows of the
+// provided slice whose keys (prefix columns) may be present in the
+// provided Bloom filter. Since Bloom filters admit false positives,
+// some rows with keys not in the filter may also be retained.
+//
+// FilterKeys is used to prune the larger side of a join before it is
+// shuffled. Join does so itself when configured with BloomFilterKeys,
+// building the filter in a stage of its own; FilterKeys prunes with a
+// filter built by other means, e.g., by exec.Result.BloomFilter, which
+// skips building the filter when the smaller side is too large. The
+// filter is passed as an argument to the Func that performs the join,
+// thus broadcasting it to every worker. Rows that pass the filter
+// spuriously are simply discarded by the join. For example:
+//
+//	var join = bigslice.Func(func(small *exec.Result, filter *bloom.Filter) bigslice.Slice {
+//		large := bigslice.FilterKeys(readLarge(), filter)
+//		return bigslice.Cogroup(large, small)
+//	})
+//
+// If filter is nil, FilterKeys returns the slice unchanged.
+//
+// Schematically:
+//
+//	FilterKeys(Slice<k1, ..., kn, v1, ..., vm>, *bloom.Filter) Slice<k1, ..., kn, v1, ..., vm>
+func FilterKeys(slice Slice, filter *bloom.Filter) Slice {
+	if filter == nil {
+		return slice
+	}
+	if !filter.Compatible(slice) {
+		typecheck.Panicf(1, "filterkeys: filter is not compatible with the keys of slice type %s", slicetype.String(slice))
+	}
+	return &filterKeysSlice{name: MakeName("filterkeys"), Slice: slice, filter: filter}
+}
+
+// filterKeysBy returns a slice that contains only the rows of the
+// provided slice whose keys may be present in slice keys. A Bloom
+// filter with the provided false positive rate is built from the keys
+// of each shard of keys and merged in a separate stage, whose result
+// is broadcast to each shard of the returned slice. If keys has more
+// than maxKeys distinct keys, no filter is built, and every row is
+// retained. Slices are named after the provided name.
+func filterKeysBy(name Name, slice, keys Slice, fpRate float64, maxKeys int) Slice {
+	keysName, reduceName := name, name
+	keysName.Op = name.Op + "_bloomkeys"
+	reduceName.Op = name.Op + "_bloommerge"
+	name.Op += "_filterkeys"
+	return &filterKeysSlice{
+		name:   name,
+		Slice:  slice,
+		keys:   &reduceSlice{&bloomKeysSlice{keysName, keys, maxKeys}, reduceName, bloomKeysCombiner},
+		fpRate: fpRate,
+	}
+}
+
+func (f *filterKeysSlice) Name() Name             { return f.name }
+func (*filterKeysSlice) Combiner() slicefunc.Func { return slicefunc.Nil }
+
+func (f *filterKeysSlice) NumDep() int {
+	if f.keys == nil {
+		return 1
+	}
+	return 2
+}
+
+func (f *filterKeysSlice) Dep(i int) Dep {
+	switch i {
+	case 0:
+		return singleDep(i, f.Slice, false)
+	case 1:
+		return Dep{Slice: f.keys, Shuffle: true, Broadcast: true}
+	}
+	panic(fmt.Sprintf("invalid dependency %d", i))
+}
+
+type filterKeysReader struct {
+	op     *filterKeysSlice
+	reader sliceio.Reader
+	// keys reads the broadcast keys from which filter is built on the
+	// first read. The filter remains nil if the keys overflowed, in
+	// which case every row is retained.
+	keys   *broadcastArgs
+	filter *bloom.Filter
+	buf    frame.Frame
+	err    error
+}
+
+func (f *filterKeysReader) Read(ctx context.Context, out frame.Frame) (n int, err error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	if !slicetype.Assignable(out, f.op) {
+		return 0, errTypeError
+	}
+	if f.keys != nil {
+		if f.err = f.keys.Init(ctx); f.err != nil {
+			return 0, f.err
+		}
+		keys := &bloomKeys{}
+		for _, k := range f.keys.values[1].Interface().([]*bloomKeys) {
+			keys = mergeBloomKeys(keys, k)
+		}
+		if !keys.Overflow {
+			f.filter = bloom.New(f.op, len(keys.Hashes), f.op.fpRate)
+			for _, h := range keys.Hashes {
+				f.filter.InsertHash(uint32(h>>32), uint32(h))
+			}
+		}
+		f.keys = nil
+	}
+	if f.filter == nil {
+		return f.reader.Read(ctx, out)
+	}
+	max := out.Len()
+	for n < max && f.err == nil {
+		if f.buf.IsZero() {
+			f.buf = frame.Make(f.op, max, max)
+		}
+		var m int
+		m, f.err = f.reader.Read(ctx, f.buf.Slice(0, max-n))
+		for i := 0; i < m; i++ {
+			if f.filter.Test(f.buf, i) {
+				frame.Copy(out.Slice(n, n+1), f.buf.Slice(i, i+1))
+				n++
+			}
+		}
+	}
+	return n, f.err
+}
+
+func (f *filterKeysSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	r := &filterKeysReader{op: f, reader: deps[0], filter: f.filter}
+	if f.keys != nil {
+		r.keys = &broadcastArgs{typ: f.keys, reader: deps[1]}
+	}
+	return r
+}
+
+// bloomKeys is a set of key hashes, from which a Bloom filter is
+// built. A set that exceeds Max keys overflows: it retains no hashes,
+// and no filter is built from it.
+type bloomKeys struct {
+	// Hashes holds the distinct key hashes, each packing the two base
+	// hashes of bloom.Hash.
+	Hashes   []uint64
+	Max      int
+	Overflow bool
+}
+
+// mergeBloomKeys returns the union of the provided key sets.
+func mergeBloomKeys(a, b *bloomKeys) *bloomKeys {
+	max := a.Max
+	if b.Max > max {
+		max = b.Max
+	}
+	if a.Overflow || b.Overflow {
+		return &bloomKeys{Max: max, Overflow: true}
+	}
+	var (
+		merged = &bloomKeys{Max: max}
+		seen   = make(map[uint64]bool, len(a.Hashes)+len(b.Hashes))
+	)
+	for _, hashes := range [][]uint64{a.Hashes, b.Hashes} {
+		for _, h := range hashes {
+			if seen[h] {
+				continue
+			}
+			seen[h] = true
+			if len(merged.Hashes) == max {
+				return &bloomKeys{Max: max, Overflow: true}
+			}
+			merged.Hashes = append(merged.Hashes, h)
+		}
+	}
+	return merged
+}
+
+// bloomKeysSlice collects the distinct key hashes of each shard of a
+// slice, producing a single row for each shard, keyed by 0.
+type bloomKeysSlice struct {
+	name Name
+	Slice
+	max int
+}
+
+func (b *bloomKeysSlice) Name() Name             { return b.name }
+func (*bloomKeysSlice) NumOut() int              { return 2 }
+func (*bloomKeysSlice) Prefix() int              { return 1 }
+func (*bloomKeysSlice) ShardType() ShardType     { return HashShard }
+func (*bloomKeysSlice) NumDep() int              { return 1 }
+func (b *bloomKeysSlice) Dep(i int) Dep          { return singleDep(i, b.Slice, false) }
+func (*bloomKeysSlice) Combiner() slicefunc.Func { return slicefunc.Nil }
+
+func (*bloomKeysSlice) Out(i int) reflect.Type {
+	if i == 0 {
+		return typeOfInt
+	}
+	return typeOfBloomKeys
+}
+
+func (b *bloomKeysSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	return &bloomKeysReader{op: b, reader: deps[0]}
+}
+
+type bloomKeysReader struct {
+	op     *bloomKeysSlice
+	reader sliceio.Reader
+	done   bool
+}
+
+func (r *bloomKeysReader) Read(ctx context.Context, out frame.Frame) (int, error) {
+	if !slicetype.Assignable(out, r.op) {
+		return 0, errTypeError
+	}
+	if r.done {
+		return 0, sliceio.EOF
+	}
+	var (
+		in   = frame.Make(r.op.Slice, defaultChunksize, defaultChunksize)
+		keys = &bloomKeys{Max: r.op.max}
+		seen = make(map[uint64]bool)
+	)
+	for !keys.Overflow {
+		n, err := r.reader.Read(ctx, in)
+		if err != nil && err != sliceio.EOF {
+			return 0, err
+		}
+		for i := 0; i < n; i++ {
+			h1, h2 := bloom.Hash(in, i)
+			h := uint64(h1)<<32 | uint64(h2)
+			if seen[h] {
+				continue
+			}
+			if len(keys.Hashes) == keys.Max {
+				// There are too many keys to filter by; the remaining
+				// rows need not be read.
+				keys = &bloomKeys{Max: keys.Max, Overflow: true}
+				break
+			}
+			seen[h] = true
+			keys.Hashes = append(keys.Hashes, h)
+		}
+		if err == sliceio.EOF {
+			break
+		}
+	}
+	r.done = true
+	if len(keys.Hashes) == 0 && !keys.Overflow {
+		return 0, sliceio.EOF
+	}
+	out.Interface(0).([]int)[0] = 0
+	out.Interface(1).([]*bloomKeys)[0] = keys
+	return 1, sliceio.EOF
+}
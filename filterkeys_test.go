@@ -0,0 +1,44 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"testing"
+
+	"github.com/grailbio/bigslice"
+	"github.com/grailbio/bigslice/bloom"
+	"github.com/grailbio/bigslice/frame"
+)
+
+func TestFilterKeys(t *testing.T) {
+	const N = 1000
+	keys := make([]int, N)
+	vals := make([]string, N)
+	for i := range keys {
+		keys[i] = i
+		vals[i] = "x"
+	}
+	small := frame.Slices([]int{3, 500, 999})
+	filter := bloom.New(small, small.Len(), 0.0001)
+	for i := 0; i < small.Len(); i++ {
+		filter.Insert(small, i)
+	}
+	slice := bigslice.Const(4, keys, vals)
+	slice = bigslice.FilterKeys(slice, filter)
+	assertEqual(t, slice, false, []int{3, 500, 999}, []string{"x", "x", "x"})
+
+	// A nil filter does not filter.
+	slice = bigslice.Const(4, keys, vals)
+	if got, want := bigslice.FilterKeys(slice, nil), slice; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestFilterKeysError(t *testing.T) {
+	filter := bloom.New(frame.Slices([]string{}), 1, 0.01)
+	expectTypeError(t, "filterkeys: filter is not compatible with the keys of slice type slice[1]int,string", func() {
+		bigslice.FilterKeys(bigslice.Const(1, []int{}, []string{}), filter)
+	})
+}
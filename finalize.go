@@ -0,0 +1,20 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import "context"
+
+// A FinalizerSlice is a slice with side effects that must be completed
+// once all of its shards have been computed and committed, e.g., to
+// publish a manifest of the data written by its shards. Finalize is
+// called once, by the driver, after an invocation that computes the
+// slice has completed successfully; it is not called if the invocation
+// fails. Since the slice's shards may instead have been read from a
+// cache, Finalize must be idempotent.
+type FinalizerSlice interface {
+	Slice
+	// Finalize completes the slice's side effects.
+	Finalize(ctx context.Context) error
+}
@@ -0,0 +1,189 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"container/heap"
+	"context"
+	"reflect"
+
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/slicefunc"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/slicetype"
+	"github.com/grailbio/bigslice/sortio"
+	"github.com/grailbio/bigslice/typecheck"
+)
+
+type flattenSortedSlice struct {
+	name Name
+	Pragmas
+	Slice
+	out  slicetype.Type
+	less slicefunc.Func
+}
+
+// FlattenSorted returns a slice that merges the (sorted) sub-slices of
+// every row of the provided single-column slice into a single sorted
+// stream. Unlike Flatmap, which expands each row independently,
+// FlattenSorted k-way merges the sub-slices of all rows in a shard so
+// that the shard's output is in sorted order.
+//
+// Each sub-slice must already be sorted. If less is nil, elements are
+// ordered by their natural order, and the element type must be
+// comparable (see frame.CanCompare); otherwise less must be a function
+// of the form:
+//
+//	func(a, b t) bool
+//
+// which reports whether a sorts before b.
+//
+// FlattenSorted operates on each shard independently: the output is
+// sorted within each shard, but no ordering is implied across shard
+// boundaries. The rows of a shard are buffered in memory while they are
+// merged.
+//
+// Schematically:
+//
+//	FlattenSorted(Slice<[]t>, func(a, b t) bool) Slice<t>
+func FlattenSorted(slice Slice, less interface{}, prags ...Pragma) Slice {
+	if slice.NumOut() != 1 {
+		typecheck.Panicf(1, "flattensorted: expected a single column, got %d", slice.NumOut())
+	}
+	col := slice.Out(0)
+	if col.Kind() != reflect.Slice {
+		typecheck.Panicf(1, "flattensorted: column type %s is not a slice", col)
+	}
+	elem := col.Elem()
+	f := new(flattenSortedSlice)
+	f.name = MakeName("flattensorted")
+	f.Slice = slice
+	f.Pragmas = prags
+	f.out = slicetype.New(elem)
+	if less == nil {
+		if !frame.CanCompare(elem) {
+			typecheck.Panicf(1, "flattensorted: element type %s cannot be sorted; provide a less function", elem)
+		}
+		return f
+	}
+	fn, ok := slicefunc.Of(less)
+	if !ok {
+		typecheck.Panicf(1, "flattensorted: invalid less function %T", less)
+	}
+	expectArg := slicetype.New(elem, elem)
+	expectRet := slicetype.New(reflect.TypeOf(false))
+	if !typecheck.Equal(fn.In, expectArg) || !typecheck.Equal(fn.Out, expectRet) {
+		typecheck.Panicf(1, "flattensorted: expected %s, got %T", slicetype.Signature(expectArg, expectRet), less)
+	}
+	f.less = fn
+	return f
+}
+
+func (f *flattenSortedSlice) Name() Name             { return f.name }
+func (f *flattenSortedSlice) NumOut() int            { return f.out.NumOut() }
+func (f *flattenSortedSlice) Out(c int) reflect.Type { return f.out.Out(c) }
+func (*flattenSortedSlice) Prefix() int              { return 1 }
+func (*flattenSortedSlice) ShardType() ShardType     { return HashShard }
+func (*flattenSortedSlice) NumDep() int              { return 1 }
+func (f *flattenSortedSlice) Dep(i int) Dep          { return singleDep(i, f.Slice, false) }
+func (*flattenSortedSlice) Combiner() slicefunc.Func { return slicefunc.Nil }
+
+type flattenSortedReader struct {
+	op     *flattenSortedSlice
+	reader sliceio.Reader
+	heap   *sortio.FrameBufferHeap
+	err    error
+}
+
+// init reads the whole shard and initializes the merge heap with one
+// frame buffer per (nonempty) row.
+func (f *flattenSortedReader) init(ctx context.Context) error {
+	var rows []reflect.Value
+	in := frame.Make(f.op.Slice, defaultChunksize, defaultChunksize)
+	for {
+		n, err := f.reader.Read(ctx, in)
+		if err != nil && err != sliceio.EOF {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			// The frame is reused across reads, so we must copy each
+			// row's slice header before retaining it.
+			if v := in.Index(0, i); v.Len() > 0 {
+				rows = append(rows, reflect.ValueOf(v.Interface()))
+			}
+		}
+		if err == sliceio.EOF {
+			break
+		}
+	}
+	f.heap = new(sortio.FrameBufferHeap)
+	f.heap.Buffers = make([]*sortio.FrameBuffer, len(rows))
+	for i, v := range rows {
+		f.heap.Buffers[i] = &sortio.FrameBuffer{
+			Frame:  frame.Values([]reflect.Value{v}),
+			Reader: sliceio.EmptyReader{},
+			Len:    v.Len(),
+			Off:    i,
+		}
+	}
+	if f.op.less.IsNil() {
+		// Maintain a compare buffer that's used to compare values across
+		// the per-row buffers.
+		lessBuf := frame.Make(f.op, 2, 2).WithKeyPolicy(frame.ContextKeyPolicy(ctx))
+		f.heap.LessFunc = func(i, j int) bool {
+			ib, jb := f.heap.Buffers[i], f.heap.Buffers[j]
+			lessBuf.Index(0, 0).Set(ib.Frame.Index(0, ib.Index))
+			lessBuf.Index(0, 1).Set(jb.Frame.Index(0, jb.Index))
+			return lessBuf.Less(0, 1)
+		}
+	} else {
+		args := make([]reflect.Value, 2)
+		f.heap.LessFunc = func(i, j int) bool {
+			ib, jb := f.heap.Buffers[i], f.heap.Buffers[j]
+			args[0] = ib.Frame.Index(0, ib.Index)
+			args[1] = jb.Frame.Index(0, jb.Index)
+			return f.op.less.Call(ctx, args)[0].Bool()
+		}
+	}
+	heap.Init(f.heap)
+	return nil
+}
+
+func (f *flattenSortedReader) Read(ctx context.Context, out frame.Frame) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	if !slicetype.Assignable(out, f.op) {
+		return 0, errTypeError
+	}
+	if f.heap == nil {
+		if f.err = f.init(ctx); f.err != nil {
+			return 0, f.err
+		}
+	}
+	var (
+		n   int
+		max = out.Len()
+	)
+	for n < max && len(f.heap.Buffers) > 0 {
+		buf := f.heap.Buffers[0]
+		out.Index(0, n).Set(buf.Frame.Index(0, buf.Index))
+		n++
+		buf.Index++
+		if buf.Index == buf.Len {
+			heap.Remove(f.heap, 0)
+		} else {
+			heap.Fix(f.heap, 0)
+		}
+	}
+	if n == 0 {
+		f.err = sliceio.EOF
+	}
+	return n, f.err
+}
+
+func (f *flattenSortedSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	return &flattenSortedReader{op: f, reader: deps[0]}
+}
@@ -0,0 +1,76 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"testing"
+
+	"github.com/grailbio/bigslice"
+	"github.com/grailbio/bigslice/slicetest"
+)
+
+func TestFlattenSorted(t *testing.T) {
+	rows := [][]int{{1, 4, 7, 10}, {}, {2, 5}, {3, 6, 8, 9}, {0}}
+	slice := bigslice.Const(1, rows)
+	slice = bigslice.FlattenSorted(slice, nil)
+	assertEqual(t, slice, false, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10})
+
+	// Reverse order, using a user-supplied less function.
+	rows = [][]int{{7, 4, 1}, {8, 5, 2}, {9, 6, 3}}
+	slice = bigslice.Const(1, rows)
+	slice = bigslice.FlattenSorted(slice, func(a, b int) bool { return a > b })
+	assertEqual(t, slice, false, []int{9, 8, 7, 6, 5, 4, 3, 2, 1})
+
+	slice = bigslice.Const(1, [][]int{})
+	slice = bigslice.FlattenSorted(slice, nil)
+	assertEqual(t, slice, false, []int{})
+
+	// Shards that span several chunks of rows.
+	const N = 5000
+	rows = make([][]int, N)
+	want := make([]int, 2*N)
+	for i := range rows {
+		rows[i] = []int{i, N + i}
+	}
+	for i := range want {
+		want[i] = i
+	}
+	slice = bigslice.Const(1, rows)
+	slice = bigslice.FlattenSorted(slice, nil)
+	assertEqual(t, slice, false, want)
+}
+
+func TestFlattenSortedError(t *testing.T) {
+	rows := [][]int{{1}}
+	ints := []int{1}
+	expectTypeError(t, "flattensorted: column type int is not a slice", func() { bigslice.FlattenSorted(bigslice.Const(1, ints), nil) })
+	expectTypeError(t, "flattensorted: expected a single column, got 2", func() { bigslice.FlattenSorted(bigslice.Const(1, rows, ints), nil) })
+	expectTypeError(t, "flattensorted: expected func(int, int) bool, got func(int) bool", func() {
+		bigslice.FlattenSorted(bigslice.Const(1, rows), func(int) bool { return false })
+	})
+	type unordered struct{ x int }
+	expectTypeError(t, "flattensorted: element type bigslice_test.unordered cannot be sorted; provide a less function", func() {
+		bigslice.FlattenSorted(bigslice.Const(1, [][]unordered{}), nil)
+	})
+}
+
+func ExampleFlattenSorted() {
+	slice := bigslice.Const(1, [][]string{
+		{"a", "d", "g"},
+		{"b", "e"},
+		{"c", "f", "h"},
+	})
+	slice = bigslice.FlattenSorted(slice, nil)
+	slicetest.Print(slice)
+	// Output:
+	// a
+	// b
+	// c
+	// d
+	// e
+	// f
+	// g
+	// h
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package frame
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/grailbio/base/errors"
+)
+
+// The builtin types (see ops_builtin.go) are encoded with a
+// fixed-layout binary codec instead of gob: each vector is encoded as
+// a single gob-encoded byte slice. Fixed-size values are stored in
+// little-endian order; int, uint, and uintptr values are always stored
+// in 8 bytes, so that encoded data is portable across architectures.
+// Strings are stored as a sequence of uvarint-encoded lengths followed
+// by the concatenation of the strings' bytes.
+
+// binaryKey is the session key for the scratch buffer used by the
+// binary codec.
+var binaryKey = FreshKey()
+
+// binaryScratch returns a scratch buffer of n bytes, reused within
+// the session s.
+func binaryScratch(s Session, n int) []byte {
+	var p *[]byte
+	s.State(binaryKey, &p)
+	if cap(*p) < n {
+		*p = make([]byte, n)
+	}
+	return (*p)[:n]
+}
+
+// decodeBinary decodes a binary-encoded vector of n bytes from dec.
+func decodeBinary(dec Decoder, n int) ([]byte, error) {
+	var p *[]byte
+	if dec.State(binaryKey, &p) {
+		*p = []byte{}
+	}
+	*p = (*p)[:0]
+	if err := dec.Decode(p); err != nil {
+		return nil, err
+	}
+	if len(*p) != n {
+		return nil, errors.E(errors.Integrity,
+			fmt.Sprintf("binary codec: decoded %d bytes, expected %d", len(*p), n))
+	}
+	return *p, nil
+}
+
+// encodeStrings encodes a vector of strings.
+func encodeStrings(enc Encoder, slice []string) error {
+	n := len(slice) * binary.MaxVarintLen64
+	for _, s := range slice {
+		n += len(s)
+	}
+	b := binaryScratch(enc, n)
+	n = 0
+	for _, s := range slice {
+		n += binary.PutUvarint(b[n:], uint64(len(s)))
+	}
+	for _, s := range slice {
+		n += copy(b[n:], s)
+	}
+	return enc.Encode(b[:n])
+}
+
+// decodeStrings decodes a vector of strings encoded by encodeStrings.
+func decodeStrings(dec Decoder, slice []string) error {
+	var p *[]byte
+	if dec.State(binaryKey, &p) {
+		*p = []byte{}
+	}
+	*p = (*p)[:0]
+	if err := dec.Decode(p); err != nil {
+		return err
+	}
+	var (
+		b    = *p
+		lens = make([]int, len(slice))
+		off  int
+	)
+	for i := range lens {
+		n, m := binary.Uvarint(b[off:])
+		if m <= 0 {
+			return errors.E(errors.Integrity, "binary codec: invalid string length")
+		}
+		off += m
+		lens[i] = int(n)
+	}
+	for i, n := range lens {
+		if n < 0 || n > len(b)-off {
+			return errors.E(errors.Integrity, "binary codec: string exceeds encoded data")
+		}
+		slice[i] = string(b[off : off+n])
+		off += n
+	}
+	if off != len(b) {
+		return errors.E(errors.Integrity, "binary codec: extra data after strings")
+	}
+	return nil
+}
@@ -87,13 +87,18 @@ type Frame struct {
 
 	// Prefix is the index of the last column in the frame's prefix.
 	prefix int
+
+	// Policy is the key policy by which the frame's keys are ordered.
+	// See WithKeyPolicy.
+	policy KeyPolicy
 }
 
 // Empty is the empty frame.
 var Empty = Frame{data: make([]data, 0)}
 
 // Make returns a new frame with the provided type, length, and
-// capacity.
+// capacity. If types is a Frame, the returned frame shares its key
+// policy.
 func Make(types slicetype.Type, len, cap int) Frame {
 	if len < 0 || len > cap {
 		panic("frame.Make: invalid len, cap")
@@ -104,6 +109,9 @@ func Make(types slicetype.Type, len, cap int) Frame {
 		cap:    cap,
 		prefix: types.Prefix() - 1,
 	}
+	if g, ok := types.(Frame); ok {
+		f.policy = g.policy
+	}
 	for i := range f.data {
 		v := reflect.MakeSlice(reflect.SliceOf(types.Out(i)), cap, cap)
 		f.data[i] = newData(v)
@@ -249,6 +257,7 @@ func (f Frame) Slice(i, j int) Frame {
 		j - i,
 		f.cap - i,
 		f.prefix,
+		f.policy,
 	}
 }
 
@@ -370,13 +379,35 @@ func (f Frame) Zero() {
 func (f Frame) Less(i, j int) bool {
 	for col := 0; col < f.prefix; col++ {
 		switch {
-		case f.data[col].ops.Less(i+f.off, j+f.off):
+		case f.less(col, i, j):
 			return true
-		case f.data[col].ops.Less(j+f.off, i+f.off):
+		case f.less(col, j, i):
 			return false
 		}
 	}
-	return f.data[f.prefix].ops.Less(i+f.off, j+f.off)
+	return f.less(f.prefix, i, j)
+}
+
+// less compares rows i and j of column col, ordering nil pointers and
+// NaNs according to the frame's key policy.
+func (f Frame) less(col, i, j int) bool {
+	ops := &f.data[col].ops
+	i, j = i+f.off, j+f.off
+	if f.policy.NilLast && ops.isNil != nil {
+		if inil, jnil := ops.isNil(i), ops.isNil(j); inil || jnil {
+			return !inil && jnil
+		}
+	}
+	if f.policy.NaNFirst && ops.isNaN != nil {
+		if inan, jnan := ops.isNaN(i), ops.isNaN(j); inan || jnan {
+			// Nil pointers, which are not NaNs, retain their order.
+			if ops.isNil != nil && (ops.isNil(i) || ops.isNil(j)) {
+				return ops.Less(i, j)
+			}
+			return inan && !jnan
+		}
+	}
+	return ops.Less(i, j)
 }
 
 // Hash returns a 32-bit hash of the prefix columns of frame f with
@@ -11,6 +11,7 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"go/format"
 	"io/ioutil"
 	"log"
@@ -47,6 +48,11 @@ func main() {
 		Type        string
 		TypeCap     string
 		ValueMethod string
+		// Size is the size in bytes of the type's binary encoding;
+		// Put and Get are expressions that encode value v into, and
+		// decode a value from, the byte slice b at index k.
+		Size     int
+		Put, Get string
 	}
 	infos := make([]typeInfo, len(types))
 	for i, typ := range types {
@@ -64,6 +70,29 @@ func main() {
 		default:
 			log.Fatalf("no value method for type %s", typ)
 		}
+		switch typ {
+		case "string":
+		case "uint8", "int8":
+			infos[i].Size = 1
+			infos[i].Put = "b[k] = byte(v)"
+			infos[i].Get = typ + "(b[k])"
+		case "float32", "float64":
+			bits := typ[len("float"):]
+			infos[i].Size = 4
+			if bits == "64" {
+				infos[i].Size = 8
+			}
+			infos[i].Put = fmt.Sprintf("binary.LittleEndian.PutUint%s(b[k*%d:], math.Float%sbits(v))", bits, infos[i].Size, bits)
+			infos[i].Get = fmt.Sprintf("math.Float%sfrombits(binary.LittleEndian.Uint%s(b[k*%d:]))", bits, bits, infos[i].Size)
+		default:
+			bits := strings.TrimLeft(typ, "uintptr")
+			if bits == "" {
+				bits = "64"
+			}
+			infos[i].Size = map[string]int{"16": 2, "32": 4, "64": 8}[bits]
+			infos[i].Put = fmt.Sprintf("binary.LittleEndian.PutUint%s(b[k*%d:], uint%s(v))", bits, infos[i].Size, bits)
+			infos[i].Get = fmt.Sprintf("%s(binary.LittleEndian.Uint%s(b[k*%d:]))", typ, bits, infos[i].Size)
+		}
 	}
 	for _, file := range []string{"ops_builtin.go"} {
 		tmpl, err := template.ParseFiles(file + "template")
@@ -0,0 +1,208 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package frame
+
+import (
+	"context"
+	"math"
+	"reflect"
+)
+
+// KeyPolicy determines how floating point NaNs and nil pointers are
+// ordered when they appear in keys. Regardless of policy, all NaNs
+// compare as equal to each other (and hash equally), as do all nil
+// pointers, so that rows with NaN or nil keys are deterministically
+// assigned to shards, sorted, and grouped. Negative and positive
+// zeros likewise compare, and hash, as equal.
+//
+// Keys may be pointers to types that are comparable (or hashable):
+// non-nil pointers are compared (or hashed) by the values they point
+// to. Interface-typed keys are not supported.
+type KeyPolicy struct {
+	// NaNFirst orders NaNs before all other values. By default, NaNs
+	// are ordered after all other values.
+	NaNFirst bool
+	// NilLast orders nil pointers after all other values. By default,
+	// nil pointers are ordered before all other values.
+	NilLast bool
+}
+
+// WithKeyPolicy returns frame f with its keys ordered by the provided
+// policy. Frames sliced from the returned frame, or made from it (see
+// Make), share its policy. Frames are otherwise ordered by the default
+// (zero) policy. Since the policy affects only the order, and not the
+// hashes, of keys, it need only be set on frames that are sorted or
+// merged; all frames whose orders are combined must share a policy.
+func (f Frame) WithKeyPolicy(p KeyPolicy) Frame {
+	f.policy = p
+	return f
+}
+
+// KeyPolicy returns the key policy of frame f.
+func (f Frame) KeyPolicy() KeyPolicy { return f.policy }
+
+type keyPolicyKey struct{}
+
+// KeyPolicyContext returns a context that carries the provided key
+// policy, by which computations using the context order their frames'
+// keys (see ContextKeyPolicy).
+func KeyPolicyContext(ctx context.Context, p KeyPolicy) context.Context {
+	return context.WithValue(ctx, keyPolicyKey{}, p)
+}
+
+// ContextKeyPolicy returns the key policy carried by the provided
+// context, or the default policy if there is none.
+func ContextKeyPolicy(ctx context.Context) KeyPolicy {
+	p, _ := ctx.Value(keyPolicyKey{}).(KeyPolicy)
+	return p
+}
+
+// lessFloat64 orders x and y, ordering NaNs after all other values, as
+// by the default key policy. (Frames apply other policies.)
+func lessFloat64(x, y float64) bool {
+	if x < y {
+		return true
+	}
+	return x == x && y != y
+}
+
+func lessFloat32(x, y float32) bool {
+	return lessFloat64(float64(x), float64(y))
+}
+
+var (
+	nan64Bits = math.Float64bits(math.NaN())
+	nan32Bits = math.Float32bits(float32(math.NaN()))
+)
+
+// float64Bits returns the bits of x for hashing: NaNs and zeros,
+// which compare as equal, have the same bits.
+func float64Bits(x float64) uint64 {
+	switch {
+	case x != x:
+		return nan64Bits
+	case x == 0:
+		return 0
+	}
+	return math.Float64bits(x)
+}
+
+func float32Bits(x float32) uint32 {
+	switch {
+	case x != x:
+		return nan32Bits
+	case x == 0:
+		return 0
+	}
+	return math.Float32bits(x)
+}
+
+// makePointerOps returns ops for a slice of pointers whose element type
+// has registered ops. Elements are compared and hashed by loading the
+// values they point to into a scratch slice, which belongs to the
+// returned ops alone; nil pointers are ordered first, as by the
+// default key policy, and hash to a fixed value. Pointers are encoded
+// as a vector of presence bits followed by the vector of non-nil
+// values, so that nil pointers, which gob cannot encode in slices,
+// round-trip.
+func makePointerOps(typ reflect.Type, slice reflect.Value) Ops {
+	makeElem, ok := lookupOps(typ.Elem())
+	if !ok {
+		return Ops{}
+	}
+	elemSliceType := reflect.SliceOf(typ.Elem())
+	scratch := reflect.MakeSlice(elemSliceType, 2, 2)
+	elemOps := makeElem.Call([]reflect.Value{scratch})[0].Interface().(Ops)
+	// load loads the value pointed to by the pointer at index i into
+	// scratch index k, and returns whether the pointer is non-nil.
+	load := func(i, k int) bool {
+		p := slice.Index(i)
+		if p.IsNil() {
+			return false
+		}
+		scratch.Index(k).Set(p.Elem())
+		return true
+	}
+	ops := Ops{
+		isNil: func(i int) bool { return slice.Index(i).IsNil() },
+	}
+	if elemOps.isNaN != nil {
+		ops.isNaN = func(i int) bool { return load(i, 0) && elemOps.isNaN(0) }
+	}
+	if elemOps.Less != nil {
+		ops.Less = func(i, j int) bool {
+			iok, jok := load(i, 0), load(j, 1)
+			if iok && jok {
+				return elemOps.Less(0, 1)
+			}
+			return !iok && jok
+		}
+	}
+	if elemOps.HashWithSeed != nil {
+		ops.HashWithSeed = func(i int, seed uint32) uint32 {
+			if !load(i, 0) {
+				return hash32(0, seed)
+			}
+			return elemOps.HashWithSeed(0, seed)
+		}
+	}
+	ops.Encode = func(enc Encoder, i, j int) error {
+		var (
+			present = make([]bool, j-i)
+			vals    = reflect.MakeSlice(elemSliceType, 0, j-i)
+		)
+		for k := range present {
+			if p := slice.Index(i + k); !p.IsNil() {
+				present[k] = true
+				vals = reflect.Append(vals, p.Elem())
+			}
+		}
+		if err := enc.Encode(present); err != nil {
+			return err
+		}
+		if valOps := makeSliceOps(typ.Elem(), vals); valOps.Encode != nil {
+			return valOps.Encode(enc, 0, vals.Len())
+		}
+		return enc.Encode(vals.Interface())
+	}
+	ops.Decode = func(dec Decoder, i, j int) error {
+		var bools []bool
+		if err := dec.Decode(&bools); err != nil {
+			return err
+		}
+		var n int
+		for _, ok := range bools {
+			if ok {
+				n++
+			}
+		}
+		vals := reflect.MakeSlice(elemSliceType, n, n)
+		if valOps := makeSliceOps(typ.Elem(), vals); valOps.Decode != nil {
+			if err := valOps.Decode(dec, 0, n); err != nil {
+				return err
+			}
+		} else {
+			ptr := reflect.New(elemSliceType)
+			if err := dec.Decode(ptr.Interface()); err != nil {
+				return err
+			}
+			vals = ptr.Elem()
+		}
+		var v int
+		for k, ok := range bools {
+			p := slice.Index(i + k)
+			if !ok {
+				p.Set(reflect.Zero(typ))
+				continue
+			}
+			elem := reflect.New(typ.Elem())
+			elem.Elem().Set(vals.Index(v))
+			p.Set(elem)
+			v++
+		}
+		return nil
+	}
+	return ops
+}
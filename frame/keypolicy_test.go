@@ -0,0 +1,90 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package frame_test
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/sliceio"
+)
+
+func TestKeyPolicy(t *testing.T) {
+	nan := math.NaN()
+	floats := func(policy frame.KeyPolicy) []float64 {
+		f := frame.Slices([]float64{1, nan, math.Copysign(0, -1), -1, nan, 0}).WithKeyPolicy(policy)
+		if err := frame.CheckKeys(f); err != nil {
+			t.Error(err)
+		}
+		sort.Sort(f)
+		return f.Interface(0).([]float64)
+	}
+	isNaN := func(xs []float64) []bool {
+		b := make([]bool, len(xs))
+		for i, x := range xs {
+			b[i] = math.IsNaN(x)
+		}
+		return b
+	}
+	if got, want := isNaN(floats(frame.KeyPolicy{})), []bool{false, false, false, false, true, true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := isNaN(floats(frame.KeyPolicy{NaNFirst: true})), []bool{true, true, false, false, false, false}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	f := frame.Slices([]float64{nan, math.Float64frombits(math.Float64bits(nan) + 1)})
+	if f.Less(0, 1) || f.Less(1, 0) || f.Hash(0) != f.Hash(1) {
+		t.Error("NaNs are not equal")
+	}
+
+	a, b := "a", "b"
+	strs := func(policy frame.KeyPolicy) []*string {
+		f := frame.Slices([]*string{&b, nil, &a, nil}).WithKeyPolicy(policy)
+		if err := frame.CheckKeys(f); err != nil {
+			t.Error(err)
+		}
+		sort.Sort(f)
+		return f.Interface(0).([]*string)
+	}
+	if got, want := strs(frame.KeyPolicy{}), []*string{nil, nil, &a, &b}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := strs(frame.KeyPolicy{NilLast: true}), []*string{&a, &b, nil, nil}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Policies apply to the pointed-to values of pointer keys, and are
+	// shared by frames made from a frame.
+	ptrs := []*float64{&nan, nil, new(float64)}
+	pf := frame.Slices(ptrs).WithKeyPolicy(frame.KeyPolicy{NaNFirst: true, NilLast: true})
+	sorted := frame.Make(pf, len(ptrs), len(ptrs))
+	frame.Copy(sorted, pf)
+	sort.Sort(sorted)
+	if got, want := sorted.Interface(0).([]*float64), []*float64{&nan, ptrs[2], nil}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Pointer columns with nil pointers round-trip.
+	var (
+		buf bytes.Buffer
+		ctx = context.Background()
+		in  = frame.Slices([]*string{&a, nil, &b})
+		out = frame.Make(in, 3, 3)
+	)
+	if err := sliceio.NewEncodingWriter(&buf).Write(ctx, in); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sliceio.ReadFull(ctx, sliceio.NewDecodingReader(&buf), out); err != nil && err != sliceio.EOF {
+		t.Fatal(err)
+	}
+	if got, want := out.Interface(0).([]*string), in.Interface(0).([]*string); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
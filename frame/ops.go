@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"reflect"
 	"runtime"
+	"sort"
 	"sync"
 
 	"github.com/spaolacci/murmur3"
@@ -21,6 +22,11 @@ var (
 	makeOps   = map[reflect.Type]reflect.Value{}
 	locations = map[reflect.Type]string{}
 	typeOfOps = reflect.TypeOf((*Ops)(nil)).Elem()
+
+	// generatedOps holds the ops of types generated at run time (see
+	// RegisterGeneratedOps). They are kept apart from makeOps, which is
+	// populated only at init time and thus read without locking.
+	generatedOps sync.Map // reflect.Type -> reflect.Value
 )
 
 // Ops represents a set of operations on a single frame instance. Ops
@@ -32,7 +38,12 @@ type Ops struct {
 	// Less compares two indices of a slice.
 	Less func(i, j int) bool
 	// HashWithSeed computes a 32-bit hash, given a seed, of an index
-	// of a slice.
+	// of a slice. HashWithSeed must be consistent with Less: values
+	// that compare as equal (neither is less than the other) must hash
+	// equally, as hashes are used to assign rows to shards, and
+	// comparisons to merge rows with equal keys. Inconsistent
+	// implementations silently produce incorrect results; CheckKeys
+	// checks for such inconsistencies.
 	HashWithSeed func(i int, seed uint32) uint32
 
 	// Encode encodes a slice of the underlying vector. Encode is
@@ -47,6 +58,12 @@ type Ops struct {
 	// Swap swaps two elements in a slice. It is implemented generically
 	// and cannot be overridden by a user implementation.
 	swap func(i, j int)
+
+	// IsNaN and isNil report whether an element is a NaN or a nil
+	// pointer, whose order is determined by the key policy of the
+	// frame (see Frame.WithKeyPolicy). Less orders them by the default
+	// policy. They are defined only by the package's own ops.
+	isNaN, isNil func(i int) bool
 }
 
 // RegisterOps registers an ops implementation. The provided argument
@@ -83,9 +100,46 @@ func RegisterOps(make interface{}) {
 	}
 }
 
+// RegisterGeneratedOps registers an ops implementation, of the same
+// form as those registered by RegisterOps, for a type that is generated
+// at run time (e.g., by reflect.StructOf). Unlike RegisterOps, it may
+// be called while frames are in use, and it is idempotent: if ops have
+// already been registered for the type, they are retained, so that all
+// frames of a type share the same ops.
+func RegisterGeneratedOps(make interface{}) {
+	typ := reflect.TypeOf(make)
+	if typ.Kind() != reflect.Func || typ.NumIn() != 1 || typ.In(0).Kind() != reflect.Slice ||
+		typ.NumOut() != 1 || typ.Out(0) != typeOfOps {
+		panic("frame.RegisterGeneratedOps: bad type " + typ.String() + "; expected func([]t) frame.Ops")
+	}
+	elem := typ.In(0).Elem()
+	mu.Lock()
+	_, ok := makeOps[elem]
+	mu.Unlock()
+	if ok {
+		panic("frame.RegisterGeneratedOps: ops already registered for type " + elem.String())
+	}
+	generatedOps.LoadOrStore(elem, reflect.ValueOf(make))
+}
+
+// lookupOps returns the registered ops constructor for the provided
+// type, if any.
+func lookupOps(typ reflect.Type) (reflect.Value, bool) {
+	if make, ok := makeOps[typ]; ok {
+		return make, true
+	}
+	if make, ok := generatedOps.Load(typ); ok {
+		return make.(reflect.Value), true
+	}
+	return reflect.Value{}, false
+}
+
 func makeSliceOps(typ reflect.Type, slice reflect.Value) Ops {
-	make, ok := makeOps[typ]
+	make, ok := lookupOps(typ)
 	if !ok {
+		if typ.Kind() == reflect.Ptr {
+			return makePointerOps(typ, slice)
+		}
 		return Ops{}
 	}
 	ops := make.Call([]reflect.Value{slice})[0].Interface().(Ops)
@@ -105,6 +159,38 @@ func CanHash(typ reflect.Type) bool {
 	return makeSliceOps(typ, reflect.MakeSlice(reflect.SliceOf(typ), 0, 0)).HashWithSeed != nil
 }
 
+// CheckKeys checks that the prefix columns of frame f hash consistently
+// with their ordering: every pair of rows whose keys compare as equal
+// must have equal hashes. It returns an error describing the first
+// inconsistency found. CheckKeys sorts a copy of f, and is intended to
+// be used to debug custom Ops, e.g., in tests.
+func CheckKeys(f Frame) error {
+	n := f.Len()
+	g := Make(f, n, n)
+	Copy(g, f)
+	sort.Sort(g)
+	for i := 1; i < n; i++ {
+		if g.Less(i-1, i) {
+			continue
+		}
+		if h0, h1 := g.Hash(i-1), g.Hash(i); h0 != h1 {
+			return fmt.Errorf("frame: keys %s and %s compare as equal but have different hashes %x and %x",
+				keyString(g, i-1), keyString(g, i), h0, h1)
+		}
+	}
+	return nil
+}
+
+// keyString returns a string representation of the prefix columns of
+// row i of frame f.
+func keyString(f Frame, i int) string {
+	vals := make([]interface{}, f.Prefix())
+	for col := range vals {
+		vals[col] = f.Index(col, i).Interface()
+	}
+	return fmt.Sprint(vals)
+}
+
 func init() {
 	RegisterOps(func(slice [][]byte) Ops {
 		return Ops{
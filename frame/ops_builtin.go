@@ -3,6 +3,7 @@
 package frame
 
 import (
+	"encoding/binary"
 	"math"
 
 	"github.com/spaolacci/murmur3"
@@ -16,6 +17,12 @@ func init() {
 			HashWithSeed: func(i int, seed uint32) uint32 {
 				return murmur3.Sum32WithSeed([]byte(slice[i]), seed)
 			},
+			Encode: func(enc Encoder, i, j int) error {
+				return encodeStrings(enc, slice[i:j])
+			},
+			Decode: func(dec Decoder, i, j int) error {
+				return decodeStrings(dec, slice[i:j])
+			},
 		}
 	})
 
@@ -25,6 +32,23 @@ func init() {
 			HashWithSeed: func(i int, seed uint32) uint32 {
 				return hash64(uint64(slice[i]), seed)
 			},
+			Encode: func(enc Encoder, i, j int) error {
+				b := binaryScratch(enc, (j-i)*8)
+				for k, v := range slice[i:j] {
+					binary.LittleEndian.PutUint64(b[k*8:], uint64(v))
+				}
+				return enc.Encode(b)
+			},
+			Decode: func(dec Decoder, i, j int) error {
+				b, err := decodeBinary(dec, (j-i)*8)
+				if err != nil {
+					return err
+				}
+				for k := range slice[i:j] {
+					slice[i+k] = uint(binary.LittleEndian.Uint64(b[k*8:]))
+				}
+				return nil
+			},
 		}
 	})
 
@@ -34,6 +58,23 @@ func init() {
 			HashWithSeed: func(i int, seed uint32) uint32 {
 				return hash32(uint32(slice[i]), seed)
 			},
+			Encode: func(enc Encoder, i, j int) error {
+				b := binaryScratch(enc, (j-i)*1)
+				for k, v := range slice[i:j] {
+					b[k] = byte(v)
+				}
+				return enc.Encode(b)
+			},
+			Decode: func(dec Decoder, i, j int) error {
+				b, err := decodeBinary(dec, (j-i)*1)
+				if err != nil {
+					return err
+				}
+				for k := range slice[i:j] {
+					slice[i+k] = uint8(b[k])
+				}
+				return nil
+			},
 		}
 	})
 
@@ -43,6 +84,23 @@ func init() {
 			HashWithSeed: func(i int, seed uint32) uint32 {
 				return hash32(uint32(slice[i]), seed)
 			},
+			Encode: func(enc Encoder, i, j int) error {
+				b := binaryScratch(enc, (j-i)*2)
+				for k, v := range slice[i:j] {
+					binary.LittleEndian.PutUint16(b[k*2:], uint16(v))
+				}
+				return enc.Encode(b)
+			},
+			Decode: func(dec Decoder, i, j int) error {
+				b, err := decodeBinary(dec, (j-i)*2)
+				if err != nil {
+					return err
+				}
+				for k := range slice[i:j] {
+					slice[i+k] = uint16(binary.LittleEndian.Uint16(b[k*2:]))
+				}
+				return nil
+			},
 		}
 	})
 
@@ -52,6 +110,23 @@ func init() {
 			HashWithSeed: func(i int, seed uint32) uint32 {
 				return hash32(uint32(slice[i]), seed)
 			},
+			Encode: func(enc Encoder, i, j int) error {
+				b := binaryScratch(enc, (j-i)*4)
+				for k, v := range slice[i:j] {
+					binary.LittleEndian.PutUint32(b[k*4:], uint32(v))
+				}
+				return enc.Encode(b)
+			},
+			Decode: func(dec Decoder, i, j int) error {
+				b, err := decodeBinary(dec, (j-i)*4)
+				if err != nil {
+					return err
+				}
+				for k := range slice[i:j] {
+					slice[i+k] = uint32(binary.LittleEndian.Uint32(b[k*4:]))
+				}
+				return nil
+			},
 		}
 	})
 
@@ -61,6 +136,23 @@ func init() {
 			HashWithSeed: func(i int, seed uint32) uint32 {
 				return hash64(uint64(slice[i]), seed)
 			},
+			Encode: func(enc Encoder, i, j int) error {
+				b := binaryScratch(enc, (j-i)*8)
+				for k, v := range slice[i:j] {
+					binary.LittleEndian.PutUint64(b[k*8:], uint64(v))
+				}
+				return enc.Encode(b)
+			},
+			Decode: func(dec Decoder, i, j int) error {
+				b, err := decodeBinary(dec, (j-i)*8)
+				if err != nil {
+					return err
+				}
+				for k := range slice[i:j] {
+					slice[i+k] = uint64(binary.LittleEndian.Uint64(b[k*8:]))
+				}
+				return nil
+			},
 		}
 	})
 
@@ -70,6 +162,23 @@ func init() {
 			HashWithSeed: func(i int, seed uint32) uint32 {
 				return hash64(uint64(slice[i]), seed)
 			},
+			Encode: func(enc Encoder, i, j int) error {
+				b := binaryScratch(enc, (j-i)*8)
+				for k, v := range slice[i:j] {
+					binary.LittleEndian.PutUint64(b[k*8:], uint64(v))
+				}
+				return enc.Encode(b)
+			},
+			Decode: func(dec Decoder, i, j int) error {
+				b, err := decodeBinary(dec, (j-i)*8)
+				if err != nil {
+					return err
+				}
+				for k := range slice[i:j] {
+					slice[i+k] = int(binary.LittleEndian.Uint64(b[k*8:]))
+				}
+				return nil
+			},
 		}
 	})
 
@@ -79,6 +188,23 @@ func init() {
 			HashWithSeed: func(i int, seed uint32) uint32 {
 				return hash32(uint32(slice[i]), seed)
 			},
+			Encode: func(enc Encoder, i, j int) error {
+				b := binaryScratch(enc, (j-i)*1)
+				for k, v := range slice[i:j] {
+					b[k] = byte(v)
+				}
+				return enc.Encode(b)
+			},
+			Decode: func(dec Decoder, i, j int) error {
+				b, err := decodeBinary(dec, (j-i)*1)
+				if err != nil {
+					return err
+				}
+				for k := range slice[i:j] {
+					slice[i+k] = int8(b[k])
+				}
+				return nil
+			},
 		}
 	})
 
@@ -88,6 +214,23 @@ func init() {
 			HashWithSeed: func(i int, seed uint32) uint32 {
 				return hash32(uint32(slice[i]), seed)
 			},
+			Encode: func(enc Encoder, i, j int) error {
+				b := binaryScratch(enc, (j-i)*2)
+				for k, v := range slice[i:j] {
+					binary.LittleEndian.PutUint16(b[k*2:], uint16(v))
+				}
+				return enc.Encode(b)
+			},
+			Decode: func(dec Decoder, i, j int) error {
+				b, err := decodeBinary(dec, (j-i)*2)
+				if err != nil {
+					return err
+				}
+				for k := range slice[i:j] {
+					slice[i+k] = int16(binary.LittleEndian.Uint16(b[k*2:]))
+				}
+				return nil
+			},
 		}
 	})
 
@@ -97,6 +240,23 @@ func init() {
 			HashWithSeed: func(i int, seed uint32) uint32 {
 				return hash32(uint32(slice[i]), seed)
 			},
+			Encode: func(enc Encoder, i, j int) error {
+				b := binaryScratch(enc, (j-i)*4)
+				for k, v := range slice[i:j] {
+					binary.LittleEndian.PutUint32(b[k*4:], uint32(v))
+				}
+				return enc.Encode(b)
+			},
+			Decode: func(dec Decoder, i, j int) error {
+				b, err := decodeBinary(dec, (j-i)*4)
+				if err != nil {
+					return err
+				}
+				for k := range slice[i:j] {
+					slice[i+k] = int32(binary.LittleEndian.Uint32(b[k*4:]))
+				}
+				return nil
+			},
 		}
 	})
 
@@ -106,23 +266,76 @@ func init() {
 			HashWithSeed: func(i int, seed uint32) uint32 {
 				return hash64(uint64(slice[i]), seed)
 			},
+			Encode: func(enc Encoder, i, j int) error {
+				b := binaryScratch(enc, (j-i)*8)
+				for k, v := range slice[i:j] {
+					binary.LittleEndian.PutUint64(b[k*8:], uint64(v))
+				}
+				return enc.Encode(b)
+			},
+			Decode: func(dec Decoder, i, j int) error {
+				b, err := decodeBinary(dec, (j-i)*8)
+				if err != nil {
+					return err
+				}
+				for k := range slice[i:j] {
+					slice[i+k] = int64(binary.LittleEndian.Uint64(b[k*8:]))
+				}
+				return nil
+			},
 		}
 	})
 
 	RegisterOps(func(slice []float32) Ops {
 		return Ops{
-			Less: func(i, j int) bool { return slice[i] < slice[j] },
+			Less:  func(i, j int) bool { return lessFloat32(slice[i], slice[j]) },
+			isNaN: func(i int) bool { return slice[i] != slice[i] },
 			HashWithSeed: func(i int, seed uint32) uint32 {
-				return hash32(math.Float32bits(slice[i]), seed)
+				return hash32(float32Bits(slice[i]), seed)
+			},
+			Encode: func(enc Encoder, i, j int) error {
+				b := binaryScratch(enc, (j-i)*4)
+				for k, v := range slice[i:j] {
+					binary.LittleEndian.PutUint32(b[k*4:], math.Float32bits(v))
+				}
+				return enc.Encode(b)
+			},
+			Decode: func(dec Decoder, i, j int) error {
+				b, err := decodeBinary(dec, (j-i)*4)
+				if err != nil {
+					return err
+				}
+				for k := range slice[i:j] {
+					slice[i+k] = math.Float32frombits(binary.LittleEndian.Uint32(b[k*4:]))
+				}
+				return nil
 			},
 		}
 	})
 
 	RegisterOps(func(slice []float64) Ops {
 		return Ops{
-			Less: func(i, j int) bool { return slice[i] < slice[j] },
+			Less:  func(i, j int) bool { return lessFloat64(slice[i], slice[j]) },
+			isNaN: func(i int) bool { return slice[i] != slice[i] },
 			HashWithSeed: func(i int, seed uint32) uint32 {
-				return hash64(math.Float64bits(slice[i]), seed)
+				return hash64(float64Bits(slice[i]), seed)
+			},
+			Encode: func(enc Encoder, i, j int) error {
+				b := binaryScratch(enc, (j-i)*8)
+				for k, v := range slice[i:j] {
+					binary.LittleEndian.PutUint64(b[k*8:], math.Float64bits(v))
+				}
+				return enc.Encode(b)
+			},
+			Decode: func(dec Decoder, i, j int) error {
+				b, err := decodeBinary(dec, (j-i)*8)
+				if err != nil {
+					return err
+				}
+				for k := range slice[i:j] {
+					slice[i+k] = math.Float64frombits(binary.LittleEndian.Uint64(b[k*8:]))
+				}
+				return nil
 			},
 		}
 	})
@@ -133,6 +346,23 @@ func init() {
 			HashWithSeed: func(i int, seed uint32) uint32 {
 				return hash64(uint64(slice[i]), seed)
 			},
+			Encode: func(enc Encoder, i, j int) error {
+				b := binaryScratch(enc, (j-i)*8)
+				for k, v := range slice[i:j] {
+					binary.LittleEndian.PutUint64(b[k*8:], uint64(v))
+				}
+				return enc.Encode(b)
+			},
+			Decode: func(dec Decoder, i, j int) error {
+				b, err := decodeBinary(dec, (j-i)*8)
+				if err != nil {
+					return err
+				}
+				for k := range slice[i:j] {
+					slice[i+k] = uintptr(binary.LittleEndian.Uint64(b[k*8:]))
+				}
+				return nil
+			},
 		}
 	})
 
@@ -5,7 +5,9 @@
 package frame_test
 
 import (
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/grailbio/bigslice/frame"
@@ -26,10 +28,95 @@ func TestDoubleRegistration(t *testing.T) {
 		t.Fatal("expected panic")
 	}
 	if message, ok := message.(string); ok {
-		if !strings.HasPrefix(message, "frame.RegisterOps: ") || !strings.HasSuffix(message, "ops_test.go:17") {
+		if !strings.HasPrefix(message, "frame.RegisterOps: ") || !strings.HasSuffix(message, "ops_test.go:19") {
 			t.Errorf("wrong message %s", message)
 		}
 	} else {
 		t.Errorf("wrong type %T for panic", message)
 	}
 }
+
+func TestRegisterGeneratedOps(t *testing.T) {
+	typ := reflect.StructOf([]reflect.StructField{{Name: "X", Type: reflect.TypeOf(0)}})
+	makeOps := reflect.FuncOf([]reflect.Type{reflect.SliceOf(typ)}, []reflect.Type{reflect.TypeOf(frame.Ops{})}, false)
+	register := func(x int) {
+		frame.RegisterGeneratedOps(reflect.MakeFunc(makeOps, func(args []reflect.Value) []reflect.Value {
+			vec := args[0]
+			return []reflect.Value{reflect.ValueOf(frame.Ops{
+				Less: func(i, j int) bool {
+					return vec.Index(i).Field(0).Int()*int64(x) < vec.Index(j).Field(0).Int()*int64(x)
+				},
+			})}
+		}).Interface())
+	}
+	// Generated ops may be registered, repeatedly, while frames of the
+	// type are in use; the first registration is retained.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			register(1)
+			wg.Done()
+		}()
+		go func() {
+			frame.CanCompare(typ)
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	register(-1)
+	vec := reflect.MakeSlice(reflect.SliceOf(typ), 2, 2)
+	vec.Index(0).Field(0).SetInt(1)
+	vec.Index(1).Field(0).SetInt(2)
+	f := frame.Values([]reflect.Value{vec})
+	if !f.Less(0, 1) || f.Less(1, 0) {
+		t.Error("generated ops were replaced")
+	}
+
+	defer func() {
+		if e := recover(); e == nil {
+			t.Error("expected panic")
+		}
+	}()
+	frame.RegisterGeneratedOps(func(slice []testType) frame.Ops { return frame.Ops{} })
+}
+
+// insensitiveString is a string type that compares case-insensitively.
+// Its hash is case-insensitive only if hashInsensitive is true.
+type insensitiveString string
+
+var hashInsensitive bool
+
+func init() {
+	frame.RegisterOps(func(slice []insensitiveString) frame.Ops {
+		return frame.Ops{
+			Less: func(i, j int) bool {
+				return strings.ToLower(string(slice[i])) < strings.ToLower(string(slice[j]))
+			},
+			HashWithSeed: func(i int, seed uint32) uint32 {
+				s := string(slice[i])
+				if hashInsensitive {
+					s = strings.ToLower(s)
+				}
+				return frame.Slices([]string{s}).HashWithSeed(0, seed)
+			},
+		}
+	})
+}
+
+func TestCheckKeys(t *testing.T) {
+	defer func() {
+		hashInsensitive = false
+	}()
+	f := frame.Slices([]insensitiveString{"b", "A", "c", "a"}, []int{1, 2, 3, 4})
+	if err := frame.CheckKeys(f); err == nil || !strings.Contains(err.Error(), "compare as equal but have different hashes") {
+		t.Errorf("got %v, want inconsistency error", err)
+	}
+	hashInsensitive = true
+	if err := frame.CheckKeys(f); err != nil {
+		t.Error(err)
+	}
+	if err := frame.CheckKeys(frame.Slices([]string{"b", "a", "b"})); err != nil {
+		t.Error(err)
+	}
+}
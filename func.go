@@ -193,6 +193,16 @@ func FuncLocations() []string {
 	return locs
 }
 
+// FuncByIndex returns the Func with the provided index in the Funcs
+// registry, as referenced by Invocation.Func. It returns false if no
+// such Func is registered.
+func FuncByIndex(index uint64) (*FuncValue, bool) {
+	if index >= uint64(len(funcs)) {
+		return nil, false
+	}
+	return funcs[index], true
+}
+
 // Invocation represents an invocation of a Bigslice func of the same
 // binary. Invocations can be transmitted across process boundaries
 // and thus may be invoked by remote executors.
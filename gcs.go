@@ -0,0 +1,627 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/retry"
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/metrics"
+	"github.com/grailbio/bigslice/slicefunc"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/slicetype"
+	"github.com/grailbio/bigslice/typecheck"
+)
+
+// GCSObject describes an object in a Google Cloud Storage bucket.
+type GCSObject struct {
+	// Name is the name of the object within its bucket.
+	Name string
+	// Size is the size of the object, in bytes.
+	Size int64
+	// Generation is the generation (version) of the object, or 0 if it
+	// is unknown. Generations are required to read snapshots of ReadGCS
+	// slices.
+	Generation int64
+}
+
+// GCSClient is the subset of the Google Cloud Storage API used by
+// ReadGCS and WriteGCS. It is typically implemented by a thin adapter
+// of an authenticated *storage.Client of the Google Cloud client
+// library, so that ReadGCS and WriteGCS use the caller's credentials.
+// Adapters should report transient failures (e.g., rate limiting, or
+// server errors) as temporary errors (see errors.IsTemporary), so that
+// they are retried.
+type GCSClient interface {
+	// ListObjects returns the objects in the bucket whose names begin
+	// with the provided prefix.
+	ListObjects(ctx context.Context, bucket, prefix string) ([]GCSObject, error)
+	// NewRangeReader returns a reader of length bytes of the named
+	// object, beginning at the provided offset. If length is negative,
+	// the object is read through its end.
+	NewRangeReader(ctx context.Context, bucket, object string, offset, length int64) (io.ReadCloser, error)
+	// NewWriter returns a writer that creates (or replaces) the named
+	// object. The object is created only once the writer is
+	// successfully closed; writes are abandoned if the provided context
+	// is cancelled before then.
+	NewWriter(ctx context.Context, bucket, object string) (io.WriteCloser, error)
+}
+
+// A GCSGenerationClient is a GCSClient that can read specific
+// generations of objects, as required to read snapshots of ReadGCS
+// slices (see SnapshotSlice).
+type GCSGenerationClient interface {
+	GCSClient
+	// NewGenerationRangeReader is as NewRangeReader, but reads the
+	// provided generation of the named object.
+	NewGenerationRangeReader(ctx context.Context, bucket, object string, generation, offset, length int64) (io.ReadCloser, error)
+}
+
+func init() {
+	gob.Register([]GCSObject(nil))
+}
+
+var (
+	// GCSBytesRead counts the number of bytes read from GCS by ReadGCS
+	// slices.
+	GCSBytesRead = metrics.NewCounter()
+	// GCSBytesWritten counts the number of bytes written to GCS by
+	// WriteGCS slices.
+	GCSBytesWritten = metrics.NewCounter()
+	// GCSRetries counts the number of times reads of ReadGCS slices
+	// were resumed after a transient error.
+	GCSRetries = metrics.NewCounter()
+)
+
+// gcsSplitSize is the target size, in bytes, of each shard of an
+// uncompressed object read by ReadGCS.
+var gcsSplitSize int64 = 64 << 20
+
+// gcsRetryPolicy is the policy with which reads of ReadGCS slices are
+// resumed after transient errors.
+var gcsRetryPolicy = retry.MaxTries(retry.Backoff(time.Second, 30*time.Second, 2), 5)
+
+// A gcsSplit is a byte range of an object that is read by a single
+// shard. Compressed objects are never split.
+type gcsSplit struct {
+	object   string
+	beg, end int64
+	gzip     bool
+	// generation is the generation of the object that is read, if the
+	// slice reads a snapshot.
+	generation int64
+}
+
+type readGCSSlice struct {
+	name Name
+	Pragmas
+	client         GCSClient
+	bucket, prefix string
+	// objects are the objects read by the slice, in name order, as
+	// listed by the driver. They are set by SetManifest or SetSnapshot.
+	objects []GCSObject
+	splits  []gcsSplit
+}
+
+// ReadGCS returns a slice of the lines of the objects in the provided
+// Google Cloud Storage bucket whose names begin with prefix, read with
+// the provided client. Schematically:
+//
+//	ReadGCS(ctx, client, bucket, prefix) Slice<string>
+//
+// As with ReadTextFiles, objects are split by byte ranges (at line
+// boundaries) into shards of approximately 64MB each, except for
+// gzip-compressed objects (whose names end in ".gz"), which are read
+// by one shard each. Objects are listed once, by the driver, when an
+// invocation that reads the slice is run, and are assigned to shards
+// in name order, so that the slice's shards are stable for a given set
+// of objects. The listing is shipped to workers with the invocation
+// (see ManifestSlice), so the slice's shards are not known before the
+// invocation is run. The invocation fails if no objects are listed.
+//
+// Reads that fail with a temporary error are resumed from the line at
+// which they failed, with backoff, up to 5 times. Bytes read and
+// resumed reads are counted by GCSBytesRead and GCSRetries. Reads may
+// be rate limited by the ReadRateLimit pragma.
+//
+// ReadGCS slices are SnapshotSlices whose snapshots are listings of
+// the objects listed by the driver, including their generations: an
+// invocation that reads a snapshot reads exactly these generations of
+// these objects, regardless of objects that are added, replaced, or
+// removed while it runs. Snapshots require a GCSGenerationClient, and
+// that the listed objects have generations. ReadGCS slices are also
+// IncrementalSlices, which read only the objects that were added after
+// an earlier snapshot.
+func ReadGCS(ctx context.Context, client GCSClient, bucket, prefix string, prags ...Pragma) Slice {
+	return &readGCSSlice{
+		name:    MakeName("readgcs"),
+		Pragmas: prags,
+		client:  client,
+		bucket:  bucket,
+		prefix:  prefix,
+	}
+}
+
+// list lists the objects read by the slice, in name order.
+func (s *readGCSSlice) list(ctx context.Context) ([]GCSObject, error) {
+	objects, err := s.client.ListObjects(ctx, s.bucket, s.prefix)
+	if err != nil {
+		return nil, errors.E(fmt.Sprintf("%s: listing gs://%s/%s", s.name, s.bucket, s.prefix), err)
+	}
+	if len(objects) == 0 {
+		return nil, errors.E(errors.NotExist, fmt.Sprintf("%s: no objects in gs://%s/%s", s.name, s.bucket, s.prefix))
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	return objects, nil
+}
+
+// gcsSplits returns the splits of the provided objects. If generations
+// is true, the splits read the objects' generations.
+func gcsSplits(objects []GCSObject, generations bool) []gcsSplit {
+	var splits []gcsSplit
+	for _, obj := range objects {
+		var gen int64
+		if generations {
+			gen = obj.Generation
+		}
+		compressed := strings.HasSuffix(obj.Name, ".gz")
+		if compressed || obj.Size <= gcsSplitSize {
+			splits = append(splits, gcsSplit{obj.Name, 0, obj.Size, compressed, gen})
+			continue
+		}
+		for beg := int64(0); beg < obj.Size; beg += gcsSplitSize {
+			end := beg + gcsSplitSize
+			if end > obj.Size {
+				end = obj.Size
+			}
+			splits = append(splits, gcsSplit{obj.Name, beg, end, false, gen})
+		}
+	}
+	return splits
+}
+
+func (s *readGCSSlice) Name() Name             { return s.name }
+func (*readGCSSlice) NumOut() int              { return 1 }
+func (*readGCSSlice) Out(c int) reflect.Type   { return typeOfString }
+func (*readGCSSlice) Prefix() int              { return 1 }
+func (s *readGCSSlice) NumShard() int          { return len(s.splits) }
+func (*readGCSSlice) ShardType() ShardType     { return HashShard }
+func (*readGCSSlice) NumDep() int              { return 0 }
+func (*readGCSSlice) Dep(i int) Dep            { panic("no deps") }
+func (*readGCSSlice) Combiner() slicefunc.Func { return slicefunc.Nil }
+
+// Manifest implements ManifestSlice. The slice's manifest is the
+// listing of its objects.
+func (s *readGCSSlice) Manifest(ctx context.Context) (interface{}, error) {
+	return s.list(ctx)
+}
+
+// SetManifest implements ManifestSlice.
+func (s *readGCSSlice) SetManifest(token interface{}) error {
+	objects, ok := token.([]GCSObject)
+	if !ok {
+		return errors.E(errors.Invalid, fmt.Sprintf("%s: invalid manifest %T", s.name, token))
+	}
+	s.objects = objects
+	s.splits = gcsSplits(objects, false)
+	return nil
+}
+
+// Snapshot implements SnapshotSlice. The slice's snapshot is the
+// listing of its objects, including their generations.
+func (s *readGCSSlice) Snapshot(ctx context.Context) (interface{}, error) {
+	if _, ok := s.client.(GCSGenerationClient); !ok {
+		return nil, errors.E(errors.NotSupported, fmt.Sprintf("%s: client %T cannot read object generations", s.name, s.client))
+	}
+	objects, err := s.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range objects {
+		if obj.Generation == 0 {
+			return nil, errors.E(errors.NotSupported, fmt.Sprintf("%s: object gs://%s/%s has no generation", s.name, s.bucket, obj.Name))
+		}
+	}
+	return objects, nil
+}
+
+// SetSnapshot implements SnapshotSlice.
+func (s *readGCSSlice) SetSnapshot(token interface{}) error {
+	objects, ok := token.([]GCSObject)
+	if !ok {
+		return errors.E(errors.Invalid, fmt.Sprintf("%s: invalid snapshot %T", s.name, token))
+	}
+	if _, ok := s.client.(GCSGenerationClient); !ok {
+		return errors.E(errors.NotSupported, fmt.Sprintf("%s: client %T cannot read object generations", s.name, s.client))
+	}
+	s.objects = objects
+	s.splits = gcsSplits(objects, true)
+	return nil
+}
+
+// SetSince implements IncrementalSlice. Objects that are in the
+// earlier snapshot are not read; it is an error for them to have been
+// replaced since.
+func (s *readGCSSlice) SetSince(token interface{}) error {
+	since, ok := token.([]GCSObject)
+	if !ok {
+		return errors.E(errors.Invalid, fmt.Sprintf("%s: invalid snapshot %T", s.name, token))
+	}
+	generations := make(map[string]int64, len(since))
+	for _, obj := range since {
+		generations[obj.Name] = obj.Generation
+	}
+	var added []GCSObject
+	for _, obj := range s.objects {
+		gen, ok := generations[obj.Name]
+		if !ok {
+			added = append(added, obj)
+			continue
+		}
+		if gen != obj.Generation {
+			return errors.E(errors.Invalid, fmt.Sprintf("%s: object gs://%s/%s was replaced (generation %d, was %d)",
+				s.name, s.bucket, obj.Name, obj.Generation, gen))
+		}
+	}
+	s.splits = gcsSplits(added, true)
+	if len(s.splits) == 0 {
+		// Nothing was added: the slice has a single, empty shard.
+		s.splits = []gcsSplit{{}}
+	}
+	return nil
+}
+
+func (s *readGCSSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	split := s.splits[shard]
+	if split.object == "" {
+		return sliceio.EmptyReader{}
+	}
+	return withReadRateLimit(s.Pragmas, len(s.splits), &readGCSReader{op: s, shard: shard, split: split, pos: split.beg})
+}
+
+type readGCSReader struct {
+	op    *readGCSSlice
+	shard int
+	split gcsSplit
+	// opened indicates that the reader's object was opened, so that
+	// subsequent failures are not handled as missing shards.
+	opened bool
+
+	body io.ReadCloser
+	r    *bufio.Reader
+	// pos is the offset in the (uncompressed) object of the next line
+	// to be read.
+	pos     int64
+	retries int
+	err     error
+}
+
+// open opens the reader's object so that the next line read is the one
+// at offset pos. Reads of uncompressed objects begin at pos, except for
+// the beginning of a split, at which the reader discards the remainder
+// of the line that begins before the split. Compressed objects are
+// read from their beginning, discarding pos bytes of uncompressed data.
+func (r *readGCSReader) open(ctx context.Context) error {
+	var (
+		offset = r.pos
+		skip   bool
+	)
+	if r.split.gzip {
+		offset = 0
+	} else if r.pos == r.split.beg && r.split.beg > 0 {
+		offset, skip = r.split.beg-1, true
+	}
+	var (
+		body io.ReadCloser
+		err  error
+	)
+	if r.split.generation != 0 {
+		client := r.op.client.(GCSGenerationClient)
+		body, err = client.NewGenerationRangeReader(ctx, r.op.bucket, r.split.object, r.split.generation, offset, -1)
+	} else {
+		body, err = r.op.client.NewRangeReader(ctx, r.op.bucket, r.split.object, offset, -1)
+	}
+	if err != nil {
+		return err
+	}
+	r.body = body
+	var rd io.Reader = &gcsCountingReader{body, metrics.ContextScope(ctx)}
+	if r.split.gzip {
+		gz, err := gzip.NewReader(rd)
+		if err != nil {
+			return err
+		}
+		r.r = bufio.NewReader(gz)
+		_, err = io.CopyN(ioutil.Discard, r.r, r.pos)
+		return err
+	}
+	r.r = bufio.NewReader(rd)
+	if skip {
+		skipped, err := r.r.ReadString('\n')
+		r.pos += int64(len(skipped)) - 1
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *readGCSReader) close() {
+	if r.body != nil {
+		_ = r.body.Close()
+	}
+	r.body, r.r = nil, nil
+}
+
+// readLine reads the next line of the split, returning sliceio.EOF
+// when no more lines are available. Failed reads of partial lines do
+// not advance the reader, so that the line is read again once the
+// reader is reopened.
+func (r *readGCSReader) readLine() (string, error) {
+	if !r.split.gzip && r.pos >= r.split.end {
+		return "", sliceio.EOF
+	}
+	line, err := r.r.ReadString('\n')
+	switch {
+	case err == io.EOF && line == "":
+		return "", sliceio.EOF
+	case err != nil && err != io.EOF:
+		return "", err
+	}
+	r.pos += int64(len(line))
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+func (r *readGCSReader) Read(ctx context.Context, out frame.Frame) (n int, err error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if !slicetype.Assignable(out, r.op) {
+		return 0, errTypeError
+	}
+	defer func() {
+		if err != nil {
+			if err != sliceio.EOF {
+				err = errors.E(fmt.Sprintf("reading gs://%s/%s", r.op.bucket, r.split.object), err)
+			}
+			r.err = err
+			r.close()
+		}
+	}()
+	for n < out.Len() {
+		if r.r == nil {
+			if err = r.open(ctx); err == nil {
+				r.opened = true
+			}
+		}
+		var line string
+		if err == nil {
+			line, err = r.readLine()
+		}
+		switch {
+		case err == nil:
+			out.Index(0, n).SetString(line)
+			n++
+			continue
+		case err == sliceio.EOF:
+			return n, err
+		case !errors.IsTemporary(err) && err != io.ErrUnexpectedEOF:
+			if !r.opened {
+				source := fmt.Sprintf("gs://%s/%s", r.op.bucket, r.split.object)
+				err = missingShard(ctx, r.op.Pragmas, r.op.name, r.shard, len(r.op.splits), source, err)
+			}
+			return n, err
+		}
+		r.close()
+		if waitErr := retry.Wait(ctx, gcsRetryPolicy, r.retries); waitErr != nil {
+			return n, err
+		}
+		r.retries++
+		GCSRetries.Incr(metrics.ContextScope(ctx), 1)
+		err = nil
+	}
+	return n, nil
+}
+
+// gcsCountingReader counts the bytes read from GCS in GCSBytesRead.
+type gcsCountingReader struct {
+	r     io.Reader
+	scope *metrics.Scope
+}
+
+func (c *gcsCountingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	GCSBytesRead.Incr(c.scope, int64(n))
+	return n, err
+}
+
+type writeGCSSlice struct {
+	name Name
+	Slice
+	client GCSClient
+	bucket string
+	prefix string
+	write  slicefunc.Func
+	opts   writeOptions
+}
+
+// WriteGCS returns a slice that is functionally equivalent to the
+// input slice, writing each shard to an object named
+// "prefix-nnnn-of-mmmm" in the provided Google Cloud Storage bucket as
+// a side effect, with the provided client. The write function is as
+// for WriteFiles:
+//
+//	func(w io.Writer, col1 []col1Type, col2 []col2Type, ..., colN []colNType) error
+//
+// Like WriteFiles, WriteGCS provides exactly-once output despite task
+// retries: since GCS objects are created only when their writes are
+// completed, each task attempt writes its shard directly, and the
+// write is completed only once the executor has confirmed that the
+// attempt succeeded. Writes of failed attempts are abandoned. Bytes
+// written are counted by GCSBytesWritten. Options are as for
+// WriteFiles.
+func WriteGCS(slice Slice, client GCSClient, bucket, prefix string, write interface{}, opts ...WriteOption) Slice {
+	colTypElems := make([]string, slice.NumOut())
+	for i := range colTypElems {
+		colTypElems[i] = fmt.Sprintf("col%d %s", i+1, reflect.SliceOf(slice.Out(i)).String())
+	}
+	expectTyp := fmt.Sprintf("func(w io.Writer, %s) error", strings.Join(colTypElems, ", "))
+	fn, ok := slicefunc.Of(write)
+	if !ok || fn.In.NumOut() != 1+slice.NumOut() || fn.In.Out(0) != typeOfWriter {
+		typecheck.Panicf(1, "writegcs: invalid write function type %T; must be %s", write, expectTyp)
+	}
+	for i := 0; i < slice.NumOut(); i++ {
+		if reflect.SliceOf(slice.Out(i)) != fn.In.Out(i+1) {
+			typecheck.Panicf(1, "writegcs: invalid write function type %T; must be %s", write, expectTyp)
+		}
+	}
+	if fn.Out.NumOut() != 1 || fn.Out.Out(0) != typeOfError {
+		typecheck.Panicf(1, "writegcs: invalid write function type %T; must return error", write)
+	}
+	return &writeGCSSlice{MakeName("writegcs"), slice, client, bucket, prefix, fn, makeWriteOptions(opts)}
+}
+
+func (s *writeGCSSlice) Name() Name             { return s.name }
+func (*writeGCSSlice) NumDep() int              { return 1 }
+func (s *writeGCSSlice) Dep(i int) Dep          { return singleDep(i, s.Slice, false) }
+func (*writeGCSSlice) Combiner() slicefunc.Func { return slicefunc.Nil }
+
+func (s *writeGCSSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	r := &writeGCSReader{
+		op:     s,
+		reader: deps[0],
+		object: fmt.Sprintf("%s-%04d-of-%04d", s.prefix, shard, s.NumShard()),
+	}
+	if s.opts.stats {
+		r.stats = newStatsAccumulator(s)
+	}
+	return r
+}
+
+// writeGCSReader writes a shard to its object. It implements
+// sliceio.Committer: the object's write is completed on Commit, and
+// abandoned on Abort.
+type writeGCSReader struct {
+	op     *writeGCSSlice
+	reader sliceio.Reader
+	object string
+	// cancel cancels the object's write.
+	cancel func()
+	wc     io.WriteCloser
+	w      io.Writer
+	err    error
+	// stats accumulates the statistics of the written rows, if they
+	// are to be written.
+	stats *statsAccumulator
+}
+
+var _ sliceio.Committer = (*writeGCSReader)(nil)
+
+func (r *writeGCSReader) Read(ctx context.Context, out frame.Frame) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.wc == nil {
+		// The write outlives the task's reads: it is completed (or
+		// abandoned) by Commit (or Abort).
+		var wctx context.Context
+		wctx, r.cancel = context.WithCancel(context.Background())
+		if r.wc, r.err = r.op.client.NewWriter(wctx, r.op.bucket, r.object); r.err != nil {
+			r.cancel()
+			r.err = errors.E(fmt.Sprintf("writing gs://%s/%s", r.op.bucket, r.object), r.err)
+			return 0, r.err
+		}
+		r.w = &gcsCountingWriter{r.wc, metrics.ContextScope(ctx)}
+	}
+	n, err := r.reader.Read(ctx, out)
+	if err != nil && err != sliceio.EOF {
+		r.err = err
+		return n, err
+	}
+	args := append([]reflect.Value{reflect.ValueOf(r.w)}, out.Slice(0, n).Values()...)
+	if e := r.op.write.Call(ctx, args)[0].Interface(); e != nil {
+		if werr := e.(error); errors.IsTemporary(werr) {
+			r.err = werr
+		} else {
+			r.err = errors.E(errors.Fatal, werr)
+		}
+		return n, r.err
+	}
+	if r.stats != nil {
+		r.stats.add(out.Slice(0, n))
+	}
+	if err == sliceio.EOF {
+		r.err = sliceio.EOF
+	}
+	return n, err
+}
+
+// Commit implements sliceio.Committer by completing the object's
+// write, which creates the object, and then writing the object's
+// statistics, if any.
+func (r *writeGCSReader) Commit(ctx context.Context) error {
+	if r.wc == nil {
+		// The shard was never read.
+		return nil
+	}
+	defer r.cancel()
+	if err := r.wc.Close(); err != nil {
+		return errors.E(fmt.Sprintf("writing gs://%s/%s", r.op.bucket, r.object), err)
+	}
+	if r.stats == nil {
+		return nil
+	}
+	object := r.object + StatsSuffix
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wc, err := r.op.client.NewWriter(wctx, r.op.bucket, object)
+	if err == nil {
+		if err = encodeStats(wc, r.stats.Stats()); err != nil {
+			// Abandon the partially written object.
+			cancel()
+			_ = wc.Close()
+		} else {
+			err = wc.Close()
+		}
+	}
+	if err != nil {
+		return errors.E(fmt.Sprintf("writing gs://%s/%s", r.op.bucket, object), err)
+	}
+	return nil
+}
+
+// Abort implements sliceio.Committer by abandoning the object's write.
+func (r *writeGCSReader) Abort(ctx context.Context) error {
+	if r.wc == nil {
+		return nil
+	}
+	r.cancel()
+	_ = r.wc.Close()
+	return nil
+}
+
+// gcsCountingWriter counts the bytes written to GCS in GCSBytesWritten.
+type gcsCountingWriter struct {
+	w     io.Writer
+	scope *metrics.Scope
+}
+
+func (c *gcsCountingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	GCSBytesWritten.Incr(c.scope, int64(n))
+	return n, err
+}
@@ -0,0 +1,312 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/retry"
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/metrics"
+	"github.com/grailbio/bigslice/sliceio"
+)
+
+// fakeGCS is an in-memory GCSClient. Its readers fail with a temporary
+// error after reading a few bytes, as long as failures remain.
+type fakeGCS struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	failures int
+}
+
+func (f *fakeGCS) ListObjects(ctx context.Context, bucket, prefix string) ([]GCSObject, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var objects []GCSObject
+	for name, data := range f.objects {
+		if strings.HasPrefix(name, bucket+"/"+prefix) {
+			objects = append(objects, GCSObject{Name: strings.TrimPrefix(name, bucket+"/"), Size: int64(len(data))})
+		}
+	}
+	return objects, nil
+}
+
+func (f *fakeGCS) NewRangeReader(ctx context.Context, bucket, object string, offset, length int64) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.objects[bucket+"/"+object]
+	if !ok {
+		return nil, errors.E(errors.NotExist, object)
+	}
+	data = data[offset:]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+	var r io.Reader = bytes.NewReader(data)
+	if f.failures > 0 {
+		f.failures--
+		r = io.MultiReader(io.LimitReader(r, 7), errorReader{errors.E(errors.Temporary, "connection reset")})
+	}
+	return ioutil.NopCloser(r), nil
+}
+
+func (f *fakeGCS) NewWriter(ctx context.Context, bucket, object string) (io.WriteCloser, error) {
+	return &fakeGCSWriter{ctx: ctx, gcs: f, name: bucket + "/" + object}, nil
+}
+
+type errorReader struct{ err error }
+
+func (e errorReader) Read(p []byte) (int, error) { return 0, e.err }
+
+type fakeGCSWriter struct {
+	ctx  context.Context
+	gcs  *fakeGCS
+	name string
+	bytes.Buffer
+}
+
+func (w *fakeGCSWriter) Close() error {
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	w.gcs.mu.Lock()
+	w.gcs.objects[w.name] = w.Bytes()
+	w.gcs.mu.Unlock()
+	return nil
+}
+
+// listGCS applies the manifest of the provided ReadGCS slice, as the
+// driver does when the slice is run.
+func listGCS(ctx context.Context, t *testing.T, slice Slice) Slice {
+	t.Helper()
+	s := slice.(ManifestSlice)
+	token, err := s.Manifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetManifest(token); err != nil {
+		t.Fatal(err)
+	}
+	return slice
+}
+
+func TestReadGCS(t *testing.T) {
+	defer func(size int64, policy retry.Policy) {
+		gcsSplitSize, gcsRetryPolicy = size, policy
+	}(gcsSplitSize, gcsRetryPolicy)
+	gcsSplitSize = 50
+	gcsRetryPolicy = retry.MaxTries(retry.Backoff(time.Millisecond, time.Millisecond, 1), 5)
+
+	var (
+		want  []string
+		plain bytes.Buffer
+		gz    bytes.Buffer
+	)
+	w := gzip.NewWriter(&gz)
+	for i := 0; i < 100; i++ {
+		line := strconv.Itoa(i)
+		want = append(want, line)
+		if i%2 == 0 {
+			fmt.Fprintln(&plain, line)
+		} else {
+			fmt.Fprintln(w, line)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(want)
+	client := &fakeGCS{objects: map[string][]byte{
+		"bucket/data/plain.txt": plain.Bytes(),
+		"bucket/data/lines.gz":  gz.Bytes(),
+		"bucket/other":          []byte("other\n"),
+	}}
+
+	var (
+		scope metrics.Scope
+		ctx   = metrics.ScopedContext(context.Background(), &scope)
+	)
+	slice := listGCS(ctx, t, ReadGCS(ctx, client, "bucket", "data/"))
+	if got, want := slice.NumShard(), 1+(plain.Len()+49)/50; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Objects are assigned to shards in name order.
+	if got, want := slice.(*readGCSSlice).splits[0].object, "data/lines.gz"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	got, err := readTextFilesSlice(ctx, t, slice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := GCSBytesRead.Value(&scope), int64(plain.Len()+gz.Len()); got < want {
+		t.Errorf("got %v, want at least %v", got, want)
+	}
+
+	// Reads are resumed after transient errors.
+	scope.Reset(nil)
+	client.failures = 3
+	got, err = readTextFilesSlice(ctx, t, listGCS(ctx, t, ReadGCS(ctx, client, "bucket", "data/")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := GCSRetries.Value(&scope), int64(3); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Reads fail once the retry policy gives up.
+	client.failures = 100
+	if _, err = readTextFilesSlice(ctx, t, listGCS(ctx, t, ReadGCS(ctx, client, "bucket", "data/"))); err == nil || !strings.Contains(err.Error(), "connection reset") {
+		t.Errorf("got %v, want connection reset", err)
+	}
+}
+
+func TestReadGCSRateLimit(t *testing.T) {
+	var (
+		scope  metrics.Scope
+		ctx    = metrics.ScopedContext(context.Background(), &scope)
+		client = &fakeGCS{objects: map[string][]byte{
+			"bucket/data/a": []byte("a\nb\n"),
+			"bucket/data/c": []byte("c\n"),
+		}}
+	)
+	slice := listGCS(ctx, t, ReadGCS(ctx, client, "bucket", "data/", ReadRateLimit(RateLimit{RowsPerSec: 1000})))
+	if _, ok := slice.Reader(0, nil).(*rateLimitReader); !ok {
+		t.Fatal("ReadGCS reader is not rate limited")
+	}
+	got, err := readTextFilesSlice(ctx, t, slice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := SourceRateLimitedRows.Value(&scope), int64(3); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestReadGCSMissing(t *testing.T) {
+	var (
+		scope  metrics.Scope
+		ctx    = metrics.ScopedContext(context.Background(), &scope)
+		client = &fakeGCS{objects: map[string][]byte{
+			"bucket/data/a": []byte("a\n"),
+			"bucket/data/b": []byte("b\n"),
+			"bucket/data/c": []byte("c\n"),
+		}}
+	)
+	slice := listGCS(ctx, t, ReadGCS(ctx, client, "bucket", "data/", OnMissingShard(EmptyMissingShards, 0.5)))
+	// The object is deleted after it is listed.
+	delete(client.objects, "bucket/data/b")
+	got, err := readTextFilesSlice(ctx, t, slice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := SourceShardsEmpty.Value(&scope), int64(1); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	samples := MissingShards(&scope)
+	if got, want := len(samples), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := samples[0].Shards[0].Source, "gs://bucket/data/b"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Without the pragma, the read fails.
+	if _, err = readTextFilesSlice(ctx, t, listGCS(ctx, t, ReadGCS(ctx, client, "bucket", "data/"))); err != nil {
+		t.Fatal(err)
+	}
+	slice = listGCS(ctx, t, ReadGCS(ctx, client, "bucket", "data/"))
+	delete(client.objects, "bucket/data/c")
+	if _, err = readTextFilesSlice(ctx, t, slice); err == nil || !errors.Is(errors.NotExist, err) {
+		t.Errorf("got %v, want NotExist", err)
+	}
+}
+
+func TestWriteGCS(t *testing.T) {
+	var (
+		scope  metrics.Scope
+		ctx    = metrics.ScopedContext(context.Background(), &scope)
+		client = &fakeGCS{objects: make(map[string][]byte)}
+		input  = Const(2, []string{"a", "b", "c", "d"})
+	)
+	slice := WriteGCS(input, client, "bucket", "out/part", func(w io.Writer, ss []string) error {
+		for _, s := range ss {
+			if _, err := fmt.Fprintln(w, s); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, WriteStats())
+	for shard := 0; shard < slice.NumShard(); shard++ {
+		r := slice.Reader(shard, []sliceio.Reader{sliceio.FrameReader(frame.Slices([]string{fmt.Sprint(shard)}))})
+		f := frame.Make(slice, 3, 3)
+		for {
+			_, err := r.Read(ctx, f)
+			if err == sliceio.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		// The object is created only once the attempt is committed.
+		name := fmt.Sprintf("bucket/out/part-%04d-of-0002", shard)
+		if _, ok := client.objects[name]; ok {
+			t.Errorf("object %s created before commit", name)
+		}
+		committer := r.(sliceio.Committer)
+		if shard == 1 {
+			if err := committer.Abort(ctx); err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{name, name + StatsSuffix} {
+				if _, ok := client.objects[name]; ok {
+					t.Errorf("aborted object %s was created", name)
+				}
+			}
+			continue
+		}
+		if err := committer.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(client.objects[name]), fmt.Sprintf("%d\n", shard); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		var stats FileStats
+		if err := json.Unmarshal(client.objects[name+StatsSuffix], &stats); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := stats.Rows, int64(1); got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	if got, want := GCSBytesWritten.Value(&scope), int64(4); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,423 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/slicefunc"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/slicetype"
+	"github.com/grailbio/bigslice/typecheck"
+)
+
+// histogramSampleSize is the number of values sampled to estimate the
+// boundaries of equal-depth bins.
+const histogramSampleSize = 1 << 13
+
+var (
+	typeOfFloat64        = reflect.TypeOf(float64(0))
+	typeOfQuantileSample = reflect.TypeOf((*quantileSample)(nil))
+
+	// typeOfHistogram is the type of a Histogram: the bounds of each
+	// bin, as its prefix, and its count.
+	typeOfHistogram = prefixedType{slicetype.New(typeOfFloat64, typeOfFloat64, typeOfCount), 2}
+
+	histogramCombiner, _ = slicefunc.Of(func(a, b int64) int64 { return a + b })
+	sampleCombiner, _    = slicefunc.Of(mergeQuantileSamples)
+)
+
+// Bins specifies the bins into which Histogram counts values. Bins are
+// constructed by EqualWidth and EqualDepth.
+type Bins struct {
+	n int
+	// lo and hi are the range of equal-width bins.
+	lo, hi float64
+	// depth indicates that the bins are equal-depth.
+	depth bool
+}
+
+// EqualWidth returns Bins that divide the range [lo, hi) into n bins of
+// equal width. Values outside of the range are counted in two overflow
+// bins: values less than lo in the bin [-Inf, lo), and values greater
+// than or equal to hi in the bin [hi, +Inf). Equal-width bins are
+// counted in a single pass.
+func EqualWidth(n int, lo, hi float64) Bins {
+	return Bins{n: n, lo: lo, hi: hi}
+}
+
+// EqualDepth returns Bins that divide the range of values into at most
+// n bins that each hold approximately the same number of values. The
+// bins span the minimum to the maximum value; the last bin includes
+// its upper bound, the maximum value. The boundaries of the bins are
+// quantiles estimated from a uniform sample of the values, so that the
+// number of values in each bin deviates from the ideal by about
+// 1/sqrt(8192) ≈ 1% of the total; the counts themselves are exact.
+// Boundaries that coincide, e.g., because a value is repeated many
+// times, are merged, so that fewer than n bins may be returned.
+// Equal-depth bins require two passes over the values: one to sample
+// them, and another to count them.
+func EqualDepth(n int) Bins {
+	return Bins{n: n, depth: true}
+}
+
+// Histogram returns a slice that counts the values of column col of
+// the provided slice, which must be of an integer or floating point
+// type, in the provided bins. The returned slice has a row for each
+// nonempty bin, comprising its lower and upper bounds and the number of
+// values in it, with the bounds as its prefix. Schematically:
+//
+//	Histogram(Slice<t1, ..., tn>, col, bins) Slice<float64, float64, int64>
+//
+// Bins are half-open, [lo, hi), except as noted by EqualDepth. Values
+// are converted to float64 before they are binned; NaNs are not
+// counted. Rows are emitted in no particular order. Counts are combined
+// map-side, so that only a count for each bin of each shard is
+// shuffled.
+func Histogram(slice Slice, col int, bins Bins) Slice {
+	if col < 0 || col >= slice.NumOut() {
+		typecheck.Panicf(1, "histogram: column %d out of range for slice %s", col, slicetype.String(slice))
+	}
+	switch slice.Out(col).Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+	default:
+		typecheck.Panicf(1, "histogram: cannot bin values of type %s", slice.Out(col))
+	}
+	if bins.n < 1 {
+		typecheck.Panicf(1, "histogram: invalid number of bins %d", bins.n)
+	}
+	if !bins.depth && !(bins.lo < bins.hi && !math.IsInf(bins.lo, 0) && !math.IsInf(bins.hi, 0)) {
+		typecheck.Panicf(1, "histogram: invalid range [%v, %v)", bins.lo, bins.hi)
+	}
+	h := &histogramSlice{name: MakeName("histogram"), Slice: slice, col: col, bins: bins}
+	if bins.depth {
+		samples := &quantileSampleSlice{MakeName("histogram_sample"), slice, col}
+		h.samples = &reduceSlice{samples, MakeName("histogram_sample"), sampleCombiner}
+	}
+	return &reduceSlice{h, MakeName("histogram"), histogramCombiner}
+}
+
+// histogramSlice maps each value of a column of a slice to a row
+// comprising the bounds of the value's bin and a count of 1.
+type histogramSlice struct {
+	name Name
+	Slice
+	col  int
+	bins Bins
+	// samples is the reduced sample of the column's values from which
+	// the boundaries of equal-depth bins are computed. It is nil for
+	// equal-width bins.
+	samples Slice
+}
+
+func (h *histogramSlice) Name() Name             { return h.name }
+func (*histogramSlice) NumOut() int              { return typeOfHistogram.NumOut() }
+func (*histogramSlice) Out(i int) reflect.Type   { return typeOfHistogram.Out(i) }
+func (*histogramSlice) Prefix() int              { return typeOfHistogram.Prefix() }
+func (*histogramSlice) ShardType() ShardType     { return HashShard }
+func (*histogramSlice) Combiner() slicefunc.Func { return slicefunc.Nil }
+
+func (h *histogramSlice) NumDep() int {
+	if h.samples == nil {
+		return 1
+	}
+	return 2
+}
+
+func (h *histogramSlice) Dep(i int) Dep {
+	switch i {
+	case 0:
+		return singleDep(i, h.Slice, false)
+	case 1:
+		return Dep{Slice: h.samples, Shuffle: true, Broadcast: true}
+	}
+	panic(fmt.Sprintf("invalid dependency %d", i))
+}
+
+func (h *histogramSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	r := &histogramReader{op: h, reader: deps[0]}
+	if h.samples == nil {
+		r.edges = make([]float64, h.bins.n+1)
+		for i := range r.edges {
+			r.edges[i] = h.bins.lo + (h.bins.hi-h.bins.lo)*float64(i)/float64(h.bins.n)
+		}
+		r.edges[h.bins.n] = h.bins.hi
+	} else {
+		r.samples = &broadcastArgs{typ: h.samples, reader: deps[1]}
+	}
+	return r
+}
+
+type histogramReader struct {
+	op     *histogramSlice
+	reader sliceio.Reader
+	// samples reads the sample of an equal-depth histogram, from which
+	// edges are computed on the first read.
+	samples *broadcastArgs
+	// edges are the boundaries of the bins: bin i is [edges[i],
+	// edges[i+1]). If closed is set, the last bin also includes its
+	// upper bound.
+	edges  []float64
+	closed bool
+	in     frame.Frame
+	values []float64
+}
+
+func (r *histogramReader) Read(ctx context.Context, out frame.Frame) (int, error) {
+	if !slicetype.Assignable(out, r.op) {
+		return 0, errTypeError
+	}
+	if r.samples != nil {
+		if err := r.samples.Init(ctx); err != nil {
+			return 0, err
+		}
+		var sample *quantileSample
+		for _, s := range r.samples.values[1].Interface().([]*quantileSample) {
+			sample = mergeQuantileSamples(sample, s)
+		}
+		r.edges = sample.Edges(r.op.bins.n)
+		r.closed = true
+		r.samples = nil
+	}
+	if r.in.IsZero() {
+		r.in = frame.Make(r.op.Slice, out.Len(), out.Len())
+	} else {
+		r.in = r.in.Ensure(out.Len())
+	}
+	var (
+		los    = out.Interface(0).([]float64)
+		his    = out.Interface(1).([]float64)
+		counts = out.Interface(2).([]int64)
+	)
+	for {
+		n, err := r.reader.Read(ctx, r.in.Slice(0, out.Len()))
+		if err != nil && err != sliceio.EOF {
+			return 0, err
+		}
+		r.values = float64s(r.in.Value(r.op.col).Slice(0, n), r.values)
+		var m int
+		for _, v := range r.values {
+			if math.IsNaN(v) {
+				continue
+			}
+			los[m], his[m] = r.bin(v)
+			counts[m] = 1
+			m++
+		}
+		if m > 0 || err == sliceio.EOF {
+			return m, err
+		}
+	}
+}
+
+// bin returns the bounds of the bin of the provided value.
+func (r *histogramReader) bin(v float64) (lo, hi float64) {
+	k := len(r.edges) - 1
+	i := sort.Search(len(r.edges), func(i int) bool { return r.edges[i] > v }) - 1
+	switch {
+	case i < 0:
+		return math.Inf(-1), r.edges[0]
+	case i == k && r.closed && v == r.edges[k]:
+		return r.edges[k-1], r.edges[k]
+	case i == k:
+		return r.edges[k], math.Inf(1)
+	}
+	return r.edges[i], r.edges[i+1]
+}
+
+// float64s converts the provided vector of numbers to float64s,
+// returned in buf, which is reused if it has sufficient capacity.
+func float64s(vec reflect.Value, buf []float64) []float64 {
+	n := vec.Len()
+	if cap(buf) < n {
+		buf = make([]float64, n)
+	}
+	buf = buf[:n]
+	if vec.Type().Elem() == typeOfFloat64 {
+		copy(buf, vec.Interface().([]float64))
+		return buf
+	}
+	switch vec.Type().Elem().Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		for i := range buf {
+			buf[i] = float64(vec.Index(i).Int())
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		for i := range buf {
+			buf[i] = float64(vec.Index(i).Uint())
+		}
+	default:
+		for i := range buf {
+			buf[i] = vec.Index(i).Float()
+		}
+	}
+	return buf
+}
+
+// quantileSample is a uniform sample of a set of values, from which
+// their quantiles are estimated. Each value is assigned a random
+// priority, and the sample keeps the histogramSampleSize values with
+// the lowest priorities; samples are thus merged by keeping the values
+// with the lowest priorities of either. The sample also records the
+// exact minimum and maximum values.
+type quantileSample struct {
+	Min, Max   float64
+	Values     []float64
+	Priorities []uint64
+}
+
+// Len implements sort.Interface, ordering values by priority.
+func (s *quantileSample) Len() int { return len(s.Values) }
+
+// Less implements sort.Interface.
+func (s *quantileSample) Less(i, j int) bool { return s.Priorities[i] < s.Priorities[j] }
+
+// Swap implements sort.Interface.
+func (s *quantileSample) Swap(i, j int) {
+	s.Values[i], s.Values[j] = s.Values[j], s.Values[i]
+	s.Priorities[i], s.Priorities[j] = s.Priorities[j], s.Priorities[i]
+}
+
+// add adds the provided value, with the provided priority, to the
+// sample. The sample is compacted as it grows.
+func (s *quantileSample) add(v float64, priority uint64) {
+	if len(s.Values) == 0 || v < s.Min {
+		s.Min = v
+	}
+	if len(s.Values) == 0 || v > s.Max {
+		s.Max = v
+	}
+	s.Values = append(s.Values, v)
+	s.Priorities = append(s.Priorities, priority)
+	if len(s.Values) >= 2*histogramSampleSize {
+		s.compact()
+	}
+}
+
+// compact discards all but the histogramSampleSize values with the
+// lowest priorities.
+func (s *quantileSample) compact() {
+	if len(s.Values) <= histogramSampleSize {
+		return
+	}
+	sort.Sort(s)
+	s.Values = s.Values[:histogramSampleSize]
+	s.Priorities = s.Priorities[:histogramSampleSize]
+}
+
+// Edges returns the boundaries of at most n equal-depth bins estimated
+// from the sample. Edges returns nil if the sample is empty.
+func (s *quantileSample) Edges(n int) []float64 {
+	if s == nil || len(s.Values) == 0 {
+		return nil
+	}
+	values := append([]float64(nil), s.Values...)
+	sort.Float64s(values)
+	edges := []float64{s.Min}
+	for i := 1; i < n; i++ {
+		if v := values[i*len(values)/n]; v > edges[len(edges)-1] && v < s.Max {
+			edges = append(edges, v)
+		}
+	}
+	return append(edges, s.Max)
+}
+
+// mergeQuantileSamples returns the merge of the provided samples,
+// either of which may be nil. The samples are not modified.
+func mergeQuantileSamples(a, b *quantileSample) *quantileSample {
+	switch {
+	case a == nil || len(a.Values) == 0:
+		return b
+	case b == nil || len(b.Values) == 0:
+		return a
+	}
+	merged := &quantileSample{
+		Min:        math.Min(a.Min, b.Min),
+		Max:        math.Max(a.Max, b.Max),
+		Values:     append(append([]float64(nil), a.Values...), b.Values...),
+		Priorities: append(append([]uint64(nil), a.Priorities...), b.Priorities...),
+	}
+	merged.compact()
+	return merged
+}
+
+// quantileSampleSlice samples the values of a column of each shard of
+// a slice, producing a single row for each shard, keyed by 0.
+type quantileSampleSlice struct {
+	name Name
+	Slice
+	col int
+}
+
+func (q *quantileSampleSlice) Name() Name             { return q.name }
+func (*quantileSampleSlice) NumOut() int              { return 2 }
+func (*quantileSampleSlice) Prefix() int              { return 1 }
+func (*quantileSampleSlice) ShardType() ShardType     { return HashShard }
+func (*quantileSampleSlice) NumDep() int              { return 1 }
+func (q *quantileSampleSlice) Dep(i int) Dep          { return singleDep(i, q.Slice, false) }
+func (*quantileSampleSlice) Combiner() slicefunc.Func { return slicefunc.Nil }
+
+func (*quantileSampleSlice) Out(i int) reflect.Type {
+	if i == 0 {
+		return typeOfInt
+	}
+	return typeOfQuantileSample
+}
+
+func (q *quantileSampleSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	return &quantileSampleReader{op: q, reader: deps[0], shard: shard}
+}
+
+type quantileSampleReader struct {
+	op     *quantileSampleSlice
+	reader sliceio.Reader
+	shard  int
+	done   bool
+}
+
+func (r *quantileSampleReader) Read(ctx context.Context, out frame.Frame) (int, error) {
+	if !slicetype.Assignable(out, r.op) {
+		return 0, errTypeError
+	}
+	if r.done {
+		return 0, sliceio.EOF
+	}
+	var (
+		in     = frame.Make(r.op.Slice, defaultChunksize, defaultChunksize)
+		rand   = sampleRand(0, r.shard)
+		sample = new(quantileSample)
+		values []float64
+	)
+	for {
+		n, err := r.reader.Read(ctx, in)
+		if err != nil && err != sliceio.EOF {
+			return 0, err
+		}
+		values = float64s(in.Value(r.op.col).Slice(0, n), values)
+		for _, v := range values {
+			if !math.IsNaN(v) {
+				sample.add(v, rand.Uint64())
+			}
+		}
+		if err == sliceio.EOF {
+			break
+		}
+	}
+	r.done = true
+	if len(sample.Values) == 0 {
+		return 0, sliceio.EOF
+	}
+	sample.compact()
+	out.Interface(0).([]int)[0] = 0
+	out.Interface(1).([]*quantileSample)[0] = sample
+	return 1, sliceio.EOF
+}
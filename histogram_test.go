@@ -0,0 +1,128 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/grailbio/bigslice"
+)
+
+// binString formats the bounds of a histogram bin.
+func binString(lo, hi float64, count int64) (string, int64) {
+	return fmt.Sprint(lo, ":", hi), count
+}
+
+func TestHistogramEqualWidth(t *testing.T) {
+	var ints []int
+	for i := -5; i < 105; i++ {
+		ints = append(ints, i)
+	}
+	slice := bigslice.Const(5, ints)
+	slice = bigslice.Histogram(slice, 0, bigslice.EqualWidth(10, 0, 100))
+	if got, want := slice.Prefix(), 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	var (
+		bins   = []string{"-Inf:0", "100:+Inf"}
+		counts = []int64{5, 5}
+	)
+	for i := 0; i < 10; i++ {
+		bins = append(bins, fmt.Sprint(i*10, ":", (i+1)*10))
+		counts = append(counts, 10)
+	}
+	assertEqual(t, bigslice.Map(slice, binString), true, bins, counts)
+
+	// NaNs are not counted; other values are binned as float64s.
+	floats := []float64{math.NaN(), 0.25, 0.5, 0.75, math.Inf(1), math.NaN()}
+	slice = bigslice.Const(2, floats)
+	slice = bigslice.Histogram(slice, 0, bigslice.EqualWidth(2, 0, 1))
+	assertEqual(t, bigslice.Map(slice, binString), true,
+		[]string{"0:0.5", "0.5:1", "1:+Inf"}, []int64{1, 2, 1})
+}
+
+func TestHistogramEqualDepth(t *testing.T) {
+	floats := make([]float64, 1000)
+	for i := range floats {
+		floats[i] = float64(i)
+	}
+	rand.New(rand.NewSource(1)).Shuffle(len(floats), func(i, j int) {
+		floats[i], floats[j] = floats[j], floats[i]
+	})
+	// The sample holds all of the values, so the bins are exact. The
+	// last bin includes the maximum value.
+	slice := bigslice.Const(5, append([]float64{math.NaN()}, floats...))
+	slice = bigslice.Histogram(slice, 0, bigslice.EqualDepth(4))
+	assertEqual(t, bigslice.Map(slice, binString), true,
+		[]string{"0:250", "250:500", "500:750", "750:999"}, []int64{250, 250, 250, 250})
+
+	// Repeated values collapse bins.
+	slice = bigslice.Const(3, []int{1, 1, 1, 1, 1, 1, 2, 3})
+	slice = bigslice.Histogram(slice, 0, bigslice.EqualDepth(4))
+	assertEqual(t, bigslice.Map(slice, binString), true,
+		[]string{"1:2", "2:3"}, []int64{6, 2})
+}
+
+func TestHistogramEqualDepthSampled(t *testing.T) {
+	const (
+		N     = 100000
+		Nbins = 10
+	)
+	r := rand.New(rand.NewSource(1))
+	floats := make([]float64, N)
+	for i := range floats {
+		floats[i] = r.ExpFloat64()
+	}
+	slice := bigslice.Const(8, floats)
+	slice = bigslice.Histogram(slice, 0, bigslice.EqualDepth(Nbins))
+	ctx := context.Background()
+	for name, scanner := range run(ctx, t, slice) {
+		var (
+			lo, hi float64
+			count  int64
+			nbin   int
+			total  int64
+		)
+		for scanner.Scan(ctx, &lo, &hi, &count) {
+			nbin++
+			total += count
+			if count < N/Nbins*9/10 || count > N/Nbins*11/10 {
+				t.Errorf("%s: bin [%v, %v): got %v, want approximately %v", name, lo, hi, count, N/Nbins)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := nbin, Nbins; got != want {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+		if got, want := total, int64(N); got != want {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestHistogramType(t *testing.T) {
+	slice := bigslice.Const(1, []string{}, []int{})
+	expectTypeError(t, "histogram: column 2 out of range for slice slice[1]string,int", func() {
+		bigslice.Histogram(slice, 2, bigslice.EqualDepth(1))
+	})
+	expectTypeError(t, "histogram: cannot bin values of type string", func() {
+		bigslice.Histogram(slice, 0, bigslice.EqualDepth(1))
+	})
+	expectTypeError(t, "histogram: invalid number of bins 0", func() {
+		bigslice.Histogram(slice, 1, bigslice.EqualWidth(0, 0, 1))
+	})
+	expectTypeError(t, "histogram: invalid range [1, 1)", func() {
+		bigslice.Histogram(slice, 1, bigslice.EqualWidth(1, 1, 1))
+	})
+	expectTypeError(t, "histogram: invalid range [0, +Inf)", func() {
+		bigslice.Histogram(slice, 1, bigslice.EqualWidth(1, 0, math.Inf(1)))
+	})
+}
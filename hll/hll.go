@@ -0,0 +1,347 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package hll implements HyperLogLog sketches, which estimate the
+// number of distinct values in a multiset using a small, fixed amount
+// of memory. Sketches are mergeable: the merge of two sketches is the
+// sketch of the union of their multisets. Merging is associative,
+// commutative, and idempotent, so that sketches may be combined in any
+// order, any number of times.
+//
+// A sketch with precision p maintains m = 2^p registers. The relative
+// standard error of its estimates is approximately 1.04/sqrt(m): about
+// 1.6% for the default precision of 12 (4KiB of registers), and 0.8%
+// for precision 14 (16KiB). Estimates are within two standard errors
+// of the true count for about 95% of multisets. Estimates of small
+// counts (below about 2.5m) use linear counting, and are more accurate.
+//
+// Sketches of few values are stored sparsely, so that they are cheap
+// to maintain for many small groups; they are converted to dense
+// registers as they grow. Sketches are gob-encodable, using a compact
+// encoding, so that they may be passed through Bigslice shuffles.
+package hll
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"reflect"
+	"sort"
+
+	"github.com/grailbio/bigslice/frame"
+)
+
+const (
+	// MinPrecision and MaxPrecision are the smallest and largest
+	// precisions supported by sketches.
+	MinPrecision = 4
+	MaxPrecision = 18
+	// DefaultPrecision is a precision that balances memory use and
+	// accuracy for most uses.
+	DefaultPrecision = 12
+)
+
+// Seeds used to derive the two halves of each 64-bit value hash.
+const (
+	seed1 = 0x3c6ef372
+	seed2 = 0xa54ff53a
+)
+
+// A Sketch is a HyperLogLog sketch.
+type Sketch struct {
+	p uint8
+	// sparse holds the nonzero registers of a sparse sketch, each
+	// encoded as index<<rankBits | rank, ordered by index.
+	sparse []uint32
+	// dense holds all of the registers of a dense sketch; it is nil
+	// while the sketch is sparse.
+	dense []uint8
+}
+
+// rankBits is the number of bits used to store a register's rank: for
+// 64-bit hashes, ranks are at most 64-MinPrecision+1.
+const rankBits = 6
+
+// New returns a new, empty sketch with the provided precision, which
+// must be in [MinPrecision, MaxPrecision].
+func New(precision int) *Sketch {
+	if precision < MinPrecision || precision > MaxPrecision {
+		panic(fmt.Sprintf("hll.New: invalid precision %d", precision))
+	}
+	return &Sketch{p: uint8(precision)}
+}
+
+// Precision returns the precision of the sketch.
+func (s *Sketch) Precision() int { return int(s.p) }
+
+// m returns the number of registers of the sketch.
+func (s *Sketch) m() int { return 1 << s.p }
+
+// Hashes computes a 64-bit hash of all of the columns of each row of
+// f, storing the hash of the i'th row in hashes[i]. Hashes are computed
+// with the frame's hash functions, so that they are consistent across
+// processes.
+func Hashes(f frame.Frame, hashes []uint64) {
+	for i := range hashes[:f.Len()] {
+		hashes[i] = 0
+	}
+	for col := 0; col < f.NumOut(); col++ {
+		c := frame.Values([]reflect.Value{f.Value(col)})
+		for i := range hashes[:f.Len()] {
+			v := uint64(c.HashWithSeed(i, seed1))<<32 | uint64(c.HashWithSeed(i, seed2))
+			// Mix so that the hash depends on the order of the columns.
+			hashes[i] = mix(hashes[i]*0x9e3779b97f4a7c15 ^ v)
+		}
+	}
+}
+
+// mix is the finalizer of SplitMix64.
+func mix(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+// Insert adds the value with the provided 64-bit hash, e.g., as
+// computed by Hashes, to the sketch.
+func (s *Sketch) Insert(hash uint64) {
+	idx := uint32(hash >> (64 - s.p))
+	w := hash<<s.p | 1<<(s.p-1)
+	s.set(idx, uint8(bits.LeadingZeros64(w)+1))
+}
+
+// set raises the register idx to rank, if it is lower.
+func (s *Sketch) set(idx uint32, rank uint8) {
+	if s.dense != nil {
+		if rank > s.dense[idx] {
+			s.dense[idx] = rank
+		}
+		return
+	}
+	i := sort.Search(len(s.sparse), func(i int) bool { return s.sparse[i]>>rankBits >= idx })
+	if i < len(s.sparse) && s.sparse[i]>>rankBits == idx {
+		if uint32(rank) > s.sparse[i]&(1<<rankBits-1) {
+			s.sparse[i] = idx<<rankBits | uint32(rank)
+		}
+		return
+	}
+	s.sparse = append(s.sparse, 0)
+	copy(s.sparse[i+1:], s.sparse[i:])
+	s.sparse[i] = idx<<rankBits | uint32(rank)
+	s.maybeDensify()
+}
+
+// maybeDensify converts the sketch to dense registers once its sparse
+// representation is larger than the dense one.
+func (s *Sketch) maybeDensify() {
+	if 4*len(s.sparse) <= s.m() {
+		return
+	}
+	s.dense = make([]uint8, s.m())
+	for _, e := range s.sparse {
+		s.dense[e>>rankBits] = uint8(e & (1<<rankBits - 1))
+	}
+	s.sparse = nil
+}
+
+// Merge merges the sketch t into s, so that s becomes the sketch of
+// the union of the values of both. Both sketches must have the same
+// precision.
+func (s *Sketch) Merge(t *Sketch) {
+	if s.p != t.p {
+		panic(fmt.Sprintf("hll.Merge: sketches have different precisions %d and %d", s.p, t.p))
+	}
+	switch {
+	case t.dense != nil:
+		if s.dense == nil {
+			sparse := s.sparse
+			s.dense = append([]uint8(nil), t.dense...)
+			s.sparse = nil
+			for _, e := range sparse {
+				s.set(e>>rankBits, uint8(e&(1<<rankBits-1)))
+			}
+			return
+		}
+		for i, rank := range t.dense {
+			if rank > s.dense[i] {
+				s.dense[i] = rank
+			}
+		}
+	case s.dense != nil:
+		for _, e := range t.sparse {
+			s.set(e>>rankBits, uint8(e&(1<<rankBits-1)))
+		}
+	default:
+		s.sparse = mergeSparse(s.sparse, t.sparse)
+		s.maybeDensify()
+	}
+}
+
+// mergeSparse merges two ordered lists of sparse registers.
+func mergeSparse(a, b []uint32) []uint32 {
+	merged := make([]uint32, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		switch ia, ib := a[0]>>rankBits, b[0]>>rankBits; {
+		case ia < ib:
+			merged = append(merged, a[0])
+			a = a[1:]
+		case ib < ia:
+			merged = append(merged, b[0])
+			b = b[1:]
+		default:
+			e := a[0]
+			if b[0] > e {
+				e = b[0]
+			}
+			merged = append(merged, e)
+			a, b = a[1:], b[1:]
+		}
+	}
+	merged = append(merged, a...)
+	return append(merged, b...)
+}
+
+// Estimate returns the estimated number of distinct values inserted
+// into the sketch.
+func (s *Sketch) Estimate() uint64 {
+	m := float64(s.m())
+	var (
+		sum   float64
+		zeros int
+	)
+	if s.dense != nil {
+		for _, rank := range s.dense {
+			sum += math.Ldexp(1, -int(rank))
+			if rank == 0 {
+				zeros++
+			}
+		}
+	} else {
+		zeros = s.m() - len(s.sparse)
+		sum = float64(zeros)
+		for _, e := range s.sparse {
+			sum += math.Ldexp(1, -int(e&(1<<rankBits-1)))
+		}
+	}
+	estimate := alpha(s.m()) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// Use linear counting for small cardinalities.
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(math.Round(estimate))
+}
+
+// alpha returns the bias correction constant for m registers.
+func alpha(m int) float64 {
+	switch m {
+	case 16:
+		return 0.673
+	case 32:
+		return 0.697
+	case 64:
+		return 0.709
+	}
+	return 0.7213 / (1 + 1.079/float64(m))
+}
+
+// Encoding formats.
+const (
+	formatSparse = 1
+	formatDense  = 2
+)
+
+// GobEncode implements gob.GobEncoder. Sparse sketches are encoded as
+// delta-encoded register indices and their ranks; dense sketches pack
+// their registers in 6 bits each.
+func (s *Sketch) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(s.p)
+	if s.dense == nil {
+		buf.WriteByte(formatSparse)
+		writeUvarint(&buf, uint64(len(s.sparse)))
+		var last uint32
+		for _, e := range s.sparse {
+			idx := e >> rankBits
+			writeUvarint(&buf, uint64(idx-last))
+			buf.WriteByte(uint8(e & (1<<rankBits - 1)))
+			last = idx
+		}
+		return buf.Bytes(), nil
+	}
+	buf.WriteByte(formatDense)
+	packed := make([]byte, (len(s.dense)*rankBits+7)/8)
+	for i, rank := range s.dense {
+		off := i * rankBits
+		v := uint16(rank) << uint(off%8)
+		packed[off/8] |= byte(v)
+		if off/8+1 < len(packed) {
+			packed[off/8+1] |= byte(v >> 8)
+		}
+	}
+	buf.Write(packed)
+	return buf.Bytes(), nil
+}
+
+var errCorrupt = errors.New("hll: corrupt sketch encoding")
+
+// GobDecode implements gob.GobDecoder.
+func (s *Sketch) GobDecode(p []byte) error {
+	if len(p) < 2 || p[0] < MinPrecision || p[0] > MaxPrecision {
+		return errCorrupt
+	}
+	*s = Sketch{p: p[0]}
+	switch p[1] {
+	case formatSparse:
+		r := bytes.NewReader(p[2:])
+		n, err := binary.ReadUvarint(r)
+		if err != nil || n > uint64(s.m()) {
+			return errCorrupt
+		}
+		s.sparse = make([]uint32, n)
+		var idx uint64
+		for i := range s.sparse {
+			delta, err := binary.ReadUvarint(r)
+			if err != nil {
+				return errCorrupt
+			}
+			idx += delta
+			rank, err := r.ReadByte()
+			if err != nil || idx >= uint64(s.m()) || (i > 0 && delta == 0) || rank >= 1<<rankBits {
+				return errCorrupt
+			}
+			s.sparse[i] = uint32(idx)<<rankBits | uint32(rank)
+		}
+		if r.Len() != 0 {
+			return errCorrupt
+		}
+	case formatDense:
+		packed := p[2:]
+		if len(packed) != (s.m()*rankBits+7)/8 {
+			return errCorrupt
+		}
+		s.dense = make([]uint8, s.m())
+		for i := range s.dense {
+			off := i * rankBits
+			v := uint16(packed[off/8])
+			if off/8+1 < len(packed) {
+				v |= uint16(packed[off/8+1]) << 8
+			}
+			s.dense[i] = uint8(v>>uint(off%8)) & (1<<rankBits - 1)
+		}
+	default:
+		return errCorrupt
+	}
+	return nil
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	var p [binary.MaxVarintLen64]byte
+	buf.Write(p[:binary.PutUvarint(p[:], v)])
+}
@@ -0,0 +1,135 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package hll
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/grailbio/bigslice/frame"
+)
+
+func insertKeys(s *Sketch, from, to int) {
+	keys := make([]string, to-from)
+	for i := range keys {
+		keys[i] = fmt.Sprint("key", from+i)
+	}
+	hashes := make([]uint64, len(keys))
+	Hashes(frame.Slices(keys), hashes)
+	for _, h := range hashes {
+		s.Insert(h)
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	for _, precision := range []int{MinPrecision, 8, DefaultPrecision, 14} {
+		for _, n := range []int{0, 1, 10, 100, 1000, 10000, 100000} {
+			s := New(precision)
+			insertKeys(s, 0, n)
+			// Insert duplicates, which should not affect the estimate.
+			insertKeys(s, 0, n/2)
+			stderr := 1.04 / math.Sqrt(float64(int(1)<<uint(precision)))
+			got := float64(s.Estimate())
+			if math.Abs(got-float64(n)) > 4*stderr*float64(n)+0.5 {
+				t.Errorf("precision %d: got estimate %v, want %d±%.1f%%", precision, got, n, 400*stderr)
+			}
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	const N = 20000
+	var (
+		all   = New(DefaultPrecision)
+		parts = make([]*Sketch, 4)
+	)
+	insertKeys(all, 0, N)
+	for i := range parts {
+		parts[i] = New(DefaultPrecision)
+	}
+	// Part 0 remains sparse; the others become dense.
+	insertKeys(parts[0], 0, 100)
+	insertKeys(parts[1], 50, N/2)
+	insertKeys(parts[2], N/2, N)
+	insertKeys(parts[3], 0, N)
+	for _, order := range [][]int{{0, 1, 2, 3}, {3, 2, 1, 0}, {1, 0, 3, 2}} {
+		merged := New(DefaultPrecision)
+		for _, i := range order {
+			merged.Merge(parts[i])
+			// Merging is idempotent.
+			merged.Merge(parts[i])
+		}
+		if got, want := merged.Estimate(), all.Estimate(); got != want {
+			t.Errorf("order %v: got %v, want %v", order, got, want)
+		}
+	}
+	// Merging sparse sketches.
+	a, b, ab := New(DefaultPrecision), New(DefaultPrecision), New(DefaultPrecision)
+	insertKeys(a, 0, 20)
+	insertKeys(b, 10, 30)
+	insertKeys(ab, 0, 30)
+	a.Merge(b)
+	if got, want := a.Estimate(), ab.Estimate(); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMergePrecision(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic")
+		}
+	}()
+	New(8).Merge(New(10))
+}
+
+func TestHashes(t *testing.T) {
+	var (
+		f      = frame.Slices([]int{1, 2, 1}, []int{2, 1, 2})
+		hashes = make([]uint64, f.Len())
+	)
+	Hashes(f, hashes)
+	if hashes[0] == hashes[1] {
+		t.Error("hash does not depend on column order")
+	}
+	if hashes[0] != hashes[2] {
+		t.Error("hashes of equal rows differ")
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	for _, n := range []int{0, 1, 100, 100000} {
+		s := New(DefaultPrecision)
+		insertKeys(s, 0, n)
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(s); err != nil {
+			t.Fatal(err)
+		}
+		// Sparse sketches take a few bytes per value; dense ones 6 bits
+		// per register.
+		if max := 64 + 3*n + (1<<DefaultPrecision)*6/8; buf.Len() > max {
+			t.Errorf("n=%d: encoded size %d, want <= %d", n, buf.Len(), max)
+		}
+		var decoded *Sketch
+		if err := gob.NewDecoder(&buf).Decode(&decoded); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := decoded.Estimate(), s.Estimate(); got != want {
+			t.Errorf("n=%d: got %v, want %v", n, got, want)
+		}
+		// Decoded sketches remain mergeable.
+		decoded.Merge(s)
+		if got, want := decoded.Estimate(), s.Estimate(); got != want {
+			t.Errorf("n=%d: got %v, want %v", n, got, want)
+		}
+	}
+	var s Sketch
+	if err := s.GobDecode([]byte{DefaultPrecision, formatDense, 1, 2, 3}); err != errCorrupt {
+		t.Errorf("got %v, want %v", err, errCorrupt)
+	}
+}
@@ -55,7 +55,12 @@ func (r *writethroughReader) Read(ctx context.Context, frame frame.Frame) (int,
 		// Ideally we'd use the underlying context for each op here,
 		// but the way encoder is set up, we can't (understandably)
 		// pass a new writer for each encode.
-		r.enc = sliceio.NewEncodingWriter(r.file.Writer(backgroundcontext.Get()))
+		r.enc, err = sliceio.NewEncryptingWriter(ctx, r.file.Writer(backgroundcontext.Get()),
+			sliceio.ContextCodec(ctx), sliceio.ContextKeyProvider(ctx))
+		if err != nil {
+			r.file.Discard(backgroundcontext.Get())
+			return 0, err
+		}
 	}
 	n, err := r.Reader.Read(ctx, frame)
 	if err == nil || err == sliceio.EOF {
@@ -63,6 +68,10 @@ func (r *writethroughReader) Read(ctx context.Context, frame frame.Frame) (int,
 			return n, writeErr
 		}
 		if err == sliceio.EOF {
+			if closeErr := r.enc.Close(); closeErr != nil {
+				r.file.Discard(backgroundcontext.Get())
+				return n, closeErr
+			}
 			if closeErr := r.file.Close(ctx); closeErr != nil {
 				return n, closeErr
 			}
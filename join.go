@@ -0,0 +1,437 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/slicefunc"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/typecheck"
+)
+
+// An AdaptiveSlice is a slice whose plan is chosen at run time,
+// depending on the measured size of one of its inputs. Executors that
+// support adaptive plans first compute the input, count its rows (up
+// to the threshold), and then compile the plan returned by Plan in
+// place of the adaptive slice, passing a slice that reads the computed
+// input. The choice is recorded with the invocation, so that every
+// compilation of the invocation (e.g., by workers) chooses the same
+// plan given the same measured sizes.
+//
+// An adaptive slice's own Slice methods describe its default plan,
+// which must be equivalent to, and have the same type and number of
+// shards as, the plans returned by Plan.
+type AdaptiveSlice interface {
+	Slice
+	// Input returns the input whose size determines the slice's plan.
+	Input() Slice
+	// Threshold returns the maximum number of rows of an input that is
+	// considered to be small.
+	Threshold() int
+	// Plan returns the slice's plan, given a slice that reads its input
+	// and whether the input is small, i.e., has at most Threshold rows.
+	Plan(input Slice, small bool) Slice
+}
+
+type joinSlice struct {
+	name         Name
+	large, small Slice
+	threshold    int
+	// fpRate and maxKeys configure the Bloom filter with which large is
+	// pruned before a shuffle join (see BloomFilterKeys). Large is not
+	// pruned if fpRate is 0.
+	fpRate  float64
+	maxKeys int
+	// Slice is the join's default plan, a shuffle join.
+	Slice
+}
+
+// Join returns a slice that computes the inner join of slices large
+// and small on their prefix columns: for each pair of rows, one from
+// each slice, with equal keys, the returned slice contains a row
+// comprising the key, followed by the non-key columns of the row of
+// large and then those of the row of small. Schematically:
+//
+//	Join(Slice<k1, ..., kp, t1, ..., tn>, Slice<k1, ..., kp, u1, ..., um>, threshold)
+//		Slice<k1, ..., kp, t1, ..., tn, u1, ..., um>
+//
+// Join chooses its strategy at run time, according to the size of
+// small. Small is computed first: if it has at most threshold rows, it
+// is broadcast to each shard of large, which is joined against it
+// without a shuffle (a broadcast join); otherwise both slices are
+// shuffled by key and joined as by Cogroup (a shuffle join). Either
+// way, the returned slice has the shards of large, and its rows are
+// not sorted. Since the choice depends only on the measured size of
+// small, it is deterministic for a given input. (Executors that do
+// not support adaptive plans always perform a shuffle join; see
+// AdaptiveSlice.)
+//
+// Both slices must have the same prefix, with key columns of the same
+// types, which must be comparable, and at least one non-key column.
+// Keys are compared by their frame operations (see frame.RegisterOps)
+// under either strategy, so that the strategies agree.
+//
+// Join accepts the BloomFilterKeys pragma, which configures the
+// shuffle join; other pragmas have no effect on joins.
+func Join(large, small Slice, threshold int, prags ...Pragma) Slice {
+	return join(2, MakeName("join"), Pragmas(prags), large, small, threshold)
+}
+
+type bloomFilterKeys struct {
+	fpRate  float64
+	maxKeys int
+}
+
+func (bloomFilterKeys) Procs() int        { return 1 }
+func (bloomFilterKeys) Exclusive() bool   { return false }
+func (bloomFilterKeys) Materialize() bool { return false }
+
+// BloomFilterKeys returns a pragma that causes a shuffle join (see
+// Join) to prune the rows of large whose keys do not match any key of
+// small before large is shuffled. The distinct keys of each shard of
+// small are collected, and merged into a Bloom filter with the
+// provided false positive rate, in a stage that precedes the join; the
+// filter is then broadcast to each shard of large. If small has more
+// than maxKeys distinct keys, the filter is not built, and large is
+// shuffled in full. The join's result is the same either way: pruning
+// only reduces the amount of data shuffled. Broadcast joins are not
+// affected. BloomFilterKeys has no effect on slices other than joins.
+func BloomFilterKeys(fpRate float64, maxKeys int) Pragma {
+	if fpRate <= 0 || fpRate >= 1 {
+		typecheck.Panicf(1, "bloomfilterkeys: invalid false positive rate %v", fpRate)
+	}
+	if maxKeys <= 0 {
+		typecheck.Panicf(1, "bloomfilterkeys: invalid maximum number of keys %d", maxKeys)
+	}
+	return bloomFilterKeys{fpRate, maxKeys}
+}
+
+// bloomFilterKeysOf returns the BloomFilterKeys pragma in p, if any.
+func bloomFilterKeysOf(p Pragma) (bloomFilterKeys, bool) {
+	switch p := p.(type) {
+	case bloomFilterKeys:
+		return p, true
+	case Pragmas:
+		for _, q := range p {
+			if b, ok := bloomFilterKeysOf(q); ok {
+				return b, true
+			}
+		}
+	}
+	return bloomFilterKeys{}, false
+}
+
+func join(calldepth int, name Name, prags Pragma, large, small Slice, threshold int) Slice {
+	if threshold < 0 {
+		typecheck.Panicf(calldepth, "join: invalid threshold %d", threshold)
+	}
+	if got, want := small.Prefix(), large.Prefix(); got != want {
+		typecheck.Panicf(calldepth, "join: prefix mismatch: expected %d but got %d", want, got)
+	}
+	for i, slice := range []Slice{large, small} {
+		if slice.NumOut() <= slice.Prefix() {
+			typecheck.Panicf(calldepth, "join: slice %d has no non-key columns", i)
+		}
+	}
+	for i := 0; i < large.Prefix(); i++ {
+		if got, want := small.Out(i), large.Out(i); got != want {
+			typecheck.Panicf(calldepth, "join: key column type mismatch: expected %s but got %s", want, got)
+		}
+		if typ := large.Out(i); !frame.CanCompare(typ) || !frame.CanHash(typ) {
+			typecheck.Panicf(calldepth, "join: key column(%d) type %s is not comparable", i, large.Out(i))
+		}
+	}
+	j := &joinSlice{name: name, large: large, small: small, threshold: threshold}
+	if b, ok := bloomFilterKeysOf(prags); ok {
+		j.fpRate = b.fpRate
+		j.maxKeys = b.maxKeys
+	}
+	j.Slice = j.Plan(small, false)
+	return j
+}
+
+func (j *joinSlice) Name() Name     { return j.name }
+func (j *joinSlice) Input() Slice   { return j.small }
+func (j *joinSlice) Threshold() int { return j.threshold }
+
+// Plan implements AdaptiveSlice. The plans' slices are named after the
+// join, so that they are named consistently wherever they are
+// compiled.
+func (j *joinSlice) Plan(small Slice, isSmall bool) Slice {
+	name := j.name
+	if isSmall {
+		name.Op = "broadcastjoin"
+		return &broadcastJoinSlice{name, j.large, small, j.threshold}
+	}
+	name.Op = "shufflejoin"
+	large := j.large
+	if j.fpRate > 0 {
+		large = filterKeysBy(name, large, small, j.fpRate, j.maxKeys)
+	}
+	c := cogroup(1, name, nil, []Slice{large, small}).(*cogroupSlice)
+	c.numShard = j.large.NumShard()
+	return &shuffleJoinSlice{name, j.large.NumOut() - j.large.Prefix(), j.large, small, c}
+}
+
+// joinType implements the type of a join of slices large and small.
+type joinType struct {
+	large, small Slice
+}
+
+func (t joinType) NumOut() int { return t.large.NumOut() + t.small.NumOut() - t.small.Prefix() }
+func (t joinType) Prefix() int { return t.large.Prefix() }
+
+func (t joinType) Out(i int) reflect.Type {
+	if i < t.large.NumOut() {
+		return t.large.Out(i)
+	}
+	return t.small.Out(i - t.large.NumOut() + t.small.Prefix())
+}
+
+// shuffleJoinSlice joins slices by expanding the groups of their
+// cogroup.
+type shuffleJoinSlice struct {
+	name Name
+	// nlarge is the number of non-key columns of the large slice.
+	nlarge       int
+	large, small Slice
+	*cogroupSlice
+}
+
+func (s *shuffleJoinSlice) Name() Name             { return s.name }
+func (s *shuffleJoinSlice) NumOut() int            { return joinType{s.large, s.small}.NumOut() }
+func (s *shuffleJoinSlice) Out(i int) reflect.Type { return joinType{s.large, s.small}.Out(i) }
+
+func (s *shuffleJoinSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	return &shuffleJoinReader{op: s, reader: s.cogroupSlice.Reader(shard, deps)}
+}
+
+// shuffleJoinReader emits the cross product of the groups of each of
+// the cogroup's keys.
+type shuffleJoinReader struct {
+	op     *shuffleJoinSlice
+	reader sliceio.Reader
+	err    error
+	// in buffers n cogrouped rows, of which row i is being expanded; a
+	// and b are the indices of the next pair of its grouped values.
+	in   frame.Frame
+	i, n int
+	a, b int
+}
+
+func (r *shuffleJoinReader) Read(ctx context.Context, out frame.Frame) (int, error) {
+	if r.in.IsZero() {
+		r.in = frame.Make(r.op.cogroupSlice, defaultChunksize, defaultChunksize)
+	}
+	var (
+		prefix = r.op.Prefix()
+		nlarge = r.op.nlarge
+		nsmall = r.op.NumOut() - prefix - nlarge
+		k      int
+	)
+	for k < out.Len() {
+		if r.i == r.n {
+			if r.err != nil {
+				break
+			}
+			r.n, r.err = r.reader.Read(ctx, r.in)
+			r.i, r.a, r.b = 0, 0, 0
+			if r.err != nil && r.err != sliceio.EOF {
+				return k, r.err
+			}
+			continue
+		}
+		na, nb := r.in.Index(prefix, r.i).Len(), r.in.Index(prefix+nlarge, r.i).Len()
+		if r.a >= na || nb == 0 {
+			r.i++
+			r.a, r.b = 0, 0
+			continue
+		}
+		for col := 0; col < prefix; col++ {
+			out.Index(col, k).Set(r.in.Index(col, r.i))
+		}
+		for col := 0; col < nlarge; col++ {
+			out.Index(prefix+col, k).Set(r.in.Index(prefix+col, r.i).Index(r.a))
+		}
+		for col := 0; col < nsmall; col++ {
+			out.Index(prefix+nlarge+col, k).Set(r.in.Index(prefix+nlarge+col, r.i).Index(r.b))
+		}
+		k++
+		if r.b++; r.b == nb {
+			r.a, r.b = r.a+1, 0
+		}
+	}
+	if k == 0 && r.err != nil {
+		return 0, r.err
+	}
+	return k, nil
+}
+
+// broadcastJoinSlice joins each shard of slice large against the
+// whole of slice small, which is broadcast to every shard.
+type broadcastJoinSlice struct {
+	name         Name
+	large, small Slice
+	maxRows      int
+}
+
+func (b *broadcastJoinSlice) Name() Name             { return b.name }
+func (b *broadcastJoinSlice) NumOut() int            { return joinType{b.large, b.small}.NumOut() }
+func (b *broadcastJoinSlice) Out(i int) reflect.Type { return joinType{b.large, b.small}.Out(i) }
+func (b *broadcastJoinSlice) Prefix() int            { return b.large.Prefix() }
+func (b *broadcastJoinSlice) NumShard() int          { return b.large.NumShard() }
+func (*broadcastJoinSlice) ShardType() ShardType     { return HashShard }
+func (*broadcastJoinSlice) NumDep() int              { return 2 }
+func (*broadcastJoinSlice) Combiner() slicefunc.Func { return slicefunc.Nil }
+
+func (b *broadcastJoinSlice) Dep(i int) Dep {
+	switch i {
+	case 0:
+		return Dep{Slice: b.large}
+	case 1:
+		return Dep{Slice: b.small, Shuffle: true, Broadcast: true}
+	}
+	panic(fmt.Sprintf("invalid dependency %d", i))
+}
+
+func (b *broadcastJoinSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	if len(deps) != 2 {
+		panic(fmt.Errorf("expected two deps, got %d", len(deps)))
+	}
+	return &broadcastJoinReader{
+		op:     b,
+		reader: deps[0],
+		small:  &broadcastReader{name: b.name, maxRows: b.maxRows, reader: deps[1]},
+	}
+}
+
+// broadcastJoinReader reads the broadcast rows of the small slice into
+// an index by key, and then emits, for each row of the large slice,
+// a row for each matching row of the small slice. Keys are hashed and
+// compared by the frame's operations, as they are by a shuffle join.
+type broadcastJoinReader struct {
+	op     *broadcastJoinSlice
+	reader sliceio.Reader
+	small  sliceio.Reader
+	err    error
+	// rows holds the small slice's rows, followed by a scratch row into
+	// which the key of the large slice's row being joined is copied,
+	// so that keys may be compared by the frame's operations. Index
+	// holds the indices of the small slice's rows by the hash of their
+	// keys.
+	rows  frame.Frame
+	index map[uint32][]int
+	// in buffers n rows of the large slice, of which row i is being
+	// joined with its jth match.
+	in      frame.Frame
+	i, n    int
+	j       int
+	matches []int
+}
+
+// keysEqual tells whether rows i and j of frame f have equal keys.
+func keysEqual(f frame.Frame, i, j int) bool {
+	return !f.Less(i, j) && !f.Less(j, i)
+}
+
+// match computes the matches of row i of the large slice.
+func (r *broadcastJoinReader) match(i int) {
+	r.matches = r.matches[:0]
+	candidates := r.index[r.in.Hash(i)]
+	if len(candidates) == 0 {
+		return
+	}
+	scratch := r.rows.Len() - 1
+	for col := 0; col < r.op.Prefix(); col++ {
+		r.rows.Index(col, scratch).Set(r.in.Index(col, i))
+	}
+	for _, k := range candidates {
+		if keysEqual(r.rows, k, scratch) {
+			r.matches = append(r.matches, k)
+		}
+	}
+}
+
+func (r *broadcastJoinReader) init(ctx context.Context) error {
+	var (
+		buf = frame.Make(r.op.small, defaultChunksize, defaultChunksize)
+		all = frame.Make(r.op.small, 0, 0)
+	)
+	for {
+		n, err := r.small.Read(ctx, buf)
+		if err != nil && err != sliceio.EOF {
+			return err
+		}
+		all = frame.AppendFrame(all, buf.Slice(0, n))
+		if err == sliceio.EOF {
+			break
+		}
+	}
+	n := all.Len()
+	r.rows = frame.AppendFrame(all, frame.Make(r.op.small, 1, 1))
+	r.index = make(map[uint32][]int)
+	for i := 0; i < n; i++ {
+		h := r.rows.Hash(i)
+		r.index[h] = append(r.index[h], i)
+	}
+	r.in = frame.Make(r.op.large, defaultChunksize, defaultChunksize)
+	return nil
+}
+
+func (r *broadcastJoinReader) Read(ctx context.Context, out frame.Frame) (int, error) {
+	if r.index == nil {
+		if err := r.init(ctx); err != nil {
+			r.err = err
+			return 0, err
+		}
+	}
+	var (
+		prefix = r.op.Prefix()
+		nlarge = r.op.large.NumOut() - prefix
+		nsmall = r.op.small.NumOut() - prefix
+		k      int
+	)
+	for k < out.Len() {
+		if r.i == r.n {
+			if r.err != nil {
+				break
+			}
+			r.n, r.err = r.reader.Read(ctx, r.in)
+			r.i, r.j = 0, 0
+			if r.err != nil && r.err != sliceio.EOF {
+				return k, r.err
+			}
+			if r.n > 0 {
+				r.match(0)
+			}
+			continue
+		}
+		matches := r.matches
+		if r.j >= len(matches) {
+			r.i++
+			r.j = 0
+			if r.i < r.n {
+				r.match(r.i)
+			}
+			continue
+		}
+		for col := 0; col < prefix+nlarge; col++ {
+			out.Index(col, k).Set(r.in.Index(col, r.i))
+		}
+		for col := 0; col < nsmall; col++ {
+			out.Index(prefix+nlarge+col, k).Set(r.rows.Index(prefix+col, matches[r.j]))
+		}
+		k++
+		r.j++
+	}
+	if k == 0 && r.err != nil {
+		return 0, r.err
+	}
+	return k, nil
+}
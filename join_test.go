@@ -0,0 +1,149 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/grailbio/bigslice"
+)
+
+func TestJoin(t *testing.T) {
+	const N = 100
+	var (
+		largeKeys   = make([]string, N)
+		largeValues = make([]int, N)
+		smallKeys   []string
+		smallValues []string
+		want        []string
+	)
+	for i := range largeKeys {
+		largeKeys[i] = fmt.Sprint(i % 20)
+		largeValues[i] = i
+	}
+	// Keys 0-9 have two matching rows; keys 30-39 match no rows of
+	// large.
+	for i := 0; i < 10; i++ {
+		for _, key := range []int{i, i, i + 30} {
+			smallKeys = append(smallKeys, fmt.Sprint(key))
+			smallValues = append(smallValues, fmt.Sprint(len(smallValues)))
+		}
+	}
+	for i := range largeKeys {
+		for j := range smallKeys {
+			if largeKeys[i] == smallKeys[j] {
+				want = append(want, fmt.Sprint(largeKeys[i], ":", largeValues[i], ":", smallValues[j]))
+			}
+		}
+	}
+	// The join is computed as a broadcast join when the small side is
+	// within the threshold, and as a shuffle join otherwise.
+	for _, threshold := range []int{0, len(smallKeys) - 1, len(smallKeys), 1000} {
+		t.Run(fmt.Sprint(threshold), func(t *testing.T) {
+			large := bigslice.Const(7, largeKeys, largeValues)
+			small := bigslice.Const(3, smallKeys, smallValues)
+			slice := bigslice.Join(large, small, threshold)
+			if got, want := slice.NumShard(), 7; got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			slice = bigslice.Map(slice, func(key string, lv int, sv string) string {
+				return fmt.Sprint(key, ":", lv, ":", sv)
+			})
+			assertEqual(t, slice, true, want)
+		})
+	}
+}
+
+func TestJoinType(t *testing.T) {
+	large := bigslice.Const(1, []string{}, []int{})
+	expectTypeError(t, "join: key column type mismatch: expected string but got int", func() {
+		bigslice.Join(large, bigslice.Const(1, []int{}, []string{}), 1)
+	})
+	expectTypeError(t, "join: slice 1 has no non-key columns", func() {
+		bigslice.Join(large, bigslice.Const(1, []string{}), 1)
+	})
+	expectTypeError(t, "join: key column(0) type []int is not comparable", func() {
+		bigslice.Join(bigslice.Const(1, [][]int{}, []int{}), bigslice.Const(1, [][]int{}, []int{}), 1)
+	})
+	expectTypeError(t, "join: invalid threshold -1", func() {
+		bigslice.Join(large, large, -1)
+	})
+}
+
+func TestJoinBloomFilterKeys(t *testing.T) {
+	const N = 1000
+	var (
+		largeKeys   = make([]int, N)
+		largeValues = make([]string, N)
+		smallKeys   []int
+		smallValues []string
+		want        []string
+	)
+	for i := range largeKeys {
+		largeKeys[i] = i
+		largeValues[i] = fmt.Sprint(i)
+	}
+	for _, key := range []int{3, 3, 500, 999, 2000} {
+		smallKeys = append(smallKeys, key)
+		smallValues = append(smallValues, fmt.Sprint("s", len(smallValues)))
+	}
+	for i := range largeKeys {
+		for j := range smallKeys {
+			if largeKeys[i] == smallKeys[j] {
+				want = append(want, fmt.Sprint(largeValues[i], ":", smallValues[j]))
+			}
+		}
+	}
+	// The join is pruned when small has at most maxKeys distinct keys;
+	// either way, its result is the same.
+	for _, maxKeys := range []int{1, 3, 4, 1000} {
+		t.Run(fmt.Sprint(maxKeys), func(t *testing.T) {
+			large := bigslice.Const(7, largeKeys, largeValues)
+			small := bigslice.Const(3, smallKeys, smallValues)
+			slice := bigslice.Join(large, small, 0, bigslice.BloomFilterKeys(0.01, maxKeys))
+			slice = bigslice.Map(slice, func(key int, lv, sv string) string {
+				return fmt.Sprint(lv, ":", sv)
+			})
+			assertEqual(t, slice, true, want)
+		})
+	}
+}
+
+func TestBloomFilterKeysError(t *testing.T) {
+	expectTypeError(t, "bloomfilterkeys: invalid false positive rate 1", func() {
+		bigslice.BloomFilterKeys(1, 10)
+	})
+	expectTypeError(t, "bloomfilterkeys: invalid maximum number of keys 0", func() {
+		bigslice.BloomFilterKeys(0.01, 0)
+	})
+}
+
+func TestJoinKeyOps(t *testing.T) {
+	// Keys are compared by their frame operations under either strategy:
+	// NaNs match each other, and pointers match by the values that they
+	// point to.
+	nan := math.NaN()
+	one, otherOne, two := new(int), new(int), new(int)
+	*one, *otherOne, *two = 1, 1, 2
+	for _, threshold := range []int{0, 1000} {
+		t.Run(fmt.Sprint(threshold), func(t *testing.T) {
+			large := bigslice.Const(2, []float64{nan, 1, 2}, []string{"a", "b", "c"})
+			small := bigslice.Const(1, []float64{nan, 2}, []int{1, 2})
+			slice := bigslice.Map(bigslice.Join(large, small, threshold), func(_ float64, lv string, sv int) string {
+				return fmt.Sprint(lv, ":", sv)
+			})
+			assertEqual(t, slice, true, []string{"a:1", "c:2"})
+
+			large = bigslice.Const(2, []*int{one, two}, []string{"a", "b"})
+			small = bigslice.Const(1, []*int{otherOne}, []int{1})
+			slice = bigslice.Map(bigslice.Join(large, small, threshold), func(_ *int, lv string, sv int) string {
+				return fmt.Sprint(lv, ":", sv)
+			})
+			assertEqual(t, slice, true, []string{"a:1"})
+		})
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/metrics"
+	"github.com/grailbio/bigslice/slicefunc"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/slicetype"
+	"github.com/grailbio/bigslice/typecheck"
+)
+
+// MalformedJSONLines counts the lines skipped by slices returned by
+// ReadJSONLines with the SkipMalformedLines pragma. It may be read
+// from the scope of a task or of a result.
+var MalformedJSONLines = metrics.NewCounter()
+
+type skipMalformedLines struct{}
+
+func (skipMalformedLines) Procs() int        { return 1 }
+func (skipMalformedLines) Exclusive() bool   { return false }
+func (skipMalformedLines) Materialize() bool { return false }
+
+// SkipMalformedLines is a Pragma that causes lines read by
+// ReadJSONLines that cannot be unmarshaled to be skipped and counted
+// by MalformedJSONLines. By default, a malformed line is a fatal error
+// of the slice. SkipMalformedLines has no effect on other slices.
+var SkipMalformedLines Pragma = skipMalformedLines{}
+
+// skipsMalformedLines returns whether p contains the
+// SkipMalformedLines pragma.
+func skipsMalformedLines(p Pragma) bool {
+	switch p := p.(type) {
+	case skipMalformedLines:
+		return true
+	case Pragmas:
+		for _, q := range p {
+			if skipsMalformedLines(q) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// A jsonPlan maps the columns of a slice read by ReadJSONLines to the
+// fields of the struct into which its lines are unmarshaled.
+type jsonPlan struct {
+	// fields holds the index of the struct field of each column.
+	fields []int
+	// columns holds the type of each column.
+	columns []reflect.Type
+}
+
+// jsonPlans caches the jsonPlan of each struct type.
+var jsonPlans sync.Map // map[reflect.Type]*jsonPlan
+
+// jsonPlanOf returns the (cached) plan for the provided struct type.
+func jsonPlanOf(typ reflect.Type) *jsonPlan {
+	if plan, ok := jsonPlans.Load(typ); ok {
+		return plan.(*jsonPlan)
+	}
+	plan := new(jsonPlan)
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.PkgPath != "" || field.Tag.Get("bigslice") == "-" {
+			continue
+		}
+		plan.fields = append(plan.fields, i)
+		plan.columns = append(plan.columns, field.Type)
+	}
+	actual, _ := jsonPlans.LoadOrStore(typ, plan)
+	return actual.(*jsonPlan)
+}
+
+type jsonLinesSlice struct {
+	name Name
+	Pragmas
+	slicetype.Type
+	splits        []textSplit
+	typ           reflect.Type
+	plan          *jsonPlan
+	skipMalformed bool
+}
+
+// ReadJSONLines returns a slice that reads the newline-delimited JSON
+// files at the provided paths. Each (non-blank) line is unmarshaled by
+// encoding/json into a value of the struct type of into, which may be a
+// struct or a pointer to a struct: for example, Record{} or
+// (*Record)(nil). The exported fields of the struct, in order of
+// declaration, make up the columns of the slice; fields tagged with
+// `bigslice:"-"` are omitted. JSON field names are given by the usual
+// `json` tags.
+//
+// Files are split into shards exactly as by ReadTextFiles, and so the
+// number of shards is derived from the provided set of files. Lines
+// that cannot be unmarshaled are reported as fatal errors along with the
+// file name and line number, unless the SkipMalformedLines pragma is
+// provided. As for ReadTextFiles, the ReadRetry, ReadRateLimit,
+// OnMissingShard, and Locality pragmas apply to the files' reads.
+//
+// Schematically:
+//
+//	ReadJSONLines(ctx, paths, struct{f1 t1; ...; fn tn}{}) Slice<t1, ..., tn>
+func ReadJSONLines(ctx context.Context, paths []string, into interface{}, prags ...Pragma) Slice {
+	s := new(jsonLinesSlice)
+	s.name = MakeName("readjsonlines")
+	s.Pragmas = prags
+	s.skipMalformed = skipsMalformedLines(s.Pragmas)
+	if len(paths) == 0 {
+		typecheck.Panic(1, "readjsonlines: no paths provided")
+	}
+	typ := reflect.TypeOf(into)
+	if typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ == nil || typ.Kind() != reflect.Struct {
+		typecheck.Panicf(1, "readjsonlines: expected struct or pointer to struct, got %T", into)
+	}
+	s.typ = typ
+	s.plan = jsonPlanOf(typ)
+	if len(s.plan.columns) == 0 {
+		typecheck.Panicf(1, "readjsonlines: struct %s has no exported fields", typ)
+	}
+	s.Type = slicetype.New(s.plan.columns...)
+	var err error
+	if s.splits, err = splitTextFiles(ctx, paths); err != nil {
+		typecheck.Panicf(1, "readjsonlines: %v", err)
+	}
+	return s
+}
+
+func (s *jsonLinesSlice) Name() Name             { return s.name }
+func (s *jsonLinesSlice) NumShard() int          { return len(s.splits) }
+func (*jsonLinesSlice) ShardType() ShardType     { return HashShard }
+func (*jsonLinesSlice) NumDep() int              { return 0 }
+func (*jsonLinesSlice) Dep(i int) Dep            { panic("no deps") }
+func (*jsonLinesSlice) Combiner() slicefunc.Func { return slicefunc.Nil }
+
+// Locality implements LocalitySlice.
+func (s *jsonLinesSlice) Locality(shard int) []string { return localityOf(s.Pragmas, shard) }
+
+// Snapshot implements SnapshotSlice. Files are read in place, and so
+// cannot provide stable snapshots.
+func (s *jsonLinesSlice) Snapshot(ctx context.Context) (interface{}, error) {
+	return nil, errors.E(errors.NotSupported, fmt.Sprintf("%s: files do not support snapshots", s.name))
+}
+
+// SetSnapshot implements SnapshotSlice.
+func (s *jsonLinesSlice) SetSnapshot(token interface{}) error {
+	return errors.E(errors.NotSupported, fmt.Sprintf("%s: files do not support snapshots", s.name))
+}
+
+func (s *jsonLinesSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	return withReadRateLimit(s.Pragmas, len(s.splits), withReadRetry(s.Pragmas, s.name, shard, func() sliceio.Reader {
+		r := &jsonLinesReader{op: s}
+		r.shard = shard
+		r.split = s.splits[shard]
+		return r
+	}))
+}
+
+// A jsonLinesReader reads lines as a textFilesReader does, unmarshaling
+// each to a row.
+type jsonLinesReader struct {
+	textFilesReader
+	op *jsonLinesSlice
+}
+
+func (r *jsonLinesReader) Read(ctx context.Context, out frame.Frame) (n int, err error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if !slicetype.Assignable(out, r.op) {
+		return 0, errTypeError
+	}
+	defer func() {
+		if err != nil {
+			if err != sliceio.EOF {
+				err = errors.E(fmt.Sprintf("reading %s", r.split.path), err)
+			}
+			r.err = err
+			r.close(ctx)
+		}
+	}()
+	if r.r == nil {
+		if err = r.open(ctx); err != nil {
+			return 0, missingShard(ctx, r.op.Pragmas, r.op.name, r.shard, len(r.op.splits), r.split.path, err)
+		}
+	}
+	for n < out.Len() {
+		line, err := r.readLine()
+		if err != nil {
+			return n, err
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		v := reflect.New(r.op.typ)
+		if err := json.Unmarshal([]byte(line), v.Interface()); err != nil {
+			if r.op.skipMalformed {
+				MalformedJSONLines.Incr(metrics.ContextScope(ctx), 1)
+				continue
+			}
+			return n, errors.E(errors.Fatal, r.location(ctx), err)
+		}
+		v = v.Elem()
+		for j, field := range r.op.plan.fields {
+			out.Index(j, n).Set(v.Field(field))
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,197 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/metrics"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/testutil"
+)
+
+type jsonRecord struct {
+	Name    string `json:"name"`
+	Count   int    `json:"count"`
+	Ignored string `bigslice:"-"`
+	private int
+}
+
+func TestReadJSONLines(t *testing.T) {
+	dir, cleanUp := testutil.TempDir(t, "", "")
+	defer cleanUp()
+	defer func(size int64) { textSplitSize = size }(textSplitSize)
+	textSplitSize = 64
+
+	var (
+		b    bytes.Buffer
+		want []string
+	)
+	for i := 0; i < 50; i++ {
+		fmt.Fprintf(&b, "{\"name\": \"rec%02d\", \"count\": %d}\n", i, i)
+		if i%10 == 0 {
+			// Blank lines are ignored.
+			fmt.Fprintln(&b)
+		}
+		want = append(want, fmt.Sprint("rec", fmt.Sprintf("%02d", i), "=", i))
+	}
+	path := filepath.Join(dir, "records.json")
+	if err := ioutil.WriteFile(path, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	slice := ReadJSONLines(ctx, []string{path}, (*jsonRecord)(nil))
+	if got, want := slice.NumShard(), (b.Len()+63)/64; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := slice.NumOut(), 2; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if slice.Out(0) != typeOfString || slice.Out(1) != typeOfInt {
+		t.Errorf("got column types %v, %v", slice.Out(0), slice.Out(1))
+	}
+	var got []string
+	for shard := 0; shard < slice.NumShard(); shard++ {
+		r := slice.Reader(shard, nil)
+		f := frame.Make(slice, 4, 4)
+		for {
+			n, err := r.Read(ctx, f)
+			for i := 0; i < n; i++ {
+				got = append(got, fmt.Sprint(f.Index(0, i).String(), "=", f.Index(1, i).Int()))
+			}
+			if err == sliceio.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestReadJSONLinesMalformed(t *testing.T) {
+	dir, cleanUp := testutil.TempDir(t, "", "")
+	defer cleanUp()
+	path := filepath.Join(dir, "bad.json")
+	data := "{\"name\": \"a\"}\n{\"name\": \"b\"\n{\"name\": \"c\", \"count\": \"x\"}\n{\"name\": \"d\"}\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	_, err := readTextFilesSlice(ctx, t, ReadJSONLines(ctx, []string{path}, jsonRecord{}))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if msg := err.Error(); !strings.Contains(msg, path) || !strings.Contains(msg, "line 2") {
+		t.Errorf("error %q does not include file name and line", msg)
+	}
+
+	// Lines are numbered from the beginning of the file, also in splits
+	// that begin within it.
+	func() {
+		defer func(size int64) { textSplitSize = size }(textSplitSize)
+		textSplitSize = 32
+		var (
+			lines  bytes.Buffer
+			offset int
+		)
+		for i := 1; i <= 20; i++ {
+			line := fmt.Sprintf("{\"name\": \"%d\"}\n", i)
+			if i == 15 {
+				offset = lines.Len()
+				line = "{\"name\": 15\n"
+			}
+			lines.WriteString(line)
+		}
+		path := filepath.Join(dir, "split.json")
+		if err := ioutil.WriteFile(path, lines.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		slice := ReadJSONLines(ctx, []string{path}, jsonRecord{})
+		if slice.NumShard() < 2 {
+			t.Fatalf("expected file to be split, got %d shards", slice.NumShard())
+		}
+		_, err := readTextFilesSlice(ctx, t, slice)
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		if msg, want := err.Error(), fmt.Sprintf("line 15 (offset %d)", offset); !strings.Contains(msg, want) {
+			t.Errorf("error %q does not include %q", msg, want)
+		}
+	}()
+
+	var scope metrics.Scope
+	ctx = metrics.ScopedContext(ctx, &scope)
+	names, err := readTextFilesSlice(ctx, t, ReadJSONLines(ctx, []string{path}, jsonRecord{}, SkipMalformedLines))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names, []string{"a", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := MalformedJSONLines.Value(&scope), int64(2); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for _, into := range []interface{}{nil, 1, struct{ x int }{}} {
+		func() {
+			defer func() {
+				if e := recover(); e == nil {
+					t.Errorf("%T: expected panic", into)
+				}
+			}()
+			ReadJSONLines(ctx, []string{path}, into)
+		}()
+	}
+}
+
+func TestReadJSONLinesPragmas(t *testing.T) {
+	dir, cleanUp := testutil.TempDir(t, "", "")
+	defer cleanUp()
+	var paths []string
+	for i, name := range []string{"a", "b"} {
+		path := filepath.Join(dir, fmt.Sprintf("%d.json", i))
+		if err := ioutil.WriteFile(path, []byte(fmt.Sprintf("{\"name\": %q}\n", name)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	ctx := context.Background()
+	slice := ReadJSONLines(ctx, paths, jsonRecord{},
+		OnMissingShard(SkipMissingShards, 1),
+		Locality(func(shard int) []string { return []string{fmt.Sprint("host", shard)} }))
+	if got, want := slice.(LocalitySlice).Locality(1), []string{"host1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The second file is deleted after the slice is split.
+	if err := os.Remove(paths[1]); err != nil {
+		t.Fatal(err)
+	}
+	var scope metrics.Scope
+	names, err := readTextFilesSlice(metrics.ScopedContext(ctx, &scope), t, slice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names, []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := SourceShardsSkipped.Value(&scope), int64(1); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
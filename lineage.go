@@ -0,0 +1,73 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A LineageSpan is the range of rows [Beg, End) of a shard of a
+// source slice, named by Source. Rows are numbered by their offset in
+// the shard, in the order in which they are read.
+type LineageSpan struct {
+	Source   string
+	Shard    int
+	Beg, End int64
+}
+
+// A Lineage is a set of source rows: a sorted list of disjoint,
+// non-adjacent spans. Lineages are tracked by executors, which record
+// the rows read from each shard of a source slice, and derive the
+// lineage of each shard of a computed slice from the shards on which it
+// depends (see exec.Result.Lineage). Lineages are not part of the data
+// of a slice, and so do not affect its type or its computation.
+type Lineage []LineageSpan
+
+// Merge returns the union of lineages l and m.
+func (l Lineage) Merge(m Lineage) Lineage {
+	spans := make([]LineageSpan, 0, len(l)+len(m))
+	spans = append(append(spans, l...), m...)
+	return normalizeLineage(spans)
+}
+
+// String returns a compact description of the lineage, e.g.,
+// "src:0[0,10) src:1[5,6)".
+func (l Lineage) String() string {
+	strs := make([]string, len(l))
+	for i, span := range l {
+		strs[i] = fmt.Sprintf("%s:%d[%d,%d)", span.Source, span.Shard, span.Beg, span.End)
+	}
+	return strings.Join(strs, " ")
+}
+
+// normalizeLineage sorts the provided spans and coalesces overlapping
+// and adjacent spans, reusing the provided slice.
+func normalizeLineage(spans []LineageSpan) Lineage {
+	sort.Slice(spans, func(i, j int) bool {
+		if spans[i].Source != spans[j].Source {
+			return spans[i].Source < spans[j].Source
+		}
+		if spans[i].Shard != spans[j].Shard {
+			return spans[i].Shard < spans[j].Shard
+		}
+		return spans[i].Beg < spans[j].Beg
+	})
+	merged := spans[:0]
+	for _, span := range spans {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			if last.Source == span.Source && last.Shard == span.Shard && span.Beg <= last.End {
+				if span.End > last.End {
+					last.End = span.End
+				}
+				continue
+			}
+		}
+		merged = append(merged, span)
+	}
+	return Lineage(merged)
+}
@@ -0,0 +1,20 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/grailbio/bigslice"
+)
+
+func TestLineageMerge(t *testing.T) {
+	l := bigslice.Lineage{{"a", 0, 0, 1}, {"a", 0, 2, 3}}
+	m := bigslice.Lineage{{"a", 0, 1, 2}, {"b", 1, 5, 6}}
+	if got, want := l.Merge(m), (bigslice.Lineage{{"a", 0, 0, 3}, {"b", 1, 5, 6}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
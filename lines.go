@@ -0,0 +1,107 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/typecheck"
+)
+
+// defaultMaxLineSize is the default maximum size, in bytes, of a line
+// read by ReadLines.
+const defaultMaxLineSize = 1 << 20
+
+// A LinesOption configures the behavior of ReadLines.
+type LinesOption func(c *linesConfig)
+
+type linesConfig struct {
+	maxLineSize int
+}
+
+// MaxLineSize is a LinesOption that sets the maximum size, in bytes, of
+// a line read by ReadLines. Reading a longer line fails the slice. The
+// default maximum is 1MB.
+func MaxLineSize(n int) LinesOption {
+	if n <= 0 {
+		typecheck.Panicf(1, "maxlinesize: invalid maximum line size %d", n)
+	}
+	return func(c *linesConfig) {
+		c.maxLineSize = n
+	}
+}
+
+// linesState is the ReaderFunc state of a shard read by ReadLines.
+type linesState struct {
+	rc   io.ReadCloser
+	scan *bufio.Scanner
+	// line is the number of lines read.
+	line int64
+}
+
+// Close closes the shard's stream. It is called once the task reading
+// the shard is complete; see ReaderFunc.
+func (s *linesState) Close() error {
+	if s.rc == nil {
+		return nil
+	}
+	return s.rc.Close()
+}
+
+// ReadLines returns a slice of strings containing the lines, without
+// line terminators, of a set of streams: each of the slice's nshard
+// shards reads the stream returned by factory for that shard. The
+// factory is invoked when the shard is computed, on the machine to
+// which it is assigned; the returned stream is closed once the task
+// computing the shard is complete, whether or not it succeeded.
+//
+// Errors returned by factory fail the task computing the shard, which
+// is then retried, unless the error is fatal (errors.Fatal). Lines that
+// exceed the maximum line size (see MaxLineSize) fail the slice.
+//
+// Schematically:
+//
+//	ReadLines(nshard, factory) Slice<string>
+func ReadLines(nshard int, factory func(shard int) (io.ReadCloser, error), opts ...LinesOption) Slice {
+	Helper()
+	config := linesConfig{maxLineSize: defaultMaxLineSize}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	return ReaderFunc(nshard, func(shard int, state *linesState, lines []string) (int, error) {
+		if state.scan == nil {
+			rc, err := factory(shard)
+			if err != nil {
+				msg := fmt.Sprintf("readlines: shard %d: opening stream", shard)
+				if errors.Recover(err).Severity == errors.Fatal {
+					return 0, errors.E(errors.Fatal, msg, err)
+				}
+				return 0, errors.E(errors.Temporary, msg, err)
+			}
+			state.rc = rc
+			state.scan = bufio.NewScanner(rc)
+			state.scan.Buffer(nil, config.maxLineSize)
+		}
+		for i := range lines {
+			if !state.scan.Scan() {
+				switch err := state.scan.Err(); {
+				case err == bufio.ErrTooLong:
+					return i, errors.E(errors.Invalid,
+						fmt.Sprintf("readlines: shard %d: line %d exceeds maximum size of %d bytes", shard, state.line+1, config.maxLineSize))
+				case err != nil:
+					return i, errors.E(fmt.Sprintf("readlines: shard %d: line %d", shard, state.line+1), err)
+				}
+				return i, sliceio.EOF
+			}
+			state.line++
+			lines[i] = state.scan.Text()
+		}
+		return len(lines), nil
+	})
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigslice"
+)
+
+// closeCounter counts the closes of the streams that it wraps.
+type closeCounter struct {
+	io.Reader
+	n *int32
+}
+
+func (c closeCounter) Close() error {
+	atomic.AddInt32(c.n, 1)
+	return nil
+}
+
+func TestReadLines(t *testing.T) {
+	const (
+		N      = 100
+		Nshard = 4
+	)
+	var (
+		want   []string
+		inputs = make([]string, Nshard)
+		closes int32
+	)
+	for shard := range inputs {
+		for i := 0; i < N; i++ {
+			line := fmt.Sprintf("%d:%03d", shard, i)
+			want = append(want, line)
+			inputs[shard] += line + "\n"
+		}
+	}
+	slice := bigslice.ReadLines(Nshard, func(shard int) (io.ReadCloser, error) {
+		return closeCounter{strings.NewReader(inputs[shard]), &closes}, nil
+	})
+	if got, want := slice.NumShard(), Nshard; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	atomic.StoreInt32(&closes, 0)
+	var got []string
+	scan := runLocal(context.Background(), t, slice)
+	for line := ""; scan.Scan(context.Background(), &line); {
+		got = append(got, line)
+	}
+	if err := scan.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(got), N*Nshard; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := atomic.LoadInt32(&closes), int32(Nshard); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	assertEqual(t, slice, true, want)
+}
+
+func TestReadLinesMaxLineSize(t *testing.T) {
+	input := "short\n" + strings.Repeat("x", 100) + "\n"
+	factory := func(shard int) (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader(input)), nil
+	}
+	slice := bigslice.ReadLines(1, factory, bigslice.MaxLineSize(200))
+	assertEqual(t, slice, false, []string{"short", strings.Repeat("x", 100)})
+
+	slice = bigslice.ReadLines(1, factory, bigslice.MaxLineSize(50))
+	for name, res := range runError(context.Background(), t, slice) {
+		if err := res.Err; err == nil || !strings.Contains(err.Error(), "line 2 exceeds maximum size of 50 bytes") {
+			t.Errorf("executor %s: got %v, want line size error", name, err)
+		}
+	}
+}
+
+func TestReadLinesFactoryError(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		attempts = make(map[int]int)
+	)
+	slice := bigslice.ReadLines(2, func(shard int) (io.ReadCloser, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[shard]++
+		if attempts[shard] == 1 {
+			return nil, errors.New("transient failure")
+		}
+		return ioutil.NopCloser(strings.NewReader(fmt.Sprintf("shard %d\n", shard))), nil
+	})
+	var lines []string
+	scan := runLocal(context.Background(), t, slice)
+	for line := ""; scan.Scan(context.Background(), &line); {
+		lines = append(lines, line)
+	}
+	if err := scan.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(lines), 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	slice = bigslice.ReadLines(1, func(shard int) (io.ReadCloser, error) {
+		return nil, errors.E(errors.Fatal, "permanent failure")
+	})
+	for name, res := range runError(context.Background(), t, slice) {
+		if err := res.Err; err == nil || !strings.Contains(err.Error(), "permanent failure") {
+			t.Errorf("executor %s: got %v, want factory error", name, err)
+		}
+	}
+}
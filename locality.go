@@ -0,0 +1,54 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+// A LocalitySlice is a Slice whose shards are preferably computed on
+// particular machines, e.g., because the data read by a source shard
+// is stored on a machine's local disk. Executors that manage clusters
+// of machines place the task that computes a shard on one of the
+// shard's preferred machines when possible. Locality is a soft
+// preference: when none of a shard's preferred machines is available,
+// the task is placed elsewhere.
+type LocalitySlice interface {
+	Slice
+	// Locality returns the preferred locations of the provided shard:
+	// the addresses or host names of machines on which the shard
+	// should be computed. Locality returns nil if the shard has no
+	// preferred locations.
+	Locality(shard int) []string
+}
+
+type locality struct {
+	hints func(shard int) []string
+}
+
+func (locality) Procs() int        { return 1 }
+func (locality) Exclusive() bool   { return false }
+func (locality) Materialize() bool { return false }
+
+// Locality returns a pragma that provides locality hints for the
+// shards of source slices (ReaderFunc, ScanReader, ReadTextFiles, and
+// ReadJSONLines): hints returns the preferred locations of a shard, as
+// the addresses or host names of the machines on which the shard
+// should be read. See LocalitySlice.
+func Locality(hints func(shard int) []string) Pragma {
+	return locality{hints}
+}
+
+// localityOf returns the locality hints for the provided shard given
+// by the Locality pragma in p, if any.
+func localityOf(p Pragma, shard int) []string {
+	switch p := p.(type) {
+	case locality:
+		return p.hints(shard)
+	case Pragmas:
+		for _, q := range p {
+			if hints := localityOf(q, shard); hints != nil {
+				return hints
+			}
+		}
+	}
+	return nil
+}
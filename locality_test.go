@@ -0,0 +1,32 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/grailbio/bigslice"
+	"github.com/grailbio/bigslice/sliceio"
+)
+
+func TestLocality(t *testing.T) {
+	read := func(shard int, state *bool, out []int) (int, error) { return 0, sliceio.EOF }
+	slice := bigslice.ReaderFunc(3, read, bigslice.Procs(2), bigslice.Locality(func(shard int) []string {
+		return []string{fmt.Sprint("host", shard)}
+	}))
+	l, ok := slice.(bigslice.LocalitySlice)
+	if !ok {
+		t.Fatal("expected a LocalitySlice")
+	}
+	if got, want := l.Locality(2), []string{"host2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	slice = bigslice.ReaderFunc(3, read)
+	if hints := slice.(bigslice.LocalitySlice).Locality(0); hints != nil {
+		t.Errorf("got %v, want nil", hints)
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigslice/metrics"
+	"github.com/grailbio/bigslice/typecheck"
+)
+
+// minErrorFractionRows is the number of rows that a shard must have
+// read before its fraction of failed rows is checked against the
+// maximum fraction of a SampleErrors pragma. The fraction is always
+// checked at the end of the shard.
+const minErrorFractionRows = 100
+
+// mapErrors samples the errors of map operations with the
+// SampleErrors pragma, keyed by the operation's name.
+var mapErrors = metrics.NewSampler()
+
+func init() {
+	gob.Register(&MapError{})
+}
+
+// A MapError is an error returned by a Map function, or a Filter
+// predicate, for a row.
+type MapError struct {
+	// Op is the name of the map operation, as given by Name.String.
+	Op string
+	// Shard is the shard of the failed row.
+	Shard int
+	// Row is the index of the failed row in its shard.
+	Row int64
+	// Err is the error returned by the map function.
+	Err *errors.Error
+}
+
+// Error implements error.
+func (e *MapError) Error() string {
+	return fmt.Sprintf("%s: shard %d: row %d: %v", e.Op, e.Shard, e.Row, e.Err)
+}
+
+// An errorPolicy determines how a map or filter operation handles the
+// errors returned by its function for individual rows. The zero policy
+// fails the computation on the first error.
+type errorPolicy struct {
+	// sample is the operation's SampleErrors pragma, if any.
+	sample *sampleErrors
+	// sink is the operation's DeadLetterSink pragma, if any.
+	sink *deadLetterSink
+	// route is true if failed rows are routed to a dead-letter slice
+	// (see MapDeadLetter); placeholders then fill the unused columns of
+	// its rows.
+	route        bool
+	placeholders []reflect.Value
+	// maxFraction is the maximum fraction of failed rows of a shard.
+	maxFraction float64
+}
+
+// makeErrorPolicy returns the error policy given by the pragmas of an
+// operation with the provided function, which returns an error if
+// fnErr is true.
+func makeErrorPolicy(p Pragma, fn interface{}, fnErr bool) (errorPolicy, error) {
+	var policy errorPolicy
+	if sample, ok := sampleErrorsOf(p); ok {
+		policy.sample = &sample
+		policy.maxFraction = sample.maxFraction
+	}
+	if sink, ok := deadLetterSinkOf(p); ok {
+		policy.sink = &sink
+		policy.maxFraction = sink.maxFraction
+	}
+	switch {
+	case policy.sample != nil && !fnErr:
+		return errorPolicy{}, fmt.Errorf("SampleErrors requires function %T to return an error", fn)
+	case policy.sink != nil && !fnErr:
+		return errorPolicy{}, fmt.Errorf("DeadLetterSink requires function %T to return an error", fn)
+	case policy.sample != nil && policy.sink != nil:
+		return errorPolicy{}, errors.New("SampleErrors and DeadLetterSink are mutually exclusive")
+	}
+	return policy, nil
+}
+
+// tolerant tells whether the policy tolerates failed rows, up to its
+// maximum fraction.
+func (p *errorPolicy) tolerant() bool {
+	return p.sample != nil || p.sink != nil || p.route
+}
+
+// rowErrors handles the errors returned by the function of a map or
+// filter operation for the rows of a shard.
+type rowErrors struct {
+	name   Name
+	shard  int
+	policy *errorPolicy
+	// rows is the number of rows read by the operation; errs is the
+	// number of these for which its function returned an error.
+	rows, errs int64
+}
+
+// fail handles the error returned by the function for the last row
+// read, whose columns are given by args. It returns the error, as a
+// fatal *MapError, if the policy does not tolerate errors; otherwise
+// it returns the *MapError describing the failed row, after sampling
+// it or passing it to the policy's sink.
+func (r *rowErrors) fail(ctx context.Context, err error, args []reflect.Value) (*MapError, error) {
+	merr := &MapError{
+		Op:    r.name.String(),
+		Shard: r.shard,
+		Row:   r.rows - 1,
+		Err:   errors.Recover(err),
+	}
+	if !r.policy.tolerant() {
+		return nil, errors.E(errors.Fatal, merr)
+	}
+	r.errs++
+	scope := metrics.ContextScope(ctx)
+	switch {
+	case r.policy.sample != nil:
+		mapErrors.Add(scope, merr.Op, r.policy.sample.size, merr)
+	case r.policy.sink != nil:
+		row := DeadLetterRow{Err: merr, Values: make([]interface{}, len(args))}
+		for i := range args {
+			row.Values[i] = args[i].Interface()
+		}
+		if err := r.policy.sink.sink(ctx, row); err != nil {
+			kind := errors.Fatal
+			if errors.IsTemporary(err) {
+				kind = errors.Temporary
+			}
+			return nil, errors.E(kind, fmt.Sprintf("%s: shard %d: dead-letter sink", r.name, r.shard), err)
+		}
+		fallthrough
+	default:
+		DeadLetterRows.Incr(scope, 1)
+	}
+	return merr, nil
+}
+
+// check returns a fatal error if the fraction of failed rows exceeds
+// the policy's maximum. The fraction is checked only once
+// minErrorFractionRows rows have been read, or at the end of the shard
+// (eof).
+func (r *rowErrors) check(eof bool) error {
+	if !r.policy.tolerant() || r.errs == 0 {
+		return nil
+	}
+	if (r.rows >= minErrorFractionRows || eof) && float64(r.errs) > r.policy.maxFraction*float64(r.rows) {
+		return errors.E(errors.Fatal, fmt.Sprintf("%s: shard %d: %d of %d rows failed, exceeding maximum fraction %v",
+			r.name, r.shard, r.errs, r.rows, r.policy.maxFraction))
+	}
+	return nil
+}
+
+type sampleErrors struct {
+	size        int
+	maxFraction float64
+}
+
+func (sampleErrors) Procs() int        { return 1 }
+func (sampleErrors) Exclusive() bool   { return false }
+func (sampleErrors) Materialize() bool { return false }
+
+// SampleErrors returns a pragma that changes the handling of errors
+// returned by Map functions and Filter predicates (see Map). Instead of failing on the first
+// error, rows for which the function returns an error are dropped,
+// and errors are counted and sampled: a uniform sample of at most size
+// errors is retained for each map operation, and is retrieved after
+// evaluation by MapErrors. Should the fraction of failed rows in a
+// shard exceed maxFraction, the computation fails. The fraction is
+// checked once the shard has read 100 rows, and at its end, so that
+// maxFraction of 0 fails on any error and maxFraction of 1 never
+// fails.
+func SampleErrors(size int, maxFraction float64) Pragma {
+	if size < 0 {
+		typecheck.Panicf(1, "sampleerrors: invalid sample size %d", size)
+	}
+	if maxFraction < 0 || maxFraction > 1 {
+		typecheck.Panicf(1, "sampleerrors: invalid maximum error fraction %v", maxFraction)
+	}
+	return sampleErrors{size, maxFraction}
+}
+
+// sampleErrorsOf returns the SampleErrors pragma in p, if any.
+func sampleErrorsOf(p Pragma) (sampleErrors, bool) {
+	switch p := p.(type) {
+	case sampleErrors:
+		return p, true
+	case Pragmas:
+		for _, q := range p {
+			if s, ok := sampleErrorsOf(q); ok {
+				return s, true
+			}
+		}
+	}
+	return sampleErrors{}, false
+}
+
+// MapErrorSample is the sample of the errors of a map operation.
+type MapErrorSample struct {
+	// Op is the name of the map operation, as given by Name.String.
+	Op string
+	// Count is the number of rows for which the map function returned
+	// an error.
+	Count int64
+	// Errors is a uniform sample of the errors.
+	Errors []*MapError
+}
+
+// MapErrors returns the errors sampled by map operations with the
+// SampleErrors pragma in the provided scope, ordered by operation name.
+// Use with the scope of a result (exec.Result.Scope) to retrieve the
+// errors sampled by its computation.
+func MapErrors(scope *metrics.Scope) []MapErrorSample {
+	var samples []MapErrorSample
+	for _, op := range mapErrors.Keys(scope) {
+		count, vals := mapErrors.Value(scope, op)
+		sample := MapErrorSample{Op: op, Count: count, Errors: make([]*MapError, len(vals))}
+		for i, v := range vals {
+			sample.Errors[i] = v.(*MapError)
+		}
+		samples = append(samples, sample)
+	}
+	return samples
+}
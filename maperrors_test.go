@@ -0,0 +1,95 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/bigslice"
+	"github.com/grailbio/bigslice/exec"
+)
+
+// failingMap returns a slice of N rows mapped by a function that
+// fails for every tenth row.
+func failingMap(prags ...bigslice.Pragma) bigslice.Slice {
+	const N = 1000
+	ints := make([]int, N)
+	for i := range ints {
+		ints[i] = i
+	}
+	slice := bigslice.Const(4, ints)
+	return bigslice.Map(slice, func(i int) (string, error) {
+		if i%10 == 0 {
+			return "", fmt.Errorf("bad row %d", i)
+		}
+		return fmt.Sprint(i), nil
+	}, prags...)
+}
+
+var mapErrorPattern = regexp.MustCompile(`shard (\d+): row (\d+): bad row \d+`)
+
+func TestMapFuncError(t *testing.T) {
+	for name, res := range runError(context.Background(), t, failingMap()) {
+		// The first failed row in each shard depends on the shard.
+		if res.Err == nil || !mapErrorPattern.MatchString(res.Err.Error()) {
+			t.Errorf("%s: got %v, want map error", name, res.Err)
+		}
+	}
+}
+
+func TestMapErrorSample(t *testing.T) {
+	ctx := context.Background()
+	for name, opt := range executors {
+		if testing.Short() && name != "Local" {
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			sess := exec.Start(opt)
+			fn := bigslice.Func(func() bigslice.Slice { return failingMap(bigslice.SampleErrors(5, 0.2)) })
+			res, err := sess.Run(ctx, fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var strs []string
+			if err = res.Collect(ctx, &strs); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := len(strs), 900; got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			samples := bigslice.MapErrors(res.Scope())
+			if got, want := len(samples), 1; got != want {
+				t.Fatalf("got %v, want %v", got, want)
+			}
+			sample := samples[0]
+			if got, want := sample.Count, int64(100); got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			if got, want := len(sample.Errors), 5; got != want {
+				t.Fatalf("got %v, want %v", got, want)
+			}
+			for _, err := range sample.Errors {
+				if err.Op != sample.Op {
+					t.Errorf("got %v, want %v", err.Op, sample.Op)
+				}
+				// Const shards have 251 rows each.
+				if got, want := err.Err.Error(), fmt.Sprintf("bad row %d", int64(err.Shard)*251+err.Row); got != want {
+					t.Errorf("got %v, want %v", got, want)
+				}
+			}
+		})
+	}
+
+	// Too many errors fail the computation.
+	for name, res := range runError(ctx, t, failingMap(bigslice.SampleErrors(5, 0.05))) {
+		if res.Err == nil || !strings.Contains(res.Err.Error(), "exceeding maximum fraction 0.05") {
+			t.Errorf("%s: got %v, want error", name, res.Err)
+		}
+	}
+}
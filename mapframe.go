@@ -0,0 +1,118 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/slicefunc"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/slicetype"
+	"github.com/grailbio/bigslice/typecheck"
+)
+
+type mapFrameSlice struct {
+	name Name
+	Pragmas
+	Slice
+	out slicetype.Type
+	fn  func(in frame.Frame) frame.Frame
+}
+
+// MapFrame transforms a slice by invoking fn for each frame of rows
+// read from it, rather than for each row, so that fn may operate
+// directly on whole column vectors. The returned slice has the
+// declared type out, which may be constructed using slicetype.New or be
+// a Slice; its prefix is that of out. Schematically:
+//
+//	MapFrame(Slice<t1, ..., tn>, slicetype<r1, ..., rm>, func(in frame.Frame) frame.Frame) Slice<r1, ..., rm>
+//
+// The frame passed to fn is nonempty and has the type of the input
+// slice. fn must return a frame of type out; columns are aligned by
+// construction, since a frame has a single length for all of its
+// columns. The returned frame may have any number of rows, so that fn
+// may also filter or expand its input. Returning a frame of a different
+// type fails the computation.
+//
+// fn owns its input frame for the duration of the call: it may modify
+// the frame in place, and may return it (or a slice of it) if out is
+// the type of the input slice. The input frame is reused once the rows
+// of the returned frame have been consumed, so fn must not retain
+// either frame across calls. MapFrame thus performs no per-row
+// reflection, beyond copying the returned frame to its consumer.
+func MapFrame(slice Slice, out slicetype.Type, fn func(in frame.Frame) frame.Frame, prags ...Pragma) Slice {
+	if fn == nil {
+		typecheck.Panic(1, "mapframe: nil function")
+	}
+	if out == nil || out.NumOut() == 0 {
+		typecheck.Panic(1, "mapframe: need at least one output column")
+	}
+	return &mapFrameSlice{MakeName("mapframe"), Pragmas(prags), slice, out, fn}
+}
+
+func (m *mapFrameSlice) Name() Name             { return m.name }
+func (m *mapFrameSlice) NumOut() int            { return m.out.NumOut() }
+func (m *mapFrameSlice) Out(c int) reflect.Type { return m.out.Out(c) }
+func (m *mapFrameSlice) Prefix() int            { return m.out.Prefix() }
+func (*mapFrameSlice) ShardType() ShardType     { return HashShard }
+func (*mapFrameSlice) NumDep() int              { return 1 }
+func (m *mapFrameSlice) Dep(i int) Dep          { return singleDep(i, m.Slice, false) }
+func (*mapFrameSlice) Combiner() slicefunc.Func { return slicefunc.Nil }
+
+func (m *mapFrameSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	return &mapFrameReader{op: m, reader: deps[0]}
+}
+
+type mapFrameReader struct {
+	op     *mapFrameSlice
+	reader sliceio.Reader
+	in     frame.Frame
+	// buf holds the rows returned by the function that have yet to be
+	// read.
+	buf frame.Frame
+	err error
+}
+
+func (m *mapFrameReader) Read(ctx context.Context, out frame.Frame) (int, error) {
+	if !slicetype.Assignable(out, m.op) {
+		return 0, errTypeError
+	}
+	for m.buf.Len() == 0 {
+		if m.err != nil {
+			return 0, m.err
+		}
+		if m.in.IsZero() {
+			m.in = frame.Make(m.op.Slice, out.Len(), out.Len())
+		} else {
+			m.in = m.in.Ensure(out.Len())
+		}
+		var n int
+		n, m.err = m.reader.Read(ctx, m.in.Slice(0, out.Len()))
+		if m.err != nil && m.err != sliceio.EOF {
+			return 0, m.err
+		}
+		if n == 0 {
+			continue
+		}
+		result := m.op.fn(m.in.Slice(0, n))
+		if result.Len() == 0 {
+			continue
+		}
+		if !typecheck.Equal(m.op, result) {
+			m.err = errors.E(errors.Fatal, errors.Invalid,
+				fmt.Sprintf("%s: function returned frame of type %s, expected %s",
+					m.op.name, slicetype.String(result), slicetype.String(m.op)))
+			return 0, m.err
+		}
+		m.buf = result
+	}
+	n := frame.Copy(out, m.buf)
+	m.buf = m.buf.Slice(n, m.buf.Len())
+	return n, nil
+}
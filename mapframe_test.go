@@ -0,0 +1,90 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/bigslice"
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/slicetype"
+)
+
+func TestMapFrame(t *testing.T) {
+	const N = 1000
+	ints := make([]int, N)
+	for i := range ints {
+		ints[i] = i
+	}
+	slice := bigslice.Const(5, ints)
+	// Modify the input frame in place.
+	doubled := bigslice.MapFrame(slice, slice, func(in frame.Frame) frame.Frame {
+		xs := in.Interface(0).([]int)
+		for i := range xs {
+			xs[i] *= 2
+		}
+		return in
+	})
+	if got, want := doubled.Name().Op, "mapframe"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	want := make([]int, N)
+	for i := range want {
+		want[i] = 2 * i
+	}
+	ctx := context.Background()
+	if got := scanInts(ctx, t, runLocal(ctx, t, doubled)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Filter rows and change the type of the slice.
+	typ := slicetype.New(reflect.TypeOf(""), reflect.TypeOf(0))
+	even := bigslice.MapFrame(slice, typ, func(in frame.Frame) frame.Frame {
+		var (
+			xs   = in.Interface(0).([]int)
+			strs []string
+			vals []int
+		)
+		for _, x := range xs {
+			if x%2 == 0 {
+				strs = append(strs, fmt.Sprint(x))
+				vals = append(vals, x)
+			}
+		}
+		return frame.Slices(strs, vals)
+	})
+	var (
+		wantStrs []string
+		wantVals []int
+	)
+	for i := 0; i < N; i += 2 {
+		wantStrs = append(wantStrs, fmt.Sprint(i))
+		wantVals = append(wantVals, i)
+	}
+	assertEqual(t, even, true, wantStrs, wantVals)
+}
+
+func TestMapFrameError(t *testing.T) {
+	slice := bigslice.Const(1, []int{1, 2, 3})
+	expectTypeError(t, "mapframe: nil function", func() {
+		bigslice.MapFrame(slice, slice, nil)
+	})
+	expectTypeError(t, "mapframe: need at least one output column", func() {
+		bigslice.MapFrame(slice, slicetype.New(), func(in frame.Frame) frame.Frame { return in })
+	})
+
+	slice = bigslice.MapFrame(slice, slicetype.New(reflect.TypeOf("")), func(in frame.Frame) frame.Frame {
+		return in
+	})
+	for name, res := range runError(context.Background(), t, slice) {
+		if err := res.Err; err == nil || !strings.Contains(err.Error(), "function returned frame of type slice[1]int, expected slice[1]string") {
+			t.Errorf("executor %s: got %v, want type error", name, err)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"fmt"
+
+	"github.com/grailbio/bigslice/slicefunc"
+	"github.com/grailbio/bigslice/sliceio"
+)
+
+type materializeSlice struct {
+	name Name
+	Slice
+}
+
+// Materialize returns a slice that is identical to the provided slice,
+// but whose results are materialized: the computation of the provided
+// slice is not pipelined with the computations that depend on the
+// returned slice, so that each of its shards is fully computed (and its
+// task results retained) before they are read. Materialize may be used
+// to reuse intermediate results across branches of a computation, or
+// to break a long pipeline into separately evaluated (and retried)
+// pieces.
+//
+// Unlike Reshuffle and Reshard, Materialize does not move any data: the
+// returned slice has the same shards, with the same sharding, as the
+// provided slice, and each of its shards is read directly from the
+// corresponding shard of the provided slice.
+func Materialize(slice Slice) Slice {
+	return &materializeSlice{MakeName("materialize"), slice}
+}
+
+func (m *materializeSlice) Name() Name             { return m.name }
+func (*materializeSlice) NumDep() int              { return 1 }
+func (m *materializeSlice) Dep(i int) Dep          { return singleDep(i, m.Slice, false) }
+func (*materializeSlice) Combiner() slicefunc.Func { return slicefunc.Nil }
+
+func (m *materializeSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	if len(deps) != 1 {
+		panic(fmt.Errorf("expected one dep, got %d", len(deps)))
+	}
+	return deps[0]
+}
+
+func (*materializeSlice) Procs() int        { return 1 }
+func (*materializeSlice) Exclusive() bool   { return false }
+func (*materializeSlice) Materialize() bool { return true }
@@ -0,0 +1,30 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/grailbio/bigslice"
+)
+
+func TestMaterialize(t *testing.T) {
+	const N = 100
+	strs := make([]string, N)
+	for i := range strs {
+		strs[i] = fmt.Sprint(i)
+	}
+	slice := bigslice.Const(5, strs)
+	slice = bigslice.Materialize(slice)
+	if got, want := slice.Name().Op, "materialize"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := slice.NumShard(), 5; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	slice = bigslice.Map(slice, func(s string) string { return s })
+	assertEqual(t, slice, true, strs)
+}
@@ -5,9 +5,12 @@
 package metrics_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/gob"
 	"fmt"
 	"log"
+	"reflect"
 	"testing"
 
 	"github.com/grailbio/bigslice"
@@ -39,6 +42,50 @@ func TestCounter(t *testing.T) {
 	}
 }
 
+func TestSampler(t *testing.T) {
+	var (
+		a, b metrics.Scope
+		s    = metrics.NewSampler()
+	)
+	for i := 0; i < 100; i++ {
+		s.Add(&a, "x", 10, i)
+	}
+	for i := 100; i < 150; i++ {
+		s.Add(&b, "x", 10, i)
+	}
+	s.Add(&b, "y", 10, -1)
+	a.Merge(&b)
+	if got, want := s.Keys(&a), []string{"x", "y"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&a); err != nil {
+		t.Fatal(err)
+	}
+	var c metrics.Scope
+	if err := gob.NewDecoder(&buf).Decode(&c); err != nil {
+		t.Fatal(err)
+	}
+	n, vals := s.Value(&c, "x")
+	if got, want := n, int64(150); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := len(vals), 10; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	seen := make(map[int]bool)
+	for _, v := range vals {
+		i := v.(int)
+		if i < 0 || i >= 150 || seen[i] {
+			t.Errorf("unexpected sample %v", i)
+		}
+		seen[i] = true
+	}
+	if n, vals = s.Value(&c, "y"); n != 1 || !reflect.DeepEqual(vals, []interface{}{-1}) {
+		t.Errorf("got %v, %v, want 1, [-1]", n, vals)
+	}
+}
+
 func ExampleCounter() {
 	filterCount := metrics.NewCounter()
 	filterFunc := bigslice.Func(func() (slice bigslice.Slice) {
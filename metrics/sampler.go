@@ -0,0 +1,198 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"bytes"
+	"encoding/gob"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// Sampler is a metric that counts values observed under a set of keys,
+// and retains a bounded, uniform sample of the values observed under
+// each key. Samples remain uniform when scopes are merged: each value
+// is assigned a random priority when it is observed, and each sample
+// comprises the values with the lowest priorities.
+//
+// Values are transmitted between processes by gob, and so must be of
+// types that are registered with gob.
+type Sampler struct {
+	id int
+}
+
+// NewSampler creates, registers, and returns a new Sampler metric.
+func NewSampler() Sampler {
+	var s Sampler
+	newMetric(func(id int) Metric {
+		s.id = id
+		return s
+	})
+	return s
+}
+
+// Add observes the value v under the provided key in the provided
+// scope, retaining at most size sampled values for the key.
+func (s Sampler) Add(scope *Scope, key string, size int, v interface{}) {
+	scope.instance(s).(*samplerValue).add(key, size, sample{rand.Uint64(), v})
+}
+
+// Value returns the number of values observed under the provided key
+// in the provided scope, and the values sampled from them.
+func (s Sampler) Value(scope *Scope, key string) (int64, []interface{}) {
+	return scope.instance(s).(*samplerValue).value(key)
+}
+
+// Keys returns the keys under which values were observed in the
+// provided scope, in sorted order.
+func (s Sampler) Keys(scope *Scope) []string {
+	return scope.instance(s).(*samplerValue).keys()
+}
+
+// metricID implements Metric.
+func (s Sampler) metricID() int { return s.id }
+
+// newInstance implements Metric.
+func (s Sampler) newInstance() interface{} {
+	return new(samplerValue)
+}
+
+// merge implements Metric.
+func (s Sampler) merge(x, y interface{}) {
+	x.(*samplerValue).merge(y.(*samplerValue))
+}
+
+func init() {
+	gob.Register(&samplerValue{})
+}
+
+type sample struct {
+	Priority uint64
+	Value    interface{}
+}
+
+// sampleSet is the sample of values observed under a single key.
+type sampleSet struct {
+	// Count is the number of values observed.
+	Count int64
+	// Size is the maximum number of samples retained.
+	Size int
+	// Samples are the values with the lowest priorities.
+	Samples []sample
+}
+
+func (s *sampleSet) add(x sample) {
+	s.Count++
+	if len(s.Samples) < s.Size {
+		s.Samples = append(s.Samples, x)
+		return
+	}
+	max := -1
+	for i := range s.Samples {
+		if max < 0 || s.Samples[i].Priority > s.Samples[max].Priority {
+			max = i
+		}
+	}
+	if max >= 0 && x.Priority < s.Samples[max].Priority {
+		s.Samples[max] = x
+	}
+}
+
+// samplerValue holds the sample sets of a Sampler, keyed by key.
+type samplerValue struct {
+	mu   sync.Mutex
+	sets map[string]*sampleSet
+}
+
+// GobEncode implements gob.GobEncoder.
+func (v *samplerValue) GobEncode() ([]byte, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var b bytes.Buffer
+	err := gob.NewEncoder(&b).Encode(v.sets)
+	return b.Bytes(), err
+}
+
+// GobDecode implements gob.GobDecoder.
+func (v *samplerValue) GobDecode(p []byte) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return gob.NewDecoder(bytes.NewReader(p)).Decode(&v.sets)
+}
+
+func (v *samplerValue) add(key string, size int, x sample) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.sets == nil {
+		v.sets = make(map[string]*sampleSet)
+	}
+	set := v.sets[key]
+	if set == nil {
+		set = &sampleSet{Size: size}
+		v.sets[key] = set
+	}
+	set.add(x)
+}
+
+func (v *samplerValue) value(key string) (int64, []interface{}) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	set := v.sets[key]
+	if set == nil {
+		return 0, nil
+	}
+	vals := make([]interface{}, len(set.Samples))
+	for i := range set.Samples {
+		vals[i] = set.Samples[i].Value
+	}
+	return set.Count, vals
+}
+
+func (v *samplerValue) keys() []string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	keys := make([]string, 0, len(v.sets))
+	for key := range v.sets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (v *samplerValue) merge(w *samplerValue) {
+	if v == w {
+		return
+	}
+	w.mu.Lock()
+	sets := make(map[string]sampleSet, len(w.sets))
+	for key, set := range w.sets {
+		sets[key] = sampleSet{set.Count, set.Size, append([]sample(nil), set.Samples...)}
+	}
+	w.mu.Unlock()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.sets == nil {
+		v.sets = make(map[string]*sampleSet)
+	}
+	for key, set := range sets {
+		mine := v.sets[key]
+		if mine == nil {
+			mine = &sampleSet{Size: set.Size}
+			v.sets[key] = mine
+		}
+		if set.Size > mine.Size {
+			mine.Size = set.Size
+		}
+		mine.Count += set.Count
+		mine.Samples = append(mine.Samples, set.Samples...)
+		sort.Slice(mine.Samples, func(i, j int) bool {
+			return mine.Samples[i].Priority < mine.Samples[j].Priority
+		})
+		if len(mine.Samples) > mine.Size {
+			mine.Samples = mine.Samples[:mine.Size]
+		}
+	}
+}
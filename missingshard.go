@@ -0,0 +1,241 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"sort"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/bigslice/metrics"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/typecheck"
+)
+
+var (
+	// SourceShardsSkipped counts the shards of source slices that were
+	// skipped because their sources could not be read (see
+	// OnMissingShard). It may be read from the scope of a task or of a
+	// result.
+	SourceShardsSkipped = metrics.NewCounter()
+	// SourceShardsEmpty counts the shards of source slices that were
+	// read as empty because their sources were missing (see
+	// OnMissingShard). It may be read from the scope of a task or of a
+	// result.
+	SourceShardsEmpty = metrics.NewCounter()
+)
+
+// missingShards records the shards that were skipped or read as empty
+// by source slices with the OnMissingShard pragma, keyed by the
+// slice's name.
+var missingShards = metrics.NewSampler()
+
+func init() {
+	gob.Register(&MissingShard{})
+}
+
+// MissingShardPolicy determines how a source slice handles a shard
+// whose source is missing or cannot be read.
+type MissingShardPolicy int
+
+const (
+	// FailMissingShards fails the computation. This is the default.
+	FailMissingShards MissingShardPolicy = iota
+	// SkipMissingShards skips shards whose sources are missing, or
+	// cannot be opened due to any other permanent error: the shards
+	// produce no rows, and are counted by SourceShardsSkipped.
+	SkipMissingShards
+	// EmptyMissingShards reads shards whose sources are missing (e.g.,
+	// objects that were deleted after they were listed) as if they
+	// were empty, so that they produce no rows, and counts them by
+	// SourceShardsEmpty. Other errors fail the computation.
+	EmptyMissingShards
+)
+
+// String returns the name of the policy.
+func (p MissingShardPolicy) String() string {
+	switch p {
+	case FailMissingShards:
+		return "fail"
+	case SkipMissingShards:
+		return "skip"
+	case EmptyMissingShards:
+		return "empty"
+	default:
+		return fmt.Sprintf("MissingShardPolicy(%d)", int(p))
+	}
+}
+
+// A MissingShard describes a shard of a source slice that was skipped,
+// or read as empty, by its OnMissingShard pragma.
+type MissingShard struct {
+	// Op is the name of the source slice, as given by Name.String.
+	Op string
+	// Shard is the index of the shard; NumShard is the number of shards
+	// of the slice.
+	Shard, NumShard int
+	// Source describes the shard's source, e.g., the URL of its object.
+	Source string
+	// Policy is the policy by which the shard was handled.
+	Policy MissingShardPolicy
+	// MaxFraction is the maximum fraction of the slice's shards that
+	// may be skipped or read as empty, as given by its pragma.
+	MaxFraction float64
+	// Err is the error with which the shard's source failed.
+	Err *errors.Error
+}
+
+// Error implements error.
+func (m *MissingShard) Error() string {
+	return fmt.Sprintf("%s: shard %d of %d (%s): %v", m.Op, m.Shard, m.NumShard, m.Source, m.Err)
+}
+
+type onMissingShard struct {
+	policy      MissingShardPolicy
+	maxFraction float64
+}
+
+func (onMissingShard) Procs() int        { return 1 }
+func (onMissingShard) Exclusive() bool   { return false }
+func (onMissingShard) Materialize() bool { return false }
+
+// OnMissingShard returns a pragma that determines how object store
+// sources (ReadGCS, ReadTextFiles, and ReadJSONLines) handle shards
+// whose sources are missing or unreadable when they are opened, e.g.,
+// because an object was deleted after it was listed. By default, such
+// shards fail the computation; with SkipMissingShards or
+// EmptyMissingShards, they instead produce no rows, so that transient
+// deletions do not fail long computations. Only permanent errors are
+// handled: temporary errors are retried as they otherwise would be
+// (see ReadRetry), and errors that occur after a shard has begun
+// producing rows fail the computation.
+//
+// Handled shards are counted by SourceShardsSkipped and
+// SourceShardsEmpty, and are described, with their errors, by
+// MissingShards. Should the fraction of the slice's shards that are
+// handled exceed maxFraction, the computation fails, so that a
+// computation does not silently process only a small fraction of its
+// data: a task fails if its shard alone exceeds the fraction (so
+// that maxFraction of 0 fails on any missing shard), and the
+// invocation fails once its tasks are complete if they together exceed
+// it. OnMissingShard has no effect on other slices.
+func OnMissingShard(policy MissingShardPolicy, maxFraction float64) Pragma {
+	if policy < FailMissingShards || policy > EmptyMissingShards {
+		typecheck.Panicf(1, "onmissingshard: invalid policy %v", policy)
+	}
+	if maxFraction < 0 || maxFraction > 1 {
+		typecheck.Panicf(1, "onmissingshard: invalid maximum fraction %v", maxFraction)
+	}
+	return onMissingShard{policy, maxFraction}
+}
+
+// onMissingShardOf returns the OnMissingShard pragma in p, if any.
+func onMissingShardOf(p Pragma) (onMissingShard, bool) {
+	switch p := p.(type) {
+	case onMissingShard:
+		return p, true
+	case Pragmas:
+		for _, q := range p {
+			if m, ok := onMissingShardOf(q); ok {
+				return m, true
+			}
+		}
+	}
+	return onMissingShard{}, false
+}
+
+// missingShard handles the error with which the source of the provided
+// shard of a source slice failed to open, before the shard produced
+// any rows, according to the slice's OnMissingShard pragma. It returns
+// sliceio.EOF if the shard is to produce no rows, and an error
+// otherwise.
+func missingShard(ctx context.Context, p Pragma, name Name, shard, numShard int, source string, err error) error {
+	m, ok := onMissingShardOf(p)
+	if !ok || errors.IsTemporary(err) {
+		return err
+	}
+	switch m.policy {
+	case SkipMissingShards:
+	case EmptyMissingShards:
+		if !errors.Is(errors.NotExist, err) {
+			return err
+		}
+	default:
+		return err
+	}
+	if 1 > m.maxFraction*float64(numShard) {
+		return errors.E(errors.Fatal, fmt.Sprintf("%s: shard %d: missing shard exceeds maximum fraction %v of %d shards",
+			name, shard, m.maxFraction, numShard), err)
+	}
+	scope := metrics.ContextScope(ctx)
+	if m.policy == SkipMissingShards {
+		SourceShardsSkipped.Incr(scope, 1)
+	} else {
+		SourceShardsEmpty.Incr(scope, 1)
+	}
+	missingShards.Add(scope, name.String(), numShard, &MissingShard{
+		Op:          name.String(),
+		Shard:       shard,
+		NumShard:    numShard,
+		Source:      source,
+		Policy:      m.policy,
+		MaxFraction: m.maxFraction,
+		Err:         errors.Recover(err),
+	})
+	log.Printf("%s: shard %d: %s: %v (%s)", name, shard, source, err, m.policy)
+	return sliceio.EOF
+}
+
+// MissingShardSample describes the shards of a source slice that were
+// skipped, or read as empty, by its OnMissingShard pragma.
+type MissingShardSample struct {
+	// Op is the name of the source slice, as given by Name.String.
+	Op string
+	// Count is the number of shards that were handled.
+	Count int64
+	// Shards describes the handled shards, ordered by shard.
+	Shards []*MissingShard
+}
+
+// MissingShards returns the shards that were skipped, or read as
+// empty, by source slices with the OnMissingShard pragma in the
+// provided scope, ordered by slice name. Use with the scope of a
+// result (exec.Result.Scope) to retrieve the shards handled by its
+// computation.
+func MissingShards(scope *metrics.Scope) []MissingShardSample {
+	var samples []MissingShardSample
+	for _, op := range missingShards.Keys(scope) {
+		count, vals := missingShards.Value(scope, op)
+		sample := MissingShardSample{Op: op, Count: count, Shards: make([]*MissingShard, len(vals))}
+		for i, v := range vals {
+			sample.Shards[i] = v.(*MissingShard)
+		}
+		sort.Slice(sample.Shards, func(i, j int) bool { return sample.Shards[i].Shard < sample.Shards[j].Shard })
+		samples = append(samples, sample)
+	}
+	return samples
+}
+
+// CheckMissingShards returns a fatal error if the fraction of the
+// shards of any source slice that were skipped, or read as empty, by
+// its OnMissingShard pragma in the provided scope exceeds the pragma's
+// maximum. It is called by executors once the tasks of an invocation
+// are complete, with their merged scopes.
+func CheckMissingShards(scope *metrics.Scope) error {
+	for _, sample := range MissingShards(scope) {
+		if len(sample.Shards) == 0 {
+			continue
+		}
+		shard := sample.Shards[0]
+		if float64(sample.Count) > shard.MaxFraction*float64(shard.NumShard) {
+			return errors.E(errors.Fatal, fmt.Sprintf("%s: %d of %d shards are missing, exceeding maximum fraction %v",
+				sample.Op, sample.Count, shard.NumShard, shard.MaxFraction))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/bigslice"
+	"github.com/grailbio/bigslice/exec"
+	"github.com/grailbio/testutil"
+)
+
+func TestOnMissingShard(t *testing.T) {
+	ctx := context.Background()
+	// The files are removed after they are listed, but before they are
+	// read. Since the Func removes them, it is run only locally.
+	sess := exec.Start(exec.Local)
+	defer sess.Shutdown()
+	fn := bigslice.Func(func(dir string, remove []int, policy int, maxFraction float64) bigslice.Slice {
+		var paths []string
+		for i := 0; i < 4; i++ {
+			paths = append(paths, filepath.Join(dir, fmt.Sprint(i)))
+		}
+		var prags []bigslice.Pragma
+		if policy != int(bigslice.FailMissingShards) {
+			prags = append(prags, bigslice.OnMissingShard(bigslice.MissingShardPolicy(policy), maxFraction))
+		}
+		slice := bigslice.ReadTextFiles(ctx, paths, nil, prags...)
+		for _, i := range remove {
+			if err := os.Remove(paths[i]); err != nil {
+				panic(err)
+			}
+		}
+		return slice
+	})
+	run := func(t *testing.T, remove []int, policy bigslice.MissingShardPolicy, maxFraction float64) (*exec.Result, string, error) {
+		t.Helper()
+		dir, cleanup := testutil.TempDir(t, "", "")
+		t.Cleanup(cleanup)
+		for i := 0; i < 4; i++ {
+			if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprint(i)), []byte(fmt.Sprintf("%d.0\n%d.1\n", i, i)), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		res, err := sess.Run(ctx, fn, dir, remove, int(policy), maxFraction)
+		return res, dir, err
+	}
+	read := func(t *testing.T, res *exec.Result) []string {
+		t.Helper()
+		var lines []string
+		if err := res.Collect(ctx, &lines); err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(lines)
+		return lines
+	}
+
+	for _, policy := range []bigslice.MissingShardPolicy{bigslice.SkipMissingShards, bigslice.EmptyMissingShards} {
+		t.Run(policy.String(), func(t *testing.T) {
+			res, dir, err := run(t, []int{1}, policy, 0.5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := read(t, res), []string{"0.0", "0.1", "2.0", "2.1", "3.0", "3.1"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			skipped, empty := bigslice.SourceShardsSkipped.Value(res.Scope()), bigslice.SourceShardsEmpty.Value(res.Scope())
+			if policy == bigslice.SkipMissingShards {
+				skipped, empty = empty, skipped
+			}
+			if got, want := skipped, int64(0); got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			if got, want := empty, int64(1); got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			samples := bigslice.MissingShards(res.Scope())
+			if got, want := len(samples), 1; got != want {
+				t.Fatalf("got %v, want %v", got, want)
+			}
+			if got, want := samples[0].Count, int64(1); got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			shard := samples[0].Shards[0]
+			if got, want := shard.Shard, 1; got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			if got, want := shard.Source, filepath.Join(dir, "1"); got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			if got, want := shard.Policy, policy; got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+
+	// By default, missing shards fail the computation.
+	if _, _, err := run(t, []int{1}, bigslice.FailMissingShards, 0); err == nil {
+		t.Error("expected error")
+	}
+	// Each shard exceeds a maximum fraction of 0.
+	if _, _, err := run(t, []int{1}, bigslice.SkipMissingShards, 0); err == nil || !strings.Contains(err.Error(), "maximum fraction") {
+		t.Errorf("got %v, want maximum fraction error", err)
+	}
+	// Together, shards exceed the maximum fraction.
+	if _, _, err := run(t, []int{1, 2}, bigslice.EmptyMissingShards, 0.25); err == nil || !strings.Contains(err.Error(), "2 of 4 shards are missing") {
+		t.Errorf("got %v, want maximum fraction error", err)
+	}
+}
+
+func TestOnMissingShardType(t *testing.T) {
+	expectTypeError(t, "onmissingshard: invalid maximum fraction 2", func() { bigslice.OnMissingShard(bigslice.SkipMissingShards, 2) })
+	expectTypeError(t, "onmissingshard: invalid policy MissingShardPolicy(5)", func() { bigslice.OnMissingShard(5, 0) })
+}
@@ -0,0 +1,112 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/slicefunc"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/slicetype"
+	"github.com/grailbio/bigslice/typecheck"
+)
+
+// Partition2 returns two slices that partition the rows of the
+// provided slice by the provided predicate: the first contains the
+// rows for which the predicate returns true, the second those for
+// which it returns false. The predicate has the same form as that of
+// Filter. Schematically:
+//
+//	Partition2(Slice<t1, ..., tn>, func(t1, ..., tn) bool) (Slice<t1, ..., tn>, Slice<t1, ..., tn>)
+//
+// Both returned slices have the same shards as the provided slice.
+// Unlike a pair of Filters, Partition2 reads the provided slice, and
+// evaluates the predicate, exactly once: each of its shards is
+// computed by a single task, which routes each row to one of two
+// outputs that are read by the tasks of the returned slices. The
+// outputs share their computation only when they are used by the same
+// invocation. Either output may be left unused, in which case it is
+// never read; however, its rows are still routed and retained with
+// the task's output.
+func Partition2(slice Slice, pred interface{}) (Slice, Slice) {
+	fn, ok := slicefunc.Of(pred)
+	if !ok {
+		typecheck.Panicf(1, "partition2: invalid predicate function %T", pred)
+	}
+	if !typecheck.CanApply(fn, slice) {
+		typecheck.Panicf(1, "partition2: function %T does not match input slice type %s", pred, slicetype.String(slice))
+	}
+	if fn.Out.NumOut() != 1 || fn.Out.Out(0).Kind() != reflect.Bool {
+		typecheck.Panic(1, "partition2: predicate must return a single boolean value")
+	}
+	p := &partition2Slice{MakeName("partition2"), slice, fn}
+	return &branchSlice{MakeName("partition2_true"), p, p.route, 0, 2},
+		&branchSlice{MakeName("partition2_false"), p, p.route, 1, 2}
+}
+
+// partition2Slice computes the slice that it embeds, routing its rows
+// to output 0 or 1 by the predicate.
+type partition2Slice struct {
+	name Name
+	Slice
+	pred slicefunc.Func
+}
+
+func (p *partition2Slice) Name() Name             { return p.name }
+func (*partition2Slice) NumDep() int              { return 1 }
+func (p *partition2Slice) Dep(i int) Dep          { return singleDep(i, p.Slice, false) }
+func (*partition2Slice) Combiner() slicefunc.Func { return slicefunc.Nil }
+
+func (p *partition2Slice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	if len(deps) != 1 {
+		panic(fmt.Errorf("expected one dep, got %d", len(deps)))
+	}
+	return deps[0]
+}
+
+// route is the partitioner of the slice's outputs.
+func (p *partition2Slice) route(ctx context.Context, f frame.Frame, nshard int, shards []int) {
+	args := make([]reflect.Value, f.NumOut())
+	for i := range shards {
+		for j := range args {
+			args[j] = f.Index(j, i)
+		}
+		if p.pred.Call(ctx, args)[0].Bool() {
+			shards[i] = 0
+		} else {
+			shards[i] = 1
+		}
+	}
+}
+
+// branchSlice is one of the outputs of a multi-output slice, whose
+// rows are routed to its outputs by route.
+type branchSlice struct {
+	name Name
+	Slice
+	route             Partitioner
+	branch, numBranch int
+}
+
+func (b *branchSlice) Name() Name             { return b.name }
+func (*branchSlice) NumDep() int              { return 1 }
+func (*branchSlice) Combiner() slicefunc.Func { return slicefunc.Nil }
+
+func (b *branchSlice) Dep(i int) Dep {
+	if i != 0 {
+		panic(fmt.Sprintf("invalid dependency %d", i))
+	}
+	return Dep{Slice: b.Slice, Partitioner: b.route, NumBranch: b.numBranch, Branch: b.branch}
+}
+
+func (b *branchSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	if len(deps) != 1 {
+		panic(fmt.Errorf("expected one dep, got %d", len(deps)))
+	}
+	return deps[0]
+}
@@ -0,0 +1,80 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+	"testing"
+
+	"github.com/grailbio/bigslice"
+	"github.com/grailbio/bigslice/sliceio"
+)
+
+func TestPartition2(t *testing.T) {
+	const N, Nshard = 1000, 7
+	var reads int32
+	slice := bigslice.ReaderFunc(Nshard, func(shard int, n *int, ints []int) (int, error) {
+		atomic.AddInt32(&reads, 1)
+		if *n >= N/Nshard+1 {
+			return 0, sliceio.EOF
+		}
+		i := shard + *n*Nshard
+		*n++
+		if i >= N {
+			return 0, sliceio.EOF
+		}
+		ints[0] = i
+		return 1, nil
+	})
+	evens, odds := bigslice.Partition2(slice, func(i int) bool { return i%2 == 0 })
+	if got, want := evens.NumShard(), Nshard; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	evens = bigslice.Map(evens, func(i int) (int, bool) { return i, true })
+	odds = bigslice.Map(odds, func(i int) (int, bool) { return i, false })
+	slice = bigslice.Cogroup(evens, odds)
+
+	ctx := context.Background()
+	scan := runLocal(ctx, t, slice)
+	var (
+		key       int
+		even, odd []bool
+		keys      []int
+	)
+	for scan.Scan(ctx, &key, &even, &odd) {
+		keys = append(keys, key)
+		if key%2 == 0 && (len(even) != 1 || len(odd) != 0) || key%2 == 1 && (len(even) != 0 || len(odd) != 1) {
+			t.Errorf("key %d: got %v, %v", key, even, odd)
+		}
+	}
+	if err := scan.Err(); err != nil {
+		t.Fatal(err)
+	}
+	sort.Ints(keys)
+	if got, want := len(keys), N; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i, key := range keys {
+		if key != i {
+			t.Fatalf("got %v, want %v", key, i)
+		}
+	}
+	// Each row is read once, and each shard reaches EOF once.
+	if got, want := atomic.LoadInt32(&reads), int32(N+Nshard); got != want {
+		t.Errorf("got %v reads, want %v", got, want)
+	}
+}
+
+func TestPartition2Unused(t *testing.T) {
+	const N = 100
+	ints := make([]int, N)
+	for i := range ints {
+		ints[i] = i
+	}
+	small, _ := bigslice.Partition2(bigslice.Const(4, ints), func(i int) bool { return i < 10 })
+	assertEqual(t, small, false, ints[:10])
+}
@@ -0,0 +1,218 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/metrics"
+	"github.com/grailbio/bigslice/sliceio"
+	"golang.org/x/time/rate"
+)
+
+var (
+	// SourceRateLimitedRows counts the rows read from source slices with
+	// the ReadRateLimit pragma.
+	SourceRateLimitedRows = metrics.NewCounter()
+	// SourceRateLimitedBytes counts the (estimated) bytes read from
+	// source slices with the ReadRateLimit pragma.
+	SourceRateLimitedBytes = metrics.NewCounter()
+	// SourceRateLimitedNanos counts the nanoseconds spent reading from
+	// source slices with the ReadRateLimit pragma, including the time
+	// spent waiting on the limit.
+	SourceRateLimitedNanos = metrics.NewCounter()
+	// SourceRateLimitWaitNanos counts the nanoseconds spent waiting on
+	// the limits of ReadRateLimit pragmas.
+	SourceRateLimitWaitNanos = metrics.NewCounter()
+)
+
+// SourceReadThroughput returns the effective throughput, in rows and
+// bytes per second, of the rate limited source reads counted in the
+// provided scope. When the scope is a task's scope, this is the
+// throughput of the task's source shard.
+func SourceReadThroughput(scope *metrics.Scope) (rowsPerSec, bytesPerSec float64) {
+	nanos := SourceRateLimitedNanos.Value(scope)
+	if nanos == 0 {
+		return 0, 0
+	}
+	secs := time.Duration(nanos).Seconds()
+	return float64(SourceRateLimitedRows.Value(scope)) / secs,
+		float64(SourceRateLimitedBytes.Value(scope)) / secs
+}
+
+// A RateLimit limits the rate at which a source slice is read. Zero
+// rates are unlimited.
+type RateLimit struct {
+	// RowsPerSec is the maximum number of rows read per second.
+	RowsPerSec float64
+	// BytesPerSec is the maximum number of bytes read per second. The
+	// size of a row is estimated from the in-memory size of its
+	// values: the fixed size of each value plus the lengths of strings
+	// and byte slices.
+	BytesPerSec float64
+	// SplitAmongShards indicates that the limit is split evenly among
+	// the slice's shards: each of its n shards is limited to 1/n of the
+	// rates, so that the slice as a whole never exceeds them, even when
+	// all of its shards are read concurrently. The limit is nonetheless
+	// enforced per shard: shards are not coordinated at runtime, so
+	// when fewer shards run at once, the slice is read more slowly than
+	// the rates allow. Otherwise, each shard is limited to the rates.
+	SplitAmongShards bool
+}
+
+type readRateLimit struct {
+	RateLimit
+}
+
+func (readRateLimit) Procs() int        { return 1 }
+func (readRateLimit) Exclusive() bool   { return false }
+func (readRateLimit) Materialize() bool { return false }
+
+// ReadRateLimit returns a pragma that limits the rate at which source
+// slices (ReaderFunc, ScanReader, ReadTextFiles, ReadJSONLines, and
+// ReadGCS) are read, to protect the external systems from which they read. The
+// limit is enforced by a token bucket that holds up to a second's
+// worth of rows or bytes: reads are charged after they complete, and
+// the next read waits until the bucket has been replenished. Reads
+// that are retried by a ReadRetry pragma are charged only for the rows
+// that they produce.
+//
+// The effective throughput of rate limited reads is reported by
+// SourceReadThroughput, and the time spent waiting on the limit by
+// SourceRateLimitWaitNanos. ReadRateLimit has no effect on slices that
+// are not sources.
+func ReadRateLimit(limit RateLimit) Pragma {
+	return readRateLimit{limit}
+}
+
+// readRateLimitOf returns the ReadRateLimit pragma in p, if any.
+func readRateLimitOf(p Pragma) (readRateLimit, bool) {
+	switch p := p.(type) {
+	case readRateLimit:
+		return p, true
+	case Pragmas:
+		for _, q := range p {
+			if r, ok := readRateLimitOf(q); ok {
+				return r, true
+			}
+		}
+	}
+	return readRateLimit{}, false
+}
+
+// withReadRateLimit returns a reader for a shard of a source slice
+// with nshard shards that applies the slice's ReadRateLimit pragma, if
+// any, to the provided reader.
+func withReadRateLimit(p Pragma, nshard int, reader sliceio.Reader) sliceio.Reader {
+	rl, ok := readRateLimitOf(p)
+	if !ok {
+		return reader
+	}
+	r := &rateLimitReader{Reader: reader}
+	r.rows = newLimiter(rl.RowsPerSec, rl.SplitAmongShards, nshard)
+	r.bytes = newLimiter(rl.BytesPerSec, rl.SplitAmongShards, nshard)
+	return r
+}
+
+// newLimiter returns a token bucket limiter for the provided per-second
+// rate, or nil if the rate is unlimited. If split is true, the rate is
+// split evenly among nshard shards.
+func newLimiter(perSec float64, split bool, nshard int) *rate.Limiter {
+	if perSec <= 0 {
+		return nil
+	}
+	if split && nshard > 1 {
+		perSec /= float64(nshard)
+	}
+	burst := int(math.Ceil(perSec))
+	return rate.NewLimiter(rate.Limit(perSec), burst)
+}
+
+// rateLimitReader implements the ReadRateLimit pragma for a shard of a
+// source slice.
+type rateLimitReader struct {
+	sliceio.Reader
+	rows, bytes *rate.Limiter
+}
+
+var _ sliceio.Cleaner = (*rateLimitReader)(nil)
+
+// Cleanup implements sliceio.Cleaner by cleaning up the underlying
+// reader, if it is a cleaner.
+func (r *rateLimitReader) Cleanup(ctx context.Context) error {
+	if cleaner, ok := r.Reader.(sliceio.Cleaner); ok {
+		return cleaner.Cleanup(ctx)
+	}
+	return nil
+}
+
+func (r *rateLimitReader) Read(ctx context.Context, out frame.Frame) (int, error) {
+	start := time.Now()
+	n, err := r.Reader.Read(ctx, out)
+	var (
+		scope = metrics.ContextScope(ctx)
+		size  int64
+	)
+	if n > 0 {
+		if r.bytes != nil {
+			size = approxFrameSize(out.Slice(0, n))
+		}
+		waitStart := time.Now()
+		if werr := wait(ctx, r.rows, int64(n)); werr != nil && err == nil {
+			err = werr
+		}
+		if werr := wait(ctx, r.bytes, size); werr != nil && err == nil {
+			err = werr
+		}
+		SourceRateLimitWaitNanos.Incr(scope, int64(time.Since(waitStart)))
+	}
+	SourceRateLimitedRows.Incr(scope, int64(n))
+	SourceRateLimitedBytes.Incr(scope, size)
+	SourceRateLimitedNanos.Incr(scope, int64(time.Since(start)))
+	return n, err
+}
+
+// wait waits until n tokens are available from the provided limiter,
+// which may be nil. Tokens are taken in increments of at most the
+// limiter's burst size, so that n may exceed it.
+func wait(ctx context.Context, lim *rate.Limiter, n int64) error {
+	if lim == nil {
+		return nil
+	}
+	burst := int64(lim.Burst())
+	for n > 0 {
+		m := n
+		if m > burst {
+			m = burst
+		}
+		if err := lim.WaitN(ctx, int(m)); err != nil {
+			return err
+		}
+		n -= m
+	}
+	return nil
+}
+
+// approxFrameSize returns an estimate of the number of bytes of memory
+// used by the values of frame f: the fixed size of each value, plus the
+// lengths of strings and byte slices.
+func approxFrameSize(f frame.Frame) int64 {
+	var size int64
+	for col := 0; col < f.NumOut(); col++ {
+		typ := f.Out(col)
+		size += int64(f.Len()) * int64(typ.Size())
+		if typ.Kind() == reflect.String || typ.Kind() == reflect.Slice && typ.Elem().Kind() == reflect.Uint8 {
+			v := f.Value(col)
+			for i := 0; i < f.Len(); i++ {
+				size += int64(v.Index(i).Len())
+			}
+		}
+	}
+	return size
+}
@@ -0,0 +1,56 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/grailbio/bigslice/metrics"
+)
+
+func TestReadRateLimit(t *testing.T) {
+	for _, limit := range []RateLimit{
+		{RowsPerSec: 20},
+		// Split among 4 shards.
+		{RowsPerSec: 80, SplitAmongShards: true},
+		// Rows are ints, estimated at 8 bytes each.
+		{BytesPerSec: 20 * 8},
+	} {
+		var (
+			scope metrics.Scope
+			ctx   = metrics.ScopedContext(context.Background(), &scope)
+			slice = flakySource(40, func(int) error { return nil }, ReadRateLimit(limit))
+		)
+		slice.(*readerFuncSlice).nshard = 4
+		// The initial burst admits 20 rows immediately, so the
+		// remaining 20 take at least a second.
+		start := time.Now()
+		vals, err := readRetrySlice(ctx, slice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+			t.Errorf("%+v: read too fast: %s", limit, elapsed)
+		}
+		if got, want := len(vals), 40; got != want {
+			t.Errorf("%+v: got %v, want %v", limit, got, want)
+		}
+		if got, want := SourceRateLimitedRows.Value(&scope), int64(40); got != want {
+			t.Errorf("%+v: got %v, want %v", limit, got, want)
+		}
+		if rows, _ := SourceReadThroughput(&scope); rows <= 0 || rows > 50 {
+			t.Errorf("%+v: unexpected throughput %v", limit, rows)
+		}
+	}
+}
+
+func TestReadRateLimitUnlimited(t *testing.T) {
+	slice := flakySource(10, func(int) error { return nil })
+	if _, ok := slice.Reader(0, nil).(*rateLimitReader); ok {
+		t.Error("unexpected rate limited reader")
+	}
+}
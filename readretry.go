@@ -0,0 +1,216 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/base/retry"
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/metrics"
+	"github.com/grailbio/bigslice/sliceio"
+)
+
+// SourceReadRetries counts the number of times that reads of source
+// slices with the ReadRetry pragma were retried. Since each task reads
+// from at most one source, the count in a task's scope is the number
+// of retries of that task's source.
+var SourceReadRetries = metrics.NewCounter()
+
+// errReadTimeout is returned by reads that did not complete within
+// the timeout of a ReadRetry pragma.
+var errReadTimeout = errors.E(errors.Timeout, errors.Temporary, "source read timed out")
+
+type readRetry struct {
+	timeout time.Duration
+	policy  retry.Policy
+}
+
+func (readRetry) Procs() int        { return 1 }
+func (readRetry) Exclusive() bool   { return false }
+func (readRetry) Materialize() bool { return false }
+
+// ReadRetry returns a pragma that makes reads of source slices
+// (ReaderFunc, ScanReader, ReadTextFiles, and ReadJSONLines) resilient
+// to hung reads and transient errors, without failing the task that
+// performs them. Each read of the source must complete within the
+// provided timeout (if nonzero). A read that times out or that returns
+// a temporary error (see errors.IsTemporary) is retried according to
+// the provided policy: the shard's reader is restarted from the
+// beginning of the shard, and the rows that were already produced are
+// skipped, so the source must be deterministic. Any other error is
+// permanent, and is returned immediately. When the policy gives up,
+// the last error is returned, and subsequent handling is left to the
+// executor, which may retry the whole task. Retries are counted by
+// SourceReadRetries.
+//
+// Since a timed out read cannot be interrupted if it does not respect
+// its context's cancellation, reads are performed in a separate
+// goroutine, which is abandoned (along with its reader) if it times
+// out. ReadRetry has no effect on slices that are not sources.
+func ReadRetry(timeout time.Duration, policy retry.Policy) Pragma {
+	return readRetry{timeout, policy}
+}
+
+// readRetryOf returns the ReadRetry pragma in p, if any.
+func readRetryOf(p Pragma) (readRetry, bool) {
+	switch p := p.(type) {
+	case readRetry:
+		return p, true
+	case Pragmas:
+		for _, q := range p {
+			if r, ok := readRetryOf(q); ok {
+				return r, true
+			}
+		}
+	}
+	return readRetry{}, false
+}
+
+// withReadRetry returns a reader for the provided shard of a source
+// slice that applies the slice's ReadRetry pragma, if any. Reader
+// must return a new reader for the shard each time it is called.
+func withReadRetry(p Pragma, name Name, shard int, reader func() sliceio.Reader) sliceio.Reader {
+	rr, ok := readRetryOf(p)
+	if !ok {
+		return reader()
+	}
+	return &retryReader{readRetry: rr, name: name, shard: shard, newReader: reader}
+}
+
+// retryReader implements the ReadRetry pragma for a shard of a source
+// slice.
+type retryReader struct {
+	readRetry
+	name      Name
+	shard     int
+	newReader func() sliceio.Reader
+
+	reader sliceio.Reader
+	buf    frame.Frame
+	// produced is the number of rows returned by retryReader; skip is
+	// the number of rows that remain to be skipped by a restarted
+	// reader.
+	produced, skip int
+	// retries is the number of consecutive retries.
+	retries int
+	// abandoned are the readers that were abandoned after timing out,
+	// which are cleaned up only once the task attempt is complete.
+	abandoned []sliceio.Reader
+}
+
+var _ sliceio.Cleaner = (*retryReader)(nil)
+
+// Cleanup implements sliceio.Cleaner by cleaning up the current reader
+// and any abandoned readers.
+func (r *retryReader) Cleanup(ctx context.Context) error {
+	var err error
+	for _, reader := range append(r.abandoned, r.reader) {
+		if cleaner, ok := reader.(sliceio.Cleaner); ok {
+			if cerr := cleaner.Cleanup(ctx); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	}
+	r.abandoned = nil
+	r.reader = nil
+	return err
+}
+
+// cleanup cleans up the provided reader, which has been discarded,
+// logging any error.
+func cleanup(reader sliceio.Reader) {
+	cleaner, ok := reader.(sliceio.Cleaner)
+	if !ok {
+		return
+	}
+	if err := cleaner.Cleanup(context.Background()); err != nil {
+		log.Error.Printf("error cleaning up discarded reader: %v", err)
+	}
+}
+
+func (r *retryReader) Read(ctx context.Context, out frame.Frame) (int, error) {
+	for {
+		if r.reader == nil {
+			r.reader = r.newReader()
+			r.skip = r.produced
+		}
+		if r.buf.IsZero() || r.buf.Cap() < out.Len() {
+			r.buf = frame.Make(out, out.Len(), out.Len())
+		}
+		n, err := r.read(ctx, r.buf.Slice(0, out.Len()))
+		if err != nil && err != sliceio.EOF && (errors.IsTemporary(err) || errors.Is(errors.Timeout, err)) && ctx.Err() == nil {
+			if err != errReadTimeout {
+				// A reader that timed out is abandoned, as it may still
+				// be in use.
+				if closer, ok := r.reader.(sliceio.ReadCloser); ok {
+					_ = closer.Close()
+				}
+				cleanup(r.reader)
+			} else {
+				r.buf = frame.Frame{}
+				r.abandoned = append(r.abandoned, r.reader)
+			}
+			r.reader = nil
+			if waitErr := retry.Wait(ctx, r.policy, r.retries); waitErr != nil {
+				return 0, errors.E(fmt.Sprintf("%s: shard %d: giving up after %d retries", r.name, r.shard, r.retries), err)
+			}
+			r.retries++
+			SourceReadRetries.Incr(metrics.ContextScope(ctx), 1)
+			log.Printf("%s: shard %d: retrying source read (retry %d): %v", r.name, r.shard, r.retries, err)
+			continue
+		}
+		r.retries = 0
+		// Skip rows that were produced before the reader was restarted.
+		m := r.skip
+		if m > n {
+			m = n
+		}
+		r.skip -= m
+		n = frame.Copy(out, r.buf.Slice(m, n))
+		r.produced += n
+		if n == 0 && err == nil {
+			continue
+		}
+		return n, err
+	}
+}
+
+// read reads from the current reader within the provided timeout.
+func (r *retryReader) read(ctx context.Context, f frame.Frame) (int, error) {
+	if r.timeout <= 0 {
+		return r.reader.Read(ctx, f)
+	}
+	type result struct {
+		n   int
+		err error
+	}
+	var (
+		readCtx, cancel = context.WithTimeout(ctx, r.timeout)
+		resultc         = make(chan result, 1)
+		reader          = r.reader
+	)
+	defer cancel()
+	go func() {
+		n, err := reader.Read(readCtx, f)
+		resultc <- result{n, err}
+	}()
+	select {
+	case res := <-resultc:
+		if res.err != nil && readCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+			return 0, errReadTimeout
+		}
+		return res.n, res.err
+	case <-readCtx.Done():
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		return 0, errReadTimeout
+	}
+}
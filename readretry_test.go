@@ -0,0 +1,154 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/retry"
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/metrics"
+	"github.com/grailbio/bigslice/sliceio"
+)
+
+// flakySource returns a ReaderFunc slice with a single shard that
+// produces the integers [0, n) in reads of 2 rows. Fail is called
+// before each read, with the number of rows produced so far by the
+// current reader, and may return an error to fail the read, or block.
+func flakySource(n int, fail func(off int) error, prags ...Pragma) Slice {
+	return ReaderFunc(1, func(shard int, off *int, out []int) (int, error) {
+		if err := fail(*off); err != nil {
+			return 0, err
+		}
+		var m int
+		for m < len(out) && m < 2 && *off < n {
+			out[m] = *off
+			m++
+			*off++
+		}
+		if *off == n {
+			return m, sliceio.EOF
+		}
+		return m, nil
+	}, prags...)
+}
+
+func readRetrySlice(ctx context.Context, slice Slice) ([]int, error) {
+	var (
+		r    = slice.Reader(0, nil)
+		f    = frame.Make(slice, 3, 3)
+		vals []int
+	)
+	for {
+		n, err := r.Read(ctx, f)
+		for i := 0; i < n; i++ {
+			vals = append(vals, int(f.Index(0, i).Int()))
+		}
+		if err == sliceio.EOF {
+			return vals, nil
+		}
+		if err != nil {
+			return vals, err
+		}
+	}
+}
+
+func TestReadRetry(t *testing.T) {
+	var (
+		scope  metrics.Scope
+		ctx    = metrics.ScopedContext(context.Background(), &scope)
+		policy = retry.MaxTries(retry.Backoff(time.Millisecond, 10*time.Millisecond, 2), 5)
+		mu     sync.Mutex
+		fails  = map[int]int{4: 2, 8: 1}
+	)
+	// Reads at offsets 4 and 8 fail transiently.
+	slice := flakySource(10, func(off int) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if fails[off] > 0 {
+			fails[off]--
+			return errors.E(errors.Temporary, "flaky")
+		}
+		return nil
+	}, ReadRetry(0, policy))
+	vals, err := readRetrySlice(ctx, slice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := vals, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := SourceReadRetries.Value(&scope), int64(3); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Permanent errors are not retried.
+	scope.Reset(nil)
+	slice = flakySource(10, func(off int) error {
+		if off == 4 {
+			return errors.New("permanent")
+		}
+		return nil
+	}, ReadRetry(0, policy))
+	if _, err = readRetrySlice(ctx, slice); err == nil {
+		t.Fatal("expected error")
+	}
+	if !errors.Match(errors.E(errors.Fatal), err) {
+		t.Errorf("got %v, want fatal error", err)
+	}
+	if got, want := SourceReadRetries.Value(&scope), int64(0); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Persistent transient errors exhaust the policy.
+	slice = flakySource(10, func(off int) error {
+		return errors.E(errors.Temporary, "flaky")
+	}, ReadRetry(0, policy))
+	if _, err = readRetrySlice(ctx, slice); err == nil || !errors.IsTemporary(err) {
+		t.Errorf("got %v, want temporary error", err)
+	}
+	if got, want := SourceReadRetries.Value(&scope), int64(5); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestReadRetryTimeout(t *testing.T) {
+	var (
+		scope   metrics.Scope
+		ctx     = metrics.ScopedContext(context.Background(), &scope)
+		policy  = retry.MaxTries(retry.Backoff(time.Millisecond, 10*time.Millisecond, 2), 5)
+		blockc  = make(chan struct{})
+		mu      sync.Mutex
+		blocked bool
+	)
+	defer close(blockc)
+	// The first read at offset 6 hangs, ignoring its context.
+	slice := flakySource(10, func(off int) error {
+		mu.Lock()
+		if off != 6 || blocked {
+			mu.Unlock()
+			return nil
+		}
+		blocked = true
+		mu.Unlock()
+		<-blockc
+		return nil
+	}, ReadRetry(10*time.Millisecond, policy))
+	vals, err := readRetrySlice(ctx, slice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := vals, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := SourceReadRetries.Value(&scope), int64(1); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
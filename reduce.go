@@ -5,9 +5,12 @@
 package bigslice
 
 import (
+	"context"
 	"fmt"
+	"reflect"
 	"strings"
 
+	"github.com/grailbio/base/errors"
 	"github.com/grailbio/bigslice/frame"
 	"github.com/grailbio/bigslice/slicefunc"
 	"github.com/grailbio/bigslice/sliceio"
@@ -30,11 +33,11 @@ import (
 // its prefix must leave just one column as the value column to be
 // aggregated.
 //
-// TODO(marius): Reduce currently maintains the working set of keys
-// in memory, and is thus appropriate only where the working set can
-// fit in memory. For situations where this is not the case, Cogroup
-// should be used instead (at an overhead). Reduce should spill to disk
-// when necessary.
+// Reduce groups keys in an in-memory hash table, which is spilled to
+// disk, as a sorted run of keys, when it grows too large; the runs are
+// then merged and reduced. The memory used by the table may be bounded
+// by the session (see exec.CombinerMemory), so that Reduce can handle
+// key sets that do not fit in memory.
 //
 // TODO(marius): consider pushing combiners into task dependency
 // definitions so that we can combine-read all partitions on one machine
@@ -67,7 +70,7 @@ type reduceSlice struct {
 
 func (r *reduceSlice) Name() Name               { return r.name }
 func (*reduceSlice) NumDep() int                { return 1 }
-func (r *reduceSlice) Dep(i int) Dep            { return Dep{r.Slice, true, nil, true} }
+func (r *reduceSlice) Dep(i int) Dep            { return Dep{Slice: r.Slice, Shuffle: true, Expand: true} }
 func (r *reduceSlice) Combiner() slicefunc.Func { return r.combiner }
 
 func (r *reduceSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
@@ -77,6 +80,169 @@ func (r *reduceSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
 	return sortio.Reduce(r, fmt.Sprintf("app-%d", shard), deps, r.combiner)
 }
 
+// ReduceMulti returns a slice that reduces elements pairwise, as
+// Reduce, and then emits any number of rows for each key: the provided
+// emit function is invoked once for each key, with the key columns and
+// the key's reduced value, and returns the output columns of the key's
+// rows as parallel slices. The emitted rows are prefixed by the key.
+// For example, the top 3 values of each key may be computed by
+// reducing into sorted, truncated lists, and emitting their elements.
+// Schematically:
+//
+//	ReduceMulti(Slice<k, v>, func(v1, v2 v) v, func(k, v) ([]r1, ..., []rn)) Slice<k, r1, ..., rn>
+//
+// The reduce function is used as the slice's combiner, exactly as for
+// Reduce: map-side combining maintains a single reduced value per key,
+// and rows are emitted only by the final reduction. The slice's name
+// has the Op "reducemulti".
+func ReduceMulti(slice Slice, reduce, emit interface{}) Slice {
+	if res := slice.NumOut() - slice.Prefix(); res != 1 {
+		typecheck.Panicf(1, "reducemulti: the slice must only have one 1 residual column; has %d", res)
+	}
+	if err := canMakeCombiningFrame(slice); err != nil {
+		typecheck.Panic(1, err.Error())
+	}
+	reduceFn, ok := slicefunc.Of(reduce)
+	if !ok {
+		typecheck.Panicf(1, "reducemulti: invalid reduce function %T", reduce)
+	}
+	valueType := slice.Out(slice.NumOut() - 1)
+	if reduceFn.In.NumOut() != 2 || reduceFn.In.Out(0) != valueType || reduceFn.In.Out(1) != valueType ||
+		reduceFn.Out.NumOut() != 1 || reduceFn.Out.Out(0) != valueType {
+		typecheck.Panicf(1, "reducemulti: invalid reduce function %T, expected func(%s, %s) %s", reduce, valueType, valueType, valueType)
+	}
+	emitFn, ok := slicefunc.Of(emit)
+	if !ok {
+		typecheck.Panicf(1, "reducemulti: invalid emit function %T", emit)
+	}
+	if !typecheck.CanApply(emitFn, slice) {
+		typecheck.Panicf(1, "reducemulti: emit function %T does not match input slice type %s", emit, slicetype.String(slice))
+	}
+	out, ok := typecheck.Devectorize(emitFn.Out)
+	if !ok || out.NumOut() == 0 {
+		typecheck.Panicf(1, "reducemulti: emit function %T must return parallel slices of output columns", emit)
+	}
+	key := make([]reflect.Type, slice.Prefix())
+	for i := range key {
+		key[i] = slice.Out(i)
+	}
+	return &reduceMultiSlice{
+		Slice:    slice,
+		name:     MakeName("reducemulti"),
+		out:      slicetype.Concat(slicetype.New(key...), out),
+		combiner: reduceFn,
+		emit:     emitFn,
+	}
+}
+
+// reduceMultiSlice reduces its underlying slice, as reduceSlice, and
+// flattens the rows emitted for each reduced key.
+type reduceMultiSlice struct {
+	Slice
+	name     Name
+	out      slicetype.Type
+	combiner slicefunc.Func
+	emit     slicefunc.Func
+}
+
+func (r *reduceMultiSlice) Name() Name               { return r.name }
+func (r *reduceMultiSlice) NumOut() int              { return r.out.NumOut() }
+func (r *reduceMultiSlice) Out(c int) reflect.Type   { return r.out.Out(c) }
+func (*reduceMultiSlice) NumDep() int                { return 1 }
+func (r *reduceMultiSlice) Dep(i int) Dep            { return Dep{Slice: r.Slice, Shuffle: true, Expand: true} }
+func (r *reduceMultiSlice) Combiner() slicefunc.Func { return r.combiner }
+
+func (r *reduceMultiSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	reader := deps[0]
+	if len(deps) > 1 {
+		reader = sortio.Reduce(r.Slice, fmt.Sprintf("app-%d", shard), deps, r.combiner)
+	}
+	return &reduceMultiReader{op: r, reader: reader}
+}
+
+// reduceMultiReader emits the rows of each of the reduced keys read from
+// its underlying reader.
+type reduceMultiReader struct {
+	op     *reduceMultiSlice
+	reader sliceio.Reader
+
+	in           frame.Frame // buffer of reduced keys
+	begIn, endIn int
+	out          frame.Frame // buffer of emitted rows
+	eof          bool
+}
+
+func (r *reduceMultiReader) Read(ctx context.Context, out frame.Frame) (int, error) {
+	if !slicetype.Assignable(out, r.op) {
+		return 0, errTypeError
+	}
+	args := make([]reflect.Value, r.op.Slice.NumOut())
+	begOut, endOut := 0, out.Len()
+	// Add buffered rows from the last call, if any.
+	if r.out.Len() > 0 {
+		n := frame.Copy(out, r.out)
+		begOut += n
+		r.out = r.out.Slice(n, r.out.Len())
+	}
+	for begOut < endOut && (!r.eof || r.begIn < r.endIn) {
+		if r.begIn == r.endIn {
+			if r.in.IsZero() {
+				r.in = frame.Make(r.op.Slice, out.Len(), out.Len())
+			} else {
+				r.in = r.in.Ensure(out.Len())
+			}
+			n, err := r.reader.Read(ctx, r.in)
+			if err != nil && err != sliceio.EOF {
+				return 0, err
+			}
+			r.begIn, r.endIn = 0, n
+			r.eof = err == sliceio.EOF
+		}
+		for ; r.begIn < r.endIn && begOut < endOut; r.begIn++ {
+			for j := range args {
+				args[j] = r.in.Index(j, r.begIn)
+			}
+			rows, err := r.rows(ctx, args)
+			if err != nil {
+				return 0, err
+			}
+			n := frame.Copy(out.Slice(begOut, endOut), rows)
+			begOut += n
+			if m := rows.Len(); n < m {
+				r.out = rows.Slice(n, m)
+			}
+		}
+	}
+	var err error
+	if r.eof && r.out.Len() == 0 && r.begIn == r.endIn {
+		err = sliceio.EOF
+	}
+	return begOut, err
+}
+
+// rows returns the rows emitted for the reduced key with the provided
+// column values.
+func (r *reduceMultiReader) rows(ctx context.Context, args []reflect.Value) (frame.Frame, error) {
+	var (
+		emitted = r.op.emit.Call(ctx, args)
+		n       = emitted[0].Len()
+		prefix  = r.op.Slice.Prefix()
+		cols    = make([]reflect.Value, prefix, prefix+len(emitted))
+	)
+	for _, col := range emitted[1:] {
+		if col.Len() != n {
+			return frame.Frame{}, errors.E(errors.Fatal, fmt.Sprintf("%s: emit function returned columns of unequal lengths for key %v", r.op.name, args[0]))
+		}
+	}
+	for i := range cols {
+		cols[i] = reflect.MakeSlice(reflect.SliceOf(r.op.Out(i)), n, n)
+		for j := 0; j < n; j++ {
+			cols[i].Index(j).Set(args[i])
+		}
+	}
+	return frame.Values(append(cols, emitted...)), nil
+}
+
 // CanMakeCombiningFrame tells whether the provided Frame type can be
 // be made into a combining frame.
 // Returns an error if types cannot be combined.
@@ -6,6 +6,7 @@ package bigslice_test
 
 import (
 	"fmt"
+	"sort"
 	"testing"
 
 	"github.com/grailbio/bigslice"
@@ -45,6 +46,73 @@ func TestReducePrefix(t *testing.T) {
 	}
 }
 
+func TestReduceMulti(t *testing.T) {
+	const N = 100
+	ints := make([]int, N)
+	for i := range ints {
+		ints[i] = i
+	}
+	// top3 merges two descending lists of at most 3 values.
+	top3 := func(x, y []int) []int {
+		merged := append(append([]int(nil), x...), y...)
+		sort.Sort(sort.Reverse(sort.IntSlice(merged)))
+		if len(merged) > 3 {
+			merged = merged[:3]
+		}
+		return merged
+	}
+	for m := 1; m < 5; m++ {
+		slice := bigslice.Const(m, ints)
+		slice = bigslice.Map(slice, func(x int) (string, []int) {
+			return fmt.Sprint(x%3) + "x", []int{x}
+		})
+		slice = bigslice.ReduceMulti(slice, top3, func(key string, top []int) ([]int, []string) {
+			ranks := make([]string, len(top))
+			for i := range ranks {
+				ranks[i] = fmt.Sprint(key, i)
+			}
+			return top, ranks
+		})
+		if got, want := slice.Name().Op, "reducemulti"; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		assertEqual(t, slice, true,
+			[]string{"0x", "0x", "0x", "1x", "1x", "1x", "2x", "2x", "2x"},
+			[]int{99, 96, 93, 97, 94, 91, 98, 95, 92},
+			[]string{"0x0", "0x1", "0x2", "1x0", "1x1", "1x2", "2x0", "2x1", "2x2"})
+	}
+
+	// Keys may emit no rows.
+	slice := bigslice.Const(2, []string{"a", "b", "a", "c"}, []int{1, 2, 3, 4})
+	slice = bigslice.ReduceMulti(slice, func(x, y int) int { return x + y }, func(key string, sum int) []int {
+		if key == "b" {
+			return nil
+		}
+		out := make([]int, sum)
+		for i := range out {
+			out[i] = i
+		}
+		return out
+	})
+	assertEqual(t, slice, true,
+		[]string{"a", "a", "a", "a", "c", "c", "c", "c"},
+		[]int{0, 1, 2, 3, 0, 1, 2, 3})
+}
+
+func TestReduceMultiType(t *testing.T) {
+	slice := bigslice.Const(1, []string{}, []int{})
+	sum := func(x, y int) int { return x + y }
+	expectTypeError(t, "reducemulti: invalid reduce function func(int, int) string, expected func(int, int) int", func() {
+		bigslice.ReduceMulti(slice, func(x, y int) string { return "" }, func(string, int) []int { return nil })
+	})
+	expectTypeError(t, "reducemulti: emit function func(int) []int does not match input slice type slice[1]string,int", func() {
+		bigslice.ReduceMulti(slice, sum, func(int) []int { return nil })
+	})
+	expectTypeError(t, "reducemulti: emit function func(string, int) ([]int, string) must return parallel slices of output columns", func() {
+		bigslice.ReduceMulti(slice, sum, func(string, int) ([]int, string) { return nil, "" })
+	})
+}
+
 func ExampleReduce() {
 	slice := bigslice.Const(2,
 		[]string{"c", "a", "b", "c", "c", "b", "a", "a", "a", "a", "c"},
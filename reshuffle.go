@@ -8,6 +8,7 @@ import (
 	"context"
 	"fmt"
 	"reflect"
+	"sort"
 
 	"github.com/grailbio/bigslice/frame"
 	"github.com/grailbio/bigslice/slicefunc"
@@ -75,9 +76,82 @@ func Repartition(slice Slice, partition interface{}) Slice {
 	return &reshuffleSlice{MakeName("repartition"), part, slice}
 }
 
-func (r *reshuffleSlice) Name() Name             { return r.name }
-func (*reshuffleSlice) NumDep() int              { return 1 }
-func (r *reshuffleSlice) Dep(i int) Dep          { return Dep{r.Slice, true, r.partitioner, false} }
+type partitionByRangesSlice struct {
+	reshuffleSlice
+	nshard int
+	keyCol int
+}
+
+// PartitionByRanges returns a slice that partitions the rows of the
+// provided slice by ranges of the values of its key column keyCol,
+// delimited by the provided bounds, of type []K, where K is the type
+// of the key column. The bounds must be strictly increasing, and K
+// must be a numeric or string type.
+//
+// The returned slice has len(bounds)+1 shards: shard i contains the
+// rows whose keys k satisfy bounds[i-1] <= k < bounds[i], that is,
+// each shard's range includes its lower bound and excludes its upper
+// bound. Shard 0 contains all keys less than bounds[0], and shard
+// len(bounds) all keys greater than or equal to the last bound (as
+// well as floating point NaN keys). Rows are not sorted within a
+// shard; if keyCol is 0, the returned slice is sharded by RangeShard.
+// Schematically:
+//
+//	PartitionByRanges(Slice<t1, ..., tn>, keyCol, []t_keyCol) Slice<t1, ..., tn>
+//
+// PartitionByRanges is a shuffle, and is useful when the distribution
+// of keys is known in advance, e.g., to produce shards whose rows are
+// range partitioned for downstream, sorted outputs.
+func PartitionByRanges(slice Slice, keyCol int, bounds interface{}) Slice {
+	if keyCol < 0 || keyCol >= slice.NumOut() {
+		typecheck.Panicf(1, "partitionbyranges: invalid key column %d for slice type %s", keyCol, slicetype.String(slice))
+	}
+	keyType := slice.Out(keyCol)
+	boundsv := reflect.ValueOf(bounds)
+	if boundsv.Kind() != reflect.Slice || boundsv.Type().Elem() != keyType {
+		typecheck.Panicf(1, "partitionbyranges: bounds of type %T do not match key column type %s", bounds, keyType)
+	}
+	less, err := lessFunc(keyType)
+	if err != nil {
+		typecheck.Panicf(1, "partitionbyranges: %v", err)
+	}
+	for i := 1; i < boundsv.Len(); i++ {
+		if !less(boundsv.Index(i-1), boundsv.Index(i)) {
+			typecheck.Panicf(1, "partitionbyranges: bounds are not strictly increasing at index %d", i)
+		}
+	}
+	nbound := boundsv.Len()
+	part := func(ctx context.Context, frame frame.Frame, nshard int, shards []int) {
+		for i := range shards {
+			key := frame.Index(keyCol, i)
+			shards[i] = sort.Search(nbound, func(j int) bool {
+				return less(key, boundsv.Index(j))
+			})
+		}
+	}
+	return &partitionByRangesSlice{
+		reshuffleSlice{MakeName("partitionbyranges"), part, slice},
+		nbound + 1,
+		keyCol,
+	}
+}
+
+func (p *partitionByRangesSlice) NumShard() int { return p.nshard }
+
+// ShardType returns RangeShard if the slice is partitioned by its first
+// column.
+func (p *partitionByRangesSlice) ShardType() ShardType {
+	if p.keyCol == 0 {
+		return RangeShard
+	}
+	return HashShard
+}
+
+func (r *reshuffleSlice) Name() Name { return r.name }
+func (*reshuffleSlice) NumDep() int  { return 1 }
+func (r *reshuffleSlice) Dep(i int) Dep {
+	return Dep{Slice: r.Slice, Shuffle: true, Partitioner: r.partitioner}
+}
 func (*reshuffleSlice) Combiner() slicefunc.Func { return slicefunc.Nil }
 
 func (r *reshuffleSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
@@ -115,6 +115,66 @@ func TestRepartitionType(t *testing.T) {
 	})
 }
 
+func TestPartitionByRanges(t *testing.T) {
+	const N = 100
+	var (
+		keys   = make([]int, N)
+		values = make([]string, N)
+	)
+	for i := range keys {
+		keys[i] = i - 10
+		values[i] = fmt.Sprint(i)
+	}
+	bounds := []int{0, 25, 50}
+	slice := bigslice.Const(7, keys, values)
+	slice = bigslice.PartitionByRanges(slice, 0, bounds)
+	if got, want := slice.NumShard(), 4; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := slice.ShardType(), bigslice.RangeShard; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	slice = bigslice.Scan(slice, func(shard int, scanner *sliceio.Scanner) error {
+		var (
+			key   int
+			value string
+		)
+		for scanner.Scan(context.Background(), &key, &value) {
+			if shard > 0 && key < bounds[shard-1] || shard < len(bounds) && key >= bounds[shard] {
+				return fmt.Errorf("key %d in shard %d", key, shard)
+			}
+		}
+		return scanner.Err()
+	})
+	for name, res := range runError(context.Background(), t, slice) {
+		if res.Err != nil {
+			t.Errorf("%s: %v", name, res.Err)
+		}
+	}
+	slice = bigslice.Const(2, values, keys)
+	slice = bigslice.PartitionByRanges(slice, 1, bounds)
+	if got, want := slice.ShardType(), bigslice.HashShard; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	assertEqual(t, slice, true, values, keys)
+}
+
+func TestPartitionByRangesType(t *testing.T) {
+	slice := bigslice.Const(1, []int{}, []string{})
+	expectTypeError(t, "partitionbyranges: bounds of type []string do not match key column type int", func() {
+		bigslice.PartitionByRanges(slice, 0, []string{"a"})
+	})
+	expectTypeError(t, "partitionbyranges: invalid key column 2 for slice type slice[1]int,string", func() {
+		bigslice.PartitionByRanges(slice, 2, []int{1})
+	})
+	expectTypeError(t, "partitionbyranges: bounds are not strictly increasing at index 2", func() {
+		bigslice.PartitionByRanges(slice, 1, []string{"a", "b", "b"})
+	})
+	expectTypeError(t, "partitionbyranges: cannot compare values of type []int", func() {
+		bigslice.PartitionByRanges(bigslice.Const(1, [][]int{}), 0, [][]int{})
+	})
+}
+
 func ExampleRepartition() {
 	// Count rows per shard before and after using Repartition to get ideal
 	// partitioning by taking advantage of the knowledge that our keys are
@@ -0,0 +1,230 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/slicefunc"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/slicetype"
+	"github.com/grailbio/bigslice/typecheck"
+)
+
+// rowIDShardBits is the number of low bits of a row ID that number the
+// rows of a shard when IDs are assigned from reserved ranges: each
+// shard may have 2^40 rows, and a slice 2^23 shards.
+const rowIDShardBits = 40
+
+var typeOfRowID = reflect.TypeOf(int64(0))
+
+// A RowIDOption configures the assignment of IDs by WithRowID.
+type RowIDOption func(s *rowIDSlice)
+
+// DenseRowIDs is a RowIDOption that numbers the rows of the slice
+// densely, from 0 to the number of rows minus one, instead of from
+// ranges reserved for each shard. Dense IDs require a pre-pass that
+// counts the rows of each shard: the slice is thus computed twice,
+// unless it is materialized.
+var DenseRowIDs RowIDOption = func(s *rowIDSlice) {
+	s.dense = true
+}
+
+// WithRowID returns a slice that prepends a unique int64 ID to each
+// row of the provided slice. The ID is the returned slice's prefix.
+// Schematically:
+//
+//	WithRowID(Slice<t1, ..., tn>, opts...) Slice<int64, t1, ..., tn>
+//
+// Each shard assigns increasing IDs to its rows, in order, from a range
+// disjoint from, and greater than, the ranges of the preceding shards:
+// by default, shard i numbers its rows from i<<40; with DenseRowIDs,
+// from the number of rows in the preceding shards. IDs are thus always
+// unique, and increase in shard order. They are monotonic in the
+// sorted order of the slice's rows only if the slice is globally
+// sorted (see GloballySorted). Since the rows of a shard are numbered
+// in the order in which they are read, IDs are stable across
+// recomputations only if the slice is deterministic.
+func WithRowID(slice Slice, opts ...RowIDOption) Slice {
+	if slice.NumShard() >= 1<<(63-rowIDShardBits) {
+		typecheck.Panicf(1, "withrowid: too many shards %d", slice.NumShard())
+	}
+	r := &rowIDSlice{
+		name:  MakeName("withrowid"),
+		Slice: slice,
+		out:   slicetype.New(append([]reflect.Type{typeOfRowID}, slicetype.Columns(slice)...)...),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if r.dense {
+		r.counts = &rowCountSlice{MakeName("withrowid_count"), slice}
+	}
+	return r
+}
+
+type rowIDSlice struct {
+	name Name
+	Slice
+	out    slicetype.Type
+	dense  bool
+	counts Slice
+}
+
+func (r *rowIDSlice) Name() Name             { return r.name }
+func (r *rowIDSlice) NumOut() int            { return r.out.NumOut() }
+func (r *rowIDSlice) Out(c int) reflect.Type { return r.out.Out(c) }
+func (*rowIDSlice) Prefix() int              { return 1 }
+func (*rowIDSlice) Combiner() slicefunc.Func { return slicefunc.Nil }
+
+// ShardType implements Slice: shards are ranges of IDs.
+func (*rowIDSlice) ShardType() ShardType { return RangeShard }
+
+// Sorted implements SortedSlice: each shard emits its rows in ID order.
+func (*rowIDSlice) Sorted() bool { return true }
+
+func (r *rowIDSlice) NumDep() int {
+	if r.dense {
+		return 2
+	}
+	return 1
+}
+
+func (r *rowIDSlice) Dep(i int) Dep {
+	switch {
+	case i == 0:
+		return Dep{Slice: r.Slice}
+	case i == 1 && r.dense:
+		return Dep{Slice: r.counts, Shuffle: true, Broadcast: true}
+	}
+	panic(fmt.Sprintf("invalid dependency %d", i))
+}
+
+func (r *rowIDSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	reader := &rowIDReader{op: r, shard: shard, reader: deps[0]}
+	if r.dense {
+		reader.counts = deps[1]
+	}
+	return reader
+}
+
+type rowIDReader struct {
+	op     *rowIDSlice
+	shard  int
+	reader sliceio.Reader
+	// counts is the broadcast reader of the row counts of every shard,
+	// if IDs are dense.
+	counts sliceio.Reader
+	in     frame.Frame
+	// next is the ID of the next row; rows is the number of rows read
+	// so far.
+	next, rows int64
+	init       bool
+}
+
+func (r *rowIDReader) Read(ctx context.Context, out frame.Frame) (int, error) {
+	if !slicetype.Assignable(out, r.op) {
+		return 0, errTypeError
+	}
+	if !r.init {
+		if r.counts == nil {
+			r.next = int64(r.shard) << rowIDShardBits
+		} else {
+			var (
+				shards []int
+				counts []int64
+			)
+			if err := sliceio.ReadAll(ctx, r.counts, &shards, &counts); err != nil {
+				return 0, err
+			}
+			for i, shard := range shards {
+				if shard < r.shard {
+					r.next += counts[i]
+				}
+			}
+		}
+		r.init = true
+	}
+	if r.in.IsZero() {
+		r.in = frame.Make(r.op.Slice, out.Len(), out.Len())
+	} else {
+		r.in = r.in.Ensure(out.Len())
+	}
+	n, err := r.reader.Read(ctx, r.in.Slice(0, out.Len()))
+	if r.rows += int64(n); r.counts == nil && r.rows > 1<<rowIDShardBits {
+		return 0, errors.E(errors.Fatal, errors.Invalid,
+			fmt.Sprintf("%s: shard %d exceeds %d rows", r.op.name, r.shard, int64(1)<<rowIDShardBits))
+	}
+	in := r.in.Slice(0, n)
+	ids := out.Interface(0).([]int64)
+	for i := 0; i < n; i++ {
+		ids[i] = r.next
+		r.next++
+	}
+	for col := 0; col < in.NumOut(); col++ {
+		reflect.Copy(out.Value(col+1), in.Value(col))
+	}
+	return n, err
+}
+
+// rowCountSlice counts the rows of each shard of a slice. Each shard
+// emits a single row, comprising the shard number and its row count.
+type rowCountSlice struct {
+	name Name
+	Slice
+}
+
+var rowCountType = slicetype.New(reflect.TypeOf(0), typeOfRowID)
+
+func (r *rowCountSlice) Name() Name             { return r.name }
+func (*rowCountSlice) NumOut() int              { return rowCountType.NumOut() }
+func (*rowCountSlice) Out(c int) reflect.Type   { return rowCountType.Out(c) }
+func (*rowCountSlice) Prefix() int              { return 1 }
+func (*rowCountSlice) ShardType() ShardType     { return HashShard }
+func (*rowCountSlice) NumDep() int              { return 1 }
+func (r *rowCountSlice) Dep(i int) Dep          { return singleDep(i, r.Slice, false) }
+func (*rowCountSlice) Combiner() slicefunc.Func { return slicefunc.Nil }
+
+func (r *rowCountSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	return &rowCountReader{op: r, shard: shard, reader: deps[0]}
+}
+
+type rowCountReader struct {
+	op     *rowCountSlice
+	shard  int
+	reader sliceio.Reader
+	done   bool
+}
+
+func (r *rowCountReader) Read(ctx context.Context, out frame.Frame) (int, error) {
+	if r.done {
+		return 0, sliceio.EOF
+	}
+	if out.Len() == 0 {
+		return 0, nil
+	}
+	var (
+		in    = frame.Make(r.op.Slice, defaultChunksize, defaultChunksize)
+		count int64
+	)
+	for {
+		n, err := r.reader.Read(ctx, in)
+		count += int64(n)
+		if err == sliceio.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	out.Interface(0).([]int)[0] = r.shard
+	out.Interface(1).([]int64)[0] = count
+	r.done = true
+	return 1, sliceio.EOF
+}
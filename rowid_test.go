@@ -0,0 +1,93 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/grailbio/bigslice"
+)
+
+func TestWithRowID(t *testing.T) {
+	const numShard, width = 8, 100
+	ctx := context.Background()
+	for _, dense := range []bool{false, true} {
+		var opts []bigslice.RowIDOption
+		if dense {
+			opts = append(opts, bigslice.DenseRowIDs)
+		}
+		slice := bigslice.WithRowID(newRangeSortedSlice(numShard, width), opts...)
+		if !bigslice.GloballySorted(slice) {
+			t.Error("expected globally sorted slice")
+		}
+		for name, scanner := range run(ctx, t, slice) {
+			var (
+				id      int64
+				v, n    int
+				ids     = make(map[int64]bool)
+				lastID  = int64(-1)
+				lastVal = -1
+			)
+			for scanner.Scan(ctx, &id, &v) {
+				if ids[id] {
+					t.Errorf("%s: duplicate id %d", name, id)
+				}
+				ids[id] = true
+				// IDs and values are monotonic in scan order, since the
+				// input is globally sorted.
+				if id <= lastID || v <= lastVal {
+					t.Errorf("%s: (%d, %d) follows (%d, %d)", name, id, v, lastID, lastVal)
+				}
+				if dense {
+					if id != int64(v) {
+						t.Errorf("%s: got id %d, want %d", name, id, v)
+					}
+				} else if want := int64(v/width)<<40 | int64(v%width); id != want {
+					t.Errorf("%s: got id %d, want %d", name, id, want)
+				}
+				lastID, lastVal = id, v
+				n++
+			}
+			if err := scanner.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := n, numShard*width; got != want {
+				t.Errorf("%s: got %v, want %v", name, got, want)
+			}
+		}
+	}
+}
+
+func TestWithRowIDUnsorted(t *testing.T) {
+	slice := bigslice.Const(5, []string{"a", "b", "c", "d", "e", "f", "g"})
+	slice = bigslice.WithRowID(slice, bigslice.DenseRowIDs)
+	ctx := context.Background()
+	for name, scanner := range run(ctx, t, slice) {
+		var (
+			ids  []int64
+			vals = make(map[string]bool)
+			id   int64
+			val  string
+		)
+		for scanner.Scan(ctx, &id, &val) {
+			ids = append(ids, id)
+			vals[val] = true
+		}
+		if err := scanner.Err(); err != nil {
+			t.Fatal(err)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		for i, id := range ids {
+			if id != int64(i) {
+				t.Errorf("%s: got id %d, want %d", name, id, i)
+			}
+		}
+		if got, want := len(vals), 7; got != want {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"reflect"
+
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/slicefunc"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/slicetype"
+	"github.com/grailbio/bigslice/sortio"
+	"github.com/grailbio/bigslice/typecheck"
+)
+
+// sampleSpillSize is the target size, in bytes, of the spill files
+// written when sorting the shards of a StratifiedSample.
+const sampleSpillSize = 1 << 25
+
+var typeOfUint64 = reflect.TypeOf(uint64(0))
+
+// StratifiedSample returns a slice that samples at most perKey rows
+// for each key of the provided slice, keeping all of the rows of keys
+// with fewer than perKey rows. The key comprises the slice's prefix
+// columns (see Prefixed), which must be hashable and comparable. The
+// returned slice has the same type as the provided slice.
+//
+// Each row is assigned a random priority, drawn from a pseudorandom
+// source that is seeded by seed and the row's shard, and the perKey
+// rows of each key with the lowest priorities are kept. The sample is
+// thus uniform within each key, and is deterministic given the seed, so
+// long as the rows of each shard of the provided slice are.
+//
+// StratifiedSample shuffles the whole of the provided slice by key, and
+// then sorts each shard of the shuffled output (spilling to disk as
+// needed) to group its rows by key; its cost is thus comparable to that
+// of Cogroup. Use StratifiedSampleFraction, which requires no shuffle,
+// if a fixed fraction of each key's rows is sufficient.
+func StratifiedSample(slice Slice, perKey int, seed int64) Slice {
+	if perKey <= 0 {
+		typecheck.Panicf(1, "stratifiedsample: invalid number of rows per key %d", perKey)
+	}
+	for i := 0; i < slice.Prefix(); i++ {
+		if !frame.CanHash(slice.Out(i)) || !frame.CanCompare(slice.Out(i)) {
+			typecheck.Panicf(1, "stratifiedsample: key column(%d) type %s cannot be hashed and sorted", i, slice.Out(i))
+		}
+	}
+	cols := slicetype.Columns(slice)
+	p := slice.Prefix()
+	cols = append(cols[:p:p], append([]reflect.Type{typeOfUint64}, cols[p:]...)...)
+	prioritized := &prioritizeSlice{
+		name:  MakeName("stratifiedsample"),
+		Slice: slice,
+		out:   slicetype.New(cols...),
+		seed:  seed,
+	}
+	return &stratifiedSampleSlice{MakeName("stratifiedsample"), slice, prioritized, perKey}
+}
+
+// StratifiedSampleFraction returns a slice that keeps each row of the
+// provided slice independently with probability fraction, so that
+// approximately the given fraction of the rows of each key is kept. As
+// with StratifiedSample, the sample is deterministic given the seed, so
+// long as the rows of each shard of the provided slice are. Since rows
+// are sampled independently, StratifiedSampleFraction is pipelined and
+// requires no shuffle.
+func StratifiedSampleFraction(slice Slice, fraction float64, seed int64) Slice {
+	if fraction < 0 || fraction > 1 {
+		typecheck.Panicf(1, "stratifiedsamplefraction: invalid fraction %v", fraction)
+	}
+	var max uint64 = math.MaxUint64
+	if fraction < 1 {
+		max = uint64(fraction * (1 << 64))
+	}
+	return &fractionSampleSlice{MakeName("stratifiedsample"), slice, seed, max}
+}
+
+// sampleRand returns the source of row priorities for the provided
+// shard of a sample with the provided seed.
+func sampleRand(seed int64, shard int) *rand.Rand {
+	return rand.New(rand.NewSource(seed ^ int64(shard+1)*0x5851f42d4c957f2d))
+}
+
+// prioritizeSlice inserts a column of random priorities after the
+// prefix columns of a slice.
+type prioritizeSlice struct {
+	name Name
+	Slice
+	out  slicetype.Type
+	seed int64
+}
+
+func (p *prioritizeSlice) Name() Name             { return p.name }
+func (p *prioritizeSlice) NumOut() int            { return p.out.NumOut() }
+func (p *prioritizeSlice) Out(i int) reflect.Type { return p.out.Out(i) }
+func (*prioritizeSlice) ShardType() ShardType     { return HashShard }
+func (*prioritizeSlice) NumDep() int              { return 1 }
+func (p *prioritizeSlice) Dep(i int) Dep          { return singleDep(i, p.Slice, false) }
+func (*prioritizeSlice) Combiner() slicefunc.Func { return slicefunc.Nil }
+
+func (p *prioritizeSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	return &prioritizeReader{op: p, reader: deps[0], rand: sampleRand(p.seed, shard)}
+}
+
+type prioritizeReader struct {
+	op     *prioritizeSlice
+	reader sliceio.Reader
+	rand   *rand.Rand
+	in     frame.Frame
+}
+
+func (r *prioritizeReader) Read(ctx context.Context, out frame.Frame) (int, error) {
+	if !slicetype.Assignable(out, r.op) {
+		return 0, errTypeError
+	}
+	if r.in.IsZero() {
+		r.in = frame.Make(r.op.Slice, out.Len(), out.Len())
+	} else {
+		r.in = r.in.Ensure(out.Len())
+	}
+	n, err := r.reader.Read(ctx, r.in.Slice(0, out.Len()))
+	in := r.in.Slice(0, n)
+	p := r.op.Prefix()
+	for i := 0; i < in.NumOut(); i++ {
+		j := i
+		if i >= p {
+			j++
+		}
+		reflect.Copy(out.Value(j), in.Value(i))
+	}
+	priorities := out.Interface(p).([]uint64)
+	for i := 0; i < n; i++ {
+		priorities[i] = r.rand.Uint64()
+	}
+	return n, err
+}
+
+// stratifiedSampleSlice shuffles a prioritizeSlice by key, and keeps
+// the rows of each key with the lowest priorities.
+type stratifiedSampleSlice struct {
+	name Name
+	Slice
+	prioritized *prioritizeSlice
+	perKey      int
+}
+
+func (s *stratifiedSampleSlice) Name() Name { return s.name }
+func (*stratifiedSampleSlice) NumDep() int  { return 1 }
+func (s *stratifiedSampleSlice) Dep(i int) Dep {
+	return Dep{Slice: s.prioritized, Shuffle: true, Expand: true}
+}
+func (*stratifiedSampleSlice) ShardType() ShardType     { return HashShard }
+func (*stratifiedSampleSlice) Combiner() slicefunc.Func { return slicefunc.Nil }
+
+func (s *stratifiedSampleSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	return &stratifiedSampleReader{op: s, readers: deps}
+}
+
+// prefixedType is a slice type with an amended prefix.
+type prefixedType struct {
+	slicetype.Type
+	prefix int
+}
+
+func (p prefixedType) Prefix() int { return p.prefix }
+
+type stratifiedSampleReader struct {
+	op      *stratifiedSampleSlice
+	readers []sliceio.Reader
+	merged  sliceio.Reader
+	in      frame.Frame
+	// last holds the key of the last row read, in row 0, and the key of
+	// the current row, in row 1; count is the number of rows read with
+	// the last key.
+	last  frame.Frame
+	count int
+	err   error
+}
+
+func (r *stratifiedSampleReader) Read(ctx context.Context, out frame.Frame) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if !slicetype.Assignable(out, r.op) {
+		return 0, errTypeError
+	}
+	p := r.op.Prefix()
+	if r.merged == nil {
+		// Sort the rows of each shuffled shard by key and priority, and
+		// merge them, so that each key's rows are read in order of
+		// priority.
+		typ := prefixedType{r.op.prioritized, p + 1}
+		sorted := make([]sliceio.Reader, len(r.readers))
+		for i := range r.readers {
+			if sorted[i], r.err = sortio.SortReader(ctx, sampleSpillSize, typ, r.readers[i]); r.err != nil {
+				return 0, r.err
+			}
+		}
+		if r.merged, r.err = sortio.NewMergeReader(ctx, typ, sorted); r.err != nil {
+			return 0, r.err
+		}
+		r.last = frame.Make(slicetype.New(slicetype.Columns(r.op)[:p]...), 2, 2).Prefixed(p).
+			WithKeyPolicy(frame.ContextKeyPolicy(ctx))
+		r.count = -1
+	}
+	if r.in.IsZero() {
+		r.in = frame.Make(r.op.prioritized, out.Len(), out.Len())
+	} else {
+		r.in = r.in.Ensure(out.Len())
+	}
+	var k int
+	for k == 0 && r.err == nil {
+		var n int
+		n, r.err = r.merged.Read(ctx, r.in.Slice(0, out.Len()))
+		for i := 0; i < n; i++ {
+			for j := 0; j < p; j++ {
+				r.last.Index(j, 1).Set(r.in.Index(j, i))
+			}
+			if r.count < 0 || r.last.Less(0, 1) {
+				r.last.Swap(0, 1)
+				r.count = 0
+			}
+			r.count++
+			if r.count > r.op.perKey {
+				continue
+			}
+			for j := 0; j < out.NumOut(); j++ {
+				col := j
+				if j >= p {
+					col++
+				}
+				out.Index(j, k).Set(r.in.Index(col, i))
+			}
+			k++
+		}
+	}
+	return k, r.err
+}
+
+// fractionSampleSlice keeps the rows of a slice whose priority does
+// not exceed max.
+type fractionSampleSlice struct {
+	name Name
+	Slice
+	seed int64
+	max  uint64
+}
+
+func (s *fractionSampleSlice) Name() Name             { return s.name }
+func (*fractionSampleSlice) NumDep() int              { return 1 }
+func (s *fractionSampleSlice) Dep(i int) Dep          { return singleDep(i, s.Slice, false) }
+func (*fractionSampleSlice) ShardType() ShardType     { return HashShard }
+func (*fractionSampleSlice) Combiner() slicefunc.Func { return slicefunc.Nil }
+
+func (s *fractionSampleSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	return &fractionSampleReader{op: s, reader: deps[0], rand: sampleRand(s.seed, shard)}
+}
+
+type fractionSampleReader struct {
+	op     *fractionSampleSlice
+	reader sliceio.Reader
+	rand   *rand.Rand
+	in     frame.Frame
+	err    error
+}
+
+func (r *fractionSampleReader) Read(ctx context.Context, out frame.Frame) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.in.IsZero() {
+		r.in = frame.Make(r.op, out.Len(), out.Len())
+	} else {
+		r.in = r.in.Ensure(out.Len())
+	}
+	var k int
+	for k == 0 && r.err == nil {
+		var n int
+		n, r.err = r.reader.Read(ctx, r.in.Slice(0, out.Len()))
+		for i := 0; i < n; i++ {
+			if r.rand.Uint64() > r.op.max {
+				continue
+			}
+			for j := 0; j < out.NumOut(); j++ {
+				out.Index(j, k).Set(r.in.Index(j, i))
+			}
+			k++
+		}
+	}
+	return k, r.err
+}
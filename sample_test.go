@@ -0,0 +1,120 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/grailbio/bigslice"
+)
+
+// sampleInput returns a slice with 1000 rows with key "a", 3 rows with
+// key "b", and 100 rows with key "c". Each row's value is unique.
+func sampleInput(nshard int) bigslice.Slice {
+	var (
+		keys   []string
+		values []int
+	)
+	for _, group := range []struct {
+		key string
+		n   int
+	}{{"a", 1000}, {"b", 3}, {"c", 100}} {
+		for i := 0; i < group.n; i++ {
+			keys = append(keys, group.key)
+			values = append(values, len(values))
+		}
+	}
+	return bigslice.Const(nshard, keys, values)
+}
+
+// scanSample runs the provided slice on every executor and returns
+// the values of each key, sorted, checking that every executor
+// produces the same sample.
+func scanSample(t *testing.T, slice bigslice.Slice) map[string][]int {
+	t.Helper()
+	ctx := context.Background()
+	var sample map[string][]int
+	for name, scan := range run(ctx, t, slice) {
+		got := make(map[string][]int)
+		var (
+			key   string
+			value int
+		)
+		for scan.Scan(ctx, &key, &value) {
+			got[key] = append(got[key], value)
+		}
+		if err := scan.Err(); err != nil {
+			t.Fatal(err)
+		}
+		for _, values := range got {
+			sort.Ints(values)
+		}
+		if sample == nil {
+			sample = got
+		} else if !reflect.DeepEqual(got, sample) {
+			t.Errorf("executor %s: got %v, want %v", name, got, sample)
+		}
+	}
+	return sample
+}
+
+func TestStratifiedSample(t *testing.T) {
+	input := sampleInput(5)
+	sample := scanSample(t, bigslice.StratifiedSample(input, 10, 1))
+	if got, want := len(sample["a"]), 10; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := sample["b"], []int{1000, 1001, 1002}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := len(sample["c"]), 10; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, value := range sample["a"] {
+		if value >= 1000 {
+			t.Errorf("value %d not in key a", value)
+		}
+	}
+
+	// Samples are deterministic given the seed.
+	if got, want := scanSample(t, bigslice.StratifiedSample(input, 10, 1)), sample; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := scanSample(t, bigslice.StratifiedSample(input, 10, 2)); reflect.DeepEqual(got, sample) {
+		t.Errorf("got same sample %v for different seeds", got)
+	}
+}
+
+func TestStratifiedSampleFraction(t *testing.T) {
+	input := sampleInput(5)
+	sample := scanSample(t, bigslice.StratifiedSampleFraction(input, 0.1, 1))
+	if n := len(sample["a"]); n < 50 || n > 150 {
+		t.Errorf("sampled %d rows of key a, expected approximately 100", n)
+	}
+	if got, want := scanSample(t, bigslice.StratifiedSampleFraction(input, 0.1, 1)), sample; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	sample = scanSample(t, bigslice.StratifiedSampleFraction(input, 1, 1))
+	if got, want := len(sample["a"])+len(sample["b"])+len(sample["c"]), 1103; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestStratifiedSampleError(t *testing.T) {
+	input := sampleInput(1)
+	expectTypeError(t, "stratifiedsample: invalid number of rows per key 0", func() {
+		bigslice.StratifiedSample(input, 0, 1)
+	})
+	expectTypeError(t, "stratifiedsamplefraction: invalid fraction 1.5", func() {
+		bigslice.StratifiedSampleFraction(input, 1.5, 1)
+	})
+	funcs := bigslice.Const(1, []func(){func() {}}, []int{0})
+	expectTypeError(t, "stratifiedsample: key column(0) type func() cannot be hashed and sorted", func() {
+		bigslice.StratifiedSample(funcs, 1, 1)
+	})
+}
@@ -19,7 +19,8 @@ var typeOfString = reflect.TypeOf("")
 // since ScanReader is unaware of the underlying data layout, it may
 // be inefficient for highly parallel access: each shard must read
 // the full file, skipping over data not belonging to the shard.
-func ScanReader(nshard int, reader func() (io.ReadCloser, error)) Slice {
+// Pragmas (e.g., ReadRetry) are applied as by ReaderFunc.
+func ScanReader(nshard int, reader func() (io.ReadCloser, error), prags ...Pragma) Slice {
 	Helper()
 	type state struct {
 		*bufio.Scanner
@@ -53,7 +54,7 @@ func ScanReader(nshard int, reader func() (io.ReadCloser, error)) Slice {
 			lines[i] = state.Text()
 		}
 		return len(lines), nil
-	})
+	}, prags...)
 }
 
 func skip(scan *bufio.Scanner, n int) error {
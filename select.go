@@ -0,0 +1,105 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/slicefunc"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/slicetype"
+	"github.com/grailbio/bigslice/typecheck"
+)
+
+// Select returns a slice that projects the columns of the provided
+// slice with the provided indices, in order. Columns may thus be
+// reordered, dropped, or duplicated (by repeating an index). Select is
+// pipelined, and copies column vectors rather than individual values.
+// Schematically:
+//
+//	Select(Slice<t1, t2, t3>, 2, 0, 0) Slice<t3, t1, t1>
+//
+// The returned slice's prefix comprises the leading columns that are
+// also leading prefix columns of the provided slice, in their original
+// positions, or else the first column.
+//
+// A Select of a Select is collapsed into a single projection of the
+// underlying slice, so that the columns it reads are explicit.
+func Select(slice Slice, cols ...int) Slice {
+	if len(cols) == 0 {
+		typecheck.Panicf(1, "select: need at least one column")
+	}
+	for _, col := range cols {
+		if col < 0 || col >= slice.NumOut() {
+			typecheck.Panicf(1, "select: column %d out of range for slice %s", col, slicetype.String(slice))
+		}
+	}
+	cols = append([]int(nil), cols...)
+	if s, ok := slice.(*selectSlice); ok {
+		for i, col := range cols {
+			cols[i] = s.cols[col]
+		}
+		slice = s.Slice
+	}
+	types := make([]reflect.Type, len(cols))
+	for i, col := range cols {
+		types[i] = slice.Out(col)
+	}
+	prefix := 0
+	for prefix < len(cols) && prefix < slice.Prefix() && cols[prefix] == prefix {
+		prefix++
+	}
+	if prefix == 0 {
+		prefix = 1
+	}
+	return &selectSlice{MakeName("select"), slice, slicetype.New(types...), cols, prefix}
+}
+
+// selectSlice projects the columns cols of a slice.
+type selectSlice struct {
+	name Name
+	Slice
+	out    slicetype.Type
+	cols   []int
+	prefix int
+}
+
+func (s *selectSlice) Name() Name             { return s.name }
+func (s *selectSlice) NumOut() int            { return s.out.NumOut() }
+func (s *selectSlice) Out(c int) reflect.Type { return s.out.Out(c) }
+func (s *selectSlice) Prefix() int            { return s.prefix }
+func (*selectSlice) ShardType() ShardType     { return HashShard }
+func (*selectSlice) NumDep() int              { return 1 }
+func (s *selectSlice) Dep(i int) Dep          { return singleDep(i, s.Slice, false) }
+func (*selectSlice) Combiner() slicefunc.Func { return slicefunc.Nil }
+
+func (s *selectSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	return &selectReader{op: s, reader: deps[0]}
+}
+
+type selectReader struct {
+	op     *selectSlice
+	reader sliceio.Reader
+	in     frame.Frame
+}
+
+func (r *selectReader) Read(ctx context.Context, out frame.Frame) (int, error) {
+	if !slicetype.Assignable(out, r.op) {
+		return 0, errTypeError
+	}
+	if r.in.IsZero() {
+		r.in = frame.Make(r.op.Slice, out.Len(), out.Len())
+	} else {
+		r.in = r.in.Ensure(out.Len())
+	}
+	n, err := r.reader.Read(ctx, r.in.Slice(0, out.Len()))
+	in := r.in.Slice(0, n)
+	for i, col := range r.op.cols {
+		reflect.Copy(out.Value(i), in.Value(col))
+	}
+	return n, err
+}
@@ -0,0 +1,64 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"testing"
+
+	"github.com/grailbio/bigslice"
+	"github.com/grailbio/bigslice/slicetype"
+)
+
+func TestSelect(t *testing.T) {
+	var (
+		keys = []string{"a", "b", "c", "d"}
+		ints = []int{1, 2, 3, 4}
+		strs = []string{"w", "x", "y", "z"}
+	)
+	slice := bigslice.Const(2, keys, ints, strs)
+	selected := bigslice.Select(slice, 2, 0, 1, 1)
+	if got, want := selected.Name().Op, "select"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := slicetype.String(selected), "slice[1]string,string,int,int"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	assertEqual(t, selected, true, strs, keys, ints, ints)
+
+	// Selects are collapsed.
+	selected = bigslice.Select(selected, 1, 3)
+	if got, want := selected.Dep(0).Slice, slice; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	assertEqual(t, selected, true, keys, ints)
+}
+
+func TestSelectPrefix(t *testing.T) {
+	slice := bigslice.Const(1, []string{"a"}, []int{1}, []int{2})
+	slice = bigslice.Prefixed(slice, 2)
+	for _, c := range []struct {
+		cols   []int
+		prefix int
+	}{
+		{[]int{0, 1, 2}, 2},
+		{[]int{0, 2}, 1},
+		{[]int{0, 1}, 2},
+		{[]int{2, 0, 1}, 1},
+	} {
+		if got, want := bigslice.Select(slice, c.cols...).Prefix(), c.prefix; got != want {
+			t.Errorf("select %v: got %v, want %v", c.cols, got, want)
+		}
+	}
+}
+
+func TestSelectError(t *testing.T) {
+	slice := bigslice.Const(1, []int{1}, []string{"a"})
+	expectTypeError(t, "select: need at least one column", func() {
+		bigslice.Select(slice)
+	})
+	expectTypeError(t, "select: column 2 out of range for slice slice[1]int,string", func() {
+		bigslice.Select(slice, 0, 2)
+	})
+}
@@ -0,0 +1,223 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/slicefunc"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/slicetype"
+	"github.com/grailbio/bigslice/typecheck"
+)
+
+// SelfJoin returns a slice that joins the provided slice with itself
+// on its key: for each pair of distinct rows with equal keys, the
+// returned slice contains a row comprising the key, followed by the
+// non-key columns of one row of the pair and then those of the other.
+// The key comprises the columns with the provided indices, or, if
+// keyCols is empty, the slice's prefix columns; the non-key columns
+// are the remaining columns, in column order. Schematically:
+//
+//	SelfJoin(Slice<k1, ..., kp, t1, ..., tn>)
+//		Slice<k1, ..., kp, t1, ..., tn, t1, ..., tn>
+//
+// For example, the pairs of co-occurring events of each user, keyed
+// by the second column, are given by:
+//
+//	SelfJoin(Slice<event string, user string>, 1)
+//		Slice<user string, event string, event string>
+//
+// Each unordered pair of rows is emitted once, and rows are not paired
+// with themselves, so that a key with n rows produces n(n-1)/2 rows:
+// the cost of SelfJoin is quadratic in the size of each key's group,
+// and keys with large groups can produce many more rows than are in
+// the input. Within a pair, the order of the two rows is unspecified.
+// Use SelfJoinFunc to process each group as a whole instead.
+//
+// Unlike a Cogroup (or Join) of the slice with itself, SelfJoin
+// computes and shuffles the slice only once. Keys must be partitionable
+// and sortable, as for Cogroup; the returned slice has the shards of
+// the provided slice, and the key as its prefix.
+func SelfJoin(slice Slice, keyCols ...int) Slice {
+	groups, nval := selfJoinGroups(2, "selfjoin", slice, keyCols)
+	if nval == 0 {
+		typecheck.Panicf(1, "selfjoin: slice %s has no non-key columns", slicetype.String(slice))
+	}
+	out := make([]reflect.Type, groups.prefix, groups.prefix+2*nval)
+	copy(out, groups.out)
+	for i := 0; i < 2; i++ {
+		for col := groups.prefix; col < groups.NumOut(); col++ {
+			out = append(out, groups.Out(col).Elem())
+		}
+	}
+	return &selfJoinSlice{MakeName("selfjoin"), out, groups}
+}
+
+// SelfJoinFunc returns a slice that applies the function fn to each
+// group of rows with equal keys of the provided slice, flattening the
+// returned slices, as Flatmap. The key comprises the columns with the
+// provided indices, or, if keyCols is empty, the slice's prefix
+// columns. The function is passed the key, followed by the values of
+// each non-key column of the group's rows, as by Cogroup.
+// Schematically:
+//
+//	SelfJoinFunc(Slice<k1, ..., kp, t1, ..., tn>, func(k1, ..., kp, []t1, ..., []tn) ([]r1, ..., []rm))
+//		Slice<r1, ..., rm>
+//
+// SelfJoinFunc allows pairs, or any other combinations, of a group's
+// rows to be computed without materializing all of the pairs produced
+// by SelfJoin, e.g., to count or filter them. Like SelfJoin, it
+// computes and shuffles the slice only once; the returned slice has
+// the shards of the provided slice.
+func SelfJoinFunc(slice Slice, fn interface{}, keyCols ...int) Slice {
+	groups, _ := selfJoinGroups(2, "selfjoinfunc", slice, keyCols)
+	sliceFn, ok := slicefunc.Of(fn)
+	if !ok {
+		typecheck.Panicf(1, "selfjoinfunc: invalid group function %T", fn)
+	}
+	if !typecheck.CanApply(sliceFn, groups) {
+		typecheck.Panicf(1, "selfjoinfunc: group function %T does not match grouped slice type %s", fn, slicetype.String(groups))
+	}
+	out, ok := typecheck.Devectorize(sliceFn.Out)
+	if !ok {
+		typecheck.Panicf(1, "selfjoinfunc: group function %T is not vectorized", fn)
+	}
+	return &flatmapSlice{MakeName("selfjoinfunc"), Pragmas(nil), groups, sliceFn, out}
+}
+
+// selfJoinGroups returns the cogroup of the provided slice keyed by
+// the columns keyCols (or its prefix, if keyCols is empty), and the
+// number of its non-key columns. Type errors are attributed to the
+// caller calldepth frames up.
+func selfJoinGroups(calldepth int, op string, slice Slice, keyCols []int) (*cogroupSlice, int) {
+	keyed := slice
+	if len(keyCols) > 0 {
+		var (
+			seen = make(map[int]bool)
+			cols = make([]int, 0, slice.NumOut())
+		)
+		for _, col := range keyCols {
+			if col < 0 || col >= slice.NumOut() {
+				typecheck.Panicf(calldepth, "%s: key column %d out of range for slice %s", op, col, slicetype.String(slice))
+			}
+			if seen[col] {
+				typecheck.Panicf(calldepth, "%s: duplicate key column %d", op, col)
+			}
+			seen[col] = true
+			cols = append(cols, col)
+		}
+		for col := 0; col < slice.NumOut(); col++ {
+			if !seen[col] {
+				cols = append(cols, col)
+			}
+		}
+		keyed = selectKeys(slice, cols, len(keyCols))
+	}
+	groups := cogroup(calldepth+1, MakeName(op+"_groups"), nil, []Slice{keyed}).(*cogroupSlice)
+	return groups, keyed.NumOut() - keyed.Prefix()
+}
+
+// selectKeys returns a slice whose columns are the columns cols of the
+// provided slice, in order, and whose first prefix columns form its
+// prefix. If the columns are already in place, the slice itself is
+// returned.
+func selectKeys(slice Slice, cols []int, prefix int) Slice {
+	inPlace := prefix == slice.Prefix()
+	for i, col := range cols {
+		inPlace = inPlace && i == col
+	}
+	if inPlace {
+		return slice
+	}
+	types := make([]reflect.Type, len(cols))
+	for i, col := range cols {
+		types[i] = slice.Out(col)
+	}
+	out := prefixedType{slicetype.New(types...), prefix}
+	return &mapFrameSlice{MakeName("selfjoin_keys"), Pragmas(nil), slice, out, func(in frame.Frame) frame.Frame {
+		f := frame.Make(out, in.Len(), in.Len())
+		for i, col := range cols {
+			reflect.Copy(f.Value(i), in.Value(col))
+		}
+		return f
+	}}
+}
+
+// selfJoinSlice pairs the rows of each group of a cogroup of a single
+// slice.
+type selfJoinSlice struct {
+	name Name
+	out  []reflect.Type
+	*cogroupSlice
+}
+
+func (s *selfJoinSlice) Name() Name             { return s.name }
+func (s *selfJoinSlice) NumOut() int            { return len(s.out) }
+func (s *selfJoinSlice) Out(i int) reflect.Type { return s.out[i] }
+
+func (s *selfJoinSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	return &selfJoinReader{op: s, reader: s.cogroupSlice.Reader(shard, deps)}
+}
+
+// selfJoinReader emits the pairs of distinct values of the groups of
+// each of the cogroup's keys.
+type selfJoinReader struct {
+	op     *selfJoinSlice
+	reader sliceio.Reader
+	err    error
+	// in buffers n cogrouped rows, of which row i is being expanded; a
+	// and b are the indices of the next pair of its grouped values.
+	in   frame.Frame
+	i, n int
+	a, b int
+}
+
+func (r *selfJoinReader) Read(ctx context.Context, out frame.Frame) (int, error) {
+	if r.in.IsZero() {
+		r.in = frame.Make(r.op.cogroupSlice, defaultChunksize, defaultChunksize)
+	}
+	var (
+		prefix = r.op.Prefix()
+		nval   = r.op.cogroupSlice.NumOut() - prefix
+		k      int
+	)
+	for k < out.Len() {
+		if r.i == r.n {
+			if r.err != nil {
+				break
+			}
+			r.n, r.err = r.reader.Read(ctx, r.in)
+			r.i, r.a, r.b = 0, 0, 1
+			if r.err != nil && r.err != sliceio.EOF {
+				return k, r.err
+			}
+			continue
+		}
+		if n := r.in.Index(prefix, r.i).Len(); r.b >= n {
+			r.i++
+			r.a, r.b = 0, 1
+			continue
+		}
+		for col := 0; col < prefix; col++ {
+			out.Index(col, k).Set(r.in.Index(col, r.i))
+		}
+		for col := 0; col < nval; col++ {
+			vals := r.in.Index(prefix+col, r.i)
+			out.Index(prefix+col, k).Set(vals.Index(r.a))
+			out.Index(prefix+nval+col, k).Set(vals.Index(r.b))
+		}
+		k++
+		if r.a++; r.a == r.b {
+			r.a, r.b = 0, r.b+1
+		}
+	}
+	if k == 0 && r.err != nil {
+		return 0, r.err
+	}
+	return k, nil
+}
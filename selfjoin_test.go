@@ -0,0 +1,93 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/grailbio/bigslice"
+)
+
+func TestSelfJoin(t *testing.T) {
+	const N = 100
+	var (
+		events = make([]int, N)
+		users  = make([]string, N)
+		want   []string
+		counts = make(map[string]int)
+	)
+	// The last users have a single event each, and thus no pairs.
+	for i := range events {
+		events[i] = i
+		users[i] = fmt.Sprint(i % 10)
+		if i >= N-5 {
+			users[i] = fmt.Sprint(i)
+		}
+		counts[users[i]]++
+	}
+	for i := range events {
+		for j := i + 1; j < len(events); j++ {
+			if users[i] == users[j] {
+				want = append(want, fmt.Sprint(users[i], ":", events[i], ":", events[j]))
+			}
+		}
+	}
+	// Pairs are normalized, since their order is unspecified.
+	pair := func(user string, a, b int) string {
+		if a > b {
+			a, b = b, a
+		}
+		return fmt.Sprint(user, ":", a, ":", b)
+	}
+
+	slice := bigslice.Const(7, users, events)
+	slice = bigslice.SelfJoin(slice)
+	if got, want := slice.NumShard(), 7; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	assertEqual(t, bigslice.Map(slice, pair), true, append([]string(nil), want...))
+
+	// The key may be any column.
+	slice = bigslice.Const(7, events, users)
+	slice = bigslice.SelfJoin(slice, 1)
+	if got, want := slice.Prefix(), 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	assertEqual(t, bigslice.Map(slice, pair), true, append([]string(nil), want...))
+
+	var (
+		wantUsers []string
+		wantPairs []int
+	)
+	for user, n := range counts {
+		wantUsers = append(wantUsers, user)
+		wantPairs = append(wantPairs, n*(n-1)/2)
+	}
+	slice = bigslice.Const(7, events, users)
+	slice = bigslice.SelfJoinFunc(slice, func(user string, events []int) ([]string, []int) {
+		return []string{user}, []int{len(events) * (len(events) - 1) / 2}
+	}, 1)
+	assertEqual(t, slice, true, wantUsers, wantPairs)
+}
+
+func TestSelfJoinType(t *testing.T) {
+	slice := bigslice.Const(1, []string{}, []int{})
+	expectTypeError(t, "selfjoin: slice slice[1]string has no non-key columns", func() {
+		bigslice.SelfJoin(bigslice.Const(1, []string{}))
+	})
+	expectTypeError(t, "selfjoin: key column 2 out of range for slice slice[1]string,int", func() {
+		bigslice.SelfJoin(slice, 2)
+	})
+	expectTypeError(t, "selfjoin: duplicate key column 0", func() {
+		bigslice.SelfJoin(slice, 0, 0)
+	})
+	expectTypeError(t, "selfjoinfunc: group function func(string, int) ([]string, []int) does not match grouped slice type slice[1]string,[]int", func() {
+		bigslice.SelfJoinFunc(slice, func(string, int) ([]string, []int) { return nil, nil })
+	})
+	expectTypeError(t, "selfjoinfunc: group function func(string, []int) int is not vectorized", func() {
+		bigslice.SelfJoinFunc(slice, func(string, []int) int { return 0 })
+	})
+}
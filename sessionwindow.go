@@ -0,0 +1,341 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/slicefunc"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/slicetype"
+	"github.com/grailbio/bigslice/typecheck"
+)
+
+var typeOfDuration = reflect.TypeOf(time.Duration(0))
+
+type sessionWindowSlice struct {
+	name Name
+	Pragmas
+	Slice
+	timeCol int
+	gap     reflect.Value
+	fval    slicefunc.Func
+	out     slicetype.Type
+	// keys are the orderings of the key columns of the slice.
+	keys []sortKey
+}
+
+// SessionWindow returns a slice that groups the rows of each key of the
+// provided slice into sessions, and aggregates each session into a
+// single row. A session is a run of consecutive rows of the same key,
+// ordered by time, in which no two successive rows are more than gap
+// apart: a row whose time follows that of the previous row of its key
+// by more than gap begins a new session. The key comprises the slice's
+// prefix columns (see Prefixed); timeCol is the index of the column
+// that holds each row's time, which must be an integer, floating point,
+// or time.Time column. The gap must be of the type of the time column,
+// or a time.Duration if it is a time.Time column, and must be positive.
+//
+// The rows of each session are aggregated, like Fold, by the provided
+// function, which is invoked, in order, for each row with the
+// session's accumulator and the row's non-key columns:
+//
+//	func(accum acctype, v_p+1 t_p+1, ..., vn tn) acctype
+//
+// The accumulator of each session is initialized to the zero value of
+// its type. The returned slice produces, for each session, the key
+// columns (its prefix), the times of the session's first and last
+// rows, and the session's accumulator. Schematically:
+//
+//	SessionWindow(Slice<k1, ..., kp, t_p+1, ..., tn>, timeCol, gap, func(acc, t_p+1, ..., tn) acc) Slice<k1, ..., kp, ttime, ttime, acc>
+//
+// SessionWindow is pipelined: it reads each shard of the provided slice
+// once, in order, and requires that its rows be ordered by key and
+// then by time. The provided slice must thus be an OrderedSlice (e.g.,
+// as returned by Sort) whose ordering's keys are the slice's key
+// columns, in any order and direction, each ordered by its natural
+// order, followed by the time column, in increasing order (time.Time
+// columns, which have no natural order, are ordered by a less function,
+// e.g., time.Time.Before); SessionWindow panics with a typecheck error
+// otherwise. Reading a shard whose rows are not ordered by time fails.
+//
+// Sessions are computed independently within each shard: they do not
+// span shard boundaries. For each key to yield a single sequence of
+// sessions, the rows of each key must be co-located in the same shard,
+// e.g., by Reshuffle, which partitions rows by the slice's prefix
+// columns, before they are sorted. Otherwise, each shard produces the
+// sessions of the rows of each key that it holds, so that sessions of
+// the same key may overlap. For example, the following counts the
+// events of each user's sessions, where sessions end after 30 minutes
+// of inactivity:
+//
+//	events = bigslice.Reshuffle(events) // Slice<user string, t time.Time>
+//	events = bigslice.Sort(events, bigslice.Ordering{Keys: []bigslice.SortKey{{Col: 0}, {Col: 1}}})
+//	sessions := bigslice.SessionWindow(events, 1, 30*time.Minute, func(n int, t time.Time) int { return n + 1 })
+func SessionWindow(slice Slice, timeCol int, gap interface{}, aggregate interface{}, prags ...Pragma) Slice {
+	prefix := slice.Prefix()
+	if timeCol < prefix || timeCol >= slice.NumOut() {
+		typecheck.Panicf(1, "sessionwindow: time column %d is not a non-key column of slice %s with %d key columns",
+			timeCol, slicetype.String(slice), prefix)
+	}
+	timeType := slice.Out(timeCol)
+	gapType := timeType
+	switch timeType.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+	default:
+		if timeType != typeOfTime {
+			typecheck.Panicf(1, "sessionwindow: time column %d has type %s; expected a numeric or time.Time column", timeCol, timeType)
+		}
+		gapType = typeOfDuration
+	}
+	gapv := reflect.ValueOf(gap)
+	if !gapv.IsValid() || gapv.Type() != gapType {
+		typecheck.Panicf(1, "sessionwindow: gap of type %T does not match time column type %s; expected %s", gap, timeType, gapType)
+	}
+	if !positive(gapv) {
+		typecheck.Panicf(1, "sessionwindow: gap %v is not positive", gap)
+	}
+
+	ordered, ok := slice.(OrderedSlice)
+	if !ok {
+		typecheck.Panicf(1, "sessionwindow: slice %s is not ordered; sort it by its key columns and then by time", slicetype.String(slice))
+	}
+	order, _ := ordered.Ordering()
+	o := makeOrdering("sessionwindow", slice, order)
+	seen := make(map[int]bool)
+	for i := 0; i < prefix; i++ {
+		if i >= len(o.keys) || o.keys[i].Col >= prefix || seen[o.keys[i].Col] || !o.keys[i].less.IsNil() {
+			typecheck.Panicf(1, "sessionwindow: slice is not ordered by its %d key columns, by their natural order, before its time column", prefix)
+		}
+		seen[o.keys[i].Col] = true
+	}
+	// The order of times is checked as the rows are read.
+	if len(o.keys) <= prefix || o.keys[prefix].Col != timeCol || o.keys[prefix].Desc {
+		typecheck.Panicf(1, "sessionwindow: slice is not ordered by increasing time column %d after its key columns", timeCol)
+	}
+
+	fn, ok := slicefunc.Of(aggregate)
+	if !ok {
+		typecheck.Panicf(1, "sessionwindow: invalid aggregate function %T", aggregate)
+	}
+	if fn.Out.NumOut() != 1 {
+		typecheck.Panicf(1, "sessionwindow: aggregate functions must return exactly one value")
+	}
+	if got, want := fn.In, slicetype.Append(fn.Out, slicetype.Slice(slice, prefix, slice.NumOut())); !typecheck.Equal(got, want) {
+		typecheck.Panicf(1, "sessionwindow: expected func(acc, t%d, ..., t%d), got %T", prefix+1, slice.NumOut(), aggregate)
+	}
+	cols := slicetype.Columns(slicetype.Slice(slice, 0, prefix))
+	cols = append(cols, timeType, timeType, fn.Out.Out(0))
+	keys := make([]sortKey, prefix)
+	for i := range keys {
+		keys[i] = sortKey{SortKey: SortKey{Col: i}, typ: slice.Out(i)}
+	}
+	return &sessionWindowSlice{
+		name:    MakeName("sessionwindow"),
+		Pragmas: prags,
+		Slice:   slice,
+		timeCol: timeCol,
+		gap:     gapv,
+		fval:    fn,
+		out:     prefixedType{slicetype.New(cols...), prefix},
+		keys:    keys,
+	}
+}
+
+// positive tells whether the provided numeric or time.Duration value
+// is positive.
+func positive(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() > 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() > 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() > 0
+	}
+	return false
+}
+
+func (s *sessionWindowSlice) Name() Name             { return s.name }
+func (s *sessionWindowSlice) NumOut() int            { return s.out.NumOut() }
+func (s *sessionWindowSlice) Out(c int) reflect.Type { return s.out.Out(c) }
+func (s *sessionWindowSlice) Prefix() int            { return s.out.Prefix() }
+func (*sessionWindowSlice) NumDep() int              { return 1 }
+func (s *sessionWindowSlice) Dep(i int) Dep          { return singleDep(i, s.Slice, false) }
+func (*sessionWindowSlice) Combiner() slicefunc.Func { return slicefunc.Nil }
+
+// compareTimes returns a function that compares the time y of a row
+// with the time x of the previous row of its key, returning -1 if y
+// precedes x (i.e., the rows are not ordered), 0 if y is within the
+// slice's gap of x, and 1 if y follows x by more than the gap.
+func (s *sessionWindowSlice) compareTimes() func(x, y reflect.Value) int {
+	compare := func(less, after bool) int {
+		switch {
+		case less:
+			return -1
+		case after:
+			return 1
+		}
+		return 0
+	}
+	switch s.gap.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if s.gap.Type() == typeOfDuration {
+			gap := time.Duration(s.gap.Int())
+			return func(x, y reflect.Value) int {
+				xt, yt := x.Interface().(time.Time), y.Interface().(time.Time)
+				return compare(yt.Before(xt), yt.Sub(xt) > gap)
+			}
+		}
+		gap := s.gap.Int()
+		return func(x, y reflect.Value) int { return compare(y.Int() < x.Int(), y.Int()-x.Int() > gap) }
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		gap := s.gap.Uint()
+		return func(x, y reflect.Value) int { return compare(y.Uint() < x.Uint(), y.Uint()-x.Uint() > gap) }
+	default:
+		gap := s.gap.Float()
+		return func(x, y reflect.Value) int { return compare(y.Float() < x.Float(), y.Float()-x.Float() > gap) }
+	}
+}
+
+type sessionWindowReader struct {
+	op     *sessionWindowSlice
+	reader sliceio.Reader
+	err    error
+
+	// in buffers the rows that have been read from reader; rows
+	// [beg, end) have yet to be aggregated.
+	in       frame.Frame
+	beg, end int
+	eof      bool
+
+	keyLess      []func(x, y reflect.Value) bool
+	compareTimes func(x, y reflect.Value) int
+	args         []reflect.Value
+
+	// open indicates whether a session is open. Its key, the times of
+	// its first and last rows, and its accumulator are given by key,
+	// first, last, and acc.
+	open        bool
+	key         []reflect.Value
+	first, last reflect.Value
+	acc         reflect.Value
+}
+
+func (s *sessionWindowSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	return &sessionWindowReader{op: s, reader: deps[0]}
+}
+
+func (r *sessionWindowReader) Read(ctx context.Context, out frame.Frame) (n int, err error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if !slicetype.Assignable(out, r.op) {
+		return 0, errTypeError
+	}
+	if r.in.IsZero() {
+		r.in = frame.Make(r.op.Slice, defaultChunksize, defaultChunksize)
+		r.keyLess = make([]func(x, y reflect.Value) bool, len(r.op.keys))
+		for i := range r.op.keys {
+			r.keyLess[i] = r.op.keys[i].lessFunc(ctx)
+		}
+		r.compareTimes = r.op.compareTimes()
+		r.args = make([]reflect.Value, 1+r.op.Slice.NumOut()-len(r.op.keys))
+	}
+	for n < out.Len() {
+		if r.beg == r.end {
+			if r.eof {
+				if r.open {
+					r.emit(out, n)
+					n++
+				}
+				r.err = sliceio.EOF
+				return n, r.err
+			}
+			var m int
+			m, err = r.reader.Read(ctx, r.in)
+			if err == sliceio.EOF {
+				r.eof = true
+			} else if err != nil {
+				r.err = err
+				return n, err
+			}
+			r.beg, r.end = 0, m
+			continue
+		}
+		i := r.beg
+		t := r.in.Index(r.op.timeCol, i)
+		if r.open {
+			if !r.sameKey(i) {
+				r.emit(out, n)
+				n++
+				continue
+			}
+			switch r.compareTimes(r.last, t) {
+			case -1:
+				r.err = errors.E(errors.Fatal, errors.Invalid, fmt.Sprintf("%s: rows are not ordered by time: %v follows %v",
+					r.op.name, t.Interface(), r.last.Interface()))
+				return n, r.err
+			case 1:
+				r.emit(out, n)
+				n++
+				continue
+			}
+		} else {
+			r.open = true
+			r.key = r.key[:0]
+			for col := range r.op.keys {
+				r.key = append(r.key, copyValue(r.in.Index(col, i)))
+			}
+			r.first = copyValue(t)
+			r.acc = reflect.Zero(r.op.fval.Out.Out(0))
+		}
+		r.last = copyValue(t)
+		r.args[0] = r.acc
+		for j := 1; j < len(r.args); j++ {
+			r.args[j] = r.in.Index(len(r.op.keys)+j-1, i)
+		}
+		r.acc = r.op.fval.Call(ctx, r.args)[0]
+		r.beg++
+	}
+	return n, nil
+}
+
+// sameKey tells whether row i of the reader's input has the key of the
+// open session.
+func (r *sessionWindowReader) sameKey(i int) bool {
+	for col, less := range r.keyLess {
+		x, y := r.key[col], r.in.Index(col, i)
+		if less(x, y) || less(y, x) {
+			return false
+		}
+	}
+	return true
+}
+
+// emit writes the open session to row i of out, and closes it.
+func (r *sessionWindowReader) emit(out frame.Frame, i int) {
+	for col, v := range r.key {
+		out.Index(col, i).Set(v)
+	}
+	out.Index(len(r.key), i).Set(r.first)
+	out.Index(len(r.key)+1, i).Set(r.last)
+	out.Index(len(r.key)+2, i).Set(r.acc)
+	r.open = false
+}
+
+// copyValue returns a copy of v that does not refer to v's storage.
+func copyValue(v reflect.Value) reflect.Value {
+	c := reflect.New(v.Type()).Elem()
+	c.Set(v)
+	return c
+}
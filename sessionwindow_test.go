@@ -0,0 +1,153 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grailbio/bigslice"
+	"github.com/grailbio/bigslice/slicetest"
+)
+
+// byKeyAndTime orders rows by their first column, and then by their
+// second.
+var byKeyAndTime = bigslice.Ordering{Keys: []bigslice.SortKey{{Col: 0}, {Col: 1}}}
+
+func TestSessionWindow(t *testing.T) {
+	slice := bigslice.Const(2,
+		[]string{"a", "a", "a", "b", "b", "a", "b"},
+		[]int{1, 3, 20, 5, 6, 22, 30},
+		[]int{1, 2, 3, 4, 5, 6, 7},
+	)
+	slice = bigslice.Sort(bigslice.Reshuffle(slice), byKeyAndTime)
+	slice = bigslice.SessionWindow(slice, 1, 5, func(sum, t, v int) int { return sum + v })
+	assertEqual(t, slice, true,
+		[]string{"a", "a", "b", "b"},
+		[]int{1, 20, 5, 30},
+		[]int{3, 22, 6, 30},
+		[]int{3, 9, 9, 7},
+	)
+
+	// Sessions span many frames.
+	const N = 10000
+	var (
+		keys  = make([]string, N)
+		times = make([]int64, N)
+	)
+	for i := range keys {
+		keys[i] = "k"
+		// Every 100 rows are followed by a gap of 11.
+		times[i] = int64(i + 10*(i/100))
+	}
+	slice = bigslice.Const(1, keys, times)
+	slice = bigslice.Sort(slice, byKeyAndTime)
+	slice = bigslice.SessionWindow(slice, 1, int64(10), func(n int, t int64) int { return n + 1 })
+	var (
+		wantKeys            = make([]string, N/100)
+		wantFirst, wantLast = make([]int64, N/100), make([]int64, N/100)
+		wantCounts          = make([]int, N/100)
+	)
+	for i := range wantKeys {
+		wantKeys[i] = "k"
+		wantFirst[i] = times[i*100]
+		wantLast[i] = times[i*100+99]
+		wantCounts[i] = 100
+	}
+	assertEqual(t, slice, false, wantKeys, wantFirst, wantLast, wantCounts)
+
+	// Sessions are keyed by all of the slice's prefix columns, and may be
+	// delimited by times.
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	slice = bigslice.Const(1,
+		[]string{"a", "a", "a", "a"},
+		[]int{1, 1, 2, 1},
+		[]time.Time{base, base.Add(time.Minute), base.Add(time.Minute), base.Add(time.Hour)},
+	)
+	slice = bigslice.Prefixed(slice, 2)
+	slice = bigslice.Sort(slice, bigslice.Ordering{Keys: []bigslice.SortKey{
+		{Col: 1, Desc: true},
+		{Col: 0},
+		{Col: 2, Less: func(a, b time.Time) bool { return a.Before(b) }},
+	}})
+	slice = bigslice.SessionWindow(slice, 2, 30*time.Minute, func(n int, t time.Time) int { return n + 1 })
+	assertEqual(t, slice, false,
+		[]string{"a", "a", "a"},
+		[]int{2, 1, 1},
+		[]time.Time{base.Add(time.Minute), base, base.Add(time.Hour)},
+		[]time.Time{base.Add(time.Minute), base.Add(time.Minute), base.Add(time.Hour)},
+		[]int{1, 2, 1},
+	)
+}
+
+func TestSessionWindowUnordered(t *testing.T) {
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	slice := bigslice.Const(1, []string{"a", "a"}, []time.Time{base, base.Add(time.Hour)})
+	// The less function orders times in decreasing order.
+	slice = bigslice.Sort(slice, bigslice.Ordering{Keys: []bigslice.SortKey{
+		{Col: 0},
+		{Col: 1, Less: func(a, b time.Time) bool { return a.After(b) }},
+	}})
+	slice = bigslice.SessionWindow(slice, 1, time.Minute, func(n int, t time.Time) int { return n + 1 })
+	for name, res := range runError(context.Background(), t, slice) {
+		if err := res.Err; err == nil || !strings.Contains(err.Error(), "rows are not ordered by time") {
+			t.Errorf("%s: got %v, want ordering error", name, err)
+		}
+	}
+}
+
+func TestSessionWindowError(t *testing.T) {
+	var (
+		input  = bigslice.Const(1, []string{"a"}, []int{1}, []float64{1})
+		sorted = bigslice.Sort(input, byKeyAndTime)
+		count  = func(n, t int, v float64) int { return n + 1 }
+	)
+	expectTypeError(t, "sessionwindow: time column 0 is not a non-key column of slice slice[1]string,int,float64 with 1 key columns", func() {
+		bigslice.SessionWindow(sorted, 0, 1, count)
+	})
+	expectTypeError(t, "sessionwindow: time column 1 has type string; expected a numeric or time.Time column", func() {
+		bigslice.SessionWindow(bigslice.Const(1, []int{1}, []string{"a"}), 1, 1, count)
+	})
+	expectTypeError(t, "sessionwindow: gap of type float64 does not match time column type int; expected int", func() {
+		bigslice.SessionWindow(sorted, 1, 1.0, count)
+	})
+	expectTypeError(t, "sessionwindow: gap 0 is not positive", func() {
+		bigslice.SessionWindow(sorted, 1, 0, count)
+	})
+	expectTypeError(t, "sessionwindow: slice slice[1]string,int,float64 is not ordered; sort it by its key columns and then by time", func() {
+		bigslice.SessionWindow(input, 1, 1, count)
+	})
+	expectTypeError(t, "sessionwindow: slice is not ordered by its 1 key columns, by their natural order, before its time column", func() {
+		bigslice.SessionWindow(bigslice.Sort(input, bigslice.Ordering{Keys: []bigslice.SortKey{{Col: 1}, {Col: 0}}}), 1, 1, count)
+	})
+	expectTypeError(t, "sessionwindow: slice is not ordered by increasing time column 1 after its key columns", func() {
+		bigslice.SessionWindow(bigslice.Sort(input, bigslice.Ordering{Keys: []bigslice.SortKey{{Col: 0}, {Col: 1, Desc: true}}}), 1, 1, count)
+	})
+	expectTypeError(t, "sessionwindow: slice is not ordered by increasing time column 2 after its key columns", func() {
+		bigslice.SessionWindow(sorted, 2, 1.0, count)
+	})
+	expectTypeError(t, "sessionwindow: expected func(acc, t2, ..., t3), got func(int, int) int", func() {
+		bigslice.SessionWindow(sorted, 1, 1, func(n, t int) int { return n })
+	})
+}
+
+func ExampleSessionWindow() {
+	// Page views by user, with their times in minutes.
+	slice := bigslice.Const(1,
+		[]string{"alice", "bob", "alice", "alice", "bob", "alice"},
+		[]int{0, 3, 10, 55, 4, 70},
+	)
+	slice = bigslice.Sort(slice, bigslice.Ordering{Keys: []bigslice.SortKey{{Col: 0}, {Col: 1}}})
+	// Count the views of each session; sessions end after 30 minutes
+	// without views.
+	slice = bigslice.SessionWindow(slice, 1, 30, func(views, minute int) int { return views + 1 })
+	slicetest.Print(slice)
+	// Output:
+	// alice 0 10 2
+	// alice 55 70 2
+	// bob 3 4 2
+}
@@ -0,0 +1,169 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigslice/slicefunc"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/slicetype"
+	"github.com/grailbio/bigslice/typecheck"
+)
+
+// MapWithState is a variant of Map whose function receives a state
+// value that is set up once for each shard, e.g., a compiled regular
+// expression, an initialized parser, or a database connection pool.
+// The function setup must be of the form:
+//
+//	func(shard int) (stateType, error)
+//
+// and may take a context.Context as its first argument. Setup is
+// invoked when the shard's reader is first read, and its state is
+// passed as the first argument of each invocation of fn on the shard's
+// rows. Schematically:
+//
+//	MapWithState(Slice<t1, ..., tn>, func(int) (s, error), func(s, t1, ..., tn) (r1, ..., rn)) Slice<r1, ..., rn>
+//
+// Each shard (and each attempt of a shard's task) sets up its own
+// state, which is used only by the goroutine that reads the shard;
+// states are thus never shared across shards, and need not be safe for
+// concurrent use. (Setup functions should not return states that share
+// unsynchronized resources.) If the state implements io.Closer, it is
+// closed once the task reading the shard is complete, whether the task
+// succeeded, failed, or was cancelled. An error returned by setup fails
+// the task; unless the error is temporary, the failure is fatal.
+//
+// MapWithState otherwise behaves as Map, and accepts the same pragmas.
+func MapWithState(slice Slice, setup, fn interface{}, prags ...Pragma) Slice {
+	setupFn, stateType, err := shardSetupOf(setup)
+	if err != nil {
+		typecheck.Panicf(1, "mapwithstate: %v", err)
+	}
+	m := new(mapSlice)
+	m.name = MakeName("mapwithstate")
+	m.Slice = slice
+	sliceFn, ok := slicefunc.Of(fn)
+	if !ok {
+		typecheck.Panicf(1, "mapwithstate: invalid map function %T", fn)
+	}
+	if !typecheck.CanApply(sliceFn, slicetype.Append(slicetype.New(stateType), slice)) {
+		typecheck.Panicf(1, "mapwithstate: function %T does not match state type %s and input slice type %s", fn, stateType, slicetype.String(slice))
+	}
+	out := slicetype.Columns(sliceFn.Out)
+	if n := len(out); n > 0 && out[n-1] == typeOfError {
+		m.fnErr = true
+		out = out[:n-1]
+	}
+	if len(out) == 0 {
+		typecheck.Panicf(1, "mapwithstate: need at least one output column")
+	}
+	m.fval = sliceFn
+	m.setup = setupFn
+	m.out = slicetype.New(out...)
+	m.Pragmas = prags
+	if m.onErr, err = makeErrorPolicy(m.Pragmas, fn, m.fnErr); err != nil {
+		typecheck.Panicf(1, "mapwithstate: %v", err)
+	}
+	return m
+}
+
+// FilterWithState is a variant of Filter whose predicate receives a
+// state value that is set up once for each shard. The function setup
+// is as for MapWithState, and its state is passed as the first argument
+// of each invocation of pred. Schematically:
+//
+//	FilterWithState(Slice<t1, ..., tn>, func(int) (s, error), func(s, t1, ..., tn) bool) Slice<t1, ..., tn>
+//
+// States are set up, used, and closed as with MapWithState.
+func FilterWithState(slice Slice, setup, pred interface{}, prags ...Pragma) Slice {
+	setupFn, stateType, err := shardSetupOf(setup)
+	if err != nil {
+		typecheck.Panicf(1, "filterwithstate: %v", err)
+	}
+	f := new(filterSlice)
+	f.name = MakeName("filterwithstate")
+	f.Slice = slice
+	f.Pragmas = prags
+	fn, ok := slicefunc.Of(pred)
+	if !ok {
+		typecheck.Panicf(1, "filterwithstate: invalid predicate function %T", pred)
+	}
+	if !typecheck.CanApply(fn, slicetype.Append(slicetype.New(stateType), slice)) {
+		typecheck.Panicf(1, "filterwithstate: function %T does not match state type %s and input slice type %s", pred, stateType, slicetype.String(slice))
+	}
+	if fn.Out.NumOut() != 1 || fn.Out.Out(0).Kind() != reflect.Bool {
+		typecheck.Panic(1, "filterwithstate: predicate must return a single boolean value")
+	}
+	f.pred = fn
+	f.setup = setupFn
+	return f
+}
+
+// shardSetupOf checks that setup is a valid shard setup function,
+// returning it along with the type of the state it sets up.
+func shardSetupOf(setup interface{}) (slicefunc.Func, reflect.Type, error) {
+	fn, ok := slicefunc.Of(setup)
+	if !ok || fn.In.NumOut() != 1 || fn.In.Out(0).Kind() != reflect.Int || fn.IsVariadic {
+		return slicefunc.Nil, nil, fmt.Errorf("invalid setup function %T", setup)
+	}
+	if fn.Out.NumOut() != 2 || fn.Out.Out(1) != typeOfError {
+		return slicefunc.Nil, nil, fmt.Errorf("setup function %T does not return (state, error)", setup)
+	}
+	return fn, fn.Out.Out(0), nil
+}
+
+// shardState is the state of a shard of a MapWithState or
+// FilterWithState slice.
+type shardState struct {
+	name  Name
+	setup slicefunc.Func
+	shard int
+	value reflect.Value
+}
+
+// Init sets up the shard's state, if it has not already been set up.
+func (s *shardState) Init(ctx context.Context) error {
+	if s.value.IsValid() {
+		return nil
+	}
+	rvs := s.setup.Call(ctx, []reflect.Value{reflect.ValueOf(s.shard)})
+	if e := rvs[1].Interface(); e != nil {
+		err := errors.E(fmt.Sprintf("%s: shard %d: setup", s.name, s.shard), e.(error))
+		if !errors.IsTemporary(err) {
+			err = errors.E(errors.Fatal, err)
+		}
+		return err
+	}
+	s.value = rvs[0]
+	return nil
+}
+
+// Cleanup implements sliceio.Cleaner by closing the shard's state, if
+// it was set up and implements io.Closer.
+func (s *shardState) Cleanup(ctx context.Context) error {
+	if !s.value.IsValid() {
+		return nil
+	}
+	if closer, ok := s.value.Interface().(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// statefulReader is a reader whose shard state is cleaned up once its
+// task is complete.
+type statefulReader struct {
+	sliceio.Reader
+	state *shardState
+}
+
+func (r statefulReader) Cleanup(ctx context.Context) error {
+	return r.state.Cleanup(ctx)
+}
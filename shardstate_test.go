@@ -0,0 +1,128 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/grailbio/bigslice"
+)
+
+var shardStateSetups, shardStateCloses int64
+
+type shardTestState struct {
+	shard, n int
+}
+
+func (*shardTestState) Close() error {
+	atomic.AddInt64(&shardStateCloses, 1)
+	return nil
+}
+
+func seq(n int) []int {
+	s := make([]int, n)
+	for i := range s {
+		s[i] = i
+	}
+	return s
+}
+
+func TestMapWithState(t *testing.T) {
+	const N = 1000
+	ctx := context.Background()
+	slice := bigslice.Const(4, seq(N))
+	slice = bigslice.MapWithState(slice,
+		func(shard int) (*shardTestState, error) {
+			atomic.AddInt64(&shardStateSetups, 1)
+			return &shardTestState{shard: shard}, nil
+		},
+		func(s *shardTestState, x int) (int, int, int) {
+			s.n++
+			return x, s.shard, s.n - 1
+		})
+	for name, s := range run(ctx, t, slice) {
+		var (
+			xs, shards, ns []int
+			x, shard, n    int
+		)
+		for s.Scan(ctx, &x, &shard, &n) {
+			xs = append(xs, x)
+			shards = append(shards, shard)
+			ns = append(ns, n)
+		}
+		if err := s.Err(); err != nil {
+			t.Fatal(err)
+		}
+		// Each shard's rows were mapped, in order, with the shard's own
+		// state.
+		seqs := make(map[int][]int)
+		for i := range xs {
+			seqs[shards[i]] = append(seqs[shards[i]], ns[i])
+		}
+		if got, want := len(seqs), 4; got != want {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+		for shard, ns := range seqs {
+			if got, want := ns, seq(len(ns)); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: shard %d: got %v, want %v", name, shard, got, want)
+			}
+		}
+		sort.Ints(xs)
+		if got, want := xs, seq(N); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+	}
+	// Every state that was set up was closed.
+	setups := atomic.LoadInt64(&shardStateSetups)
+	if setups < 4 {
+		t.Errorf("got %v setups, want at least 4", setups)
+	}
+	if got, want := atomic.LoadInt64(&shardStateCloses), setups; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	input := bigslice.Const(1, []string{})
+	expectTypeError(t, "mapwithstate: invalid setup function func() (int, error)", func() {
+		bigslice.MapWithState(input, func() (int, error) { return 0, nil }, func(int, string) int { return 0 })
+	})
+	expectTypeError(t, "mapwithstate: setup function func(int) int does not return (state, error)", func() { bigslice.MapWithState(input, func(int) int { return 0 }, func(int, string) int { return 0 }) })
+	expectTypeError(t, "mapwithstate: function func(string) int does not match state type int and input slice type slice[1]string", func() {
+		bigslice.MapWithState(input, func(int) (int, error) { return 0, nil }, func(string) int { return 0 })
+	})
+}
+
+func TestFilterWithState(t *testing.T) {
+	slice := bigslice.Const(2, []string{"a1", "b2", "a3", "c4", "a5"})
+	slice = bigslice.FilterWithState(slice,
+		func(ctx context.Context, shard int) (*regexp.Regexp, error) {
+			return regexp.Compile("^a")
+		},
+		func(re *regexp.Regexp, s string) bool {
+			return re.MatchString(s)
+		})
+	assertEqual(t, slice, true, []string{"a1", "a3", "a5"})
+}
+
+func TestShardStateSetupError(t *testing.T) {
+	ctx := context.Background()
+	slice := bigslice.Const(2, []int{1, 2, 3})
+	slice = bigslice.MapWithState(slice,
+		func(shard int) (int, error) {
+			return 0, errors.New("cannot connect")
+		},
+		func(state, x int) int { return x })
+	for name, res := range runError(ctx, t, slice) {
+		if res.Err == nil || !strings.Contains(res.Err.Error(), "setup") || !strings.Contains(res.Err.Error(), "cannot connect") {
+			t.Errorf("%s: got %v, want setup error", name, res.Err)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import "fmt"
+
+type sizeHint struct {
+	rows, bytes int64
+}
+
+func (sizeHint) Procs() int        { return 1 }
+func (sizeHint) Exclusive() bool   { return false }
+func (sizeHint) Materialize() bool { return false }
+
+// SizeHint returns a pragma that hints at the total size of a source
+// slice's output, summed over its shards: its number of rows and its
+// encoded size in bytes. Size hints are not used to compute slices;
+// they are used to estimate the cost of computations before they are
+// run (see exec.EstimateShuffle), and need only be approximate.
+func SizeHint(rows, bytes int64) Pragma {
+	if rows < 0 || bytes < 0 {
+		panic(fmt.Sprintf("bigslice.SizeHint: invalid size %d rows, %d bytes", rows, bytes))
+	}
+	return sizeHint{rows, bytes}
+}
+
+// SizeHintOf returns the size given by the first SizeHint pragma in p,
+// and whether there is one.
+func SizeHintOf(p Pragma) (rows, bytes int64, ok bool) {
+	eachPragma(p, func(q Pragma) {
+		if h, isHint := q.(sizeHint); isHint && !ok {
+			rows, bytes, ok = h.rows, h.bytes, true
+		}
+	})
+	return
+}
+
+type selectivity float64
+
+func (selectivity) Procs() int        { return 1 }
+func (selectivity) Exclusive() bool   { return false }
+func (selectivity) Materialize() bool { return false }
+
+// Selectivity returns a pragma that hints at the ratio of the size of
+// a slice's output to the size of its input: e.g., 0.1 for a Filter
+// that keeps a tenth of its rows, or 3 for a Flatmap that emits three
+// rows for each row that it reads. Like SizeHint, selectivity hints
+// are used only to estimate the cost of computations (see
+// exec.EstimateShuffle); slices without hints are taken to output as
+// much as they read.
+func Selectivity(ratio float64) Pragma {
+	if ratio <= 0 {
+		panic(fmt.Sprintf("bigslice.Selectivity: invalid ratio %v", ratio))
+	}
+	return selectivity(ratio)
+}
+
+// SelectivityOf returns the ratio given by the Selectivity pragmas in
+// p, or 0 if there are none. The ratios of multiple pragmas are
+// multiplied, as they are when slices are pipelined.
+func SelectivityOf(p Pragma) float64 {
+	var ratio float64
+	eachPragma(p, func(q Pragma) {
+		if r, ok := q.(selectivity); ok {
+			if ratio == 0 {
+				ratio = float64(r)
+			} else {
+				ratio *= float64(r)
+			}
+		}
+	})
+	return ratio
+}
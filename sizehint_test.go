@@ -0,0 +1,57 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/grailbio/bigslice"
+	"github.com/grailbio/bigslice/sliceio"
+)
+
+func TestSizeHintPragmas(t *testing.T) {
+	p := bigslice.Pragmas{bigslice.Procs(2), bigslice.SizeHint(10, 100), bigslice.Selectivity(0.5), bigslice.Selectivity(4)}
+	rows, bytes, ok := bigslice.SizeHintOf(p)
+	if !ok || rows != 10 || bytes != 100 {
+		t.Errorf("got %v, %v, %v, want 10, 100, true", rows, bytes, ok)
+	}
+	if got, want := bigslice.SelectivityOf(p), 2.; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	p = bigslice.Pragmas{bigslice.Exclusive}
+	if _, _, ok := bigslice.SizeHintOf(p); ok {
+		t.Error("unexpected size hint")
+	}
+	if got, want := bigslice.SelectivityOf(p), 0.; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestPragmaLookupSlices(t *testing.T) {
+	source := bigslice.ReaderFunc(1, func(shard int, state *int, x []int) (int, error) {
+		return 0, sliceio.EOF
+	}, bigslice.SizeHint(10, 100), bigslice.Tag("k", "source"), bigslice.Concurrency(4))
+	mapped := bigslice.Map(source, func(x int) int { return x },
+		bigslice.Selectivity(2), bigslice.Tag("k", "map"), bigslice.ChunkSize(16), bigslice.Concurrency(2))
+	// Pragmas are looked up through the slices that carry them, as they
+	// are composed by compiled tasks.
+	p := bigslice.Pragmas{source.(bigslice.Pragma), mapped.(bigslice.Pragma)}
+	if rows, bytes, ok := bigslice.SizeHintOf(p); !ok || rows != 10 || bytes != 100 {
+		t.Errorf("got %v, %v, %v, want 10, 100, true", rows, bytes, ok)
+	}
+	if got, want := bigslice.SelectivityOf(p), 2.; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := bigslice.TagsOf(p), map[string]string{"k": "map"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := bigslice.ChunkSizeOf(p), 16; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := bigslice.ConcurrencyOf(p), 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
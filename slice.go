@@ -7,6 +7,7 @@ package bigslice
 import (
 	"context"
 	"fmt"
+	"io"
 	"reflect"
 	"runtime"
 	"strings"
@@ -37,6 +38,11 @@ var errTypeError = errors.New("type error")
 // partition from all dependent shards. If Shuffle is true, then the provided
 // partitioner determines how the output is partitioned. If it is nil, the
 // default (hash by first column) partitioner is used.
+//
+// Fields may be added to Dep, at its end, as dependencies acquire new
+// behaviors; Dep literals must therefore be keyed (e.g.,
+// Dep{Slice: slice, Shuffle: true}), and the zero value of each new
+// field preserves the behavior of dependencies that do not set it.
 type Dep struct {
 	Slice
 	Shuffle     bool
@@ -46,6 +52,21 @@ type Dep struct {
 	// not merged) when handed to the slice implementation. This is to
 	// support merge-sorting of shards of the same partition.
 	Expand bool
+	// Broadcast indicates that the output of each shard of a shuffle
+	// dependency should be read in full by every shard of the dependent
+	// slice, instead of being partitioned among them. The partitioner
+	// is not used for broadcast dependencies.
+	Broadcast bool
+	// NumBranch, if nonzero, indicates that the dependency is one of
+	// NumBranch outputs of a multi-output slice. Each shard of the
+	// dependency routes its rows among the outputs using the
+	// partitioner, and each shard of the dependent slice reads output
+	// Branch of the corresponding shard of the dependency. Branch
+	// dependencies are not shuffles: the dependency must have the same
+	// number of shards as the dependent slice. The dependency is
+	// computed once for all of its outputs. A zero NumBranch denotes an
+	// ordinary, single-output dependency.
+	NumBranch, Branch int
 }
 
 // ShardType indicates the type of sharding used by a Slice.
@@ -155,6 +176,28 @@ func (p Pragmas) Materialize() bool {
 	return false
 }
 
+// pragmas returns the underlying pragmas. It is promoted to the slices
+// that embed their Pragmas, so that pragma lookups (see eachPragma)
+// find the pragmas of the slices of a task.
+func (p Pragmas) pragmas() Pragmas { return p }
+
+// eachPragma calls fn for each of the pragmas that compose p, in
+// order: the elements of Pragmas, and the pragmas of slices that embed
+// them, are visited recursively.
+func eachPragma(p Pragma, fn func(Pragma)) {
+	switch p := p.(type) {
+	case Pragmas:
+		for _, q := range p {
+			eachPragma(q, fn)
+		}
+	case interface{ pragmas() Pragmas }:
+		eachPragma(p.pragmas(), fn)
+	case nil:
+	default:
+		fn(p)
+	}
+}
+
 type exclusive struct{}
 
 func (exclusive) Procs() int        { return 1 }
@@ -199,6 +242,81 @@ func Procs(n int) Pragma {
 	return procs{n: n}
 }
 
+type chunkSize struct {
+	n int
+}
+
+func (chunkSize) Procs() int        { return 1 }
+func (chunkSize) Exclusive() bool   { return false }
+func (chunkSize) Materialize() bool { return false }
+
+// ChunkSize returns a pragma that sets the number of rows per frame with
+// which a slice task's output is read and written to n, overriding the
+// session's chunk size (see exec.ChunkSize). Larger chunks amortize
+// per-frame overhead, at the cost of memory and latency; chunks of tens
+// to thousands of rows are typical.
+func ChunkSize(n int) Pragma {
+	if n <= 0 {
+		typecheck.Panicf(1, "chunksize: invalid chunk size %d", n)
+	}
+	return chunkSize{n}
+}
+
+// ChunkSizeOf returns the chunk size given by the ChunkSize pragmas in
+// p, or 0 if there are none. If multiple slices with ChunkSize pragmas
+// are pipelined, the largest chunk size applies to the composed
+// pipeline.
+func ChunkSizeOf(p Pragma) int {
+	var size int
+	eachPragma(p, func(q Pragma) {
+		if c, ok := q.(chunkSize); ok && c.n > size {
+			size = c.n
+		}
+	})
+	return size
+}
+
+type tag struct {
+	key, value string
+}
+
+func (tag) Procs() int        { return 1 }
+func (tag) Exclusive() bool   { return false }
+func (tag) Materialize() bool { return false }
+
+// Tag returns a pragma that attaches the metadata key=value to the
+// tasks that compute a slice, e.g., to correlate them with cost centers
+// or traces in downstream systems. Tags are surfaced in task traces,
+// events, and logs. Tags are inherited by the operations pipelined
+// with a slice: a task carries the tags of all of the slices it
+// computes, and a slice's tag overrides a tag with the same key on the
+// slices from which it is pipelined. Tags do not affect the identity
+// of tasks, and so do not affect caching or reuse.
+func Tag(key, value string) Pragma {
+	if key == "" {
+		typecheck.Panic(1, "tag: empty key")
+	}
+	return tag{key, value}
+}
+
+// TagsOf returns the metadata attached by the Tag pragmas in p, or nil
+// if there are none. Tags with the same key are resolved in favor of
+// the last pragma. Since compiled tasks order the pragmas of pipelined
+// slices from first to last, a slice's tags override those of the
+// slices from which it is pipelined.
+func TagsOf(p Pragma) map[string]string {
+	var tags map[string]string
+	eachPragma(p, func(q Pragma) {
+		if t, ok := q.(tag); ok {
+			if tags == nil {
+				tags = make(map[string]string)
+			}
+			tags[t.key] = t.value
+		}
+	})
+	return tags
+}
+
 type constSlice struct {
 	name Name
 	slicetype.Type
@@ -282,7 +400,7 @@ func (s *constSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
 
 type readerFuncSlice struct {
 	name Name
-	Pragma
+	Pragmas
 	slicetype.Type
 	nshard    int
 	read      slicefunc.Func
@@ -309,6 +427,14 @@ type readerFuncSlice struct {
 // argument is a pointer, it is allocated.) Subsequent invocations of
 // the function receive the same state value, thus permitting the
 // reader to maintain local state across the read of a whole shard.
+//
+// If the state implements io.Closer, it is closed once the task
+// reading the shard is complete, whether the task succeeded, failed, or
+// was cancelled. Readers may release resources such as open files and
+// connections this way.
+//
+// With the ReadRetry pragma, a shard whose read fails transiently is
+// restarted with a new zero-value state.
 func ReaderFunc(nshard int, read interface{}, prags ...Pragma) Slice {
 	s := new(readerFuncSlice)
 	s.name = MakeName("reader")
@@ -326,7 +452,7 @@ func ReaderFunc(nshard int, read interface{}, prags ...Pragma) Slice {
 		typecheck.Panicf(1, "readerfunc: function %T is not vectorized", read)
 	}
 	s.read = fn
-	s.Pragma = Pragmas(prags)
+	s.Pragmas = prags
 	return s
 }
 
@@ -388,8 +514,25 @@ func (r *readerFuncSliceReader) Read(ctx context.Context, out frame.Frame) (n in
 	return n, r.err
 }
 
+// Cleanup implements sliceio.Cleaner by closing the reader's state, if
+// it implements io.Closer.
+func (r *readerFuncSliceReader) Cleanup(ctx context.Context) error {
+	if !r.state.IsValid() {
+		return nil
+	}
+	if closer, ok := r.state.Interface().(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Locality implements LocalitySlice.
+func (r *readerFuncSlice) Locality(shard int) []string { return localityOf(r.Pragmas, shard) }
+
 func (r *readerFuncSlice) Reader(shard int, reader []sliceio.Reader) sliceio.Reader {
-	return &readerFuncSliceReader{op: r, shard: shard}
+	return withReadRateLimit(r.Pragmas, r.nshard, withReadRetry(r.Pragmas, r.name, shard, func() sliceio.Reader {
+		return &readerFuncSliceReader{op: r, shard: shard}
+	}))
 }
 
 type writerFuncSlice struct {
@@ -540,9 +683,18 @@ func (s *writerFuncSlice) Reader(shard int, reader []sliceio.Reader) sliceio.Rea
 
 type mapSlice struct {
 	name Name
-	Pragma
+	Pragmas
 	Slice
 	fval slicefunc.Func
+	out  slicetype.Type
+	// setup, if non-nil, sets up the state passed to fval for each
+	// shard. See MapWithState.
+	setup slicefunc.Func
+	// fnErr is true if the map function returns an error as its last
+	// value.
+	fnErr bool
+	// onErr determines the handling of the errors returned by fval.
+	onErr errorPolicy
 }
 
 // Map transforms a slice by invoking a function for each record. The
@@ -551,6 +703,12 @@ type mapSlice struct {
 // The returned slice matches the input slice's sharding, but is always
 // hash partitioned.
 //
+// If the last value returned by fn is of type error, it is not an
+// output column; instead, a non-nil error fails the computation with
+// a *MapError describing the failed row, or, if the SampleErrors or
+// DeadLetterSink pragma is provided, drops the row and samples the
+// error or passes the row to the sink. See also MapDeadLetter.
+//
 // Schematically:
 //
 //	Map(Slice<t1, t2, ..., tn>, func(v1 t1, v2 t2, ..., vn tn) (r1, r2, ..., rn)) Slice<r1, r2, ..., rn>
@@ -565,17 +723,27 @@ func Map(slice Slice, fn interface{}, prags ...Pragma) Slice {
 	if !typecheck.CanApply(sliceFn, slice) {
 		typecheck.Panicf(1, "map: function %T does not match input slice type %s", fn, slicetype.String(slice))
 	}
-	if sliceFn.Out.NumOut() == 0 {
+	out := slicetype.Columns(sliceFn.Out)
+	if n := len(out); n > 0 && out[n-1] == typeOfError {
+		m.fnErr = true
+		out = out[:n-1]
+	}
+	if len(out) == 0 {
 		typecheck.Panicf(1, "map: need at least one output column")
 	}
 	m.fval = sliceFn
-	m.Pragma = Pragmas(prags)
+	m.out = slicetype.New(out...)
+	m.Pragmas = prags
+	var err error
+	if m.onErr, err = makeErrorPolicy(m.Pragmas, fn, m.fnErr); err != nil {
+		typecheck.Panicf(1, "map: %v", err)
+	}
 	return m
 }
 
 func (m *mapSlice) Name() Name             { return m.name }
-func (m *mapSlice) NumOut() int            { return m.fval.Out.NumOut() }
-func (m *mapSlice) Out(c int) reflect.Type { return m.fval.Out.Out(c) }
+func (m *mapSlice) NumOut() int            { return m.out.NumOut() }
+func (m *mapSlice) Out(c int) reflect.Type { return m.out.Out(c) }
 func (*mapSlice) ShardType() ShardType     { return HashShard }
 func (*mapSlice) NumDep() int              { return 1 }
 func (m *mapSlice) Dep(i int) Dep          { return singleDep(i, m.Slice, false) }
@@ -586,6 +754,12 @@ type mapReader struct {
 	reader sliceio.Reader // parent reader
 	in     frame.Frame    // buffer for input column vectors
 	err    error
+	// state is the shard's state, if the map has a setup function.
+	state *shardState
+	// bcast holds the shard's broadcast rows, if the map is a
+	// MapWithBroadcast.
+	bcast *broadcastArgs
+	errs  rowErrors
 }
 
 func (m *mapReader) Read(ctx context.Context, out frame.Frame) (int, error) {
@@ -595,44 +769,109 @@ func (m *mapReader) Read(ctx context.Context, out frame.Frame) (int, error) {
 	if !slicetype.Assignable(out, m.op) {
 		return 0, errTypeError
 	}
+	if m.state != nil {
+		if m.err = m.state.Init(ctx); m.err != nil {
+			return 0, m.err
+		}
+	}
+	if m.bcast != nil {
+		if m.err = m.bcast.Init(ctx); m.err != nil {
+			return 0, m.err
+		}
+	}
 	n := out.Len()
 	if m.in.IsZero() {
 		m.in = frame.Make(m.op.Slice, n, n)
 	} else {
 		m.in = m.in.Ensure(n)
 	}
-	n, m.err = m.reader.Read(ctx, m.in.Slice(0, n))
-	// Now iterate over each record, transform it, and set the output
-	// records. Note that we could parallelize the map operation here,
-	// but for simplicity, parallelism should be achieved by finer
-	// sharding instead, simplifying management of parallel
-	// computation.
-	//
-	// TODO(marius): provide a vectorized version of map for efficiency.
-	args := make([]reflect.Value, m.in.NumOut())
-	for i := 0; i < n; i++ {
-		// Gather the arguments for a single invocation.
-		for j := range args {
-			args[j] = m.in.Index(j, i)
+	var k int
+	for k == 0 && m.err == nil {
+		n, m.err = m.reader.Read(ctx, m.in.Slice(0, out.Len()))
+		if n == 0 {
+			break
 		}
-		// TODO(marius): consider using an unsafe copy here
-		result := m.op.fval.Call(ctx, args)
-		for j := range result {
-			out.Index(j, i).Set(result[j])
+		// Now iterate over each record, transform it, and set the output
+		// records. Note that we could parallelize the map operation here,
+		// but for simplicity, parallelism should be achieved by finer
+		// sharding instead, simplifying management of parallel
+		// computation.
+		//
+		// TODO(marius): provide a vectorized version of map for efficiency.
+		var (
+			args = make([]reflect.Value, m.in.NumOut())
+			call = args
+		)
+		switch {
+		case m.state != nil:
+			call = append([]reflect.Value{m.state.value}, args...)
+			args = call[1:]
+		case m.bcast != nil:
+			call = append(append([]reflect.Value{}, m.bcast.values...), args...)
+			args = call[len(m.bcast.values):]
+		}
+		for i := 0; i < n; i++ {
+			// Gather the arguments for a single invocation.
+			for j := range args {
+				args[j] = m.in.Index(j, i)
+			}
+			// TODO(marius): consider using an unsafe copy here
+			result := m.op.fval.Call(ctx, call)
+			m.errs.rows++
+			if m.op.fnErr {
+				last := len(result) - 1
+				if e := result[last].Interface(); e != nil {
+					merr, err := m.errs.fail(ctx, e.(error), args)
+					if err != nil {
+						m.err = err
+						return k, m.err
+					}
+					if m.op.onErr.route {
+						m.op.onErr.routeFailed(out, k, last, args, merr)
+						k++
+					}
+					continue
+				}
+				result = result[:last]
+			}
+			for j := range result {
+				out.Index(j, k).Set(result[j])
+			}
+			if m.op.onErr.route {
+				m.op.onErr.routeOK(out, k, len(result))
+			}
+			k++
+		}
+		if err := m.errs.check(m.err == sliceio.EOF); err != nil {
+			m.err = err
 		}
 	}
-	return n, m.err
+	return k, m.err
 }
 
 func (m *mapSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
-	return &mapReader{op: m, reader: deps[0]}
+	r := &mapReader{op: m, reader: deps[0]}
+	r.errs = rowErrors{name: m.name, shard: shard, policy: &m.onErr}
+	if m.setup.IsNil() {
+		return r
+	}
+	r.state = &shardState{name: m.name, setup: m.setup, shard: shard}
+	return statefulReader{r, r.state}
 }
 
 type filterSlice struct {
 	name Name
-	Pragma
+	Pragmas
 	Slice
 	pred slicefunc.Func
+	// setup, if non-nil, sets up the state passed to pred for each
+	// shard. See FilterWithState.
+	setup slicefunc.Func
+	// fnErr is true if the predicate returns an error as its last
+	// value.
+	fnErr bool
+	// onErr determines the handling of the errors returned by pred.
+	onErr errorPolicy
 }
 
 // Filter returns a slice where the provided predicate is applied to
@@ -640,7 +879,9 @@ type filterSlice struct {
 // those entries for which the predicate is true.
 //
 // The predicate function should receive each column of slice
-// and return a single boolean value.
+// and return a single boolean value. The predicate may also return an
+// error as its second value, which is handled as are the errors of Map
+// functions.
 //
 // Schematically:
 //
@@ -649,7 +890,7 @@ func Filter(slice Slice, pred interface{}, prags ...Pragma) Slice {
 	f := new(filterSlice)
 	f.name = MakeName("filter")
 	f.Slice = slice
-	f.Pragma = Pragmas(prags)
+	f.Pragmas = prags
 	fn, ok := slicefunc.Of(pred)
 	if !ok {
 		typecheck.Panicf(1, "filter: invalid predicate function %T", pred)
@@ -657,10 +898,15 @@ func Filter(slice Slice, pred interface{}, prags ...Pragma) Slice {
 	if !typecheck.CanApply(fn, slice) {
 		typecheck.Panicf(1, "filter: function %T does not match input slice type %s", pred, slicetype.String(slice))
 	}
-	if fn.Out.NumOut() != 1 || fn.Out.Out(0).Kind() != reflect.Bool {
+	f.fnErr = fn.Out.NumOut() == 2 && fn.Out.Out(1) == typeOfError
+	if (fn.Out.NumOut() != 1 && !f.fnErr) || fn.Out.Out(0).Kind() != reflect.Bool {
 		typecheck.Panic(1, "filter: predicate must return a single boolean value")
 	}
 	f.pred = fn
+	var err error
+	if f.onErr, err = makeErrorPolicy(f.Pragmas, pred, f.fnErr); err != nil {
+		typecheck.Panicf(1, "filter: %v", err)
+	}
 	return f
 }
 
@@ -669,11 +915,30 @@ func (*filterSlice) NumDep() int              { return 1 }
 func (f *filterSlice) Dep(i int) Dep          { return singleDep(i, f.Slice, false) }
 func (*filterSlice) Combiner() slicefunc.Func { return slicefunc.Nil }
 
+// NumOut and Out include the error column of dead-letter filters (see
+// FilterDeadLetter).
+func (f *filterSlice) NumOut() int {
+	if f.onErr.route {
+		return f.Slice.NumOut() + 1
+	}
+	return f.Slice.NumOut()
+}
+
+func (f *filterSlice) Out(c int) reflect.Type {
+	if f.onErr.route && c == f.Slice.NumOut() {
+		return typeOfMapError
+	}
+	return f.Slice.Out(c)
+}
+
 type filterReader struct {
 	op     *filterSlice
 	reader sliceio.Reader
 	in     frame.Frame
 	err    error
+	// state is the shard's state, if the filter has a setup function.
+	state *shardState
+	errs  rowErrors
 }
 
 func (f *filterReader) Read(ctx context.Context, out frame.Frame) (n int, err error) {
@@ -683,18 +948,28 @@ func (f *filterReader) Read(ctx context.Context, out frame.Frame) (n int, err er
 	if !slicetype.Assignable(out, f.op) {
 		return 0, errTypeError
 	}
+	if f.state != nil {
+		if f.err = f.state.Init(ctx); f.err != nil {
+			return 0, f.err
+		}
+	}
 	var (
-		m   int
-		max = out.Len()
+		m    int
+		max  = out.Len()
+		args = make([]reflect.Value, f.op.Slice.NumOut())
+		call = args
 	)
-	args := make([]reflect.Value, out.NumOut())
+	if f.state != nil {
+		call = append([]reflect.Value{f.state.value}, args...)
+		args = call[1:]
+	}
 	for m < max && f.err == nil {
 		// TODO(marius): this can get pretty inefficient when the accept
 		// rate is low: as we fill the output; we could degenerate into a
 		// case where we issue a call for each element. Consider input
 		// buffering instead.
 		if f.in.IsZero() {
-			f.in = frame.Make(f.op, max-m, max-m)
+			f.in = frame.Make(f.op.Slice, max-m, max-m)
 		} else {
 			f.in = f.in.Ensure(max - m)
 		}
@@ -703,22 +978,55 @@ func (f *filterReader) Read(ctx context.Context, out frame.Frame) (n int, err er
 			for j := range args {
 				args[j] = f.in.Value(j).Index(i)
 			}
-			if f.op.pred.Call(ctx, args)[0].Bool() {
+			result := f.op.pred.Call(ctx, call)
+			f.errs.rows++
+			if f.op.fnErr {
+				if e := result[1].Interface(); e != nil {
+					merr, err := f.errs.fail(ctx, e.(error), args)
+					if err != nil {
+						f.err = err
+						return m, f.err
+					}
+					if f.op.onErr.route {
+						f.op.onErr.routeFailed(out, m, 0, args, merr)
+						m++
+					}
+					continue
+				}
+			}
+			if !result[0].Bool() {
+				continue
+			}
+			if f.op.onErr.route {
+				for j := range args {
+					out.Index(j, m).Set(args[j])
+				}
+				f.op.onErr.routeOK(out, m, len(args))
+			} else {
 				frame.Copy(out.Slice(m, m+1), f.in.Slice(i, i+1))
-				m++
 			}
+			m++
+		}
+		if err := f.errs.check(f.err == sliceio.EOF); err != nil {
+			f.err = err
 		}
 	}
 	return m, f.err
 }
 
 func (f *filterSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
-	return &filterReader{op: f, reader: deps[0]}
+	r := &filterReader{op: f, reader: deps[0]}
+	r.errs = rowErrors{name: f.name, shard: shard, policy: &f.onErr}
+	if f.setup.IsNil() {
+		return r
+	}
+	r.state = &shardState{name: f.name, setup: f.setup, shard: shard}
+	return statefulReader{r, r.state}
 }
 
 type flatmapSlice struct {
 	name Name
-	Pragma
+	Pragmas
 	Slice
 	fval slicefunc.Func
 	out  slicetype.Type
@@ -737,7 +1045,7 @@ func Flatmap(slice Slice, fn interface{}, prags ...Pragma) Slice {
 	f := new(flatmapSlice)
 	f.name = MakeName("flatmap")
 	f.Slice = slice
-	f.Pragma = Pragmas(prags)
+	f.Pragmas = prags
 	sliceFn, ok := slicefunc.Of(fn)
 	if !ok {
 		typecheck.Panicf(1, "flatmap: invalid flatmap function %T", fn)
@@ -873,7 +1181,7 @@ func Fold(slice Slice, fold interface{}) Slice {
 	f.Slice = slice
 	// Fold requires shuffle by the first column.
 	// TODO(marius): allow deps to express shuffling by other columns.
-	f.dep = Dep{slice, true, nil, false}
+	f.dep = Dep{Slice: slice, Shuffle: true}
 
 	fn, ok := slicefunc.Of(fold)
 	if !ok {
@@ -1047,6 +1355,9 @@ func Prefixed(slice Slice, prefix int) Slice {
 
 func (p *prefixSlice) Prefix() int { return p.prefix }
 
+// pragmas returns the pragmas of the underlying slice.
+func (p *prefixSlice) pragmas() Pragmas { return Pragmas{p.Pragma} }
+
 // Unwrap returns the underlying slice if the provided slice is used
 // only to amend the type of the slice it composes.
 //
@@ -1073,7 +1384,7 @@ func singleDep(i int, slice Slice, shuffle bool) Dep {
 	if i != 0 {
 		panic(fmt.Sprintf("invalid dependency %d", i))
 	}
-	return Dep{slice, shuffle, nil, false}
+	return Dep{Slice: slice, Shuffle: shuffle}
 }
 
 var (
@@ -636,6 +636,10 @@ func TestMapError(t *testing.T) {
 	expectTypeError(t, "map: function func(int) string does not match input slice type slice[1]string", func() { bigslice.Map(input, func(x int) string { return "" }) })
 	expectTypeError(t, "map: function func(int, int) string does not match input slice type slice[1]string", func() { bigslice.Map(input, func(x, y int) string { return "" }) })
 	expectTypeError(t, "map: need at least one output column", func() { bigslice.Map(input, func(x string) {}) })
+	expectTypeError(t, "map: need at least one output column", func() { bigslice.Map(input, func(x string) error { return nil }) })
+	expectTypeError(t, "map: SampleErrors requires function func(string) string to return an error", func() {
+		bigslice.Map(input, func(x string) string { return "" }, bigslice.SampleErrors(1, 0))
+	})
 }
 
 func TestFilter(t *testing.T) {
@@ -6,6 +6,7 @@ package sliceio
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/gob"
 	"fmt"
@@ -61,13 +62,40 @@ func newGobDecoder(r io.Reader) *gobDecoder {
 	}
 }
 
+// frameMagic begins every stream of encoded frames (inside any
+// compression or encryption); it is followed by the version of the
+// stream's encoding, as a single byte. Since gob never begins a stream
+// with a zero byte, streams written before the encoding was versioned,
+// which lack the header, are distinguished as being of version 0.
+var frameMagic = []byte("\x00bsframe")
+
+const (
+	// frameVersionGob is the version of streams in which columns of
+	// builtin types are encoded with gob, as are columns of other types
+	// without codecs.
+	frameVersionGob = 0
+	// frameVersionBinary is the version of streams in which columns of
+	// builtin types are encoded with the fixed-layout binary codecs of
+	// their frame ops.
+	frameVersionBinary = 1
+
+	// frameVersion is the version of the streams written by Encoders.
+	frameVersion = frameVersionBinary
+)
+
 // An Encoder manages transmission of slices through an underlying
 // io.Writer. The stream of slice values represented by batches of
 // rows stored in column-major order. Streams can be read by a
 // Decoder.
 type Encoder struct {
+	w   io.Writer
 	enc *gobEncoder
 	crc hash.Hash32
+	// versioned is true once the stream's version header is written.
+	versioned bool
+	// closer is the encoder's compressor, if any. See
+	// NewCompressingWriter.
+	closer io.Closer
 }
 
 // NewEncodingWriter returns a Writer that streams slices into the provided
@@ -75,14 +103,22 @@ type Encoder struct {
 func NewEncodingWriter(w io.Writer) *Encoder {
 	crc := crc32.NewIEEE()
 	return &Encoder{
+		w:   w,
 		enc: newGobEncoder(io.MultiWriter(w, crc)),
 		crc: crc,
 	}
 }
 
 // Encode encodes a batch of rows and writes the encoded output into
-// the encoder's writer.
+// the encoder's writer. The stream's version header is written with
+// the first batch.
 func (e *Encoder) Write(_ context.Context, f frame.Frame) error {
+	if !e.versioned {
+		if _, err := e.w.Write(append(append([]byte{}, frameMagic...), frameVersion)); err != nil {
+			return err
+		}
+		e.versioned = true
+	}
 	e.crc.Reset()
 	if err := e.enc.Encode(f.Len()); err != nil {
 		return err
@@ -114,6 +150,12 @@ func (e *Encoder) Write(_ context.Context, f frame.Frame) error {
 // DecodingReader provides a Reader on top of a gob stream
 // encoded with batches of rows stored in column-major order.
 type decodingReader struct {
+	r io.Reader
+	// version is the version of the stream's encoding.
+	version byte
+	// spill is true for readers of spill files (see NewSpillReader),
+	// which are decrypted with the process's ephemeral spill key.
+	spill   bool
 	dec     *gobDecoder
 	crc     hash.Hash32
 	scratch frame.Frame
@@ -124,7 +166,43 @@ type decodingReader struct {
 // NewDecodingReader returns a new Reader that decodes values from
 // the provided stream. Since values are streamed in vectors, decoding
 // reader must buffer values until they are read by the consumer.
+// Streams compressed by a registered codec (see NewCompressingWriter)
+// are decompressed; reads of streams compressed by an unregistered
+// codec fail with an error of kind errors.NotSupported. Encrypted
+// streams (see NewEncryptingWriter) are decrypted with the key provider
+// carried by the context of the first read. If the context carries a
+// key provider, streams that are not encrypted are rejected with an
+// error of kind errors.Integrity.
 func NewDecodingReader(r io.Reader) Reader {
+	return &decodingReader{r: r}
+}
+
+// init initializes the reader's decoder, decrypting and decompressing
+// its stream if needed.
+func (d *decodingReader) init(ctx context.Context) error {
+	br, ok := d.r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(d.r)
+	}
+	keys := ContextKeyProvider(ctx)
+	required := keys != nil
+	if d.spill {
+		var err error
+		if keys, err = spillKeys(); err != nil {
+			return err
+		}
+	}
+	br, err := decrypt(ctx, br, keys, required)
+	if err != nil {
+		return err
+	}
+	r, err := decompress(br)
+	if err != nil {
+		return err
+	}
+	if d.version, r, err = frameVersionOf(r); err != nil {
+		return err
+	}
 	// We need to compute checksums by inspecting the underlying
 	// bytestream, however, gob uses whether the reader implements
 	// io.ByteReader as a proxy for whether the passed reader is
@@ -133,18 +211,54 @@ func NewDecodingReader(r io.Reader) Reader {
 	// means of synchronizing stream positions, required for
 	// checksumming. Instead we fake an implementation of io.ByteReader,
 	// and take over the responsibility of ensuring that IO is buffered.
-	crc := crc32.NewIEEE()
+	d.crc = crc32.NewIEEE()
 	if _, ok := r.(io.ByteReader); !ok {
 		r = bufio.NewReader(r)
 	}
-	r = io.TeeReader(r, crc)
-	return &decodingReader{dec: newGobDecoder(readerByteReader{Reader: r}), crc: crc}
+	r = io.TeeReader(r, d.crc)
+	d.dec = newGobDecoder(readerByteReader{Reader: r})
+	return nil
+}
+
+// frameVersionOf reads the version header of the encoded stream read
+// by r, and returns the stream's version and a reader of the remainder
+// of the stream. Streams of version frameVersionGob are decoded as
+// other streams: the encoding of each column, with its codec or with
+// gob, is recorded in the stream.
+func frameVersionOf(r io.Reader) (byte, io.Reader, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	magic, err := br.Peek(len(frameMagic))
+	if err != nil || !bytes.Equal(magic, frameMagic) {
+		// The stream predates versioning, or is too short to be
+		// versioned. Any errors are left to the decoder.
+		return frameVersionGob, br, nil
+	}
+	if _, err = br.Discard(len(frameMagic)); err != nil {
+		return 0, nil, err
+	}
+	version, err := br.ReadByte()
+	if err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	if version > frameVersion {
+		return 0, nil, errors.E(errors.NotSupported,
+			fmt.Sprintf("sliceio: unsupported encoding version %d", version))
+	}
+	return version, br, nil
 }
 
 func (d *decodingReader) Read(ctx context.Context, f frame.Frame) (n int, err error) {
 	if d.err != nil {
 		return 0, d.err
 	}
+	if d.dec == nil {
+		if d.err = d.init(ctx); d.err != nil {
+			return 0, d.err
+		}
+	}
 	for d.buf.Len() == 0 {
 		d.crc.Reset()
 		if d.err = d.dec.Decode(&n); d.err != nil {
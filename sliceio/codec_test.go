@@ -211,6 +211,8 @@ func TestDecodingReaderCorrupted(t *testing.T) {
 			t.Errorf("invalid error %v", err)
 		case errors.Integrity:
 			nintegrity++
+		case errors.NotSupported:
+			// The stream's version was corrupted.
 		case errors.Other:
 			switch {
 			default:
@@ -372,12 +374,121 @@ func TestTypes(t *testing.T) {
 			B string
 		}{}, []*int{}},
 		{[]rune{}, []byte{}, [][]byte{}, []int16{}, []int8{}, []*[]string{}, []int64{}},
+		{[]uint{}, []uint8{}, []uint16{}, []uint32{}, []uint64{}, []uintptr{}},
+		{[]int{}, []int8{}, []int16{}, []int32{}, []int64{}},
+		{[]float32{}, []float64{}, []string{}, []bool{}},
 	}
 	for _, cols := range types {
 		testRoundTrip(t, cols...)
 	}
 }
 
+// Named types do not have registered codecs, and are thus encoded
+// with gob.
+type (
+	gobInt64   int64
+	gobFloat64 float64
+	gobString  string
+)
+
+// TestBinaryCodecCompat verifies that columns of builtin types that
+// were encoded with gob, as they were before the binary codec was
+// introduced, can still be decoded.
+func TestBinaryCodecCompat(t *testing.T) {
+	var (
+		ints    = []gobInt64{1, -2, 3}
+		floats  = []gobFloat64{0.5, -1.5, 2}
+		strs    = []gobString{"a", "", "ccc"}
+		b       bytes.Buffer
+		ctx     = context.Background()
+		enc     = NewEncodingWriter(&b)
+		gotInts []int64
+		gotFlts []float64
+		gotStrs []string
+	)
+	if err := enc.Write(ctx, frame.Slices(ints, floats, strs)); err != nil {
+		t.Fatal(err)
+	}
+	// Streams written before the encoding was versioned lack the
+	// version header.
+	header := append(append([]byte{}, frameMagic...), frameVersion)
+	if !bytes.HasPrefix(b.Bytes(), header) {
+		t.Fatal("stream is missing its version header")
+	}
+	legacy := bytes.NewReader(b.Bytes()[len(header):])
+	if err := ReadAll(ctx, NewDecodingReader(legacy), &gotInts, &gotFlts, &gotStrs); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := gotInts, []int64{1, -2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := gotFlts, []float64{0.5, -1.5, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := gotStrs, []string{"a", "", "ccc"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestUnsupportedVersion(t *testing.T) {
+	var (
+		b   bytes.Buffer
+		ctx = context.Background()
+		enc = NewEncodingWriter(&b)
+	)
+	if err := enc.Write(ctx, frame.Slices([]int{1, 2, 3})); err != nil {
+		t.Fatal(err)
+	}
+	p := b.Bytes()
+	p[len(frameMagic)] = frameVersion + 1
+	var ints []int
+	err := ReadAll(ctx, NewDecodingReader(bytes.NewReader(p)), &ints)
+	if !errors.Is(errors.NotSupported, err) {
+		t.Errorf("got %v, want NotSupported", err)
+	}
+}
+
+func benchmarkCodec(b *testing.B, col interface{}) {
+	const N = 1024
+	fz := fuzz.New()
+	fz.NilChance(0)
+	fz.NumElements(N, N)
+	ptr := reflect.New(reflect.TypeOf(col))
+	fz.Fuzz(ptr.Interface())
+	f := frame.Slices(reflect.Indirect(ptr).Interface())
+	var (
+		ctx = context.Background()
+		buf bytes.Buffer
+		enc = NewEncodingWriter(&buf)
+	)
+	for i := 0; i < b.N; i++ {
+		if err := enc.Write(ctx, f); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.SetBytes(int64(buf.Len() / b.N))
+	var (
+		dec = NewDecodingReader(&buf)
+		out = frame.Make(f, N, N)
+	)
+	for i := 0; i < b.N; i++ {
+		if _, err := dec.Read(ctx, out); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// The binary and gob benchmarks encode and decode frames of builtin
+// types, which use the binary codec, and of named types, which use
+// gob. The reported throughput is that of the encoded data.
+
+func BenchmarkCodecBinaryInt64(b *testing.B)   { benchmarkCodec(b, []int64{}) }
+func BenchmarkCodecGobInt64(b *testing.B)      { benchmarkCodec(b, []gobInt64{}) }
+func BenchmarkCodecBinaryFloat64(b *testing.B) { benchmarkCodec(b, []float64{}) }
+func BenchmarkCodecGobFloat64(b *testing.B)    { benchmarkCodec(b, []gobFloat64{}) }
+func BenchmarkCodecBinaryString(b *testing.B)  { benchmarkCodec(b, []string{}) }
+func BenchmarkCodecGobString(b *testing.B)     { benchmarkCodec(b, []gobString{}) }
+
 func TestSession(t *testing.T) {
 	s := make(session)
 	k1, k2 := frame.FreshKey(), frame.FreshKey()
@@ -0,0 +1,49 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package sliceio
+
+import "context"
+
+// A Committer is implemented by readers whose side effects (e.g., writes
+// to an external store) are staged for each task attempt, and made
+// visible only once the executor has confirmed that the attempt
+// succeeded. Because tasks may be retried, or run more than once when
+// machines are lost, a reader may be instantiated and read many times
+// for the same shard. Staging writes per attempt and committing them
+// only on success gives exactly-once visibility of the shard's side
+// effects.
+//
+// The executor calls Commit after the reader has been read to EOF and
+// the task's output has been stored. If the attempt fails for any
+// reason, including because Commit itself fails, Abort is called. Thus
+// Commit is called at most once, and Abort at most once, for each
+// attempt; Abort is called after Commit only if Commit fails, and so
+// must discard whatever a failed Commit leaves staged. Abort is never
+// called after a successful Commit, even if the attempt later fails
+// (e.g., because another committer in the same task fails). Because an executor may confirm more than
+// one successful attempt of the same task (e.g., when a machine is
+// presumed lost but in fact completed its work), Commit must be
+// idempotent with respect to the shard: committing a second,
+// equivalent attempt must replace, not duplicate, the first.
+type Committer interface {
+	// Commit makes the attempt's staged side effects visible.
+	Commit(ctx context.Context) error
+	// Abort discards the attempt's staged side effects.
+	Abort(ctx context.Context) error
+}
+
+// A Cleaner is implemented by readers that hold resources (e.g., open
+// files or database connections) that must be released once a task
+// attempt is complete, whether or not the reader was read to EOF. The
+// executor calls Cleanup exactly once for each task attempt in which
+// the reader was instantiated, after the attempt has succeeded, failed,
+// or been cancelled, and after any Commit or Abort (see Committer). The
+// context passed to Cleanup is not cancelled with the task, so that
+// resources may be released even when the task is cancelled. Errors
+// returned by Cleanup are logged, but do not fail the task.
+type Cleaner interface {
+	// Cleanup releases the reader's resources.
+	Cleanup(ctx context.Context) error
+}
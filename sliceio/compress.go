@@ -0,0 +1,177 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package sliceio
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/grailbio/base/errors"
+)
+
+// A Compressor returns a writer that compresses the data written to it
+// into w. Closing the returned writer must flush any buffered data to
+// w, but must not close w.
+type Compressor func(w io.Writer) (io.WriteCloser, error)
+
+// A Decompressor returns a reader that decompresses the data read from
+// r, as compressed by the Compressor of the same codec.
+type Decompressor func(r io.Reader) (io.ReadCloser, error)
+
+type codec struct {
+	compress   Compressor
+	decompress Decompressor
+}
+
+var (
+	codecsMu sync.Mutex
+	codecs   = make(map[string]codec)
+)
+
+// RegisterCodec registers a compression codec with the provided name.
+// Registered codecs may be used to compress encoded streams (see
+// NewCompressingWriter); the codec's name is recorded at the beginning
+// of each compressed stream, so that decoding readers (see
+// NewDecodingReader) select the matching decompressor. Codecs must be
+// registered by every process that reads or writes streams compressed
+// with them, typically in an init function. The codec "gzip" is
+// registered by default. RegisterCodec panics if name is empty or
+// longer than 255 bytes, or if a codec with the same name is already
+// registered.
+func RegisterCodec(name string, compress Compressor, decompress Decompressor) {
+	if name == "" || len(name) > 255 {
+		panic(fmt.Sprintf("sliceio.RegisterCodec: invalid codec name %q", name))
+	}
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if _, ok := codecs[name]; ok {
+		panic(fmt.Sprintf("sliceio.RegisterCodec: codec %q already registered", name))
+	}
+	codecs[name] = codec{compress, decompress}
+}
+
+// CodecRegistered tells whether a codec with the provided name is
+// registered.
+func CodecRegistered(name string) bool {
+	_, ok := lookupCodec(name)
+	return ok
+}
+
+func lookupCodec(name string) (codec, bool) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	c, ok := codecs[name]
+	return c, ok
+}
+
+func init() {
+	RegisterCodec("gzip",
+		func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+		func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) })
+}
+
+// codecMagic begins every compressed stream; it is followed by the
+// length of the codec's name, as a single byte, and the name itself.
+// Since gob never begins a stream with a zero byte, compressed streams
+// are distinguished from uncompressed ones.
+var codecMagic = []byte("\x00bscodec")
+
+// NewCompressingWriter returns an Encoder that streams slices into the
+// provided writer, compressed by the registered codec with the
+// provided name. If name is empty, the stream is not compressed, and
+// the returned Encoder is equivalent to that returned by
+// NewEncodingWriter. The caller must Close the returned encoder to
+// flush the compressed stream; closing does not close w.
+func NewCompressingWriter(w io.Writer, name string) (*Encoder, error) {
+	if name == "" {
+		return NewEncodingWriter(w), nil
+	}
+	c, ok := lookupCodec(name)
+	if !ok {
+		return nil, errors.E(errors.NotSupported, fmt.Sprintf("sliceio: unregistered codec %q", name))
+	}
+	header := append(append(append([]byte{}, codecMagic...), byte(len(name))), name...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	cw, err := c.compress(w)
+	if err != nil {
+		return nil, err
+	}
+	enc := NewEncodingWriter(cw)
+	enc.closer = cw
+	return enc, nil
+}
+
+// Close flushes and closes the encoder's compressor, if any. It does
+// not close the underlying writer.
+func (e *Encoder) Close() error {
+	if e.closer == nil {
+		return nil
+	}
+	err := e.closer.Close()
+	e.closer = nil
+	return err
+}
+
+// decompress returns a reader of the decompressed stream read from r,
+// if it was compressed by a registered codec, or else a reader of the
+// (uncompressed) stream itself.
+func decompress(r *bufio.Reader) (io.Reader, error) {
+	magic, err := r.Peek(len(codecMagic))
+	if err != nil || !bytes.Equal(magic, codecMagic) {
+		// The stream is uncompressed, or too short to be compressed. Any
+		// errors are left to the decoder.
+		return r, nil
+	}
+	if _, err = r.Discard(len(codecMagic)); err != nil {
+		return nil, err
+	}
+	n, err := r.ReadByte()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	name := make([]byte, n)
+	if _, err = io.ReadFull(r, name); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	c, ok := lookupCodec(string(name))
+	if !ok {
+		return nil, errors.E(errors.Fatal, errors.NotSupported,
+			fmt.Sprintf("sliceio: data compressed with unregistered codec %q", name))
+	}
+	return c.decompress(r)
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+type codecContextKeyType struct{}
+
+var codecContextKey codecContextKeyType
+
+// CodecContext returns a context that carries the name of the codec
+// with which data stored by tasks, such as checkpoints, should be
+// compressed. It is used by executors to propagate the session's codec
+// to the tasks that they run.
+func CodecContext(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, codecContextKey, name)
+}
+
+// ContextCodec returns the name of the codec carried by the provided
+// context (see CodecContext), or an empty string if there is none.
+func ContextCodec(ctx context.Context) string {
+	name, _ := ctx.Value(codecContextKey).(string)
+	return name
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package sliceio
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigslice/frame"
+)
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func init() {
+	// "test-identity" is registered, and "test-unregistered" is used
+	// only to write data that cannot be read.
+	RegisterCodec("test-identity",
+		func(w io.Writer) (io.WriteCloser, error) { return nopWriteCloser{w}, nil },
+		func(r io.Reader) (io.ReadCloser, error) { return ioutil.NopCloser(r), nil })
+}
+
+func TestCompressingWriter(t *testing.T) {
+	const N = 1000
+	var (
+		ctx  = context.Background()
+		ints = make([]int, N)
+		strs = make([]string, N)
+	)
+	for i := range ints {
+		ints[i] = i
+		strs[i] = "a repetitive, compressible string"
+	}
+	in := frame.Slices(ints, strs)
+	var uncompressed int
+	for _, codec := range []string{"", "gzip", "test-identity"} {
+		var b bytes.Buffer
+		enc, err := NewCompressingWriter(&b, codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := enc.Write(ctx, in); err != nil {
+			t.Fatal(err)
+		}
+		if err := enc.Close(); err != nil {
+			t.Fatal(err)
+		}
+		switch codec {
+		case "":
+			uncompressed = b.Len()
+		case "gzip":
+			if b.Len() >= uncompressed {
+				t.Errorf("gzip: got %d bytes, uncompressed %d", b.Len(), uncompressed)
+			}
+		}
+		out := frame.Make(in, N, N)
+		n, err := ReadFull(ctx, NewDecodingReader(&b), out)
+		if err != nil && err != EOF {
+			t.Fatalf("%s: %v", codec, err)
+		}
+		if got, want := n, N; got != want {
+			t.Fatalf("%s: got %v, want %v", codec, got, want)
+		}
+		for col := 0; col < in.NumOut(); col++ {
+			if !reflect.DeepEqual(in.Interface(col), out.Interface(col)) {
+				t.Errorf("%s: column %d mismatch", codec, col)
+			}
+		}
+	}
+}
+
+func TestUnregisteredCodec(t *testing.T) {
+	if _, err := NewCompressingWriter(ioutil.Discard, "test-unregistered"); !errors.Is(errors.NotSupported, err) {
+		t.Errorf("expected NotSupported error, got %v", err)
+	}
+	// Forge a stream compressed by an unregistered codec.
+	var b bytes.Buffer
+	b.Write(codecMagic)
+	b.WriteByte(byte(len("test-unregistered")))
+	b.WriteString("test-unregistered")
+	b.WriteString("garbage")
+	f := frame.Make(frame.Slices([]int{}), 10, 10)
+	_, err := NewDecodingReader(&b).Read(context.Background(), f)
+	if !errors.Is(errors.NotSupported, err) {
+		t.Errorf("expected NotSupported error, got %v", err)
+	}
+}
+
+func TestCodecContext(t *testing.T) {
+	ctx := context.Background()
+	if got, want := ContextCodec(ctx), ""; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := ContextCodec(CodecContext(ctx, "gzip")), "gzip"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
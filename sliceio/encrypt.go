@@ -0,0 +1,397 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package sliceio
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+
+	"github.com/grailbio/base/errors"
+)
+
+func init() {
+	gob.Register(StaticKeys{})
+}
+
+// A KeyProvider provides the keys with which encrypted streams are
+// sealed and opened (see NewEncryptingWriter). Keys are identified by
+// IDs, which are recorded with the data that they encrypt, so that
+// keys may be rotated: new data are encrypted with the current key,
+// while data encrypted with previous keys remain readable for as long
+// as the provider returns them. Keys must be 16, 24, or 32 bytes long,
+// selecting AES-128, AES-192, or AES-256. Providers are consulted once
+// for each stream that is read or written, and so should cache keys
+// that are expensive to retrieve.
+type KeyProvider interface {
+	// CurrentKey returns the ID of the key with which new data are
+	// encrypted, and the key itself.
+	CurrentKey(ctx context.Context) (id string, key []byte, err error)
+	// Key returns the key with the provided ID. It should return an
+	// error of kind errors.NotExist if there is no such key.
+	Key(ctx context.Context, id string) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider of a fixed set of keys. StaticKeys is
+// registered with gob, so that it may be shipped to the machines of
+// a session. The keys are thus transmitted with the session's other
+// configuration; providers that retrieve keys from a key management
+// service should be used where this is undesirable.
+type StaticKeys struct {
+	// Current is the ID of the current key.
+	Current string
+	// Keys is the set of keys, indexed by ID.
+	Keys map[string][]byte
+}
+
+// CurrentKey implements KeyProvider.
+func (s StaticKeys) CurrentKey(ctx context.Context) (string, []byte, error) {
+	key, err := s.Key(ctx, s.Current)
+	return s.Current, key, err
+}
+
+// Key implements KeyProvider.
+func (s StaticKeys) Key(_ context.Context, id string) ([]byte, error) {
+	key, ok := s.Keys[id]
+	if !ok {
+		return nil, errors.E(errors.NotExist, fmt.Sprintf("sliceio: key %q", id))
+	}
+	return key, nil
+}
+
+// cryptMagic begins every encrypted stream; it is followed by the
+// length of the ID of the stream's key, as a single byte, the ID
+// itself, and the stream's nonce. Since gob never begins a stream
+// with a zero byte, encrypted streams are distinguished from
+// unencrypted ones, and from compressed ones (see codecMagic).
+var cryptMagic = []byte("\x00bscrypt")
+
+const (
+	// cryptRecordSize is the maximum number of plaintext bytes sealed in
+	// each record of an encrypted stream.
+	cryptRecordSize = 64 << 10
+	// cryptNonceSize is the size of the nonces of encrypted streams,
+	// as required by AES-GCM.
+	cryptNonceSize = 12
+	// cryptLastRecord is set in the length prefix of the last record of
+	// an encrypted stream.
+	cryptLastRecord = 1 << 31
+)
+
+// NewEncryptingWriter returns an Encoder that streams slices into the
+// provided writer, compressed by the registered codec with the
+// provided name (see NewCompressingWriter), and then encrypted by the
+// current key of the provided key provider. If keys is nil, the stream
+// is not encrypted, and the returned Encoder is equivalent to that
+// returned by NewCompressingWriter. The caller must Close the returned
+// encoder to flush the encrypted stream; closing does not close w.
+//
+// Encrypted streams are sealed with AES-GCM in records of up to 64KiB,
+// each authenticated with the stream's header (which records the ID
+// of its key) and its position in the stream, so that decoding readers
+// (see NewDecodingReader) detect data that are modified, reordered, or
+// truncated. Decoding readers open encrypted streams with the key
+// provider carried by their contexts (see KeyProviderContext).
+func NewEncryptingWriter(ctx context.Context, w io.Writer, codec string, keys KeyProvider) (*Encoder, error) {
+	if keys == nil {
+		return NewCompressingWriter(w, codec)
+	}
+	id, key, err := keys.CurrentKey(ctx)
+	if err != nil {
+		return nil, errors.E("sliceio: current encryption key", err)
+	}
+	if id == "" || len(id) > 255 {
+		return nil, errors.E(errors.Invalid, fmt.Sprintf("sliceio: invalid key ID %q", id))
+	}
+	aead, err := newAEAD(id, key)
+	if err != nil {
+		return nil, err
+	}
+	header := append(append(append([]byte{}, cryptMagic...), byte(len(id))), id...)
+	nonce := make([]byte, cryptNonceSize)
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header = append(header, nonce...)
+	if _, err = w.Write(header); err != nil {
+		return nil, err
+	}
+	ew := &encryptingWriter{
+		w:      w,
+		aead:   aead,
+		header: header,
+		nonce:  nonce,
+		buf:    make([]byte, 0, cryptRecordSize),
+	}
+	enc, err := NewCompressingWriter(ew, codec)
+	if err != nil {
+		return nil, err
+	}
+	if enc.closer == nil {
+		enc.closer = ew
+	} else {
+		enc.closer = chainCloser{enc.closer, ew}
+	}
+	return enc, nil
+}
+
+// chainCloser closes each of its closers, in order, returning the first
+// error.
+type chainCloser []io.Closer
+
+func (c chainCloser) Close() error {
+	var err error
+	for _, closer := range c {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func newAEAD(id string, key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.E(errors.Invalid, fmt.Sprintf("sliceio: key %q", id), err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// recordNonce returns the nonce of the record with the provided index,
+// derived from the stream's nonce.
+func recordNonce(dst, nonce []byte, index uint64) []byte {
+	dst = append(dst[:0], nonce...)
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], index)
+	for i := range counter {
+		dst[cryptNonceSize-8+i] ^= counter[i]
+	}
+	return dst
+}
+
+// recordData returns the additional data with which records are
+// authenticated: the stream's header, followed by a byte that
+// indicates whether the record is the stream's last.
+func recordData(dst, header []byte, last bool) []byte {
+	dst = append(dst[:0], header...)
+	if last {
+		return append(dst, 1)
+	}
+	return append(dst, 0)
+}
+
+// encryptingWriter seals the data written to it in records, which are
+// written to w, each prefixed by its length. The stream is terminated
+// by a last record, possibly empty, which is written when the writer
+// is closed, and whose length prefix is marked by cryptLastRecord.
+type encryptingWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	nonce  []byte
+	buf    []byte
+	index  uint64
+	closed bool
+
+	scratch, recordNonce, recordData []byte
+}
+
+func (e *encryptingWriter) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, errors.E(errors.Invalid, "sliceio: write to closed encrypted stream")
+	}
+	n := len(p)
+	for len(p) > 0 {
+		m := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+m]
+		p = p[m:]
+		if len(e.buf) == cap(e.buf) {
+			if err := e.seal(false); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close writes the stream's last record. It does not close the
+// underlying writer.
+func (e *encryptingWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.seal(true)
+}
+
+func (e *encryptingWriter) seal(last bool) error {
+	e.recordNonce = recordNonce(e.recordNonce, e.nonce, e.index)
+	e.recordData = recordData(e.recordData, e.header, last)
+	e.index++
+	e.scratch = append(e.scratch[:0], 0, 0, 0, 0)
+	e.scratch = e.aead.Seal(e.scratch, e.recordNonce, e.buf, e.recordData)
+	size := uint32(len(e.scratch) - 4)
+	if last {
+		size |= cryptLastRecord
+	}
+	binary.BigEndian.PutUint32(e.scratch, size)
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(e.scratch)
+	return err
+}
+
+// decryptingReader opens the records of an encrypted stream, written
+// by an encryptingWriter.
+type decryptingReader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	header []byte
+	nonce  []byte
+	index  uint64
+	// buf holds the opened, but not yet read, data of the current
+	// record.
+	buf  []byte
+	last bool
+	err  error
+
+	sealed, recordNonce, recordData []byte
+}
+
+// decrypt returns a reader of the decrypted stream read from r, if it
+// was encrypted, or else r itself. Encrypted streams are opened with the
+// provided keys. If required is true, streams that are not encrypted
+// (including empty streams, which may be truncated encrypted streams)
+// are rejected with an error of kind errors.Integrity, so that data
+// cannot be substituted by an unauthenticated stream.
+func decrypt(ctx context.Context, r *bufio.Reader, keys KeyProvider, required bool) (*bufio.Reader, error) {
+	magic, err := r.Peek(len(cryptMagic))
+	if err != nil || !bytes.Equal(magic, cryptMagic) {
+		if required {
+			return nil, errors.E(errors.Fatal, errors.Integrity,
+				"sliceio: stream is not encrypted, but a key provider is configured")
+		}
+		// The stream is not encrypted, or too short to be encrypted. Any
+		// errors are left to the decoder.
+		return r, nil
+	}
+	if _, err = r.Discard(len(cryptMagic)); err != nil {
+		return nil, err
+	}
+	n, err := r.ReadByte()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	header := append(append([]byte{}, cryptMagic...), n)
+	idAndNonce := make([]byte, int(n)+cryptNonceSize)
+	if _, err = io.ReadFull(r, idAndNonce); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	header = append(header, idAndNonce...)
+	id := string(idAndNonce[:n])
+	if keys == nil {
+		return nil, errors.E(errors.Fatal, errors.NotSupported,
+			fmt.Sprintf("sliceio: data encrypted with key %q, but no key provider is available", id))
+	}
+	key, err := keys.Key(ctx, id)
+	if err != nil {
+		return nil, errors.E(errors.Fatal, fmt.Sprintf("sliceio: encryption key %q", id), err)
+	}
+	aead, err := newAEAD(id, key)
+	if err != nil {
+		return nil, errors.E(errors.Fatal, err)
+	}
+	return bufio.NewReader(&decryptingReader{
+		r:      r,
+		aead:   aead,
+		header: header,
+		nonce:  idAndNonce[n:],
+	}), nil
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.err = d.open(); d.err != nil && d.err != io.EOF {
+			return 0, d.err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// open opens the stream's next record. It returns io.EOF once the
+// stream's last record has been read, and an error if the stream is
+// truncated or extended.
+func (d *decryptingReader) open() error {
+	var size [4]byte
+	if _, err := io.ReadFull(d.r, size[:]); err != nil {
+		if err == io.EOF {
+			if d.last {
+				return io.EOF
+			}
+			err = io.ErrUnexpectedEOF
+		}
+		return errors.E(errors.Integrity, "sliceio: encrypted stream is truncated", err)
+	}
+	if d.last {
+		return errors.E(errors.Fatal, errors.Integrity, "sliceio: encrypted stream has data after its last record")
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	d.last = n&cryptLastRecord != 0
+	n &^= cryptLastRecord
+	if int(n) > cryptRecordSize+d.aead.Overhead() {
+		return errors.E(errors.Fatal, errors.Integrity, fmt.Sprintf("sliceio: encrypted record of %d bytes exceeds maximum", n))
+	}
+	if cap(d.sealed) < int(n) {
+		d.sealed = make([]byte, n)
+	}
+	d.sealed = d.sealed[:n]
+	if _, err := io.ReadFull(d.r, d.sealed); err != nil {
+		return errors.E(errors.Integrity, "sliceio: encrypted stream is truncated", unexpectedEOF(err))
+	}
+	// The record's position is authenticated by its nonce, and whether
+	// it is the last record by its additional data, so that records
+	// cannot be reordered, and the stream cannot be truncated at a
+	// record boundary.
+	d.recordNonce = recordNonce(d.recordNonce, d.nonce, d.index)
+	d.recordData = recordData(d.recordData, d.header, d.last)
+	d.index++
+	plain, err := d.aead.Open(d.sealed[:0], d.recordNonce, d.sealed, d.recordData)
+	if err != nil {
+		return errors.E(errors.Fatal, errors.Integrity, "sliceio: encrypted data failed authentication")
+	}
+	d.buf = plain
+	return nil
+}
+
+type keyProviderContextKeyType struct{}
+
+var keyProviderContextKey keyProviderContextKeyType
+
+// KeyProviderContext returns a context that carries the key provider
+// with which encrypted streams are read, and with which data stored by
+// tasks, such as checkpoints, should be encrypted. It is used by
+// executors to propagate the session's key provider to the tasks that
+// they run.
+func KeyProviderContext(ctx context.Context, keys KeyProvider) context.Context {
+	return context.WithValue(ctx, keyProviderContextKey, keys)
+}
+
+// ContextKeyProvider returns the key provider carried by the provided
+// context (see KeyProviderContext), or nil if there is none.
+func ContextKeyProvider(ctx context.Context) KeyProvider {
+	keys, _ := ctx.Value(keyProviderContextKey).(KeyProvider)
+	return keys
+}
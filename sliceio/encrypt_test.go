@@ -0,0 +1,236 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package sliceio
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigslice/frame"
+)
+
+var testKeys = StaticKeys{
+	Current: "k1",
+	Keys: map[string][]byte{
+		"k1": bytes.Repeat([]byte{1}, 32),
+		"k2": bytes.Repeat([]byte{2}, 16),
+	},
+}
+
+// encryptFrame encodes the provided frame into a stream compressed by
+// the provided codec and encrypted with the provided keys.
+func encryptFrame(t *testing.T, f frame.Frame, codec string, keys KeyProvider) []byte {
+	t.Helper()
+	ctx := context.Background()
+	var b bytes.Buffer
+	enc, err := NewEncryptingWriter(ctx, &b, codec, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Write(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// decryptFrame decodes a frame of the same type as f from the
+// provided stream, using the provided keys. The stream is read until
+// it is exhausted.
+func decryptFrame(keys KeyProvider, f frame.Frame, p []byte) (frame.Frame, error) {
+	ctx := context.Background()
+	if keys != nil {
+		ctx = KeyProviderContext(ctx, keys)
+	}
+	out := frame.Make(f, f.Len()+1, f.Len()+1)
+	n, err := ReadFull(ctx, NewDecodingReader(bytes.NewReader(p)), out)
+	if err == EOF {
+		err = nil
+	}
+	return out.Slice(0, n), err
+}
+
+func testFrame(n int) frame.Frame {
+	var (
+		ints = make([]int, n)
+		strs = make([]string, n)
+	)
+	for i := range ints {
+		ints[i] = i
+		strs[i] = "a repetitive, compressible string"
+	}
+	return frame.Slices(ints, strs)
+}
+
+func TestEncryptingWriter(t *testing.T) {
+	// The frame spans several records.
+	in := testFrame(10000)
+	var plain []byte
+	for _, codec := range []string{"", "gzip"} {
+		p := encryptFrame(t, in, codec, testKeys)
+		if !bytes.HasPrefix(p, append(append(cryptMagic, 2), "k1"...)) {
+			t.Errorf("%s: stream does not record its key", codec)
+		}
+		if codec == "" {
+			plain = encryptFrame(t, in, "", nil)
+			if bytes.Contains(p, []byte("repetitive")) {
+				t.Errorf("%s: stream is not encrypted", codec)
+			}
+			if len(p) <= len(plain) {
+				t.Errorf("%s: got %d bytes, unencrypted %d", codec, len(p), len(plain))
+			}
+		}
+		out, err := decryptFrame(testKeys, in, p)
+		if err != nil {
+			t.Fatalf("%s: %v", codec, err)
+		}
+		if got, want := out.Len(), in.Len(); got != want {
+			t.Fatalf("%s: got %v, want %v", codec, got, want)
+		}
+		for col := 0; col < in.NumOut(); col++ {
+			if !reflect.DeepEqual(in.Interface(col), out.Interface(col)) {
+				t.Errorf("%s: column %d mismatch", codec, col)
+			}
+		}
+	}
+	// Unencrypted streams are read in the absence of a key provider; see
+	// TestEncryptionTamper for their rejection otherwise.
+	if out, err := decryptFrame(nil, in, plain); err != nil || out.Len() != in.Len() {
+		t.Errorf("got %v, %v", out.Len(), err)
+	}
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	in := testFrame(10)
+	old := encryptFrame(t, in, "", testKeys)
+	rotated := testKeys
+	rotated.Current = "k2"
+	p := encryptFrame(t, in, "", rotated)
+	if !bytes.HasPrefix(p, append(append(cryptMagic, 2), "k2"...)) {
+		t.Error("stream not encrypted with the current key")
+	}
+	for _, p := range [][]byte{old, p} {
+		if out, err := decryptFrame(rotated, in, p); err != nil || out.Len() != in.Len() {
+			t.Errorf("got %v, %v", out.Len(), err)
+		}
+	}
+	// Once the old key is retired, its data can no longer be read.
+	retired := StaticKeys{Current: "k2", Keys: map[string][]byte{"k2": testKeys.Keys["k2"]}}
+	if _, err := decryptFrame(retired, in, old); !errors.Is(errors.NotExist, err) {
+		t.Errorf("expected NotExist error, got %v", err)
+	}
+	if _, err := decryptFrame(nil, in, old); !errors.Is(errors.NotSupported, err) {
+		t.Errorf("expected NotSupported error, got %v", err)
+	}
+}
+
+func TestEncryptionTamper(t *testing.T) {
+	in := testFrame(10000)
+	p := encryptFrame(t, in, "gzip", testKeys)
+	header := len(cryptMagic) + 1 + len("k1") + cryptNonceSize
+	for _, test := range []struct {
+		name   string
+		tamper func(p []byte) []byte
+	}{
+		{"data", func(p []byte) []byte {
+			p[len(p)/2] ^= 1
+			return p
+		}},
+		{"nonce", func(p []byte) []byte {
+			p[header-1] ^= 1
+			return p
+		}},
+		{"key", func(p []byte) []byte {
+			// Substitute a key with the same ID length.
+			copy(p[len(cryptMagic)+1:], "k2")
+			return p
+		}},
+		{"truncate", func(p []byte) []byte { return p[:len(p)-100] }},
+		{"truncate record", func(p []byte) []byte {
+			// Remove the last record.
+			return p[:len(p)-4-16]
+		}},
+		{"extend", func(p []byte) []byte { return append(p, p[header:]...) }},
+		{"plaintext", func([]byte) []byte { return encryptFrame(t, in, "", nil) }},
+		{"compressed plaintext", func([]byte) []byte { return encryptFrame(t, in, "gzip", nil) }},
+		{"empty", func([]byte) []byte { return nil }},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := decryptFrame(testKeys, in, test.tamper(append([]byte{}, p...)))
+			if !errors.Is(errors.Integrity, err) {
+				t.Errorf("expected Integrity error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestEncryptingWriterErrors(t *testing.T) {
+	ctx := context.Background()
+	for _, keys := range []StaticKeys{
+		{Current: "missing", Keys: testKeys.Keys},
+		{Current: "short", Keys: map[string][]byte{"short": []byte("short")}},
+		{Current: "", Keys: map[string][]byte{"": testKeys.Keys["k1"]}},
+	} {
+		if _, err := NewEncryptingWriter(ctx, ioutil.Discard, "", keys); err == nil {
+			t.Errorf("%s: expected error", keys.Current)
+		}
+	}
+}
+
+func TestKeyProviderContext(t *testing.T) {
+	ctx := context.Background()
+	if got := ContextKeyProvider(ctx); got != nil {
+		t.Errorf("got %v, want nil", got)
+	}
+	if got, want := ContextKeyProvider(KeyProviderContext(ctx, testKeys)), KeyProvider(testKeys); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func benchmarkEncryption(b *testing.B, codec string, keys KeyProvider) {
+	var (
+		ctx = KeyProviderContext(context.Background(), testKeys)
+		f   = testFrame(1024)
+		buf bytes.Buffer
+	)
+	enc, err := NewEncryptingWriter(ctx, &buf, codec, keys)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < b.N; i++ {
+		if err := enc.Write(ctx, f); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := enc.Close(); err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(buf.Len() / b.N))
+	var (
+		dec = NewDecodingReader(&buf)
+		out = frame.Make(f, f.Len(), f.Len())
+	)
+	for i := 0; i < b.N; i++ {
+		if _, err := ReadFull(ctx, dec, out); err != nil && err != EOF {
+			b.Fatal(err)
+		}
+	}
+}
+
+// The encryption benchmarks encode and decode frames in streams that
+// are encrypted, compressed, both, or neither, so that the overhead of
+// encryption may be weighed. The reported throughput is that of the
+// stored data.
+
+func BenchmarkEncryptionNone(b *testing.B)    { benchmarkEncryption(b, "", nil) }
+func BenchmarkEncryptionAES(b *testing.B)     { benchmarkEncryption(b, "", testKeys) }
+func BenchmarkEncryptionGzip(b *testing.B)    { benchmarkEncryption(b, "gzip", nil) }
+func BenchmarkEncryptionGzipAES(b *testing.B) { benchmarkEncryption(b, "gzip", testKeys) }
@@ -6,12 +6,14 @@ package sliceio
 
 import (
 	"context"
+	cryptorand "crypto/rand"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/grailbio/base/backgroundcontext"
 	"github.com/grailbio/base/file"
@@ -23,6 +25,57 @@ import (
 // SpillBatchSize then trades off memory footprint for encoding size.
 var SpillBatchSize = defaultChunksize
 
+var (
+	spillKeysOnce     sync.Once
+	spillKeysProvider KeyProvider
+	spillKeysErr      error
+)
+
+// spillKeys returns the key provider with which spill files are
+// encrypted. Its single key is generated randomly for each process,
+// and is never stored: spill files are read only by the process that
+// wrote them.
+func spillKeys() (KeyProvider, error) {
+	spillKeysOnce.Do(func() {
+		key := make([]byte, 32)
+		if _, spillKeysErr = cryptorand.Read(key); spillKeysErr != nil {
+			return
+		}
+		spillKeysProvider = StaticKeys{
+			Current: "spill",
+			Keys:    map[string][]byte{"spill": key},
+		}
+	})
+	return spillKeysProvider, spillKeysErr
+}
+
+// NewSpillWriter returns an Encoder that streams slices into the
+// provided writer, which stores data that are read back by the same
+// process, such as spill files. If ctx carries a key provider (see
+// KeyProviderContext), the stream is encrypted with a key that is
+// generated for the process, so that data are not stored unencrypted
+// when encryption is configured. The caller must Close the returned
+// encoder to flush the stream. Streams written by NewSpillWriter must
+// be read by NewSpillReader.
+func NewSpillWriter(ctx context.Context, w io.Writer) (*Encoder, error) {
+	if ContextKeyProvider(ctx) == nil {
+		return NewEncodingWriter(w), nil
+	}
+	keys, err := spillKeys()
+	if err != nil {
+		return nil, err
+	}
+	return NewEncryptingWriter(ctx, w, "", keys)
+}
+
+// NewSpillReader returns a Reader that decodes values from the
+// provided stream, written by NewSpillWriter. As with
+// NewDecodingReader, streams that are not encrypted are rejected if
+// the context of the first read carries a key provider.
+func NewSpillReader(r io.Reader) Reader {
+	return &decodingReader{r: r, spill: true}
+}
+
 // A Spiller manages a set of spill files.
 type Spiller string
 
@@ -39,8 +92,10 @@ func NewSpiller(name string) (Spiller, error) {
 
 // Spill spills the provided frame to a new file in the spiller.
 // Spill returns the file's encoded size, or an error. The frame
-// is encoded in batches of SpillBatchSize.
-func (dir Spiller) Spill(frame frame.Frame) (int, error) {
+// is encoded in batches of SpillBatchSize. The file is encrypted
+// if ctx carries a key provider (see NewSpillWriter), in which case
+// the spiller's readers must be read with such a context.
+func (dir Spiller) Spill(ctx context.Context, frame frame.Frame) (int, error) {
 	// Generate a random path and divide it into a hierarchy
 	// of paths so that any particular directory does not get
 	// too big. We'll use 3 levels of hierarchy with a fanout
@@ -55,18 +110,25 @@ func (dir Spiller) Spill(frame frame.Frame) (int, error) {
 		return 0, err
 	}
 	// TODO(marius): buffer?
-	enc := NewEncodingWriter(f)
+	enc, err := NewSpillWriter(ctx, f)
+	if err != nil {
+		_ = f.Close()
+		return 0, err
+	}
 	for frame.Len() > 0 {
 		n := SpillBatchSize
 		m := frame.Len()
 		if m < n {
 			n = m
 		}
-		if writeErr := enc.Write(context.Background(), frame.Slice(0, n)); writeErr != nil {
+		if writeErr := enc.Write(ctx, frame.Slice(0, n)); writeErr != nil {
 			return 0, writeErr
 		}
 		frame = frame.Slice(n, m)
 	}
+	if err := enc.Close(); err != nil {
+		return 0, err
+	}
 	size, err := f.Seek(0, io.SeekCurrent)
 	if err != nil {
 		return 0, err
@@ -100,7 +162,7 @@ func (dir Spiller) Readers() ([]ReadCloser, error) {
 			}
 			return nil, err
 		}
-		readers[i] = ReaderWithCloseFunc{NewDecodingReader(f), f.Close}
+		readers[i] = ReaderWithCloseFunc{NewSpillReader(f), f.Close}
 	}
 	return readers, nil
 }
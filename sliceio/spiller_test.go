@@ -5,7 +5,12 @@
 package sliceio
 
 import (
+	"bytes"
 	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 
 	fuzz "github.com/google/gofuzz"
@@ -27,10 +32,10 @@ func TestSpiller(t *testing.T) {
 			t.Fatal(err)
 		}
 	}()
-	if _, err = spill.Spill(f1); err != nil {
+	if _, err = spill.Spill(context.Background(), f1); err != nil {
 		t.Fatal(err)
 	}
-	if _, err = spill.Spill(f1); err != nil {
+	if _, err = spill.Spill(context.Background(), f1); err != nil {
 		t.Fatal(err)
 	}
 
@@ -68,3 +73,60 @@ func TestSpiller(t *testing.T) {
 	}
 
 }
+
+func TestSpillerEncryption(t *testing.T) {
+	const n = 100
+	var (
+		fz  = fuzz.NewWithSeed(123)
+		f   = fuzzFrame(fz, n, typeOfString, typeOfInt)
+		ctx = KeyProviderContext(context.Background(), testKeys)
+	)
+	spill, err := NewSpiller("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err = spill.Cleanup(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if _, err = spill.Spill(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	err = filepath.Walk(string(spill), func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			paths = append(paths, path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(paths), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	p, err := ioutil.ReadFile(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(p, cryptMagic) {
+		t.Error("spill file is not encrypted")
+	}
+	readers, err := spill.Readers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readers[0].Close()
+	out := frame.Make(f, n+1, n+1)
+	m, err := ReadFull(ctx, readers[0], out)
+	if err != EOF {
+		t.Fatal(err)
+	}
+	if got, want := m, n; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := out.Slice(0, m).Interfaces(), f.Interfaces(); !reflect.DeepEqual(got, want) {
+		t.Error("spilled frame was not read back")
+	}
+}
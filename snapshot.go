@@ -0,0 +1,76 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import "context"
+
+// A SnapshotSlice is a source slice whose underlying data may change
+// over time (e.g., a database table, or a prefix of an object store to
+// which objects are added), and which can read a consistent,
+// point-in-time snapshot of that data. Snapshots make invocations
+// reproducible: every task of an invocation reads the same snapshot,
+// even if the data changes while the invocation runs, and the snapshot
+// of one invocation may be reused by another (see exec.Snapshot and
+// exec.AtSnapshots).
+//
+// A snapshot is identified by a token, such as a timestamp, a version,
+// or an explicit manifest of the objects that make up the data. Tokens
+// are captured once, by the driver, when an invocation is compiled, and
+// are shipped with the invocation to the workers that compile it.
+// Tokens must therefore be encodable by encoding/gob; types other than
+// gob's basic types must be registered with gob.Register.
+type SnapshotSlice interface {
+	Slice
+	// Snapshot captures the current state of the slice's data,
+	// returning a token that identifies it. Snapshot returns an error
+	// if the slice cannot provide a stable snapshot of its data.
+	Snapshot(ctx context.Context) (token interface{}, err error)
+	// SetSnapshot configures the slice to read its data as of the
+	// snapshot identified by the provided token, as returned by
+	// Snapshot. It is called before the slice is compiled, both by the
+	// driver and by workers, and so must not perform I/O.
+	SetSnapshot(token interface{}) error
+}
+
+// An IncrementalSlice is a snapshot slice of an append-only source
+// (e.g., a prefix of an object store to which objects are only added),
+// which can read just the data that was added after a previous
+// snapshot. Incremental slices are used by exec.Session.RunIncremental
+// to process only the data added since the last run of a computation.
+type IncrementalSlice interface {
+	SnapshotSlice
+	// SetSince configures the slice to read only the data of its
+	// snapshot that was added after the snapshot identified by the
+	// provided token, as returned by Snapshot. It is called after
+	// SetSnapshot, both by the driver and by workers, and so must not
+	// perform I/O. SetSince returns an error if the data of the earlier
+	// snapshot have since changed, as the source is then not
+	// append-only.
+	SetSince(token interface{}) error
+}
+
+// A ManifestSlice is a source slice whose shards are determined by a
+// manifest of its data, such as a listing of the objects that it
+// reads, which is computed by the driver. The driver computes the
+// manifest once for each invocation, before the invocation is
+// compiled, and ships it with the invocation, so that workers compile
+// the same shards without computing it again. Manifests are encoded
+// with encoding/gob, as are snapshot tokens (see SnapshotSlice).
+//
+// A manifest slice may also be a snapshot slice, whose snapshots then
+// record its manifest: when an invocation reads the slice's snapshot
+// (see exec.Snapshot and exec.AtSnapshots), the manifest is not
+// computed, and the snapshot determines the slice's shards instead.
+type ManifestSlice interface {
+	Slice
+	// Manifest computes the manifest of the slice's data. It is called
+	// only by the driver.
+	Manifest(ctx context.Context) (token interface{}, err error)
+	// SetManifest configures the slice to read the data described by
+	// the provided manifest, as returned by Manifest. It is called
+	// before the slice is compiled, both by the driver and by workers,
+	// and so must not perform I/O.
+	SetManifest(token interface{}) error
+}
@@ -0,0 +1,330 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"reflect"
+	"sort"
+
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/slicefunc"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/slicetype"
+	"github.com/grailbio/bigslice/sortio"
+	"github.com/grailbio/bigslice/typecheck"
+)
+
+// sortSpillSize is the target size, in bytes, of the spill files
+// written while sorting shards.
+const sortSpillSize = 1 << 25
+
+// A SortKey orders rows by the values of one of their columns.
+type SortKey struct {
+	// Col is the index of the column by which rows are ordered.
+	Col int
+	// Desc orders rows by decreasing, rather than increasing, column
+	// values.
+	Desc bool
+	// Less, if non-nil, is a function of the form
+	//
+	//	func(a, b t) bool
+	//
+	// where t is the type of column Col, which reports whether a sorts
+	// before b. If Less is nil, column values are ordered by their
+	// natural order (see frame.CanCompare).
+	Less interface{}
+}
+
+// An Ordering specifies the order of the rows of a sorted slice. Rows
+// are compared by each of the ordering's keys in turn; rows that
+// compare as equal by all of its keys are then compared by the
+// ordering's Less function, if any.
+type Ordering struct {
+	// Keys are the keys by which rows are ordered, most significant
+	// first.
+	Keys []SortKey
+	// Less, if non-nil, is a function of the form
+	//
+	//	func(a1 t1, a2 t2, ..., an tn, b1 t1, b2 t2, ..., bn tn) bool
+	//
+	// where t1, t2, ..., tn are the column types of the sorted slice,
+	// which reports whether row a sorts before row b.
+	Less interface{}
+	// Stable tells whether rows that compare as equal are to retain
+	// the order in which they are read.
+	Stable bool
+}
+
+// A sortKey is a typechecked SortKey.
+type sortKey struct {
+	SortKey
+	typ  reflect.Type
+	less slicefunc.Func
+}
+
+// lessFunc returns a function that reports whether column value x
+// sorts before column value y under the key. The returned function is
+// not safe for concurrent use.
+func (k *sortKey) lessFunc(ctx context.Context) func(x, y reflect.Value) bool {
+	var less func(x, y reflect.Value) bool
+	if k.less.IsNil() {
+		// Maintain a compare buffer so that values are compared by the
+		// ops of their frame.
+		buf := frame.Make(slicetype.New(k.typ), 2, 2).WithKeyPolicy(frame.ContextKeyPolicy(ctx))
+		less = func(x, y reflect.Value) bool {
+			buf.Index(0, 0).Set(x)
+			buf.Index(0, 1).Set(y)
+			return buf.Less(0, 1)
+		}
+	} else {
+		args := make([]reflect.Value, 2)
+		less = func(x, y reflect.Value) bool {
+			args[0], args[1] = x, y
+			return k.less.Call(ctx, args)[0].Bool()
+		}
+	}
+	if k.Desc {
+		return func(x, y reflect.Value) bool { return less(y, x) }
+	}
+	return less
+}
+
+// An ordering is a typechecked Ordering.
+type ordering struct {
+	Ordering
+	keys []sortKey
+	less slicefunc.Func
+}
+
+// makeOrdering typechecks the provided ordering against the columns of
+// typ, panicking with a typecheck error (attributed to the caller of
+// the caller of makeOrdering) if it is invalid.
+func makeOrdering(op string, typ slicetype.Type, order Ordering) ordering {
+	if len(order.Keys) == 0 && order.Less == nil {
+		typecheck.Panicf(2, "%s: ordering has neither keys nor a less function", op)
+	}
+	o := ordering{Ordering: order, keys: make([]sortKey, len(order.Keys))}
+	for i, key := range order.Keys {
+		if key.Col < 0 || key.Col >= typ.NumOut() {
+			typecheck.Panicf(2, "%s: invalid column %d for key %d of slice type %s", op, key.Col, i, slicetype.String(typ))
+		}
+		k := sortKey{SortKey: key, typ: typ.Out(key.Col)}
+		if key.Less == nil {
+			if !frame.CanCompare(k.typ) {
+				typecheck.Panicf(2, "%s: column type %s of key %d cannot be sorted; provide a less function", op, k.typ, i)
+			}
+		} else {
+			fn, ok := slicefunc.Of(key.Less)
+			if !ok {
+				typecheck.Panicf(2, "%s: invalid less function %T for key %d", op, key.Less, i)
+			}
+			expectArg := slicetype.New(k.typ, k.typ)
+			expectRet := slicetype.New(typeOfBool)
+			if !typecheck.Equal(fn.In, expectArg) || !typecheck.Equal(fn.Out, expectRet) {
+				typecheck.Panicf(2, "%s: key %d: expected %s, got %T", op, i, slicetype.Signature(expectArg, expectRet), key.Less)
+			}
+			k.less = fn
+		}
+		o.keys[i] = k
+	}
+	if order.Less != nil {
+		fn, ok := slicefunc.Of(order.Less)
+		if !ok {
+			typecheck.Panicf(2, "%s: invalid less function %T", op, order.Less)
+		}
+		expectArg := slicetype.Append(typ, typ)
+		expectRet := slicetype.New(typeOfBool)
+		if !typecheck.Equal(fn.In, expectArg) || !typecheck.Equal(fn.Out, expectRet) {
+			typecheck.Panicf(2, "%s: expected %s, got %T", op, slicetype.Signature(expectArg, expectRet), order.Less)
+		}
+		o.less = fn
+	}
+	return o
+}
+
+// natural tells whether the ordering orders rows of a slice with the
+// provided prefix by the natural order of their prefix columns, as
+// required of a SortedSlice.
+func (o *ordering) natural(prefix int) bool {
+	if len(o.keys) < prefix {
+		return false
+	}
+	for i := 0; i < prefix; i++ {
+		if k := o.keys[i]; k.Col != i || k.Desc || !k.less.IsNil() {
+			return false
+		}
+	}
+	return true
+}
+
+// lessFunc returns a function that reports whether row i of a frame
+// sorts before row j under the ordering. The returned function is not
+// safe for concurrent use.
+func (o *ordering) lessFunc(ctx context.Context) sortio.LessFunc {
+	keys := make([]func(x, y reflect.Value) bool, len(o.keys))
+	for i := range o.keys {
+		keys[i] = o.keys[i].lessFunc(ctx)
+	}
+	var args []reflect.Value
+	return func(f frame.Frame, i, j int) bool {
+		for k, less := range keys {
+			x, y := f.Index(o.keys[k].Col, i), f.Index(o.keys[k].Col, j)
+			switch {
+			case less(x, y):
+				return true
+			case less(y, x):
+				return false
+			}
+		}
+		if o.less.IsNil() {
+			return false
+		}
+		n := f.NumOut()
+		if args == nil {
+			args = make([]reflect.Value, 2*n)
+		}
+		for col := 0; col < n; col++ {
+			args[col] = f.Index(col, i)
+			args[n+col] = f.Index(col, j)
+		}
+		return o.less.Call(ctx, args)[0].Bool()
+	}
+}
+
+type sortSlice struct {
+	name Name
+	Pragmas
+	Slice
+	order  ordering
+	global bool
+}
+
+// Sort returns a slice whose shards each produce the rows of the
+// corresponding shard of the provided slice, sorted by the provided
+// ordering. Orderings may compare rows by any number of their columns,
+// each in increasing or decreasing order, and each by its natural order
+// or by a user-supplied less function; rows that compare as equal by
+// their keys may further be compared by a less function over whole
+// rows. Orderings are typechecked against the slice's columns.
+//
+// Sort operates on each shard independently: no ordering is implied
+// across shard boundaries (see SortGlobal). Shards that do not fit in
+// memory are sorted by spilling sorted runs to disk and merging them.
+// If order.Stable is set, rows that compare as equal are produced in
+// the order in which they are read.
+//
+// If the ordering orders rows by the natural order of the slice's
+// prefix columns, the returned slice is a SortedSlice; otherwise it is
+// an OrderedSlice whose order is given by the ordering.
+//
+// For example, the following orders rows by decreasing count, and then
+// by increasing name:
+//
+//	bigslice.Sort(slice, bigslice.Ordering{
+//		Keys: []bigslice.SortKey{{Col: 1, Desc: true}, {Col: 0}},
+//	})
+//
+// Schematically:
+//
+//	Sort(Slice<t1, t2, ..., tn>, Ordering) Slice<t1, t2, ..., tn>
+func Sort(slice Slice, order Ordering, prags ...Pragma) Slice {
+	return &sortSlice{
+		name:    MakeName("sort"),
+		Pragmas: prags,
+		Slice:   slice,
+		order:   makeOrdering("sort", slice, order),
+	}
+}
+
+// SortGlobal returns a slice that sorts the rows of the provided slice
+// by the provided ordering (see Sort) across its shards: its rows are
+// partitioned into len(bounds)+1 shards by the value of the ordering's
+// first key, so that the rows of each shard sort before those of the
+// next, and each shard is then sorted. Bounds must be a slice of values
+// of the type of the first key's column, strictly increasing under the
+// ordering of the first key: a row is placed in shard i if its key does
+// not sort before bounds[i-1] and sorts before bounds[i]. Results of
+// the returned slice are scanned in sorted order (see GloballySorted).
+//
+// Schematically:
+//
+//	SortGlobal(Slice<t1, t2, ..., tn>, Ordering, []t_k) Slice<t1, t2, ..., tn>
+func SortGlobal(slice Slice, order Ordering, bounds interface{}, prags ...Pragma) Slice {
+	o := makeOrdering("sortglobal", slice, order)
+	if len(o.keys) == 0 {
+		typecheck.Panicf(1, "sortglobal: ordering has no keys")
+	}
+	key := o.keys[0]
+	boundsv := reflect.ValueOf(bounds)
+	if boundsv.Kind() != reflect.Slice || boundsv.Type().Elem() != key.typ {
+		typecheck.Panicf(1, "sortglobal: bounds of type %T do not match key column type %s", bounds, key.typ)
+	}
+	less := key.lessFunc(context.Background())
+	for i := 1; i < boundsv.Len(); i++ {
+		if !less(boundsv.Index(i-1), boundsv.Index(i)) {
+			typecheck.Panicf(1, "sortglobal: bounds are not strictly increasing at index %d", i)
+		}
+	}
+	nbound := boundsv.Len()
+	part := func(ctx context.Context, frame frame.Frame, nshard int, shards []int) {
+		less := key.lessFunc(ctx)
+		for i := range shards {
+			k := frame.Index(key.Col, i)
+			shards[i] = sort.Search(nbound, func(j int) bool {
+				return less(k, boundsv.Index(j))
+			})
+		}
+	}
+	return &sortSlice{
+		name:    MakeName("sortglobal"),
+		Pragmas: prags,
+		Slice: &partitionByRangesSlice{
+			reshuffleSlice{MakeName("sortglobal"), part, slice},
+			nbound + 1,
+			key.Col,
+		},
+		order:  o,
+		global: true,
+	}
+}
+
+func (s *sortSlice) Name() Name             { return s.name }
+func (*sortSlice) NumDep() int              { return 1 }
+func (s *sortSlice) Dep(i int) Dep          { return singleDep(i, s.Slice, false) }
+func (*sortSlice) Combiner() slicefunc.Func { return slicefunc.Nil }
+
+// Sorted implements SortedSlice.
+func (s *sortSlice) Sorted() bool { return s.order.natural(s.Prefix()) }
+
+// Ordering implements OrderedSlice.
+func (s *sortSlice) Ordering() (Ordering, bool) { return s.order.Ordering, s.global }
+
+func (s *sortSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	return &sortReader{op: s, reader: deps[0]}
+}
+
+type sortReader struct {
+	op     *sortSlice
+	reader sliceio.Reader
+	sorted sliceio.Reader
+	err    error
+}
+
+func (s *sortReader) Read(ctx context.Context, out frame.Frame) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	if s.sorted == nil {
+		s.sorted, s.err = sortio.SortReaderFunc(ctx, sortSpillSize, s.op, s.reader,
+			s.op.order.lessFunc(ctx), s.op.order.Stable)
+		if s.err != nil {
+			return 0, s.err
+		}
+	}
+	var n int
+	n, s.err = s.sorted.Read(ctx, out)
+	return n, s.err
+}
@@ -0,0 +1,134 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"testing"
+
+	"github.com/grailbio/bigslice"
+)
+
+func TestSort(t *testing.T) {
+	var (
+		names  = []string{"c", "a", "bb", "d", "b", "aaa"}
+		counts = []int{2, 1, 3, 1, 3, 2}
+	)
+	slice := bigslice.Const(1, names, counts)
+	// Decreasing count, then increasing name.
+	sorted := bigslice.Sort(slice, bigslice.Ordering{
+		Keys: []bigslice.SortKey{{Col: 1, Desc: true}, {Col: 0}},
+	})
+	assertEqual(t, sorted, false,
+		[]string{"b", "bb", "aaa", "c", "a", "d"},
+		[]int{3, 3, 2, 2, 1, 1},
+	)
+	if bigslice.GloballySorted(sorted) {
+		t.Error("slice is globally sorted")
+	}
+
+	// Decreasing name length, with ties broken by a row comparison.
+	sorted = bigslice.Sort(slice, bigslice.Ordering{
+		Keys: []bigslice.SortKey{{
+			Col:  0,
+			Desc: true,
+			Less: func(a, b string) bool { return len(a) < len(b) },
+		}},
+		Less: func(name1 string, count1 int, name2 string, count2 int) bool {
+			return count1 < count2 || count1 == count2 && name1 < name2
+		},
+	})
+	assertEqual(t, sorted, false,
+		[]string{"aaa", "bb", "a", "d", "c", "b"},
+		[]int{2, 3, 1, 1, 2, 3},
+	)
+
+	// The natural order of the prefix produces a sorted slice.
+	sorted = bigslice.Sort(slice, bigslice.Ordering{Keys: []bigslice.SortKey{{Col: 0}}})
+	if s, ok := sorted.(bigslice.SortedSlice); !ok || !s.Sorted() {
+		t.Error("slice is not sorted")
+	}
+}
+
+func TestSortStable(t *testing.T) {
+	const N = 1000
+	var (
+		keys = make([]int, N)
+		vals = make([]int, N)
+	)
+	for i := range keys {
+		keys[i] = (N - i) % 3
+		vals[i] = i
+	}
+	slice := bigslice.Const(1, keys, vals)
+	slice = bigslice.Sort(slice, bigslice.Ordering{
+		Keys:   []bigslice.SortKey{{Col: 0}},
+		Stable: true,
+	})
+	var wantKeys, wantVals []int
+	for key := 0; key < 3; key++ {
+		for i := range keys {
+			if keys[i] == key {
+				wantKeys = append(wantKeys, key)
+				wantVals = append(wantVals, i)
+			}
+		}
+	}
+	assertEqual(t, slice, false, wantKeys, wantVals)
+}
+
+func TestSortGlobal(t *testing.T) {
+	const N = 100
+	var (
+		keys = make([]string, N)
+		vals = make([]int, N)
+	)
+	for i := range vals {
+		keys[i] = string(rune('a' + i%26))
+		vals[i] = (i * 37) % N
+	}
+	slice := bigslice.Const(4, keys, vals)
+	slice = bigslice.SortGlobal(slice, bigslice.Ordering{
+		Keys: []bigslice.SortKey{{Col: 1, Desc: true}},
+	}, []int{75, 50, 25})
+	if got, want := slice.NumShard(), 4; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if !bigslice.GloballySorted(slice) {
+		t.Error("slice is not globally sorted")
+	}
+	wantKeys := make([]string, N)
+	wantVals := make([]int, N)
+	for i := range vals {
+		wantVals[i] = N - 1 - i
+		wantKeys[i] = keys[(wantVals[i]*73)%N]
+	}
+	assertEqual(t, slice, false, wantKeys, wantVals)
+}
+
+func TestSortType(t *testing.T) {
+	slice := bigslice.Const(1, []string{}, []int{})
+	expectTypeError(t, "sort: ordering has neither keys nor a less function", func() {
+		bigslice.Sort(slice, bigslice.Ordering{})
+	})
+	expectTypeError(t, "sort: invalid column 2 for key 0 of slice type slice[1]string,int", func() {
+		bigslice.Sort(slice, bigslice.Ordering{Keys: []bigslice.SortKey{{Col: 2}}})
+	})
+	expectTypeError(t, "sort: key 0: expected func(int, int) bool, got func(string, string) bool", func() {
+		bigslice.Sort(slice, bigslice.Ordering{Keys: []bigslice.SortKey{{
+			Col:  1,
+			Less: func(a, b string) bool { return a < b },
+		}}})
+	})
+	expectTypeError(t, "sort: expected func(string, int, string, int) bool, got func(string, string) bool", func() {
+		bigslice.Sort(slice, bigslice.Ordering{Less: func(a, b string) bool { return a < b }})
+	})
+	type unordered struct{ x int }
+	expectTypeError(t, "sort: column type bigslice_test.unordered of key 0 cannot be sorted; provide a less function", func() {
+		bigslice.Sort(bigslice.Const(1, []unordered{}), bigslice.Ordering{Keys: []bigslice.SortKey{{Col: 0}}})
+	})
+	expectTypeError(t, "sortglobal: bounds are not strictly increasing at index 1", func() {
+		bigslice.SortGlobal(slice, bigslice.Ordering{Keys: []bigslice.SortKey{{Col: 1, Desc: true}}}, []int{1, 2})
+	})
+}
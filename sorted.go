@@ -0,0 +1,49 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+// A SortedSlice is a Slice whose shards may each produce their rows in
+// increasing order of the slice's prefix columns. A sorted slice
+// that is also sharded by RangeShard, so that the keys of each shard
+// precede those of the next, is globally sorted: reading its shards in
+// order yields its rows in sorted order. Results of globally sorted
+// slices are scanned in this order; see GloballySorted.
+type SortedSlice interface {
+	Slice
+	// Sorted tells whether each of the slice's shards produces its rows
+	// in sorted order.
+	Sorted() bool
+}
+
+// An OrderedSlice is a Slice whose shards each produce their rows in
+// the order of an Ordering, as do the slices returned by Sort.
+type OrderedSlice interface {
+	Slice
+	// Ordering returns the ordering of the rows of each of the slice's
+	// shards, and whether the slice is globally ordered: that is,
+	// whether its shards are partitioned by ranges consistent with the
+	// ordering, so that the rows of each shard precede those of the
+	// next.
+	Ordering() (order Ordering, global bool)
+}
+
+// GloballySorted tells whether the rows of the provided slice are
+// globally sorted: that is, whether it is a globally ordered
+// OrderedSlice, or whether it is sharded by RangeShard and is a
+// SortedSlice whose shards are sorted by its prefix columns.
+// Operations that do not preserve the order of their input, including
+// pipelined operations such as Map, do not produce sorted slices.
+func GloballySorted(slice Slice) bool {
+	if o, ok := slice.(OrderedSlice); ok {
+		if _, global := o.Ordering(); global {
+			return true
+		}
+	}
+	if slice.ShardType() != RangeShard {
+		return false
+	}
+	s, ok := slice.(SortedSlice)
+	return ok && s.Sorted()
+}
@@ -0,0 +1,85 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/grailbio/bigslice"
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/slicefunc"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/slicetype"
+)
+
+// rangeSortedSlice is a range-sharded, sorted slice of ints, whose
+// shard i comprises the integers [i*width, (i+1)*width).
+type rangeSortedSlice struct {
+	slicetype.Type
+	name            bigslice.Name
+	numShard, width int
+}
+
+func newRangeSortedSlice(numShard, width int) bigslice.Slice {
+	return &rangeSortedSlice{
+		Type:     slicetype.New(reflect.TypeOf(0)),
+		name:     bigslice.MakeName("rangesorted"),
+		numShard: numShard,
+		width:    width,
+	}
+}
+
+func (s *rangeSortedSlice) Name() bigslice.Name         { return s.name }
+func (s *rangeSortedSlice) NumShard() int               { return s.numShard }
+func (*rangeSortedSlice) ShardType() bigslice.ShardType { return bigslice.RangeShard }
+func (*rangeSortedSlice) NumDep() int                   { return 0 }
+func (*rangeSortedSlice) Dep(i int) bigslice.Dep        { panic("no deps") }
+func (*rangeSortedSlice) Combiner() slicefunc.Func      { return slicefunc.Nil }
+func (*rangeSortedSlice) Sorted() bool                  { return true }
+func (s *rangeSortedSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	ints := make([]int, s.width)
+	for i := range ints {
+		ints[i] = shard*s.width + i
+	}
+	return sliceio.FrameReader(frame.Slices(ints))
+}
+
+func TestGloballySorted(t *testing.T) {
+	const numShard, width = 8, 100
+	slice := newRangeSortedSlice(numShard, width)
+	if !bigslice.GloballySorted(slice) {
+		t.Error("expected globally sorted slice")
+	}
+	if bigslice.GloballySorted(bigslice.Map(slice, func(i int) int { return i })) {
+		t.Error("map should not be globally sorted")
+	}
+	// Cogroup sorts its shards, but is hash sharded.
+	if bigslice.GloballySorted(bigslice.Cogroup(bigslice.Const(1, []int{1}, []int{2}))) {
+		t.Error("cogroup should not be globally sorted")
+	}
+
+	ctx := context.Background()
+	for name, scanner := range run(ctx, t, slice) {
+		var (
+			val, n int
+			last   = -1
+		)
+		for scanner.Scan(ctx, &val) {
+			if val <= last {
+				t.Errorf("%s: %d follows %d", name, val, last)
+			}
+			last = val
+			n++
+		}
+		if err := scanner.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := n, numShard*width; got != want {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+	}
+}
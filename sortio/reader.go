@@ -32,7 +32,9 @@ type reader struct {
 
 // Reduce returns a Reader that merges and reduces a set of
 // sorted (and possibly combined) readers. Reduce panics if
-// the provided type is not reducable.
+// the provided type is not reducable. Keys are ordered by the key
+// policy of the context of the reader's first read (see
+// frame.ContextKeyPolicy).
 func Reduce(typ slicetype.Type, name string, readers []sliceio.Reader, combiner slicefunc.Func) sliceio.Reader {
 	if typ.NumOut()-typ.Prefix() != 1 {
 		typecheck.Panicf(1, "cannot reduce type %s", slicetype.String(typ))
@@ -51,7 +53,7 @@ func (r *reader) Read(ctx context.Context, out frame.Frame) (int, error) {
 	}
 	if r.heap == nil {
 		n := len(r.readers) * defaultChunksize
-		r.frame = frame.Make(r.typ, n, n)
+		r.frame = frame.Make(r.typ, n, n).WithKeyPolicy(frame.ContextKeyPolicy(ctx))
 		r.heap = new(FrameBufferHeap)
 		r.heap.LessFunc = func(i, j int) bool {
 			return r.frame.Less(r.heap.Buffers[i].Pos(), r.heap.Buffers[j].Pos())
@@ -9,6 +9,7 @@ package sortio
 import (
 	"container/heap"
 	"context"
+	"expvar"
 	"math"
 	"sort"
 
@@ -21,40 +22,81 @@ import (
 
 var numCanaryRows = &defaultsize.SortCanary
 
+// sortSpillBytes is the number of bytes spilled to disk by SortReader.
+var sortSpillBytes = expvar.NewInt("sortspillbytes")
+
 // SortReader sorts a Reader by its prefix columns. SortReader may
 // spill to disk, in which case it targets spill file sizes of
 // spillTarget (in bytes). Because the encoded size of objects is not
 // known in advance, sortReader uses a "canary" batch size of ~16k
 // rows in order to estimate the size of future reads. The estimate
 // is revisited on every subsequent fill and adjusted if it is
-// violated by more than 5%.
+// violated by more than 5%. Keys are ordered by the key policy of the
+// provided context (see frame.ContextKeyPolicy).
 func SortReader(ctx context.Context, spillTarget int, typ slicetype.Type, r sliceio.Reader) (sliceio.Reader, error) {
-	spill, err := sliceio.NewSpiller("sorter")
-	if err != nil {
-		return nil, err
-	}
+	return SortReaderFunc(ctx, spillTarget, typ, r, nil, false)
+}
+
+// A LessFunc reports whether row i of frame f sorts before row j.
+type LessFunc func(f frame.Frame, i, j int) bool
+
+// lessSorter sorts a frame by a LessFunc.
+type lessSorter struct {
+	frame.Frame
+	less LessFunc
+}
+
+func (s lessSorter) Less(i, j int) bool { return s.less(s.Frame, i, j) }
+
+// SortReaderFunc is like SortReader, but sorts the rows of the Reader
+// by the provided less function. If less is nil, rows are sorted by
+// their prefix columns. If stable is true, rows that compare as equal
+// are produced in the order in which they were read.
+func SortReaderFunc(ctx context.Context, spillTarget int, typ slicetype.Type, r sliceio.Reader, less LessFunc, stable bool) (sliceio.Reader, error) {
+	// The files of a spiller are unordered. Stable sorts spill each
+	// sorted run to its own spiller so that runs are merged in the
+	// order in which they were read.
+	var spills []sliceio.Spiller
 	defer func() {
-		if cleanupErr := spill.Cleanup(); cleanupErr != nil {
-			// Consider temporary file cleanup to be best-effort.
-			log.Debug.Printf("%s: failed to clean up temporary files: %v",
-				spill, cleanupErr)
+		for _, spill := range spills {
+			if cleanupErr := spill.Cleanup(); cleanupErr != nil {
+				// Consider temporary file cleanup to be best-effort.
+				log.Debug.Printf("%s: failed to clean up temporary files: %v",
+					spill, cleanupErr)
+			}
 		}
 	}()
-	f := frame.Make(typ, *numCanaryRows, *numCanaryRows)
+	var err error
+	f := frame.Make(typ, *numCanaryRows, *numCanaryRows).WithKeyPolicy(frame.ContextKeyPolicy(ctx))
 	for {
+		if len(spills) == 0 || stable {
+			var spill sliceio.Spiller
+			if spill, err = sliceio.NewSpiller("sorter"); err != nil {
+				return nil, err
+			}
+			spills = append(spills, spill)
+		}
 		var n int
 		n, err = sliceio.ReadFull(ctx, r, f)
 		if err != nil && err != sliceio.EOF {
 			return nil, err
 		}
 		eof := err == sliceio.EOF
-		g := f.Slice(0, n)
-		sort.Sort(g)
+		var g sort.Interface = f.Slice(0, n)
+		if less != nil {
+			g = lessSorter{f.Slice(0, n), less}
+		}
+		if stable {
+			sort.Stable(g)
+		} else {
+			sort.Sort(g)
+		}
 		var size int
-		size, err = spill.Spill(g)
+		size, err = spills[len(spills)-1].Spill(ctx, f.Slice(0, n))
 		if err != nil {
 			return nil, err
 		}
+		sortSpillBytes.Add(int64(size))
 		if eof {
 			break
 		}
@@ -68,11 +110,15 @@ func SortReader(ctx context.Context, spillTarget int, typ slicetype.Type, r slic
 			f = f.Ensure(targetRows)
 		}
 	}
-	readers, err := spill.ClosingReaders()
-	if err != nil {
-		return nil, err
+	var readers []sliceio.Reader
+	for _, spill := range spills {
+		spillReaders, err := spill.ClosingReaders()
+		if err != nil {
+			return nil, err
+		}
+		readers = append(readers, spillReaders...)
 	}
-	return NewMergeReader(ctx, typ, readers)
+	return NewMergeReaderFunc(ctx, typ, readers, less, stable)
 }
 
 // A FrameBuffer is a buffered frame. The frame is filled from
@@ -157,14 +203,32 @@ type mergeReader struct {
 }
 
 // NewMergeReader returns a new Reader that is sorted by its prefix columns. The
-// readers to be merged must already be sorted.
+// readers to be merged must already be sorted, by the key policy of the
+// provided context (see frame.ContextKeyPolicy).
 func NewMergeReader(ctx context.Context, typ slicetype.Type, readers []sliceio.Reader) (sliceio.Reader, error) {
+	return NewMergeReaderFunc(ctx, typ, readers, nil, false)
+}
+
+// NewMergeReaderFunc is like NewMergeReader, but merges readers that
+// are sorted by the provided less function. If less is nil, readers
+// are merged by their prefix columns. If stable is true, rows that
+// compare as equal are produced in the order of the readers from which
+// they are read.
+func NewMergeReaderFunc(ctx context.Context, typ slicetype.Type, readers []sliceio.Reader, less LessFunc, stable bool) (sliceio.Reader, error) {
 	h := new(FrameBufferHeap)
 	h.Buffers = make([]*FrameBuffer, 0, len(readers))
 	n := len(readers) * sliceio.SpillBatchSize
-	f := frame.Make(typ, n, n)
+	f := frame.Make(typ, n, n).WithKeyPolicy(frame.ContextKeyPolicy(ctx))
+	if less == nil {
+		less = frame.Frame.Less
+	}
 	h.LessFunc = func(i, j int) bool {
-		return f.Less(h.Buffers[i].Pos(), h.Buffers[j].Pos())
+		pi, pj := h.Buffers[i].Pos(), h.Buffers[j].Pos()
+		if less(f, pi, pj) {
+			return true
+		}
+		// Buffers are laid out in the order of their readers.
+		return stable && !less(f, pj, pi) && h.Buffers[i].Off < h.Buffers[j].Off
 	}
 	for i := range readers {
 		off := i * sliceio.SpillBatchSize
@@ -0,0 +1,385 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	goerrors "errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/slicefunc"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/slicetype"
+	"github.com/grailbio/bigslice/typecheck"
+)
+
+const (
+	// SQLRange is the placeholder in the query templates of ReadSQL
+	// that is replaced by the condition that restricts a shard's query
+	// to its key range.
+	SQLRange = "{{range}}"
+	// SQLSnapshot is the placeholder in the query templates of ReadSQL
+	// that is replaced by the time of the snapshot that is read.
+	SQLSnapshot = "{{snapshot}}"
+)
+
+var (
+	typeOfTime    = reflect.TypeOf(time.Time{})
+	typeOfScanner = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+)
+
+type sqlSlice struct {
+	name Name
+	Pragmas
+	slicetype.Type
+	open           func(ctx context.Context) (*sql.DB, error)
+	query, key     string
+	minKey, maxKey int64
+	nshard         int
+	plan           *jsonPlan
+	// snapshot is the time of the snapshot read by the slice, if any.
+	snapshot string
+}
+
+// ReadSQL returns a slice that reads the rows of a SQL query, sharded
+// by ranges of an integer key column (e.g., the table's primary key).
+// The inclusive key range [minKey, maxKey] is split into nshard
+// contiguous subranges of (nearly) equal size, and each shard runs the
+// query restricted to its subrange: the query is a template in which
+// the placeholder SQLRange is replaced by a condition of the form
+//
+//	(key >= lo AND key <= hi)
+//
+// For example:
+//
+//	SELECT id, name, score FROM users WHERE {{range}} ORDER BY id
+//
+// The key range is not computed by ReadSQL, since the slice is also
+// constructed on every worker; SQLKeyRange may be called by the driver
+// to compute it, and its result passed as an argument to the Func.
+//
+// Open is called once by each shard's reader, on the machine that
+// reads the shard, to open the connection over which the shard's query
+// is run; the returned database is limited to a single connection, and
+// is closed once the shard has been read. Open is passed the task's
+// context, and so may look up credentials with LookupCredential.
+//
+// The columns of the query's result are mapped, in order, to the
+// columns of the slice, which are given by the exported fields of the
+// struct type of into, exactly as for ReadJSONLines. Column values are
+// converted as by (*sql.Rows).Scan: supported field types are
+// booleans, integers, floats, strings, []byte, time.Time, types that
+// implement sql.Scanner, and pointers to any of these, which are nil
+// for NULL values. Values that cannot be converted are fatal errors.
+//
+// Transient database errors (bad connections, timeouts, and errors
+// that report themselves as temporary) are returned as temporary
+// errors, so that they are retried by the ReadRetry pragma, if
+// provided, or else by the executor, which retries the task. Since
+// retried reads skip the rows that were already produced, queries
+// should order their rows (e.g., by key) when they are retried.
+//
+// ReadSQL slices are SnapshotSlices if their queries read the database
+// as of a point in time given by the placeholder SQLSnapshot, which is
+// replaced by a UTC timestamp in RFC 3339 format (with nanoseconds).
+// For example, in dialects that support time travel queries:
+//
+//	SELECT id, name FROM users AS OF SYSTEM TIME '{{snapshot}}' WHERE {{range}}
+//
+// The timestamp is the time at which the snapshot is captured by the
+// driver, or, if the slice does not read a snapshot, the time at which
+// each shard's query is run. Slices whose queries do not contain the
+// placeholder cannot provide snapshots.
+//
+// Schematically:
+//
+//	ReadSQL(open, query, key, min, max, nshard, struct{f1 t1; ...; fn tn}{}) Slice<t1, ..., tn>
+func ReadSQL(open func(ctx context.Context) (*sql.DB, error), query, keyColumn string, minKey, maxKey int64, nshard int, into interface{}, prags ...Pragma) Slice {
+	if open == nil {
+		typecheck.Panic(1, "readsql: nil open function")
+	}
+	if !strings.Contains(query, SQLRange) {
+		typecheck.Panicf(1, "readsql: query %q does not contain the placeholder %s", query, SQLRange)
+	}
+	if keyColumn == "" {
+		typecheck.Panic(1, "readsql: no key column provided")
+	}
+	if minKey > maxKey {
+		typecheck.Panicf(1, "readsql: invalid key range [%d, %d]", minKey, maxKey)
+	}
+	if nshard < 1 {
+		typecheck.Panicf(1, "readsql: invalid number of shards %d", nshard)
+	}
+	typ := reflect.TypeOf(into)
+	if typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ == nil || typ.Kind() != reflect.Struct {
+		typecheck.Panicf(1, "readsql: expected struct or pointer to struct, got %T", into)
+	}
+	plan := jsonPlanOf(typ)
+	if len(plan.columns) == 0 {
+		typecheck.Panicf(1, "readsql: struct %s has no exported fields", typ)
+	}
+	for i, col := range plan.columns {
+		if !sqlScannable(col) {
+			typecheck.Panicf(1, "readsql: field %s has unsupported column type %s", typ.Field(plan.fields[i]).Name, col)
+		}
+	}
+	return &sqlSlice{
+		name:    MakeName("readsql"),
+		Pragmas: prags,
+		Type:    slicetype.New(plan.columns...),
+		open:    open,
+		query:   query,
+		key:     keyColumn,
+		minKey:  minKey,
+		maxKey:  maxKey,
+		nshard:  nshard,
+		plan:    plan,
+	}
+}
+
+// sqlScannable tells whether values of SQL columns may be scanned into
+// values of the provided type.
+func sqlScannable(typ reflect.Type) bool {
+	if reflect.PtrTo(typ).Implements(typeOfScanner) {
+		return true
+	}
+	switch typ.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	case reflect.Slice:
+		return typ.Elem().Kind() == reflect.Uint8
+	case reflect.Struct:
+		return typ == typeOfTime
+	case reflect.Ptr:
+		return typ.Elem().Kind() != reflect.Ptr && sqlScannable(typ.Elem())
+	}
+	return false
+}
+
+// SQLKeyRange returns the smallest and largest values of the provided
+// integer key column of a table, for use as the key range of ReadSQL.
+// It returns an error if the table is empty.
+func SQLKeyRange(ctx context.Context, db *sql.DB, table, keyColumn string) (minKey, maxKey int64, err error) {
+	var min, max sql.NullInt64
+	query := fmt.Sprintf("SELECT MIN(%s), MAX(%s) FROM %s", keyColumn, keyColumn, table)
+	if err = db.QueryRowContext(ctx, query).Scan(&min, &max); err != nil {
+		return 0, 0, errors.E(fmt.Sprintf("sqlkeyrange: %s", table), err)
+	}
+	if !min.Valid || !max.Valid {
+		return 0, 0, errors.E(errors.NotExist, fmt.Sprintf("sqlkeyrange: table %s is empty", table))
+	}
+	return min.Int64, max.Int64, nil
+}
+
+func (s *sqlSlice) Name() Name             { return s.name }
+func (s *sqlSlice) NumShard() int          { return s.nshard }
+func (*sqlSlice) ShardType() ShardType     { return HashShard }
+func (*sqlSlice) NumDep() int              { return 0 }
+func (*sqlSlice) Dep(i int) Dep            { panic("no deps") }
+func (*sqlSlice) Combiner() slicefunc.Func { return slicefunc.Nil }
+
+// shardRange returns the inclusive key range of the provided shard.
+// The range is empty (lo > hi) if there are more shards than keys.
+func (s *sqlSlice) shardRange(shard int) (lo, hi int64) {
+	// Compute offsets in uint64 so that key ranges that span more than
+	// half of the int64 range do not overflow.
+	var (
+		span = uint64(s.maxKey-s.minKey) + 1
+		n    = uint64(s.nshard)
+		q, r = span / n, span % n
+	)
+	offset := func(i uint64) uint64 {
+		if i < r {
+			return i*q + i
+		}
+		return i*q + r
+	}
+	i := uint64(shard)
+	lo = s.minKey + int64(offset(i))
+	hi = s.minKey + int64(offset(i+1)-1)
+	return
+}
+
+// shardQuery returns the query run by the provided shard.
+func (s *sqlSlice) shardQuery(shard int) string {
+	lo, hi := s.shardRange(shard)
+	cond := fmt.Sprintf("(%s >= %d AND %s <= %d)", s.key, lo, s.key, hi)
+	query := strings.Replace(s.query, SQLRange, cond, -1)
+	if strings.Contains(query, SQLSnapshot) {
+		snapshot := s.snapshot
+		if snapshot == "" {
+			snapshot = time.Now().UTC().Format(time.RFC3339Nano)
+		}
+		query = strings.Replace(query, SQLSnapshot, snapshot, -1)
+	}
+	return query
+}
+
+// Snapshot implements SnapshotSlice.
+func (s *sqlSlice) Snapshot(ctx context.Context) (interface{}, error) {
+	if !strings.Contains(s.query, SQLSnapshot) {
+		return nil, errors.E(errors.NotSupported, fmt.Sprintf("%s: query does not contain the placeholder %s", s.name, SQLSnapshot))
+	}
+	return time.Now().UTC().Format(time.RFC3339Nano), nil
+}
+
+// SetSnapshot implements SnapshotSlice.
+func (s *sqlSlice) SetSnapshot(token interface{}) error {
+	snapshot, ok := token.(string)
+	if !ok {
+		return errors.E(errors.Invalid, fmt.Sprintf("%s: invalid snapshot %T", s.name, token))
+	}
+	if !strings.Contains(s.query, SQLSnapshot) {
+		return errors.E(errors.NotSupported, fmt.Sprintf("%s: query does not contain the placeholder %s", s.name, SQLSnapshot))
+	}
+	s.snapshot = snapshot
+	return nil
+}
+
+func (s *sqlSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	return withReadRateLimit(s.Pragmas, s.nshard, withReadRetry(s.Pragmas, s.name, shard, func() sliceio.Reader {
+		return &sqlReader{op: s, shard: shard}
+	}))
+}
+
+// A sqlReader reads the rows of a shard of a sqlSlice over its own
+// database connection.
+type sqlReader struct {
+	op    *sqlSlice
+	shard int
+
+	db   *sql.DB
+	rows *sql.Rows
+	// dest holds the (pointer) values into which each column is
+	// scanned.
+	dest []interface{}
+	err  error
+}
+
+var _ sliceio.Cleaner = (*sqlReader)(nil)
+
+// Cleanup implements sliceio.Cleaner by closing the reader's query and
+// connection, if they remain open.
+func (r *sqlReader) Cleanup(ctx context.Context) error {
+	return r.close()
+}
+
+func (r *sqlReader) close() error {
+	var err error
+	if r.rows != nil {
+		err = r.rows.Close()
+		r.rows = nil
+	}
+	if r.db != nil {
+		if cerr := r.db.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		r.db = nil
+	}
+	return err
+}
+
+// start opens the reader's connection and runs its query.
+func (r *sqlReader) start(ctx context.Context) error {
+	var err error
+	if r.db, err = r.op.open(ctx); err != nil {
+		return sqlError("open", err)
+	}
+	r.db.SetMaxOpenConns(1)
+	if r.rows, err = r.db.QueryContext(ctx, r.op.shardQuery(r.shard)); err != nil {
+		return sqlError("query", err)
+	}
+	cols, err := r.rows.Columns()
+	if err != nil {
+		return sqlError("query", err)
+	}
+	if got, want := len(cols), r.op.NumOut(); got != want {
+		return errors.E(errors.Fatal, fmt.Sprintf("query returned %d columns, but the slice has %d", got, want))
+	}
+	r.dest = make([]interface{}, len(cols))
+	for i := range r.dest {
+		r.dest[i] = reflect.New(r.op.Out(i)).Interface()
+	}
+	return nil
+}
+
+func (r *sqlReader) Read(ctx context.Context, out frame.Frame) (n int, err error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if !slicetype.Assignable(out, r.op) {
+		return 0, errTypeError
+	}
+	defer func() {
+		if err != nil {
+			if err != sliceio.EOF {
+				err = errors.E(fmt.Sprintf("%s: shard %d", r.op.name, r.shard), err)
+			}
+			r.err = err
+			if cerr := r.close(); cerr != nil && err == sliceio.EOF {
+				err = sqlError("close", cerr)
+				r.err = err
+			}
+		}
+	}()
+	if r.rows == nil {
+		if err = r.start(ctx); err != nil {
+			return 0, err
+		}
+	}
+	for n < out.Len() {
+		if !r.rows.Next() {
+			if err = r.rows.Err(); err != nil {
+				return n, sqlError("read", err)
+			}
+			return n, sliceio.EOF
+		}
+		if err = r.rows.Scan(r.dest...); err != nil {
+			return n, errors.E(errors.Fatal, err)
+		}
+		for j, dest := range r.dest {
+			out.Index(j, n).Set(reflect.ValueOf(dest).Elem())
+		}
+		n++
+	}
+	return n, nil
+}
+
+// sqlError annotates an error returned by the database, marking it as
+// temporary if it is transient, so that it is retried.
+func sqlError(op string, err error) error {
+	if sqlTransient(err) {
+		return errors.E(errors.Temporary, op, err)
+	}
+	return errors.E(op, err)
+}
+
+// sqlTransient tells whether an error returned by the database is
+// transient: that is, whether the operation may succeed if retried.
+func sqlTransient(err error) bool {
+	if goerrors.Is(err, driver.ErrBadConn) || goerrors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if goerrors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var temp interface{ Temporary() bool }
+	return goerrors.As(err, &temp) && temp.Temporary()
+}
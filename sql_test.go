@@ -0,0 +1,229 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/retry"
+	"github.com/grailbio/bigslice"
+)
+
+// testSQLRows is the number of rows of the table served by
+// testSQLDriver. Row i is ("row<i>", i, i/2), with NULL scores for
+// multiples of 10.
+const testSQLRows = 100
+
+var testSQL = struct {
+	sync.Mutex
+	// failures is the number of transient failures to inject into the
+	// next reads of the rows with the given ids.
+	failures map[int64]int
+	// queries holds the queries that were run.
+	queries []string
+}{failures: make(map[int64]int)}
+
+func init() {
+	sql.Register("bigslicetest", testSQLDriver{})
+}
+
+type testSQLDriver struct{}
+
+func (testSQLDriver) Open(name string) (driver.Conn, error) {
+	return testSQLConn{}, nil
+}
+
+type testSQLConn struct{}
+
+func (testSQLConn) Prepare(query string) (driver.Stmt, error) { return testSQLStmt(query), nil }
+func (testSQLConn) Close() error                              { return nil }
+func (testSQLConn) Begin() (driver.Tx, error)                 { return nil, errors.New("unsupported") }
+
+var testSQLRange = regexp.MustCompile(`\(id >= (-?\d+) AND id <= (-?\d+)\)`)
+
+type testSQLStmt string
+
+func (testSQLStmt) Close() error  { return nil }
+func (testSQLStmt) NumInput() int { return -1 }
+
+func (testSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("unsupported")
+}
+
+func (s testSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	m := testSQLRange.FindStringSubmatch(string(s))
+	if m == nil {
+		return nil, fmt.Errorf("invalid query %q", s)
+	}
+	lo, _ := strconv.ParseInt(m[1], 10, 64)
+	hi, _ := strconv.ParseInt(m[2], 10, 64)
+	if lo < 0 {
+		lo = 0
+	}
+	testSQL.Lock()
+	testSQL.queries = append(testSQL.queries, string(s))
+	testSQL.Unlock()
+	return &testSQLResult{next: lo, hi: hi}, nil
+}
+
+type testSQLResult struct {
+	next, hi int64
+}
+
+func (*testSQLResult) Columns() []string { return []string{"name", "id", "score"} }
+func (*testSQLResult) Close() error      { return nil }
+
+func (r *testSQLResult) Next(dest []driver.Value) error {
+	if r.next > r.hi || r.next >= testSQLRows {
+		return io.EOF
+	}
+	testSQL.Lock()
+	if testSQL.failures[r.next] > 0 {
+		testSQL.failures[r.next]--
+		testSQL.Unlock()
+		return temporaryError{}
+	}
+	testSQL.Unlock()
+	dest[0] = fmt.Sprint("row", r.next)
+	dest[1] = r.next
+	if r.next%10 == 0 {
+		dest[2] = nil
+	} else {
+		dest[2] = float64(r.next) / 2
+	}
+	r.next++
+	return nil
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "connection reset" }
+func (temporaryError) Temporary() bool { return true }
+
+func openTestSQL(ctx context.Context) (*sql.DB, error) {
+	return sql.Open("bigslicetest", "")
+}
+
+type testSQLRecord struct {
+	Name  string
+	ID    int64
+	Score *float64
+}
+
+func testSQLExpect(min, max int64) (names []string, ids []int64, scores []*float64) {
+	if min < 0 {
+		min = 0
+	}
+	for id := min; id <= max && id < testSQLRows; id++ {
+		names = append(names, fmt.Sprint("row", id))
+		ids = append(ids, id)
+		if id%10 == 0 {
+			scores = append(scores, nil)
+		} else {
+			score := float64(id) / 2
+			scores = append(scores, &score)
+		}
+	}
+	return
+}
+
+func TestReadSQL(t *testing.T) {
+	const query = "SELECT name, id, score FROM t WHERE {{range}} ORDER BY id"
+	for _, c := range []struct {
+		min, max int64
+		nshard   int
+	}{
+		{0, testSQLRows - 1, 1},
+		{0, testSQLRows - 1, 7},
+		{10, 19, 3},
+		{-5, 2, 20},
+	} {
+		slice := bigslice.ReadSQL(openTestSQL, query, "id", c.min, c.max, c.nshard, testSQLRecord{})
+		if got, want := slice.NumShard(), c.nshard; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		names, ids, scores := testSQLExpect(c.min, c.max)
+		assertEqual(t, slice, true, names, ids, scores)
+	}
+}
+
+func TestReadSQLRetry(t *testing.T) {
+	testSQL.Lock()
+	testSQL.failures[25] = 2
+	testSQL.failures[80] = 1
+	testSQL.Unlock()
+	policy := retry.MaxTries(retry.Backoff(time.Millisecond, 10*time.Millisecond, 2), 5)
+	slice := bigslice.ReadSQL(openTestSQL, "SELECT * FROM t WHERE {{range}}", "id", 0, testSQLRows-1, 4,
+		testSQLRecord{}, bigslice.ReadRetry(0, policy))
+	names, ids, scores := testSQLExpect(0, testSQLRows-1)
+	assertEqual(t, slice, true, names, ids, scores)
+}
+
+func TestReadSQLSnapshot(t *testing.T) {
+	const query = "SELECT name, id, score FROM t AS OF SYSTEM TIME '{{snapshot}}' WHERE {{range}}"
+	slice := bigslice.ReadSQL(openTestSQL, query, "id", 0, testSQLRows-1, 4, testSQLRecord{}).(bigslice.SnapshotSlice)
+	token, err := slice.Snapshot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = slice.SetSnapshot(token); err != nil {
+		t.Fatal(err)
+	}
+	testSQL.Lock()
+	testSQL.queries = nil
+	testSQL.Unlock()
+	names, ids, scores := testSQLExpect(0, testSQLRows-1)
+	assertEqual(t, slice, true, names, ids, scores)
+	testSQL.Lock()
+	defer testSQL.Unlock()
+	if len(testSQL.queries) == 0 {
+		t.Fatal("no queries")
+	}
+	for _, q := range testSQL.queries {
+		if want := fmt.Sprintf("AS OF SYSTEM TIME '%s'", token); !strings.Contains(q, want) {
+			t.Errorf("query %q does not read snapshot %s", q, token)
+		}
+	}
+
+	// Queries without the placeholder cannot provide snapshots.
+	slice = bigslice.ReadSQL(openTestSQL, "SELECT * FROM t WHERE {{range}}", "id", 0, 1, 1, testSQLRecord{}).(bigslice.SnapshotSlice)
+	if _, err = slice.Snapshot(context.Background()); !errors.Is(errors.NotSupported, err) {
+		t.Errorf("got %v, want not supported error", err)
+	}
+}
+
+func TestReadSQLType(t *testing.T) {
+	const query = "SELECT * FROM t WHERE {{range}}"
+	expectTypeError(t, `readsql: query "SELECT * FROM t" does not contain the placeholder {{range}}`, func() {
+		bigslice.ReadSQL(openTestSQL, "SELECT * FROM t", "id", 0, 1, 1, testSQLRecord{})
+	})
+	expectTypeError(t, "readsql: invalid key range [1, 0]", func() {
+		bigslice.ReadSQL(openTestSQL, query, "id", 1, 0, 1, testSQLRecord{})
+	})
+	expectTypeError(t, "readsql: invalid number of shards 0", func() {
+		bigslice.ReadSQL(openTestSQL, query, "id", 0, 1, 0, testSQLRecord{})
+	})
+	expectTypeError(t, "readsql: expected struct or pointer to struct, got int", func() {
+		bigslice.ReadSQL(openTestSQL, query, "id", 0, 1, 1, 0)
+	})
+	type record struct {
+		ID   int64
+		Tags map[string]string
+	}
+	expectTypeError(t, "readsql: field Tags has unsupported column type map[string]string", func() {
+		bigslice.ReadSQL(openTestSQL, query, "id", 0, 1, 1, record{})
+	})
+}
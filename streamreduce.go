@@ -0,0 +1,277 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/internal/defaultsize"
+	"github.com/grailbio/bigslice/slicefunc"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/slicetype"
+	"github.com/grailbio/bigslice/typecheck"
+)
+
+// A StreamOption configures the emission of partial results by
+// StreamReduce.
+type StreamOption func(s *streamReduceSlice)
+
+// PartialEvery is a StreamOption that emits partial results each time
+// a shard of the StreamReduce has combined another n rows.
+func PartialEvery(n int) StreamOption {
+	if n <= 0 {
+		typecheck.Panicf(1, "partialevery: invalid number of rows %d", n)
+	}
+	return func(s *streamReduceSlice) {
+		s.rows = n
+	}
+}
+
+// PartialInterval is a StreamOption that emits partial results at
+// most every d while a shard of the StreamReduce is combining rows.
+func PartialInterval(d time.Duration) StreamOption {
+	if d <= 0 {
+		typecheck.Panicf(1, "partialinterval: invalid interval %s", d)
+	}
+	return func(s *streamReduceSlice) {
+		s.interval = d
+	}
+}
+
+// PartialSink is a StreamOption that passes each partial emission of a
+// shard of the StreamReduce to sink as it is made, while the shard is
+// still combining rows. Since the rows of a slice are available to its
+// consumers only once the shard that produces them is complete, sinks
+// are the means by which partial results may feed, e.g., a live view.
+// Sink is invoked on the machine that computes the shard, with the
+// shard's index and a frame of its current partial aggregates, of the
+// StreamReduce's input type (without the partial column); the frame
+// is valid only for the duration of the call. An error returned by
+// sink fails the shard; unless the error is temporary, the failure is
+// fatal.
+func PartialSink(sink func(ctx context.Context, shard int, rows frame.Frame) error) StreamOption {
+	if sink == nil {
+		typecheck.Panic(1, "partialsink: nil sink")
+	}
+	return func(s *streamReduceSlice) {
+		s.sink = sink
+	}
+}
+
+// StreamReduce is a variant of Reduce that, in addition to the reduced
+// value of each key, emits partial results while the reduction is in
+// progress. Its slice has an additional boolean column that tells
+// whether the row is partial. Schematically:
+//
+//	StreamReduce(Slice<k, v>, func(v1, v2 v) v, opts...) Slice<k, v, bool>
+//
+// The options determine when partial results are emitted (see
+// PartialEvery and PartialInterval): each emission comprises, for
+// every key combined so far by the shard, its current partial
+// aggregate, and is marked partial. Once all of the shard's input is
+// combined, each key's final value is emitted once, and is not marked
+// partial. The final rows are the same as those of Reduce with the
+// same reducer; consumers that want only the final result should
+// filter out the partial rows.
+//
+// Like Reduce, StreamReduce combines values map-side. Partial results
+// thus reflect the progress of a reduce shard in combining the
+// (already combined) output of the shards of its dependency, and are
+// emitted only after its dependency is computed. The partial rows of
+// the slice, like its other rows, are available to consumers only once
+// their shard is complete; use PartialSink to observe partial results
+// while the reduction is in progress. StreamReduce maintains the
+// working set of each shard's keys in memory.
+func StreamReduce(slice Slice, reduce interface{}, opts ...StreamOption) Slice {
+	if res := slice.NumOut() - slice.Prefix(); res != 1 {
+		typecheck.Panicf(1, "streamreduce: the slice must have exactly 1 residual column; has %d", res)
+	}
+	if err := canMakeCombiningFrame(slice); err != nil {
+		typecheck.Panic(1, err.Error())
+	}
+	fn, ok := slicefunc.Of(reduce)
+	if !ok {
+		typecheck.Panicf(1, "streamreduce: invalid reduce function %T", reduce)
+	}
+	outputType := slice.Out(slice.NumOut() - 1)
+	if fn.In.NumOut() != 2 || fn.In.Out(0) != outputType || fn.In.Out(1) != outputType ||
+		fn.Out.NumOut() != 1 || fn.Out.Out(0) != outputType {
+		typecheck.Panicf(1, "streamreduce: invalid reduce function %T, expected func(%s, %s) %s", reduce, outputType, outputType, outputType)
+	}
+	s := &streamReduceSlice{
+		name:     MakeName("streamreduce"),
+		Slice:    slice,
+		out:      slicetype.Append(slice, slicetype.New(typeOfBool)),
+		combiner: fn,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+var typeOfBool = reflect.TypeOf(false)
+
+type streamReduceSlice struct {
+	name Name
+	Slice
+	out      slicetype.Type
+	combiner slicefunc.Func
+	// rows and interval determine when partial results are emitted;
+	// they are ignored if zero.
+	rows     int
+	interval time.Duration
+	// sink, if not nil, is passed partial emissions as they are made.
+	// See PartialSink.
+	sink func(ctx context.Context, shard int, rows frame.Frame) error
+}
+
+func (s *streamReduceSlice) Name() Name               { return s.name }
+func (s *streamReduceSlice) NumOut() int              { return s.out.NumOut() }
+func (s *streamReduceSlice) Out(i int) reflect.Type   { return s.out.Out(i) }
+func (*streamReduceSlice) NumDep() int                { return 1 }
+func (s *streamReduceSlice) Dep(i int) Dep            { return Dep{Slice: s.Slice, Shuffle: true, Expand: true} }
+func (s *streamReduceSlice) Combiner() slicefunc.Func { return s.combiner }
+
+func (s *streamReduceSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	return &streamReduceReader{op: s, shard: shard, readers: deps}
+}
+
+// partialTable is an in-memory table of the combined values of each
+// key.
+type partialTable struct {
+	combiner slicefunc.Func
+	// data holds the table's rows, followed by scratch space for the
+	// row being combined.
+	data frame.Frame
+	n    int
+	// index maps key hashes to the indices of the rows in data with
+	// that hash.
+	index map[uint32][]int
+	args  [2]reflect.Value
+}
+
+func newPartialTable(typ slicetype.Type, combiner slicefunc.Func) *partialTable {
+	return &partialTable{
+		combiner: combiner,
+		data:     frame.Make(typ, 0, defaultsize.Chunk),
+		index:    make(map[uint32][]int),
+	}
+}
+
+// Combine combines the rows of f into the table.
+func (t *partialTable) Combine(ctx context.Context, f frame.Frame) {
+	vcol := f.NumOut() - 1
+	for i := 0; i < f.Len(); i++ {
+		t.data = t.data.Ensure(t.n + 1)
+		frame.Copy(t.data.Slice(t.n, t.n+1), f.Slice(i, i+1))
+		hash := t.data.Hash(t.n)
+		var found bool
+		for _, j := range t.index[hash] {
+			if t.data.Less(j, t.n) || t.data.Less(t.n, j) {
+				continue
+			}
+			t.args[0] = t.data.Index(vcol, j)
+			t.args[1] = t.data.Index(vcol, t.n)
+			rvs := t.combiner.Call(ctx, t.args[:])
+			t.data.Index(vcol, j).Set(rvs[0])
+			found = true
+			break
+		}
+		if !found {
+			t.index[hash] = append(t.index[hash], t.n)
+			t.n++
+		}
+	}
+}
+
+// Rows returns the table's rows. The returned frame is valid until the
+// next call to Combine.
+func (t *partialTable) Rows() frame.Frame { return t.data.Slice(0, t.n) }
+
+type streamReduceReader struct {
+	op      *streamReduceSlice
+	shard   int
+	readers []sliceio.Reader
+	table   *partialTable
+	in      frame.Frame
+
+	// rows is the number of rows combined since the last emission, and
+	// last is the time of the last emission.
+	rows int
+	last time.Time
+
+	// emit are the rows that remain to be emitted in the current
+	// emission, and partial tells whether the emission is partial.
+	emit    frame.Frame
+	partial bool
+	eof     bool
+}
+
+func (r *streamReduceReader) Read(ctx context.Context, out frame.Frame) (int, error) {
+	if !slicetype.Assignable(out, r.op) {
+		return 0, errTypeError
+	}
+	if r.table == nil {
+		r.table = newPartialTable(r.op.Slice, r.op.combiner)
+		r.in = frame.Make(r.op.Slice, defaultsize.Chunk, defaultsize.Chunk)
+		r.last = time.Now()
+	}
+	for {
+		if r.emit.Len() > 0 {
+			n := out.Len()
+			if m := r.emit.Len(); m < n {
+				n = m
+			}
+			pcol := r.op.Slice.NumOut()
+			for col := 0; col < pcol; col++ {
+				reflect.Copy(out.Value(col), r.emit.Value(col))
+			}
+			partial := out.Interface(pcol).([]bool)
+			for i := 0; i < n; i++ {
+				partial[i] = r.partial
+			}
+			r.emit = r.emit.Slice(n, r.emit.Len())
+			return n, nil
+		}
+		if r.eof {
+			return 0, sliceio.EOF
+		}
+		if len(r.readers) == 0 {
+			r.eof = true
+			r.emit, r.partial = r.table.Rows(), false
+			continue
+		}
+		n, err := r.readers[0].Read(ctx, r.in)
+		r.table.Combine(ctx, r.in.Slice(0, n))
+		r.rows += n
+		switch {
+		case err == sliceio.EOF:
+			r.readers = r.readers[1:]
+		case err != nil:
+			return 0, err
+		}
+		if r.rows > 0 && (r.op.rows > 0 && r.rows >= r.op.rows ||
+			r.op.interval > 0 && time.Since(r.last) >= r.op.interval) {
+			r.emit, r.partial = r.table.Rows(), true
+			r.rows = 0
+			r.last = time.Now()
+			if r.op.sink != nil {
+				if err := r.op.sink(ctx, r.shard, r.emit); err != nil {
+					kind := errors.Fatal
+					if errors.IsTemporary(err) {
+						kind = errors.Temporary
+					}
+					return 0, errors.E(kind, fmt.Sprintf("%s: shard %d: partial sink", r.op.name, r.shard), err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grailbio/bigslice"
+	"github.com/grailbio/bigslice/exec"
+	"github.com/grailbio/bigslice/frame"
+)
+
+func TestStreamReduce(t *testing.T) {
+	const N = 100
+	ints := make([]int, N)
+	for i := range ints {
+		ints[i] = i
+	}
+	sum := func(x, y int) int { return x + y }
+	for m := 1; m < 5; m++ {
+		slice := bigslice.Const(m, ints)
+		slice = bigslice.Map(slice, func(x int) (string, int) {
+			return fmt.Sprint(x%3) + "x", x
+		})
+		slice = bigslice.StreamReduce(slice, sum, bigslice.PartialEvery(1), bigslice.PartialInterval(time.Hour))
+		if got, want := slice.Name().Op, "streamreduce"; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		final := bigslice.Filter(slice, func(key string, val int, partial bool) bool { return !partial })
+		final = bigslice.Map(final, func(key string, val int, partial bool) (string, int) { return key, val })
+		assertEqual(t, final, true, []string{"0x", "1x", "2x"}, []int{1683, 1617, 1650})
+
+		ctx := context.Background()
+		for name, scanner := range run(ctx, t, slice) {
+			var (
+				key      string
+				val      int
+				partial  bool
+				npartial int
+				want     = map[string]int{"0x": 1683, "1x": 1617, "2x": 1650}
+			)
+			for scanner.Scan(ctx, &key, &val, &partial) {
+				if !partial {
+					continue
+				}
+				npartial++
+				if val > want[key] {
+					t.Errorf("%s: key %s: partial value %d exceeds final value %d", name, key, val, want[key])
+				}
+			}
+			if err := scanner.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if npartial == 0 {
+				t.Errorf("%s: no partial results", name)
+			}
+		}
+	}
+}
+
+func TestStreamReducePartialSink(t *testing.T) {
+	const N = 100
+	ints := make([]int, N)
+	for i := range ints {
+		ints[i] = i
+	}
+	var (
+		ctx  = context.Background()
+		mu   sync.Mutex
+		sunk = make(map[string][]int)
+		sink = func(ctx context.Context, shard int, rows frame.Frame) error {
+			mu.Lock()
+			defer mu.Unlock()
+			keys, vals := rows.Interface(0).([]string), rows.Interface(1).([]int)
+			for i := range keys {
+				sunk[keys[i]] = append(sunk[keys[i]], vals[i])
+			}
+			return nil
+		}
+		want = map[string]int{"0x": 1683, "1x": 1617, "2x": 1650}
+	)
+	sess := exec.Start(exec.Local)
+	defer sess.Shutdown()
+	fn := bigslice.Func(func(sink func(context.Context, int, frame.Frame) error) bigslice.Slice {
+		slice := bigslice.Const(4, ints)
+		slice = bigslice.Map(slice, func(x int) (string, int) {
+			return fmt.Sprint(x%3) + "x", x
+		})
+		return bigslice.StreamReduce(slice, func(x, y int) int { return x + y },
+			bigslice.PartialEvery(1), bigslice.PartialInterval(time.Hour), bigslice.PartialSink(sink))
+	})
+	if _, err := sess.Run(ctx, fn, sink); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sunk) == 0 {
+		t.Fatal("no partial results were sunk")
+	}
+	for key, vals := range sunk {
+		for _, val := range vals {
+			if val > want[key] {
+				t.Errorf("key %s: partial value %d exceeds final value %d", key, val, want[key])
+			}
+		}
+	}
+
+	// Errors returned by the sink fail the reduction.
+	fn = bigslice.Func(func() bigslice.Slice {
+		slice := bigslice.Const(1, []string{"x"}, []int{1})
+		return bigslice.StreamReduce(slice, func(x, y int) int { return x + y },
+			bigslice.PartialEvery(1), bigslice.PartialSink(func(context.Context, int, frame.Frame) error {
+				return errors.New("sink failed")
+			}))
+	})
+	if _, err := sess.Run(ctx, fn); err == nil || !strings.Contains(err.Error(), "sink failed") {
+		t.Errorf("got %v, want sink error", err)
+	}
+}
+
+func TestStreamReduceError(t *testing.T) {
+	slice := bigslice.Const(1, []string{"x"}, []int{1}, []int{2})
+	expectTypeError(t, "streamreduce: the slice must have exactly 1 residual column; has 2", func() {
+		bigslice.StreamReduce(slice, func(x, y int) int { return x + y })
+	})
+	expectTypeError(t, "partialevery: invalid number of rows 0", func() {
+		bigslice.PartialEvery(0)
+	})
+	expectTypeError(t, "partialsink: nil sink", func() {
+		bigslice.PartialSink(nil)
+	})
+}
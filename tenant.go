@@ -0,0 +1,249 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"sort"
+
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/slicetype"
+	"github.com/grailbio/bigslice/typecheck"
+)
+
+// A TenantPartitioning assigns disjoint, contiguous ranges of
+// partitions to tenants, so that the data of each tenant are shuffled
+// only to the shards of its range, and tenants never share shards. A
+// TenantPartitioning is used by PartitionByTenant and ReduceByTenant,
+// and may also be used to route rows in custom slices (see
+// TenantPartitioning.Partitioner).
+//
+// Partitions are allocated to tenants in proportion to their volumes:
+// each tenant is allocated at least one partition, and the remaining
+// partitions are apportioned by volume, so that a tenant with 10 times
+// the volume of another is allocated roughly 10 times the partitions.
+// The last partition is shared by all tenants that were not allocated
+// partitions. Rows are hash-distributed among the partitions of their
+// tenant's range.
+type TenantPartitioning struct {
+	numShard   int
+	tenantType reflect.Type
+	ranges     map[interface{}]tenantRange
+}
+
+// tenantRange is the range of partitions [beg, end) allocated to a
+// tenant.
+type tenantRange struct{ beg, end int }
+
+// NewTenantPartitioning returns a TenantPartitioning of nshard
+// partitions among the tenants in the provided volumes, of type
+// map[K]V, where K is the type of the tenant IDs and V is a numeric
+// type. Each tenant's volume, e.g., its expected number of rows,
+// determines its share of the partitions; volumes need only be
+// relative. K must be a numeric or string type, so that the
+// partitioning is deterministic. Since each tenant is allocated at
+// least one partition, and one partition is shared by all other
+// tenants, nshard must exceed the number of tenants.
+func NewTenantPartitioning(nshard int, volumes interface{}) *TenantPartitioning {
+	volumesv := reflect.ValueOf(volumes)
+	if volumesv.Kind() != reflect.Map {
+		typecheck.Panicf(1, "tenantpartitioning: volumes of type %T is not a map", volumes)
+	}
+	var (
+		tenantType = volumesv.Type().Key()
+		volumeType = volumesv.Type().Elem()
+	)
+	less, err := lessFunc(tenantType)
+	if err != nil {
+		typecheck.Panicf(1, "tenantpartitioning: %v", err)
+	}
+	if _, err := lessFunc(volumeType); err != nil || volumeType.Kind() == reflect.String {
+		typecheck.Panicf(1, "tenantpartitioning: volumes of type %s are not numeric", volumeType)
+	}
+	if ntenant := volumesv.Len(); nshard <= ntenant {
+		typecheck.Panicf(1, "tenantpartitioning: %d partitions cannot be allocated among %d tenants and others", nshard, ntenant)
+	}
+	tenants := volumesv.MapKeys()
+	sort.Slice(tenants, func(i, j int) bool { return less(tenants[i], tenants[j]) })
+	var (
+		vols  = make([]float64, len(tenants))
+		total float64
+	)
+	for i, tenant := range tenants {
+		v := volumesv.MapIndex(tenant)
+		switch volumeType.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			vols[i] = float64(v.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			vols[i] = float64(v.Uint())
+		default:
+			vols[i] = v.Float()
+		}
+		if !(vols[i] >= 0) || math.IsInf(vols[i], 0) {
+			typecheck.Panicf(1, "tenantpartitioning: tenant %v has invalid volume %v", tenant, v)
+		}
+		total += vols[i]
+	}
+	counts := apportion(nshard-1-len(tenants), vols, total)
+	p := &TenantPartitioning{
+		numShard:   nshard,
+		tenantType: tenantType,
+		ranges:     make(map[interface{}]tenantRange, len(tenants)),
+	}
+	var beg int
+	for i, tenant := range tenants {
+		end := beg + 1 + counts[i]
+		p.ranges[tenant.Interface()] = tenantRange{beg, end}
+		beg = end
+	}
+	return p
+}
+
+// apportion apportions n items in proportion to the provided weights,
+// which sum to total, by the largest remainder method. Ties are broken
+// in favor of earlier weights. If total is zero, the items are
+// apportioned evenly.
+func apportion(n int, weights []float64, total float64) []int {
+	counts := make([]int, len(weights))
+	if len(weights) == 0 {
+		return counts
+	}
+	var (
+		remainders = make([]float64, len(weights))
+		assigned   int
+	)
+	for i, w := range weights {
+		quota := float64(n) / float64(len(weights))
+		if total > 0 {
+			quota = float64(n) * w / total
+		}
+		counts[i] = int(quota)
+		remainders[i] = quota - float64(counts[i])
+		assigned += counts[i]
+	}
+	order := make([]int, len(weights))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return remainders[order[i]] > remainders[order[j]] })
+	for i := 0; assigned < n; i++ {
+		counts[order[i%len(order)]]++
+		assigned++
+	}
+	return counts
+}
+
+// NumShard returns the number of partitions of p.
+func (p *TenantPartitioning) NumShard() int { return p.numShard }
+
+// Range returns the range of partitions [beg, end) allocated to the
+// provided tenant. Tenants that were not allocated partitions share
+// the last partition.
+func (p *TenantPartitioning) Range(tenant interface{}) (beg, end int) {
+	if r, ok := p.ranges[tenant]; ok {
+		return r.beg, r.end
+	}
+	return p.numShard - 1, p.numShard
+}
+
+// Partitioner returns a Partitioner that routes each row to the range
+// of partitions of the tenant in column tenantCol of the row, and,
+// within the range, by the hash of the row's prefix columns, as
+// Reshuffle. The partitioner must be used to partition p.NumShard()
+// partitions.
+func (p *TenantPartitioning) Partitioner(tenantCol int) Partitioner {
+	return func(ctx context.Context, frame frame.Frame, nshard int, shards []int) {
+		if nshard != p.numShard {
+			panic("tenantpartitioning: partitioner used for a different number of partitions")
+		}
+		for i := range shards {
+			beg, end := p.Range(frame.Index(tenantCol, i).Interface())
+			shards[i] = beg + int(frame.Hash(i)%uint32(end-beg))
+		}
+	}
+}
+
+// typecheckTenant checks that column tenantCol of the provided slice
+// holds the tenants of p, panicking with a type error attributed to
+// the caller of the caller of typecheckTenant if it does not.
+func (p *TenantPartitioning) typecheckTenant(op string, slice Slice, tenantCol int) {
+	if tenantCol < 0 || tenantCol >= slice.NumOut() {
+		typecheck.Panicf(2, "%s: invalid tenant column %d for slice type %s", op, tenantCol, slicetype.String(slice))
+	}
+	if got, want := slice.Out(tenantCol), p.tenantType; got != want {
+		typecheck.Panicf(2, "%s: tenant column %d has type %s; expected %s", op, tenantCol, got, want)
+	}
+}
+
+type partitionByTenantSlice struct {
+	reshuffleSlice
+	numShard int
+}
+
+// PartitionByTenant returns a slice that partitions the rows of the
+// provided slice by tenant, so that each tenant's rows are placed in
+// the shards of the range allocated to the tenant by p, and tenants
+// never share shards: a tenant with a large volume of data thus cannot
+// starve a small tenant whose shards it would otherwise share. Within
+// a tenant's range, rows are distributed by the hash of their prefix
+// columns, as by Reshuffle. The tenant of each row is the value of
+// its column tenantCol, which must be of p's tenant type. The returned
+// slice has p.NumShard() shards, and the same type as the input.
+// Rows are not sorted within a shard.
+//
+// Subsequent shuffles, e.g., by Reduce, distribute rows among all of
+// the shards of the shuffled slice without regard to their tenants.
+// To maintain isolation, use ReduceByTenant in place of Reduce.
+func PartitionByTenant(slice Slice, tenantCol int, p *TenantPartitioning) Slice {
+	p.typecheckTenant("partitionbytenant", slice, tenantCol)
+	if err := canMakeCombiningFrame(slice); err != nil {
+		typecheck.Panic(1, err.Error())
+	}
+	return &partitionByTenantSlice{
+		reshuffleSlice{MakeName("partitionbytenant"), p.Partitioner(tenantCol), slice},
+		p.NumShard(),
+	}
+}
+
+func (p *partitionByTenantSlice) NumShard() int { return p.numShard }
+
+type reduceByTenantSlice struct {
+	*reduceSlice
+	numShard    int
+	partitioner Partitioner
+}
+
+// ReduceByTenant is a variant of Reduce that keeps tenants isolated:
+// the keys of each tenant are reduced only by the shards of the range
+// allocated to the tenant by p, instead of by any shard. The tenant of
+// each row is the value of its column tenantCol, which must be a key
+// column of the slice, so that all of the rows of a key belong to the
+// same tenant, and must be of p's tenant type. The returned slice has
+// p.NumShard() shards, and shard i holds the reduced rows of the
+// tenant whose range, as returned by p.Range, includes i. Map-side
+// combining, as well as the reduction itself, is as for Reduce.
+// Schematically:
+//
+//	ReduceByTenant(Slice<k1, k2, v>, tenantCol, p, func(v1, v2 v) v) Slice<k1, k2, v>
+func ReduceByTenant(slice Slice, tenantCol int, p *TenantPartitioning, reduce interface{}) Slice {
+	p.typecheckTenant("reducebytenant", slice, tenantCol)
+	if tenantCol >= slice.Prefix() {
+		typecheck.Panicf(1, "reducebytenant: tenant column %d is not a key column of slice %s with %d key columns",
+			tenantCol, slicetype.String(slice), slice.Prefix())
+	}
+	r := Reduce(slice, reduce).(*reduceSlice)
+	r.name = MakeName("reducebytenant")
+	return &reduceByTenantSlice{r, p.NumShard(), p.Partitioner(tenantCol)}
+}
+
+func (r *reduceByTenantSlice) NumShard() int { return r.numShard }
+
+func (r *reduceByTenantSlice) Dep(i int) Dep {
+	dep := r.reduceSlice.Dep(i)
+	dep.Partitioner = r.partitioner
+	return dep
+}
@@ -0,0 +1,150 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/grailbio/bigslice"
+	"github.com/grailbio/bigslice/sliceio"
+)
+
+func TestTenantPartitioning(t *testing.T) {
+	p := bigslice.NewTenantPartitioning(20, map[string]int{"big": 1000, "medium": 100, "small": 1, "idle": 0})
+	if got, want := p.NumShard(), 20; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, test := range []struct {
+		tenant   interface{}
+		beg, end int
+	}{
+		// Tenants are allocated ranges in tenant order; "big" receives
+		// 14 of the 15 partitions that remain once each tenant has one.
+		{"big", 0, 15},
+		{"idle", 15, 16},
+		{"medium", 16, 18},
+		{"small", 18, 19},
+		{"other", 19, 20},
+	} {
+		beg, end := p.Range(test.tenant)
+		if beg != test.beg || end != test.end {
+			t.Errorf("%s: got [%d, %d), want [%d, %d)", test.tenant, beg, end, test.beg, test.end)
+		}
+	}
+	// Without volumes, partitions are allocated evenly.
+	p = bigslice.NewTenantPartitioning(7, map[int]float64{1: 0, 2: 0, 3: 0})
+	for tenant, want := range map[int][2]int{1: {0, 2}, 2: {2, 4}, 3: {4, 6}} {
+		if beg, end := p.Range(tenant); beg != want[0] || end != want[1] {
+			t.Errorf("%d: got [%d, %d), want %v", tenant, beg, end, want)
+		}
+	}
+}
+
+func TestPartitionByTenant(t *testing.T) {
+	const N = 1000
+	var (
+		ids     = make([]string, N)
+		keys    = make([]string, N)
+		tenants = make([]string, N)
+		ones    = make([]int, N)
+	)
+	for i := range ids {
+		ids[i] = fmt.Sprint(i)
+		keys[i] = fmt.Sprint(i % 50)
+		switch {
+		case i%10 == 0:
+			tenants[i] = "small"
+		case i%50 == 1:
+			tenants[i] = "unknown"
+		default:
+			tenants[i] = "big"
+		}
+		ones[i] = 1
+	}
+	p := bigslice.NewTenantPartitioning(8, map[string]int{"big": 90, "small": 10})
+	// checkTenants checks that each shard of the provided slice, with
+	// tenants in its second column, holds only rows of the tenants
+	// whose ranges include the shard.
+	checkTenants := func(slice bigslice.Slice) {
+		t.Helper()
+		scanned := bigslice.Scan(slice, func(shard int, scanner *sliceio.Scanner) error {
+			var (
+				key, tenant string
+				n           int
+			)
+			for scanner.Scan(context.Background(), &key, &tenant, &n) {
+				if beg, end := p.Range(tenant); shard < beg || shard >= end {
+					return fmt.Errorf("tenant %s in shard %d, outside of [%d, %d)", tenant, shard, beg, end)
+				}
+			}
+			return scanner.Err()
+		})
+		for name, res := range runError(context.Background(), t, scanned) {
+			if res.Err != nil {
+				t.Errorf("%s: %v", name, res.Err)
+			}
+		}
+	}
+
+	slice := bigslice.PartitionByTenant(bigslice.Const(5, ids, tenants, ones), 1, p)
+	if got, want := slice.NumShard(), 8; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	checkTenants(slice)
+	// assertEqual sorts the expected columns in place, so we pass copies.
+	assertEqual(t, slice, true,
+		append([]string{}, ids...), append([]string{}, tenants...), append([]int{}, ones...))
+
+	// Keys are reduced within their tenants' ranges.
+	slice = bigslice.Prefixed(bigslice.Const(5, keys, tenants, ones), 2)
+	slice = bigslice.ReduceByTenant(slice, 1, p, func(a, b int) int { return a + b })
+	if got, want := slice.NumShard(), 8; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	checkTenants(slice)
+	var (
+		wantKeys    = make([]string, 50)
+		wantTenants = make([]string, 50)
+		wantCounts  = make([]int, 50)
+	)
+	for i := range wantKeys {
+		wantKeys[i] = keys[i]
+		wantTenants[i] = tenants[i]
+		wantCounts[i] = N / 50
+	}
+	assertEqual(t, slice, true, wantKeys, wantTenants, wantCounts)
+}
+
+func TestTenantPartitioningError(t *testing.T) {
+	p := bigslice.NewTenantPartitioning(3, map[string]int{"a": 1})
+	slice := bigslice.Const(1, []string{"a"}, []int{1})
+	expectTypeError(t, "tenantpartitioning: volumes of type []int is not a map", func() {
+		bigslice.NewTenantPartitioning(3, []int{1})
+	})
+	expectTypeError(t, "tenantpartitioning: cannot compare values of type *int", func() {
+		bigslice.NewTenantPartitioning(3, map[*int]int{})
+	})
+	expectTypeError(t, "tenantpartitioning: volumes of type string are not numeric", func() {
+		bigslice.NewTenantPartitioning(3, map[string]string{})
+	})
+	expectTypeError(t, "tenantpartitioning: 2 partitions cannot be allocated among 2 tenants and others", func() {
+		bigslice.NewTenantPartitioning(2, map[string]int{"a": 1, "b": 1})
+	})
+	expectTypeError(t, "tenantpartitioning: tenant a has invalid volume -1", func() {
+		bigslice.NewTenantPartitioning(3, map[string]int{"a": -1})
+	})
+	expectTypeError(t, "partitionbytenant: invalid tenant column 2 for slice type slice[1]string,int", func() {
+		bigslice.PartitionByTenant(slice, 2, p)
+	})
+	expectTypeError(t, "partitionbytenant: tenant column 1 has type int; expected string", func() {
+		bigslice.PartitionByTenant(slice, 1, p)
+	})
+	expectTypeError(t, "reducebytenant: tenant column 1 is not a key column of slice slice[1]int,string,int with 1 key columns", func() {
+		slice := bigslice.Const(1, []int{1}, []string{"a"}, []int{1})
+		bigslice.ReduceByTenant(slice, 1, p, func(a, b int) int { return a + b })
+	})
+}
@@ -0,0 +1,364 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+	"strings"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/traverse"
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/slicefunc"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/slicetype"
+	"github.com/grailbio/bigslice/typecheck"
+)
+
+// textSplitSize is the target size, in bytes, of each shard of an
+// uncompressed text file read by ReadTextFiles.
+var textSplitSize int64 = 64 << 20
+
+// gzipMagic is the magic number that begins every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// A textSplit is a byte range of a text file that is read by a single
+// shard. Compressed files are never split: their splits cover the whole
+// file.
+type textSplit struct {
+	path     string
+	beg, end int64
+	gzip     bool
+}
+
+type textFilesSlice struct {
+	name Name
+	Pragmas
+	slicetype.Type
+	splits []textSplit
+	parse  slicefunc.Func
+	// parseErr is true if the parse function returns an error as its
+	// last value.
+	parseErr bool
+}
+
+// ReadTextFiles returns a slice that reads the lines of the text files
+// at the provided paths. Gzip-compressed files cannot be split, and are
+// thus read by one shard per file; uncompressed files are split by byte
+// ranges (at line boundaries) into shards of approximately 64MB each. A
+// file is taken to be compressed if its name ends in ".gz", or if its
+// content begins with the gzip magic number. The number of shards is
+// thus derived from the provided set of files, which ReadTextFiles
+// inspects when it is called.
+//
+// If parse is nil, the returned slice has a single string column
+// containing the lines of the files, without line terminators.
+// Otherwise, parse is invoked for each line to produce a row, and must
+// be of the form:
+//
+//	func(line string) (col1 col1Type, ..., colN colNType)
+//
+// optionally returning an error as its last value, in which case the
+// error is reported (along with the file name and line number) as a
+// fatal error of the slice. Errors reading the files are also reported
+// with the file name.
+//
+// Schematically:
+//
+//	ReadTextFiles(ctx, paths, func(line string) (t1, ..., tn)) Slice<t1, ..., tn>
+//
+// ReadTextFiles uses GRAIL's file library, so paths may refer to URLs
+// to a distributed object store such as S3. Use the ReadRetry pragma to
+// retry reads that hang or fail transiently.
+func ReadTextFiles(ctx context.Context, paths []string, parse interface{}, prags ...Pragma) Slice {
+	s := new(textFilesSlice)
+	s.name = MakeName("readtextfiles")
+	s.Pragmas = prags
+	if len(paths) == 0 {
+		typecheck.Panic(1, "readtextfiles: no paths provided")
+	}
+	if parse == nil {
+		s.Type = slicetype.New(typeOfString)
+	} else {
+		fn, ok := slicefunc.Of(parse)
+		if !ok || fn.In.NumOut() != 1 || fn.In.Out(0) != typeOfString {
+			typecheck.Panicf(1, "readtextfiles: invalid parse function %T; must be func(line string) (...)", parse)
+		}
+		out := slicetype.Columns(fn.Out)
+		if n := len(out); n > 0 && out[n-1] == typeOfError {
+			s.parseErr = true
+			out = out[:n-1]
+		}
+		if len(out) == 0 {
+			typecheck.Panicf(1, "readtextfiles: parse function %T must return at least one column", parse)
+		}
+		s.Type = slicetype.New(out...)
+		s.parse = fn
+	}
+	var err error
+	if s.splits, err = splitTextFiles(ctx, paths); err != nil {
+		typecheck.Panicf(1, "readtextfiles: %v", err)
+	}
+	return s
+}
+
+// splitTextFiles computes the splits for the text files at the provided
+// paths, in order.
+func splitTextFiles(ctx context.Context, paths []string) ([]textSplit, error) {
+	splits := make([][]textSplit, len(paths))
+	err := traverse.Limit(10*runtime.NumCPU()).Each(len(paths), func(i int) (err error) {
+		splits[i], err = splitTextFile(ctx, paths[i])
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	var all []textSplit
+	for _, fileSplits := range splits {
+		all = append(all, fileSplits...)
+	}
+	return all, nil
+}
+
+// splitTextFile computes the splits for the text file at the provided path.
+func splitTextFile(ctx context.Context, path string) (splits []textSplit, err error) {
+	f, err := file.Open(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.CloseAndReport(ctx, f, &err)
+	info, err := f.Stat(ctx)
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	compressed := strings.HasSuffix(path, ".gz")
+	if !compressed && size >= int64(len(gzipMagic)) {
+		magic := make([]byte, len(gzipMagic))
+		if _, err = io.ReadFull(f.Reader(ctx), magic); err != nil {
+			return nil, errors.E(fmt.Sprintf("reading %s", path), err)
+		}
+		compressed = bytes.Equal(magic, gzipMagic)
+	}
+	if compressed || size <= textSplitSize {
+		return []textSplit{{path, 0, size, compressed}}, nil
+	}
+	for beg := int64(0); beg < size; beg += textSplitSize {
+		end := beg + textSplitSize
+		if end > size {
+			end = size
+		}
+		splits = append(splits, textSplit{path, beg, end, false})
+	}
+	return splits, nil
+}
+
+func (s *textFilesSlice) Name() Name             { return s.name }
+func (s *textFilesSlice) NumShard() int          { return len(s.splits) }
+func (*textFilesSlice) ShardType() ShardType     { return HashShard }
+func (*textFilesSlice) NumDep() int              { return 0 }
+func (*textFilesSlice) Dep(i int) Dep            { panic("no deps") }
+func (*textFilesSlice) Combiner() slicefunc.Func { return slicefunc.Nil }
+
+// Locality implements LocalitySlice.
+func (s *textFilesSlice) Locality(shard int) []string { return localityOf(s.Pragmas, shard) }
+
+// Snapshot implements SnapshotSlice. Files are read in place, and so
+// cannot provide stable snapshots.
+func (s *textFilesSlice) Snapshot(ctx context.Context) (interface{}, error) {
+	return nil, errors.E(errors.NotSupported, fmt.Sprintf("%s: files do not support snapshots", s.name))
+}
+
+// SetSnapshot implements SnapshotSlice.
+func (s *textFilesSlice) SetSnapshot(token interface{}) error {
+	return errors.E(errors.NotSupported, fmt.Sprintf("%s: files do not support snapshots", s.name))
+}
+
+func (s *textFilesSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	return withReadRateLimit(s.Pragmas, len(s.splits), withReadRetry(s.Pragmas, s.name, shard, func() sliceio.Reader {
+		return &textFilesReader{op: s, shard: shard, split: s.splits[shard]}
+	}))
+}
+
+type textFilesReader struct {
+	op    *textFilesSlice
+	shard int
+	split textSplit
+
+	file   file.File
+	closer io.Closer
+	r      *bufio.Reader
+	// pos is the offset in the (uncompressed) file of the next line to
+	// be read; lineStart is the offset of the last line read, and line
+	// its (1-based) number within the split.
+	pos       int64
+	lineStart int64
+	line      int
+	err       error
+}
+
+// open opens the file of the reader's split and positions the reader at
+// the beginning of the first line of the split.
+func (r *textFilesReader) open(ctx context.Context) error {
+	var err error
+	r.file, err = file.Open(ctx, r.split.path)
+	if err != nil {
+		return err
+	}
+	rs := r.file.Reader(ctx)
+	if r.split.gzip {
+		gz, err := gzip.NewReader(rs)
+		if err != nil {
+			return err
+		}
+		r.closer = gz
+		r.r = bufio.NewReader(gz)
+		return nil
+	}
+	r.pos = r.split.beg
+	if r.split.beg > 0 {
+		// The first line of the split is the first line that begins
+		// at or after its beginning. We seek to just before the beginning
+		// of the split and discard through the end of the (partial) line.
+		if _, err = rs.Seek(r.split.beg-1, io.SeekStart); err != nil {
+			return err
+		}
+		r.r = bufio.NewReader(rs)
+		skipped, err := r.r.ReadString('\n')
+		r.pos += int64(len(skipped)) - 1
+		if err != nil && err != io.EOF {
+			return err
+		}
+		return nil
+	}
+	r.r = bufio.NewReader(rs)
+	return nil
+}
+
+func (r *textFilesReader) close(ctx context.Context) {
+	if r.closer != nil {
+		_ = r.closer.Close()
+	}
+	if r.file != nil {
+		_ = r.file.Close(ctx)
+	}
+}
+
+// readLine reads the next line of the split, returning sliceio.EOF
+// when no more lines are available.
+func (r *textFilesReader) readLine() (string, error) {
+	if !r.split.gzip && r.pos >= r.split.end {
+		return "", sliceio.EOF
+	}
+	line, err := r.r.ReadString('\n')
+	r.lineStart = r.pos
+	r.pos += int64(len(line))
+	if err == io.EOF {
+		if line == "" {
+			return "", sliceio.EOF
+		}
+		err = nil
+	}
+	r.line++
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), err
+}
+
+// location describes the position of the last line read, for error
+// messages. Lines are numbered from the beginning of the file: the
+// lines that precede a split that does not begin the file are counted
+// by reading the file up to the line, which is done only to report
+// errors. If they cannot be counted, the line number is given relative
+// to the split, and labeled with the split's offset.
+func (r *textFilesReader) location(ctx context.Context) string {
+	if r.split.gzip || r.split.beg == 0 {
+		return fmt.Sprintf("line %d (offset %d)", r.line, r.lineStart)
+	}
+	n, err := countLines(ctx, r.split.path, r.lineStart)
+	if err != nil {
+		return fmt.Sprintf("line %d of split at offset %d (offset %d)", r.line, r.split.beg, r.lineStart)
+	}
+	return fmt.Sprintf("line %d (offset %d)", n+1, r.lineStart)
+}
+
+// countLines returns the number of lines terminated in the first n
+// bytes of the (uncompressed) file at the provided path.
+func countLines(ctx context.Context, path string, n int64) (count int, err error) {
+	f, err := file.Open(ctx, path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if closeErr := f.Close(ctx); err == nil {
+			err = closeErr
+		}
+	}()
+	r := bufio.NewReader(io.LimitReader(f.Reader(ctx), n))
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(chunk) > 0 && chunk[len(chunk)-1] == '\n' {
+			count++
+		}
+		switch err {
+		case nil, bufio.ErrBufferFull:
+		case io.EOF:
+			return count, nil
+		default:
+			return 0, err
+		}
+	}
+}
+
+func (r *textFilesReader) Read(ctx context.Context, out frame.Frame) (n int, err error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if !slicetype.Assignable(out, r.op) {
+		return 0, errTypeError
+	}
+	defer func() {
+		if err != nil {
+			if err != sliceio.EOF {
+				err = errors.E(fmt.Sprintf("reading %s", r.split.path), err)
+			}
+			r.err = err
+			r.close(ctx)
+		}
+	}()
+	if r.r == nil {
+		if err = r.open(ctx); err != nil {
+			return 0, missingShard(ctx, r.op.Pragmas, r.op.name, r.shard, len(r.op.splits), r.split.path, err)
+		}
+	}
+	for n < out.Len() {
+		line, err := r.readLine()
+		if err != nil {
+			return n, err
+		}
+		if r.op.parse.IsNil() {
+			out.Index(0, n).SetString(line)
+			n++
+			continue
+		}
+		rvs := r.op.parse.Call(ctx, []reflect.Value{reflect.ValueOf(line)})
+		if r.op.parseErr {
+			if e := rvs[len(rvs)-1].Interface(); e != nil {
+				return n, errors.E(errors.Fatal, r.location(ctx), e.(error))
+			}
+		}
+		for j := 0; j < out.NumOut(); j++ {
+			out.Index(j, n).Set(rvs[j])
+		}
+		n++
+	}
+	return n, nil
+}
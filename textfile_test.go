@@ -0,0 +1,178 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/testutil"
+)
+
+// readTextFilesSlice reads all shards of the provided slice, returning
+// the first column of each row, sorted, and the first error that occurred.
+func readTextFilesSlice(ctx context.Context, t *testing.T, slice Slice) ([]string, error) {
+	t.Helper()
+	var lines []string
+	for shard := 0; shard < slice.NumShard(); shard++ {
+		r := slice.Reader(shard, nil)
+		f := frame.Make(slice, 3, 3)
+		for {
+			n, err := r.Read(ctx, f)
+			for i := 0; i < n; i++ {
+				lines = append(lines, fmt.Sprint(f.Index(0, i).Interface()))
+			}
+			if err == sliceio.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	sort.Strings(lines)
+	return lines, nil
+}
+
+func TestReadTextFiles(t *testing.T) {
+	dir, cleanUp := testutil.TempDir(t, "", "")
+	defer cleanUp()
+	defer func(size int64) { textSplitSize = size }(textSplitSize)
+	textSplitSize = 10
+
+	var (
+		want  []string
+		plain bytes.Buffer
+		gz    bytes.Buffer
+	)
+	w := gzip.NewWriter(&gz)
+	for i := 0; i < 100; i++ {
+		line := strconv.Itoa(i)
+		want = append(want, line)
+		if i%2 == 0 {
+			fmt.Fprintln(&plain, line)
+		} else {
+			fmt.Fprintln(w, line)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(want)
+	var (
+		plainPath = filepath.Join(dir, "plain.txt")
+		gzPath    = filepath.Join(dir, "compressed.txt.gz")
+		magicPath = filepath.Join(dir, "compressed")
+	)
+	if err := ioutil.WriteFile(plainPath, plain.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Compression is detected both by extension and by magic number.
+	for _, path := range []string{gzPath, magicPath} {
+		if err := ioutil.WriteFile(path, gz.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	slice := ReadTextFiles(ctx, []string{plainPath, gzPath}, nil)
+	if got, want := slice.NumShard(), (plain.Len()+9)/10+1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	got, err := readTextFilesSlice(ctx, t, slice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	slice = ReadTextFiles(ctx, []string{plainPath, magicPath}, func(line string) (int, error) {
+		return strconv.Atoi(line)
+	})
+	if got, want := slice.Out(0), typeOfInt; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	got, err = readTextFilesSlice(ctx, t, slice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestReadTextFilesError(t *testing.T) {
+	dir, cleanUp := testutil.TempDir(t, "", "")
+	defer cleanUp()
+	path := filepath.Join(dir, "bad.txt")
+	if err := ioutil.WriteFile(path, []byte("1\n2\nx\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	slice := ReadTextFiles(ctx, []string{path}, func(line string) (int, error) {
+		return strconv.Atoi(line)
+	})
+	_, err := readTextFilesSlice(ctx, t, slice)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if msg := err.Error(); !strings.Contains(msg, path) || !strings.Contains(msg, "line 3") {
+		t.Errorf("error %q does not include file name and line", msg)
+	}
+
+	// Lines are numbered from the beginning of the file, also in splits
+	// that begin within it.
+	defer func(size int64) { textSplitSize = size }(textSplitSize)
+	textSplitSize = 10
+	var (
+		lines  bytes.Buffer
+		offset int
+	)
+	for i := 1; i <= 20; i++ {
+		line := fmt.Sprintln(i)
+		if i == 15 {
+			offset = lines.Len()
+			line = "x\n"
+		}
+		lines.WriteString(line)
+	}
+	if err := ioutil.WriteFile(path, lines.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	slice = ReadTextFiles(ctx, []string{path}, func(line string) (int, error) {
+		return strconv.Atoi(line)
+	})
+	if slice.NumShard() < 2 {
+		t.Fatalf("expected file to be split, got %d shards", slice.NumShard())
+	}
+	_, err = readTextFilesSlice(ctx, t, slice)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if msg, want := err.Error(), fmt.Sprintf("line 15 (offset %d)", offset); !strings.Contains(msg, want) {
+		t.Errorf("error %q does not include %q", msg, want)
+	}
+
+	func() {
+		defer func() {
+			if e := recover(); e == nil {
+				t.Error("expected panic")
+			}
+		}()
+		ReadTextFiles(context.Background(), []string{path}, func(x int) int { return x })
+	}()
+}
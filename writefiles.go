@@ -0,0 +1,243 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/slicefunc"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/typecheck"
+)
+
+var typeOfWriter = reflect.TypeOf((*io.Writer)(nil)).Elem()
+
+type writeFilesSlice struct {
+	name Name
+	Slice
+	prefix string
+	write  slicefunc.Func
+	opts   writeOptions
+}
+
+// WriteFiles returns a slice that is functionally equivalent to the input
+// slice, writing each shard to a file named "prefix-nnnn-of-mmmm" as a side
+// effect. The provided write function must be of the form:
+//
+//	func(w io.Writer, col1 []col1Type, col2 []col2Type, ..., colN []colNType) error
+//
+// where the input slice is of the form:
+//
+//	Slice<col1Type, col2Type, ..., colNType>
+//
+// The write function is invoked with every read of the input slice, and
+// should encode the provided rows to w. As with WriterFunc, the column
+// slices share memory with the read frame and must not be retained.
+//
+// WriteFiles provides exactly-once output despite task retries: each
+// task attempt writes its shard to a temporary file that is unique to the
+// attempt, and the temporary file is moved to its final path only once
+// the executor has confirmed that the attempt succeeded. Failed attempts
+// remove their temporary files. See sliceio.Committer for the contract
+// that custom sinks must follow to provide the same guarantee.
+//
+// WriteFiles may be configured by the provided options; for example,
+// WriteStats writes a sidecar file of column statistics for each
+// shard.
+//
+// WriteFiles uses GRAIL's file library, so prefix may refer to URLs to a
+// distributed object store such as S3.
+func WriteFiles(slice Slice, prefix string, write interface{}, opts ...WriteOption) Slice {
+	colTypElems := make([]string, slice.NumOut())
+	for i := range colTypElems {
+		colTypElems[i] = fmt.Sprintf("col%d %s", i+1, reflect.SliceOf(slice.Out(i)).String())
+	}
+	expectTyp := fmt.Sprintf("func(w io.Writer, %s) error", strings.Join(colTypElems, ", "))
+	fn, ok := slicefunc.Of(write)
+	if !ok || fn.In.NumOut() != 1+slice.NumOut() || fn.In.Out(0) != typeOfWriter {
+		typecheck.Panicf(1, "writefiles: invalid write function type %T; must be %s", write, expectTyp)
+	}
+	for i := 0; i < slice.NumOut(); i++ {
+		if reflect.SliceOf(slice.Out(i)) != fn.In.Out(i+1) {
+			typecheck.Panicf(1, "writefiles: invalid write function type %T; must be %s", write, expectTyp)
+		}
+	}
+	if fn.Out.NumOut() != 1 || fn.Out.Out(0) != typeOfError {
+		typecheck.Panicf(1, "writefiles: invalid write function type %T; must return error", write)
+	}
+	return &writeFilesSlice{MakeName("writefiles"), slice, prefix, fn, makeWriteOptions(opts)}
+}
+
+func (s *writeFilesSlice) Name() Name             { return s.name }
+func (*writeFilesSlice) NumDep() int              { return 1 }
+func (s *writeFilesSlice) Dep(i int) Dep          { return singleDep(i, s.Slice, false) }
+func (*writeFilesSlice) Combiner() slicefunc.Func { return slicefunc.Nil }
+
+func (s *writeFilesSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	path := fmt.Sprintf("%s-%04d-of-%04d", s.prefix, shard, s.NumShard())
+	r := &writeFilesReader{
+		op:      s,
+		reader:  deps[0],
+		path:    path,
+		tmpPath: fmt.Sprintf("%s.attempt-%016x", path, rand.Uint64()),
+	}
+	if s.opts.stats {
+		r.stats = newStatsAccumulator(s)
+	}
+	return r
+}
+
+// writeFilesReader writes a shard to a temporary file for the current
+// task attempt. It implements sliceio.Committer: the temporary file is
+// moved to its final path on Commit.
+type writeFilesReader struct {
+	op      *writeFilesSlice
+	reader  sliceio.Reader
+	path    string
+	tmpPath string
+	file    file.File
+	w       io.Writer
+	closed  bool
+	err     error
+	// stats accumulates the statistics of the written rows, if they
+	// are to be written.
+	stats *statsAccumulator
+}
+
+var _ sliceio.Committer = (*writeFilesReader)(nil)
+
+func (r *writeFilesReader) Read(ctx context.Context, out frame.Frame) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.file == nil {
+		if r.file, r.err = file.Create(ctx, r.tmpPath); r.err != nil {
+			return 0, r.err
+		}
+		r.w = r.file.Writer(ctx)
+	}
+	n, err := r.reader.Read(ctx, out)
+	if err != nil && err != sliceio.EOF {
+		r.err = err
+		return n, err
+	}
+	args := append([]reflect.Value{reflect.ValueOf(r.w)}, out.Slice(0, n).Values()...)
+	if e := r.op.write.Call(ctx, args)[0].Interface(); e != nil {
+		if werr := e.(error); errors.IsTemporary(werr) {
+			r.err = werr
+		} else {
+			r.err = errors.E(errors.Fatal, werr)
+		}
+		return n, r.err
+	}
+	if r.stats != nil {
+		r.stats.add(out.Slice(0, n))
+	}
+	if err == sliceio.EOF {
+		r.closed = true
+		if r.err = r.file.Close(ctx); r.err != nil {
+			return n, r.err
+		}
+		r.err = sliceio.EOF
+	}
+	return n, err
+}
+
+// Commit implements sliceio.Committer by moving the attempt's
+// temporary file to its final path, so that readers never observe a
+// partially written shard. On local file systems, the file is renamed,
+// which is atomic. Object stores such as S3 do not support renames:
+// there, the file is copied, which is atomic since objects are created
+// only once they are completely written, and is then removed. The
+// shard's statistics, if any, are written once the shard is in place.
+//
+// Only shards that were read to completion are committed: if the
+// shard's reader did not reach EOF, e.g., because a downstream slice
+// stopped reading early, Commit aborts the attempt and returns an
+// error.
+func (r *writeFilesReader) Commit(ctx context.Context) error {
+	if r.file == nil {
+		// The shard was never read.
+		return nil
+	}
+	if !r.closed {
+		if err := r.Abort(ctx); err != nil {
+			return err
+		}
+		return errors.E(errors.Fatal, errors.Precondition,
+			fmt.Sprintf("writefiles: shard %s was not read to completion", r.path))
+	}
+	if err := moveFile(ctx, r.path, r.tmpPath); err != nil {
+		return err
+	}
+	if r.stats != nil {
+		if err := writeStatsFile(ctx, r.path+StatsSuffix, r.stats.Stats()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveFile moves the file at path src to path dst. Local files are
+// renamed; files in other file systems, which do not support renames,
+// are copied and then removed.
+func moveFile(ctx context.Context, dst, src string) error {
+	scheme, _, err := file.ParsePath(src)
+	if err != nil {
+		return err
+	}
+	if scheme == "" {
+		return os.Rename(src, dst)
+	}
+	if err := copyFile(ctx, dst, src); err != nil {
+		return err
+	}
+	return file.Remove(ctx, src)
+}
+
+// copyFile copies the file at path src to the file at path dst.
+func copyFile(ctx context.Context, dst, src string) (err error) {
+	in, err := file.Open(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer file.CloseAndReport(ctx, in, &err)
+	out, err := file.Create(ctx, dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out.Writer(ctx), in.Reader(ctx)); err != nil {
+		out.Discard(ctx)
+		return err
+	}
+	return out.Close(ctx)
+}
+
+// Abort implements sliceio.Committer by removing the attempt's temporary
+// file.
+func (r *writeFilesReader) Abort(ctx context.Context) error {
+	if r.file == nil {
+		return nil
+	}
+	if !r.closed {
+		// The file is still open for writing: discard it instead.
+		r.closed = true
+		r.file.Discard(ctx)
+		return nil
+	}
+	if err := file.Remove(ctx, r.tmpPath); err != nil && !errors.Is(errors.NotExist, err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/bigslice"
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/testutil"
+)
+
+func TestWriteFiles(t *testing.T) {
+	dir, cleanUp := testutil.TempDir(t, "", "")
+	defer cleanUp()
+	const (
+		N      = 1000
+		Nshard = 7
+	)
+	ints := make([]int, N)
+	for i := range ints {
+		ints[i] = i
+	}
+	slice := bigslice.Const(Nshard, ints)
+	slice = bigslice.WriteFiles(slice, filepath.Join(dir, "out"), func(w io.Writer, xs []int) error {
+		for _, x := range xs {
+			if _, err := fmt.Fprintln(w, x); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	// WriteFiles passes its input through unchanged.
+	assertEqual(t, slice, false, ints)
+
+	paths := ls1(t, dir)
+	if got, want := len(paths), Nshard; got != want {
+		t.Fatalf("got %v [%v], want %v", got, paths, want)
+	}
+	var written []int
+	for _, path := range paths {
+		if strings.Contains(path, ".attempt-") {
+			t.Errorf("leftover attempt file %s", path)
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Fields(string(b)) {
+			x, err := strconv.Atoi(line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			written = append(written, x)
+		}
+	}
+	sort.Ints(written)
+	if !reflect.DeepEqual(written, ints) {
+		t.Errorf("got %d values, want %d", len(written), len(ints))
+	}
+}
+
+func TestWriteFilesError(t *testing.T) {
+	dir, cleanUp := testutil.TempDir(t, "", "")
+	defer cleanUp()
+	slice := bigslice.Const(2, []int{1, 2, 3})
+	slice = bigslice.WriteFiles(slice, filepath.Join(dir, "out"), func(w io.Writer, xs []int) error {
+		return errors.New("write error")
+	})
+	for _, res := range runError(context.Background(), t, slice) {
+		if res.Err == nil {
+			t.Error("expected error")
+		}
+	}
+	// No files should be committed, and attempts should be cleaned up.
+	if paths := ls1(t, dir); len(paths) != 0 {
+		t.Errorf("got %v, want no files", paths)
+	}
+	// Attempts that panic are also aborted.
+	slice = bigslice.Const(2, []int{1, 2, 3})
+	slice = bigslice.WriteFiles(slice, filepath.Join(dir, "out"), func(w io.Writer, xs []int) error {
+		panic("write panic")
+	})
+	for _, res := range runError(context.Background(), t, slice) {
+		if res.Err == nil {
+			t.Error("expected error")
+		}
+	}
+	if paths := ls1(t, dir); len(paths) != 0 {
+		t.Errorf("got %v, want no files", paths)
+	}
+	expectTypeError(t, "writefiles: invalid write function type func([]int) error; must be func(w io.Writer, col1 []int) error", func() {
+		bigslice.WriteFiles(bigslice.Const(1, []int{}), "", func([]int) error { return nil })
+	})
+}
+
+func TestWriteFilesIncomplete(t *testing.T) {
+	dir, cleanUp := testutil.TempDir(t, "", "")
+	defer cleanUp()
+	ctx := context.Background()
+	slice := bigslice.WriteFiles(bigslice.Const(1, []int{}), filepath.Join(dir, "out"), func(w io.Writer, xs []int) error {
+		for _, x := range xs {
+			if _, err := fmt.Fprintln(w, x); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	r := slice.Reader(0, []sliceio.Reader{sliceio.FrameReader(frame.Slices([]int{1, 2, 3}))})
+	// Read only part of the shard.
+	if _, err := r.Read(ctx, frame.Make(slice, 1, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.(sliceio.Committer).Commit(ctx); err == nil {
+		t.Error("expected error")
+	}
+	// The incomplete shard is not committed, and the attempt is cleaned up.
+	if paths := ls1(t, dir); len(paths) != 0 {
+		t.Errorf("got %v, want no files", paths)
+	}
+}
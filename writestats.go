@@ -0,0 +1,241 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"reflect"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/slicetype"
+)
+
+// StatsSuffix is the suffix of the names of the statistics sidecar
+// files written with the WriteStats option: the statistics of the
+// shard written to "prefix-nnnn-of-mmmm" are written to
+// "prefix-nnnn-of-mmmm.stats.json".
+const StatsSuffix = ".stats.json"
+
+// A WriteOption configures the behavior of WriteFiles and WriteGCS.
+type WriteOption func(o *writeOptions)
+
+type writeOptions struct {
+	// stats determines whether column statistics are written.
+	stats bool
+}
+
+func makeWriteOptions(opts []WriteOption) writeOptions {
+	var o writeOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WriteStats is a WriteOption that computes statistics of each column
+// of each shard as its rows are written, and writes them, encoded as a
+// JSON FileStats, to a sidecar file (or object) named after the
+// shard's, with the suffix StatsSuffix. Downstream systems may use the
+// statistics to prune files, as they would the statistics in the
+// footers of formats, such as Parquet, that record them natively.
+// The sidecar file is written once the shard is committed, so that a
+// committed shard's statistics describe exactly the rows written to
+// it.
+func WriteStats() WriteOption {
+	return func(o *writeOptions) { o.stats = true }
+}
+
+// FileStats are the statistics of a shard written with the WriteStats
+// option. They are encoded in JSON as, for example:
+//
+//	{
+//		"rows": 3,
+//		"columns": [
+//			{"type": "string", "count": 3, "nulls": 0, "min": "a", "max": "c"},
+//			{"type": "*int", "count": 1, "nulls": 2, "min": 7, "max": 7},
+//			{"type": "[]int", "count": 3, "nulls": 0}
+//		]
+//	}
+type FileStats struct {
+	// Rows is the number of rows written to the file.
+	Rows int64 `json:"rows"`
+	// Columns holds the statistics of each column, in column order.
+	Columns []ColumnStats `json:"columns"`
+}
+
+// ColumnStats are the statistics of a column of a file. Minimums and
+// maximums are computed for columns of primitive types (booleans,
+// integers, floating point numbers, and strings) and pointers to
+// them; they are omitted for columns of other types, or if the column
+// has no non-null values. NaNs are counted as values, but are ignored
+// in minimums and maximums; infinite minimums and maximums are encoded
+// as the strings "-Inf" and "+Inf". (Decoders that need to preserve
+// the precision of large integers should decode minimums and maximums
+// as json.Numbers.)
+type ColumnStats struct {
+	// Type is the Go type of the column.
+	Type string `json:"type"`
+	// Count is the number of non-null values in the column.
+	Count int64 `json:"count"`
+	// Nulls is the number of null values, i.e., nil pointers, slices,
+	// maps, or interfaces, in the column.
+	Nulls int64 `json:"nulls"`
+	// Min is the minimum value in the column.
+	Min interface{} `json:"min,omitempty"`
+	// Max is the maximum value in the column.
+	Max interface{} `json:"max,omitempty"`
+}
+
+// statsAccumulator accumulates the statistics of a file as its
+// frames are written.
+type statsAccumulator struct {
+	rows int64
+	cols []columnStatsAccumulator
+}
+
+type columnStatsAccumulator struct {
+	typ reflect.Type
+	// nilable tells whether the column's values may be nil; ptr
+	// whether its values are pointers to the values that are compared.
+	nilable, ptr bool
+	// less orders the column's (dereferenced) values, or is nil if
+	// they are not ordered.
+	less         func(x, y reflect.Value) bool
+	count, nulls int64
+	min, max     reflect.Value
+}
+
+func newStatsAccumulator(typ slicetype.Type) *statsAccumulator {
+	a := &statsAccumulator{cols: make([]columnStatsAccumulator, typ.NumOut())}
+	for i := range a.cols {
+		col := &a.cols[i]
+		col.typ = typ.Out(i)
+		elem := col.typ
+		switch col.typ.Kind() {
+		case reflect.Ptr:
+			col.ptr = true
+			elem = col.typ.Elem()
+			fallthrough
+		case reflect.Slice, reflect.Map, reflect.Interface, reflect.Chan, reflect.Func:
+			col.nilable = true
+		}
+		col.less = statsLessFunc(elem)
+	}
+	return a
+}
+
+// statsLessFunc returns a function that orders values of the provided
+// type, or nil if the type is not primitive.
+func statsLessFunc(typ reflect.Type) func(x, y reflect.Value) bool {
+	if typ.Kind() == reflect.Bool {
+		return func(x, y reflect.Value) bool { return !x.Bool() && y.Bool() }
+	}
+	less, err := lessFunc(typ)
+	if err != nil {
+		return nil
+	}
+	return less
+}
+
+// add accumulates the statistics of the rows of the provided frame.
+func (a *statsAccumulator) add(f frame.Frame) {
+	a.rows += int64(f.Len())
+	for i := range a.cols {
+		col := &a.cols[i]
+		vals := f.Value(i)
+		for j := 0; j < vals.Len(); j++ {
+			v := vals.Index(j)
+			if col.nilable && v.IsNil() {
+				col.nulls++
+				continue
+			}
+			col.count++
+			if col.less == nil {
+				continue
+			}
+			if col.ptr {
+				v = v.Elem()
+			}
+			if (v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64) && math.IsNaN(v.Float()) {
+				continue
+			}
+			if !col.min.IsValid() || col.less(v, col.min) {
+				col.min = v
+			}
+			if !col.max.IsValid() || col.less(col.max, v) {
+				col.max = v
+			}
+		}
+	}
+}
+
+// Stats returns the statistics accumulated so far.
+func (a *statsAccumulator) Stats() FileStats {
+	stats := FileStats{Rows: a.rows, Columns: make([]ColumnStats, len(a.cols))}
+	for i, col := range a.cols {
+		stats.Columns[i] = ColumnStats{
+			Type:  col.typ.String(),
+			Count: col.count,
+			Nulls: col.nulls,
+		}
+		if col.min.IsValid() {
+			stats.Columns[i].Min = statsValue(col.min)
+			stats.Columns[i].Max = statsValue(col.max)
+		}
+	}
+	return stats
+}
+
+// statsValue returns the JSON-encodable value of the provided
+// primitive value. Values of named types are converted to their
+// underlying types, so that they are not encoded by custom
+// marshalers.
+func statsValue(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint()
+	case reflect.Float32, reflect.Float64:
+		switch f := v.Float(); {
+		case math.IsInf(f, 1):
+			return "+Inf"
+		case math.IsInf(f, -1):
+			return "-Inf"
+		default:
+			return f
+		}
+	case reflect.String:
+		return v.String()
+	}
+	panic("bigslice: unexpected statistics type " + v.Type().String())
+}
+
+// encodeStats encodes the provided statistics to w as JSON.
+func encodeStats(w io.Writer, stats FileStats) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(stats)
+}
+
+// writeStatsFile writes the provided statistics to the file at the
+// provided path.
+func writeStatsFile(ctx context.Context, path string, stats FileStats) error {
+	f, err := file.Create(ctx, path)
+	if err != nil {
+		return err
+	}
+	if err := encodeStats(f.Writer(ctx), stats); err != nil {
+		f.Discard(ctx)
+		return err
+	}
+	return f.Close(ctx)
+}
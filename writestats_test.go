@@ -0,0 +1,63 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/grailbio/bigslice"
+	"github.com/grailbio/testutil"
+)
+
+func TestWriteStats(t *testing.T) {
+	dir, cleanUp := testutil.TempDir(t, "", "")
+	defer cleanUp()
+	seven := 7
+	var (
+		strs   = []string{"b", "c", "a"}
+		ptrs   = []*int{nil, &seven, nil}
+		floats = []float64{math.NaN(), 1.5, math.Inf(-1)}
+		ints   = [][]int{{1}, nil, {2, 3}}
+	)
+	slice := bigslice.Const(1, strs, ptrs, floats, ints)
+	slice = bigslice.WriteFiles(slice, filepath.Join(dir, "out"),
+		func(w io.Writer, _ []string, _ []*int, _ []float64, _ [][]int) error { return nil },
+		bigslice.WriteStats())
+	// NaNs are not equal to themselves, so only the first column is
+	// compared.
+	slice = bigslice.Map(slice, func(s string, _ *int, _ float64, _ []int) string { return s })
+	assertEqual(t, slice, true, []string{"a", "b", "c"})
+
+	paths := ls1(t, dir)
+	if got, want := paths, []string{"out-0000-of-0001", "out-0000-of-0001" + bigslice.StatsSuffix}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, paths[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats bigslice.FileStats
+	if err := json.Unmarshal(b, &stats); err != nil {
+		t.Fatal(err)
+	}
+	want := bigslice.FileStats{
+		Rows: 3,
+		Columns: []bigslice.ColumnStats{
+			{Type: "string", Count: 3, Min: "a", Max: "c"},
+			{Type: "*int", Count: 1, Nulls: 2, Min: 7.0, Max: 7.0},
+			{Type: "float64", Count: 3, Min: "-Inf", Max: 1.5},
+			{Type: "[]int", Count: 2, Nulls: 1},
+		},
+	}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("got %+v, want %+v", stats, want)
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bigslice/frame"
+	"github.com/grailbio/bigslice/slicefunc"
+	"github.com/grailbio/bigslice/sliceio"
+	"github.com/grailbio/bigslice/slicetype"
+	"github.com/grailbio/bigslice/typecheck"
+)
+
+type zipSlice struct {
+	name Name
+	a, b Slice
+	out  slicetype.Type
+}
+
+// Zip returns a slice that combines the rows of slices a and b by
+// position: the ith row of each shard of the returned slice comprises
+// the columns of the ith row of the same shard of a, followed by those
+// of b. The returned slice's prefix is that of a. Schematically:
+//
+//	Zip(Slice<t1, ..., tn>, Slice<u1, ..., um>) Slice<t1, ..., tn, u1, ..., um>
+//
+// The slices must have the same number of shards, and corresponding
+// shards must have the same number of rows, in a deterministic order,
+// e.g., because both slices are derived by pipelined operations from
+// the same source. Zip is not pipelined with either slice: as with
+// other operations of multiple dependencies, a and b are computed by
+// tasks of their own, and each shard of the zip reads the outputs of
+// the corresponding shards of a and b, in lockstep. Shards whose row
+// counts differ fail the computation.
+func Zip(a, b Slice) Slice {
+	if a.NumShard() != b.NumShard() {
+		typecheck.Panicf(1, "zip: slices have different numbers of shards %d and %d", a.NumShard(), b.NumShard())
+	}
+	out := slicetype.New(append(slicetype.Columns(a), slicetype.Columns(b)...)...)
+	return &zipSlice{MakeName("zip"), a, b, out}
+}
+
+func (z *zipSlice) Name() Name             { return z.name }
+func (z *zipSlice) NumOut() int            { return z.out.NumOut() }
+func (z *zipSlice) Out(c int) reflect.Type { return z.out.Out(c) }
+func (z *zipSlice) Prefix() int            { return z.a.Prefix() }
+func (z *zipSlice) NumShard() int          { return z.a.NumShard() }
+func (*zipSlice) ShardType() ShardType     { return HashShard }
+func (*zipSlice) NumDep() int              { return 2 }
+func (*zipSlice) Combiner() slicefunc.Func { return slicefunc.Nil }
+
+func (z *zipSlice) Dep(i int) Dep {
+	switch i {
+	case 0:
+		return Dep{Slice: z.a}
+	case 1:
+		return Dep{Slice: z.b}
+	}
+	panic(fmt.Sprintf("invalid dependency %d", i))
+}
+
+func (z *zipSlice) Reader(shard int, deps []sliceio.Reader) sliceio.Reader {
+	return &zipReader{op: z, shard: shard, a: deps[0], b: deps[1]}
+}
+
+type zipReader struct {
+	op    *zipSlice
+	shard int
+	a, b  sliceio.Reader
+	ina   frame.Frame
+	inb   frame.Frame
+	nrow  int
+	err   error
+}
+
+func (z *zipReader) Read(ctx context.Context, out frame.Frame) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	if !slicetype.Assignable(out, z.op) {
+		return 0, errTypeError
+	}
+	if z.ina.IsZero() {
+		z.ina = frame.Make(z.op.a, out.Len(), out.Len())
+		z.inb = frame.Make(z.op.b, out.Len(), out.Len())
+	} else {
+		z.ina = z.ina.Ensure(out.Len())
+		z.inb = z.inb.Ensure(out.Len())
+	}
+	n, err := z.a.Read(ctx, z.ina.Slice(0, out.Len()))
+	if err != nil && err != sliceio.EOF {
+		z.err = err
+		return 0, err
+	}
+	// Read exactly as many rows from b as were read from a.
+	var m int
+	for m < n {
+		k, errb := z.b.Read(ctx, z.inb.Slice(m, n))
+		m += k
+		if errb == sliceio.EOF {
+			z.err = z.mismatch(z.nrow+m, "b")
+			return 0, z.err
+		}
+		if errb != nil {
+			z.err = errb
+			return 0, errb
+		}
+	}
+	z.nrow += n
+	if err == sliceio.EOF {
+		// Make sure that b is also exhausted.
+		for {
+			k, errb := z.b.Read(ctx, z.inb.Slice(0, 1))
+			if k > 0 {
+				z.err = z.mismatch(z.nrow, "a")
+				return 0, z.err
+			}
+			if errb == sliceio.EOF {
+				break
+			}
+			if errb != nil {
+				z.err = errb
+				return 0, errb
+			}
+		}
+	}
+	var (
+		na  = z.op.a.NumOut()
+		ina = z.ina.Slice(0, n)
+		inb = z.inb.Slice(0, n)
+	)
+	for col := 0; col < na; col++ {
+		reflect.Copy(out.Value(col), ina.Value(col))
+	}
+	for col := 0; col < z.op.b.NumOut(); col++ {
+		reflect.Copy(out.Value(na+col), inb.Value(col))
+	}
+	z.err = err
+	return n, err
+}
+
+// mismatch returns the error reported when the named slice (a or b)
+// ends after nrow rows, before the other.
+func (z *zipReader) mismatch(nrow int, slice string) error {
+	return errors.E(errors.Fatal, errors.Invalid,
+		fmt.Sprintf("%s: shard %d: slice %s has %d rows, fewer than the other slice; zipped slices must have equal row counts",
+			z.op.name, z.shard, slice, nrow))
+}
@@ -0,0 +1,66 @@
+// Copyright 2020 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bigslice_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/bigslice"
+)
+
+func TestZip(t *testing.T) {
+	const N = 1000
+	var (
+		keys = make([]string, N)
+		vals = make([]int, N)
+	)
+	for i := range keys {
+		keys[i] = fmt.Sprint(i)
+		vals[i] = i
+	}
+	source := bigslice.Const(7, keys, vals)
+	a := bigslice.Map(source, func(key string, val int) string { return key })
+	b := bigslice.Map(source, func(key string, val int) (int, string) { return val * 2, key + "!" })
+	zipped := bigslice.Zip(a, b)
+	if got, want := zipped.Name().Op, "zip"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := zipped.NumShard(), 7; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	doubled := make([]int, N)
+	bangs := make([]string, N)
+	for i := range doubled {
+		doubled[i] = 2 * i
+		bangs[i] = keys[i] + "!"
+	}
+	assertEqual(t, zipped, true, keys, doubled, bangs)
+}
+
+func TestZipError(t *testing.T) {
+	expectTypeError(t, "zip: slices have different numbers of shards 1 and 2", func() {
+		bigslice.Zip(bigslice.Const(1, []int{1, 2}), bigslice.Const(2, []int{1, 2}))
+	})
+	var (
+		long  = bigslice.Const(2, []int{1, 2, 3, 4, 5, 6})
+		short = bigslice.Filter(long, func(x int) bool { return x != 5 })
+	)
+	for _, c := range []struct {
+		slice bigslice.Slice
+		msg   string
+	}{
+		{bigslice.Zip(long, short), "slice b has"},
+		{bigslice.Zip(short, long), "slice a has"},
+	} {
+		for name, res := range runError(context.Background(), t, c.slice) {
+			if err := res.Err; err == nil || !strings.Contains(err.Error(), c.msg) {
+				t.Errorf("executor %s: got %v, want %q", name, err, c.msg)
+			}
+		}
+	}
+}